@@ -3,8 +3,11 @@ package main
 import (
 	"log"
 	"net/http"
+	"os"
 
 	agi "imuslab.com/arozos/mod/agi"
+	"imuslab.com/arozos/mod/agi/agitest"
+	prout "imuslab.com/arozos/mod/prouter"
 )
 
 var (
@@ -17,13 +20,21 @@ func AGIInit() {
 		BuildVersion:         build_version,
 		InternalVersion:      internal_version,
 		LoadedModule:         moduleHandler.GetModuleNameList(),
-		ReservedTables:       []string{"auth", "permisson", "desktop"},
+		ReservedTables:       agi.DefaultReservedTables,
 		ModuleRegisterParser: moduleHandler.RegisterModuleFromJSON,
 		PackageManager:       packageManager,
 		UserHandler:          userHandler,
 		StartupRoot:          "./web",
 		ActivateScope:        []string{"./web", "./subservice"},
 		FileSystemRender:     thumbRenderHandler,
+		DefaultLimit: agi.ExecutionLimit{
+			Timeout:         int64(*agi_timeout),
+			MaxHTTPCalls:    *agi_max_http,
+			MaxBytesWritten: int64(*agi_max_write) << 20,
+		},
+		JobRetention:   int64(*agi_job_retention),
+		EventBus:       eventBus,
+		DefaultKVQuota: int64(*agi_kv_quota) << 20,
 	})
 	if err != nil {
 		log.Println("AGI Gateway Initialization Failed")
@@ -69,5 +80,58 @@ func AGIInit() {
 
 	})
 
+	//Register the admin endpoint for setting execution limits of modules
+	adminRouter := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "System Setting",
+		AdminOnly:   true,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			sendErrorResponse(w, "Permission Denied")
+		},
+	})
+	adminRouter.HandleFunc("/system/ajgi/limits", gw.HandleExecutionLimits)
+	adminRouter.HandleFunc("/system/ajgi/events", gw.HandleListEventHandlers)
+	adminRouter.HandleFunc("/system/ajgi/data", gw.HandleModuleData)
+
+	//Register the endpoints for background jobs started by execd
+	router := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "",
+		AdminOnly:   false,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			sendErrorResponse(w, "Permission Denied")
+		},
+	})
+	router.HandleFunc("/system/ajgi/jobs/list", gw.HandleListJobs)
+	router.HandleFunc("/system/ajgi/jobs/status", gw.HandleJobStatus)
+	router.HandleFunc("/system/ajgi/jobs/cancel", gw.HandleCancelJob)
+
+	//Register the endpoints for managing and calling webhooks. Webhook calls are public
+	router.HandleFunc("/system/ajgi/webhooks", gw.HandleWebhooks)
+	http.HandleFunc("/api/ajgi/webhook/", gw.HandleWebhookCall)
+
+	//Remove expired job records nightly
+	nightlyManager.RegisterNightlyTask(gw.PruneJobs)
+
 	AGIGateway = gw
 }
+
+//Run the AGI module test suite headlessly, used by CI of module repositories. Return the exit code
+func runAGITestSuite(suiteFile string) int {
+	suite, err := agitest.LoadTestSuite(suiteFile)
+	if err != nil {
+		log.Println("[AGI] Unable to load test suite: " + err.Error())
+		return 2
+	}
+
+	failed, err := suite.Run(os.Stdout)
+	if err != nil {
+		log.Println("[AGI] Unable to run test suite: " + err.Error())
+		return 2
+	}
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
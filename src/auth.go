@@ -37,6 +37,9 @@ func AuthInit() {
 		http.Redirect(w, r, common.ConstructRelativePathFromRequestURL(r.RequestURI, "login.system")+"?redirect="+r.URL.Path, 307)
 	})
 
+	//Publish login and logout events
+	authAgent.EventBus = eventBus
+
 	if *allow_autologin == true {
 		authAgent.AllowAutoLogin = true
 	} else {
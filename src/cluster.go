@@ -4,9 +4,13 @@ import (
 	"log"
 	"net/http"
 
+	"imuslab.com/arozos/mod/cluster"
 	"imuslab.com/arozos/mod/cluster/aclient"
+	"imuslab.com/arozos/mod/cluster/aserver"
+	fs "imuslab.com/arozos/mod/filesystem"
 	"imuslab.com/arozos/mod/network/neighbour"
 	prout "imuslab.com/arozos/mod/prouter"
+	user "imuslab.com/arozos/mod/user"
 )
 
 /*
@@ -20,6 +24,8 @@ import (
 
 var (
 	NeighbourDiscoverer *neighbour.Discoverer
+	ClusterServer       *aserver.Aserver
+	ClusterClient       *aclient.Aclient
 )
 
 func ClusterInit() {
@@ -57,18 +63,186 @@ func ClusterInit() {
 
 		router.HandleFunc("/system/cluster/scan", NeighbourDiscoverer.HandleScanningRequest)
 
-		/*
-			Start and Cluster Server and Client
-		*/
+	} else {
+		log.Println("MDNS not enabled or startup failed. Skipping Cluster Scanner initiation.")
+	}
+
+	/*
+		Start and Cluster Server and Client
+	*/
+
+	if *allow_clustering {
+		ClusterServicesInit()
+	}
+
+}
+
+func ClusterServicesInit() {
+	node, err := cluster.NewNode(cluster.NodeOption{
+		UUID:     deviceUUID,
+		Name:     *host_name,
+		Port:     *cluster_port,
+		Version:  internal_version,
+		CertPath: "./system/cluster/node.crt",
+		KeyPath:  "./system/cluster/node.key",
+	})
+	if err != nil {
+		log.Println("[Cluster] Unable to load node certificate: " + err.Error())
+		return
+	}
+
+	peers, err := cluster.NewPeerStore(sysdb)
+	if err != nil {
+		log.Println("[Cluster] Unable to load paired nodes: " + err.Error())
+		return
+	}
+	pairingCodes := &cluster.PairingCodeManager{}
+
+	ClusterServer = aserver.NewServer(aserver.AserverOption{
+		Node:         node,
+		Peers:        peers,
+		PairingCodes: pairingCodes,
+		UserHandler:  userHandler,
+	})
+	err = ClusterServer.Start()
+	if err != nil {
+		log.Println("[Cluster] Unable to start cluster server: " + err.Error())
+		ClusterServer = nil
+		return
+	}
+
+	ClusterClient = aclient.NewClient(aclient.AclientOption{
+		MDNS:         MDNS,
+		Node:         node,
+		Peers:        peers,
+		PairingCodes: pairingCodes,
+		UserHandler:  userHandler,
+	})
+
+	//Public node information for pairing
+	http.HandleFunc("/system/cluster/info", ClusterServer.HandleNodeInfo)
+
+	//Register the settings
+	registerSetting(settingModule{
+		Name:         "Cluster Nodes",
+		Desc:         "Pair and manage the Cluster Nodes",
+		IconPath:     "SystemAO/cluster/img/small_icon.png",
+		Group:        "Cluster",
+		StartDir:     "SystemAO/cluster/nodes.html",
+		RequireAdmin: true,
+	})
+
+	adminRouter := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "System Setting",
+		AdminOnly:   true,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			errorHandlePermissionDenied(w, r)
+		},
+	})
+
+	adminRouter.HandleFunc("/system/cluster/status", ClusterClient.HandleClusterStatus)
+	adminRouter.HandleFunc("/system/cluster/pair", ClusterClient.HandlePair)
+	adminRouter.HandleFunc("/system/cluster/unpair", ClusterClient.HandleUnpair)
+	adminRouter.HandleFunc("/system/cluster/pairingCode", ClusterClient.HandlePairingCode)
+	adminRouter.HandleFunc("/system/cluster/trust", ClusterClient.HandleTrustCertificate)
+	adminRouter.HandleFunc("/system/cluster/usermap", ClusterClient.HandleUserMapping)
+	adminRouter.HandleFunc("/system/cluster/discover", ClusterClient.HandleDiscover)
+
+	router := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "File Manager",
+		AdminOnly:   false,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			sendErrorResponse(w, "Permission Denied")
+		},
+	})
+
+	router.HandleFunc("/system/cluster/nodes", ClusterClient.HandleListNodes)
+	router.HandleFunc("/system/cluster/transfer", ClusterClient.HandleTransfer)
+}
+
+/*
+	Remote virtual roots (node-{uuid}:/) in file system APIs
+*/
+
+//Check if the given path is on a paired node
+func cluster_isRemotePath(vpath string) bool {
+	return ClusterClient != nil && cluster.IsRemotePath(vpath)
+}
 
-		if *allow_clustering {
-			aclient.NewClient(aclient.AclientOption{
-				MDNS: MDNS,
-			})
+//Check if any of the given paths is on a paired node
+func cluster_isRemoteFileOpr(sourceFiles []string, dest string) bool {
+	if cluster_isRemotePath(dest) {
+		return true
+	}
+	for _, src := range sourceFiles {
+		if cluster_isRemotePath(src) {
+			return true
 		}
+	}
+	return false
+}
 
-	} else {
-		log.Println("MDNS not enabled or startup failed. Skipping Cluster Scanner initiation.")
+//List the remote directory in the file explorer format
+func cluster_listRemoteDir(userinfo *user.User, vpath string) ([]fs.FileData, error) {
+	files, err := ClusterClient.ListDir(userinfo.Username, vpath)
+	if err != nil {
+		return nil, err
 	}
 
+	results := []fs.FileData{}
+	for _, file := range files {
+		results = append(results, fs.FileData{
+			Filename:    file.Name,
+			Filepath:    file.Vpath,
+			IsDir:       file.IsDir,
+			Filesize:    file.Size,
+			Displaysize: fs.GetFileDisplaySize(file.Size, 2),
+			ModTime:     file.ModTime,
+			Tags:        []string{},
+		})
+	}
+	return results, nil
+}
+
+//Handle copy, move and delete operations from the file explorer on remote paths
+func cluster_handleRemoteFileOpr(w http.ResponseWriter, userinfo *user.User, operation string, sourceFiles []string, dest string) {
+	switch operation {
+	case "copy", "move":
+		for _, src := range sourceFiles {
+			_, err := ClusterClient.Transfer(userinfo, src, dest, operation == "move")
+			if err != nil {
+				sendErrorResponse(w, err.Error())
+				return
+			}
+		}
+	case "delete":
+		for _, src := range sourceFiles {
+			if !cluster.IsRemotePath(src) {
+				sendErrorResponse(w, "Local and remote files cannot be deleted together")
+				return
+			}
+			err := ClusterClient.Remove(userinfo.Username, src)
+			if err != nil {
+				sendErrorResponse(w, err.Error())
+				return
+			}
+		}
+	default:
+		sendErrorResponse(w, "This operation is not supported on cluster nodes")
+		return
+	}
+	sendOK(w)
+}
+
+//Serve the file on paired node for the media server
+func cluster_serveRemoteMedia(w http.ResponseWriter, r *http.Request, vpath string) {
+	userinfo, err := userHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+	dw, _ := mv(r, "download", false)
+	ClusterClient.ServeRemoteFile(w, r, userinfo.Username, vpath, dw == "true")
 }
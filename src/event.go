@@ -0,0 +1,35 @@
+package main
+
+import (
+	"imuslab.com/arozos/mod/disk/hybridBackup"
+	"imuslab.com/arozos/mod/event"
+)
+
+/*
+	System Event Bus
+
+	Core subsystems publish their events (user login, file upload etc)
+	to this event bus. See mod/event for a list of event types
+*/
+
+var eventBus *event.EventBus
+
+func EventBusInit() {
+	eventBus = event.NewEventBus()
+
+	//Publish the result of backup cycles
+	hybridBackup.SetCycleEventHandler(func(task *hybridBackup.BackupTask, err error) {
+		payload := map[string]interface{}{
+			"parent": task.ParentUID,
+			"disk":   task.DiskUID,
+			"mode":   task.Mode,
+		}
+
+		if err != nil {
+			payload["error"] = err.Error()
+			eventBus.Publish(event.BackupFailed, "", payload)
+			return
+		}
+		eventBus.Publish(event.BackupFinished, "", payload)
+	})
+}
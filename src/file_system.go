@@ -25,12 +25,14 @@ import (
 	uuid "github.com/satori/go.uuid"
 
 	"imuslab.com/arozos/mod/disk/hybridBackup"
+	"imuslab.com/arozos/mod/event"
 	fs "imuslab.com/arozos/mod/filesystem"
 	fsp "imuslab.com/arozos/mod/filesystem/fspermission"
 	hidden "imuslab.com/arozos/mod/filesystem/hidden"
 	metadata "imuslab.com/arozos/mod/filesystem/metadata"
 	"imuslab.com/arozos/mod/filesystem/shortcut"
 	module "imuslab.com/arozos/mod/modules"
+	"imuslab.com/arozos/mod/network/bandwidth"
 	prout "imuslab.com/arozos/mod/prouter"
 	"imuslab.com/arozos/mod/share"
 	storage "imuslab.com/arozos/mod/storage"
@@ -65,8 +67,8 @@ func FileSystemInit() {
 	})
 
 	//Upload related functions
-	router.HandleFunc("/system/file_system/upload", system_fs_handleUpload)
-	router.HandleFunc("/system/file_system/lowmemUpload", system_fs_handleLowMemoryUpload)
+	router.HandleFunc("/system/file_system/upload", BandwidthController.HandlerFunc(bandwidth.ProtocolWeb, system_fs_handleUpload))
+	router.HandleFunc("/system/file_system/lowmemUpload", BandwidthController.HandlerFunc(bandwidth.ProtocolWeb, system_fs_handleLowMemoryUpload))
 
 	//Other file operations
 	router.HandleFunc("/system/file_system/validateFileOpr", system_fs_validateFileOpr)
@@ -93,6 +95,7 @@ func FileSystemInit() {
 	router.HandleFunc("/system/file_system/handleFolderCache", system_fs_handleFolderCache)
 	router.HandleFunc("/system/file_system/handleCacheRender", system_fs_handleCacheRender)
 	router.HandleFunc("/system/file_system/loadThumbnail", system_fs_handleThumbnailLoad)
+	router.HandleFunc("/system/file_system/preview", system_fs_handleFilePreview)
 
 	//Directory specific config
 	router.HandleFunc("/system/file_system/sortMode", system_fs_handleFolderSortModePreference)
@@ -175,6 +178,7 @@ func FileSystemInit() {
 		UserHandler: userHandler,
 		HostName:    *host_name,
 		TmpFolder:   *tmp_directory,
+		EventBus:    eventBus,
 	})
 
 	//Share related functions
@@ -184,7 +188,7 @@ func FileSystemInit() {
 	router.HandleFunc("/system/file_system/share/checkShared", shareManager.HandleShareCheck)
 
 	//Handle the main share function
-	http.HandleFunc("/share", shareManager.HandleShareAccess)
+	http.HandleFunc("/share", BandwidthController.HandlerFunc(bandwidth.ProtocolShare, shareManager.HandleShareAccess))
 
 	/*
 		Nighly Tasks
@@ -516,6 +520,11 @@ func system_fs_handleLowMemoryUpload(w http.ResponseWriter, r *http.Request) {
 	//Return complete signal
 	c.WriteMessage(1, []byte("OK"))
 
+	eventBus.Publish(event.FileUploaded, userinfo.Username, map[string]interface{}{
+		"path": filepath.ToSlash(filepath.Join(uploadTarget, filename)),
+		"size": fi.Size(),
+	})
+
 	//Stop the timeout listner
 	done <- true
 
@@ -688,6 +697,11 @@ func system_fs_handleUpload(w http.ResponseWriter, r *http.Request) {
 	//Fnish upload. Fix the tmp filename
 	log.Println(userinfo.Username + " uploaded a file: " + handler.Filename)
 
+	eventBus.Publish(event.FileUploaded, userinfo.Username, map[string]interface{}{
+		"path": filepath.ToSlash(filepath.Join(uploadTarget, storeFilename)),
+		"size": handler.Size,
+	})
+
 	//Do upload finishing stuff
 	//Perform a GC
 	runtime.GC()
@@ -909,7 +923,11 @@ func system_fs_restoreFile(w http.ResponseWriter, r *http.Request) {
 	//OK to proceed.
 	targetPath := filepath.ToSlash(filepath.Dir(filepath.Dir(realpath))) + "/" + strings.TrimSuffix(filepath.Base(realpath), filepath.Ext(filepath.Base(realpath)))
 	//log.Println(targetPath);
-	os.Rename(realpath, targetPath)
+	err = os.Rename(realpath, targetPath)
+	if err == nil {
+		//Restore the file tags of the trashed file
+		userinfo.MoveFileTags(realpath, targetPath)
+	}
 
 	//Check if the parent dir has no more fileds. If yes, remove it
 	filescounter, _ := filepath.Glob(filepath.Dir(realpath) + "/*")
@@ -1181,6 +1199,13 @@ func system_fs_handleWebSocketOpr(w http.ResponseWriter, r *http.Request) {
 	vdestFile = escapedVdest
 	rdestFile, _ := userinfo.VirtualPathToRealPath(vdestFile)
 
+	//Files on paired cluster nodes are handled by the legacy endpoint
+	if cluster_isRemoteFileOpr(sourceFiles, vdestFile) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 - Cluster file operations are not supported on WebSocket endpoint"))
+		return
+	}
+
 	//Permission checking
 	if !userinfo.CanWrite(vdestFile) {
 		log.Println("Access denied for " + userinfo.Username + " try to access " + vdestFile)
@@ -1349,6 +1374,9 @@ func system_fs_handleWebSocketOpr(w http.ResponseWriter, r *http.Request) {
 					return
 				}
 
+				//Carry the file tags to the new location
+				userinfo.MoveFileTags(rsrcFile, filepath.ToSlash(filepath.Clean(rdestFile))+"/"+filepath.Base(rsrcFile))
+
 				//Remove the cache for the original file
 				metadata.RemoveCache(rsrcFile)
 
@@ -1381,6 +1409,9 @@ func system_fs_handleWebSocketOpr(w http.ResponseWriter, r *http.Request) {
 					c.Close()
 					return
 				}
+
+				//Copy the file tags to the new file
+				userinfo.CopyFileTags(rsrcFile, filepath.ToSlash(filepath.Clean(rdestFile))+"/"+filepath.Base(rsrcFile))
 			}
 		}
 	}
@@ -1446,6 +1477,12 @@ func system_fs_handleOpr(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	//Copy, move and delete on paired cluster nodes
+	if cluster_isRemoteFileOpr(sourceFiles, vdestFile) {
+		cluster_handleRemoteFileOpr(w, userinfo, operation, sourceFiles, vdestFile)
+		return
+	}
+
 	if operation == "zip" {
 		//Zip operation. Parse the real filepath list
 		rsrcFiles := []string{}
@@ -1542,6 +1579,14 @@ func system_fs_handleOpr(w http.ResponseWriter, r *http.Request) {
 					return
 				}
 
+				//Carry the file tags to the renamed file
+				userinfo.MoveFileTags(rsrcFile, targetNewName)
+
+				eventBus.Publish(event.FileRenamed, userinfo.Username, map[string]interface{}{
+					"path":    vsrcFile,
+					"newPath": filepath.ToSlash(filepath.Join(filepath.Dir(vsrcFile), thisFilename)),
+				})
+
 				//Remove the cache for the original file
 				metadata.RemoveCache(rsrcFile)
 
@@ -1621,6 +1666,9 @@ func system_fs_handleOpr(w http.ResponseWriter, r *http.Request) {
 				//Set user to own the new file
 				userinfo.SetOwnerOfFile(filepath.ToSlash(filepath.Clean(rdestFile)) + "/" + filepath.Base(rsrcFile))
 
+				//Carry the file tags to the new location
+				userinfo.MoveFileTags(rsrcFile, filepath.ToSlash(filepath.Clean(rdestFile))+"/"+filepath.Base(rsrcFile))
+
 				//Remove cache for the original file
 				metadata.RemoveCache(rsrcFile)
 			} else if operation == "copy" {
@@ -1663,6 +1711,9 @@ func system_fs_handleOpr(w http.ResponseWriter, r *http.Request) {
 				//Set user to own this file
 				userinfo.SetOwnerOfFile(filepath.ToSlash(filepath.Clean(rdestFile)) + "/" + filepath.Base(rsrcFile))
 
+				//Copy the file tags to the new file
+				userinfo.CopyFileTags(rsrcFile, filepath.ToSlash(filepath.Clean(rdestFile))+"/"+filepath.Base(rsrcFile))
+
 			} else if operation == "delete" {
 				//Delete the file permanently
 				if !fileExists(rsrcFile) {
@@ -1687,6 +1738,9 @@ func system_fs_handleOpr(w http.ResponseWriter, r *http.Request) {
 				//Check if this file has any cached files. If yes, remove it
 				metadata.RemoveCache(rsrcFile)
 
+				//Remove the file tags of this file
+				userinfo.RemoveFileTags(rsrcFile)
+
 				//Clear the cache folder if there is no files inside
 				fc, _ := filepath.Glob(filepath.ToSlash(filepath.Dir(rsrcFile)) + "/.cache/*")
 				if len(fc) == 0 {
@@ -1695,6 +1749,10 @@ func system_fs_handleOpr(w http.ResponseWriter, r *http.Request) {
 
 				os.RemoveAll(rsrcFile)
 
+				eventBus.Publish(event.FileDeleted, userinfo.Username, map[string]interface{}{
+					"path": vsrcFile,
+				})
+
 			} else if operation == "recycle" {
 				//Put it into a subfolder named trash and allow it to to be removed later
 				if !fileExists(rsrcFile) {
@@ -1733,7 +1791,17 @@ func system_fs_handleOpr(w http.ResponseWriter, r *http.Request) {
 				trashDir := filepath.ToSlash(filepath.Dir(rsrcFile)) + "/.trash/"
 				os.MkdirAll(trashDir, 0755)
 				hidden.HideFile(trashDir)
-				os.Rename(rsrcFile, trashDir+filepath.Base(rsrcFile)+"."+Int64ToString(GetUnixTime()))
+				trashedFilename := trashDir + filepath.Base(rsrcFile) + "." + Int64ToString(GetUnixTime())
+				err = os.Rename(rsrcFile, trashedFilename)
+				if err == nil {
+					//Keep the file tags with the trashed file so it can be restored later
+					userinfo.MoveFileTags(rsrcFile, trashedFilename)
+
+					eventBus.Publish(event.FileDeleted, userinfo.Username, map[string]interface{}{
+						"path":     vsrcFile,
+						"recycled": true,
+					})
+				}
 			} else if operation == "unzip" {
 				//Unzip the file to destination
 
@@ -1939,6 +2007,17 @@ func system_fs_listRoot(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
+		//Append the storage of paired cluster nodes
+		if ClusterClient != nil {
+			for _, remoteRoot := range ClusterClient.ListRemoteRoots() {
+				roots = append(roots, &rootObject{
+					rootID:   remoteRoot.UUID,
+					RootName: remoteRoot.RootName,
+					RootPath: remoteRoot.RootPath,
+				})
+			}
+		}
+
 		jsonString, _ := json.Marshal(roots)
 		sendJSONResponse(w, string(jsonString))
 	}
@@ -2042,6 +2121,8 @@ func system_fs_getFileProperties(w http.ResponseWriter, r *http.Request) {
 		LastModUnix    int64
 		IsDirectory    bool
 		Owner          string
+		Tags           []string
+		Favourite      bool
 	}
 
 	mime := "text/directory"
@@ -2075,6 +2156,9 @@ func system_fs_getFileProperties(w http.ResponseWriter, r *http.Request) {
 		owner = "Unknown"
 	}
 
+	//Get the file tags of this user
+	tagRecord, _ := userinfo.GetFileTags(rpath)
+
 	result := fileProperties{
 		VirtualPath:    vpath,
 		StoragePath:    filepath.Clean(rpath),
@@ -2089,6 +2173,8 @@ func system_fs_getFileProperties(w http.ResponseWriter, r *http.Request) {
 		LastModUnix:    fileStat.ModTime().Unix(),
 		IsDirectory:    fileStat.IsDir(),
 		Owner:          owner,
+		Tags:           tagRecord.Tags,
+		Favourite:      tagRecord.Favourite,
 	}
 
 	jsonString, _ := json.Marshal(result)
@@ -2123,6 +2209,22 @@ func system_fs_handleList(w http.ResponseWriter, r *http.Request) {
 		sendErrorResponse(w, "Invalid dir given.")
 		return
 	}
+	if sortMode == "" {
+		sortMode = "default"
+	}
+
+	//Directory on paired cluster node
+	if cluster_isRemotePath(currentDir) {
+		parsedFilelist, err := cluster_listRemoteDir(userinfo, currentDir)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+		system_fs_sortFileList(parsedFilelist, sortMode)
+		jsonString, _ := json.Marshal(parsedFilelist)
+		sendJSONResponse(w, string(jsonString))
+		return
+	}
 
 	//Pad a slash at the end of currentDir if not exists
 	if currentDir[len(currentDir)-1:] != "/" {
@@ -2152,9 +2254,6 @@ func system_fs_handleList(w http.ResponseWriter, r *http.Request) {
 		}
 
 	}
-	if sortMode == "" {
-		sortMode = "default"
-	}
 
 	//Check for really special exception in where the path contains [ or ] which cannot be handled via Golang Glob function
 	files, _ := system_fs_specialGlob(filepath.Clean(realpath) + "/*")
@@ -2186,6 +2285,7 @@ func system_fs_handleList(w http.ResponseWriter, r *http.Request) {
 
 		rawsize := fs.GetFileSize(v)
 		modtime, _ := fs.GetModTime(v)
+		tagRecord, _ := userinfo.GetFileTags(v)
 		thisFile := fs.FileData{
 			Filename:    filepath.Base(v),
 			Filepath:    currentDir + filepath.Base(v),
@@ -2196,12 +2296,23 @@ func system_fs_handleList(w http.ResponseWriter, r *http.Request) {
 			ModTime:     modtime,
 			IsShared:    shareManager.FileIsShared(v),
 			Shortcut:    shortCutInfo,
+			Tags:        tagRecord.Tags,
+			IsFavourite: tagRecord.Favourite,
 		}
 
 		parsedFilelist = append(parsedFilelist, thisFile)
 	}
 
 	//Sort the filelist
+	system_fs_sortFileList(parsedFilelist, sortMode)
+
+	jsonString, _ := json.Marshal(parsedFilelist)
+	sendJSONResponse(w, string(jsonString))
+
+}
+
+//Sort the file list with the given sort mode
+func system_fs_sortFileList(parsedFilelist []fs.FileData, sortMode string) {
 	if sortMode == "default" {
 		//Sort by name, convert filename to window sorting methods
 		sort.Slice(parsedFilelist, func(i, j int) bool {
@@ -2221,10 +2332,6 @@ func system_fs_handleList(w http.ResponseWriter, r *http.Request) {
 	} else if sortMode == "leastRecent" {
 		sort.Slice(parsedFilelist, func(i, j int) bool { return parsedFilelist[i].ModTime < parsedFilelist[j].ModTime })
 	}
-
-	jsonString, _ := json.Marshal(parsedFilelist)
-	sendJSONResponse(w, string(jsonString))
-
 }
 
 //Handle getting a hash from a given contents in the given path
@@ -2461,6 +2568,50 @@ func system_fs_handleThumbnailLoad(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+//Handle loading of the multi-page preview of a file for the preview pane
+func system_fs_handleFilePreview(w http.ResponseWriter, r *http.Request) {
+	userinfo, _ := userHandler.GetUserInfoFromRequest(w, r)
+	vpath, err := mv(r, "file", false)
+	if err != nil {
+		sendErrorResponse(w, "file not defined")
+		return
+	}
+
+	rpath, err := userinfo.VirtualPathToRealPath(vpath)
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+
+	if !userinfo.CanRead(vpath) {
+		sendErrorResponse(w, "Access Denied")
+		return
+	}
+
+	//Number of pages to render, default 5 and at most 20
+	maxPages := 5
+	pages, err := mv(r, "pages", false)
+	if err == nil {
+		maxPages, err = strconv.Atoi(pages)
+		if err != nil || maxPages <= 0 {
+			sendErrorResponse(w, "Invalid pages value")
+			return
+		}
+		if maxPages > 20 {
+			maxPages = 20
+		}
+	}
+
+	preview, err := thumbRenderHandler.RenderPreview(rpath, maxPages)
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+
+	js, _ := json.Marshal(preview)
+	sendJSONResponse(w, string(js))
+}
+
 //Handle file thumbnail caching
 func system_fs_handleFolderCache(w http.ResponseWriter, r *http.Request) {
 	userinfo, _ := userHandler.GetUserInfoFromRequest(w, r)
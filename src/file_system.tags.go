@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	uuid "github.com/satori/go.uuid"
+
+	prout "imuslab.com/arozos/mod/prouter"
+	user "imuslab.com/arozos/mod/user"
+)
+
+/*
+	File Tags, Favourites and Smart Collections
+
+	This script handle the user file tagging related APIs.
+	Tags are stored inside the fsdb of each file system handler (see mod/filesystem/filetag.go)
+	while smart collections (saved tag queries) are stored in the system database
+*/
+
+type smartCollection struct {
+	UUID  string
+	Name  string
+	Query *user.FileTagQuery
+}
+
+func FileTagsInit() {
+	router := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "File Manager",
+		AdminOnly:   false,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			sendErrorResponse(w, "Permission Denied")
+		},
+	})
+
+	router.HandleFunc("/system/file_system/tags", system_fs_handleFileTags)
+	router.HandleFunc("/system/file_system/favourite", system_fs_handleFavourite)
+	router.HandleFunc("/system/file_system/tags/query", system_fs_handleTagQuery)
+	router.HandleFunc("/system/file_system/tags/collections", system_fs_handleSmartCollections)
+
+	//Create the table for storing user smart collections
+	sysdb.NewTable("fs-collections")
+}
+
+/*
+	Handle get and set of file tags
+
+	opr=get		=> return the tag record of the given path
+	opr=set		=> overwrite the tags of the given path with tags (JSON array)
+	opr=add		=> add the given tag to the path
+	opr=remove	=> remove the given tag from the path
+	opr=list	=> list all tags used by the user with usage counts
+*/
+func system_fs_handleFileTags(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := userHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	opr, _ := mv(r, "opr", true)
+	if opr == "list" {
+		js, _ := json.Marshal(userinfo.ListAllFileTags())
+		sendJSONResponse(w, string(js))
+		return
+	}
+
+	vpath, err := mv(r, "path", true)
+	if err != nil {
+		sendErrorResponse(w, "Invalid path given")
+		return
+	}
+
+	rpath, err := userinfo.VirtualPathToRealPath(vpath)
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+
+	if !fileExists(rpath) {
+		sendErrorResponse(w, "File not exists")
+		return
+	}
+
+	if !userinfo.CanRead(vpath) {
+		sendErrorResponse(w, "Access Denied")
+		return
+	}
+
+	record, err := userinfo.GetFileTags(rpath)
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+
+	if opr == "" || opr == "get" {
+		js, _ := json.Marshal(record)
+		sendJSONResponse(w, string(js))
+		return
+	}
+
+	newTags := record.Tags
+	if opr == "set" {
+		tagsJSON, _ := mv(r, "tags", true)
+		newTags = []string{}
+		if tagsJSON != "" {
+			err = json.Unmarshal([]byte(tagsJSON), &newTags)
+			if err != nil {
+				sendErrorResponse(w, "Unable to parse JSON for tags")
+				return
+			}
+		}
+	} else if opr == "add" || opr == "remove" {
+		tag, err := mv(r, "tag", true)
+		if err != nil || strings.TrimSpace(tag) == "" {
+			sendErrorResponse(w, "Invalid tag given")
+			return
+		}
+
+		if opr == "add" {
+			newTags = append(newTags, tag)
+		} else {
+			newTags = []string{}
+			for _, thisTag := range record.Tags {
+				if !strings.EqualFold(thisTag, strings.TrimSpace(tag)) {
+					newTags = append(newTags, thisTag)
+				}
+			}
+		}
+	} else {
+		sendErrorResponse(w, "Invalid opr mode")
+		return
+	}
+
+	for _, tag := range newTags {
+		if len(tag) > 64 {
+			sendErrorResponse(w, "Tag too long. Each tag can only store maximum 64 characters.")
+			return
+		}
+	}
+
+	err = userinfo.SetFileTags(rpath, newTags)
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+
+	sendOK(w)
+}
+
+//Handle marking and unmarking of favourite files
+func system_fs_handleFavourite(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := userHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	vpath, err := mv(r, "path", true)
+	if err != nil {
+		//No path given. List all favourite files of this user
+		results := userinfo.QueryTaggedFiles(&user.FileTagQuery{FavouriteOnly: true})
+		js, _ := json.Marshal(results)
+		sendJSONResponse(w, string(js))
+		return
+	}
+
+	rpath, err := userinfo.VirtualPathToRealPath(vpath)
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+
+	if !fileExists(rpath) {
+		sendErrorResponse(w, "File not exists")
+		return
+	}
+
+	if !userinfo.CanRead(vpath) {
+		sendErrorResponse(w, "Access Denied")
+		return
+	}
+
+	favourite, _ := mv(r, "favourite", true)
+	if favourite == "" {
+		//Get mode
+		record, _ := userinfo.GetFileTags(rpath)
+		js, _ := json.Marshal(record.Favourite)
+		sendJSONResponse(w, string(js))
+		return
+	}
+
+	err = userinfo.SetFileFavourite(rpath, favourite == "true")
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+
+	sendOK(w)
+}
+
+//Handle searching of tagged files with the given query
+func system_fs_handleTagQuery(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := userHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	query, err := system_fs_parseTagQuery(r)
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+
+	results := system_fs_runTagQuery(userinfo, query)
+	js, _ := json.Marshal(results)
+	sendJSONResponse(w, string(js))
+}
+
+/*
+	Handle user smart collections (saved tag queries)
+
+	opr=list	=> list all saved collections
+	opr=save	=> save a collection with name and query paramters (see system_fs_parseTagQuery)
+	opr=delete	=> delete the collection with the given uuid
+	opr=run		=> run the collection with the given uuid and return the matching files
+*/
+func system_fs_handleSmartCollections(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := userHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	opr, _ := mv(r, "opr", true)
+	if opr == "" || opr == "list" {
+		results := []*smartCollection{}
+		entries, _ := sysdb.ListTable("fs-collections")
+		for _, keypairs := range entries {
+			if !strings.HasPrefix(string(keypairs[0]), userinfo.Username+"/") {
+				continue
+			}
+			thisCollection := new(smartCollection)
+			json.Unmarshal(keypairs[1], &thisCollection)
+			results = append(results, thisCollection)
+		}
+
+		sort.Slice(results, func(i, j int) bool {
+			return strings.ToLower(results[i].Name) < strings.ToLower(results[j].Name)
+		})
+
+		js, _ := json.Marshal(results)
+		sendJSONResponse(w, string(js))
+	} else if opr == "save" {
+		name, err := mv(r, "name", true)
+		if err != nil {
+			sendErrorResponse(w, "Invalid collection name given")
+			return
+		}
+
+		query, err := system_fs_parseTagQuery(r)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+
+		//Overwrite the collection if uuid is given
+		collectionID, _ := mv(r, "uuid", true)
+		if collectionID == "" {
+			collectionID = uuid.NewV4().String()
+		}
+
+		thisCollection := smartCollection{
+			UUID:  collectionID,
+			Name:  name,
+			Query: query,
+		}
+
+		err = sysdb.Write("fs-collections", userinfo.Username+"/"+collectionID, thisCollection)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+
+		js, _ := json.Marshal(collectionID)
+		sendJSONResponse(w, string(js))
+	} else if opr == "delete" || opr == "run" {
+		collectionID, err := mv(r, "uuid", true)
+		if err != nil {
+			sendErrorResponse(w, "Invalid collection uuid given")
+			return
+		}
+
+		key := userinfo.Username + "/" + collectionID
+		if !sysdb.KeyExists("fs-collections", key) {
+			sendErrorResponse(w, "Collection not exists")
+			return
+		}
+
+		if opr == "delete" {
+			sysdb.Delete("fs-collections", key)
+			sendOK(w)
+			return
+		}
+
+		thisCollection := new(smartCollection)
+		sysdb.Read("fs-collections", key, &thisCollection)
+		if thisCollection.Query == nil {
+			thisCollection.Query = &user.FileTagQuery{}
+		}
+
+		results := system_fs_runTagQuery(userinfo, thisCollection.Query)
+		js, _ := json.Marshal(results)
+		sendJSONResponse(w, string(js))
+	} else {
+		sendErrorResponse(w, "Invalid opr mode")
+	}
+}
+
+/*
+	Parse a tag query from the request
+
+	tags: JSON array of tags or a single tag
+	type: file extension (e.g. pdf) or mime type prefix (e.g. image)
+	days: modified within the given amount of days
+	favourite: true for favourite files only
+*/
+func system_fs_parseTagQuery(r *http.Request) (*user.FileTagQuery, error) {
+	query := user.FileTagQuery{
+		Tags: []string{},
+	}
+
+	tags, _ := mv(r, "tags", true)
+	if tags != "" {
+		if strings.HasPrefix(strings.TrimSpace(tags), "[") {
+			err := json.Unmarshal([]byte(tags), &query.Tags)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			query.Tags = []string{tags}
+		}
+	}
+
+	query.Type, _ = mv(r, "type", true)
+
+	days, _ := mv(r, "days", true)
+	if days != "" {
+		d, err := strconv.Atoi(days)
+		if err != nil || d < 0 {
+			return nil, errors.New("Invalid days given")
+		}
+		query.ModifiedWithin = d
+	}
+
+	favourite, _ := mv(r, "favourite", true)
+	query.FavouriteOnly = favourite == "true"
+
+	return &query, nil
+}
+
+//Run the given query for the user, sorted by the most recently modified files
+func system_fs_runTagQuery(userinfo *user.User, query *user.FileTagQuery) []*user.TaggedFile {
+	results := userinfo.QueryTaggedFiles(query)
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].ModTime > results[j].ModTime
+	})
+	return results
+}
@@ -27,6 +27,7 @@ func IoTHubInit() {
 	if *allow_iot && *allow_mdns && MDNS != nil {
 		//Create a new ioT Manager
 		iotManager = iot.NewIoTManager(sysdb)
+		iotManager.EventBus = eventBus
 
 		//Register IoT Hub Module
 		moduleHandler.RegisterModule(module.ModuleInfo{
@@ -80,6 +80,18 @@ var file_opr_buff = flag.Int("iobuf", 1024, "Amount of buffer memory for IO oper
 var enable_dir_listing = flag.Bool("dir_list", true, "Enable directory listing")
 var enable_asyncFileUpload = flag.Bool("upload_async", false, "Enable file upload buffering to run in async mode (Faster upload, require RAM >= 8GB)")
 
+//Flags related to media streaming
+var transcode_cache_size = flag.Int("transcode_cache", 4096, "Maximum size of the video transcode cache in MB. Least recently played videos will be removed first")
+var max_transcode = flag.Int("max_transcode", 2, "Maximum number of concurrent video transcoding processes")
+
+//Flags related to AGI script execution
+var agi_timeout = flag.Int("agi_timeout", 600, "Default maximum execution time of AGI scripts in seconds, 0 for unlimited. Can be overwritten per module and per scheduled job")
+var agi_max_http = flag.Int("agi_max_http", 0, "Default maximum number of outgoing HTTP requests per AGI script execution, 0 for unlimited")
+var agi_max_write = flag.Int("agi_max_write", 0, "Default maximum file size written per AGI script execution in MB, 0 for unlimited")
+var agi_kv_quota = flag.Int("agi_kv_quota", 16, "Default storage quota of each module key-value namespace in MB, 0 for unlimited. Can be overwritten per module")
+var agi_job_retention = flag.Int("agi_job_retention", 604800, "Time before the records of finished background AGI jobs are removed in seconds. Default 604800 seconds = 7 days")
+var agi_test_suite = flag.String("agi_test", "", "Run the AGI module test suite in the given JSON file against a temporary system and exit. Exit code is non zero if any test failed")
+
 //Flags related to compatibility or testing
 var enable_beta_scanning_support = flag.Bool("beta_scan", false, "Allow compatibility to ArOZ Online Beta Clusters")
 var enable_console = flag.Bool("console", false, "Enable the debugging console.")
@@ -97,4 +109,5 @@ var maxTempFileKeepTime = flag.Int("tmp_time", 86400, "Time before tmp file will
 
 //Flags related to ArozOS Cluster services
 var allow_clustering = flag.Bool("allow_cluster", true, "Enable cluster operations within LAN. Require allow_mdns=true flag")
+var cluster_port = flag.Int("cluster_port", 8099, "Listening port for the mutual TLS connections between paired cluster nodes")
 var allow_iot = flag.Bool("allow_iot", true, "Enable IoT related APIs and scanner. Require MDNS enabled")
@@ -62,6 +62,18 @@ func executeShutdownSequence() {
 		ftpServer.Close()
 	}
 
+	//Shutdown Cluster Server
+	if ClusterServer != nil {
+		log.Println("\r- Shutting down cluster server")
+		ClusterServer.Close()
+	}
+
+	//Stop all video transcoding processes
+	if videoTranscoder != nil {
+		log.Println("\r- Stopping video transcoder")
+		videoTranscoder.Close()
+	}
+
 	//Cleaning up tmp files
 	log.Println("\r- Cleaning up tmp folder")
 	os.RemoveAll(*tmp_directory)
@@ -81,6 +93,11 @@ func main() {
 		os.Exit(0)
 	}
 
+	//Handle AGI module test suite execution
+	if *agi_test_suite != "" {
+		os.Exit(runAGITestSuite(*agi_test_suite))
+	}
+
 	//Handle flag assignments
 	max_upload_size = int64(*max_upload) << 20 //Parse the max upload size
 	if *demo_mode {                            //Disable hardware man under demo mode
@@ -127,14 +144,18 @@ func main() {
 			if !*disable_http {
 				go func() {
 					log.Println("Standard (HTTP) Web server listening at :" + strconv.Itoa(*listen_port))
-					http.ListenAndServe(":"+strconv.Itoa(*listen_port), nil)
+					http.ListenAndServe(":"+strconv.Itoa(*listen_port), certManagerHTTPHandler(http.DefaultServeMux))
 				}()
 			}
 			log.Println("Secure (HTTPS) Web server listening at :" + strconv.Itoa(*tls_listen_port))
-			http.ListenAndServeTLS(":"+strconv.Itoa(*tls_listen_port), *tls_cert, *tls_key, nil)
+			server := &http.Server{
+				Addr:      ":" + strconv.Itoa(*tls_listen_port),
+				TLSConfig: certManagerTLSConfig(),
+			}
+			server.ListenAndServeTLS("", "")
 		} else {
 			log.Println("Web server listening at :" + strconv.Itoa(*listen_port))
-			http.ListenAndServe(":"+strconv.Itoa(*listen_port), nil)
+			http.ListenAndServe(":"+strconv.Itoa(*listen_port), certManagerHTTPHandler(http.DefaultServeMux))
 		}
 	}()
 
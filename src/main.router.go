@@ -15,6 +15,7 @@ import (
 
 	"imuslab.com/arozos/mod/common"
 	fs "imuslab.com/arozos/mod/filesystem"
+	"imuslab.com/arozos/mod/network/bandwidth"
 )
 
 func mrouter(h http.Handler) http.Handler {
@@ -63,6 +64,10 @@ func mrouter(h http.Handler) http.Handler {
 
 		} else if len(r.URL.Path) >= len("/webdav") && r.URL.Path[:7] == "/webdav" {
 			WebDavHandler.HandleRequest(w, r)
+		} else if strings.HasPrefix(r.URL.Path, "/caldav") || strings.HasPrefix(r.URL.Path, "/carddav") ||
+			r.URL.Path == "/.well-known/caldav" || r.URL.Path == "/.well-known/carddav" {
+			//CalDAV and CardDAV, authenticated by the DAV server
+			DAVHandler.HandleRequest(w, r)
 		} else if r.URL.Path == "/" && authAgent.CheckAuth(r) {
 			//Use logged in and request the index. Serve the user's interface module
 			w.Header().Set("Cache-Control", "no-cache, no-store, no-transform, must-revalidate, private, max-age=0")
@@ -111,7 +116,10 @@ func mrouter(h http.Handler) http.Handler {
 
 				if isRP {
 					//Check user permission on that module
-					ssRouter.HandleRoutingRequest(w, r, proxy, subserviceObject, rewriteURL)
+					username, _ := authAgent.GetUserName(w, r)
+					BandwidthController.Serve(w, r, bandwidth.ProtocolSubservice, username, func(w http.ResponseWriter, r *http.Request) {
+						ssRouter.HandleRoutingRequest(w, r, proxy, subserviceObject, rewriteURL)
+					})
 					return
 				}
 			}
@@ -1,15 +1,21 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"log"
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	fs "imuslab.com/arozos/mod/filesystem"
+	"imuslab.com/arozos/mod/music"
+	"imuslab.com/arozos/mod/network/bandwidth"
 	"imuslab.com/arozos/mod/network/gzipmiddleware"
+	prout "imuslab.com/arozos/mod/prouter"
+	"imuslab.com/arozos/mod/transcoder"
 )
 
 /*
@@ -29,15 +35,52 @@ PLEASE ALWAYS USE URLENCODE IN THE LINK PASSED INTO THE /media ENDPOINT
 
 //
 
+var (
+	musicLibrary    *music.Manager
+	videoTranscoder *transcoder.Transcoder
+)
+
 func mediaServer_init() {
 	if *enable_gzip {
-		http.HandleFunc("/media/", gzipmiddleware.CompressFunc(serverMedia))
+		http.HandleFunc("/media/", BandwidthController.HandlerFunc(bandwidth.ProtocolWeb, gzipmiddleware.CompressFunc(serverMedia)))
 		http.HandleFunc("/media/getMime/", gzipmiddleware.CompressFunc(serveMediaMime))
 	} else {
-		http.HandleFunc("/media/", serverMedia)
+		http.HandleFunc("/media/", BandwidthController.HandlerFunc(bandwidth.ProtocolWeb, serverMedia))
 		http.HandleFunc("/media/getMime/", serveMediaMime)
 	}
 
+	mediaServer_musicLibraryInit()
+	mediaServer_transcoderInit()
+}
+
+//Initiate the music library and its browsing, playlist and queue APIs
+func mediaServer_musicLibraryInit() {
+	musicLibrary = music.NewMusicManager(music.Options{
+		UserHandler: userHandler,
+		Database:    sysdb,
+	})
+
+	router := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "Music",
+		AdminOnly:   false,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			sendErrorResponse(w, "Permission Denied")
+		},
+	})
+
+	router.HandleFunc("/media/music/library", musicLibrary.HandleLibrary)
+	router.HandleFunc("/media/music/tracks", musicLibrary.HandleTracks)
+	router.HandleFunc("/media/music/albums", musicLibrary.HandleAlbums)
+	router.HandleFunc("/media/music/artists", musicLibrary.HandleArtists)
+	router.HandleFunc("/media/music/played", musicLibrary.HandlePlayed)
+	router.HandleFunc("/media/music/playlists", musicLibrary.HandlePlaylists)
+	router.HandleFunc("/media/music/queue", musicLibrary.HandleQueue)
+
+	//Inject the music library into the AGI interface
+	if AGIGateway != nil {
+		AGIGateway.Option.MusicLibrary = musicLibrary
+	}
 }
 
 //This function validate the incoming media request and return the real path for the targed file
@@ -124,6 +167,13 @@ func serveMediaMime(w http.ResponseWriter, r *http.Request) {
 
 func serverMedia(w http.ResponseWriter, r *http.Request) {
 	//Serve normal media files
+	targetfile, _ := mv(r, "file", false)
+	if cluster_isRemotePath(targetfile) {
+		//File on paired cluster node
+		cluster_serveRemoteMedia(w, r, targetfile)
+		return
+	}
+
 	realFilepath, err := media_server_validateSourceFile(w, r)
 	if err != nil {
 		sendErrorResponse(w, err.Error())
@@ -156,3 +206,190 @@ func serverMedia(w http.ResponseWriter, r *http.Request) {
 
 	http.ServeFile(w, r, realFilepath)
 }
+
+/*
+	Video Transcoding and HLS Streaming
+
+	Videos are transcoded into HLS streams on demand using ffmpeg
+	Example usage:
+	/media/hls/?file=user:/Video/movie.mkv					=> Master playlist
+	/media/hls/?rendition=720p&file=user:/Video/movie.mkv			=> Rendition playlist
+	/media/subtitles/?file=user:/Video/movie.mkv				=> List of subtitle tracks
+	/media/subtitles/?track=embedded:0&file=user:/Video/movie.mkv	=> Subtitle in WebVTT
+
+	The file paramter must be placed at the end of the URL for compatibility mode to work
+*/
+func mediaServer_transcoderInit() {
+	t, err := transcoder.NewTranscoder(transcoder.Options{
+		CacheFolder:   filepath.Join(*tmp_directory, "transcode"),
+		MaxCacheSize:  int64(*transcode_cache_size) << 20,
+		MaxConcurrent: *max_transcode,
+	})
+	if err != nil {
+		log.Println("[Media Server] Unable to start video transcoder: ", err.Error())
+		return
+	}
+
+	if !t.IsAvailable() {
+		log.Println("[Media Server] ffmpeg not found. Video transcoding is disabled")
+	}
+
+	videoTranscoder = t
+	http.HandleFunc("/media/hls/", BandwidthController.HandlerFunc(bandwidth.ProtocolWeb, serveMediaHLS))
+	http.HandleFunc("/media/subtitles/", serveMediaSubtitles)
+}
+
+func serveMediaHLS(w http.ResponseWriter, r *http.Request) {
+	realFilepath, err := media_server_validateSourceFile(w, r)
+	if err != nil {
+		http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if videoTranscoder == nil || !videoTranscoder.IsAvailable() {
+		http.Error(w, "501 - Video transcoding not available on this host", http.StatusNotImplemented)
+		return
+	}
+
+	vpath, _ := mv(r, "file", false)
+	escapedVpath := url.QueryEscape(vpath)
+	rendition, _ := mv(r, "rendition", false)
+	segment, _ := mv(r, "segment", false)
+
+	if segment != "" {
+		//Serve the transcoded segment
+		segmentFile, err := videoTranscoder.GetSegment(realFilepath, rendition, segment)
+		if err != nil {
+			http.Error(w, "404 - "+err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp2t")
+		http.ServeFile(w, r, segmentFile)
+		return
+	}
+
+	if rendition == "" {
+		//Serve the master playlist
+		playlist := videoTranscoder.GetMasterPlaylist(realFilepath, func(renditionName string) string {
+			return "/media/hls/?rendition=" + renditionName + "&file=" + escapedVpath
+		})
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Write([]byte(playlist))
+		return
+	}
+
+	//Serve the rendition playlist. Transcode will be started if needed
+	playlist, err := videoTranscoder.GetRenditionPlaylist(realFilepath, rendition, func(segmentName string) string {
+		return "/media/hls/?rendition=" + rendition + "&segment=" + segmentName + "&file=" + escapedVpath
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "concurrent") {
+			http.Error(w, "503 - "+err.Error(), http.StatusServiceUnavailable)
+		} else {
+			http.Error(w, "500 - "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(playlist))
+}
+
+func serveMediaSubtitles(w http.ResponseWriter, r *http.Request) {
+	realFilepath, err := media_server_validateSourceFile(w, r)
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+
+	if videoTranscoder == nil {
+		sendErrorResponse(w, "Video transcoder not ready")
+		return
+	}
+
+	track, _ := mv(r, "track", false)
+	if track == "" {
+		//List all the subtitle tracks
+		type subtitleTrack struct {
+			Track    string
+			Label    string
+			Language string
+		}
+		results := []subtitleTrack{}
+		for _, sidecar := range transcoder.FindSidecarSubtitles(realFilepath) {
+			results = append(results, subtitleTrack{
+				Track: "sidecar:" + filepath.Base(sidecar),
+				Label: filepath.Base(sidecar),
+			})
+		}
+
+		mediaInfo, err := videoTranscoder.Probe(realFilepath)
+		if err == nil {
+			for _, subtitle := range mediaInfo.Subtitles {
+				label := subtitle.Title
+				if label == "" {
+					label = "Track " + strconv.Itoa(subtitle.Index+1)
+					if subtitle.Language != "" {
+						label += " (" + subtitle.Language + ")"
+					}
+				}
+				results = append(results, subtitleTrack{
+					Track:    "embedded:" + strconv.Itoa(subtitle.Index),
+					Label:    label,
+					Language: subtitle.Language,
+				})
+			}
+		}
+
+		js, _ := json.Marshal(results)
+		sendJSONResponse(w, string(js))
+		return
+	}
+
+	vtt := ""
+	if strings.HasPrefix(track, "sidecar:") {
+		//Only allow subtitles next to the video
+		sidecarName := strings.TrimPrefix(track, "sidecar:")
+		sidecarFile := ""
+		for _, sidecar := range transcoder.FindSidecarSubtitles(realFilepath) {
+			if filepath.Base(sidecar) == sidecarName {
+				sidecarFile = sidecar
+			}
+		}
+		if sidecarFile == "" {
+			http.Error(w, "404 - Subtitle not found", http.StatusNotFound)
+			return
+		}
+
+		vtt, err = transcoder.LoadSubtitleAsWebVTT(sidecarFile)
+		if err != nil {
+			http.Error(w, "500 - "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else if strings.HasPrefix(track, "embedded:") {
+		index, err := strconv.Atoi(strings.TrimPrefix(track, "embedded:"))
+		if err != nil {
+			http.Error(w, "400 - Invalid track given", http.StatusBadRequest)
+			return
+		}
+
+		mediaInfo, err := videoTranscoder.Probe(realFilepath)
+		if err != nil || index < 0 || index >= len(mediaInfo.Subtitles) {
+			http.Error(w, "404 - Subtitle not found", http.StatusNotFound)
+			return
+		}
+
+		vtt, err = videoTranscoder.ExtractSubtitle(realFilepath, index, mediaInfo.Subtitles[index].Codec)
+		if err != nil {
+			http.Error(w, "500 - "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		http.Error(w, "400 - Invalid track given", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	w.Write([]byte(vtt))
+}
@@ -0,0 +1,296 @@
+package agi
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/robertkrimen/otto"
+	fs "imuslab.com/arozos/mod/filesystem"
+	user "imuslab.com/arozos/mod/user"
+)
+
+/*
+	AJGI Archive Library
+
+	This is a library for creating, extracting and listing archives in agi scripts.
+	Zip archives can be created. zip, tar (plain or compressed), rar and 7z
+	(require 7z installed on host) archives can be listed and extracted.
+
+	The optional progress callback is called with (filename, current file count, total file count, progress in percentage)
+*/
+
+func (g *Gateway) ArchiveLibRegister() {
+	err := g.RegisterLib("archivelib", g.injectArchiveLibFunctions)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+//Call the progress callback function of the script if it is given
+func callProgressHandler(callback otto.Value) func(string, int, int, float64) {
+	return func(filename string, current int, total int, progress float64) {
+		if callback.IsFunction() {
+			callback.Call(otto.NullValue(), filename, current, total, progress)
+		}
+	}
+}
+
+func (g *Gateway) injectArchiveLibFunctions(vm *otto.Otto, u *user.User) {
+	//Resolve the virtual paths within the file scopes allowed by the module capabilities
+	virtualPathToRealPath := g.getScopedPathResolver(vm)
+
+	//Translate and check the read permission of the given archive
+	getArchiveRealPath := func(vpath string) (string, error) {
+		if !u.CanRead(vpath) {
+			panic(vm.MakeCustomError("PermissionDenied", "Path access denied: "+vpath))
+		}
+
+		rpath, err := virtualPathToRealPath(vpath, u)
+		if err != nil {
+			return "", err
+		}
+
+		if !fileExists(rpath) || fs.IsDir(rpath) {
+			return "", errors.New("Archive not exists: " + vpath)
+		}
+
+		return rpath, nil
+	}
+
+	//zip(sourceVpaths, outputVpath, progressCallback) => return true when succeed. sourceVpaths can be a string or an array of strings
+	vm.Set("_archivelib_zip", func(call otto.FunctionCall) otto.Value {
+		sourceVpaths := []string{}
+		exported, _ := call.Argument(0).Export()
+		switch sources := exported.(type) {
+		case string:
+			sourceVpaths = append(sourceVpaths, sources)
+		case []string:
+			sourceVpaths = sources
+		case []interface{}:
+			for _, source := range sources {
+				if sourceString, ok := source.(string); ok {
+					sourceVpaths = append(sourceVpaths, sourceString)
+				}
+			}
+		}
+
+		if len(sourceVpaths) == 0 {
+			g.raiseError(errors.New("No source file given"))
+			return otto.FalseValue()
+		}
+
+		outputVpath, err := call.Argument(1).ToString()
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		if !u.CanWrite(outputVpath) {
+			panic(vm.MakeCustomError("PermissionDenied", "Path access denied: "+outputVpath))
+		}
+
+		//Translate the source files and count their total size
+		sourceRpaths := []string{}
+		totalSize := int64(0)
+		for _, sourceVpath := range sourceVpaths {
+			if !u.CanRead(sourceVpath) {
+				panic(vm.MakeCustomError("PermissionDenied", "Path access denied: "+sourceVpath))
+			}
+
+			sourceRpath, err := virtualPathToRealPath(sourceVpath, u)
+			if err != nil {
+				g.raiseError(err)
+				return otto.FalseValue()
+			}
+
+			if !fileExists(sourceRpath) {
+				g.raiseError(errors.New("File not exists: " + sourceVpath))
+				return otto.FalseValue()
+			}
+
+			if fs.IsDir(sourceRpath) {
+				dirSize, _ := fs.GetDirctorySize(sourceRpath, false)
+				totalSize += dirSize
+			} else {
+				totalSize += fs.GetFileSize(sourceRpath)
+			}
+
+			sourceRpaths = append(sourceRpaths, sourceRpath)
+		}
+
+		outputRpath, err := virtualPathToRealPath(outputVpath, u)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		if fileExists(outputRpath) {
+			g.raiseError(errors.New("Output file already exists: " + outputVpath))
+			return otto.FalseValue()
+		}
+
+		//The compressed file will not be larger than its source in most cases
+		if !u.StorageQuota.HaveSpace(totalSize) {
+			g.raiseError(errors.New("Storage Quota Fulled"))
+			return otto.FalseValue()
+		}
+
+		os.MkdirAll(filepath.Dir(outputRpath), 0755)
+		err = fs.ArozZipFileWithProgress(sourceRpaths, outputRpath, false, callProgressHandler(call.Argument(2)))
+		if err != nil {
+			os.Remove(outputRpath)
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		if err := g.chargeFileWritten(vm, outputRpath); err != nil {
+			os.Remove(outputRpath)
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		u.SetOwnerOfFile(outputRpath)
+		return otto.TrueValue()
+	})
+
+	//unzip(archiveVpath, outputFolderVpath, progressCallback) => return true when succeed
+	vm.Set("_archivelib_unzip", func(call otto.FunctionCall) otto.Value {
+		archiveVpath, err := call.Argument(0).ToString()
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		outputVpath, err := call.Argument(1).ToString()
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		if !u.CanWrite(outputVpath) {
+			panic(vm.MakeCustomError("PermissionDenied", "Path access denied: "+outputVpath))
+		}
+
+		archiveRpath, err := getArchiveRealPath(archiveVpath)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		outputRpath, err := virtualPathToRealPath(outputVpath, u)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		entries, err := fs.ListArchiveEntries(archiveRpath)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		//Reject early if the declared uncompressed size does not fit the quota
+		totalSize := int64(0)
+		for _, entry := range entries {
+			totalSize += entry.Size
+		}
+
+		if !u.StorageQuota.HaveSpace(totalSize) {
+			g.raiseError(errors.New("Storage Quota Fulled"))
+			return otto.FalseValue()
+		}
+
+		//The header sizes can be forged, so limit the bytes actually extracted by the remaining quota and write limit
+		remainingWrite := g.remainingWriteBytes(vm)
+		maxBytes := remainingWrite
+		if u.StorageQuota.TotalStorageQuota != -1 {
+			remainingQuota := u.StorageQuota.TotalStorageQuota - u.StorageQuota.UsedStorageQuota
+			if remainingQuota < 0 {
+				remainingQuota = 0
+			}
+			if maxBytes < 0 || remainingQuota < maxBytes {
+				maxBytes = remainingQuota
+			}
+		}
+
+		written, err := fs.ArozExtractArchiveWithLimit(archiveRpath, outputRpath, maxBytes, callProgressHandler(call.Argument(2)))
+		if err == fs.ErrExtractSizeLimit {
+			//Nothing is moved into the output folder when the limit is reached
+			if remainingWrite >= 0 && remainingWrite == maxBytes {
+				err = g.chargeBytesWritten(vm, remainingWrite+1)
+			} else {
+				err = errors.New("Storage Quota Fulled")
+			}
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		if chargeErr := g.chargeBytesWritten(vm, written); chargeErr != nil {
+			g.raiseError(chargeErr)
+			return otto.FalseValue()
+		}
+
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		//Set the owner of the extracted files
+		for _, entry := range entries {
+			if entry.IsDir {
+				continue
+			}
+			extractedFile := filepath.Join(outputRpath, entry.Name)
+			if fileExists(extractedFile) {
+				u.SetOwnerOfFile(extractedFile)
+			}
+		}
+
+		return otto.TrueValue()
+	})
+
+	//list(archiveVpath) => return [{name, size, isDir}]
+	vm.Set("_archivelib_list", func(call otto.FunctionCall) otto.Value {
+		archiveVpath, err := call.Argument(0).ToString()
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		archiveRpath, err := getArchiveRealPath(archiveVpath)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		entries, err := fs.ListArchiveEntries(archiveRpath)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		results := []map[string]interface{}{}
+		for _, entry := range entries {
+			results = append(results, map[string]interface{}{
+				"name":  entry.Name,
+				"size":  entry.Size,
+				"isDir": entry.IsDir,
+			})
+		}
+
+		js, _ := json.Marshal(results)
+		reply, _ := vm.Object("(" + string(js) + ")")
+		return reply.Value()
+	})
+
+	//Wrap all the native code function into an archivelib class
+	vm.Run(`
+		var archivelib = {};
+		archivelib.zip = _archivelib_zip;
+		archivelib.unzip = _archivelib_unzip;
+		archivelib.list = _archivelib_list;
+	`)
+}
@@ -0,0 +1,450 @@
+package agi
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/robertkrimen/otto"
+	"golang.org/x/crypto/scrypt"
+	fs "imuslab.com/arozos/mod/filesystem"
+	user "imuslab.com/arozos/mod/user"
+)
+
+/*
+	AJGI Crypto Library
+
+	This is a library for common cryptographic operations in agi scripts.
+
+	encrypt / decrypt uses AES-256-GCM with a key derived from the given key string by scrypt
+	with a random salt. The encrypted output is salt + nonce + ciphertext, base64 encoded for strings.
+	JSON Web Tokens are signed and verified with HS256
+*/
+
+//Maximum number of random bytes that can be generated in one call
+const maxRandomBytes = 65536
+
+//Key derivation parameters of encrypt and decrypt
+const (
+	cryptoSaltSize = 16
+	scryptN        = 32768
+	scryptR        = 8
+	scryptP        = 1
+)
+
+func (g *Gateway) CryptoLibRegister() {
+	err := g.RegisterLib("cryptolib", g.injectCryptoLibFunctions)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+//Get the hash constructor for HMAC from the algorithm name
+func getHMACHash(algorithm string) (func() hash.Hash, error) {
+	switch strings.ToLower(algorithm) {
+	case "md5":
+		return md5.New, nil
+	case "sha1":
+		return sha1.New, nil
+	case "sha256":
+		return sha256.New, nil
+	case "sha512":
+		return sha512.New, nil
+	}
+	return nil, errors.New("Unsupported HMAC algorithm: " + algorithm)
+}
+
+//Create the AES-GCM cipher with the key derived from the key string and salt
+func newGCM(key string, salt []byte) (cipher.AEAD, error) {
+	derivedKey, err := scrypt.Key([]byte(key), salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(derivedKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//Encrypt the content with AES-GCM. Return salt + nonce + ciphertext
+func aesEncrypt(content []byte, key string) ([]byte, error) {
+	salt := make([]byte, cryptoSaltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(append(salt, nonce...), nonce, content, nil), nil
+}
+
+//Decrypt the content encrypted by aesEncrypt
+func aesDecrypt(content []byte, key string) ([]byte, error) {
+	if len(content) < cryptoSaltSize {
+		return nil, errors.New("Invalid ciphertext")
+	}
+
+	gcm, err := newGCM(key, content[:cryptoSaltSize])
+	if err != nil {
+		return nil, err
+	}
+
+	content = content[cryptoSaltSize:]
+	if len(content) < gcm.NonceSize() {
+		return nil, errors.New("Invalid ciphertext")
+	}
+
+	return gcm.Open(nil, content[:gcm.NonceSize()], content[gcm.NonceSize():], nil)
+}
+
+//Sign the JSON payload as a HS256 JSON Web Token
+func jwtSign(payload []byte, secret string) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	signingInput := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+//Verify the HS256 JSON Web Token and return its payload
+func jwtVerify(token string, secret string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Invalid token")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("Invalid token header")
+	}
+
+	header := map[string]interface{}{}
+	err = json.Unmarshal(headerJSON, &header)
+	if err != nil || header["alg"] != "HS256" {
+		return nil, errors.New("Unsupported token algorithm")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("Invalid token signature")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errors.New("Invalid token signature")
+	}
+
+	payloadJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("Invalid token payload")
+	}
+
+	payload := map[string]interface{}{}
+	err = json.Unmarshal(payloadJSON, &payload)
+	if err != nil {
+		return nil, errors.New("Invalid token payload")
+	}
+
+	//Check the registered time claims
+	now := float64(time.Now().Unix())
+	if exp, ok := payload["exp"].(float64); ok && now >= exp {
+		return nil, errors.New("Token expired")
+	}
+	if nbf, ok := payload["nbf"].(float64); ok && now < nbf {
+		return nil, errors.New("Token not yet valid")
+	}
+
+	return payload, nil
+}
+
+func (g *Gateway) injectCryptoLibFunctions(vm *otto.Otto, u *user.User) {
+	//Resolve the virtual paths within the file scopes allowed by the module capabilities
+	virtualPathToRealPath := g.getScopedPathResolver(vm)
+
+	//encrypt(plaintext, key) => return base64 encoded ciphertext
+	vm.Set("_cryptolib_encrypt", func(call otto.FunctionCall) otto.Value {
+		plaintext, _ := call.Argument(0).ToString()
+		key, err := call.Argument(1).ToString()
+		if err != nil || key == "" {
+			g.raiseError(errors.New("Invalid encryption key"))
+			return otto.FalseValue()
+		}
+
+		ciphertext, err := aesEncrypt([]byte(plaintext), key)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		reply, _ := vm.ToValue(base64.StdEncoding.EncodeToString(ciphertext))
+		return reply
+	})
+
+	//decrypt(ciphertext, key) => return plaintext or false if the key is incorrect
+	vm.Set("_cryptolib_decrypt", func(call otto.FunctionCall) otto.Value {
+		encoded, _ := call.Argument(0).ToString()
+		key, err := call.Argument(1).ToString()
+		if err != nil || key == "" {
+			g.raiseError(errors.New("Invalid encryption key"))
+			return otto.FalseValue()
+		}
+
+		ciphertext, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		plaintext, err := aesDecrypt(ciphertext, key)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		reply, _ := vm.ToValue(string(plaintext))
+		return reply
+	})
+
+	//Encrypt or decrypt the file at srcVpath and write the result to destVpath
+	processFile := func(call otto.FunctionCall, encrypt bool) otto.Value {
+		srcVpath, err := call.Argument(0).ToString()
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		destVpath, err := call.Argument(1).ToString()
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		key, err := call.Argument(2).ToString()
+		if err != nil || key == "" {
+			g.raiseError(errors.New("Invalid encryption key"))
+			return otto.FalseValue()
+		}
+
+		//Check for permission
+		if !u.CanRead(srcVpath) {
+			panic(vm.MakeCustomError("PermissionDenied", "Path access denied: "+srcVpath))
+		}
+
+		if !u.CanWrite(destVpath) {
+			panic(vm.MakeCustomError("PermissionDenied", "Path access denied: "+destVpath))
+		}
+
+		srcRpath, err := virtualPathToRealPath(srcVpath, u)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		destRpath, err := virtualPathToRealPath(destVpath, u)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		if !fileExists(srcRpath) || fs.IsDir(srcRpath) {
+			g.raiseError(errors.New("File not exists: " + srcVpath))
+			return otto.FalseValue()
+		}
+
+		content, err := ioutil.ReadFile(srcRpath)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		var result []byte
+		if encrypt {
+			result, err = aesEncrypt(content, key)
+		} else {
+			result, err = aesDecrypt(content, key)
+		}
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		//Check if the script is allowed to write this much
+		if err := g.chargeBytesWritten(vm, int64(len(result))); err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		if !u.StorageQuota.HaveSpace(int64(len(result))) {
+			g.raiseError(errors.New("Storage Quota Fulled"))
+			return otto.FalseValue()
+		}
+
+		//Remove ownership of the old file if it is overwritten
+		if fileExists(destRpath) {
+			u.RemoveOwnershipFromFile(destRpath)
+		}
+
+		os.MkdirAll(filepath.Dir(destRpath), 0755)
+		err = ioutil.WriteFile(destRpath, result, 0755)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		u.SetOwnerOfFile(destRpath)
+		return otto.TrueValue()
+	}
+
+	//encryptFile(srcVpath, destVpath, key) => return true when succeed
+	vm.Set("_cryptolib_encryptFile", func(call otto.FunctionCall) otto.Value {
+		return processFile(call, true)
+	})
+
+	//decryptFile(srcVpath, destVpath, key) => return true when succeed
+	vm.Set("_cryptolib_decryptFile", func(call otto.FunctionCall) otto.Value {
+		return processFile(call, false)
+	})
+
+	//randomBytes(length, encoding) => return random bytes in hex (default) or base64
+	vm.Set("_cryptolib_randomBytes", func(call otto.FunctionCall) otto.Value {
+		length, err := call.Argument(0).ToInteger()
+		if err != nil || length <= 0 || length > maxRandomBytes {
+			g.raiseError(errors.New("Invalid random bytes length"))
+			return otto.FalseValue()
+		}
+
+		buf := make([]byte, length)
+		_, err = rand.Read(buf)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		encoding := "hex"
+		if call.Argument(1).IsString() {
+			encoding, _ = call.Argument(1).ToString()
+		}
+
+		result := hex.EncodeToString(buf)
+		if encoding == "base64" {
+			result = base64.StdEncoding.EncodeToString(buf)
+		}
+
+		reply, _ := vm.ToValue(result)
+		return reply
+	})
+
+	//hmac(algorithm, key, message) => return HMAC of the message in hex
+	vm.Set("_cryptolib_hmac", func(call otto.FunctionCall) otto.Value {
+		algorithm, _ := call.Argument(0).ToString()
+		key, _ := call.Argument(1).ToString()
+		message, _ := call.Argument(2).ToString()
+
+		hashFunc, err := getHMACHash(algorithm)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		mac := hmac.New(hashFunc, []byte(key))
+		mac.Write([]byte(message))
+		reply, _ := vm.ToValue(hex.EncodeToString(mac.Sum(nil)))
+		return reply
+	})
+
+	//jwtSign(payload, secret, expireSeconds) => return signed token. exp and iat are set if expireSeconds is given
+	vm.Set("_cryptolib_jwtSign", func(call otto.FunctionCall) otto.Value {
+		secret, err := call.Argument(1).ToString()
+		if err != nil || secret == "" {
+			g.raiseError(errors.New("Invalid token secret"))
+			return otto.FalseValue()
+		}
+
+		payloadJSON, err := vm.Call("JSON.stringify", nil, call.Argument(0))
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		payload := map[string]interface{}{}
+		err = json.Unmarshal([]byte(payloadJSON.String()), &payload)
+		if err != nil {
+			g.raiseError(errors.New("Token payload must be an object"))
+			return otto.FalseValue()
+		}
+
+		if call.Argument(2).IsNumber() {
+			expireSeconds, _ := call.Argument(2).ToInteger()
+			payload["iat"] = time.Now().Unix()
+			payload["exp"] = time.Now().Unix() + expireSeconds
+		}
+
+		js, _ := json.Marshal(payload)
+		reply, _ := vm.ToValue(jwtSign(js, secret))
+		return reply
+	})
+
+	//jwtVerify(token, secret) => return payload object or false if the token is invalid or expired
+	vm.Set("_cryptolib_jwtVerify", func(call otto.FunctionCall) otto.Value {
+		token, _ := call.Argument(0).ToString()
+		secret, err := call.Argument(1).ToString()
+		if err != nil || secret == "" {
+			g.raiseError(errors.New("Invalid token secret"))
+			return otto.FalseValue()
+		}
+
+		payload, err := jwtVerify(token, secret)
+		if err != nil {
+			return otto.FalseValue()
+		}
+
+		js, _ := json.Marshal(payload)
+		reply, err := vm.Object("(" + string(js) + ")")
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+		return reply.Value()
+	})
+
+	//Wrap all the native code function into a cryptolib class
+	vm.Run(`
+		var cryptolib = {};
+		cryptolib.encrypt = _cryptolib_encrypt;
+		cryptolib.decrypt = _cryptolib_decrypt;
+		cryptolib.encryptFile = _cryptolib_encryptFile;
+		cryptolib.decryptFile = _cryptolib_decryptFile;
+		cryptolib.randomBytes = _cryptolib_randomBytes;
+		cryptolib.hmac = _cryptolib_hmac;
+		cryptolib.jwtSign = _cryptolib_jwtSign;
+		cryptolib.jwtVerify = _cryptolib_jwtVerify;
+	`)
+}
@@ -30,6 +30,9 @@ func (g *Gateway) FileLibRegister() {
 }
 
 func (g *Gateway) injectFileLibFunctions(vm *otto.Otto, u *user.User) {
+	//Resolve the virtual paths within the file scopes allowed by the module capabilities
+	virtualPathToRealPath := g.getScopedPathResolver(vm)
+
 
 	//Legacy File system API
 	//writeFile(virtualFilepath, content) => return true/false when succeed / failed
@@ -53,6 +56,13 @@ func (g *Gateway) injectFileLibFunctions(vm *otto.Otto, u *user.User) {
 			return reply
 		}
 
+		//Check if the script is allowed to write this much
+		if err := g.chargeBytesWritten(vm, int64(len(content))); err != nil {
+			g.raiseError(err)
+			reply, _ := vm.ToValue(false)
+			return reply
+		}
+
 		//Check if there is quota for the given length
 		if !u.StorageQuota.HaveSpace(int64(len(content))) {
 			//User have no remaining storage quota
@@ -533,8 +543,31 @@ func (g *Gateway) injectFileLibFunctions(vm *otto.Otto, u *user.User) {
 
 	//Get MD5 of the given filepath
 	vm.Set("_filelib_md5", func(call otto.FunctionCall) otto.Value {
-		log.Println("Call to MD5 Functions!")
-		return otto.FalseValue()
+		vpath, err := call.Argument(0).ToString()
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		//Check for permission
+		if !u.CanRead(vpath) {
+			panic(vm.MakeCustomError("PermissionDenied", "Path access denied: "+vpath))
+		}
+
+		rpath, err := virtualPathToRealPath(vpath, u)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		result, err := hashFile("md5", rpath)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		reply, _ := vm.ToValue(result)
+		return reply
 	})
 
 	//Get the root name of the given virtual path root
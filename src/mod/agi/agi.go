@@ -7,13 +7,16 @@ import (
 	"net/http"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/robertkrimen/otto"
 
 	apt "imuslab.com/arozos/mod/apt"
 	auth "imuslab.com/arozos/mod/auth"
 	metadata "imuslab.com/arozos/mod/filesystem/metadata"
+	"imuslab.com/arozos/mod/event"
 	"imuslab.com/arozos/mod/iot"
+	"imuslab.com/arozos/mod/music"
 	user "imuslab.com/arozos/mod/user"
 )
 
@@ -26,7 +29,10 @@ import (
 */
 
 var (
-	AgiVersion string = "1.5" //Defination of the agi runtime version. Update this when new function is added
+	AgiVersion string = "1.6" //Defination of the agi runtime version. Update this when new function is added
+
+	//System tables that cannot be accessed by AGI scripts with the database functions
+	DefaultReservedTables = []string{"auth", "permisson", "desktop", "agi-limits", "agi-jobs", "agi-capabilities", "agi-webhooks", "module", "module-packages", "module-trustedkeys", "acme", "dynamicproxy", "sftp", "dlna", "cluster", "nearby", "bandwidth"}
 )
 
 type AgiLibIntergface func(*otto.Otto, *user.User) //Define the lib loader interface for AGI Libraries
@@ -48,6 +54,12 @@ type AgiSysInfo struct {
 	AuthAgent            *auth.AuthAgent
 	FileSystemRender     *metadata.RenderHandler
 	IotManager           *iot.Manager
+	MusicLibrary         *music.Manager
+	DefaultLimit         ExecutionLimit //Execution limit for modules and scripts without their own limit
+	JobRetention         int64          //Time in seconds to keep the records of finished execd jobs
+	EventBus             *event.EventBus
+	DefaultKVQuota       int64         //Default storage quota in bytes of each module key-value namespace, 0 = unlimited
+	DefaultCapabilities  *Capabilities //Capabilities of modules without manifest and scripts not belongs to any module, nil for DefaultCapabilities
 
 	//Scanning Roots
 	StartupRoot   string
@@ -59,6 +71,16 @@ type Gateway struct {
 	AllowAccessPkgs  map[string][]AgiPackage
 	LoadedAGILibrary map[string]AgiLibIntergface
 	Option           *AgiSysInfo
+	runningVMs       sync.Map //Execution context of the running vms
+	jobManager       *jobManager
+
+	declaredCapabilities map[string]*Capabilities //Capabilities declared by modules, key is the module root folder
+	capabilityMutex      sync.Mutex
+
+	eventHandlers map[string][]*EventHandlerScript //Event handler scripts registered by modules, key is the event type
+	eventMutex    sync.Mutex
+
+	webhookRateCounters sync.Map //Rate limit counters of the webhooks, key is the webhook ID
 }
 
 func NewGateway(option AgiSysInfo) (*Gateway, error) {
@@ -69,19 +91,35 @@ func NewGateway(option AgiSysInfo) (*Gateway, error) {
 		AllowAccessPkgs:  map[string][]AgiPackage{},
 		LoadedAGILibrary: map[string]AgiLibIntergface{},
 		Option:           &option,
+
+		declaredCapabilities: map[string]*Capabilities{},
+		eventHandlers:        map[string][]*EventHandlerScript{},
 	}
 
-	for _, script := range startupScripts {
-		scriptContentByte, _ := ioutil.ReadFile(script)
-		scriptContent := string(scriptContentByte)
-		log.Println("[AGI] Gateway script loaded (" + script + ")")
-		//Create a new vm for this request
-		vm := otto.New()
+	if option.DefaultCapabilities == nil {
+		option.DefaultCapabilities = &DefaultCapabilities
+	}
 
-		//Only allow non user based operations
-		gatewayObject.injectStandardLibs(vm, script, "./web/")
+	//Create the table for module execution limits
+	option.UserHandler.GetDatabase().NewTable("agi-limits")
 
-		_, err := vm.Run(scriptContent)
+	//Load the records of execd jobs
+	gatewayObject.loadJobs()
+
+	//Create the table for approved module capabilities
+	option.UserHandler.GetDatabase().NewTable("agi-capabilities")
+
+	//Create the table for the webhooks published by users
+	option.UserHandler.GetDatabase().NewTable("agi-webhooks")
+
+	//Create the tables for module key-value storage and database table ownership
+	option.UserHandler.GetDatabase().NewTable(kvTableName)
+	option.UserHandler.GetDatabase().NewTable(kvQuotaTableName)
+	option.UserHandler.GetDatabase().NewTable(kvOwnerTableName)
+
+	for _, script := range startupScripts {
+		log.Println("[AGI] Gateway script loaded (" + script + ")")
+		err := gatewayObject.RunModuleInitScript(script)
 		if err != nil {
 			log.Println("[AGI] Load Failed: " + script + ". Skipping.")
 			log.Println(err)
@@ -95,6 +133,12 @@ func NewGateway(option AgiSysInfo) (*Gateway, error) {
 	gatewayObject.HTTPLibRegister()
 	gatewayObject.IoTLibRegister()
 	gatewayObject.AppdataLibRegister()
+	gatewayObject.TagLibRegister()
+	gatewayObject.MusicLibRegister()
+	gatewayObject.ArchiveLibRegister()
+	gatewayObject.HashLibRegister()
+	gatewayObject.CryptoLibRegister()
+	gatewayObject.KVLibRegister()
 
 	return &gatewayObject, nil
 }
@@ -106,7 +150,7 @@ func (g *Gateway) RunScript(script string) error {
 	//Only allow non user based operations
 	g.injectStandardLibs(vm, "", "./web/")
 
-	_, err := vm.Run(script)
+	_, err := g.runWithLimit(vm, script, "", g.Option.DefaultLimit, "", "system")
 	if err != nil {
 		log.Println("[AGI] Script Execution Failed: ", err.Error())
 		return err
@@ -139,6 +183,11 @@ func (g *Gateway) filterDBTable(tablename string, existsCheck bool) bool {
 		return false
 	}
 
+	//Module storage can only be accessed with kvlib
+	if tablename == kvTableName || tablename == kvQuotaTableName || tablename == kvOwnerTableName {
+		return false
+	}
+
 	//Check if table exists
 	if existsCheck {
 		if !g.Option.UserHandler.GetDatabase().TableExists(tablename) {
@@ -240,14 +289,17 @@ func (g *Gateway) ExecuteAGIScript(scriptContent string, scriptFile string, scri
 	g.injectStandardLibs(vm, scriptFile, scriptScope)
 	g.injectUserFunctions(vm, scriptFile, scriptScope, thisuser, w, r)
 
+	//Expose the request and response objects
+	body := readRequestBody(r)
+	g.injectRequestObject(vm, r, body, thisuser)
+	resp := g.injectResponseObject(vm, w, r, thisuser)
+
 	//Detect cotent type
 	contentType := r.Header.Get("Content-type")
 	if strings.Contains(contentType, "application/json") {
 		//For shitty people who use Angular
-		body, _ := ioutil.ReadAll(r.Body)
 		vm.Set("POST_data", string(body))
 	} else {
-		r.ParseForm()
 		//Insert all paramters into the vm
 		for k, v := range r.PostForm {
 			if len(v) == 1 {
@@ -259,36 +311,31 @@ func (g *Gateway) ExecuteAGIScript(scriptContent string, scriptFile string, scri
 		}
 	}
 
-	_, err := vm.Run(scriptContent)
-	if err != nil {
-		scriptpath, _ := filepath.Abs(scriptFile)
-		g.RenderErrorTemplate(w, err.Error(), scriptpath)
-		return
+	moduleName := ""
+	if scriptFile != "" {
+		moduleName = getScriptRoot(scriptFile, scriptScope)
 	}
 
-	//Get the return valu from the script
-	value, err := vm.Get("HTTP_RESP")
+	_, err := g.runWithLimit(vm, scriptContent, moduleName, g.GetModuleExecutionLimit(moduleName), scriptFile, thisuser.Username)
 	if err != nil {
-		sendTextResponse(w, "")
+		if resp.committed {
+			//Part of the response is already sent. Nothing else can be done
+			return
+		}
+		scriptpath, _ := filepath.Abs(scriptFile)
+		g.RenderErrorTemplate(w, err.Error(), scriptpath)
 		return
 	}
-	valueString, err := value.ToString()
-
-	//Get respond header type from the vm
-	header, _ := vm.Get("HTTP_HEADER")
-	headerString, _ := header.ToString()
-	if headerString != "" {
-		w.Header().Set("Content-Type", headerString)
-	}
 
-	w.Write([]byte(valueString))
+	resp.finish()
 }
 
 /*
-	Execute AGI script with given user information
+	Execute AGI script with given user information.
+	Pass in nil limit to use the system default limit
 
 */
-func (g *Gateway) ExecuteAGIScriptAsUser(scriptFile string, targetUser *user.User) (string, error) {
+func (g *Gateway) ExecuteAGIScriptAsUser(scriptFile string, targetUser *user.User, limit *ExecutionLimit) (string, error) {
 	//Create a new vm for this request
 	vm := otto.New()
 	//Inject standard libs into the vm
@@ -301,7 +348,11 @@ func (g *Gateway) ExecuteAGIScriptAsUser(scriptFile string, targetUser *user.Use
 		return "", err
 	}
 
-	_, err = vm.Run(scriptContent)
+	if limit == nil {
+		limit = &g.Option.DefaultLimit
+	}
+
+	_, err = g.runWithLimit(vm, scriptContent, g.getScriptModule(scriptFile), *limit, scriptFile, targetUser.Username)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,144 @@
+package agi
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/robertkrimen/otto"
+	fs "imuslab.com/arozos/mod/filesystem"
+	user "imuslab.com/arozos/mod/user"
+)
+
+/*
+	AJGI Hash Library
+
+	This is a library for calculating the hash of strings and files in agi scripts.
+	Supported algorithms: md5, sha1, sha256, sha512 and crc32
+*/
+
+func (g *Gateway) HashLibRegister() {
+	err := g.RegisterLib("hashlib", g.injectHashLibFunctions)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+//Create a new hash function from the algorithm name
+func newHash(algorithm string) (hash.Hash, error) {
+	switch strings.ToLower(algorithm) {
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	case "crc32":
+		return crc32.NewIEEE(), nil
+	}
+	return nil, errors.New("Unsupported hash algorithm: " + algorithm)
+}
+
+//Get the hash of the given file in hex string
+func hashFile(algorithm string, filename string) (string, error) {
+	h, err := newHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (g *Gateway) injectHashLibFunctions(vm *otto.Otto, u *user.User) {
+	//Resolve the virtual paths within the file scopes allowed by the module capabilities
+	virtualPathToRealPath := g.getScopedPathResolver(vm)
+
+	//hash(algorithm, content) => return hash of the string in hex
+	vm.Set("_hashlib_hash", func(call otto.FunctionCall) otto.Value {
+		algorithm, _ := call.Argument(0).ToString()
+		content, err := call.Argument(1).ToString()
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		h, err := newHash(algorithm)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		h.Write([]byte(content))
+		reply, _ := vm.ToValue(hex.EncodeToString(h.Sum(nil)))
+		return reply
+	})
+
+	//hashFile(algorithm, vpath) => return hash of the file in hex
+	vm.Set("_hashlib_hashFile", func(call otto.FunctionCall) otto.Value {
+		algorithm, _ := call.Argument(0).ToString()
+		vpath, err := call.Argument(1).ToString()
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		//Check for permission
+		if !u.CanRead(vpath) {
+			panic(vm.MakeCustomError("PermissionDenied", "Path access denied: "+vpath))
+		}
+
+		rpath, err := virtualPathToRealPath(vpath, u)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		if !fileExists(rpath) || fs.IsDir(rpath) {
+			g.raiseError(errors.New("File not exists: " + vpath))
+			return otto.FalseValue()
+		}
+
+		result, err := hashFile(algorithm, rpath)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		reply, _ := vm.ToValue(result)
+		return reply
+	})
+
+	//Wrap all the native code function into a hashlib class
+	vm.Run(`
+		var hashlib = {};
+		hashlib.hash = _hashlib_hash;
+		hashlib.hashFile = _hashlib_hashFile;
+		hashlib.md5 = function(content){ return _hashlib_hash("md5", content); };
+		hashlib.sha1 = function(content){ return _hashlib_hash("sha1", content); };
+		hashlib.sha256 = function(content){ return _hashlib_hash("sha256", content); };
+		hashlib.sha512 = function(content){ return _hashlib_hash("sha512", content); };
+		hashlib.crc32 = function(content){ return _hashlib_hash("crc32", content); };
+	`)
+}
@@ -40,8 +40,18 @@ func (g *Gateway) injectHTTPFunctions(vm *otto.Otto, u *user.User) {
 			return otto.NullValue()
 		}
 
+		if err := g.checkHTTPRequest(vm, url); err != nil {
+			g.raiseError(err)
+			return otto.NullValue()
+		}
+
+		if err := g.chargeHTTPCall(vm); err != nil {
+			g.raiseError(err)
+			return otto.NullValue()
+		}
+
 		//Get respond of the url
-		res, err := http.Get(url)
+		res, err := g.getHTTPClient(vm).Get(url)
 		if err != nil {
 			return otto.NullValue()
 		}
@@ -84,8 +94,18 @@ func (g *Gateway) injectHTTPFunctions(vm *otto.Otto, u *user.User) {
 
 		req.Header.Set("Content-Type", "application/json")
 
+		if err := g.checkHTTPRequest(vm, url); err != nil {
+			g.raiseError(err)
+			return otto.NullValue()
+		}
+
+		if err := g.chargeHTTPCall(vm); err != nil {
+			g.raiseError(err)
+			return otto.NullValue()
+		}
+
 		//Send the request
-		client := &http.Client{}
+		client := g.getHTTPClient(vm)
 		resp, err := client.Do(req)
 		if err != nil {
 			log.Println(err)
@@ -110,8 +130,18 @@ func (g *Gateway) injectHTTPFunctions(vm *otto.Otto, u *user.User) {
 			return otto.NullValue()
 		}
 
+		if err := g.checkHTTPRequest(vm, url); err != nil {
+			g.raiseError(err)
+			return otto.NullValue()
+		}
+
+		if err := g.chargeHTTPCall(vm); err != nil {
+			g.raiseError(err)
+			return otto.NullValue()
+		}
+
 		//Request the url
-		resp, err := http.Get(url)
+		resp, err := g.getHTTPClient(vm).Get(url)
 		if err != nil {
 			return otto.NullValue()
 		}
@@ -155,7 +185,7 @@ func (g *Gateway) injectHTTPFunctions(vm *otto.Otto, u *user.User) {
 		}
 
 		//Check user acess permission
-		if !u.CanWrite(vpath) {
+		if !u.CanWrite(vpath) || !g.capabilityAllowFile(vm, vpath) {
 			g.raiseError(errors.New("Permission Denied"))
 			return otto.FalseValue()
 		}
@@ -173,8 +203,18 @@ func (g *Gateway) injectHTTPFunctions(vm *otto.Otto, u *user.User) {
 
 		downloadDest := filepath.Join(rpath, filename)
 
+		if err := g.checkHTTPRequest(vm, decodedURL); err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		if err := g.chargeHTTPCall(vm); err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
 		//Ok. Download the file
-		resp, err := http.Get(decodedURL)
+		resp, err := g.getHTTPClient(vm).Get(decodedURL)
 		if err != nil {
 			return otto.FalseValue()
 		}
@@ -187,8 +227,21 @@ func (g *Gateway) injectHTTPFunctions(vm *otto.Otto, u *user.User) {
 		}
 		defer out.Close()
 
-		// Write the body to file
-		_, err = io.Copy(out, resp.Body)
+		// Write the body to file, stop when the script reaches its write limit
+		var written int64
+		remaining := g.remainingWriteBytes(vm)
+		if remaining >= 0 {
+			written, err = io.CopyN(out, resp.Body, remaining+1)
+		} else {
+			written, err = io.Copy(out, resp.Body)
+		}
+
+		if err := g.chargeBytesWritten(vm, written); err != nil {
+			out.Close()
+			os.Remove(downloadDest)
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
 		return otto.TrueValue()
 	})
 
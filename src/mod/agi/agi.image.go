@@ -36,6 +36,9 @@ func (g *Gateway) ImageLibRegister() {
 }
 
 func (g *Gateway) injectImageLibFunctions(vm *otto.Otto, u *user.User) {
+	//Resolve the virtual paths within the file scopes allowed by the module capabilities
+	virtualPathToRealPath := g.getScopedPathResolver(vm)
+
 
 	//Get image dimension, requires filepath (virtual)
 	vm.Set("_imagelib_getImageDimension", func(call otto.FunctionCall) otto.Value {
@@ -138,6 +141,11 @@ func (g *Gateway) injectImageLibFunctions(vm *otto.Otto, u *user.User) {
 			g.raiseError(err)
 			return otto.FalseValue()
 		}
+
+		if err := g.chargeFileWritten(vm, rdest); err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
 		return otto.TrueValue()
 	})
 
@@ -228,6 +236,11 @@ func (g *Gateway) injectImageLibFunctions(vm *otto.Otto, u *user.User) {
 
 		out.Close()
 
+		if err := g.chargeFileWritten(vm, rdest); err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
 		return otto.TrueValue()
 	})
 
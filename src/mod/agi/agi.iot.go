@@ -111,7 +111,7 @@ func (g *Gateway) injectIoTFunctions(vm *otto.Otto, u *user.User) {
 
 		//We have no idea what is the structure of the dev status.
 		//Just leave it to the front end to handle :P
-		devStatus, err := dev.Handler.Status(dev)
+		devStatus, err := g.Option.IotManager.GetDeviceStatus(dev)
 		if err != nil {
 			log.Println("*AGI IoT* " + err.Error())
 			return otto.FalseValue()
@@ -0,0 +1,205 @@
+package agi
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/robertkrimen/otto"
+	user "imuslab.com/arozos/mod/user"
+)
+
+/*
+	AGI Key-Value Storage Library
+
+	Isolated key-value storage of the module. Values can be any JSON serializable value.
+	kvlib.xxx functions use the namespace shared by all users of the module and
+	kvlib.user.xxx functions use the private namespace of the current user.
+
+	kvlib.get(key)                        => value or null
+	kvlib.set(key, value)                 => true, throw QuotaExceeded if quota is full
+	kvlib.delete(key)                     => true
+	kvlib.cas(key, expected, value)       => true if swapped. null expected = key not exists, null value = delete
+	kvlib.list(prefix, limit)             => [{key, value}] in key order
+	kvlib.range(start, end, limit)        => [{key, value}] with start <= key < end
+	kvlib.usage()                         => {used, quota} in bytes, quota 0 = unlimited
+*/
+
+func (g *Gateway) KVLibRegister() {
+	err := g.RegisterLib("kvlib", g.injectKVLibFunctions)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (g *Gateway) injectKVLibFunctions(vm *otto.Otto, u *user.User) {
+	//Resolve the namespace from the scope argument of the internal functions
+	getNamespace := func(call otto.FunctionCall) *KVNamespace {
+		context := g.getExecutionContext(vm)
+		if context == nil || context.module == "" {
+			panic(vm.MakeCustomError("PermissionDenied", "kvlib is only available to module scripts"))
+		}
+
+		scope, _ := call.Argument(0).ToString()
+		if scope == "user" {
+			if u == nil {
+				panic(vm.MakeCustomError("PermissionDenied", "User namespace is not available without user"))
+			}
+			return g.GetKVNamespace(context.module, u.Username)
+		}
+		return g.GetKVNamespace(context.module, "")
+	}
+
+	//Serialize the javascript value into JSON
+	encodeValue := func(value otto.Value) []byte {
+		if value.IsUndefined() || value.IsNull() {
+			return nil
+		}
+
+		exported, err := value.Export()
+		if err != nil {
+			panic(vm.MakeTypeError("Value cannot be stored: " + err.Error()))
+		}
+		js, err := json.Marshal(exported)
+		if err != nil {
+			panic(vm.MakeTypeError("Value cannot be stored: " + err.Error()))
+		}
+		return js
+	}
+
+	//Convert the stored JSON back into javascript value
+	decodeValue := func(js []byte) otto.Value {
+		if js == nil {
+			return otto.NullValue()
+		}
+		value, err := vm.Call("JSON.parse", nil, string(js))
+		if err != nil {
+			g.raiseError(err)
+			return otto.NullValue()
+		}
+		return value
+	}
+
+	entriesToValue := func(entries []KVEntry) otto.Value {
+		js, _ := json.Marshal(entries)
+		obj, err := vm.Object("(" + string(js) + ")")
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+		return obj.Value()
+	}
+
+	//Handle the errors from the store. Quota errors are thrown so scripts can catch them
+	handleError := func(err error) otto.Value {
+		if _, ok := err.(*KVQuotaExceededError); ok {
+			panic(vm.MakeCustomError("QuotaExceeded", err.Error()))
+		}
+		g.raiseError(err)
+		return otto.FalseValue()
+	}
+
+	vm.Set("_kvlib_get", func(call otto.FunctionCall) otto.Value {
+		namespace := getNamespace(call)
+		key, _ := call.Argument(1).ToString()
+		value, err := namespace.Get(key)
+		if err != nil {
+			return handleError(err)
+		}
+		return decodeValue(value)
+	})
+
+	vm.Set("_kvlib_set", func(call otto.FunctionCall) otto.Value {
+		namespace := getNamespace(call)
+		key, _ := call.Argument(1).ToString()
+		value := encodeValue(call.Argument(2))
+		var err error
+		if value == nil {
+			err = namespace.Delete(key)
+		} else {
+			err = namespace.Set(key, value)
+		}
+		if err != nil {
+			return handleError(err)
+		}
+		return otto.TrueValue()
+	})
+
+	vm.Set("_kvlib_delete", func(call otto.FunctionCall) otto.Value {
+		namespace := getNamespace(call)
+		key, _ := call.Argument(1).ToString()
+		err := namespace.Delete(key)
+		if err != nil {
+			return handleError(err)
+		}
+		return otto.TrueValue()
+	})
+
+	vm.Set("_kvlib_cas", func(call otto.FunctionCall) otto.Value {
+		namespace := getNamespace(call)
+		key, _ := call.Argument(1).ToString()
+		swapped, err := namespace.CompareAndSwap(key, encodeValue(call.Argument(2)), encodeValue(call.Argument(3)))
+		if err != nil {
+			return handleError(err)
+		}
+		reply, _ := vm.ToValue(swapped)
+		return reply
+	})
+
+	vm.Set("_kvlib_scan", func(call otto.FunctionCall) otto.Value {
+		namespace := getNamespace(call)
+		prefix := ""
+		if !call.Argument(1).IsUndefined() && !call.Argument(1).IsNull() {
+			prefix, _ = call.Argument(1).ToString()
+		}
+		start := ""
+		if !call.Argument(2).IsUndefined() && !call.Argument(2).IsNull() {
+			start, _ = call.Argument(2).ToString()
+		}
+		end := ""
+		if !call.Argument(3).IsUndefined() && !call.Argument(3).IsNull() {
+			end, _ = call.Argument(3).ToString()
+		}
+		limit := int64(0)
+		if call.Argument(4).IsNumber() {
+			limit, _ = call.Argument(4).ToInteger()
+		}
+
+		entries, err := namespace.Scan(prefix, start, end, int(limit))
+		if err != nil {
+			return handleError(err)
+		}
+		return entriesToValue(entries)
+	})
+
+	vm.Set("_kvlib_usage", func(call otto.FunctionCall) otto.Value {
+		namespace := getNamespace(call)
+		used, err := namespace.Usage()
+		if err != nil {
+			return handleError(err)
+		}
+		js, _ := json.Marshal(map[string]int64{
+			"used":  used,
+			"quota": namespace.Quota(),
+		})
+		obj, _ := vm.Object("(" + string(js) + ")")
+		return obj.Value()
+	})
+
+	//Wrap all the native code function into a kvlib class
+	vm.Run(`
+		var kvlib = {};
+		var _kvlib_namespace = function(scope){
+			return {
+				get: function(key){ return _kvlib_get(scope, key); },
+				set: function(key, value){ return _kvlib_set(scope, key, value); },
+				delete: function(key){ return _kvlib_delete(scope, key); },
+				cas: function(key, expected, value){ return _kvlib_cas(scope, key, expected, value); },
+				list: function(prefix, limit){ return _kvlib_scan(scope, prefix, null, null, limit); },
+				range: function(start, end, limit){ return _kvlib_scan(scope, null, start, end, limit); },
+				usage: function(){ return _kvlib_usage(scope); }
+			};
+		};
+		kvlib = _kvlib_namespace("module");
+		kvlib.user = _kvlib_namespace("user");
+	`)
+}
@@ -0,0 +1,411 @@
+package agi
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"path"
+
+	"github.com/robertkrimen/otto"
+	"imuslab.com/arozos/mod/music"
+	user "imuslab.com/arozos/mod/user"
+)
+
+/*
+	AJGI Music Library
+
+	This is a library for browsing the user music library, managing playlists
+	and the play queue in agi scripts. Results are passed to the VM as JSON
+	and parsed in the wrapper functions
+
+	Author: tobychui
+*/
+
+func (g *Gateway) MusicLibRegister() {
+	err := g.RegisterLib("musiclib", g.injectMusicLibFunctions)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (g *Gateway) injectMusicLibFunctions(vm *otto.Otto, u *user.User) {
+	//Resolve the virtual paths within the file scopes allowed by the module capabilities
+	virtualPathToRealPath := g.getScopedPathResolver(vm)
+
+	//Return the given object as JSON string value
+	jsonReply := func(object interface{}) otto.Value {
+		js, _ := json.Marshal(object)
+		reply, _ := vm.ToValue(string(js))
+		return reply
+	}
+
+	//Get an array of strings from the given argument
+	getStringArray := func(value otto.Value) []string {
+		results := []string{}
+		exported, err := value.Export()
+		if err != nil {
+			return results
+		}
+		if itemArray, ok := exported.([]interface{}); ok {
+			for _, item := range itemArray {
+				if itemString, ok := item.(string); ok {
+					results = append(results, itemString)
+				}
+			}
+		} else if itemArray, ok := exported.([]string); ok {
+			results = itemArray
+		}
+		return results
+	}
+
+	libraryReady := func() bool {
+		if g.Option.MusicLibrary == nil {
+			g.raiseError(errors.New("Music library not ready"))
+			return false
+		}
+		return true
+	}
+
+	vm.Set("_musiclib_ready", func(call otto.FunctionCall) otto.Value {
+		if g.Option.MusicLibrary == nil {
+			return otto.FalseValue()
+		}
+		return otto.TrueValue()
+	})
+
+	//scan() => start scanning the user library in the background
+	vm.Set("_musiclib_scan", func(call otto.FunctionCall) otto.Value {
+		if !libraryReady() {
+			return otto.FalseValue()
+		}
+		g.Option.MusicLibrary.ScanInBackground(u)
+		return otto.TrueValue()
+	})
+
+	//getFolders() / setFolders(["user:/Music/"]) => get or set the library folders
+	vm.Set("_musiclib_getFolders", func(call otto.FunctionCall) otto.Value {
+		if !libraryReady() {
+			return otto.FalseValue()
+		}
+		return jsonReply(g.Option.MusicLibrary.GetLibraryFolders(u.Username))
+	})
+
+	vm.Set("_musiclib_setFolders", func(call otto.FunctionCall) otto.Value {
+		if !libraryReady() {
+			return otto.FalseValue()
+		}
+		err := g.Option.MusicLibrary.SetLibraryFolders(u, getStringArray(call.Argument(0)))
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+		return otto.TrueValue()
+	})
+
+	//getTracks({album: "", artist: "", keyword: ""}) => return the tracks in the library
+	vm.Set("_musiclib_getTracks", func(call otto.FunctionCall) otto.Value {
+		if !libraryReady() {
+			return otto.FalseValue()
+		}
+
+		tracks := g.Option.MusicLibrary.ListUserTracks(u)
+		if call.Argument(0).IsObject() {
+			filter := call.Argument(0).Object()
+			album, artist, keyword := "", "", ""
+			if value, err := filter.Get("album"); err == nil && value.IsDefined() {
+				album, _ = value.ToString()
+			}
+			if value, err := filter.Get("artist"); err == nil && value.IsDefined() {
+				artist, _ = value.ToString()
+			}
+			if value, err := filter.Get("keyword"); err == nil && value.IsDefined() {
+				keyword, _ = value.ToString()
+			}
+
+			if album != "" {
+				tracks = music.FilterAlbum(tracks, album, artist)
+			} else if artist != "" {
+				tracks = music.FilterArtist(tracks, artist)
+			}
+			if keyword != "" {
+				tracks = music.Search(tracks, keyword)
+			}
+		}
+
+		return jsonReply(tracks)
+	})
+
+	//getTrack(vpath) => return the track information of the given file
+	vm.Set("_musiclib_getTrack", func(call otto.FunctionCall) otto.Value {
+		if !libraryReady() {
+			return otto.FalseValue()
+		}
+		vpath, _ := call.Argument(0).ToString()
+		thisTrack, err := g.Option.MusicLibrary.GetTrack(u, vpath)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+		return jsonReply(thisTrack)
+	})
+
+	//getAlbums() / getArtists() => return the albums and artists in the library
+	vm.Set("_musiclib_getAlbums", func(call otto.FunctionCall) otto.Value {
+		if !libraryReady() {
+			return otto.FalseValue()
+		}
+		return jsonReply(music.GroupAlbums(g.Option.MusicLibrary.ListUserTracks(u)))
+	})
+
+	vm.Set("_musiclib_getArtists", func(call otto.FunctionCall) otto.Value {
+		if !libraryReady() {
+			return otto.FalseValue()
+		}
+		return jsonReply(music.GroupArtists(g.Option.MusicLibrary.ListUserTracks(u)))
+	})
+
+	//recordPlay(vpath) => increase the play count of the given track
+	vm.Set("_musiclib_recordPlay", func(call otto.FunctionCall) otto.Value {
+		if !libraryReady() {
+			return otto.FalseValue()
+		}
+		vpath, _ := call.Argument(0).ToString()
+		if !u.CanRead(vpath) {
+			panic(vm.MakeCustomError("PermissionDenied", "Path access denied: "+vpath))
+		}
+		playRecord, err := g.Option.MusicLibrary.RecordPlay(u.Username, vpath)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+		return jsonReply(playRecord)
+	})
+
+	//getPlaylists() => return all playlists of the user
+	vm.Set("_musiclib_getPlaylists", func(call otto.FunctionCall) otto.Value {
+		if !libraryReady() {
+			return otto.FalseValue()
+		}
+		return jsonReply(g.Option.MusicLibrary.ListPlaylists(u.Username))
+	})
+
+	//getPlaylist(playlistID) => return the playlist with the given ID
+	vm.Set("_musiclib_getPlaylist", func(call otto.FunctionCall) otto.Value {
+		if !libraryReady() {
+			return otto.FalseValue()
+		}
+		playlistID, _ := call.Argument(0).ToString()
+		playlist, err := g.Option.MusicLibrary.GetPlaylist(u.Username, playlistID)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+		return jsonReply(playlist)
+	})
+
+	//createPlaylist(name, [vpaths]) => return the created playlist
+	vm.Set("_musiclib_createPlaylist", func(call otto.FunctionCall) otto.Value {
+		if !libraryReady() {
+			return otto.FalseValue()
+		}
+		name, _ := call.Argument(0).ToString()
+		tracks := []string{}
+		for _, vpath := range getStringArray(call.Argument(1)) {
+			if u.CanRead(vpath) && music.IsAudio(vpath) {
+				tracks = append(tracks, vpath)
+			}
+		}
+		playlist, err := g.Option.MusicLibrary.CreatePlaylist(u.Username, name, tracks)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+		return jsonReply(playlist)
+	})
+
+	//setPlaylistTracks(playlistID, [vpaths]) => overwrite the tracks of the playlist
+	vm.Set("_musiclib_setPlaylistTracks", func(call otto.FunctionCall) otto.Value {
+		if !libraryReady() {
+			return otto.FalseValue()
+		}
+		playlistID, _ := call.Argument(0).ToString()
+		playlist, err := g.Option.MusicLibrary.GetPlaylist(u.Username, playlistID)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		playlist.Tracks = []string{}
+		for _, vpath := range getStringArray(call.Argument(1)) {
+			if u.CanRead(vpath) && music.IsAudio(vpath) {
+				playlist.Tracks = append(playlist.Tracks, vpath)
+			}
+		}
+
+		err = g.Option.MusicLibrary.SavePlaylist(playlist)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+		return otto.TrueValue()
+	})
+
+	//deletePlaylist(playlistID) => return true when succeed
+	vm.Set("_musiclib_deletePlaylist", func(call otto.FunctionCall) otto.Value {
+		if !libraryReady() {
+			return otto.FalseValue()
+		}
+		playlistID, _ := call.Argument(0).ToString()
+		err := g.Option.MusicLibrary.DeletePlaylist(u.Username, playlistID)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+		return otto.TrueValue()
+	})
+
+	//importPlaylist(vpath) => import a m3u / pls file as new playlist
+	vm.Set("_musiclib_importPlaylist", func(call otto.FunctionCall) otto.Value {
+		if !libraryReady() {
+			return otto.FalseValue()
+		}
+		vpath, _ := call.Argument(0).ToString()
+		if !u.CanRead(vpath) {
+			panic(vm.MakeCustomError("PermissionDenied", "Path access denied: "+vpath))
+		}
+
+		rpath, err := virtualPathToRealPath(vpath, u)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		content, err := ioutil.ReadFile(rpath)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		playlist, err := g.Option.MusicLibrary.ImportPlaylist(u, vpath, string(content))
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+		return jsonReply(playlist)
+	})
+
+	//exportPlaylist(playlistID, "m3u", "user:/Music/list.m3u") => write the playlist to file
+	vm.Set("_musiclib_exportPlaylist", func(call otto.FunctionCall) otto.Value {
+		if !libraryReady() {
+			return otto.FalseValue()
+		}
+		playlistID, _ := call.Argument(0).ToString()
+		format, _ := call.Argument(1).ToString()
+		vpath, _ := call.Argument(2).ToString()
+		if !u.CanWrite(vpath) {
+			panic(vm.MakeCustomError("PermissionDenied", "Path access denied: "+vpath))
+		}
+
+		playlist, err := g.Option.MusicLibrary.GetPlaylist(u.Username, playlistID)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		content, err := g.Option.MusicLibrary.ExportPlaylist(u, playlist, format, path.Dir(vpath))
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		rpath, err := virtualPathToRealPath(vpath, u)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		if err := g.chargeBytesWritten(vm, int64(len(content))); err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		if fileExists(rpath) && u.IsOwnerOfFile(rpath) {
+			u.RemoveOwnershipFromFile(rpath)
+		}
+
+		err = ioutil.WriteFile(rpath, []byte(content), 0755)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+		u.SetOwnerOfFile(rpath)
+		return otto.TrueValue()
+	})
+
+	//getQueue() => return the play queue state, including the next track for preloading
+	vm.Set("_musiclib_getQueue", func(call otto.FunctionCall) otto.Value {
+		if !libraryReady() {
+			return otto.FalseValue()
+		}
+		queue := g.Option.MusicLibrary.GetQueue(u.Username)
+		return jsonReply(g.Option.MusicLibrary.GetQueueState(u, queue))
+	})
+
+	//setQueue([vpaths], position) => replace the play queue
+	vm.Set("_musiclib_setQueue", func(call otto.FunctionCall) otto.Value {
+		if !libraryReady() {
+			return otto.FalseValue()
+		}
+
+		tracks := []string{}
+		for _, vpath := range getStringArray(call.Argument(0)) {
+			if u.CanRead(vpath) && music.IsAudio(vpath) {
+				tracks = append(tracks, vpath)
+			}
+		}
+		position, _ := call.Argument(1).ToInteger()
+
+		queue, err := g.Option.MusicLibrary.UpdateQueue(u.Username, func(q *music.Queue) error {
+			q.Tracks = tracks
+			q.Position = int(position)
+			return nil
+		})
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+		return jsonReply(g.Option.MusicLibrary.GetQueueState(u, queue))
+	})
+
+	//Wrap all the native code function into an musiclib class
+	vm.Run(`
+		var musiclib = {};
+		musiclib._parse = function(reply){
+			if (reply === false){
+				return false;
+			}
+			return JSON.parse(reply);
+		};
+		musiclib.ready = _musiclib_ready;
+		musiclib.scan = _musiclib_scan;
+		musiclib.getFolders = function(){ return musiclib._parse(_musiclib_getFolders()); };
+		musiclib.setFolders = _musiclib_setFolders;
+		musiclib.getTracks = function(filter){ return musiclib._parse(_musiclib_getTracks(filter)); };
+		musiclib.getTrack = function(vpath){ return musiclib._parse(_musiclib_getTrack(vpath)); };
+		musiclib.getAlbums = function(){ return musiclib._parse(_musiclib_getAlbums()); };
+		musiclib.getArtists = function(){ return musiclib._parse(_musiclib_getArtists()); };
+		musiclib.search = function(keyword){ return musiclib._parse(_musiclib_getTracks({keyword: keyword})); };
+		musiclib.recordPlay = function(vpath){ return musiclib._parse(_musiclib_recordPlay(vpath)); };
+		musiclib.getPlaylists = function(){ return musiclib._parse(_musiclib_getPlaylists()); };
+		musiclib.getPlaylist = function(id){ return musiclib._parse(_musiclib_getPlaylist(id)); };
+		musiclib.createPlaylist = function(name, tracks){ return musiclib._parse(_musiclib_createPlaylist(name, tracks || [])); };
+		musiclib.setPlaylistTracks = _musiclib_setPlaylistTracks;
+		musiclib.deletePlaylist = _musiclib_deletePlaylist;
+		musiclib.importPlaylist = function(vpath){ return musiclib._parse(_musiclib_importPlaylist(vpath)); };
+		musiclib.exportPlaylist = _musiclib_exportPlaylist;
+		musiclib.getQueue = function(){ return musiclib._parse(_musiclib_getQueue()); };
+		musiclib.setQueue = function(tracks, position){ return musiclib._parse(_musiclib_setQueue(tracks, position || 0)); };
+	`)
+}
+
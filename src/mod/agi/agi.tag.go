@@ -0,0 +1,254 @@
+package agi
+
+import (
+	"errors"
+	"log"
+
+	"github.com/robertkrimen/otto"
+	user "imuslab.com/arozos/mod/user"
+)
+
+/*
+	AJGI File Tag Library
+
+	This is a library for reading and writing user file tags and favourites
+	and searching tagged files in agi scripts.
+*/
+
+func (g *Gateway) TagLibRegister() {
+	err := g.RegisterLib("taglib", g.injectTagLibFunctions)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (g *Gateway) injectTagLibFunctions(vm *otto.Otto, u *user.User) {
+	//Resolve the virtual paths within the file scopes allowed by the module capabilities
+	virtualPathToRealPath := g.getScopedPathResolver(vm)
+
+	//Translate and check the read permission of the given virtual path
+	getTagTargetRealPath := func(call otto.FunctionCall) (string, error) {
+		vpath, err := call.Argument(0).ToString()
+		if err != nil {
+			return "", err
+		}
+
+		if !u.CanRead(vpath) {
+			panic(vm.MakeCustomError("PermissionDenied", "Path access denied: "+vpath))
+		}
+
+		rpath, err := virtualPathToRealPath(vpath, u)
+		if err != nil {
+			return "", err
+		}
+
+		if !fileExists(rpath) {
+			return "", errors.New("File not exists")
+		}
+
+		return rpath, nil
+	}
+
+	//getTags(vpath) => return tags of the file in array
+	vm.Set("_taglib_getTags", func(call otto.FunctionCall) otto.Value {
+		rpath, err := getTagTargetRealPath(call)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		record, err := u.GetFileTags(rpath)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		reply, _ := vm.ToValue(record.Tags)
+		return reply
+	})
+
+	//setTags(vpath, ["tag1", "tag2"]) => return true when succeed
+	vm.Set("_taglib_setTags", func(call otto.FunctionCall) otto.Value {
+		rpath, err := getTagTargetRealPath(call)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		tags := []string{}
+		tagsObject, err := call.Argument(1).Export()
+		if err == nil {
+			if tagArray, ok := tagsObject.([]interface{}); ok {
+				for _, tag := range tagArray {
+					if tagString, ok := tag.(string); ok {
+						tags = append(tags, tagString)
+					}
+				}
+			} else if tagArray, ok := tagsObject.([]string); ok {
+				tags = tagArray
+			}
+		}
+
+		err = u.SetFileTags(rpath, tags)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		return otto.TrueValue()
+	})
+
+	//addTag(vpath, tag) / removeTag(vpath, tag) => return true when succeed
+	vm.Set("_taglib_addTag", func(call otto.FunctionCall) otto.Value {
+		rpath, err := getTagTargetRealPath(call)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		tag, err := call.Argument(1).ToString()
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		record, _ := u.GetFileTags(rpath)
+		err = u.SetFileTags(rpath, append(record.Tags, tag))
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		return otto.TrueValue()
+	})
+
+	vm.Set("_taglib_removeTag", func(call otto.FunctionCall) otto.Value {
+		rpath, err := getTagTargetRealPath(call)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		tag, err := call.Argument(1).ToString()
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		record, _ := u.GetFileTags(rpath)
+		newTags := []string{}
+		for _, thisTag := range record.Tags {
+			if thisTag != tag {
+				newTags = append(newTags, thisTag)
+			}
+		}
+
+		err = u.SetFileTags(rpath, newTags)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		return otto.TrueValue()
+	})
+
+	//isFavourite(vpath) => return true if the file is marked as favourite
+	vm.Set("_taglib_isFavourite", func(call otto.FunctionCall) otto.Value {
+		rpath, err := getTagTargetRealPath(call)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		record, _ := u.GetFileTags(rpath)
+		reply, _ := vm.ToValue(record.Favourite)
+		return reply
+	})
+
+	//setFavourite(vpath, true) => return true when succeed
+	vm.Set("_taglib_setFavourite", func(call otto.FunctionCall) otto.Value {
+		rpath, err := getTagTargetRealPath(call)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		favourite, err := call.Argument(1).ToBoolean()
+		if err != nil {
+			favourite = true
+		}
+
+		err = u.SetFileFavourite(rpath, favourite)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		return otto.TrueValue()
+	})
+
+	//listTags() => return all tags used by the user with its usage counts
+	vm.Set("_taglib_listTags", func(call otto.FunctionCall) otto.Value {
+		reply, _ := vm.ToValue(u.ListAllFileTags())
+		return reply
+	})
+
+	//query({tags: ["invoice"], type: "pdf", days: 30, favourite: false}) => return matching virtual paths
+	vm.Set("_taglib_query", func(call otto.FunctionCall) otto.Value {
+		query := user.FileTagQuery{
+			Tags: []string{},
+		}
+
+		if call.Argument(0).IsObject() {
+			queryObject := call.Argument(0).Object()
+			if tagsValue, err := queryObject.Get("tags"); err == nil && tagsValue.IsDefined() {
+				exported, _ := tagsValue.Export()
+				if tagArray, ok := exported.([]interface{}); ok {
+					for _, tag := range tagArray {
+						if tagString, ok := tag.(string); ok {
+							query.Tags = append(query.Tags, tagString)
+						}
+					}
+				} else if tagArray, ok := exported.([]string); ok {
+					query.Tags = tagArray
+				} else if tagString, ok := exported.(string); ok {
+					query.Tags = []string{tagString}
+				}
+			}
+
+			if typeValue, err := queryObject.Get("type"); err == nil && typeValue.IsDefined() {
+				query.Type, _ = typeValue.ToString()
+			}
+
+			if daysValue, err := queryObject.Get("days"); err == nil && daysValue.IsDefined() {
+				days, _ := daysValue.ToInteger()
+				query.ModifiedWithin = int(days)
+			}
+
+			if favouriteValue, err := queryObject.Get("favourite"); err == nil && favouriteValue.IsDefined() {
+				query.FavouriteOnly, _ = favouriteValue.ToBoolean()
+			}
+		}
+
+		results := []string{}
+		for _, taggedFile := range u.QueryTaggedFiles(&query) {
+			results = append(results, taggedFile.Filepath)
+		}
+
+		reply, _ := vm.ToValue(results)
+		return reply
+	})
+
+	//Wrap all the native code function into an taglib class
+	vm.Run(`
+		var taglib = {};
+		taglib.getTags = _taglib_getTags;
+		taglib.setTags = _taglib_setTags;
+		taglib.addTag = _taglib_addTag;
+		taglib.removeTag = _taglib_removeTag;
+		taglib.isFavourite = _taglib_isFavourite;
+		taglib.setFavourite = _taglib_setFavourite;
+		taglib.listTags = _taglib_listTags;
+		taglib.query = _taglib_query;
+	`)
+}
@@ -0,0 +1,463 @@
+package agitest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	agi "imuslab.com/arozos/mod/agi"
+	apt "imuslab.com/arozos/mod/apt"
+	auth "imuslab.com/arozos/mod/auth"
+	db "imuslab.com/arozos/mod/database"
+	"imuslab.com/arozos/mod/event"
+	fs "imuslab.com/arozos/mod/filesystem"
+	metadata "imuslab.com/arozos/mod/filesystem/metadata"
+	permission "imuslab.com/arozos/mod/permission"
+	storage "imuslab.com/arozos/mod/storage"
+	user "imuslab.com/arozos/mod/user"
+)
+
+/*
+	AGI Test Harness
+
+	Boot an AGI Gateway against a throwaway database and temporary storage pool
+	with fake users, so module developers can run their AGI scripts headlessly
+	and assert on the response, files and database state.
+
+	Usage:
+	h, err := agitest.NewHarness(agitest.Options{
+		ModuleRoot: "./web/MyModule",
+		Users:      []agitest.FakeUser{{Username: "alice"}},
+	})
+	defer h.Close()
+	resp, err := h.RunScript("backend/hello.js", "alice", &agitest.Request{Method: "POST", Form: map[string]string{"name": "alice"}})
+
+	See the agitesting package for the helpers in Go tests.
+*/
+
+type FakeUser struct {
+	Username string `json:"username"`
+	Admin    bool   `json:"admin"` //Put the user into the administrator group
+	Quota    int64  `json:"quota"` //Storage quota in bytes, 0 for unlimited
+}
+
+type Options struct {
+	ModuleRoot        string             //Path to the module folder under test, the folder containing init.agi
+	Users             []FakeUser         //Fake users to create. An admin user "admin" is created if empty
+	Limit             agi.ExecutionLimit //Default execution limit of the scripts
+	PendingCapability bool               //Keep the declared module capabilities pending instead of approving them
+}
+
+type Request struct {
+	Method  string            `json:"method"`  //HTTP method, default GET or POST if form or body is given
+	Query   map[string]string `json:"query"`   //Query string parameters
+	Form    map[string]string `json:"form"`    //Form parameters sent as urlencoded body
+	JSON    interface{}       `json:"json"`    //Object sent as JSON body
+	Body    string            `json:"body"`    //Raw body, used when form and json are empty
+	Headers map[string]string `json:"headers"` //Request headers
+}
+
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       string
+}
+
+type Harness struct {
+	Gateway     *agi.Gateway
+	Database    *db.Database
+	UserHandler *user.UserHandler
+	EventBus    *event.EventBus
+	ModuleName  string //Name of the module folder under test
+	TempDir     string //Temporary folder holding the database and storage
+
+	moduleScope string
+	fsHandlers  []*fs.FileSystemHandler
+	users       []string
+}
+
+//Decode the JSON response body into v
+func (r *Response) DecodeJSON(v interface{}) error {
+	return json.Unmarshal([]byte(r.Body), v)
+}
+
+//Create a new test harness for the given module
+func NewHarness(option Options) (*Harness, error) {
+	moduleRoot, err := filepath.Abs(option.ModuleRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	if info, err := os.Stat(moduleRoot); err != nil || !info.IsDir() {
+		return nil, errors.New("Module root not exists: " + option.ModuleRoot)
+	}
+
+	tempDir, err := ioutil.TempDir("", "agitest")
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Harness{
+		ModuleName:  filepath.Base(moduleRoot),
+		TempDir:     tempDir,
+		moduleScope: filepath.ToSlash(filepath.Join(tempDir, "modules")),
+		EventBus:    event.NewEventBus(),
+	}
+
+	err = h.init(moduleRoot, option)
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *Harness) init(moduleRoot string, option Options) error {
+	//Only the module under test is placed in the startup root, so init.agi of the sibling modules are not executed
+	os.MkdirAll(h.moduleScope, 0755)
+	moduleLink := filepath.Join(h.moduleScope, h.ModuleName)
+	if err := os.Symlink(moduleRoot, moduleLink); err != nil {
+		//Symlink is not available (e.g. Windows without privilege). Copy the module instead
+		err = fs.CopyDir(moduleRoot, moduleLink)
+		if err != nil {
+			return err
+		}
+	}
+
+	//Create the throwaway system database
+	sysdb, err := db.NewDatabase(filepath.Join(h.TempDir, "system.db"), false)
+	if err != nil {
+		return err
+	}
+	h.Database = sysdb
+	sysdb.NewTable("auth")
+
+	//The auth agent only need the database for user records, no session or login logger is required
+	authAgent := &auth.AuthAgent{
+		SessionName: "agitest",
+		Database:    sysdb,
+	}
+
+	permissionHandler, err := permission.NewPermissionHandler(sysdb)
+	if err != nil {
+		return err
+	}
+	permissionHandler.LoadPermissionGroupsFromDatabase()
+
+	//Create the temporary storage pool with user and tmp storage
+	for _, uuid := range []string{"user", "tmp"} {
+		storagePath := filepath.Join(h.TempDir, uuid)
+		os.MkdirAll(storagePath, 0755)
+		fsHandler, err := fs.NewFileSystemHandler(fs.FileSystemOption{
+			Name:      uuid,
+			Uuid:      uuid,
+			Path:      filepath.ToSlash(storagePath) + "/",
+			Hierarchy: "user",
+		})
+		if err != nil {
+			return err
+		}
+		h.fsHandlers = append(h.fsHandlers, fsHandler)
+	}
+
+	storagePool, err := storage.NewStoragePool(h.fsHandlers, "system")
+	if err != nil {
+		return err
+	}
+	storagePool.OtherPermission = "readwrite"
+
+	userHandler, err := user.NewUserHandler(sysdb, authAgent, permissionHandler, storagePool)
+	if err != nil {
+		return err
+	}
+	h.UserHandler = userHandler
+
+	limit := option.Limit
+	if limit.Timeout == 0 {
+		limit.Timeout = 60
+	}
+
+	gateway, err := agi.NewGateway(agi.AgiSysInfo{
+		BuildVersion:    "development",
+		InternalVersion: "agitest",
+		LoadedModule:    []string{h.ModuleName},
+		ReservedTables:  agi.DefaultReservedTables,
+		ModuleRegisterParser: func(string) error {
+			return nil
+		},
+		PackageManager:   apt.NewPackageManager(false),
+		UserHandler:      userHandler,
+		AuthAgent:        authAgent,
+		StartupRoot:      h.moduleScope,
+		ActivateScope:    []string{h.moduleScope},
+		FileSystemRender: metadata.NewRenderHandler(),
+		DefaultLimit:     limit,
+		EventBus:         h.EventBus,
+	})
+	if err != nil {
+		return err
+	}
+	h.Gateway = gateway
+
+	//Approve the capabilities declared in init.agi as an admin would do
+	if !option.PendingCapability && gateway.GetModuleCapabilities(h.ModuleName).Pending {
+		err = gateway.ApproveModuleCapabilities(h.ModuleName)
+		if err != nil {
+			return err
+		}
+	}
+
+	//Create the fake users
+	users := option.Users
+	if len(users) == 0 {
+		users = []FakeUser{{Username: "admin", Admin: true}}
+	}
+
+	for _, fakeUser := range users {
+		err = h.AddUser(fakeUser)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Create a fake user. Non admin users can only access the module under test
+func (h *Harness) AddUser(fakeUser FakeUser) error {
+	if fakeUser.Username == "" {
+		return errors.New("Username cannot be empty")
+	}
+
+	groupName := "administrator"
+	if !fakeUser.Admin {
+		groupName = "agitest"
+		permissionHandler := h.UserHandler.GetPermissionHandler()
+		if !permissionHandler.GroupExists(groupName) {
+			permissionHandler.NewPermissionGroup(groupName, false, -1, []string{h.ModuleName}, h.ModuleName)
+		}
+	}
+
+	err := h.UserHandler.GetAuthAgent().CreateUserAccount(fakeUser.Username, fakeUser.Username, []string{groupName})
+	if err != nil {
+		return err
+	}
+	h.users = append(h.users, fakeUser.Username)
+
+	//Initialize the user folders and storage quota
+	thisUser, err := h.UserHandler.GetUserInfoFromUsername(fakeUser.Username)
+	if err != nil {
+		return err
+	}
+
+	homedir, err := thisUser.GetHomeDirectory()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Join(homedir, "Desktop"), 0755)
+	if err != nil {
+		return err
+	}
+
+	if fakeUser.Quota > 0 {
+		thisUser.StorageQuota.SetUserStorageQuota(fakeUser.Quota)
+	}
+	return nil
+}
+
+//Get the user object of the fake user
+func (h *Harness) GetUser(username string) (*user.User, error) {
+	return h.UserHandler.GetUserInfoFromUsername(username)
+}
+
+//Execute a script of the module as the given user. scriptFile is relative to the module root
+func (h *Harness) RunScript(scriptFile string, username string, request *Request) (*Response, error) {
+	thisUser, err := h.GetUser(username)
+	if err != nil {
+		return nil, err
+	}
+
+	if request == nil {
+		request = &Request{}
+	}
+
+	r, err := h.buildRequest(filepath.ToSlash(filepath.Join(h.ModuleName, scriptFile)), request)
+	if err != nil {
+		return nil, err
+	}
+
+	recorder := newResponseRecorder()
+	h.Gateway.InterfaceHandler(recorder, r, thisUser)
+
+	return &Response{
+		StatusCode: recorder.statusCode,
+		Header:     recorder.header,
+		Body:       recorder.body.String(),
+	}, nil
+}
+
+//Build the mocked http request for the interface handler
+func (h *Harness) buildRequest(scriptPath string, request *Request) (*http.Request, error) {
+	query := url.Values{}
+	for key, value := range request.Query {
+		query.Set(key, value)
+	}
+	query.Set("script", scriptPath)
+
+	body := []byte(request.Body)
+	contentType := ""
+	if len(request.Form) > 0 {
+		form := url.Values{}
+		for key, value := range request.Form {
+			form.Set(key, value)
+		}
+		body = []byte(form.Encode())
+		contentType = "application/x-www-form-urlencoded"
+	} else if request.JSON != nil {
+		js, err := json.Marshal(request.JSON)
+		if err != nil {
+			return nil, err
+		}
+		body = js
+		contentType = "application/json"
+	}
+
+	method := strings.ToUpper(request.Method)
+	if method == "" {
+		method = http.MethodGet
+		if len(body) > 0 {
+			method = http.MethodPost
+		}
+	}
+
+	r, err := http.NewRequest(method, "http://localhost/system/ajgi/interface?"+query.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	r.RequestURI = r.URL.RequestURI()
+	r.RemoteAddr = "127.0.0.1:1234"
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	for key, value := range request.Headers {
+		r.Header.Set(key, value)
+	}
+	return r, nil
+}
+
+/*
+	Response Recorder
+
+	Record the response written by the gateway. This replace httptest so the
+	harness linked into the system binary does not depend on the testing package.
+*/
+
+type responseRecorder struct {
+	header      http.Header
+	body        bytes.Buffer
+	statusCode  int
+	wroteHeader bool
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{
+		header:     http.Header{},
+		statusCode: http.StatusOK,
+	}
+}
+
+func (rw *responseRecorder) Header() http.Header {
+	return rw.header
+}
+
+func (rw *responseRecorder) WriteHeader(statusCode int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.statusCode = statusCode
+	rw.wroteHeader = true
+}
+
+func (rw *responseRecorder) Write(content []byte) (int, error) {
+	rw.WriteHeader(http.StatusOK)
+	return rw.body.Write(content)
+}
+
+//Streaming responses are flushed by the gateway
+func (rw *responseRecorder) Flush() {
+	rw.WriteHeader(http.StatusOK)
+}
+
+//Translate the virtual path of the user to real path
+func (h *Harness) realPath(username string, vpath string) (string, error) {
+	thisUser, err := h.GetUser(username)
+	if err != nil {
+		return "", err
+	}
+	return thisUser.VirtualPathToRealPath(vpath)
+}
+
+//Write a fixture file into the user's storage
+func (h *Harness) WriteFile(username string, vpath string, content []byte) error {
+	rpath, err := h.realPath(username, vpath)
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(filepath.Dir(rpath), 0755)
+	return ioutil.WriteFile(rpath, content, 0755)
+}
+
+//Read a file from the user's storage
+func (h *Harness) ReadFile(username string, vpath string) ([]byte, error) {
+	rpath, err := h.realPath(username, vpath)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(rpath)
+}
+
+//Check if a file exists in the user's storage
+func (h *Harness) FileExists(username string, vpath string) bool {
+	rpath, err := h.realPath(username, vpath)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(rpath)
+	return err == nil
+}
+
+//Read a value from the system database
+func (h *Harness) DBRead(table string, key string, assignee interface{}) error {
+	if !h.Database.KeyExists(table, key) {
+		return errors.New("Key not exists: " + table + "/" + key)
+	}
+	return h.Database.Read(table, key, assignee)
+}
+
+//Check if a key exists in the system database
+func (h *Harness) DBKeyExists(table string, key string) bool {
+	return h.Database.KeyExists(table, key)
+}
+
+//Close the harness and remove all the temporary files
+func (h *Harness) Close() {
+	for _, username := range h.users {
+		h.UserHandler.ClearQuotaCache(username)
+	}
+
+	for _, fsHandler := range h.fsHandlers {
+		fsHandler.Close()
+	}
+
+	if h.Database != nil {
+		h.Database.Close()
+	}
+
+	os.RemoveAll(h.TempDir)
+}
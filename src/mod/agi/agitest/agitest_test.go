@@ -0,0 +1,145 @@
+package agitest_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"imuslab.com/arozos/mod/agi/agitest"
+	"imuslab.com/arozos/mod/agi/agitest/agitesting"
+)
+
+//Create a module folder with the given files for testing
+func newTestModule(t *testing.T, files map[string]string) string {
+	moduleRoot := filepath.Join(t.TempDir(), "TestModule")
+	for filename, content := range files {
+		target := filepath.Join(moduleRoot, filename)
+		os.MkdirAll(filepath.Dir(target), 0755)
+		err := ioutil.WriteFile(target, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return moduleRoot
+}
+
+const testModuleInit = `
+registerModule(JSON.stringify({
+	Name: "TestModule",
+	Group: "Utilities",
+	StartDir: "TestModule/index.html",
+	Capabilities: {
+		Libs: ["filelib"],
+		FileScopes: ["user:/Desktop"],
+		DBTables: ["TestModule"]
+	}
+}));
+`
+
+func TestHarnessRunScript(t *testing.T) {
+	moduleRoot := newTestModule(t, map[string]string{
+		"init.agi": testModuleInit,
+		"backend/write.js": `
+			requirelib("filelib");
+			newDBTableIfNotExists("TestModule");
+			writeDBItem("TestModule", "greeted", name);
+			filelib.writeFile("user:/Desktop/out.txt", "Hello " + name);
+			sendJSONResp(JSON.stringify({user: USERNAME, name: name}));
+		`,
+		"backend/read.js": `
+			requirelib("filelib");
+			sendResp(filelib.readFile("user:/Desktop/input.txt"));
+		`,
+	})
+
+	h := agitesting.New(t, agitest.Options{
+		ModuleRoot: moduleRoot,
+		Users:      []agitest.FakeUser{{Username: "alice"}, {Username: "bob"}},
+	})
+	defer h.Close()
+
+	//The user folders are ready for the scripts to write into
+	resp := agitesting.MustRunScript(t, h, "backend/write.js", "alice", &agitest.Request{Form: map[string]string{"name": "alice"}})
+	agitesting.AssertStatus(t, resp, 200)
+	agitesting.AssertJSON(t, resp, map[string]string{"user": "alice", "name": "alice"})
+	agitesting.AssertFileContent(t, h, "alice", "user:/Desktop/out.txt", "Hello alice")
+	agitesting.AssertDBValue(t, h, "TestModule", "greeted", "alice")
+	if h.FileExists("bob", "user:/Desktop/out.txt") {
+		t.Error("File written into the home of another user")
+	}
+
+	//Fixtures written by the test are visible to the scripts
+	err := h.WriteFile("bob", "user:/Desktop/input.txt", []byte("fixture"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = agitesting.MustRunScript(t, h, "backend/read.js", "bob", nil)
+	agitesting.AssertBodyContains(t, resp, "fixture")
+}
+
+func TestHarnessAddUser(t *testing.T) {
+	moduleRoot := newTestModule(t, map[string]string{"init.agi": testModuleInit})
+	h := agitesting.New(t, agitest.Options{ModuleRoot: moduleRoot})
+	defer h.Close()
+
+	//The default admin user is created when no user is given
+	admin, err := h.GetUser("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !admin.IsAdmin() {
+		t.Error("Default user is not an administrator")
+	}
+
+	err = h.AddUser(agitest.FakeUser{Username: "carol", Quota: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	carol, err := h.GetUser("carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if carol.IsAdmin() {
+		t.Error("Fake user is an administrator")
+	}
+	if !carol.GetModuleAccessPermission("TestModule") {
+		t.Error("Fake user cannot access the module under test")
+	}
+	if carol.StorageQuota.TotalStorageQuota != 1024 {
+		t.Errorf("Storage quota = %d, want 1024", carol.StorageQuota.TotalStorageQuota)
+	}
+	if !h.FileExists("carol", "user:/Desktop") {
+		t.Error("Desktop folder not created for the new user")
+	}
+
+	if err := h.AddUser(agitest.FakeUser{}); err == nil {
+		t.Error("User created without username")
+	}
+}
+
+func TestHarnessSkipSiblingModules(t *testing.T) {
+	moduleRoot := newTestModule(t, map[string]string{"init.agi": testModuleInit})
+	siblingInit := filepath.Join(filepath.Dir(moduleRoot), "SiblingModule", "init.agi")
+	os.MkdirAll(filepath.Dir(siblingInit), 0755)
+	err := ioutil.WriteFile(siblingInit, []byte(`newDBTableIfNotExists("SiblingModule");`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := agitesting.New(t, agitest.Options{ModuleRoot: moduleRoot})
+	defer h.Close()
+	if h.Database.TableExists("SiblingModule") {
+		t.Error("Init script of the sibling module executed")
+	}
+	if h.Gateway.GetModuleCapabilities("TestModule").Declared == nil {
+		t.Error("Init script of the module under test not executed")
+	}
+}
+
+func TestHarnessRejectMissingModule(t *testing.T) {
+	_, err := agitest.NewHarness(agitest.Options{ModuleRoot: filepath.Join(t.TempDir(), "NotExists")})
+	if err == nil {
+		t.Error("Harness created for a module that does not exist")
+	}
+}
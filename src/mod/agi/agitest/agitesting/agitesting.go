@@ -0,0 +1,104 @@
+package agitesting
+
+import (
+	"strings"
+	"testing"
+
+	"imuslab.com/arozos/mod/agi/agitest"
+)
+
+/*
+	Helpers for using the AGI test harness in Go tests of module repositories
+
+	This is kept out of the agitest package so the harness used by the
+	-agi_test flag does not link the testing package into the system binary.
+
+	func TestHello(t *testing.T) {
+		h := agitesting.New(t, agitest.Options{ModuleRoot: "../MyModule"})
+		defer h.Close()
+		resp := agitesting.MustRunScript(t, h, "backend/hello.js", "admin", nil)
+		agitesting.AssertStatus(t, resp, 200)
+		agitesting.AssertBodyContains(t, resp, "Hello")
+	}
+*/
+
+//Create a new harness and fail the test if it cannot be created
+func New(t testing.TB, option agitest.Options) *agitest.Harness {
+	t.Helper()
+	h, err := agitest.NewHarness(option)
+	if err != nil {
+		t.Fatalf("Unable to create AGI test harness: %s", err.Error())
+	}
+	return h
+}
+
+//Execute the script and fail the test if it cannot be executed
+func MustRunScript(t testing.TB, h *agitest.Harness, scriptFile string, username string, request *agitest.Request) *agitest.Response {
+	t.Helper()
+	resp, err := h.RunScript(scriptFile, username, request)
+	if err != nil {
+		t.Fatalf("Unable to run script %s: %s", scriptFile, err.Error())
+	}
+	return resp
+}
+
+func AssertStatus(t testing.TB, resp *agitest.Response, statusCode int) {
+	t.Helper()
+	if resp.StatusCode != statusCode {
+		t.Errorf("Expected status %d, got %d. Response: %s", statusCode, resp.StatusCode, resp.Body)
+	}
+}
+
+func AssertBodyContains(t testing.TB, resp *agitest.Response, keyword string) {
+	t.Helper()
+	if !strings.Contains(resp.Body, keyword) {
+		t.Errorf("Expected body to contain %q, got %q", keyword, resp.Body)
+	}
+}
+
+//Assert the JSON response contains the expected keys and values
+func AssertJSON(t testing.TB, resp *agitest.Response, expected interface{}) {
+	t.Helper()
+	var actual interface{}
+	err := resp.DecodeJSON(&actual)
+	if err != nil {
+		t.Errorf("Response is not valid JSON: %s", resp.Body)
+		return
+	}
+
+	if !agitest.MatchJSON(expected, actual) {
+		t.Errorf("Expected JSON to match %v, got %s", expected, resp.Body)
+	}
+}
+
+func AssertFileContent(t testing.TB, h *agitest.Harness, username string, vpath string, content string) {
+	t.Helper()
+	actual, err := h.ReadFile(username, vpath)
+	if err != nil {
+		t.Errorf("Expected file %s exists", vpath)
+	} else if string(actual) != content {
+		t.Errorf("Expected file %s to be %q, got %q", vpath, content, string(actual))
+	}
+}
+
+func AssertFileExists(t testing.TB, h *agitest.Harness, username string, vpath string) {
+	t.Helper()
+	if !h.FileExists(username, vpath) {
+		t.Errorf("Expected file %s exists", vpath)
+	}
+}
+
+//Assert the database record equals the expected value
+func AssertDBValue(t testing.TB, h *agitest.Harness, table string, key string, expected interface{}) {
+	t.Helper()
+	var actual interface{}
+	err := h.DBRead(table, key, &actual)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	if !agitest.MatchJSON(expected, actual) {
+		t.Errorf("Expected database value %s/%s to be %v, got %v", table, key, expected, actual)
+	}
+}
@@ -0,0 +1,276 @@
+package agitest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+/*
+	AGI Test Suite
+
+	A test suite is a JSON file describing the module under test, the fake users,
+	the fixture files and a list of test cases. Paths are relative to the suite file.
+
+	{
+		"module": "./MyModule",
+		"users": [{"username": "alice"}, {"username": "bob", "admin": true}],
+		"files": {"alice": {"user:/Desktop/input.txt": "Hello World"}},
+		"tests": [
+			{
+				"name": "Say hello",
+				"script": "backend/hello.js",
+				"user": "alice",
+				"request": {"method": "POST", "form": {"name": "alice"}},
+				"expect": {
+					"status": 200,
+					"bodyContains": ["Hello alice"],
+					"json": {"name": "alice"},
+					"files": {"user:/Desktop/output.txt": "Hello alice"},
+					"db": [{"table": "MyModule", "key": "greeted", "value": "true"}]
+				}
+			}
+		]
+	}
+
+	Test cases are executed in order on the same harness, so later tests
+	can depend on the files and database records created by earlier tests.
+*/
+
+type DBExpectation struct {
+	Table  string      `json:"table"`
+	Key    string      `json:"key"`
+	Value  interface{} `json:"value"`  //Expected value, ignored if Exists is set
+	Exists *bool       `json:"exists"` //Only check if the key exists or not
+}
+
+type Expectation struct {
+	Status       int                `json:"status"`       //Expected status code, 0 to skip
+	Body         *string            `json:"body"`         //Expected body
+	BodyContains []string           `json:"bodyContains"` //Strings that must appear in the body
+	Headers      map[string]string  `json:"headers"`      //Expected response headers
+	JSON         interface{}        `json:"json"`         //Expected JSON body. Only the given keys of objects are compared
+	Files        map[string]*string `json:"files"`        //Expected file content by virtual path, null to check for non-existence
+	DB           []DBExpectation    `json:"db"`
+}
+
+type TestCase struct {
+	Name    string      `json:"name"`
+	Script  string      `json:"script"` //Script path relative to the module root
+	User    string      `json:"user"`   //Execute as this user, default the first user
+	Request Request     `json:"request"`
+	Expect  Expectation `json:"expect"`
+}
+
+type TestSuite struct {
+	Module string                       `json:"module"`
+	Users  []FakeUser                   `json:"users"`
+	Files  map[string]map[string]string `json:"files"` //Fixture files, username => vpath => content
+	Tests  []TestCase                   `json:"tests"`
+}
+
+//Load the test suite from a JSON file
+func LoadTestSuite(suiteFile string) (*TestSuite, error) {
+	content, err := ioutil.ReadFile(suiteFile)
+	if err != nil {
+		return nil, err
+	}
+
+	suite := TestSuite{}
+	err = json.Unmarshal(content, &suite)
+	if err != nil {
+		return nil, err
+	}
+
+	if suite.Module == "" {
+		return nil, errors.New("Module root not defined in test suite")
+	}
+
+	//Module path is relative to the suite file
+	if !filepath.IsAbs(suite.Module) {
+		suite.Module = filepath.Join(filepath.Dir(suiteFile), suite.Module)
+	}
+
+	return &suite, nil
+}
+
+//Run all the test cases and write the results to out. Return the number of failed tests
+func (s *TestSuite) Run(out io.Writer) (int, error) {
+	h, err := NewHarness(Options{
+		ModuleRoot: s.Module,
+		Users:      s.Users,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer h.Close()
+
+	//Write the fixture files
+	for username, files := range s.Files {
+		for vpath, content := range files {
+			err = h.WriteFile(username, vpath, []byte(content))
+			if err != nil {
+				return 0, errors.New("Unable to write fixture " + vpath + ": " + err.Error())
+			}
+		}
+	}
+
+	defaultUser := "admin"
+	if len(s.Users) > 0 {
+		defaultUser = s.Users[0].Username
+	}
+
+	failed := 0
+	for i, testCase := range s.Tests {
+		name := testCase.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d %s", i+1, testCase.Script)
+		}
+
+		username := testCase.User
+		if username == "" {
+			username = defaultUser
+		}
+
+		startTime := time.Now()
+		resp, err := h.RunScript(testCase.Script, username, &testCase.Request)
+		failures := []string{}
+		if err != nil {
+			failures = append(failures, err.Error())
+		} else {
+			failures = h.Check(resp, username, testCase.Expect)
+		}
+		duration := time.Since(startTime).Seconds()
+
+		if len(failures) == 0 {
+			fmt.Fprintf(out, "PASS %s (%.2fs)\n", name, duration)
+		} else {
+			failed++
+			fmt.Fprintf(out, "FAIL %s (%.2fs)\n", name, duration)
+			for _, failure := range failures {
+				fmt.Fprintln(out, "    "+failure)
+			}
+			if resp != nil {
+				fmt.Fprintln(out, "    Response: "+resp.Body)
+			}
+		}
+	}
+
+	fmt.Fprintf(out, "%d passed, %d failed\n", len(s.Tests)-failed, failed)
+	return failed, nil
+}
+
+//Check the response and the state of the harness against the expectation. Return the list of failures
+func (h *Harness) Check(resp *Response, username string, expect Expectation) []string {
+	failures := []string{}
+	if expect.Status != 0 && resp.StatusCode != expect.Status {
+		failures = append(failures, fmt.Sprintf("Expected status %d, got %d", expect.Status, resp.StatusCode))
+	}
+
+	if expect.Body != nil && resp.Body != *expect.Body {
+		failures = append(failures, fmt.Sprintf("Expected body %q, got %q", *expect.Body, resp.Body))
+	}
+
+	for _, keyword := range expect.BodyContains {
+		if !strings.Contains(resp.Body, keyword) {
+			failures = append(failures, fmt.Sprintf("Expected body to contain %q", keyword))
+		}
+	}
+
+	for key, value := range expect.Headers {
+		if resp.Header.Get(key) != value {
+			failures = append(failures, fmt.Sprintf("Expected header %s to be %q, got %q", key, value, resp.Header.Get(key)))
+		}
+	}
+
+	if expect.JSON != nil {
+		var actual interface{}
+		err := resp.DecodeJSON(&actual)
+		if err != nil {
+			failures = append(failures, "Response is not valid JSON: "+err.Error())
+		} else if !jsonMatch(expect.JSON, actual) {
+			expected, _ := json.Marshal(expect.JSON)
+			failures = append(failures, "Expected JSON to match "+string(expected))
+		}
+	}
+
+	for vpath, content := range expect.Files {
+		exists := h.FileExists(username, vpath)
+		if content == nil {
+			if exists {
+				failures = append(failures, "Expected file "+vpath+" not exists")
+			}
+			continue
+		}
+
+		actual, err := h.ReadFile(username, vpath)
+		if err != nil {
+			failures = append(failures, "Expected file "+vpath+" exists")
+		} else if string(actual) != *content {
+			failures = append(failures, fmt.Sprintf("Expected file %s to be %q, got %q", vpath, *content, string(actual)))
+		}
+	}
+
+	for _, record := range expect.DB {
+		exists := h.DBKeyExists(record.Table, record.Key)
+		if record.Exists != nil {
+			if exists != *record.Exists {
+				failures = append(failures, fmt.Sprintf("Expected database key %s/%s exists to be %t", record.Table, record.Key, *record.Exists))
+			}
+			continue
+		}
+
+		var actual interface{}
+		err := h.DBRead(record.Table, record.Key, &actual)
+		if err != nil {
+			failures = append(failures, err.Error())
+		} else if !jsonMatch(record.Value, actual) {
+			failures = append(failures, fmt.Sprintf("Expected database value %s/%s to be %v, got %v", record.Table, record.Key, record.Value, actual))
+		}
+	}
+
+	return failures
+}
+
+//Check if actual match the expected JSON value. Objects only need to contain the expected keys
+func jsonMatch(expected interface{}, actual interface{}) bool {
+	expectedObject, ok := expected.(map[string]interface{})
+	if !ok {
+		return reflect.DeepEqual(expected, actual)
+	}
+
+	actualObject, ok := actual.(map[string]interface{})
+	if !ok {
+		return false
+	}
+
+	for key, value := range expectedObject {
+		if !jsonMatch(value, actualObject[key]) {
+			return false
+		}
+	}
+	return true
+}
+
+//Check if the decoded JSON value actual match the expected go value
+func MatchJSON(expected interface{}, actual interface{}) bool {
+	return jsonMatch(normalizeJSON(expected), actual)
+}
+
+//Convert a go value into the types produced by json.Unmarshal
+func normalizeJSON(value interface{}) interface{} {
+	js, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+
+	var result interface{}
+	json.Unmarshal(js, &result)
+	return result
+}
@@ -0,0 +1,346 @@
+package agi
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/robertkrimen/otto"
+	user "imuslab.com/arozos/mod/user"
+)
+
+/*
+	AGI Capability Manifest
+
+	Modules can declare the capabilities they need in the Capabilities field
+	of the registerModule JSON in their init.agi, for example
+
+	"Capabilities": {
+		"Libs": ["http", "filelib"],
+		"Hosts": ["api.example.com", "*.example.org"],
+		"FileScopes": ["user:/Music/"],
+		"DBTables": ["mymodule"],
+		"Packages": ["ffmpeg"]
+	}
+
+	Once a module declared its capabilities, scripts of the module can only use
+	the capabilities that are approved by admin. Modules without a manifest and
+	scripts not belongs to any module (user scripts, webhooks, scheduled tasks)
+	get the default capabilities, which have no network access and no system
+	packages. "*" in FileScopes or DBTables allows everything the user
+	permissions, reserved tables and table owners already allow.
+*/
+
+type Capabilities struct {
+	Libs       []string //AGI libraries loadable with requirelib
+	Hosts      []string //Host patterns the http lib can connect to, e.g. api.example.com or *.example.com
+	FileScopes []string //Virtual path prefixes accessible by the file related libs, e.g. user:/Music/
+	DBTables   []string //Database tables accessible by the DB functions
+	Packages   []string //System packages usable by requirepkg and execpkg
+}
+
+//Default capabilities of modules without a manifest
+var DefaultCapabilities = Capabilities{
+	Libs:       []string{"appdata", "archivelib", "audio", "cryptolib", "filelib", "hashlib", "imagelib", "iot", "kvlib", "musiclib", "taglib", "websocket"},
+	Hosts:      []string{},
+	FileScopes: []string{"*"},
+	DBTables:   []string{"*"},
+	Packages:   []string{},
+}
+
+//Capabilities declared and approved for a module
+type ModuleCapabilities struct {
+	Module   string        //The module root folder name
+	Declared *Capabilities //Capabilities declared in init.agi
+	Approved *Capabilities //Capabilities approved by admin, nil if never approved
+	Pending  bool          //If there are declared capabilities not yet approved
+}
+
+//Register the capabilities declared by the module from the registerModule JSON
+func (g *Gateway) registerModuleCapabilities(moduleRoot string, jsonModuleConfig string) {
+	if moduleRoot == "" {
+		return
+	}
+
+	config := struct {
+		Capabilities *Capabilities
+	}{}
+	err := json.Unmarshal([]byte(jsonModuleConfig), &config)
+	if err != nil || config.Capabilities == nil {
+		return
+	}
+
+	g.capabilityMutex.Lock()
+	g.declaredCapabilities[moduleRoot] = config.Capabilities
+	g.capabilityMutex.Unlock()
+
+	if g.GetModuleCapabilities(moduleRoot).Pending {
+		log.Println("[AGI] Module " + moduleRoot + " declared capabilities that require admin approval")
+	}
+}
+
+//Get the declared and approved capabilities of a module
+func (g *Gateway) GetModuleCapabilities(moduleRoot string) *ModuleCapabilities {
+	g.capabilityMutex.Lock()
+	declared := g.declaredCapabilities[moduleRoot]
+	g.capabilityMutex.Unlock()
+
+	var approved *Capabilities
+	sysdb := g.Option.UserHandler.GetDatabase()
+	if sysdb.KeyExists("agi-capabilities", moduleRoot) {
+		approved = &Capabilities{}
+		sysdb.Read("agi-capabilities", moduleRoot, approved)
+	}
+
+	return &ModuleCapabilities{
+		Module:   moduleRoot,
+		Declared: declared,
+		Approved: approved,
+		Pending:  declared != nil && !capabilitiesCovered(declared, approved),
+	}
+}
+
+//List the modules with declared capabilities that are not yet approved
+func (g *Gateway) ListPendingModuleCapabilities() []*ModuleCapabilities {
+	g.capabilityMutex.Lock()
+	moduleRoots := []string{}
+	for moduleRoot := range g.declaredCapabilities {
+		moduleRoots = append(moduleRoots, moduleRoot)
+	}
+	g.capabilityMutex.Unlock()
+	sort.Strings(moduleRoots)
+
+	results := []*ModuleCapabilities{}
+	for _, moduleRoot := range moduleRoots {
+		capabilities := g.GetModuleCapabilities(moduleRoot)
+		if capabilities.Pending {
+			results = append(results, capabilities)
+		}
+	}
+	return results
+}
+
+//Approve all the capabilities currently declared by the module
+func (g *Gateway) ApproveModuleCapabilities(moduleRoot string) error {
+	g.capabilityMutex.Lock()
+	declared := g.declaredCapabilities[moduleRoot]
+	g.capabilityMutex.Unlock()
+
+	if declared == nil {
+		return errors.New("This module did not declare any capabilities")
+	}
+	return g.Option.UserHandler.GetDatabase().Write("agi-capabilities", moduleRoot, declared)
+}
+
+//Revoke the approval of the module capabilities
+func (g *Gateway) RevokeModuleCapabilities(moduleRoot string) error {
+	return g.Option.UserHandler.GetDatabase().Delete("agi-capabilities", moduleRoot)
+}
+
+//Remove all capability records of a module, called when the module is uninstalled
+func (g *Gateway) RemoveModuleCapabilities(moduleRoot string) {
+	g.capabilityMutex.Lock()
+	delete(g.declaredCapabilities, moduleRoot)
+	g.capabilityMutex.Unlock()
+	g.RevokeModuleCapabilities(moduleRoot)
+}
+
+//Check if every declared capability is in the approved set
+func capabilitiesCovered(declared *Capabilities, approved *Capabilities) bool {
+	if approved == nil {
+		return false
+	}
+	return sliceCovered(declared.Libs, approved.Libs) &&
+		sliceCovered(declared.Hosts, approved.Hosts) &&
+		sliceCovered(declared.FileScopes, approved.FileScopes) &&
+		sliceCovered(declared.DBTables, approved.DBTables) &&
+		sliceCovered(declared.Packages, approved.Packages)
+}
+
+func sliceCovered(items []string, set []string) bool {
+	for _, item := range items {
+		if !stringInSlice(item, set) {
+			return false
+		}
+	}
+	return true
+}
+
+func sliceIntersect(a []string, b []string) []string {
+	results := []string{}
+	for _, item := range a {
+		if stringInSlice(item, b) {
+			results = append(results, item)
+		}
+	}
+	return results
+}
+
+//Get the module of a script file, or empty string if the script is not inside the startup root
+func (g *Gateway) getScriptModule(scriptFile string) string {
+	startupRoot, err := filepath.Abs(g.Option.StartupRoot)
+	if err != nil {
+		return ""
+	}
+	scriptFileAbs, err := filepath.Abs(scriptFile)
+	if err != nil {
+		return ""
+	}
+	relPath, err := filepath.Rel(startupRoot, scriptFileAbs)
+	if err != nil || relPath == "." || strings.HasPrefix(filepath.ToSlash(relPath), "../") {
+		return ""
+	}
+	return getScriptRoot(scriptFile, g.Option.StartupRoot)
+}
+
+/*
+	Get the capabilities the vm is allowed to use.
+	Return the default capabilities if the vm is not running a module script or the module has no manifest
+*/
+func (g *Gateway) getEffectiveCapabilities(vm *otto.Otto) *Capabilities {
+	context := g.getExecutionContext(vm)
+	if context == nil || context.module == "" {
+		return g.Option.DefaultCapabilities
+	}
+
+	capabilities := g.GetModuleCapabilities(context.module)
+	if capabilities.Declared == nil {
+		return g.Option.DefaultCapabilities
+	}
+
+	if capabilities.Approved == nil {
+		//Declared but not approved. Nothing is allowed
+		return &Capabilities{}
+	}
+
+	//Only allow the capabilities that are both declared and approved
+	return &Capabilities{
+		Libs:       sliceIntersect(capabilities.Declared.Libs, capabilities.Approved.Libs),
+		Hosts:      sliceIntersect(capabilities.Declared.Hosts, capabilities.Approved.Hosts),
+		FileScopes: sliceIntersect(capabilities.Declared.FileScopes, capabilities.Approved.FileScopes),
+		DBTables:   sliceIntersect(capabilities.Declared.DBTables, capabilities.Approved.DBTables),
+		Packages:   sliceIntersect(capabilities.Declared.Packages, capabilities.Approved.Packages),
+	}
+}
+
+//Check if the vm can load the given library
+func (g *Gateway) capabilityAllowLib(vm *otto.Otto, libname string) bool {
+	return stringInSlice(libname, g.getEffectiveCapabilities(vm).Libs)
+}
+
+//Check if the vm can access the given virtual path
+func (g *Gateway) capabilityAllowFile(vm *otto.Otto, vpath string) bool {
+	capabilities := g.getEffectiveCapabilities(vm)
+	if stringInSlice("*", capabilities.FileScopes) {
+		return true
+	}
+
+	vpath = strings.TrimSuffix(filepath.ToSlash(filepath.Clean(vpath)), "/") + "/"
+	for _, scope := range capabilities.FileScopes {
+		scope = strings.TrimSuffix(filepath.ToSlash(filepath.Clean(scope)), "/") + "/"
+		if strings.HasPrefix(vpath, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+//Check if the vm can access the given database table. Tables created by a module can only be accessed by that module
+func (g *Gateway) capabilityAllowTable(vm *otto.Otto, tablename string) bool {
+	if owner := g.getTableOwner(tablename); owner != "" {
+		context := g.getExecutionContext(vm)
+		if context == nil || context.module != owner {
+			return false
+		}
+	}
+
+	capabilities := g.getEffectiveCapabilities(vm)
+	return stringInSlice("*", capabilities.DBTables) || stringInSlice(tablename, capabilities.DBTables)
+}
+
+//Check if the vm can use the given system package
+func (g *Gateway) capabilityAllowPackage(vm *otto.Otto, packageName string) bool {
+	return stringInSlice(strings.ToLower(packageName), lowerSlice(g.getEffectiveCapabilities(vm).Packages))
+}
+
+//Check if the vm can connect to the host of the given URL
+func (g *Gateway) capabilityAllowHost(vm *otto.Otto, targetURL *url.URL) bool {
+	capabilities := g.getEffectiveCapabilities(vm)
+	hostname := strings.ToLower(targetURL.Hostname())
+	for _, pattern := range capabilities.Hosts {
+		if matched, _ := path.Match(strings.ToLower(pattern), hostname); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func lowerSlice(items []string) []string {
+	results := []string{}
+	for _, item := range items {
+		results = append(results, strings.ToLower(item))
+	}
+	return results
+}
+
+//Create a http client that only connect and follow redirects to the hosts allowed for this vm
+func (g *Gateway) getHTTPClient(vm *otto.Otto) *http.Client {
+	return &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			if !g.capabilityAllowHost(vm, req.URL) {
+				return errors.New("Redirect to " + req.URL.Hostname() + " is not allowed by module capabilities")
+			}
+			return nil
+		},
+	}
+}
+
+//Check if the vm can request the given URL
+func (g *Gateway) checkHTTPRequest(vm *otto.Otto, requestURL string) error {
+	parsedURL, err := url.Parse(requestURL)
+	if err != nil {
+		return err
+	}
+	if !g.capabilityAllowHost(vm, parsedURL) {
+		return errors.New("Host " + parsedURL.Hostname() + " is not allowed by module capabilities")
+	}
+	return nil
+}
+
+//Get a virtual path resolver that reject paths outside the file scopes of the vm
+func (g *Gateway) getScopedPathResolver(vm *otto.Otto) func(string, *user.User) (string, error) {
+	return func(vpath string, u *user.User) (string, error) {
+		if !g.capabilityAllowFile(vm, vpath) {
+			return "", errors.New("Path " + vpath + " is outside of the module file scopes")
+		}
+		return virtualPathToRealPath(vpath, u)
+	}
+}
+
+//Run the init script of a module and register the capabilities it declared
+func (g *Gateway) RunModuleInitScript(initScript string) error {
+	scriptContent, err := ioutil.ReadFile(initScript)
+	if err != nil {
+		return err
+	}
+
+	//Create a new vm for this request
+	vm := otto.New()
+
+	//Only allow non user based operations
+	g.injectStandardLibs(vm, initScript, g.Option.StartupRoot)
+
+	moduleName := getScriptRoot(initScript, g.Option.StartupRoot)
+	_, err = g.runWithLimit(vm, string(scriptContent), moduleName, g.GetModuleExecutionLimit(moduleName), initScript, "system")
+	return err
+}
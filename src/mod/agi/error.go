@@ -18,7 +18,11 @@ import (
 
 
 func (g *Gateway)RenderErrorTemplate(w http.ResponseWriter, errmsg string, scriptpath string){
-	template, _ := ioutil.ReadFile("system/agi/error.html")
+	template, err := ioutil.ReadFile("system/agi/error.html")
+	if err != nil {
+		//Template not found, e.g. running in the test harness. Reply the error in plain text
+		template = []byte("AGI Runtime Error: {{error_msg}} ({{script_filepath}})")
+	}
 	t := fasttemplate.New(string(template), "{{", "}}")
 	s := t.ExecuteString(map[string]interface{}{
 		"error_msg":  errmsg,
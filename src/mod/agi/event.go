@@ -0,0 +1,174 @@
+package agi
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/robertkrimen/otto"
+	"imuslab.com/arozos/mod/event"
+)
+
+/*
+	AGI Event Handlers
+
+	Modules can register handler scripts for system events in their init.agi, e.g.
+	registerEventHandler("file.uploaded", "onUpload.js")
+
+	The handler script is executed as the user affected by the event (or as system
+	if the event is not related to any user) with the module execution limits applied.
+	The event is available in the script as the EVENT object
+*/
+
+type EventHandlerScript struct {
+	EventType   string //The event type this script handles
+	Module      string //The module root folder of the script
+	ScriptFile  string //Path of the handler script
+	scriptScope string
+}
+
+//Register a handler script for the given event type
+func (g *Gateway) registerEventHandler(eventType string, handlerScript string, scriptFile string, scriptScope string) error {
+	if g.Option.EventBus == nil {
+		return errors.New("Event bus not enabled")
+	}
+
+	if !event.IsValidEventType(eventType) {
+		return errors.New("Unknown event type: " + eventType)
+	}
+
+	//Handler scripts are relative to the module root, the folder containing init.agi
+	moduleFolder := filepath.Dir(scriptFile)
+	handlerFile := filepath.ToSlash(filepath.Join(moduleFolder, handlerScript))
+	moduleFolderSlash := filepath.ToSlash(filepath.Clean(moduleFolder)) + "/"
+	if !strings.HasPrefix(handlerFile, moduleFolderSlash) {
+		return errors.New("Handler script must be located inside the module folder")
+	}
+
+	if !(filepath.Ext(handlerFile) == ".agi" || filepath.Ext(handlerFile) == ".js") {
+		return errors.New("Handler script must have file extension of .agi or .js")
+	}
+
+	if !fileExists(handlerFile) {
+		return errors.New("Handler script not found: " + handlerScript)
+	}
+
+	thisHandler := &EventHandlerScript{
+		EventType:   eventType,
+		Module:      getScriptRoot(scriptFile, scriptScope),
+		ScriptFile:  handlerFile,
+		scriptScope: scriptScope,
+	}
+
+	g.eventMutex.Lock()
+	defer g.eventMutex.Unlock()
+
+	//Skip if this script is already registered, e.g. module reloaded
+	for _, registeredHandler := range g.eventHandlers[eventType] {
+		if registeredHandler.ScriptFile == thisHandler.ScriptFile {
+			return nil
+		}
+	}
+
+	if _, ok := g.eventHandlers[eventType]; !ok {
+		//First handler of this event type. Subscribe to the event bus
+		g.Option.EventBus.Subscribe(eventType, g.handleEvent)
+	}
+	g.eventHandlers[eventType] = append(g.eventHandlers[eventType], thisHandler)
+	return nil
+}
+
+//Remove all event handlers registered by the given module
+func (g *Gateway) RemoveModuleEventHandlers(moduleRoot string) {
+	g.eventMutex.Lock()
+	defer g.eventMutex.Unlock()
+	for eventType, handlers := range g.eventHandlers {
+		remainingHandlers := []*EventHandlerScript{}
+		for _, thisHandler := range handlers {
+			if thisHandler.Module != moduleRoot {
+				remainingHandlers = append(remainingHandlers, thisHandler)
+			}
+		}
+
+		//Keep the key so the bus subscription is not registered twice
+		g.eventHandlers[eventType] = remainingHandlers
+	}
+}
+
+//List all the registered event handlers
+func (g *Gateway) ListEventHandlers() []EventHandlerScript {
+	g.eventMutex.Lock()
+	defer g.eventMutex.Unlock()
+	results := []EventHandlerScript{}
+	for _, eventType := range event.EventTypes {
+		for _, thisHandler := range g.eventHandlers[eventType] {
+			results = append(results, *thisHandler)
+		}
+	}
+	return results
+}
+
+//Dispatch the event to the handler scripts
+func (g *Gateway) handleEvent(e event.Event) {
+	g.eventMutex.Lock()
+	handlers := append([]*EventHandlerScript{}, g.eventHandlers[e.Type]...)
+	g.eventMutex.Unlock()
+
+	for _, thisHandler := range handlers {
+		go func(thisHandler *EventHandlerScript) {
+			err := g.executeEventHandler(thisHandler, e)
+			if err != nil {
+				log.Println("[AGI] Event handler " + thisHandler.ScriptFile + " for " + e.Type + " failed: " + err.Error())
+			}
+		}(thisHandler)
+	}
+}
+
+//Execute a handler script with the given event
+func (g *Gateway) executeEventHandler(handler *EventHandlerScript, e event.Event) error {
+	scriptContent, err := ioutil.ReadFile(handler.ScriptFile)
+	if err != nil {
+		return err
+	}
+
+	//Create a new vm for this event
+	vm := otto.New()
+	g.injectStandardLibs(vm, handler.ScriptFile, handler.scriptScope)
+
+	executor := "system"
+	if e.Username != "" {
+		//Run as the affected user if the user has access to this module
+		thisuser, err := g.Option.UserHandler.GetUserInfoFromUsername(e.Username)
+		if err != nil {
+			return err
+		}
+
+		if !thisuser.GetModuleAccessPermission(handler.Module) {
+			return nil
+		}
+
+		g.injectUserFunctions(vm, handler.ScriptFile, handler.scriptScope, thisuser, nil, nil)
+		executor = thisuser.Username
+	}
+
+	//Inject the event as a native object
+	js, _ := json.Marshal(e)
+	eventObject, err := vm.Object("(" + string(js) + ")")
+	if err != nil {
+		return err
+	}
+	vm.Set("EVENT", eventObject)
+
+	_, err = g.runWithLimit(vm, string(scriptContent), handler.Module, g.GetModuleExecutionLimit(handler.Module), handler.ScriptFile, executor)
+	return err
+}
+
+//Handle listing of the registered event handlers. Admin only
+func (g *Gateway) HandleListEventHandlers(w http.ResponseWriter, r *http.Request) {
+	js, _ := json.Marshal(g.ListEventHandlers())
+	sendJSONResponse(w, string(js))
+}
@@ -0,0 +1,386 @@
+package agi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robertkrimen/otto"
+	uuid "github.com/satori/go.uuid"
+	user "imuslab.com/arozos/mod/user"
+)
+
+/*
+	AGI Background Job Manager
+
+	Keep track of the scripts detached with execd. Each detached script
+	is given a job ID which can be used by the parent script or the UI to
+	query its status, progress, console output and return value or to cancel it.
+	Job records are persisted in the system database until the retention
+	window passes
+*/
+
+//Maximum number of console lines kept for each job
+const maxJobConsoleLines = 1000
+
+type Job struct {
+	ID              string
+	Owner           string
+	ScriptFile      string
+	Status          string //running, finished, failed or cancelled
+	Progress        float64
+	ProgressMessage string
+	Console         []string
+	ReturnValue     string
+	Error           string
+	StartTime       int64
+	EndTime         int64
+
+	vm        *otto.Otto
+	cancelled bool
+}
+
+type jobManager struct {
+	jobs  map[string]*Job
+	mutex sync.Mutex
+}
+
+func (g *Gateway) loadJobs() {
+	g.jobManager = &jobManager{
+		jobs: map[string]*Job{},
+	}
+
+	sysdb := g.Option.UserHandler.GetDatabase()
+	sysdb.NewTable("agi-jobs")
+	entries, err := sysdb.ListTable("agi-jobs")
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		thisJob := Job{}
+		err = json.Unmarshal(entry[1], &thisJob)
+		if err != nil {
+			continue
+		}
+
+		if thisJob.Status == "running" {
+			//The system restarted while this job is running
+			thisJob.Status = "failed"
+			thisJob.Error = "Interrupted by system restart"
+			thisJob.EndTime = time.Now().Unix()
+			sysdb.Write("agi-jobs", thisJob.ID, thisJob)
+		}
+		g.jobManager.jobs[thisJob.ID] = &thisJob
+	}
+
+	g.PruneJobs()
+}
+
+//Create a job record for a detached script
+func (g *Gateway) createJob(owner string, scriptFile string) *Job {
+	thisJob := Job{
+		ID:         uuid.NewV4().String(),
+		Owner:      owner,
+		ScriptFile: scriptFile,
+		Status:     "running",
+		Console:    []string{},
+		StartTime:  time.Now().Unix(),
+	}
+
+	g.jobManager.mutex.Lock()
+	g.jobManager.jobs[thisJob.ID] = &thisJob
+	g.jobManager.mutex.Unlock()
+	g.saveJob(&thisJob)
+	return &thisJob
+}
+
+//Write the job record into database
+func (g *Gateway) saveJob(job *Job) {
+	g.jobManager.mutex.Lock()
+	js, _ := json.Marshal(job)
+	g.jobManager.mutex.Unlock()
+	g.Option.UserHandler.GetDatabase().Write("agi-jobs", job.ID, json.RawMessage(js))
+}
+
+//Get a copy of the job with the given ID
+func (g *Gateway) GetJob(jobID string) (Job, error) {
+	g.jobManager.mutex.Lock()
+	defer g.jobManager.mutex.Unlock()
+	thisJob, ok := g.jobManager.jobs[jobID]
+	if !ok {
+		return Job{}, errors.New("Job not exists")
+	}
+	return copyJob(thisJob), nil
+}
+
+//List the jobs started by the given user, newest first
+func (g *Gateway) ListJobs(owner string) []Job {
+	g.jobManager.mutex.Lock()
+	defer g.jobManager.mutex.Unlock()
+	results := []Job{}
+	for _, thisJob := range g.jobManager.jobs {
+		if thisJob.Owner == owner {
+			results = append(results, copyJob(thisJob))
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].StartTime > results[j].StartTime
+	})
+	return results
+}
+
+func copyJob(job *Job) Job {
+	result := *job
+	result.Console = append([]string{}, job.Console...)
+	result.vm = nil
+	return result
+}
+
+//Cancel a running job
+func (g *Gateway) CancelJob(jobID string) error {
+	g.jobManager.mutex.Lock()
+	thisJob, ok := g.jobManager.jobs[jobID]
+	if !ok {
+		g.jobManager.mutex.Unlock()
+		return errors.New("Job not exists")
+	}
+
+	if thisJob.Status != "running" {
+		g.jobManager.mutex.Unlock()
+		return errors.New("Job is not running")
+	}
+	thisJob.cancelled = true
+	vm := thisJob.vm
+	g.jobManager.mutex.Unlock()
+
+	if vm != nil {
+		context := g.getExecutionContext(vm)
+		if context != nil {
+			context.abort("cancelled")
+		} else {
+			//The script is not started yet. Stop it at the first statement
+			select {
+			case vm.Interrupt <- func() {
+				panic(&ExecutionAbortedError{Reason: "cancelled"})
+			}:
+			default:
+			}
+		}
+	}
+	return nil
+}
+
+//Remove job records that finished before the retention window
+func (g *Gateway) PruneJobs() {
+	retention := g.Option.JobRetention
+	if retention <= 0 {
+		retention = 604800
+	}
+
+	expiredJobs := []string{}
+	g.jobManager.mutex.Lock()
+	for jobID, thisJob := range g.jobManager.jobs {
+		if thisJob.Status != "running" && time.Now().Unix()-thisJob.EndTime > retention {
+			expiredJobs = append(expiredJobs, jobID)
+			delete(g.jobManager.jobs, jobID)
+		}
+	}
+	g.jobManager.mutex.Unlock()
+
+	for _, jobID := range expiredJobs {
+		g.Option.UserHandler.GetDatabase().Delete("agi-jobs", jobID)
+	}
+}
+
+//Inject the job related functions into the vm of a detached script and capture its console output
+func (g *Gateway) injectJobFunctions(vm *otto.Otto, job *Job) {
+	vm.Interrupt = make(chan func(), 1)
+	g.jobManager.mutex.Lock()
+	job.vm = vm
+	g.jobManager.mutex.Unlock()
+
+	vm.Set("JOB_ID", job.ID)
+
+	//setJobProgress(percentage, message)
+	vm.Set("setJobProgress", func(call otto.FunctionCall) otto.Value {
+		progress, err := call.Argument(0).ToFloat()
+		if err != nil {
+			return otto.FalseValue()
+		}
+		message := ""
+		if call.Argument(1).IsDefined() {
+			message, _ = call.Argument(1).ToString()
+		}
+
+		g.jobManager.mutex.Lock()
+		job.Progress = progress
+		job.ProgressMessage = message
+		g.jobManager.mutex.Unlock()
+		return otto.TrueValue()
+	})
+
+	//Capture the console output
+	captureConsole := func(level string) func(call otto.FunctionCall) otto.Value {
+		return func(call otto.FunctionCall) otto.Value {
+			values := []string{}
+			for _, argument := range call.ArgumentList {
+				values = append(values, fmt.Sprintf("%v", argument))
+			}
+			line := strings.Join(values, " ")
+			if level != "log" {
+				line = "[" + level + "] " + line
+			}
+
+			g.jobManager.mutex.Lock()
+			job.Console = append(job.Console, line)
+			if len(job.Console) > maxJobConsoleLines {
+				job.Console = job.Console[len(job.Console)-maxJobConsoleLines:]
+			}
+			g.jobManager.mutex.Unlock()
+			return otto.UndefinedValue()
+		}
+	}
+
+	console, err := vm.Get("console")
+	if err == nil && console.IsObject() {
+		for _, level := range []string{"log", "info", "warn", "error"} {
+			console.Object().Set(level, captureConsole(level))
+		}
+	}
+}
+
+//Update the job record after the script finished
+func (g *Gateway) finishJob(job *Job, vm *otto.Otto, err error) {
+	returnValue := ""
+	if value, getErr := vm.Get("HTTP_RESP"); getErr == nil && value.IsDefined() {
+		returnValue, _ = value.ToString()
+	}
+
+	g.jobManager.mutex.Lock()
+	job.vm = nil
+	job.EndTime = time.Now().Unix()
+	job.ReturnValue = returnValue
+	if job.cancelled {
+		job.Status = "cancelled"
+	} else if err != nil {
+		job.Status = "failed"
+		job.Error = err.Error()
+	} else {
+		job.Status = "finished"
+		job.Progress = 100
+	}
+	g.jobManager.mutex.Unlock()
+
+	g.saveJob(job)
+}
+
+//Inject the functions for managing the jobs of the current user
+func (g *Gateway) injectJobManagementFunctions(vm *otto.Otto, u *user.User) {
+	//getJob(jobID) => return the job status as JSON string, or false if not found
+	vm.Set("getJob", func(call otto.FunctionCall) otto.Value {
+		jobID, _ := call.Argument(0).ToString()
+		thisJob, err := g.GetJob(jobID)
+		if err != nil || thisJob.Owner != u.Username {
+			return otto.FalseValue()
+		}
+		js, _ := json.Marshal(thisJob)
+		reply, _ := vm.ToValue(string(js))
+		return reply
+	})
+
+	//listJobs() => return the jobs of the current user as JSON string
+	vm.Set("listJobs", func(call otto.FunctionCall) otto.Value {
+		js, _ := json.Marshal(g.ListJobs(u.Username))
+		reply, _ := vm.ToValue(string(js))
+		return reply
+	})
+
+	//cancelJob(jobID) => return true if the job is cancelled
+	vm.Set("cancelJob", func(call otto.FunctionCall) otto.Value {
+		jobID, _ := call.Argument(0).ToString()
+		thisJob, err := g.GetJob(jobID)
+		if err != nil || thisJob.Owner != u.Username {
+			return otto.FalseValue()
+		}
+		err = g.CancelJob(jobID)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+		return otto.TrueValue()
+	})
+}
+
+//Handle listing of the jobs of the current user
+func (g *Gateway) HandleListJobs(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := g.Option.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	js, _ := json.Marshal(g.ListJobs(userinfo.Username))
+	sendJSONResponse(w, string(js))
+}
+
+//Handle getting the status of a job
+func (g *Gateway) HandleJobStatus(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := g.Option.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	jobID, err := mv(r, "id", false)
+	if err != nil {
+		sendErrorResponse(w, "Invalid job id")
+		return
+	}
+
+	thisJob, err := g.GetJob(jobID)
+	if err != nil || (thisJob.Owner != userinfo.Username && !userinfo.IsAdmin()) {
+		sendErrorResponse(w, "Job not exists")
+		return
+	}
+
+	js, _ := json.Marshal(thisJob)
+	sendJSONResponse(w, string(js))
+}
+
+//Handle cancelling of a running job
+func (g *Gateway) HandleCancelJob(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := g.Option.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	jobID, err := mv(r, "id", true)
+	if err != nil {
+		sendErrorResponse(w, "Invalid job id")
+		return
+	}
+
+	thisJob, err := g.GetJob(jobID)
+	if err != nil || (thisJob.Owner != userinfo.Username && !userinfo.IsAdmin()) {
+		sendErrorResponse(w, "Job not exists")
+		return
+	}
+
+	err = g.CancelJob(jobID)
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+
+	log.Println("[AGI] Job " + jobID + " (" + thisJob.ScriptFile + ") cancelled by " + userinfo.Username)
+	sendOK(w)
+}
@@ -0,0 +1,709 @@
+package agi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+/*
+	AGI Module Key-Value Storage
+
+	Each module has its own isolated key-value namespaces. The module namespace
+	is shared by all users of the module and each user has a private namespace
+	inside the module. Namespaces are stored as nested buckets of the agi-kv table
+
+	agi-kv / {module root} / module            => Module namespace
+	agi-kv / {module root} / user / {username} => User namespace
+
+	The size of a namespace (length of keys and values) is limited by the quota
+	of the module, which can be set by admin. Data of a module can be exported,
+	imported and wiped by admin and is removed when the module is uninstalled.
+*/
+
+const (
+	kvTableName      = "agi-kv"        //Table holding all the module namespaces
+	kvQuotaTableName = "agi-kv-quotas" //Table holding the quota of modules, key is the module root folder
+	kvOwnerTableName = "agi-db-owners" //Table holding the owner module of the database tables created by modules
+	kvMaxKeyLength   = 1024
+)
+
+//Storage quota of the namespaces of a module in bytes, 0 = unlimited
+type KVQuota struct {
+	Module int64 //Quota of the module namespace
+	User   int64 //Quota of each user namespace
+}
+
+type KVEntry struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+//Usage summary of a module for admin
+type KVModuleUsage struct {
+	Module      string
+	ModuleKeys  int
+	ModuleSize  int64
+	Users       map[string]int64 //Username => namespace size
+	OwnedTables []string         //Database tables created by this module
+	Quota       KVQuota
+}
+
+//Exported data of a module
+type KVModuleExport struct {
+	Module   string
+	Exported int64
+	Data     []KVEntry                             //Entries in the module namespace
+	Users    map[string][]KVEntry                  //Entries in the user namespaces
+	Tables   map[string]map[string]json.RawMessage //Database tables owned by the module
+}
+
+//Error returned when writing the entry would exceed the namespace quota
+type KVQuotaExceededError struct {
+	Quota int64
+}
+
+func (e *KVQuotaExceededError) Error() string {
+	return "Storage quota exceeded (" + strconv.FormatInt(e.Quota, 10) + " bytes)"
+}
+
+//A key-value namespace of a module, or of a user in a module if Username is not empty
+type KVNamespace struct {
+	gateway  *Gateway
+	Module   string
+	Username string
+}
+
+//Get the namespace of a module. Leave username empty for the namespace shared by all users
+func (g *Gateway) GetKVNamespace(module string, username string) *KVNamespace {
+	return &KVNamespace{
+		gateway:  g,
+		Module:   module,
+		Username: username,
+	}
+}
+
+func (g *Gateway) getBoltDB() *bolt.DB {
+	return g.Option.UserHandler.GetDatabase().Db
+}
+
+func (g *Gateway) kvWritable() error {
+	if g.Option.UserHandler.GetDatabase().ReadOnly {
+		return errors.New("Operation rejected in ReadOnly mode")
+	}
+	return nil
+}
+
+//Get the bucket of the namespace, return nil if it does not exist and create is false
+func (n *KVNamespace) bucket(tx *bolt.Tx, create bool) (*bolt.Bucket, error) {
+	if n.Module == "" {
+		return nil, errors.New("Key-value storage is only available to modules")
+	}
+
+	path := [][]byte{[]byte(kvTableName), []byte(n.Module), []byte("module")}
+	if n.Username != "" {
+		path = [][]byte{[]byte(kvTableName), []byte(n.Module), []byte("user"), []byte(n.Username)}
+	}
+
+	var b *bolt.Bucket
+	for i, name := range path {
+		if create {
+			var err error
+			if i == 0 {
+				b, err = tx.CreateBucketIfNotExists(name)
+			} else {
+				b, err = b.CreateBucketIfNotExists(name)
+			}
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			if i == 0 {
+				b = tx.Bucket(name)
+			} else {
+				b = b.Bucket(name)
+			}
+			if b == nil {
+				return nil, nil
+			}
+		}
+	}
+	return b, nil
+}
+
+func validateKVKey(key string) error {
+	if key == "" {
+		return errors.New("Key cannot be empty")
+	}
+	if len(key) > kvMaxKeyLength {
+		return errors.New("Key cannot be longer than " + strconv.Itoa(kvMaxKeyLength) + " bytes")
+	}
+	return nil
+}
+
+//Get the size of all the keys and values in the bucket
+func bucketSize(b *bolt.Bucket) int64 {
+	if b == nil {
+		return 0
+	}
+
+	var size int64
+	b.ForEach(func(k, v []byte) error {
+		if v != nil {
+			size += int64(len(k) + len(v))
+		}
+		return nil
+	})
+	return size
+}
+
+//Get the quota of this namespace in bytes, 0 = unlimited
+func (n *KVNamespace) Quota() int64 {
+	quota := n.gateway.GetKVQuota(n.Module)
+	if n.Username != "" {
+		return quota.User
+	}
+	return quota.Module
+}
+
+//Get the number of bytes used by this namespace
+func (n *KVNamespace) Usage() (int64, error) {
+	var size int64
+	err := n.gateway.getBoltDB().View(func(tx *bolt.Tx) error {
+		b, err := n.bucket(tx, false)
+		if err != nil {
+			return err
+		}
+		size = bucketSize(b)
+		return nil
+	})
+	return size, err
+}
+
+//Get the value of the key. Return nil if the key does not exist
+func (n *KVNamespace) Get(key string) ([]byte, error) {
+	var value []byte
+	err := n.gateway.getBoltDB().View(func(tx *bolt.Tx) error {
+		b, err := n.bucket(tx, false)
+		if err != nil || b == nil {
+			return err
+		}
+		if v := b.Get([]byte(key)); v != nil {
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+//Write the value into the bucket if it fits in the quota
+func (n *KVNamespace) put(b *bolt.Bucket, key string, value []byte) error {
+	quota := n.Quota()
+	if quota > 0 {
+		newSize := bucketSize(b) + int64(len(key)+len(value))
+		if oldValue := b.Get([]byte(key)); oldValue != nil {
+			newSize -= int64(len(key) + len(oldValue))
+		}
+		if newSize > quota {
+			return &KVQuotaExceededError{Quota: quota}
+		}
+	}
+	return b.Put([]byte(key), value)
+}
+
+//Set the value of the key
+func (n *KVNamespace) Set(key string, value []byte) error {
+	if err := validateKVKey(key); err != nil {
+		return err
+	}
+	if err := n.gateway.kvWritable(); err != nil {
+		return err
+	}
+
+	return n.gateway.getBoltDB().Update(func(tx *bolt.Tx) error {
+		b, err := n.bucket(tx, true)
+		if err != nil {
+			return err
+		}
+		return n.put(b, key, value)
+	})
+}
+
+//Delete the key
+func (n *KVNamespace) Delete(key string) error {
+	if err := n.gateway.kvWritable(); err != nil {
+		return err
+	}
+
+	return n.gateway.getBoltDB().Update(func(tx *bolt.Tx) error {
+		b, err := n.bucket(tx, false)
+		if err != nil || b == nil {
+			return err
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+/*
+	Atomically set the key to value if its current value equals expected.
+	Use nil expected to require the key not exists, and nil value to delete the key.
+	Return false if the current value does not match
+*/
+func (n *KVNamespace) CompareAndSwap(key string, expected []byte, value []byte) (bool, error) {
+	if err := validateKVKey(key); err != nil {
+		return false, err
+	}
+	if err := n.gateway.kvWritable(); err != nil {
+		return false, err
+	}
+
+	swapped := false
+	err := n.gateway.getBoltDB().Update(func(tx *bolt.Tx) error {
+		b, err := n.bucket(tx, true)
+		if err != nil {
+			return err
+		}
+
+		current := b.Get([]byte(key))
+		if (expected == nil) != (current == nil) || (expected != nil && !bytes.Equal(current, expected)) {
+			return nil
+		}
+
+		if value == nil {
+			err = b.Delete([]byte(key))
+		} else {
+			err = n.put(b, key, value)
+		}
+		if err != nil {
+			return err
+		}
+		swapped = true
+		return nil
+	})
+	return swapped, err
+}
+
+/*
+	List the entries in key order.
+	Only keys starting with prefix and within [start, end) are returned. Leave empty for no restriction.
+	limit <= 0 return all matching entries
+*/
+func (n *KVNamespace) Scan(prefix string, start string, end string, limit int) ([]KVEntry, error) {
+	results := []KVEntry{}
+	err := n.gateway.getBoltDB().View(func(tx *bolt.Tx) error {
+		b, err := n.bucket(tx, false)
+		if err != nil || b == nil {
+			return err
+		}
+
+		seek := prefix
+		if start > seek {
+			seek = start
+		}
+
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(seek)); k != nil; k, v = c.Next() {
+			if !bytes.HasPrefix(k, []byte(prefix)) {
+				break
+			}
+			if end != "" && string(k) >= end {
+				break
+			}
+			if v == nil {
+				continue
+			}
+
+			results = append(results, KVEntry{
+				Key:   string(k),
+				Value: json.RawMessage(append([]byte{}, v...)),
+			})
+			if limit > 0 && len(results) >= limit {
+				break
+			}
+		}
+		return nil
+	})
+	return results, err
+}
+
+//Get the quota of the module, return the system default if not set
+func (g *Gateway) GetKVQuota(module string) KVQuota {
+	quota := KVQuota{
+		Module: g.Option.DefaultKVQuota,
+		User:   g.Option.DefaultKVQuota,
+	}
+	sysdb := g.Option.UserHandler.GetDatabase()
+	if module != "" && sysdb.KeyExists(kvQuotaTableName, module) {
+		sysdb.Read(kvQuotaTableName, module, &quota)
+	}
+	return quota
+}
+
+//Set the quota of the module
+func (g *Gateway) SetKVQuota(module string, quota KVQuota) error {
+	if module == "" {
+		return errors.New("Invalid module name")
+	}
+	if quota.Module < 0 || quota.User < 0 {
+		return errors.New("Quota cannot be negative")
+	}
+	return g.Option.UserHandler.GetDatabase().Write(kvQuotaTableName, module, quota)
+}
+
+//Get the module that created the database table, empty if the table is not owned by any module
+func (g *Gateway) getTableOwner(tablename string) string {
+	owner := ""
+	sysdb := g.Option.UserHandler.GetDatabase()
+	if sysdb.KeyExists(kvOwnerTableName, tablename) {
+		sysdb.Read(kvOwnerTableName, tablename, &owner)
+	}
+	return owner
+}
+
+//Get the list of database tables owned by the module
+func (g *Gateway) getOwnedTables(module string) []string {
+	results := []string{}
+	entries, _ := g.Option.UserHandler.GetDatabase().ListTable(kvOwnerTableName)
+	for _, entry := range entries {
+		owner := ""
+		json.Unmarshal(entry[1], &owner)
+		if owner == module {
+			results = append(results, string(entry[0]))
+		}
+	}
+	sort.Strings(results)
+	return results
+}
+
+//Get the list of modules with stored data
+func (g *Gateway) ListModuleData() ([]KVModuleUsage, error) {
+	modules := map[string]*KVModuleUsage{}
+	getUsage := func(module string) *KVModuleUsage {
+		if _, ok := modules[module]; !ok {
+			modules[module] = &KVModuleUsage{
+				Module:      module,
+				Users:       map[string]int64{},
+				OwnedTables: []string{},
+				Quota:       g.GetKVQuota(module),
+			}
+		}
+		return modules[module]
+	}
+
+	err := g.getBoltDB().View(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(kvTableName))
+		if root == nil {
+			return nil
+		}
+
+		return root.ForEach(func(name, _ []byte) error {
+			usage := getUsage(string(name))
+			moduleBucket := root.Bucket(name)
+			if moduleBucket == nil {
+				return nil
+			}
+
+			if b := moduleBucket.Bucket([]byte("module")); b != nil {
+				usage.ModuleKeys = b.Stats().KeyN
+				usage.ModuleSize = bucketSize(b)
+			}
+
+			if userBuckets := moduleBucket.Bucket([]byte("user")); userBuckets != nil {
+				userBuckets.ForEach(func(username, _ []byte) error {
+					usage.Users[string(username)] = bucketSize(userBuckets.Bucket(username))
+					return nil
+				})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	entries, _ := g.Option.UserHandler.GetDatabase().ListTable(kvOwnerTableName)
+	for _, entry := range entries {
+		owner := ""
+		json.Unmarshal(entry[1], &owner)
+		if owner != "" {
+			usage := getUsage(owner)
+			usage.OwnedTables = append(usage.OwnedTables, string(entry[0]))
+		}
+	}
+
+	results := []KVModuleUsage{}
+	for _, usage := range modules {
+		results = append(results, *usage)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Module < results[j].Module
+	})
+	return results, nil
+}
+
+//Check if the module has any stored data
+func (g *Gateway) ModuleHasData(module string) bool {
+	if len(g.getOwnedTables(module)) > 0 {
+		return true
+	}
+
+	exists := false
+	g.getBoltDB().View(func(tx *bolt.Tx) error {
+		if root := tx.Bucket([]byte(kvTableName)); root != nil {
+			exists = root.Bucket([]byte(module)) != nil
+		}
+		return nil
+	})
+	return exists
+}
+
+//Export all the data of the module, including its namespaces and owned database tables
+func (g *Gateway) ExportModuleData(module string, w io.Writer) error {
+	export := KVModuleExport{
+		Module:   module,
+		Exported: time.Now().Unix(),
+		Users:    map[string][]KVEntry{},
+		Tables:   map[string]map[string]json.RawMessage{},
+	}
+
+	var err error
+	export.Data, err = g.GetKVNamespace(module, "").Scan("", "", "", 0)
+	if err != nil {
+		return err
+	}
+
+	usernames := []string{}
+	g.getBoltDB().View(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(kvTableName))
+		if root == nil || root.Bucket([]byte(module)) == nil || root.Bucket([]byte(module)).Bucket([]byte("user")) == nil {
+			return nil
+		}
+		return root.Bucket([]byte(module)).Bucket([]byte("user")).ForEach(func(username, _ []byte) error {
+			usernames = append(usernames, string(username))
+			return nil
+		})
+	})
+
+	for _, username := range usernames {
+		export.Users[username], err = g.GetKVNamespace(module, username).Scan("", "", "", 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	sysdb := g.Option.UserHandler.GetDatabase()
+	for _, tablename := range g.getOwnedTables(module) {
+		if !sysdb.TableExists(tablename) {
+			continue
+		}
+		table := map[string]json.RawMessage{}
+		entries, err := sysdb.ListTable(tablename)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			table[string(entry[0])] = json.RawMessage(entry[1])
+		}
+		export.Tables[tablename] = table
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", " ")
+	return encoder.Encode(export)
+}
+
+//Restore the data exported by ExportModuleData. Existing keys are overwritten
+func (g *Gateway) ImportModuleData(module string, r io.Reader) error {
+	if err := g.kvWritable(); err != nil {
+		return err
+	}
+
+	export := KVModuleExport{}
+	err := json.NewDecoder(r).Decode(&export)
+	if err != nil {
+		return errors.New("Invalid module data: " + err.Error())
+	}
+
+	err = g.getBoltDB().Update(func(tx *bolt.Tx) error {
+		namespaces := map[string][]KVEntry{"": export.Data}
+		for username, entries := range export.Users {
+			if username != "" {
+				namespaces[username] = entries
+			}
+		}
+
+		for username, entries := range namespaces {
+			b, err := g.GetKVNamespace(module, username).bucket(tx, true)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				if validateKVKey(entry.Key) != nil {
+					continue
+				}
+				if err := b.Put([]byte(entry.Key), entry.Value); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sysdb := g.Option.UserHandler.GetDatabase()
+	for tablename, entries := range export.Tables {
+		if stringInSlice(tablename, g.ReservedTables) {
+			continue
+		}
+		//Only import into tables owned by the module, or tables not exists yet
+		owner := g.getTableOwner(tablename)
+		if owner != module && (owner != "" || sysdb.TableExists(tablename)) {
+			continue
+		}
+
+		sysdb.NewTable(tablename)
+		sysdb.Write(kvOwnerTableName, tablename, module)
+		for key, value := range entries {
+			sysdb.Write(tablename, key, value)
+		}
+	}
+	return nil
+}
+
+//Remove the data of the module. Leave username empty to remove all data of the module, including its owned database tables
+func (g *Gateway) RemoveModuleData(module string, username string) error {
+	if err := g.kvWritable(); err != nil {
+		return err
+	}
+
+	err := g.getBoltDB().Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(kvTableName))
+		if root == nil || root.Bucket([]byte(module)) == nil {
+			return nil
+		}
+
+		if username == "" {
+			return root.DeleteBucket([]byte(module))
+		}
+
+		userBuckets := root.Bucket([]byte(module)).Bucket([]byte("user"))
+		if userBuckets == nil || userBuckets.Bucket([]byte(username)) == nil {
+			return nil
+		}
+		return userBuckets.DeleteBucket([]byte(username))
+	})
+	if err != nil || username != "" {
+		return err
+	}
+
+	sysdb := g.Option.UserHandler.GetDatabase()
+	for _, tablename := range g.getOwnedTables(module) {
+		if sysdb.TableExists(tablename) {
+			sysdb.DropTable(tablename)
+			sysdb.Tables.Delete(tablename)
+		}
+		sysdb.Delete(kvOwnerTableName, tablename)
+	}
+	sysdb.Delete(kvQuotaTableName, module)
+	log.Println("[AGI] Data of module " + module + " removed")
+	return nil
+}
+
+/*
+	Handle the inspection and management of module data. Admin only
+	GET: (no module) => return the data usage of all modules
+	GET: module={name}&user={username}&prefix={prefix} => return the entries of the namespace
+	GET: opr=export&module={name} => download the data of the module
+	POST: opr=import&module={name} with the exported file in "file"
+	POST: opr=wipe&module={name}&user={username} => remove the data of the module or one of its users
+	POST: opr=quota&module={name}&modulequota={bytes}&userquota={bytes}
+*/
+func (g *Gateway) HandleModuleData(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		moduleName, err := mv(r, "module", false)
+		if err != nil {
+			results, err := g.ListModuleData()
+			if err != nil {
+				sendErrorResponse(w, err.Error())
+				return
+			}
+			js, _ := json.Marshal(results)
+			sendJSONResponse(w, string(js))
+			return
+		}
+
+		opr, _ := mv(r, "opr", false)
+		if opr == "export" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Disposition", "attachment; filename=\""+strings.ReplaceAll(moduleName, "\"", "")+".json\"")
+			err = g.ExportModuleData(moduleName, w)
+			if err != nil {
+				log.Println("[AGI] Unable to export module data: " + err.Error())
+			}
+			return
+		}
+
+		username, _ := mv(r, "user", false)
+		prefix, _ := mv(r, "prefix", false)
+		entries, err := g.GetKVNamespace(moduleName, username).Scan(prefix, "", "", 1000)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+		js, _ := json.Marshal(entries)
+		sendJSONResponse(w, string(js))
+		return
+	}
+
+	moduleName, err := mv(r, "module", true)
+	if err != nil || moduleName == "" {
+		sendErrorResponse(w, "Invalid module name")
+		return
+	}
+
+	opr, _ := mv(r, "opr", true)
+	if opr == "import" {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			sendErrorResponse(w, "Invalid file")
+			return
+		}
+		defer file.Close()
+		err = g.ImportModuleData(moduleName, file)
+	} else if opr == "wipe" {
+		username, _ := mv(r, "user", true)
+		err = g.RemoveModuleData(moduleName, username)
+	} else if opr == "quota" {
+		quota := g.GetKVQuota(moduleName)
+		for key, target := range map[string]*int64{"modulequota": &quota.Module, "userquota": &quota.User} {
+			if value, err := mv(r, key, true); err == nil && value != "" {
+				*target, err = strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					sendErrorResponse(w, "Invalid "+key)
+					return
+				}
+			}
+		}
+		err = g.SetKVQuota(moduleName, quota)
+	} else {
+		sendErrorResponse(w, "Unknown operation")
+		return
+	}
+
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+	sendOK(w)
+}
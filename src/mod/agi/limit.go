@@ -0,0 +1,304 @@
+package agi
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/robertkrimen/otto"
+)
+
+/*
+	AGI Execution Limits
+
+	Each script is executed with a wall-clock timeout, a maximum number of
+	outgoing HTTP calls and a maximum number of bytes written to the file system.
+	When any of the limits is reached, the VM is stopped with otto's interrupt
+	mechanism so even a script stuck in while(true){} can be aborted.
+
+	Limits are resolved in the following order: scheduled job limit, module limit
+	(set by admin) and the system default limit
+*/
+
+type ExecutionLimit struct {
+	Timeout         int64 //Maximum execution time in seconds, 0 = unlimited
+	MaxHTTPCalls    int   //Maximum number of outgoing HTTP requests, 0 = unlimited
+	MaxBytesWritten int64 //Maximum number of bytes written to file system, 0 = unlimited
+}
+
+//Error returned when the script is aborted due to limit exceeded
+type ExecutionAbortedError struct {
+	Reason string
+}
+
+func (e *ExecutionAbortedError) Error() string {
+	return "Script execution aborted: " + e.Reason
+}
+
+//The execution states of a running vm
+type executionContext struct {
+	module       string //The module root folder of the script, empty if not a module script
+	limit        ExecutionLimit
+	httpCalls    int
+	bytesWritten int64
+	aborted      bool
+	vm           *otto.Otto
+	mutex        sync.Mutex
+}
+
+//Stop the vm at the next statement
+func (c *executionContext) abort(reason string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.aborted {
+		return
+	}
+	c.aborted = true
+
+	abortError := &ExecutionAbortedError{Reason: reason}
+	select {
+	case c.vm.Interrupt <- func() {
+		panic(abortError)
+	}:
+	default:
+	}
+}
+
+//Get the limit of the given module, return the system default if not set
+func (g *Gateway) GetModuleExecutionLimit(moduleName string) ExecutionLimit {
+	limit := g.Option.DefaultLimit
+	sysdb := g.Option.UserHandler.GetDatabase()
+	if moduleName != "" && sysdb.KeyExists("agi-limits", moduleName) {
+		sysdb.Read("agi-limits", moduleName, &limit)
+	}
+	return limit
+}
+
+//Set the limit of the given module
+func (g *Gateway) SetModuleExecutionLimit(moduleName string, limit ExecutionLimit) error {
+	if moduleName == "" {
+		return errors.New("Invalid module name")
+	}
+	if limit.Timeout < 0 || limit.MaxHTTPCalls < 0 || limit.MaxBytesWritten < 0 {
+		return errors.New("Limit values cannot be negative")
+	}
+	return g.Option.UserHandler.GetDatabase().Write("agi-limits", moduleName, limit)
+}
+
+//Remove the limit of the given module so the system default is used
+func (g *Gateway) RemoveModuleExecutionLimit(moduleName string) error {
+	return g.Option.UserHandler.GetDatabase().Delete("agi-limits", moduleName)
+}
+
+/*
+	Run the script in the vm with the given limit.
+	moduleName is used for enforcing the module capabilities, leave empty if the script
+	does not belongs to any module. scriptFile and username are only used for logging
+*/
+func (g *Gateway) runWithLimit(vm *otto.Otto, script interface{}, moduleName string, limit ExecutionLimit, scriptFile string, username string) (value otto.Value, err error) {
+	context := &executionContext{
+		module: moduleName,
+		limit:  limit,
+		vm:     vm,
+	}
+	if vm.Interrupt == nil {
+		vm.Interrupt = make(chan func(), 1)
+	}
+	g.runningVMs.Store(vm, context)
+	defer g.runningVMs.Delete(vm)
+
+	if limit.Timeout > 0 {
+		timer := time.AfterFunc(time.Duration(limit.Timeout)*time.Second, func() {
+			context.abort("timeout after " + strconv.FormatInt(limit.Timeout, 10) + " seconds")
+		})
+		defer timer.Stop()
+	}
+
+	defer func() {
+		if caught := recover(); caught != nil {
+			if abortError, ok := caught.(*ExecutionAbortedError); ok {
+				log.Println("[AGI] Script " + scriptFile + " executed by " + username + " aborted: " + abortError.Reason)
+				err = abortError
+				return
+			}
+			panic(caught)
+		}
+	}()
+
+	return vm.Run(script)
+}
+
+//Get the execution context of the vm, return nil if the vm is not started by runWithLimit
+func (g *Gateway) getExecutionContext(vm *otto.Otto) *executionContext {
+	context, ok := g.runningVMs.Load(vm)
+	if !ok {
+		return nil
+	}
+	return context.(*executionContext)
+}
+
+//Count an outgoing HTTP call. Return error and abort the script if the limit is reached
+func (g *Gateway) chargeHTTPCall(vm *otto.Otto) error {
+	context := g.getExecutionContext(vm)
+	if context == nil {
+		return nil
+	}
+
+	context.mutex.Lock()
+	context.httpCalls++
+	exceeded := context.limit.MaxHTTPCalls > 0 && context.httpCalls > context.limit.MaxHTTPCalls
+	context.mutex.Unlock()
+
+	if exceeded {
+		reason := "maximum number of HTTP calls (" + strconv.Itoa(context.limit.MaxHTTPCalls) + ") exceeded"
+		context.abort(reason)
+		return errors.New(reason)
+	}
+	return nil
+}
+
+//Count the bytes about to be written. Return error and abort the script if the limit is reached
+func (g *Gateway) chargeBytesWritten(vm *otto.Otto, size int64) error {
+	context := g.getExecutionContext(vm)
+	if context == nil {
+		return nil
+	}
+
+	context.mutex.Lock()
+	context.bytesWritten += size
+	exceeded := context.limit.MaxBytesWritten > 0 && context.bytesWritten > context.limit.MaxBytesWritten
+	context.mutex.Unlock()
+
+	if exceeded {
+		reason := "maximum bytes written (" + strconv.FormatInt(context.limit.MaxBytesWritten, 10) + ") exceeded"
+		context.abort(reason)
+		return errors.New(reason)
+	}
+	return nil
+}
+
+//Count the size of a file that is already written by the vm
+func (g *Gateway) chargeFileWritten(vm *otto.Otto, file string) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil
+	}
+	return g.chargeBytesWritten(vm, info.Size())
+}
+
+//Get the remaining bytes the vm can write, return -1 if unlimited
+func (g *Gateway) remainingWriteBytes(vm *otto.Otto) int64 {
+	context := g.getExecutionContext(vm)
+	if context == nil || context.limit.MaxBytesWritten == 0 {
+		return -1
+	}
+
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+	remaining := context.limit.MaxBytesWritten - context.bytesWritten
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+/*
+	Handle the get and set of module execution limits. Admin only
+	GET: module={name} => return the limit of the module
+	POST: module={name}&timeout={sec}&maxhttp={count}&maxwrite={bytes}
+	POST: module={name}&remove=true => reset to system default
+*/
+func (g *Gateway) HandleExecutionLimits(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		moduleName, err := mv(r, "module", false)
+		if err != nil {
+			//Return the system default
+			js, _ := json.Marshal(g.Option.DefaultLimit)
+			sendJSONResponse(w, string(js))
+			return
+		}
+
+		js, _ := json.Marshal(g.GetModuleExecutionLimit(moduleName))
+		sendJSONResponse(w, string(js))
+		return
+	}
+
+	moduleName, err := mv(r, "module", true)
+	if err != nil {
+		sendErrorResponse(w, "Invalid module name")
+		return
+	}
+
+	remove, _ := mv(r, "remove", true)
+	if remove == "true" {
+		err = g.RemoveModuleExecutionLimit(moduleName)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+		sendOK(w)
+		return
+	}
+
+	limit, err := ParseExecutionLimit(r, g.GetModuleExecutionLimit(moduleName))
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+
+	err = g.SetModuleExecutionLimit(moduleName, limit)
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+	sendOK(w)
+}
+
+//Clamp the limit so it never exceeds max. Unlimited (0) fields in max do not restrict the limit
+func (l ExecutionLimit) Within(max ExecutionLimit) ExecutionLimit {
+	if max.Timeout > 0 && (l.Timeout == 0 || l.Timeout > max.Timeout) {
+		l.Timeout = max.Timeout
+	}
+	if max.MaxHTTPCalls > 0 && (l.MaxHTTPCalls == 0 || l.MaxHTTPCalls > max.MaxHTTPCalls) {
+		l.MaxHTTPCalls = max.MaxHTTPCalls
+	}
+	if max.MaxBytesWritten > 0 && (l.MaxBytesWritten == 0 || l.MaxBytesWritten > max.MaxBytesWritten) {
+		l.MaxBytesWritten = max.MaxBytesWritten
+	}
+	return l
+}
+
+//Parse the timeout, maxhttp and maxwrite POST paramters. Missing values are taken from base
+func ParseExecutionLimit(r *http.Request, base ExecutionLimit) (ExecutionLimit, error) {
+	limit := base
+	if timeout, err := mv(r, "timeout", true); err == nil {
+		value, err := strconv.ParseInt(timeout, 10, 64)
+		if err != nil || value < 0 {
+			return limit, errors.New("Invalid timeout")
+		}
+		limit.Timeout = value
+	}
+
+	if maxhttp, err := mv(r, "maxhttp", true); err == nil {
+		value, err := strconv.Atoi(maxhttp)
+		if err != nil || value < 0 {
+			return limit, errors.New("Invalid maxhttp")
+		}
+		limit.MaxHTTPCalls = value
+	}
+
+	if maxwrite, err := mv(r, "maxwrite", true); err == nil {
+		value, err := strconv.ParseInt(maxwrite, 10, 64)
+		if err != nil || value < 0 {
+			return limit, errors.New("Invalid maxwrite")
+		}
+		limit.MaxBytesWritten = value
+	}
+
+	return limit, nil
+}
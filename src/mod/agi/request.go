@@ -0,0 +1,202 @@
+package agi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/robertkrimen/otto"
+	user "imuslab.com/arozos/mod/user"
+)
+
+/*
+	AGI Request Object
+
+	Expose the incoming HTTP request to the script as the request object
+
+	request.method, request.url, request.path, request.ip
+	request.headers   //Header key => value, except Cookie and Authorization
+	request.cookies   //Cookie name => value, except the login session cookie
+	request.query     //Query string parameters
+	request.form      //Form parameters from urlencoded or multipart body
+	request.body      //Raw body as string, empty for multipart uploads
+	request.files     //Uploaded files [{field, filename, size, contentType}]
+	request.saveFile(field, vpath) //Save an uploaded file to the given virtual path
+*/
+
+//Maximum size of the raw body kept in memory for the request object
+const maxRequestBodySize = 32 << 20
+
+type requestFile struct {
+	Field       string `json:"field"`
+	Filename    string `json:"filename"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType"`
+}
+
+//Read the raw body of the request and parse its form. The body is restored so it can be read again
+func readRequestBody(r *http.Request) []byte {
+	body := []byte{}
+	if r.Body == nil {
+		return body
+	}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		//Do not keep the uploaded files in memory
+		r.ParseMultipartForm(maxRequestBodySize)
+		return body
+	}
+
+	body, _ = ioutil.ReadAll(io.LimitReader(r.Body, maxRequestBodySize))
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ParseForm()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body
+}
+
+//Convert url.Values style map into a map with single values as string and multiple values as array
+func flattenValues(values map[string][]string) map[string]interface{} {
+	results := map[string]interface{}{}
+	for key, value := range values {
+		if len(value) == 1 {
+			results[key] = value[0]
+		} else {
+			results[key] = value
+		}
+	}
+	return results
+}
+
+//Get the name of the login session cookie, which scripts cannot read or set
+func (g *Gateway) sessionCookieName() string {
+	if g.Option.UserHandler == nil || g.Option.UserHandler.GetAuthAgent() == nil {
+		return ""
+	}
+	return g.Option.UserHandler.GetAuthAgent().SessionName
+}
+
+//Inject the request object into the vm. u can be nil if the script is not executed by a user
+func (g *Gateway) injectRequestObject(vm *otto.Otto, r *http.Request, body []byte, u *user.User) {
+	//Credentials of the user are never exposed to the script
+	headers := map[string]string{}
+	for key := range r.Header {
+		if key == "Cookie" || key == "Authorization" {
+			continue
+		}
+		headers[key] = r.Header.Get(key)
+	}
+	cookies := map[string]string{}
+	for _, cookie := range r.Cookies() {
+		if cookie.Name != g.sessionCookieName() {
+			cookies[cookie.Name] = cookie.Value
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	files := []requestFile{}
+	if r.MultipartForm != nil {
+		for field, fileHeaders := range r.MultipartForm.File {
+			for _, fileHeader := range fileHeaders {
+				files = append(files, requestFile{
+					Field:       field,
+					Filename:    fileHeader.Filename,
+					Size:        fileHeader.Size,
+					ContentType: fileHeader.Header.Get("Content-Type"),
+				})
+			}
+		}
+	}
+
+	requestInfo := map[string]interface{}{
+		"method":  r.Method,
+		"url":     r.URL.String(),
+		"path":    r.URL.Path,
+		"ip":      host,
+		"headers": headers,
+		"cookies": cookies,
+		"query":   flattenValues(r.URL.Query()),
+		"form":    flattenValues(r.PostForm),
+		"body":    string(body),
+		"files":   files,
+	}
+
+	js, _ := json.Marshal(requestInfo)
+	requestObject, err := vm.Object("(" + string(js) + ")")
+	if err != nil {
+		g.raiseError(err)
+		return
+	}
+
+	//saveFile(field, vpath) => return true if succeed
+	requestObject.Set("saveFile", func(call otto.FunctionCall) otto.Value {
+		field, _ := call.Argument(0).ToString()
+		vpath, err := call.Argument(1).ToString()
+		if err != nil || u == nil || r.MultipartForm == nil {
+			return otto.FalseValue()
+		}
+
+		fileHeaders, ok := r.MultipartForm.File[field]
+		if !ok || len(fileHeaders) == 0 {
+			g.raiseError(errors.New("Uploaded file not found: " + field))
+			return otto.FalseValue()
+		}
+
+		if !u.CanWrite(vpath) {
+			g.raiseError(errors.New("Permission Denied"))
+			return otto.FalseValue()
+		}
+
+		rpath, err := g.getScopedPathResolver(vm)(vpath, u)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		if !u.StorageQuota.HaveSpace(fileHeaders[0].Size) {
+			g.raiseError(errors.New("Storage Quota Full"))
+			return otto.FalseValue()
+		}
+
+		if err := g.chargeBytesWritten(vm, fileHeaders[0].Size); err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		src, err := fileHeaders[0].Open()
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+		defer src.Close()
+
+		os.MkdirAll(filepath.Dir(rpath), 0755)
+		dest, err := os.Create(rpath)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+		defer dest.Close()
+
+		_, err = io.Copy(dest, src)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		u.SetOwnerOfFile(rpath)
+		return otto.TrueValue()
+	})
+
+	vm.Set("request", requestObject)
+}
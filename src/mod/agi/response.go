@@ -0,0 +1,426 @@
+package agi
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/robertkrimen/otto"
+	user "imuslab.com/arozos/mod/user"
+)
+
+/*
+	AGI Response Object
+
+	The response object allow scripts to control the HTTP response
+	instead of only returning HTTP_RESP as text. Supported functions
+
+	response.setStatus(code)
+	response.setHeader(key, value)
+	response.setCookie(name, value, {maxAge, path, domain, secure, httpOnly, sameSite})
+	response.redirect(url, code)                 //code default 302
+	response.sendBinary([bytes...], contentType) //Send an array of byte values
+	response.sendBase64(base64, contentType)     //Send base64 encoded binary
+	response.sendFile(vpath, filename)           //Send a file from virtual path
+	response.write(chunk)                        //Stream a chunk to the client
+	response.sendEvent(data, event, id)          //Stream a server-sent event
+	response.flush()
+
+	HTTP_RESP, HTTP_HEADER, HTTP_STATUS and HTTP_HEADERS are still supported
+	and are written when the script finished if the body is not yet sent
+*/
+
+type scriptResponse struct {
+	w         http.ResponseWriter
+	r         *http.Request
+	vm        *otto.Otto
+	committed bool //If the status and headers are already sent to client
+	finished  bool //If the body is sent by redirect, sendBinary, sendBase64 or sendFile
+}
+
+//Send the status and headers set by the script
+func (resp *scriptResponse) writeHeaders() {
+	if resp.committed {
+		return
+	}
+	resp.committed = true
+
+	//Get respond header type from the vm
+	header, _ := resp.vm.Get("HTTP_HEADER")
+	headerString, _ := header.ToString()
+	if headerString != "" && resp.w.Header().Get("Content-Type") == "" {
+		resp.w.Header().Set("Content-Type", headerString)
+	}
+
+	//Custom headers set by the script in HTTP_HEADERS
+	headers, err := resp.vm.Get("HTTP_HEADERS")
+	if err == nil && headers.IsObject() {
+		for _, key := range headers.Object().Keys() {
+			if strings.EqualFold(key, "Set-Cookie") {
+				//Cookies must be set with setCookie
+				continue
+			}
+			headerValue, _ := headers.Object().Get(key)
+			headerValueString, _ := headerValue.ToString()
+			resp.w.Header().Set(key, headerValueString)
+		}
+	}
+
+	//Status code set by the script in HTTP_STATUS or response.setStatus
+	status, err := resp.vm.Get("HTTP_STATUS")
+	if err == nil && status.IsNumber() {
+		statusCode, _ := status.ToInteger()
+		if statusCode >= 100 && statusCode <= 999 {
+			resp.w.WriteHeader(int(statusCode))
+		}
+	}
+}
+
+//Write the body of the response after the script finished
+func (resp *scriptResponse) finish() {
+	if resp.finished {
+		return
+	}
+
+	//Get the return valu from the script
+	value, err := resp.vm.Get("HTTP_RESP")
+	if err != nil {
+		resp.writeHeaders()
+		return
+	}
+	valueString, _ := value.ToString()
+
+	resp.writeHeaders()
+	resp.w.Write([]byte(valueString))
+}
+
+func (resp *scriptResponse) flush() {
+	if flusher, ok := resp.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//Send a binary body with the given content type
+func (resp *scriptResponse) sendBinary(content []byte, contentType string) error {
+	if resp.committed {
+		return errors.New("Response already sent")
+	}
+	if contentType == "" {
+		contentType = http.DetectContentType(content)
+	}
+	resp.w.Header().Set("Content-Type", contentType)
+	resp.w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	resp.writeHeaders()
+	resp.w.Write(content)
+	resp.finished = true
+	return nil
+}
+
+//Convert a JavaScript array of byte values into []byte
+func exportByteArray(value otto.Value) ([]byte, error) {
+	exported, err := value.Export()
+	if err != nil {
+		return nil, err
+	}
+
+	results := []byte{}
+	switch values := exported.(type) {
+	case []byte:
+		return values, nil
+	case []interface{}:
+		for _, v := range values {
+			switch b := v.(type) {
+			case int64:
+				results = append(results, byte(b))
+			case float64:
+				results = append(results, byte(b))
+			default:
+				return nil, errors.New("Byte array contains non numeric value")
+			}
+		}
+	case []int64:
+		for _, b := range values {
+			results = append(results, byte(b))
+		}
+	case []float64:
+		for _, b := range values {
+			results = append(results, byte(b))
+		}
+	default:
+		return nil, errors.New("Input is not a byte array")
+	}
+	return results, nil
+}
+
+//Inject the response object into the vm. u can be nil if the script is not executed by a user
+func (g *Gateway) injectResponseObject(vm *otto.Otto, w http.ResponseWriter, r *http.Request, u *user.User) *scriptResponse {
+	resp := &scriptResponse{
+		w:  w,
+		r:  r,
+		vm: vm,
+	}
+
+	responseObject, _ := vm.Object("({})")
+
+	responseObject.Set("setStatus", func(call otto.FunctionCall) otto.Value {
+		statusCode, err := call.Argument(0).ToInteger()
+		if err != nil || statusCode < 100 || statusCode > 999 {
+			g.raiseError(errors.New("Invalid status code"))
+			return otto.FalseValue()
+		}
+		vm.Set("HTTP_STATUS", statusCode)
+		return otto.TrueValue()
+	})
+
+	responseObject.Set("setHeader", func(call otto.FunctionCall) otto.Value {
+		key, _ := call.Argument(0).ToString()
+		value, _ := call.Argument(1).ToString()
+		if key == "" || resp.committed || strings.EqualFold(key, "Set-Cookie") {
+			//Cookies must be set with setCookie
+			return otto.FalseValue()
+		}
+
+		if strings.EqualFold(key, "Content-Type") {
+			//Keep HTTP_HEADER in sync as it is used as the content type
+			vm.Set("HTTP_HEADER", value)
+		}
+		resp.w.Header().Set(key, value)
+		return otto.TrueValue()
+	})
+
+	responseObject.Set("setCookie", func(call otto.FunctionCall) otto.Value {
+		name, _ := call.Argument(0).ToString()
+		value, _ := call.Argument(1).ToString()
+		if name == "" || resp.committed || name == g.sessionCookieName() {
+			//The login session cookie cannot be overwritten by scripts
+			return otto.FalseValue()
+		}
+
+		cookie := &http.Cookie{
+			Name:  name,
+			Value: value,
+			Path:  "/",
+		}
+
+		if call.Argument(2).IsObject() {
+			options := call.Argument(2).Object()
+			if v, err := options.Get("maxAge"); err == nil && v.IsNumber() {
+				maxAge, _ := v.ToInteger()
+				cookie.MaxAge = int(maxAge)
+			}
+			if v, err := options.Get("path"); err == nil && v.IsString() {
+				cookie.Path, _ = v.ToString()
+			}
+			if v, err := options.Get("domain"); err == nil && v.IsString() {
+				cookie.Domain, _ = v.ToString()
+			}
+			if v, err := options.Get("secure"); err == nil && v.IsBoolean() {
+				cookie.Secure, _ = v.ToBoolean()
+			}
+			if v, err := options.Get("httpOnly"); err == nil && v.IsBoolean() {
+				cookie.HttpOnly, _ = v.ToBoolean()
+			}
+			if v, err := options.Get("sameSite"); err == nil && v.IsString() {
+				sameSite, _ := v.ToString()
+				switch strings.ToLower(sameSite) {
+				case "strict":
+					cookie.SameSite = http.SameSiteStrictMode
+				case "lax":
+					cookie.SameSite = http.SameSiteLaxMode
+				case "none":
+					cookie.SameSite = http.SameSiteNoneMode
+				}
+			}
+		}
+
+		http.SetCookie(resp.w, cookie)
+		return otto.TrueValue()
+	})
+
+	responseObject.Set("redirect", func(call otto.FunctionCall) otto.Value {
+		target, err := call.Argument(0).ToString()
+		if err != nil || target == "" || resp.committed {
+			return otto.FalseValue()
+		}
+
+		statusCode := int64(http.StatusFound)
+		if call.Argument(1).IsNumber() {
+			statusCode, _ = call.Argument(1).ToInteger()
+		}
+		if statusCode < 300 || statusCode > 399 {
+			g.raiseError(errors.New("Invalid redirect status code"))
+			return otto.FalseValue()
+		}
+
+		resp.w.Header().Set("Location", target)
+		vm.Set("HTTP_STATUS", statusCode)
+		resp.writeHeaders()
+		resp.finished = true
+		return otto.TrueValue()
+	})
+
+	responseObject.Set("sendBinary", func(call otto.FunctionCall) otto.Value {
+		content, err := exportByteArray(call.Argument(0))
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		contentType := ""
+		if call.Argument(1).IsString() {
+			contentType, _ = call.Argument(1).ToString()
+		}
+
+		err = resp.sendBinary(content, contentType)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+		return otto.TrueValue()
+	})
+
+	responseObject.Set("sendBase64", func(call otto.FunctionCall) otto.Value {
+		encoded, _ := call.Argument(0).ToString()
+		content, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		contentType := ""
+		if call.Argument(1).IsString() {
+			contentType, _ = call.Argument(1).ToString()
+		}
+
+		err = resp.sendBinary(content, contentType)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+		return otto.TrueValue()
+	})
+
+	responseObject.Set("sendFile", func(call otto.FunctionCall) otto.Value {
+		vpath, err := call.Argument(0).ToString()
+		if err != nil || u == nil || resp.committed {
+			return otto.FalseValue()
+		}
+
+		if !u.CanRead(vpath) {
+			g.raiseError(errors.New("Permission Denied"))
+			return otto.FalseValue()
+		}
+
+		rpath, err := g.getScopedPathResolver(vm)(vpath, u)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+
+		f, err := os.Open(rpath)
+		if err != nil {
+			g.raiseError(err)
+			return otto.FalseValue()
+		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil || info.IsDir() {
+			g.raiseError(errors.New(vpath + " is not a file"))
+			return otto.FalseValue()
+		}
+
+		//Optional download filename
+		if call.Argument(1).IsString() {
+			filename, _ := call.Argument(1).ToString()
+			resp.w.Header().Set("Content-Disposition", "attachment; filename=\""+strings.ReplaceAll(filename, "\"", "")+"\"")
+		}
+
+		//Custom headers set by the script
+		headers, err := vm.Get("HTTP_HEADERS")
+		if err == nil && headers.IsObject() {
+			for _, key := range headers.Object().Keys() {
+				if strings.EqualFold(key, "Set-Cookie") {
+					//Cookies must be set with setCookie
+					continue
+				}
+				headerValue, _ := headers.Object().Get(key)
+				headerValueString, _ := headerValue.ToString()
+				resp.w.Header().Set(key, headerValueString)
+			}
+		}
+
+		//ServeContent handles content type, range requests and caching headers
+		resp.committed = true
+		resp.finished = true
+		http.ServeContent(resp.w, resp.r, filepath.Base(rpath), info.ModTime(), f)
+		return otto.TrueValue()
+	})
+
+	responseObject.Set("write", func(call otto.FunctionCall) otto.Value {
+		if resp.finished {
+			return otto.FalseValue()
+		}
+		chunk, _ := call.Argument(0).ToString()
+		resp.writeHeaders()
+		resp.w.Write([]byte(chunk))
+		resp.flush()
+		return otto.TrueValue()
+	})
+
+	responseObject.Set("sendEvent", func(call otto.FunctionCall) otto.Value {
+		if resp.finished {
+			return otto.FalseValue()
+		}
+
+		//Line breaks in the id or event name would start another field or event in the stream
+		for _, field := range []otto.Value{call.Argument(1), call.Argument(2)} {
+			if value, _ := field.ToString(); field.IsDefined() && strings.ContainsAny(value, "\r\n") {
+				g.raiseError(errors.New("Event name and id cannot contain line breaks"))
+				return otto.FalseValue()
+			}
+		}
+
+		if !resp.committed {
+			resp.w.Header().Set("Content-Type", "text/event-stream")
+			resp.w.Header().Set("Cache-Control", "no-cache")
+			resp.w.Header().Set("Connection", "keep-alive")
+			vm.Set("HTTP_HEADER", "text/event-stream")
+		}
+
+		//CR is also a line terminator in event streams. Every line of the data is sent as a data field
+		data, _ := call.Argument(0).ToString()
+		data = strings.ReplaceAll(strings.ReplaceAll(data, "\r\n", "\n"), "\r", "\n")
+		message := ""
+		if call.Argument(2).IsDefined() {
+			id, _ := call.Argument(2).ToString()
+			message += "id: " + id + "\n"
+		}
+		if call.Argument(1).IsDefined() {
+			eventName, _ := call.Argument(1).ToString()
+			message += "event: " + eventName + "\n"
+		}
+		for _, line := range strings.Split(data, "\n") {
+			message += "data: " + line + "\n"
+		}
+		message += "\n"
+
+		resp.writeHeaders()
+		resp.w.Write([]byte(message))
+		resp.flush()
+		return otto.TrueValue()
+	})
+
+	responseObject.Set("flush", func(call otto.FunctionCall) otto.Value {
+		resp.writeHeaders()
+		resp.flush()
+		return otto.TrueValue()
+	})
+
+	vm.Set("response", responseObject)
+	return resp
+}
@@ -8,12 +8,17 @@ import (
 	"log"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/robertkrimen/otto"
+	apt "imuslab.com/arozos/mod/apt"
 )
 
+//Package names accepted by pkgInstalled, following the naming rule of Debian packages
+var validPackageName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.+_-]*$`)
+
 //Inject aroz online custom functions into the virtual machine
 func (g *Gateway) injectStandardLibs(vm *otto.Otto, scriptFile string, scriptScope string) {
 	//Define system core modules and definations
@@ -26,6 +31,9 @@ func (g *Gateway) injectStandardLibs(vm *otto.Otto, scriptFile string, scriptSco
 	vm.Set("LOADED_STORAGES", g.Option.UserHandler.GetStoragePool())
 	vm.Set("HTTP_RESP", "")
 	vm.Set("HTTP_HEADER", "text/plain")
+	vm.Set("HTTP_STATUS", 200)
+	httpHeaders, _ := vm.Object("({})")
+	vm.Set("HTTP_HEADERS", httpHeaders)
 
 	//Response related
 	vm.Set("sendResp", func(call otto.FunctionCall) otto.Value {
@@ -51,8 +59,14 @@ func (g *Gateway) injectStandardLibs(vm *otto.Otto, scriptFile string, scriptSco
 			return reply
 		}
 		//Create the table with given tableName
-		if g.filterDBTable(tableName, false) {
+		if g.filterDBTable(tableName, false) && g.capabilityAllowTable(vm, tableName) {
+			tableExists := sysdb.TableExists(tableName)
 			sysdb.NewTable(tableName)
+
+			//Tables created by module are owned by the module and removed with it. Existing tables are never claimed
+			if context := g.getExecutionContext(vm); context != nil && context.module != "" && !tableExists {
+				sysdb.Write(kvOwnerTableName, tableName, context.module)
+			}
 			//Return true
 			reply, _ := vm.ToValue(true)
 			return reply
@@ -69,7 +83,7 @@ func (g *Gateway) injectStandardLibs(vm *otto.Otto, scriptFile string, scriptSco
 			return reply
 		}
 		//Create the table with given tableName
-		if sysdb.TableExists(tableName) {
+		if sysdb.TableExists(tableName) && g.capabilityAllowTable(vm, tableName) {
 			return otto.TrueValue()
 		}
 
@@ -85,8 +99,9 @@ func (g *Gateway) injectStandardLibs(vm *otto.Otto, scriptFile string, scriptSco
 			return reply
 		}
 		//Create the table with given tableName
-		if g.filterDBTable(tableName, true) {
+		if g.filterDBTable(tableName, true) && g.capabilityAllowTable(vm, tableName) {
 			sysdb.DropTable(tableName)
+			sysdb.Delete(kvOwnerTableName, tableName)
 			reply, _ := vm.ToValue(true)
 			return reply
 		}
@@ -106,7 +121,7 @@ func (g *Gateway) injectStandardLibs(vm *otto.Otto, scriptFile string, scriptSco
 		}
 
 		//Check if the tablename is reserved
-		if g.filterDBTable(tableName, true) {
+		if g.filterDBTable(tableName, true) && g.capabilityAllowTable(vm, tableName) {
 			keyString, err := call.Argument(1).ToString()
 			if err != nil {
 				g.raiseError(err)
@@ -135,7 +150,7 @@ func (g *Gateway) injectStandardLibs(vm *otto.Otto, scriptFile string, scriptSco
 		keyString, _ := call.Argument(1).ToString()
 		returnValue := ""
 		reply, _ := vm.ToValue(nil)
-		if g.filterDBTable(tableName, true) {
+		if g.filterDBTable(tableName, true) && g.capabilityAllowTable(vm, tableName) {
 			sysdb.Read(tableName, keyString, &returnValue)
 			r, _ := vm.ToValue(returnValue)
 			reply = r
@@ -150,7 +165,7 @@ func (g *Gateway) injectStandardLibs(vm *otto.Otto, scriptFile string, scriptSco
 		tableName, _ := call.Argument(0).ToString()
 		returnValue := map[string]string{}
 		reply, _ := vm.ToValue(nil)
-		if g.filterDBTable(tableName, true) {
+		if g.filterDBTable(tableName, true) && g.capabilityAllowTable(vm, tableName) {
 			entries, _ := sysdb.ListTable(tableName)
 			for _, keypairs := range entries {
 				//Decode the string
@@ -173,7 +188,7 @@ func (g *Gateway) injectStandardLibs(vm *otto.Otto, scriptFile string, scriptSco
 	vm.Set("deleteDBItem", func(call otto.FunctionCall) otto.Value {
 		tableName, _ := call.Argument(0).ToString()
 		keyString, _ := call.Argument(1).ToString()
-		if g.filterDBTable(tableName, true) {
+		if g.filterDBTable(tableName, true) && g.capabilityAllowTable(vm, tableName) {
 			err := sysdb.Delete(tableName, keyString)
 			if err != nil {
 				return otto.FalseValue()
@@ -195,15 +210,45 @@ func (g *Gateway) injectStandardLibs(vm *otto.Otto, scriptFile string, scriptSco
 			return reply
 		}
 		//Try to decode it to a module Info
-		g.Option.ModuleRegisterParser(jsonModuleConfig)
+		err = g.Option.ModuleRegisterParser(jsonModuleConfig)
 		if err != nil {
 			g.raiseError(err)
 			reply, _ := vm.ToValue(false)
 			return reply
 		}
+
+		//Keep track of the capabilities declared by the module init script
+		if scriptFile != "" && filepath.Base(scriptFile) == "init.agi" {
+			g.registerModuleCapabilities(getScriptRoot(scriptFile, scriptScope), jsonModuleConfig)
+		}
 		return otto.Value{}
 	})
 
+	//Event handler registry. Only usable in the init script of modules
+	if scriptFile != "" && filepath.Base(scriptFile) == "init.agi" {
+		//registerEventHandler(eventType, handlerScript) => return true if succeed
+		vm.Set("registerEventHandler", func(call otto.FunctionCall) otto.Value {
+			eventType, err := call.Argument(0).ToString()
+			if err != nil {
+				g.raiseError(err)
+				return otto.FalseValue()
+			}
+
+			handlerScript, err := call.Argument(1).ToString()
+			if err != nil {
+				g.raiseError(err)
+				return otto.FalseValue()
+			}
+
+			err = g.registerEventHandler(eventType, handlerScript, scriptFile, scriptScope)
+			if err != nil {
+				g.raiseError(err)
+				return otto.FalseValue()
+			}
+			return otto.TrueValue()
+		})
+	}
+
 	//Package Executation. Only usable when called to a given script File.
 	if scriptFile != "" && scriptScope != "" {
 		//Package request --> Install linux package if not exists
@@ -237,6 +282,12 @@ func (g *Gateway) injectStandardLibs(vm *otto.Otto, scriptFile string, scriptSco
 				})
 			}
 
+			//The request is kept even if not approved, so execpkg works once the admin approved the capabilities
+			if !g.capabilityAllowPackage(vm, packageName) {
+				g.raiseError(errors.New("Package " + packageName + " is not allowed by module capabilities"))
+				return otto.FalseValue()
+			}
+
 			//Try to install the package via apt
 			err = g.Option.PackageManager.InstallIfNotExists(packageName, requireComply)
 			if err != nil {
@@ -247,6 +298,19 @@ func (g *Gateway) injectStandardLibs(vm *otto.Otto, scriptFile string, scriptSco
 			return otto.TrueValue()
 		})
 
+		//Check if the package is installed. Nothing is installed so it does not require the package capability
+		vm.Set("pkgInstalled", func(call otto.FunctionCall) otto.Value {
+			packageName, err := call.Argument(0).ToString()
+			if err != nil || !validPackageName.MatchString(packageName) {
+				g.raiseError(errors.New("Invalid package name"))
+				return otto.FalseValue()
+			}
+
+			installed, _ := apt.PackageExists(packageName)
+			reply, _ := vm.ToValue(installed)
+			return reply
+		})
+
 		//Exec required pkg with permission control
 		vm.Set("execpkg", func(call otto.FunctionCall) otto.Value {
 			//Check if the pkg is already registered
@@ -257,6 +321,11 @@ func (g *Gateway) injectStandardLibs(vm *otto.Otto, scriptFile string, scriptSco
 				return otto.FalseValue()
 			}
 
+			if !g.capabilityAllowPackage(vm, packageName) {
+				g.raiseError(errors.New("Package " + packageName + " is not allowed by module capabilities"))
+				return otto.FalseValue()
+			}
+
 			if val, ok := g.AllowAccessPkgs[packageName]; ok {
 				//Package already registered by at least one module. Check if this script root registered
 				thisModuleRegistered := false
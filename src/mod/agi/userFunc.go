@@ -254,6 +254,12 @@ func (g *Gateway) injectUserFunctions(vm *otto.Otto, scriptFile string, scriptSc
 			return reply
 		}
 
+		//Check if the module declared this library in its capabilities
+		if !g.capabilityAllowLib(vm, libname) {
+			g.raiseError(errors.New("Library " + libname + " is not allowed by module capabilities"))
+			return otto.FalseValue()
+		}
+
 		//Handle special case on high level libraries
 		if libname == "websocket" && w != nil && r != nil {
 			g.injectWebSocketFunctions(vm, u, w, r)
@@ -274,6 +280,9 @@ func (g *Gateway) injectUserFunctions(vm *otto.Otto, scriptFile string, scriptSc
 		return otto.FalseValue()
 	})
 
+	//Background job status and cancellation
+	g.injectJobManagementFunctions(vm, u)
+
 	//Execd (Execute & detach) run another script and detach the execution
 	vm.Set("execd", func(call otto.FunctionCall) otto.Value {
 		//Check if the pkg is already registered
@@ -293,26 +302,38 @@ func (g *Gateway) injectUserFunctions(vm *otto.Otto, scriptFile string, scriptSc
 			return otto.FalseValue()
 		}
 
-		//Run the script
+		//Run the script as a background job
 		scriptContent, _ := ioutil.ReadFile(targetScriptPath)
-		go func() {
-			//Create a new VM to execute the script (also for isolation)
-			vm := otto.New()
-			//Inject standard libs into the vm
-			g.injectStandardLibs(vm, scriptFile, scriptScope)
-			g.injectUserFunctions(vm, scriptFile, scriptScope, u, w, r)
-
-			vm.Set("PARENT_DETACHED", true)
-			vm.Set("PARENT_PAYLOAD", payload)
-			_, err = vm.Run(string(scriptContent))
+		job := g.createJob(u.Username, targetScriptPath)
+
+		//Create a new VM to execute the script (also for isolation)
+		childVM := otto.New()
+		//Inject standard libs into the vm
+		g.injectStandardLibs(childVM, scriptFile, scriptScope)
+		g.injectUserFunctions(childVM, scriptFile, scriptScope, u, w, r)
+		g.injectJobFunctions(childVM, job)
+
+		childVM.Set("PARENT_DETACHED", true)
+		childVM.Set("PARENT_PAYLOAD", payload)
+
+		go func(vm *otto.Otto) {
+			moduleName := ""
+			if scriptScope != "" {
+				moduleName = getScriptRoot(targetScriptPath, scriptScope)
+			}
+
+			_, err := g.runWithLimit(vm, string(scriptContent), moduleName, g.GetModuleExecutionLimit(moduleName), targetScriptPath, u.Username)
 			if err != nil {
 				//Script execution failed
 				log.Println("Script Execution Failed: ", err.Error())
 				g.raiseError(err)
 			}
-		}()
+			g.finishJob(job, vm, err)
+		}(childVM)
 
-		return otto.TrueValue()
+		//Return the job ID for status checking
+		reply, _ := vm.ToValue(job.ID)
+		return reply
 	})
 
 }
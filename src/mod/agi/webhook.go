@@ -0,0 +1,482 @@
+package agi
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robertkrimen/otto"
+	uuid "github.com/satori/go.uuid"
+	user "imuslab.com/arozos/mod/user"
+)
+
+/*
+	AGI Webhooks
+
+	Allow users to publish an AGI script as a public URL so external services
+	(e.g. Git hosts, form providers or IoT sensors) can call into it.
+
+	Each webhook is protected by either a secret token (passed as the token
+	query parameter or the X-Webhook-Token header) or a HMAC-SHA256 signature
+	of the request body (passed as the X-Hub-Signature-256 or X-Signature header).
+	Calls can be further restricted with a rate limit and an IP allowlist.
+
+	The script is executed as the webhook owner with the request and response
+	objects injected, see request.go and response.go
+*/
+
+//Maximum size of the request body accepted by webhooks
+const maxWebhookBodySize = 10 << 20
+
+type Webhook struct {
+	ID          string
+	Name        string
+	Owner       string
+	ScriptFile  string   //Virtual path of the script file
+	AuthMode    string   //token or hmac
+	Secret      string   //Secret token or HMAC key
+	RateLimit   int      //Maximum number of calls per minute, 0 = unlimited
+	AllowedIPs  []string //IP or CIDR that can call this webhook, empty = allow all
+	Enabled     bool
+	CreatedTime int64
+	LastCalled  int64
+}
+
+type webhookRateCounter struct {
+	window int64 //The minute of the current counting window
+	count  int
+	mutex  sync.Mutex
+}
+
+//Get the webhook with the given ID
+func (g *Gateway) GetWebhook(webhookID string) (*Webhook, error) {
+	sysdb := g.Option.UserHandler.GetDatabase()
+	if webhookID == "" || !sysdb.KeyExists("agi-webhooks", webhookID) {
+		return nil, errors.New("Webhook not exists")
+	}
+
+	thisWebhook := Webhook{}
+	err := sysdb.Read("agi-webhooks", webhookID, &thisWebhook)
+	if err != nil {
+		return nil, err
+	}
+	return &thisWebhook, nil
+}
+
+//List the webhooks owned by the given user
+func (g *Gateway) ListWebhooks(owner string) []*Webhook {
+	results := []*Webhook{}
+	entries, err := g.Option.UserHandler.GetDatabase().ListTable("agi-webhooks")
+	if err != nil {
+		return results
+	}
+
+	for _, entry := range entries {
+		thisWebhook := Webhook{}
+		err = json.Unmarshal(entry[1], &thisWebhook)
+		if err != nil || thisWebhook.Owner != owner {
+			continue
+		}
+		results = append(results, &thisWebhook)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].CreatedTime < results[j].CreatedTime
+	})
+	return results
+}
+
+func (g *Gateway) saveWebhook(webhook *Webhook) error {
+	return g.Option.UserHandler.GetDatabase().Write("agi-webhooks", webhook.ID, webhook)
+}
+
+//Remove the webhook with the given ID
+func (g *Gateway) RemoveWebhook(webhookID string) error {
+	g.webhookRateCounters.Delete(webhookID)
+	return g.Option.UserHandler.GetDatabase().Delete("agi-webhooks", webhookID)
+}
+
+//Generate a random secret for webhooks
+func generateWebhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+//Check if the request has a valid token or signature for the webhook
+func (webhook *Webhook) verifyRequest(r *http.Request, body []byte) bool {
+	if webhook.AuthMode == "hmac" {
+		signature := r.Header.Get("X-Hub-Signature-256")
+		if signature == "" {
+			signature = r.Header.Get("X-Signature")
+		}
+		signature = strings.TrimPrefix(signature, "sha256=")
+		signatureBytes, err := hex.DecodeString(signature)
+		if err != nil || len(signatureBytes) == 0 {
+			return false
+		}
+
+		mac := hmac.New(sha256.New, []byte(webhook.Secret))
+		mac.Write(body)
+		return hmac.Equal(signatureBytes, mac.Sum(nil))
+	}
+
+	token := r.Header.Get("X-Webhook-Token")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(webhook.Secret)) == 1
+}
+
+//Check if the remote address is in the allowlist of the webhook
+func (webhook *Webhook) allowIP(remoteAddr string) bool {
+	if len(webhook.AllowedIPs) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, allowed := range webhook.AllowedIPs {
+		if strings.Contains(allowed, "/") {
+			_, ipnet, err := net.ParseCIDR(allowed)
+			if err == nil && ipnet.Contains(ip) {
+				return true
+			}
+		} else if allowedIP := net.ParseIP(allowed); allowedIP != nil && allowedIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//Count a call to the webhook. Return false if the rate limit is reached
+func (g *Gateway) chargeWebhookCall(webhook *Webhook) bool {
+	if webhook.RateLimit <= 0 {
+		return true
+	}
+
+	counterInterface, _ := g.webhookRateCounters.LoadOrStore(webhook.ID, &webhookRateCounter{})
+	counter := counterInterface.(*webhookRateCounter)
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	currentWindow := time.Now().Unix() / 60
+	if counter.window != currentWindow {
+		counter.window = currentWindow
+		counter.count = 0
+	}
+
+	if counter.count >= webhook.RateLimit {
+		return false
+	}
+	counter.count++
+	return true
+}
+
+//Parse the IP allowlist from comma seperated string
+func parseWebhookAllowedIPs(allowlist string) ([]string, error) {
+	results := []string{}
+	for _, allowed := range strings.Split(allowlist, ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "" {
+			continue
+		}
+
+		if strings.Contains(allowed, "/") {
+			if _, _, err := net.ParseCIDR(allowed); err != nil {
+				return results, errors.New("Invalid CIDR: " + allowed)
+			}
+		} else if net.ParseIP(allowed) == nil {
+			return results, errors.New("Invalid IP address: " + allowed)
+		}
+		results = append(results, allowed)
+	}
+	return results, nil
+}
+
+//Handle the public webhook calls. The webhook ID is the last segment of the URL
+func (g *Gateway) HandleWebhookCall(w http.ResponseWriter, r *http.Request) {
+	webhookID := filepath.Base(r.URL.Path)
+	webhook, err := g.GetWebhook(webhookID)
+	if err != nil || !webhook.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !webhook.allowIP(r.RemoteAddr) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return
+	}
+
+	//Read the body for signature verification and the script
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodySize))
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte("413 - Request Entity Too Large"))
+		return
+	}
+
+	if !webhook.verifyRequest(r, body) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("401 - Unauthorized"))
+		return
+	}
+
+	if !g.chargeWebhookCall(webhook) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte("429 - Too Many Requests"))
+		return
+	}
+
+	webhook.LastCalled = time.Now().Unix()
+	g.saveWebhook(webhook)
+
+	//Resolve the script as the webhook owner
+	owner, err := g.Option.UserHandler.GetUserInfoFromUsername(webhook.Owner)
+	if err != nil || !owner.CanRead(webhook.ScriptFile) {
+		log.Println("[AGI] Webhook " + webhook.ID + " owner or script no longer accessible")
+		http.NotFound(w, r)
+		return
+	}
+
+	scriptFile, err := owner.VirtualPathToRealPath(webhook.ScriptFile)
+	if err != nil || !fileExists(scriptFile) {
+		log.Println("[AGI] Webhook " + webhook.ID + " script not found: " + webhook.ScriptFile)
+		http.NotFound(w, r)
+		return
+	}
+
+	err = g.executeWebhookScript(w, r, body, scriptFile, owner)
+	if err != nil {
+		log.Println("[AGI] Webhook " + webhook.ID + " execution failed: " + err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 - Internal Server Error"))
+	}
+}
+
+//Execute the webhook script with the request exposed to the vm
+func (g *Gateway) executeWebhookScript(w http.ResponseWriter, r *http.Request, body []byte, scriptFile string, owner *user.User) error {
+	scriptContent, err := ioutil.ReadFile(scriptFile)
+	if err != nil {
+		return err
+	}
+
+	//Create a new vm for this request
+	vm := otto.New()
+	g.injectStandardLibs(vm, scriptFile, "")
+	g.injectUserFunctions(vm, scriptFile, "", owner, nil, nil)
+
+	//Expose the request to the script. The body is already read for signature verification
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	readRequestBody(r)
+	g.injectRequestObject(vm, r, body, owner)
+	resp := g.injectResponseObject(vm, w, r, owner)
+
+	_, err = g.runWithLimit(vm, string(scriptContent), g.getScriptModule(scriptFile), g.Option.DefaultLimit, scriptFile, owner.Username)
+	if err != nil {
+		if resp.committed {
+			//Part of the response is already sent
+			log.Println("[AGI] Webhook script " + scriptFile + " failed after response sent: " + err.Error())
+			return nil
+		}
+		return err
+	}
+
+	resp.finish()
+	return nil
+}
+
+/*
+	Handle the management of webhooks of the current user
+	GET: => list the webhooks of the current user
+	POST: opr=create&name={name}&script={vpath}&auth={token / hmac}&ratelimit={per minute}&allowip={ip or cidr, comma seperated}
+	POST: opr=update&id={id}&name&ratelimit&allowip&enabled={true / false}&regenerate={true / false}
+	POST: opr=remove&id={id}
+*/
+func (g *Gateway) HandleWebhooks(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := g.Option.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	opr, _ := mv(r, "opr", true)
+	if opr == "" {
+		js, _ := json.Marshal(g.ListWebhooks(userinfo.Username))
+		sendJSONResponse(w, string(js))
+		return
+	}
+
+	if opr == "create" {
+		name, err := mv(r, "name", true)
+		if err != nil {
+			sendErrorResponse(w, "Invalid webhook name")
+			return
+		}
+
+		scriptFile, err := mv(r, "script", true)
+		if err != nil {
+			sendErrorResponse(w, "Invalid script path")
+			return
+		}
+
+		//Check the script is an AGI script that this user can read
+		if !(filepath.Ext(scriptFile) == ".agi" || filepath.Ext(scriptFile) == ".js") {
+			sendErrorResponse(w, "AGI script must have file extension of .agi or .js")
+			return
+		}
+
+		if !userinfo.CanRead(scriptFile) {
+			sendErrorResponse(w, "Permission Denied")
+			return
+		}
+
+		rpath, err := userinfo.VirtualPathToRealPath(scriptFile)
+		if err != nil || !fileExists(rpath) {
+			sendErrorResponse(w, "Script not found")
+			return
+		}
+
+		authMode, _ := mv(r, "auth", true)
+		if authMode == "" {
+			authMode = "token"
+		}
+		if authMode != "token" && authMode != "hmac" {
+			sendErrorResponse(w, "Invalid authentication mode")
+			return
+		}
+
+		secret, err := generateWebhookSecret()
+		if err != nil {
+			sendErrorResponse(w, "Unable to generate webhook secret")
+			return
+		}
+
+		thisWebhook := Webhook{
+			ID:          uuid.NewV4().String(),
+			Name:        name,
+			Owner:       userinfo.Username,
+			ScriptFile:  scriptFile,
+			AuthMode:    authMode,
+			Secret:      secret,
+			RateLimit:   60,
+			AllowedIPs:  []string{},
+			Enabled:     true,
+			CreatedTime: time.Now().Unix(),
+		}
+
+		err = parseWebhookOptions(r, &thisWebhook)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+
+		err = g.saveWebhook(&thisWebhook)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+
+		js, _ := json.Marshal(thisWebhook)
+		sendJSONResponse(w, string(js))
+		return
+	}
+
+	//Other operations require an existing webhook owned by this user
+	webhookID, _ := mv(r, "id", true)
+	thisWebhook, err := g.GetWebhook(webhookID)
+	if err != nil || thisWebhook.Owner != userinfo.Username {
+		sendErrorResponse(w, "Webhook not exists")
+		return
+	}
+
+	if opr == "update" {
+		if name, err := mv(r, "name", true); err == nil {
+			thisWebhook.Name = name
+		}
+
+		if enabled, err := mv(r, "enabled", true); err == nil {
+			thisWebhook.Enabled = (enabled == "true")
+		}
+
+		err = parseWebhookOptions(r, thisWebhook)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+
+		regenerate, _ := mv(r, "regenerate", true)
+		if regenerate == "true" {
+			thisWebhook.Secret, err = generateWebhookSecret()
+			if err != nil {
+				sendErrorResponse(w, "Unable to generate webhook secret")
+				return
+			}
+		}
+
+		err = g.saveWebhook(thisWebhook)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+
+		js, _ := json.Marshal(thisWebhook)
+		sendJSONResponse(w, string(js))
+	} else if opr == "remove" {
+		err = g.RemoveWebhook(thisWebhook.ID)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+		sendOK(w)
+	} else {
+		sendErrorResponse(w, "Unknown operation")
+	}
+}
+
+//Parse the optional ratelimit and allowip paramters into the webhook
+func parseWebhookOptions(r *http.Request, webhook *Webhook) error {
+	if rateLimit, err := mv(r, "ratelimit", true); err == nil {
+		value, err := strconv.Atoi(rateLimit)
+		if err != nil || value < 0 {
+			return errors.New("Invalid rate limit")
+		}
+		webhook.RateLimit = value
+	}
+
+	if _, ok := r.PostForm["allowip"]; ok {
+		allowedIPs, err := parseWebhookAllowedIPs(r.PostForm.Get("allowip"))
+		if err != nil {
+			return err
+		}
+		webhook.AllowedIPs = allowedIPs
+	}
+	return nil
+}
@@ -33,10 +33,6 @@ func (a *AptPackageManager) InstallIfNotExists(pkgname string, mustComply bool)
 	pkgname = strings.ReplaceAll(pkgname, "&", "")
 	pkgname = strings.ReplaceAll(pkgname, "|", "")
 
-	if a.AllowAutoInstall == false {
-		return errors.New("Package auto install is disabled")
-	}
-
 	installed, err := PackageExists(pkgname)
 	if err != nil {
 		log.Println(err.Error())
@@ -45,6 +41,8 @@ func (a *AptPackageManager) InstallIfNotExists(pkgname string, mustComply bool)
 	//log.Println(packageInfo)
 	if installed {
 		return nil
+	} else if a.AllowAutoInstall == false {
+		return errors.New("Package auto install is disabled")
 	} else {
 		//Package not installed. Install if now if running in sudo mode
 		log.Println("Installing package " + pkgname + "...")
@@ -35,6 +35,7 @@ import (
 
 	"imuslab.com/arozos/mod/auth/authlogger"
 	db "imuslab.com/arozos/mod/database"
+	"imuslab.com/arozos/mod/event"
 )
 
 type AuthAgent struct {
@@ -56,6 +57,9 @@ type AuthAgent struct {
 
 	//Logger
 	Logger *authlogger.Logger
+
+	//Event bus for publishing login and logout events
+	EventBus *event.EventBus
 }
 
 type AuthEndpoints struct {
@@ -232,6 +236,10 @@ func (a *AuthAgent) LoginUserByRequest(w http.ResponseWriter, r *http.Request, u
 		}
 	}
 	session.Save(r, w)
+
+	a.EventBus.Publish(event.UserLogin, username, map[string]interface{}{
+		"ip": r.RemoteAddr,
+	})
 }
 
 //Handle logout, reply OK after logged out. WILL NOT DO REDIRECTION
@@ -247,6 +255,12 @@ func (a *AuthAgent) HandleLogout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if username != "" {
+		a.EventBus.Publish(event.UserLogout, username, map[string]interface{}{
+			"ip": r.RemoteAddr,
+		})
+	}
+
 	w.Write([]byte("OK"))
 }
 
@@ -1,6 +1,20 @@
 package aclient
 
-import "imuslab.com/arozos/mod/network/mdns"
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"imuslab.com/arozos/mod/cluster"
+	"imuslab.com/arozos/mod/network/mdns"
+	user "imuslab.com/arozos/mod/user"
+)
 
 /*
 	ArOZ Cluster Client Module
@@ -9,22 +23,147 @@ import "imuslab.com/arozos/mod/network/mdns"
 	This module is designed to connect this host to a remote host and act as a client
 	for sending commands
 
+	All connections to the paired nodes are mutual TLS with the pinned
+	certificate of the remote node.
 */
 
 type Aclient struct {
 	Options AclientOption
+	clients map[string]*peerClient //Node UUID => HTTP client for the node
+	mutex   sync.Mutex
 }
 
 type AclientOption struct {
-	MDNS *mdns.MDNSHost
+	MDNS         *mdns.MDNSHost
+	Node         *cluster.Node
+	Peers        *cluster.PeerStore
+	PairingCodes *cluster.PairingCodeManager
+	UserHandler  *user.UserHandler
+}
+
+type peerClient struct {
+	fingerprint string
+	client      *http.Client
 }
 
 func NewClient(option AclientOption) *Aclient {
 	return &Aclient{
 		Options: option,
+		clients: map[string]*peerClient{},
+	}
+}
+
+//Scan for other ArozOS hosts with the given domain. Leave empty to scan for hosts with the same domain as this host
+func (a *Aclient) DiscoverServices(serviceType string) []*mdns.NetworkHost {
+	results := []*mdns.NetworkHost{}
+	if a.Options.MDNS == nil {
+		return results
+	}
+	if serviceType == "" {
+		serviceType = a.Options.MDNS.Host.Domain
+	}
+
+	for _, host := range a.Options.MDNS.Scan(3, serviceType) {
+		if host.UUID == a.Options.MDNS.Host.UUID {
+			//Loopback of this host
+			continue
+		}
+		results = append(results, host)
+	}
+	return results
+}
+
+//Get the HTTP client for connecting to the paired node
+func (a *Aclient) getClient(peer *cluster.Peer) *http.Client {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if pc, ok := a.clients[peer.UUID]; ok && pc.fingerprint == peer.Fingerprint {
+		return pc.client
+	}
+
+	client := a.newTLSClient(peer.Fingerprint)
+	a.clients[peer.UUID] = &peerClient{
+		fingerprint: peer.Fingerprint,
+		client:      client,
+	}
+	return client
+}
+
+func (a *Aclient) newTLSClient(fingerprint string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout:   5 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSClientConfig:       a.Options.Node.ClientTLSConfig(fingerprint),
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConnsPerHost:   4,
+		},
 	}
 }
 
-func (a *Aclient) DiscoverServices(serviceType string) {
+//Send a request to the paired node. Non 2xx responses are returned as error
+func (a *Aclient) doRequest(nodeUUID string, method string, path string, query url.Values, body io.Reader, header http.Header) (*http.Response, error) {
+	peer, err := a.Options.Peers.Get(nodeUUID)
+	if err != nil {
+		return nil, err
+	}
 
+	requestURL := "https://" + peer.Address + path
+	if len(query) > 0 {
+		requestURL += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, requestURL, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+
+	resp, err := a.getClient(peer).Do(req)
+	if err != nil {
+		return nil, errors.New("Unable to connect to " + peer.Name + ": " + err.Error())
+	}
+	a.Options.Peers.Touch(peer.UUID)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		return nil, readError(resp)
+	}
+	return resp, nil
+}
+
+//Send a request to the paired node and decode the JSON response into result
+func (a *Aclient) callAPI(nodeUUID string, method string, path string, query url.Values, body io.Reader, result interface{}) error {
+	resp, err := a.doRequest(nodeUUID, method, path, query, body, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if result == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func readError(resp *http.Response) error {
+	errResp := struct {
+		Error string `json:"error"`
+	}{}
+	content, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if json.Unmarshal(content, &errResp) == nil && errResp.Error != "" {
+		return errors.New(errResp.Error)
+	}
+	return errors.New("Remote node returned " + resp.Status)
 }
@@ -0,0 +1,409 @@
+package aclient
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	auth "imuslab.com/arozos/mod/auth"
+	"imuslab.com/arozos/mod/cluster"
+	"imuslab.com/arozos/mod/cluster/aserver"
+	db "imuslab.com/arozos/mod/database"
+	fs "imuslab.com/arozos/mod/filesystem"
+	permission "imuslab.com/arozos/mod/permission"
+	storage "imuslab.com/arozos/mod/storage"
+	user "imuslab.com/arozos/mod/user"
+)
+
+/*
+	Cluster tests with two nodes on localhost
+
+	Each node has its own certificate, database and storage, with the cluster
+	server listening on a random local port.
+*/
+
+type testNode struct {
+	Node         *cluster.Node
+	Peers        *cluster.PeerStore
+	PairingCodes *cluster.PairingCodeManager
+	UserHandler  *user.UserHandler
+	Client       *Aclient
+	Address      string
+
+	server   *httptest.Server
+	database *db.Database
+	fsh      *fs.FileSystemHandler
+	users    []string
+}
+
+func newTestNode(t *testing.T, name string, usernames ...string) *testNode {
+	dir := t.TempDir()
+	sysdb, err := db.NewDatabase(filepath.Join(dir, "system.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &testNode{database: sysdb}
+	t.Cleanup(n.close)
+
+	n.Node, err = cluster.NewNode(cluster.NodeOption{
+		UUID:     name,
+		Name:     name,
+		CertPath: filepath.Join(dir, "node.crt"),
+		KeyPath:  filepath.Join(dir, "node.key"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Peers, err = cluster.NewPeerStore(sysdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.PairingCodes = &cluster.PairingCodeManager{}
+
+	//Users with a single user storage
+	sysdb.NewTable("auth")
+	authAgent := &auth.AuthAgent{SessionName: "clustertest", Database: sysdb}
+	permissionHandler, err := permission.NewPermissionHandler(sysdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	permissionHandler.LoadPermissionGroupsFromDatabase()
+	os.MkdirAll(filepath.Join(dir, "storage"), 0755)
+	n.fsh, err = fs.NewFileSystemHandler(fs.FileSystemOption{
+		Name:      "user",
+		Uuid:      "user",
+		Path:      filepath.ToSlash(filepath.Join(dir, "storage")) + "/",
+		Hierarchy: "user",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storagePool, err := storage.NewStoragePool([]*fs.FileSystemHandler{n.fsh}, "system")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.UserHandler, err = user.NewUserHandler(sysdb, authAgent, permissionHandler, storagePool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range usernames {
+		err = authAgent.CreateUserAccount(username, username, []string{"administrator"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.users = append(n.users, username)
+	}
+
+	//Start the cluster server on a random port
+	server := aserver.NewServer(aserver.AserverOption{
+		Node:         n.Node,
+		Peers:        n.Peers,
+		PairingCodes: n.PairingCodes,
+		UserHandler:  n.UserHandler,
+	})
+	n.server = httptest.NewUnstartedServer(server)
+	n.server.TLS = n.Node.ServerTLSConfig()
+	n.server.StartTLS()
+	n.Address = n.server.Listener.Addr().String()
+	_, port, _ := net.SplitHostPort(n.Address)
+	n.Node.Port, _ = strconv.Atoi(port)
+
+	n.Client = NewClient(AclientOption{
+		Node:         n.Node,
+		Peers:        n.Peers,
+		PairingCodes: n.PairingCodes,
+		UserHandler:  n.UserHandler,
+	})
+	return n
+}
+
+func (n *testNode) close() {
+	if n.server != nil {
+		n.server.Close()
+	}
+	for _, username := range n.users {
+		n.UserHandler.ClearQuotaCache(username)
+	}
+	if n.fsh != nil {
+		n.fsh.Close()
+	}
+	n.database.Close()
+}
+
+//Get the real path of the file in the user home on this node
+func (n *testNode) homeFile(t *testing.T, username string, filename string) string {
+	userinfo, err := n.UserHandler.GetUserInfoFromUsername(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	home, err := userinfo.GetHomeDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(home, filename)
+}
+
+//Pair node a with node b using a pairing code generated on b
+func pairNodes(t *testing.T, a *testNode, b *testNode) {
+	code, err := b.PairingCodes.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.Client.Pair(b.Address, code.Code, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPairWithPairingCode(t *testing.T) {
+	a := newTestNode(t, "alpha")
+	b := newTestNode(t, "beta")
+
+	code, err := b.PairingCodes.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Codes are entered by human and accepted in lower case with separators
+	peer, err := a.Client.Pair(b.Address, strings.ToLower(code.Code[:4]+"-"+code.Code[4:]), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Both nodes pinned the certificate presented by the other
+	if peer.UUID != "beta" || peer.Fingerprint != b.Node.Fingerprint {
+		t.Errorf("Node A paired with %s (%s), want beta (%s)", peer.UUID, peer.Fingerprint, b.Node.Fingerprint)
+	}
+	remotePeer, err := b.Peers.Get("alpha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remotePeer.Fingerprint != a.Node.Fingerprint {
+		t.Errorf("Node B pinned fingerprint %s, want %s", remotePeer.Fingerprint, a.Node.Fingerprint)
+	}
+	if remotePeer.Address != a.Address {
+		t.Errorf("Node B recorded address %s, want %s", remotePeer.Address, a.Address)
+	}
+	if b.PairingCodes.Current() != nil {
+		t.Error("Pairing code not consumed")
+	}
+
+	//Both directions of the paired connection work
+	if _, err := a.Client.Status("beta", ""); err != nil {
+		t.Errorf("Node A unable to reach node B: %v", err)
+	}
+	if _, err := b.Client.Status("alpha", ""); err != nil {
+		t.Errorf("Node B unable to reach node A: %v", err)
+	}
+}
+
+func TestPairWithWrongPairingCode(t *testing.T) {
+	a := newTestNode(t, "alpha")
+	b := newTestNode(t, "beta")
+
+	code, err := b.PairingCodes.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.Client.Pair(b.Address, "AAAAAAAAAAAAAAAA", "")
+	if err == nil {
+		t.Fatal("Paired with wrong pairing code")
+	}
+	if len(a.Peers.List()) != 0 || len(b.Peers.List()) != 0 {
+		t.Error("Node saved after failed pairing")
+	}
+
+	//The valid code is still usable after a failed attempt
+	_, err = a.Client.Pair(b.Address, code.Code, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPairWithTrustedFingerprint(t *testing.T) {
+	a := newTestNode(t, "alpha")
+	b := newTestNode(t, "beta")
+
+	//Certificate not trusted by node B
+	_, err := a.Client.Pair(b.Address, "", b.Node.Fingerprint)
+	if err == nil {
+		t.Fatal("Paired without trusted certificate")
+	}
+
+	//Node A expect another certificate from node B
+	b.Peers.TrustFingerprint(a.Node.Fingerprint, time.Minute)
+	_, err = a.Client.Pair(b.Address, "", a.Node.Fingerprint)
+	if err == nil {
+		t.Fatal("Paired with unexpected server certificate")
+	}
+	if len(b.Peers.List()) != 0 {
+		t.Error("Node B saved the pairing when node A rejected its certificate")
+	}
+
+	b.Peers.TrustFingerprint(a.Node.Fingerprint, time.Minute)
+	peer, err := a.Client.Pair(b.Address, "", strings.ToUpper(b.Node.Fingerprint))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.Fingerprint != b.Node.Fingerprint {
+		t.Errorf("Pinned fingerprint %s, want %s", peer.Fingerprint, b.Node.Fingerprint)
+	}
+	if _, err := b.Peers.GetByFingerprint(a.Node.Fingerprint); err != nil {
+		t.Error("Node A not paired on node B")
+	}
+}
+
+func TestUnpairedNodeRejected(t *testing.T) {
+	a := newTestNode(t, "alpha")
+	b := newTestNode(t, "beta")
+	c := newTestNode(t, "gamma")
+	pairNodes(t, a, b)
+
+	//Node C knows the address and certificate of node B but it is not paired on node B
+	c.Peers.Add(&cluster.Peer{UUID: "beta", Name: "beta", Address: b.Address, Fingerprint: b.Node.Fingerprint})
+	if _, err := c.Client.Status("beta", ""); err == nil || !strings.Contains(err.Error(), "not paired") {
+		t.Errorf("Unpaired node got %v, want node not paired", err)
+	}
+
+	//Node A refuse to talk to a node presenting another certificate
+	peer, _ := a.Peers.Get("beta")
+	peer.Address = c.Address
+	a.Peers.Update(peer)
+	if _, err := a.Client.Status("beta", ""); err == nil {
+		t.Error("Connected to a node with unpinned certificate")
+	}
+
+	//Unpaired on both side
+	peer.Address = b.Address
+	a.Peers.Update(peer)
+	if err := a.Client.Unpair("beta"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Peers.Get("alpha"); err == nil {
+		t.Error("Node B not notified for unpairing")
+	}
+}
+
+func TestUserMapping(t *testing.T) {
+	a := newTestNode(t, "alpha", "alice")
+	b := newTestNode(t, "beta", "bob", "carol")
+	pairNodes(t, a, b)
+
+	//No user is mapped by default
+	err := a.Client.WriteFile("alice", "node-beta:/user/hello.txt", strings.NewReader("hello"))
+	if err == nil || !strings.Contains(err.Error(), "not mapped") {
+		t.Fatalf("Unmapped user got %v, want not mapped", err)
+	}
+
+	peer, _ := b.Peers.Get("alpha")
+	peer.UserMap["alice"] = "bob"
+	b.Peers.Update(peer)
+
+	err = a.Client.WriteFile("alice", "node-beta:/user/hello.txt", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(b.homeFile(t, "bob", "hello.txt"))
+	if err != nil || string(content) != "hello" {
+		t.Errorf("File not written into the home of the mapped user: %s, %v", content, err)
+	}
+	if _, err := os.Stat(b.homeFile(t, "carol", "hello.txt")); err == nil {
+		t.Error("File written into the home of another user")
+	}
+
+	files, err := a.Client.ListDir("alice", "node-beta:/user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Vpath != "node-beta:/user/hello.txt" || files[0].Size != 5 {
+		t.Errorf("Unexpected listing %+v", files)
+	}
+
+	//Mapping to an user that does not exist is rejected
+	peer.UserMap["alice"] = "dave"
+	b.Peers.Update(peer)
+	if _, err := a.Client.ListDir("alice", "node-beta:/user"); err == nil {
+		t.Error("Mapped to an user that does not exist")
+	}
+
+	//Same name mapping
+	peer.UserMap = map[string]string{}
+	peer.MapSameName = true
+	b.Peers.Update(peer)
+	if _, err := a.Client.ListDir("carol", "node-beta:/user"); err != nil {
+		t.Errorf("Same name mapping failed: %v", err)
+	}
+	if _, err := a.Client.ListDir("alice", "node-beta:/user"); err == nil {
+		t.Error("User without local account mapped by same name")
+	}
+}
+
+func TestWriteExceedQuota(t *testing.T) {
+	a := newTestNode(t, "alpha", "dave")
+	b := newTestNode(t, "beta", "erin")
+	pairNodes(t, a, b)
+	peer, _ := b.Peers.Get("alpha")
+	peer.UserMap["dave"] = "erin"
+	b.Peers.Update(peer)
+
+	erin, err := b.UserHandler.GetUserInfoFromUsername("erin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	erin.StorageQuota.SetUserStorageQuota(1024)
+
+	//The write is stopped at the quota instead of after the whole body is written
+	err = a.Client.WriteFile("dave", "node-beta:/user/large.bin", strings.NewReader(strings.Repeat("a", 4096)))
+	if err == nil || !strings.Contains(err.Error(), "quota") {
+		t.Errorf("Write larger than quota got %v, want storage quota full", err)
+	}
+	files, _ := ioutil.ReadDir(filepath.Dir(b.homeFile(t, "erin", "large.bin")))
+	if len(files) != 0 {
+		t.Errorf("Files left after rejected write: %d", len(files))
+	}
+
+	err = a.Client.WriteFile("dave", "node-beta:/user/small.txt", strings.NewReader("small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransferSkipHiddenFiles(t *testing.T) {
+	a := newTestNode(t, "alpha", "frank")
+	b := newTestNode(t, "beta", "grace")
+	pairNodes(t, a, b)
+	peer, _ := b.Peers.Get("alpha")
+	peer.UserMap["frank"] = "grace"
+	b.Peers.Update(peer)
+
+	for filename, content := range map[string]string{"folder/file.txt": "hello", "folder/.trash/deleted.txt": "deleted"} {
+		target := a.homeFile(t, "frank", filename)
+		os.MkdirAll(filepath.Dir(target), 0755)
+		if err := ioutil.WriteFile(target, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	frank, err := a.UserHandler.GetUserInfoFromUsername("frank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := a.Client.Transfer(frank, "user:/folder", "node-beta:/user", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("Transferred %d files, want 1", count)
+	}
+	if content, err := ioutil.ReadFile(b.homeFile(t, "grace", "folder/file.txt")); err != nil || string(content) != "hello" {
+		t.Errorf("File not transferred: %s, %v", content, err)
+	}
+	if _, err := os.Stat(b.homeFile(t, "grace", "folder/.trash")); err == nil {
+		t.Error("Hidden folder transferred to the remote node")
+	}
+}
@@ -0,0 +1,266 @@
+package aclient
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"imuslab.com/arozos/mod/cluster"
+	"imuslab.com/arozos/mod/network/mdns"
+)
+
+/*
+	Cluster Handlers
+
+	Admin endpoints for pairing and managing the paired nodes, and user
+	endpoints for accessing the remote storage
+*/
+
+const statusTimeout = 3 * time.Second
+
+//Cluster status view with this node information and the status of the paired nodes
+func (a *Aclient) HandleClusterStatus(w http.ResponseWriter, r *http.Request) {
+	type thisNode struct {
+		UUID        string
+		Name        string
+		Port        int
+		Fingerprint string
+		Version     string
+		StartTime   int64
+	}
+
+	node := a.Options.Node
+	js, _ := json.Marshal(struct {
+		ThisNode    thisNode
+		PairingCode *cluster.PairingCode
+		Peers       []*PeerStatus
+	}{
+		ThisNode: thisNode{
+			UUID:        node.UUID,
+			Name:        node.Name,
+			Port:        node.Port,
+			Fingerprint: node.Fingerprint,
+			Version:     node.Version,
+			StartTime:   node.StartTime,
+		},
+		PairingCode: a.Options.PairingCodes.Current(),
+		Peers:       a.StatusAll("", statusTimeout),
+	})
+	sendJSONResponse(w, string(js))
+}
+
+//Pair with a remote node, require address and either code or fingerprint
+func (a *Aclient) HandlePair(w http.ResponseWriter, r *http.Request) {
+	address, err := mv(r, "address", true)
+	if err != nil {
+		sendErrorResponse(w, "Invalid address given")
+		return
+	}
+	code, _ := mv(r, "code", true)
+	fingerprint, _ := mv(r, "fingerprint", true)
+
+	peer, err := a.Pair(strings.TrimSpace(address), code, fingerprint)
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+	js, _ := json.Marshal(peer)
+	sendJSONResponse(w, string(js))
+}
+
+func (a *Aclient) HandleUnpair(w http.ResponseWriter, r *http.Request) {
+	nodeUUID, err := mv(r, "uuid", true)
+	if err != nil {
+		sendErrorResponse(w, "Invalid node uuid given")
+		return
+	}
+	err = a.Unpair(nodeUUID)
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+	sendOK(w)
+}
+
+//Generate or revoke the pairing code of this node. Use opr=new or opr=revoke, or leave empty to get the active code
+func (a *Aclient) HandlePairingCode(w http.ResponseWriter, r *http.Request) {
+	opr, _ := mv(r, "opr", true)
+	switch opr {
+	case "new":
+		code, err := a.Options.PairingCodes.Generate()
+		if err != nil {
+			sendErrorResponse(w, "Unable to generate pairing code")
+			return
+		}
+		js, _ := json.Marshal(code)
+		sendJSONResponse(w, string(js))
+	case "revoke":
+		a.Options.PairingCodes.Revoke()
+		sendOK(w)
+	case "":
+		js, _ := json.Marshal(a.Options.PairingCodes.Current())
+		sendJSONResponse(w, string(js))
+	default:
+		sendErrorResponse(w, "Unknown operation")
+	}
+}
+
+//Trust the certificate fingerprint of a remote node so it can pair with this node without pairing code
+func (a *Aclient) HandleTrustCertificate(w http.ResponseWriter, r *http.Request) {
+	fingerprint, err := mv(r, "fingerprint", true)
+	if err != nil {
+		sendErrorResponse(w, "Invalid fingerprint given")
+		return
+	}
+	fingerprint = cluster.NormalizeFingerprint(fingerprint)
+	if decoded, err := hex.DecodeString(fingerprint); err != nil || len(decoded) != 32 {
+		sendErrorResponse(w, "Invalid fingerprint given")
+		return
+	}
+	if fingerprint == a.Options.Node.Fingerprint {
+		sendErrorResponse(w, "This is the fingerprint of this node")
+		return
+	}
+
+	a.Options.Peers.TrustFingerprint(fingerprint, cluster.PairingCodeLifetime)
+	sendOK(w)
+}
+
+//Get or set the user mapping of the paired node
+func (a *Aclient) HandleUserMapping(w http.ResponseWriter, r *http.Request) {
+	nodeUUID, err := mv(r, "uuid", true)
+	if err != nil {
+		sendErrorResponse(w, "Invalid node uuid given")
+		return
+	}
+	peer, err := a.Options.Peers.Get(nodeUUID)
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+
+	localUsers := a.Options.UserHandler.GetAuthAgent().ListUsers()
+	if r.Method == http.MethodGet {
+		js, _ := json.Marshal(struct {
+			UUID        string
+			Name        string
+			UserMap     map[string]string
+			MapSameName bool
+			LocalUsers  []string
+		}{peer.UUID, peer.Name, peer.UserMap, peer.MapSameName, localUsers})
+		sendJSONResponse(w, string(js))
+		return
+	}
+
+	usermap, _ := mv(r, "usermap", true)
+	sameName, _ := mv(r, "samename", true)
+	newMap := map[string]string{}
+	if usermap != "" {
+		err = json.Unmarshal([]byte(usermap), &newMap)
+		if err != nil {
+			sendErrorResponse(w, "Invalid user mapping given")
+			return
+		}
+	}
+	for remoteUser, localUser := range newMap {
+		if strings.TrimSpace(remoteUser) == "" || !inArray(localUsers, localUser) {
+			sendErrorResponse(w, "User "+localUser+" not exists on this node")
+			return
+		}
+	}
+
+	updatedPeer := *peer
+	updatedPeer.UserMap = newMap
+	updatedPeer.MapSameName = sameName == "true"
+	err = a.Options.Peers.Update(&updatedPeer)
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+	sendOK(w)
+}
+
+//Scan for nearby ArozOS hosts that can be paired
+func (a *Aclient) HandleDiscover(w http.ResponseWriter, r *http.Request) {
+	type discoveredHost struct {
+		Host   *mdns.NetworkHost
+		Paired bool
+	}
+	results := []discoveredHost{}
+	for _, host := range a.DiscoverServices("") {
+		_, err := a.Options.Peers.Get(host.UUID)
+		results = append(results, discoveredHost{
+			Host:   host,
+			Paired: err == nil,
+		})
+	}
+	js, _ := json.Marshal(results)
+	sendJSONResponse(w, string(js))
+}
+
+//List the paired nodes as remote virtual roots for the current user
+func (a *Aclient) HandleListNodes(w http.ResponseWriter, r *http.Request) {
+	js, _ := json.Marshal(a.ListRemoteRoots())
+	sendJSONResponse(w, string(js))
+}
+
+type RemoteRoot struct {
+	UUID     string
+	RootName string
+	RootPath string
+}
+
+//List the remote virtual roots. The node is not contacted, so the user might not be mapped on the node
+func (a *Aclient) ListRemoteRoots() []RemoteRoot {
+	results := []RemoteRoot{}
+	for _, peer := range a.Options.Peers.List() {
+		results = append(results, RemoteRoot{
+			UUID:     peer.UUID,
+			RootName: peer.Name,
+			RootPath: cluster.RemoteRootPrefix + peer.UUID + ":/",
+		})
+	}
+	return results
+}
+
+//Copy or move files between this node and the paired nodes. Require src (JSON array), dest and opr (copy or move)
+func (a *Aclient) HandleTransfer(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := a.Options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	opr, _ := mv(r, "opr", true)
+	if opr != "copy" && opr != "move" {
+		sendErrorResponse(w, "Invalid operation given")
+		return
+	}
+	src, _ := mv(r, "src", true)
+	dest, err := mv(r, "dest", true)
+	if err != nil {
+		sendErrorResponse(w, "Invalid destination given")
+		return
+	}
+	sourceFiles := []string{}
+	err = json.Unmarshal([]byte(src), &sourceFiles)
+	if err != nil || len(sourceFiles) == 0 {
+		sendErrorResponse(w, "Invalid source files given")
+		return
+	}
+
+	counter := 0
+	for _, sourceFile := range sourceFiles {
+		transferred, err := a.Transfer(userinfo, sourceFile, dest, opr == "move")
+		counter += transferred
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+	}
+
+	js, _ := json.Marshal(counter)
+	sendJSONResponse(w, string(js))
+}
@@ -0,0 +1,161 @@
+package aclient
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"imuslab.com/arozos/mod/cluster"
+)
+
+/*
+	Cluster Pairing (Client side)
+
+	See the cluster package for the pairing procedure.
+*/
+
+//Pair with the node at the given address with a pairing code or the expected certificate fingerprint
+func (a *Aclient) Pair(address string, code string, fingerprint string) (*cluster.Peer, error) {
+	code = cluster.NormalizePairingCode(code)
+	fingerprint = cluster.NormalizeFingerprint(fingerprint)
+	if code == "" && fingerprint == "" {
+		return nil, errors.New("Pairing code or certificate fingerprint is required")
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, errors.New("Invalid address. Use the format host:port")
+	}
+
+	//Resolve the cluster port from the web interface. Fallback to use the address as the cluster server address
+	clusterAddress := address
+	info, err := fetchNodeInfo(address)
+	if err == nil {
+		if info.UUID == a.Options.Node.UUID {
+			return nil, errors.New("Node cannot pair with itself")
+		}
+		host, _, _ := net.SplitHostPort(address)
+		clusterAddress = net.JoinHostPort(host, strconv.Itoa(info.Port))
+	}
+
+	nonce := make([]byte, 16)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	req := cluster.PairRequest{
+		UUID:      a.Options.Node.UUID,
+		Name:      a.Options.Node.Name,
+		Port:      a.Options.Node.Port,
+		Nonce:     hex.EncodeToString(nonce),
+		Timestamp: time.Now().Unix(),
+	}
+	if code != "" {
+		req.Signature = cluster.SignPairRequest(code, &req, a.Options.Node.Fingerprint)
+	}
+	js, _ := json.Marshal(req)
+
+	//The certificate of the remote node is pinned by fingerprint, or verified with the response signature
+	client := a.newTLSClient(fingerprint)
+	client.Timeout = 30 * time.Second
+	resp, err := client.Post("https://"+clusterAddress+cluster.APIPair, "application/json", bytes.NewReader(js))
+	if err != nil {
+		return nil, errors.New("Unable to connect to the remote node: " + err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, readError(resp)
+	}
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+		return nil, errors.New("Remote node did not present a certificate")
+	}
+	serverFingerprint := cluster.Fingerprint(resp.TLS.PeerCertificates[0].Raw)
+
+	pairResp := cluster.PairResponse{}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&pairResp)
+	if err != nil || pairResp.UUID == "" {
+		return nil, errors.New("Invalid response from the remote node")
+	}
+
+	if code != "" {
+		expected := cluster.SignPairResponse(code, &pairResp, serverFingerprint, req.Nonce)
+		if pairResp.Signature != expected {
+			return nil, errors.New("Remote node failed to prove the pairing code. Pairing aborted")
+		}
+	} else if serverFingerprint != fingerprint {
+		return nil, errors.New("Remote node certificate does not match the given fingerprint")
+	}
+
+	name := pairResp.Name
+	if name == "" {
+		name = pairResp.UUID
+	}
+	peer := &cluster.Peer{
+		UUID:        pairResp.UUID,
+		Name:        name,
+		Address:     clusterAddress,
+		Fingerprint: serverFingerprint,
+		PairedTime:  time.Now().Unix(),
+		LastSeen:    time.Now().Unix(),
+	}
+	err = a.Options.Peers.Add(peer)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("[Cluster] Paired with node " + name + " (" + pairResp.UUID + ")")
+	return peer, nil
+}
+
+//Remove the paired node and notify the remote node if it is online
+func (a *Aclient) Unpair(nodeUUID string) error {
+	_, err := a.Options.Peers.Get(nodeUUID)
+	if err != nil {
+		return err
+	}
+
+	err = a.callAPI(nodeUUID, http.MethodPost, cluster.APIUnpair, nil, nil, nil)
+	if err != nil {
+		log.Println("[Cluster] Unable to notify node " + nodeUUID + " for unpairing: " + err.Error())
+	}
+
+	a.mutex.Lock()
+	delete(a.clients, nodeUUID)
+	a.mutex.Unlock()
+	return a.Options.Peers.Remove(nodeUUID)
+}
+
+//Get the public node information from the web interface of the remote node
+func fetchNodeInfo(address string) (*cluster.NodeInfo, error) {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			//Only the cluster port is read from here. The node identity is verified in the pairing
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	var lastErr error
+	for _, scheme := range []string{"http", "https"} {
+		resp, err := client.Get(scheme + "://" + address + "/system/cluster/info")
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		info := cluster.NodeInfo{}
+		err = json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&info)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK || info.Port <= 0 {
+			lastErr = errors.New("Cluster not enabled on the remote host")
+			continue
+		}
+		return &info, nil
+	}
+	return nil, lastErr
+}
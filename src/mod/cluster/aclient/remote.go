@@ -0,0 +1,198 @@
+package aclient
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"imuslab.com/arozos/mod/cluster"
+)
+
+/*
+	Remote Storage Access
+
+	Access the storage of the paired nodes as the given local user. The
+	remote node decide which of its users the local user is mapped to.
+*/
+
+//Status of a paired node for the cluster status view
+type PeerStatus struct {
+	Peer   *cluster.Peer
+	Online bool
+	Status *cluster.NodeStatus
+	Error  string
+}
+
+//Get the status of the paired node. If username is given, the virtual roots accessible by the user are included
+func (a *Aclient) Status(nodeUUID string, username string) (*cluster.NodeStatus, error) {
+	query := url.Values{}
+	if username != "" {
+		query.Set("user", username)
+	}
+	status := cluster.NodeStatus{}
+	err := a.callAPI(nodeUUID, http.MethodGet, cluster.APIStatus, query, nil, &status)
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+//Get the status of all paired nodes concurrently
+func (a *Aclient) StatusAll(username string, timeout time.Duration) []*PeerStatus {
+	peers := a.Options.Peers.List()
+	results := make([]*PeerStatus, len(peers))
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		wg.Add(1)
+		go func(i int, peer *cluster.Peer) {
+			defer wg.Done()
+			result := PeerStatus{Peer: peer}
+			done := make(chan bool, 1)
+			go func() {
+				status, err := a.Status(peer.UUID, username)
+				if err != nil {
+					result.Error = err.Error()
+				} else {
+					result.Online = true
+					result.Status = status
+				}
+				done <- true
+			}()
+
+			select {
+			case <-done:
+				results[i] = &result
+			case <-time.After(timeout):
+				results[i] = &PeerStatus{Peer: peer, Error: "Connection timeout"}
+			}
+		}(i, peer)
+	}
+	wg.Wait()
+	return results
+}
+
+//List the directory on the remote path, e.g. node-{uuid}:/user/Desktop. The node root list the virtual roots
+func (a *Aclient) ListDir(username string, vpath string) ([]cluster.FileInfo, error) {
+	nodeUUID, remoteVpath, err := cluster.ParseRemotePath(vpath)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []cluster.FileInfo{}
+	if remoteVpath == "" {
+		status, err := a.Status(nodeUUID, username)
+		if err != nil {
+			return nil, err
+		}
+		for _, vroot := range status.Vroots {
+			results = append(results, cluster.FileInfo{
+				Name:  vroot.Name,
+				Vpath: cluster.ToRemotePath(nodeUUID, vroot.ID+":/"),
+				IsDir: true,
+			})
+		}
+		return results, nil
+	}
+
+	err = a.callAPI(nodeUUID, http.MethodGet, cluster.APIFiles+"list", fileQuery(username, remoteVpath), nil, &results)
+	if err != nil {
+		return nil, err
+	}
+	for i := range results {
+		results[i].Vpath = cluster.ToRemotePath(nodeUUID, results[i].Vpath)
+	}
+	return results, nil
+}
+
+//Get the file information of the remote path
+func (a *Aclient) Stat(username string, vpath string) (*cluster.FileInfo, error) {
+	nodeUUID, remoteVpath, err := cluster.ParseRemotePath(vpath)
+	if err != nil {
+		return nil, err
+	}
+	if remoteVpath == "" {
+		return &cluster.FileInfo{Name: nodeUUID, Vpath: vpath, IsDir: true}, nil
+	}
+
+	result := cluster.FileInfo{}
+	err = a.callAPI(nodeUUID, http.MethodGet, cluster.APIFiles+"stat", fileQuery(username, remoteVpath), nil, &result)
+	if err != nil {
+		return nil, err
+	}
+	result.Vpath = cluster.ToRemotePath(nodeUUID, result.Vpath)
+	return &result, nil
+}
+
+//Open the remote file. The given header (e.g. Range) is passed to the remote node. Caller must close the response body
+func (a *Aclient) Open(username string, vpath string, header http.Header) (*http.Response, error) {
+	nodeUUID, remoteVpath, err := cluster.ParseRemotePath(vpath)
+	if err != nil {
+		return nil, err
+	}
+	return a.doRequest(nodeUUID, http.MethodGet, cluster.APIFiles+"read", fileQuery(username, remoteVpath), nil, header)
+}
+
+//Write the content into the remote file. Existing file will be overwritten
+func (a *Aclient) WriteFile(username string, vpath string, content io.Reader) error {
+	nodeUUID, remoteVpath, err := cluster.ParseRemotePath(vpath)
+	if err != nil {
+		return err
+	}
+	return a.callAPI(nodeUUID, http.MethodPost, cluster.APIFiles+"write", fileQuery(username, remoteVpath), content, nil)
+}
+
+func (a *Aclient) Mkdir(username string, vpath string) error {
+	nodeUUID, remoteVpath, err := cluster.ParseRemotePath(vpath)
+	if err != nil {
+		return err
+	}
+	return a.callAPI(nodeUUID, http.MethodPost, cluster.APIFiles+"mkdir", fileQuery(username, remoteVpath), nil, nil)
+}
+
+func (a *Aclient) Remove(username string, vpath string) error {
+	nodeUUID, remoteVpath, err := cluster.ParseRemotePath(vpath)
+	if err != nil {
+		return err
+	}
+	return a.callAPI(nodeUUID, http.MethodPost, cluster.APIFiles+"remove", fileQuery(username, remoteVpath), nil, nil)
+}
+
+func fileQuery(username string, remoteVpath string) url.Values {
+	query := url.Values{}
+	query.Set("user", username)
+	query.Set("path", remoteVpath)
+	return query
+}
+
+//Serve the remote file to the browser. Range requests are passed to the remote node for media streaming
+func (a *Aclient) ServeRemoteFile(w http.ResponseWriter, r *http.Request, username string, vpath string, download bool) {
+	header := http.Header{}
+	for _, key := range []string{"Range", "If-Range"} {
+		if r.Header.Get(key) != "" {
+			header.Set(key, r.Header.Get(key))
+		}
+	}
+
+	resp, err := a.Open(username, vpath, header)
+	if err != nil {
+		http.Error(w, "404 - "+err.Error(), http.StatusNotFound)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, key := range []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "Last-Modified", "Etag"} {
+		if resp.Header.Get(key) != "" {
+			w.Header().Set(key, resp.Header.Get(key))
+		}
+	}
+	if download {
+		filename := strings.ReplaceAll(url.QueryEscape(path.Base(vpath)), "+", "%20")
+		w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+filename)
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
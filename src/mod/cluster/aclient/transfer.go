@@ -0,0 +1,205 @@
+package aclient
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"imuslab.com/arozos/mod/cluster"
+	"imuslab.com/arozos/mod/filesystem/fileapi"
+	user "imuslab.com/arozos/mod/user"
+)
+
+/*
+	Server to Server Copy and Move
+
+	Copy or move files between this node and the paired nodes, or between two
+	paired nodes. The file content is streamed between the nodes without
+	going through the browser.
+*/
+
+//Copy or move the source file or folder into the destination folder. Return the number of files transferred
+func (a *Aclient) Transfer(userinfo *user.User, src string, destDir string, move bool) (int, error) {
+	srcRemote := cluster.IsRemotePath(src)
+	destRemote := cluster.IsRemotePath(destDir)
+	if !srcRemote && !destRemote {
+		return 0, errors.New("Source or destination must be on a paired node")
+	}
+
+	//Check the paths and the permission on this node. Remote nodes check with the mapped user
+	for _, vpath := range []string{src, destDir} {
+		if !strings.Contains(vpath, ":/") || inArray(strings.Split(filepath.ToSlash(vpath), "/"), "..") {
+			return 0, errors.New("Invalid path given")
+		}
+		if cluster.IsRemotePath(vpath) {
+			_, remoteVpath, err := cluster.ParseRemotePath(vpath)
+			if err != nil {
+				return 0, err
+			}
+			if remoteVpath == "" {
+				return 0, errors.New("Node root is not a folder")
+			}
+		}
+	}
+	if !srcRemote && (!userinfo.CanRead(src) || (move && !userinfo.CanWrite(src))) {
+		return 0, errors.New("Permission denied")
+	}
+	if !destRemote && !userinfo.CanWrite(destDir) {
+		return 0, errors.New("Permission denied")
+	}
+
+	name := path.Base(strings.TrimRight(src[strings.Index(src, ":/")+2:], "/"))
+	if name == "" || name == "." || name == "/" {
+		return 0, errors.New("Virtual root cannot be transferred")
+	}
+	dest := strings.TrimRight(destDir, "/") + "/" + name
+	if _, err := a.stat(userinfo, dest); err == nil {
+		return 0, errors.New("Destination already exists")
+	}
+
+	counter := 0
+	err := a.transferItem(userinfo, src, dest, &counter)
+	if err != nil {
+		return counter, err
+	}
+
+	if move {
+		err = a.remove(userinfo, src)
+		if err != nil {
+			return counter, errors.New("Files copied but unable to remove the source: " + err.Error())
+		}
+	}
+	return counter, nil
+}
+
+func (a *Aclient) transferItem(userinfo *user.User, src string, dest string, counter *int) error {
+	info, err := a.stat(userinfo, src)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir {
+		err = a.mkdir(userinfo, dest)
+		if err != nil {
+			return err
+		}
+		children, err := a.listDir(userinfo, src)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			err = a.transferItem(userinfo, strings.TrimRight(src, "/")+"/"+child.Name, strings.TrimRight(dest, "/")+"/"+child.Name, counter)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	reader, err := a.open(userinfo, src)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	err = a.write(userinfo, dest, reader)
+	if err != nil {
+		return err
+	}
+	*counter++
+	return nil
+}
+
+/*
+	File operations on either local or remote paths
+*/
+
+func (a *Aclient) stat(userinfo *user.User, vpath string) (*cluster.FileInfo, error) {
+	if cluster.IsRemotePath(vpath) {
+		return a.Stat(userinfo.Username, vpath)
+	}
+	realpath, err := userinfo.VirtualPathToRealPath(vpath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fileapi.Stat(vpath, realpath)
+	if err != nil {
+		return nil, errors.New("File not exists")
+	}
+	result := cluster.FileInfo(info)
+	return &result, nil
+}
+
+//List the directory with the same filter as the file API served to the paired nodes
+func (a *Aclient) listDir(userinfo *user.User, vpath string) ([]cluster.FileInfo, error) {
+	if cluster.IsRemotePath(vpath) {
+		return a.ListDir(userinfo.Username, vpath)
+	}
+	realpath, err := userinfo.VirtualPathToRealPath(vpath)
+	if err != nil {
+		return nil, err
+	}
+	files, err := fileapi.ListDir(vpath, realpath)
+	if err != nil {
+		return nil, err
+	}
+	results := []cluster.FileInfo{}
+	for _, file := range files {
+		results = append(results, cluster.FileInfo(file))
+	}
+	return results, nil
+}
+
+func (a *Aclient) open(userinfo *user.User, vpath string) (io.ReadCloser, error) {
+	if cluster.IsRemotePath(vpath) {
+		resp, err := a.Open(userinfo.Username, vpath, nil)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
+	}
+	realpath, err := userinfo.VirtualPathToRealPath(vpath)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(realpath)
+}
+
+func (a *Aclient) mkdir(userinfo *user.User, vpath string) error {
+	if cluster.IsRemotePath(vpath) {
+		return a.Mkdir(userinfo.Username, vpath)
+	}
+	realpath, err := userinfo.VirtualPathToRealPath(vpath)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(realpath, 0755)
+}
+
+func (a *Aclient) remove(userinfo *user.User, vpath string) error {
+	if cluster.IsRemotePath(vpath) {
+		return a.Remove(userinfo.Username, vpath)
+	}
+	realpath, err := userinfo.VirtualPathToRealPath(vpath)
+	if err != nil {
+		return err
+	}
+	return fileapi.Remove(userinfo, realpath)
+}
+
+func (a *Aclient) write(userinfo *user.User, vpath string, content io.Reader) error {
+	if cluster.IsRemotePath(vpath) {
+		return a.WriteFile(userinfo.Username, vpath, content)
+	}
+	realpath, err := userinfo.VirtualPathToRealPath(vpath)
+	if err != nil {
+		return err
+	}
+	err = fileapi.WriteFile(userinfo, realpath, content)
+	if err != nil && err != fileapi.ErrQuotaFull {
+		return errors.New("Transfer interrupted: " + err.Error())
+	}
+	return err
+}
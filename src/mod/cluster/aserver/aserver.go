@@ -1,5 +1,20 @@
 package aserver
 
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"imuslab.com/arozos/mod/cluster"
+	user "imuslab.com/arozos/mod/user"
+)
+
 /*
 	ArOZ Cluster Server
 	author: tobychui
@@ -7,4 +22,175 @@ package aserver
 	This module is used to act as an ArOZ CLuster Server and receive
 	command from client and do things
 
+	The server listen on the cluster port with mutual TLS. Except the pair
+	request, all requests must come from a paired node presenting its pinned
+	certificate.
 */
+
+type Aserver struct {
+	Options    AserverOption
+	httpServer *http.Server
+}
+
+type AserverOption struct {
+	Node         *cluster.Node
+	Peers        *cluster.PeerStore
+	PairingCodes *cluster.PairingCodeManager
+	UserHandler  *user.UserHandler
+}
+
+func NewServer(option AserverOption) *Aserver {
+	return &Aserver{
+		Options: option,
+	}
+}
+
+//Start listening on the cluster port
+func (s *Aserver) Start() error {
+	if s.httpServer != nil {
+		return errors.New("Cluster server already running")
+	}
+
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(s.Options.Node.Port))
+	if err != nil {
+		return err
+	}
+
+	s.httpServer = &http.Server{
+		Handler:           s,
+		TLSConfig:         s.Options.Node.ServerTLSConfig(),
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+
+	go func(server *http.Server) {
+		err := server.ServeTLS(listener, "", "")
+		if err != nil && err != http.ErrServerClosed {
+			log.Println("[Cluster] Cluster server stopped: " + err.Error())
+		}
+	}(s.httpServer)
+
+	log.Println("[Cluster] Cluster server started on port " + strconv.Itoa(s.Options.Node.Port))
+	return nil
+}
+
+func (s *Aserver) Close() {
+	if s.httpServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.httpServer.Shutdown(ctx)
+	s.httpServer = nil
+}
+
+func (s *Aserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		sendErrorStatus(w, http.StatusUnauthorized, "Client certificate required")
+		return
+	}
+	fingerprint := cluster.Fingerprint(r.TLS.PeerCertificates[0].Raw)
+
+	if r.URL.Path == cluster.APIPair {
+		s.handlePair(w, r, fingerprint)
+		return
+	}
+
+	//Other requests must come from paired nodes
+	peer, err := s.Options.Peers.GetByFingerprint(fingerprint)
+	if err != nil {
+		sendErrorStatus(w, http.StatusForbidden, "Node not paired")
+		return
+	}
+	s.Options.Peers.Touch(peer.UUID)
+
+	switch {
+	case r.URL.Path == cluster.APIStatus:
+		s.handleStatus(w, r, peer)
+	case r.URL.Path == cluster.APIUnpair:
+		if r.Method != http.MethodPost {
+			sendErrorStatus(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		s.Options.Peers.Remove(peer.UUID)
+		log.Println("[Cluster] Node " + peer.Name + " (" + peer.UUID + ") unpaired by the remote node")
+		sendOK(w)
+	case strings.HasPrefix(r.URL.Path, cluster.APIFiles):
+		s.handleFileAPI(w, r, peer)
+	default:
+		sendErrorStatus(w, http.StatusNotFound, "Unknown cluster API")
+	}
+}
+
+//Serve the public node information for pairing. This is served on the web interface port
+func (s *Aserver) HandleNodeInfo(w http.ResponseWriter, r *http.Request) {
+	node := s.Options.Node
+	js, _ := json.Marshal(cluster.NodeInfo{
+		UUID:        node.UUID,
+		Name:        node.Name,
+		Port:        node.Port,
+		Fingerprint: node.Fingerprint,
+	})
+	sendJSONResponse(w, string(js))
+}
+
+func (s *Aserver) handleStatus(w http.ResponseWriter, r *http.Request, peer *cluster.Peer) {
+	node := s.Options.Node
+	status := cluster.NodeStatus{
+		UUID:      node.UUID,
+		Name:      node.Name,
+		Version:   node.Version,
+		StartTime: node.StartTime,
+		Time:      time.Now().Unix(),
+		Vroots:    []cluster.RemoteVroot{},
+	}
+
+	//Append the virtual roots if the user is mapped on this node
+	remoteUsername := r.URL.Query().Get("user")
+	if remoteUsername != "" {
+		userinfo, err := s.mapUser(peer, remoteUsername)
+		if err != nil {
+			sendErrorStatus(w, http.StatusForbidden, err.Error())
+			return
+		}
+		for _, fsh := range userinfo.GetAllAccessibleFileSystemHandler() {
+			if fsh.Hierarchy != "user" && fsh.Hierarchy != "public" {
+				continue
+			}
+			permission := userinfo.GetPathAccessPermission(fsh.UUID + ":/")
+			if permission != "readonly" && permission != "readwrite" {
+				continue
+			}
+			status.Vroots = append(status.Vroots, cluster.RemoteVroot{
+				ID:         fsh.UUID,
+				Name:       fsh.Name,
+				Permission: permission,
+			})
+		}
+	}
+
+	js, _ := json.Marshal(status)
+	sendJSONResponse(w, string(js))
+}
+
+//Get the local user mapped from the user on the peer
+func (s *Aserver) mapUser(peer *cluster.Peer, remoteUsername string) (*user.User, error) {
+	localUsername, err := s.Options.Peers.MapUser(peer.UUID, remoteUsername)
+	if err != nil {
+		return nil, err
+	}
+	userinfo, err := s.Options.UserHandler.GetUserInfoFromUsername(localUsername)
+	if err != nil {
+		return nil, errors.New("Mapped user " + localUsername + " not exists")
+	}
+	return userinfo, nil
+}
+
+//Send error response with the given HTTP status code
+func sendErrorStatus(w http.ResponseWriter, statusCode int, errMsg string) {
+	js, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{errMsg})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(js)
+}
@@ -0,0 +1,34 @@
+package aserver
+
+import (
+	"net/http"
+	"strings"
+
+	"imuslab.com/arozos/mod/cluster"
+	"imuslab.com/arozos/mod/filesystem/fileapi"
+)
+
+/*
+	Cluster File API
+
+	Allow paired nodes to access the files on this node as the mapped user.
+	The same permission of the mapped user apply. The file operations are
+	served by the shared virtual path file API.
+
+	/cluster/fs/list?user={username}&path={vpath}	=> list the directory
+	/cluster/fs/stat?user={username}&path={vpath}	=> get the file info
+	/cluster/fs/read?user={username}&path={vpath}	=> read the file, support range request
+	/cluster/fs/write?user={username}&path={vpath}	=> write the request body into the file (POST)
+	/cluster/fs/mkdir?user={username}&path={vpath}	=> create the directory (POST)
+	/cluster/fs/remove?user={username}&path={vpath}	=> remove the file or directory (POST)
+*/
+
+func (s *Aserver) handleFileAPI(w http.ResponseWriter, r *http.Request, peer *cluster.Peer) {
+	userinfo, err := s.mapUser(peer, r.URL.Query().Get("user"))
+	if err != nil {
+		sendErrorStatus(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	fileapi.ServeFileAPI(w, r, userinfo, strings.TrimPrefix(r.URL.Path, cluster.APIFiles))
+}
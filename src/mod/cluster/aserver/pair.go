@@ -0,0 +1,93 @@
+package aserver
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"imuslab.com/arozos/mod/cluster"
+)
+
+/*
+	Pair request handler
+
+	The certificate presented in the TLS handshake is the one being pinned, so the
+	requesting node must own the private key of the certificate it claims.
+*/
+
+func (s *Aserver) handlePair(w http.ResponseWriter, r *http.Request, fingerprint string) {
+	if r.Method != http.MethodPost {
+		sendErrorStatus(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	req := cluster.PairRequest{}
+	err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req)
+	if err != nil {
+		sendErrorStatus(w, http.StatusBadRequest, "Invalid pair request")
+		return
+	}
+	err = req.Validate()
+	if err != nil {
+		sendErrorStatus(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.UUID == s.Options.Node.UUID {
+		sendErrorStatus(w, http.StatusBadRequest, "Node cannot pair with itself")
+		return
+	}
+
+	code := ""
+	if req.Signature != "" {
+		//Pairing with shared secret
+		code, err = s.Options.PairingCodes.VerifyRequest(&req, fingerprint)
+		if err != nil {
+			log.Println("[Cluster] Pair request from " + r.RemoteAddr + " rejected: " + err.Error())
+			sendErrorStatus(w, http.StatusForbidden, err.Error())
+			return
+		}
+	} else if !s.Options.Peers.ConsumeTrustedFingerprint(fingerprint) {
+		//Pairing with certificate exchange
+		log.Println("[Cluster] Pair request from " + r.RemoteAddr + " rejected: certificate not trusted")
+		sendErrorStatus(w, http.StatusForbidden, "Certificate not trusted by this node")
+		return
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		sendErrorStatus(w, http.StatusBadRequest, "Unable to resolve the node address")
+		return
+	}
+
+	name := req.Name
+	if name == "" {
+		name = req.UUID
+	}
+	err = s.Options.Peers.Add(&cluster.Peer{
+		UUID:        req.UUID,
+		Name:        name,
+		Address:     net.JoinHostPort(host, strconv.Itoa(req.Port)),
+		Fingerprint: fingerprint,
+		PairedTime:  time.Now().Unix(),
+		LastSeen:    time.Now().Unix(),
+	})
+	if err != nil {
+		sendErrorStatus(w, http.StatusInternalServerError, "Unable to save the paired node")
+		return
+	}
+	log.Println("[Cluster] Paired with node " + name + " (" + req.UUID + ")")
+
+	resp := cluster.PairResponse{
+		UUID: s.Options.Node.UUID,
+		Name: s.Options.Node.Name,
+	}
+	if code != "" {
+		resp.Signature = cluster.SignPairResponse(code, &resp, s.Options.Node.Fingerprint, req.Nonce)
+	}
+	js, _ := json.Marshal(resp)
+	sendJSONResponse(w, string(js))
+}
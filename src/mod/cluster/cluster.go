@@ -0,0 +1,113 @@
+package cluster
+
+import (
+	"errors"
+	"strings"
+)
+
+/*
+	ArOZ Cluster
+	author: tobychui
+
+	Nodes paired with each other can access the storage of the others over
+	mutual TLS. This package contains the node identity, the paired node list
+	and the data types shared by the cluster server (aserver) and the cluster
+	client (aclient).
+
+	Cluster API served by aserver on the cluster port
+	/cluster/pair						=> pair request (POST, pairing code or trusted certificate)
+	/cluster/unpair						=> notify the node is unpaired (POST)
+	/cluster/status?user={username}				=> status of the node and the virtual roots of the user
+	/cluster/fs/{opr}?user={username}&path={vpath}		=> list, stat, read, write, mkdir and remove
+*/
+
+const (
+	APIPair   = "/cluster/pair"
+	APIUnpair = "/cluster/unpair"
+	APIStatus = "/cluster/status"
+	APIFiles  = "/cluster/fs/"
+)
+
+//Information of the node exposed to the public for pairing
+type NodeInfo struct {
+	UUID        string
+	Name        string
+	Port        int
+	Fingerprint string
+}
+
+//Status of a node returned to the paired nodes
+type NodeStatus struct {
+	UUID      string
+	Name      string
+	Version   string
+	StartTime int64
+	Time      int64
+	Vroots    []RemoteVroot //Virtual roots accessible by the mapped user, if a user is given
+}
+
+type RemoteVroot struct {
+	ID         string
+	Name       string
+	Permission string
+}
+
+//File information returned by the cluster file API
+type FileInfo struct {
+	Name    string
+	Vpath   string
+	IsDir   bool
+	Size    int64
+	ModTime int64
+}
+
+/*
+	Remote Virtual Roots
+
+	The storage of paired nodes are mounted as node-{uuid}:/. The first level
+	of the path is the virtual root on the remote node, e.g.
+	node-{uuid}:/user/Desktop/file.txt => user:/Desktop/file.txt on the remote node
+*/
+
+const RemoteRootPrefix = "node-"
+
+func IsRemotePath(vpath string) bool {
+	return strings.HasPrefix(vpath, RemoteRootPrefix) && strings.Contains(vpath, ":/")
+}
+
+//Split the remote path into node UUID and virtual path on the remote node. Return empty vpath for the node root
+func ParseRemotePath(vpath string) (string, string, error) {
+	if !IsRemotePath(vpath) {
+		return "", "", errors.New("Not a remote path")
+	}
+	pos := strings.Index(vpath, ":/")
+	nodeUUID := vpath[len(RemoteRootPrefix):pos]
+	subpath := strings.Trim(strings.ReplaceAll(vpath[pos+2:], "\\", "/"), "/")
+	if nodeUUID == "" {
+		return "", "", errors.New("Invalid remote path")
+	}
+	for _, segment := range strings.Split(subpath, "/") {
+		if segment == ".." || segment == "." {
+			return "", "", errors.New("Invalid remote path")
+		}
+	}
+	if subpath == "" {
+		return nodeUUID, "", nil
+	}
+
+	parts := strings.SplitN(subpath, "/", 2)
+	remoteVpath := parts[0] + ":/"
+	if len(parts) > 1 {
+		remoteVpath += parts[1]
+	}
+	return nodeUUID, remoteVpath, nil
+}
+
+//Convert the virtual path on the remote node back to the local representation
+func ToRemotePath(nodeUUID string, remoteVpath string) string {
+	pos := strings.Index(remoteVpath, ":/")
+	if pos <= 0 {
+		return RemoteRootPrefix + nodeUUID + ":/"
+	}
+	return strings.TrimRight(RemoteRootPrefix+nodeUUID+":/"+remoteVpath[:pos]+"/"+remoteVpath[pos+2:], "/")
+}
@@ -0,0 +1,145 @@
+package cluster
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+	ArOZ Cluster Node Identity
+
+	Each node owns a self-signed certificate with its device UUID as common name.
+	The certificates are exchanged during pairing and pinned by fingerprint, so
+	no certificate authority is required. All the node to node connections after
+	pairing are mutual TLS with the pinned certificates.
+*/
+
+type Node struct {
+	UUID        string
+	Name        string
+	Port        int //Listening port of the cluster server
+	Version     string
+	StartTime   int64
+	Certificate tls.Certificate
+	Fingerprint string
+}
+
+type NodeOption struct {
+	UUID     string
+	Name     string
+	Port     int
+	Version  string
+	CertPath string //Certificate file of this node, e.g. ./system/cluster/node.crt
+	KeyPath  string //Private key file of this node, e.g. ./system/cluster/node.key
+}
+
+//Load the node certificate, or generate a new one if it does not exists
+func NewNode(option NodeOption) (*Node, error) {
+	if !fileExists(option.CertPath) || !fileExists(option.KeyPath) {
+		err := generateNodeCertificate(option.UUID, option.CertPath, option.KeyPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(option.CertPath, option.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Node{
+		UUID:        option.UUID,
+		Name:        option.Name,
+		Port:        option.Port,
+		Version:     option.Version,
+		StartTime:   time.Now().Unix(),
+		Certificate: cert,
+		Fingerprint: Fingerprint(cert.Certificate[0]),
+	}, nil
+}
+
+func generateNodeCertificate(nodeUUID string, certPath string, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: nodeUUID, Organization: []string{"ArozOS Cluster"}},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().AddDate(20, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+
+	certBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	os.MkdirAll(filepath.Dir(certPath), 0755)
+	os.MkdirAll(filepath.Dir(keyPath), 0755)
+	err = ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes}), 0644)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), 0600)
+}
+
+//SHA-256 fingerprint of the DER encoded certificate
+func Fingerprint(der []byte) string {
+	hash := sha256.Sum256(der)
+	return hex.EncodeToString(hash[:])
+}
+
+//TLS config for the cluster server. Client certificates are required but checked against the peer list by the handlers
+func (n *Node) ServerTLSConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{n.Certificate},
+		ClientAuth:   tls.RequireAnyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+//TLS config for connecting to another node. If fingerprint is empty, any server certificate is accepted (pairing only)
+func (n *Node) ClientTLSConfig(fingerprint string) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{n.Certificate},
+		MinVersion:   tls.VersionTLS12,
+		//The certificates are self-signed and verified by the pinned fingerprint below
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("Remote node did not present a certificate")
+			}
+			if fingerprint != "" && Fingerprint(rawCerts[0]) != fingerprint {
+				return errors.New("Remote node certificate does not match the paired certificate")
+			}
+			return nil
+		},
+	}
+}
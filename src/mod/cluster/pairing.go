@@ -0,0 +1,153 @@
+package cluster
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Cluster Pairing
+
+	Pairing with shared secret:
+	1. Admin of node B generate a one time pairing code
+	2. Admin of node A enter the address of node B and the pairing code
+	3. Node A connect to node B with its node certificate and send a pair request,
+	   signed with HMAC-SHA256 of the pairing code over its UUID, certificate
+	   fingerprint and a nonce
+	4. Node B verify the signature and the presented certificate, pin the
+	   certificate and reply with its own information signed with the same code
+	5. Node A verify the reply against the server certificate and pin it
+
+	Pairing with certificate exchange:
+	The admin of node B trust the fingerprint of node A in advance and the admin
+	of node A enter the fingerprint of node B instead of the pairing code.
+*/
+
+const (
+	PairingCodeLifetime = 10 * time.Minute
+	maxPairingAttempts  = 5 //The pairing code is revoked after this number of failed attempts
+	maxRequestAge       = 300
+)
+
+type PairRequest struct {
+	UUID      string
+	Name      string
+	Port      int //Cluster server port of the requesting node
+	Nonce     string
+	Timestamp int64
+	Signature string //HMAC with the pairing code, empty if certificate exchange is used
+}
+
+type PairResponse struct {
+	UUID      string
+	Name      string
+	Signature string
+}
+
+type PairingCode struct {
+	Code      string
+	ExpiresAt int64
+	failed    int
+}
+
+type PairingCodeManager struct {
+	current *PairingCode
+	mutex   sync.Mutex
+}
+
+//Generate a new pairing code. The previous code is revoked
+func (m *PairingCodeManager) Generate() (*PairingCode, error) {
+	buf := make([]byte, 10)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.current = &PairingCode{
+		Code:      base32.StdEncoding.EncodeToString(buf),
+		ExpiresAt: time.Now().Add(PairingCodeLifetime).Unix(),
+	}
+	return m.current, nil
+}
+
+//Get the active pairing code, or nil if there are none
+func (m *PairingCodeManager) Current() *PairingCode {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.current == nil || time.Now().Unix() > m.current.ExpiresAt {
+		m.current = nil
+		return nil
+	}
+	return m.current
+}
+
+func (m *PairingCodeManager) Revoke() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.current = nil
+}
+
+//Verify the pair request signed with the pairing code. The code is consumed if the signature is valid
+func (m *PairingCodeManager) VerifyRequest(req *PairRequest, fingerprint string) (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.current == nil || time.Now().Unix() > m.current.ExpiresAt {
+		m.current = nil
+		return "", errors.New("No active pairing code on this node")
+	}
+
+	expected := SignPairRequest(m.current.Code, req, fingerprint)
+	if !hmac.Equal([]byte(expected), []byte(req.Signature)) {
+		m.current.failed++
+		if m.current.failed >= maxPairingAttempts {
+			m.current = nil
+		}
+		return "", errors.New("Invalid pairing code")
+	}
+
+	code := m.current.Code
+	m.current = nil
+	return code, nil
+}
+
+//Check if the timestamp of the pair request is recent
+func (req *PairRequest) Validate() error {
+	if req.UUID == "" || req.Nonce == "" || req.Port <= 0 {
+		return errors.New("Invalid pair request")
+	}
+	age := time.Now().Unix() - req.Timestamp
+	if age > maxRequestAge || age < -maxRequestAge {
+		return errors.New("Pair request expired. Check the clock of both nodes")
+	}
+	return nil
+}
+
+func SignPairRequest(code string, req *PairRequest, fingerprint string) string {
+	return pairingHMAC(code, "request", req.UUID, fingerprint, req.Nonce, strconv.FormatInt(req.Timestamp, 10))
+}
+
+func SignPairResponse(code string, resp *PairResponse, fingerprint string, nonce string) string {
+	return pairingHMAC(code, "response", resp.UUID, fingerprint, nonce)
+}
+
+func pairingHMAC(code string, fields ...string) string {
+	mac := hmac.New(sha256.New, []byte(NormalizePairingCode(code)))
+	mac.Write([]byte(strings.Join(fields, "|")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//Pairing codes are case insensitive and can be entered with spaces or dashes
+func NormalizePairingCode(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
@@ -0,0 +1,186 @@
+package cluster
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	db "imuslab.com/arozos/mod/database"
+)
+
+func newTestRequest() *PairRequest {
+	return &PairRequest{
+		UUID:      "node-a",
+		Name:      "Node A",
+		Port:      8443,
+		Nonce:     "0123456789abcdef",
+		Timestamp: time.Now().Unix(),
+	}
+}
+
+func TestPairRequestSignature(t *testing.T) {
+	req := newTestRequest()
+	signature := SignPairRequest("ABCD EFGH", req, "fingerprint-a")
+	if signature != SignPairRequest("abcd-efgh", req, "fingerprint-a") {
+		t.Error("Pairing code is not normalized before signing")
+	}
+
+	//Every signed field must change the signature
+	tampered := []struct {
+		name        string
+		req         PairRequest
+		fingerprint string
+	}{
+		{"uuid", PairRequest{UUID: "node-b", Nonce: req.Nonce, Timestamp: req.Timestamp}, "fingerprint-a"},
+		{"nonce", PairRequest{UUID: req.UUID, Nonce: "replayed", Timestamp: req.Timestamp}, "fingerprint-a"},
+		{"timestamp", PairRequest{UUID: req.UUID, Nonce: req.Nonce, Timestamp: req.Timestamp + 1}, "fingerprint-a"},
+		{"fingerprint", PairRequest{UUID: req.UUID, Nonce: req.Nonce, Timestamp: req.Timestamp}, "fingerprint-b"},
+	}
+	for _, tc := range tampered {
+		if SignPairRequest("ABCDEFGH", &tc.req, tc.fingerprint) == signature {
+			t.Errorf("Signature not changed with different %s", tc.name)
+		}
+	}
+	if SignPairRequest("ABCDEFGX", req, "fingerprint-a") == signature {
+		t.Error("Signature not changed with different pairing code")
+	}
+
+	//Request and response signatures must not be interchangeable
+	resp := &PairResponse{UUID: req.UUID}
+	if SignPairResponse("ABCDEFGH", resp, "fingerprint-a", req.Nonce) == signature {
+		t.Error("Response signature equals to the request signature")
+	}
+}
+
+func TestVerifyPairRequest(t *testing.T) {
+	manager := &PairingCodeManager{}
+	req := newTestRequest()
+	if _, err := manager.VerifyRequest(req, "fingerprint-a"); err == nil {
+		t.Fatal("Request verified without active pairing code")
+	}
+
+	code, err := manager.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Signature bound to another certificate is rejected
+	req.Signature = SignPairRequest(code.Code, req, "fingerprint-b")
+	if _, err := manager.VerifyRequest(req, "fingerprint-a"); err == nil {
+		t.Fatal("Request signed for another certificate is accepted")
+	}
+
+	req.Signature = SignPairRequest(code.Code, req, "fingerprint-a")
+	verifiedCode, err := manager.VerifyRequest(req, "fingerprint-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verifiedCode != code.Code {
+		t.Errorf("Verified code = %s, want %s", verifiedCode, code.Code)
+	}
+
+	//The code is consumed after a successful pairing
+	if manager.Current() != nil {
+		t.Error("Pairing code not consumed")
+	}
+	if _, err := manager.VerifyRequest(req, "fingerprint-a"); err == nil {
+		t.Error("Consumed pairing code accepted again")
+	}
+}
+
+func TestPairingCodeRevokedAfterFailedAttempts(t *testing.T) {
+	manager := &PairingCodeManager{}
+	code, err := manager.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := newTestRequest()
+	req.Signature = SignPairRequest("WRONGCODE", req, "fingerprint-a")
+	for i := 0; i < maxPairingAttempts; i++ {
+		if _, err := manager.VerifyRequest(req, "fingerprint-a"); err == nil {
+			t.Fatal("Request with wrong pairing code accepted")
+		}
+	}
+
+	req.Signature = SignPairRequest(code.Code, req, "fingerprint-a")
+	if _, err := manager.VerifyRequest(req, "fingerprint-a"); err == nil {
+		t.Error("Pairing code not revoked after too many failed attempts")
+	}
+}
+
+func TestPairRequestValidate(t *testing.T) {
+	req := newTestRequest()
+	if err := req.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	req.Timestamp = time.Now().Unix() - maxRequestAge - 10
+	if err := req.Validate(); err == nil {
+		t.Error("Expired pair request accepted")
+	}
+
+	req = newTestRequest()
+	req.Nonce = ""
+	if err := req.Validate(); err == nil {
+		t.Error("Pair request without nonce accepted")
+	}
+}
+
+func TestMapUser(t *testing.T) {
+	sysdb, err := db.NewDatabase(filepath.Join(t.TempDir(), "system.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sysdb.Close()
+
+	store, err := NewPeerStore(sysdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.MapUser("node-a", "alice"); err == nil {
+		t.Error("User mapped for unpaired node")
+	}
+
+	err = store.Add(&Peer{UUID: "node-a", Name: "Node A", Fingerprint: "fingerprint-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, _ := store.Get("node-a")
+	peer.UserMap["alice"] = "bob"
+	store.Update(peer)
+
+	if localUser, err := store.MapUser("node-a", "alice"); err != nil || localUser != "bob" {
+		t.Errorf("MapUser(alice) = %s, %v, want bob", localUser, err)
+	}
+	if _, err := store.MapUser("node-a", "carol"); err == nil {
+		t.Error("Unmapped user is accepted")
+	}
+
+	peer.MapSameName = true
+	store.Update(peer)
+	if localUser, err := store.MapUser("node-a", "carol"); err != nil || localUser != "carol" {
+		t.Errorf("MapUser(carol) = %s, %v, want carol", localUser, err)
+	}
+	if _, err := store.MapUser("node-a", ""); err == nil {
+		t.Error("Empty username is mapped")
+	}
+
+	//The user mapping is kept when the node is paired again
+	err = store.Add(&Peer{UUID: "node-a", Name: "Node A", Fingerprint: "fingerprint-a2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if localUser, err := store.MapUser("node-a", "alice"); err != nil || localUser != "bob" {
+		t.Errorf("User mapping lost after pairing again: %s, %v", localUser, err)
+	}
+
+	//Paired nodes are restored from the database
+	reloaded, err := NewPeerStore(sysdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer, err := reloaded.GetByFingerprint("fingerprint-a2"); err != nil || peer.UserMap["alice"] != "bob" {
+		t.Errorf("Paired node not restored from database: %v", err)
+	}
+}
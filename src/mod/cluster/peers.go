@@ -0,0 +1,208 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	db "imuslab.com/arozos/mod/database"
+)
+
+/*
+	Paired Nodes
+
+	The paired nodes are stored in the cluster table of the system database.
+	Requests from a paired node carry the username on that node, which is
+	mapped to a local user by the user mapping of the peer. Requests without
+	a mapping are rejected.
+*/
+
+type Peer struct {
+	UUID        string
+	Name        string
+	Address     string //Host and port of the cluster server of the peer
+	Fingerprint string //Pinned certificate fingerprint
+	PairedTime  int64
+	LastSeen    int64
+	UserMap     map[string]string //Username on the peer => local username
+	MapSameName bool              //Map the users with the same username if not listed in UserMap
+}
+
+type PeerStore struct {
+	database *db.Database
+	peers    map[string]*Peer
+	trusted  map[string]int64 //Fingerprints trusted for pairing => expire time
+	mutex    sync.RWMutex
+}
+
+func NewPeerStore(sysdb *db.Database) (*PeerStore, error) {
+	err := sysdb.NewTable("cluster")
+	if err != nil {
+		return nil, err
+	}
+
+	store := PeerStore{
+		database: sysdb,
+		peers:    map[string]*Peer{},
+		trusted:  map[string]int64{},
+	}
+
+	entries, err := sysdb.ListTable("cluster")
+	if err != nil {
+		return nil, err
+	}
+	for _, keypairs := range entries {
+		if !strings.HasPrefix(string(keypairs[0]), "peer/") {
+			continue
+		}
+		peer := Peer{}
+		if json.Unmarshal(keypairs[1], &peer) != nil {
+			continue
+		}
+		if peer.UserMap == nil {
+			peer.UserMap = map[string]string{}
+		}
+		store.peers[peer.UUID] = &peer
+	}
+
+	return &store, nil
+}
+
+//List the paired nodes sorted by name
+func (s *PeerStore) List() []*Peer {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	results := []*Peer{}
+	for _, peer := range s.peers {
+		results = append(results, peer)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return strings.ToLower(results[i].Name) < strings.ToLower(results[j].Name)
+	})
+	return results
+}
+
+func (s *PeerStore) Get(nodeUUID string) (*Peer, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	peer, ok := s.peers[nodeUUID]
+	if !ok {
+		return nil, errors.New("Node not paired")
+	}
+	return peer, nil
+}
+
+//Get the peer with the given certificate fingerprint
+func (s *PeerStore) GetByFingerprint(fingerprint string) (*Peer, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, peer := range s.peers {
+		if peer.Fingerprint == fingerprint {
+			return peer, nil
+		}
+	}
+	return nil, errors.New("Node not paired")
+}
+
+//Add or replace a paired node
+func (s *PeerStore) Add(peer *Peer) error {
+	if peer.UUID == "" || peer.Fingerprint == "" {
+		return errors.New("Invalid node information")
+	}
+	if peer.UserMap == nil {
+		peer.UserMap = map[string]string{}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if oldPeer, ok := s.peers[peer.UUID]; ok {
+		//Keep the user mapping when the node is paired again
+		peer.UserMap = oldPeer.UserMap
+		peer.MapSameName = oldPeer.MapSameName
+	}
+	s.peers[peer.UUID] = peer
+	return s.database.Write("cluster", "peer/"+peer.UUID, peer)
+}
+
+//Save the changes of the given peer
+func (s *PeerStore) Update(peer *Peer) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.peers[peer.UUID]; !ok {
+		return errors.New("Node not paired")
+	}
+	s.peers[peer.UUID] = peer
+	return s.database.Write("cluster", "peer/"+peer.UUID, peer)
+}
+
+func (s *PeerStore) Remove(nodeUUID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.peers[nodeUUID]; !ok {
+		return errors.New("Node not paired")
+	}
+	delete(s.peers, nodeUUID)
+	return s.database.Delete("cluster", "peer/"+nodeUUID)
+}
+
+//Update the last seen time of the peer. This is not written to database
+func (s *PeerStore) Touch(nodeUUID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if peer, ok := s.peers[nodeUUID]; ok {
+		peer.LastSeen = time.Now().Unix()
+	}
+}
+
+//Map the username on the peer to local username
+func (s *PeerStore) MapUser(nodeUUID string, remoteUsername string) (string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	peer, ok := s.peers[nodeUUID]
+	if !ok {
+		return "", errors.New("Node not paired")
+	}
+	if localUsername, ok := peer.UserMap[remoteUsername]; ok && localUsername != "" {
+		return localUsername, nil
+	}
+	if peer.MapSameName && remoteUsername != "" {
+		return remoteUsername, nil
+	}
+	return "", errors.New("User " + remoteUsername + " is not mapped on this node")
+}
+
+/*
+	Certificate Exchange
+
+	Instead of a pairing code, the admin can trust the certificate fingerprint
+	of the remote node shown on its cluster page. The remote node can then pair
+	with this node within the given time without any shared secret.
+*/
+
+func (s *PeerStore) TrustFingerprint(fingerprint string, duration time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.trusted[NormalizeFingerprint(fingerprint)] = time.Now().Add(duration).Unix()
+}
+
+//Check and remove the trusted fingerprint. Return false if it is not trusted or expired
+func (s *PeerStore) ConsumeTrustedFingerprint(fingerprint string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	expire, ok := s.trusted[fingerprint]
+	if !ok {
+		return false
+	}
+	delete(s.trusted, fingerprint)
+	return time.Now().Unix() < expire
+}
+
+//Remove separators and spaces from the fingerprint copied by users
+func NormalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.ToLower(strings.TrimSpace(fingerprint))
+	fingerprint = strings.ReplaceAll(fingerprint, ":", "")
+	return strings.ReplaceAll(fingerprint, " ", "")
+}
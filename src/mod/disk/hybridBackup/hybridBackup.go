@@ -87,8 +87,14 @@ type RestorableReport struct {
 
 var (
 	internalTickerTime time.Duration = 60
+	cycleEventHandler  func(*BackupTask, error) //Called when a backup cycle finished or failed
 )
 
+//Set the handler to be called when a backup cycle finished or failed
+func SetCycleEventHandler(handler func(task *BackupTask, err error)) {
+	cycleEventHandler = handler
+}
+
 func NewHyperBackupManager() *Manager {
 	//Create a new minute ticker
 	ticker := time.NewTicker(internalTickerTime * time.Second)
@@ -108,12 +114,7 @@ func NewHyperBackupManager() *Manager {
 			case <-ticker.C:
 				for _, task := range newManager.Tasks {
 					if task.Enabled == true {
-						output, err := task.HandleBackupProcess()
-						if err != nil {
-							task.Enabled = false
-							task.PanicStopped = true
-							task.ErrorMessage = output
-						}
+						task.runCycle()
 					}
 				}
 			case <-stopper:
@@ -182,14 +183,7 @@ func (m *Manager) StartTask(jobname string) {
 			task.Enabled = true
 
 			//Run it once in go routine
-			go func() {
-				output, err := task.HandleBackupProcess()
-				if err != nil {
-					task.Enabled = false
-					task.PanicStopped = true
-					task.ErrorMessage = output
-				}
-			}()
+			go task.runCycle()
 
 		}
 	}
@@ -219,6 +213,26 @@ func (m *Manager) Close() error {
 	return nil
 }
 
+//Run a backup cycle and report the result to the cycle event handler
+func (backupConfig *BackupTask) runCycle() {
+	lastCycleTime := backupConfig.LastCycleTime
+	output, err := backupConfig.HandleBackupProcess()
+	if err != nil {
+		backupConfig.Enabled = false
+		backupConfig.PanicStopped = true
+		backupConfig.ErrorMessage = output
+		if cycleEventHandler != nil {
+			cycleEventHandler(backupConfig, err)
+		}
+		return
+	}
+
+	//Only report full backup cycles, not the incremental checks between them
+	if backupConfig.LastCycleTime != lastCycleTime && cycleEventHandler != nil {
+		cycleEventHandler(backupConfig, nil)
+	}
+}
+
 //Main handler function for hybrid backup
 func (backupConfig *BackupTask) HandleBackupProcess() (string, error) {
 	//Check if the target disk is writable and mounted
@@ -0,0 +1,125 @@
+package event
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+	ArozOS Event Bus
+
+	Core subsystems publish events to the bus when something happens
+	(e.g. user login or file uploaded) and other subsystems (e.g. AGI)
+	subscribe to the event types they are interested in.
+
+	Handlers are executed in their own go routine so a slow handler
+	will not block the publisher
+*/
+
+//List of system event types
+const (
+	UserLogin        = "user.login"
+	UserLogout       = "user.logout"
+	FileUploaded     = "file.uploaded"
+	FileDeleted      = "file.deleted"
+	FileRenamed      = "file.renamed"
+	ShareCreated     = "share.created"
+	ShareAccessed    = "share.accessed"
+	BackupFinished   = "backup.finished"
+	BackupFailed     = "backup.failed"
+	IoTStatusChanged = "iot.status_changed"
+	StorageAttached  = "storage.attached"
+	StorageDetached  = "storage.detached"
+	NearbyOffer      = "nearby.offer"
+	NearbyReceived   = "nearby.received"
+)
+
+//All event types that can be subscribed
+var EventTypes = []string{
+	UserLogin,
+	UserLogout,
+	FileUploaded,
+	FileDeleted,
+	FileRenamed,
+	ShareCreated,
+	ShareAccessed,
+	BackupFinished,
+	BackupFailed,
+	IoTStatusChanged,
+	StorageAttached,
+	StorageDetached,
+	NearbyOffer,
+	NearbyReceived,
+}
+
+type Event struct {
+	Type      string                 //Type of the event, e.g. file.uploaded
+	Username  string                 //The user affected by this event, empty for system events
+	Payload   map[string]interface{} //Event specific data, e.g. the path of the uploaded file
+	Timestamp int64                  //Unix timestamp of the event
+}
+
+type Handler func(Event)
+
+type EventBus struct {
+	handlers map[string][]Handler
+	mutex    sync.RWMutex
+}
+
+//Create a new event bus
+func NewEventBus() *EventBus {
+	return &EventBus{
+		handlers: map[string][]Handler{},
+	}
+}
+
+//Check if the given event type is a valid system event type
+func IsValidEventType(eventType string) bool {
+	for _, thisType := range EventTypes {
+		if thisType == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+//Subscribe to the given event type
+func (b *EventBus) Subscribe(eventType string, handler Handler) {
+	b.mutex.Lock()
+	b.handlers[eventType] = append(b.handlers[eventType], handler)
+	b.mutex.Unlock()
+}
+
+//Publish an event to all subscribers. Safe to call on a nil event bus
+func (b *EventBus) Publish(eventType string, username string, payload map[string]interface{}) {
+	if b == nil {
+		return
+	}
+
+	if payload == nil {
+		payload = map[string]interface{}{}
+	}
+
+	thisEvent := Event{
+		Type:      eventType,
+		Username:  username,
+		Payload:   payload,
+		Timestamp: time.Now().Unix(),
+	}
+
+	b.mutex.RLock()
+	handlers := append([]Handler{}, b.handlers[eventType]...)
+	b.mutex.RUnlock()
+
+	for _, handler := range handlers {
+		go func(handler Handler) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Println("[Event] Handler for "+eventType+" panic: ", r)
+				}
+			}()
+			handler(thisEvent)
+		}(handler)
+	}
+}
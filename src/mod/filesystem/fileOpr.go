@@ -12,13 +12,17 @@ package filesystem
 */
 
 import (
+	"archive/tar"
 	"archive/zip"
 	"compress/flate"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -174,7 +178,7 @@ func ArozZipFileWithProgress(filelist []string, outputfile string, includeTopLev
 	//Create the target zip file
 	file, err := os.Create(outputfile)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer file.Close()
 
@@ -356,15 +360,296 @@ func insideHiddenFolder(path string) bool {
 	return FileIsHidden
 }
 
+type ArchiveEntry struct {
+	Name  string //Path of the entry inside the archive
+	Size  int64  //Uncompressed size of the entry
+	IsDir bool
+}
+
+//List the files inside an archive. Support zip, tar (plain or compressed), rar and 7z (require 7z installed)
 func ViewZipFile(filepath string) ([]string, error) {
-	z := archiver.Zip{}
+	entries, err := ListArchiveEntries(filepath)
 	filelist := []string{}
-	err := z.Walk(filepath, func(f archiver.File) error {
-		filelist = append(filelist, f.Name())
+	for _, entry := range entries {
+		filelist = append(filelist, entry.Name)
+	}
+
+	return filelist, err
+}
+
+//List the entries inside an archive with their uncompressed size
+func ListArchiveEntries(filepath string) ([]ArchiveEntry, error) {
+	if strings.ToLower(path.Ext(filepath)) == ".7z" {
+		return list7zEntries(filepath)
+	}
+
+	entries := []ArchiveEntry{}
+	err := archiver.Walk(filepath, func(f archiver.File) error {
+		//Use the full path inside the archive if the header provides one
+		name := f.Name()
+		switch h := f.Header.(type) {
+		case zip.FileHeader:
+			name = h.Name
+		case *tar.Header:
+			name = h.Name
+		}
+		entries = append(entries, ArchiveEntry{
+			Name:  name,
+			Size:  f.Size(),
+			IsDir: f.IsDir(),
+		})
 		return nil
 	})
 
-	return filelist, err
+	return entries, err
+}
+
+//Get the 7z command line tool installed on this host
+func get7zBinary() (string, error) {
+	for _, name := range []string{"7z", "7za", "7zr"} {
+		if _, err := exec.LookPath(name); err == nil {
+			return name, nil
+		}
+	}
+
+	return "", errors.New("7z not installed on this host")
+}
+
+//List the files inside a 7z archive using the 7z command line tool
+func list7zEntries(filepath string) ([]ArchiveEntry, error) {
+	binary, err := get7zBinary()
+	if err != nil {
+		return []ArchiveEntry{}, err
+	}
+
+	out, err := exec.Command(binary, "l", "-slt", "-ba", filepath).Output()
+	if err != nil {
+		return []ArchiveEntry{}, err
+	}
+
+	//Each entry is a block of "Key = Value" lines starting with Path
+	entries := []ArchiveEntry{}
+	for _, line := range strings.Split(strings.ReplaceAll(string(out), "\r\n", "\n"), "\n") {
+		if strings.HasPrefix(line, "Path = ") {
+			entries = append(entries, ArchiveEntry{
+				Name: strings.TrimPrefix(line, "Path = "),
+			})
+		} else if len(entries) > 0 && strings.HasPrefix(line, "Size = ") {
+			size, _ := strconv.ParseInt(strings.TrimPrefix(line, "Size = "), 10, 64)
+			entries[len(entries)-1].Size = size
+		} else if len(entries) > 0 && strings.HasPrefix(line, "Attributes = ") {
+			entries[len(entries)-1].IsDir = strings.HasPrefix(strings.TrimPrefix(line, "Attributes = "), "D")
+		}
+	}
+
+	return entries, nil
+}
+
+//Get the real path of an archive entry when extracted to outputFolder. Return error if the entry escape the output folder
+func getArchiveEntryDestination(outputFolder string, entryName string) (string, error) {
+	destination := filepath.Join(outputFolder, entryName)
+	if destination != filepath.Clean(outputFolder) && !strings.HasPrefix(destination, filepath.Clean(outputFolder)+string(os.PathSeparator)) {
+		return "", errors.New("Illegal file path in archive: " + entryName)
+	}
+	return destination, nil
+}
+
+//Extract zip, tar (plain or compressed), rar and 7z archives with progress update function (current filename / current file count / total file count / progress in percentage)
+func ArozExtractArchiveWithProgress(archiveFile string, outputFolder string, progressHandler func(string, int, int, float64)) error {
+	_, err := ArozExtractArchiveWithLimit(archiveFile, outputFolder, -1, progressHandler)
+	return err
+}
+
+//Returned when the extracted files exceed the size limit given to ArozExtractArchiveWithLimit
+var ErrExtractSizeLimit = errors.New("Extracted files exceed the size limit")
+
+/*
+	Extract the archive and stop when the bytes written exceed maxBytes, set maxBytes to -1 for no limit.
+	The limit is enforced on the extracted data instead of the sizes declared in the archive headers.
+	Return the number of bytes written.
+
+	With a limit, the archive is extracted into a staging folder inside outputFolder and the files
+	are moved into place only when the whole archive fits the limit, so existing files are never
+	touched by a rejected archive. 7z archives are extracted by the 7z tool, so they are rejected
+	before extraction if the listed sizes exceed the limit and checked again after extraction.
+*/
+func ArozExtractArchiveWithLimit(archiveFile string, outputFolder string, maxBytes int64, progressHandler func(string, int, int, float64)) (int64, error) {
+	entries, err := ListArchiveEntries(archiveFile)
+	if err != nil {
+		return 0, err
+	}
+
+	//Make sure no entries will be extracted outside of the output folder
+	for _, entry := range entries {
+		_, err := getArchiveEntryDestination(outputFolder, entry.Name)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = os.MkdirAll(outputFolder, 0755)
+	if err != nil {
+		return 0, err
+	}
+
+	if maxBytes < 0 {
+		return extractArchive(archiveFile, outputFolder, entries, -1, progressHandler)
+	}
+
+	//Reject without extracting anything if the listed sizes already exceed the limit
+	listedSize := int64(0)
+	for _, entry := range entries {
+		listedSize += entry.Size
+	}
+	if listedSize > maxBytes {
+		return 0, ErrExtractSizeLimit
+	}
+
+	stagingFolder, err := ioutil.TempDir(outputFolder, ".extract-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(stagingFolder)
+
+	written, err := extractArchive(archiveFile, stagingFolder, entries, maxBytes, progressHandler)
+	if err != nil {
+		return written, err
+	}
+
+	//The 7z tool does not stop at the limit. Check the size of what it actually extracted
+	if stagedSize, _ := GetDirctorySize(stagingFolder, true); stagedSize > maxBytes {
+		return stagedSize, ErrExtractSizeLimit
+	}
+
+	return written, moveExtractedFiles(stagingFolder, outputFolder)
+}
+
+//Extract the archive into outputFolder, stop when the bytes written exceed maxBytes unless it is -1
+func extractArchive(archiveFile string, outputFolder string, entries []ArchiveEntry, maxBytes int64, progressHandler func(string, int, int, float64)) (int64, error) {
+	ext := strings.ToLower(filepath.Ext(archiveFile))
+	if ext == ".zip" && maxBytes < 0 {
+		err := ArozUnzipFileWithProgress([]string{archiveFile}, outputFolder, progressHandler)
+		return archiveEntriesSize(outputFolder, entries), err
+	} else if ext == ".7z" {
+		binary, err := get7zBinary()
+		if err != nil {
+			return 0, err
+		}
+
+		err = exec.Command(binary, "x", "-y", "-o"+outputFolder, archiveFile).Run()
+		if err != nil {
+			return 0, err
+		}
+
+		progressHandler(filepath.Base(archiveFile), len(entries), len(entries), 100)
+		return archiveEntriesSize(outputFolder, entries), nil
+	}
+
+	//Other archive formats supported by archiver, and zip files with size limit
+	totalFileCount := len(entries)
+	extractedFileCount := 0
+	writer := &extractWriter{limit: maxBytes}
+	err := archiver.Walk(archiveFile, func(f archiver.File) error {
+		name := f.Name()
+		switch h := f.Header.(type) {
+		case zip.FileHeader:
+			name = h.Name
+		case *tar.Header:
+			name = h.Name
+		}
+
+		destination, err := getArchiveEntryDestination(outputFolder, name)
+		if err != nil {
+			return err
+		}
+
+		if f.IsDir() {
+			err = os.MkdirAll(destination, 0755)
+		} else {
+			err = writer.extract(f, destination)
+		}
+		if err != nil {
+			return err
+		}
+
+		extractedFileCount++
+		progressHandler(name, extractedFileCount, totalFileCount, float64(extractedFileCount)/float64(totalFileCount)*100.0)
+		return nil
+	})
+	if writer.exceeded {
+		//The walk error is wrapped by archiver
+		return writer.written, ErrExtractSizeLimit
+	}
+	return writer.written, err
+}
+
+//Move the extracted files from the staging folder into the output folder, replacing the existing files
+func moveExtractedFiles(stagingFolder string, outputFolder string) error {
+	return filepath.Walk(stagingFolder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(stagingFolder, path)
+		if err != nil || relPath == "." {
+			return err
+		}
+
+		destination := filepath.Join(outputFolder, relPath)
+		if info.IsDir() {
+			return os.MkdirAll(destination, 0755)
+		}
+		return os.Rename(path, destination)
+	})
+}
+
+//Count the bytes extracted from the archive and stop when the limit is reached
+type extractWriter struct {
+	file     *os.File
+	limit    int64 //-1 for unlimited
+	written  int64
+	exceeded bool
+}
+
+func (w *extractWriter) Write(p []byte) (int, error) {
+	if w.limit >= 0 && w.written+int64(len(p)) > w.limit {
+		w.exceeded = true
+		return 0, ErrExtractSizeLimit
+	}
+	n, err := w.file.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *extractWriter) extract(f archiver.File, destination string) error {
+	err := os.MkdirAll(filepath.Dir(destination), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w.file = file
+	_, err = io.Copy(w, f)
+	return err
+}
+
+//Get the total size of the extracted files of the archive entries
+func archiveEntriesSize(outputFolder string, entries []ArchiveEntry) int64 {
+	totalSize := int64(0)
+	for _, entry := range entries {
+		if entry.IsDir {
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(outputFolder, entry.Name)); err == nil && !info.IsDir() {
+			totalSize += info.Size()
+		}
+	}
+	return totalSize
 }
 
 func FileCopy(src string, dest string, mode string, progressUpdate func(int, string)) error {
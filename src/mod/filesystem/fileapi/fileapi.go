@@ -0,0 +1,252 @@
+package fileapi
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	user "imuslab.com/arozos/mod/user"
+)
+
+/*
+	Virtual Path File API
+
+	Access the files of a user by virtual path over HTTP. This is shared by
+	the APIs that act on behalf of a user authenticated by other means, e.g.
+	the subservice file API and the cluster file API. The caller authenticate
+	the request and resolve the user, then the same permission of the user apply.
+
+	list	=> list the directory
+	stat	=> get the file info
+	read	=> read the file, support range request
+	write	=> write the request body into the file (POST)
+	mkdir	=> create the directory (POST)
+	remove	=> remove the file or directory (POST)
+
+	The path is given in the "path" query parameter, e.g. ?path=user:/Desktop
+*/
+
+//Returned by WriteFile when the content does not fit the storage quota of the user
+var ErrQuotaFull = errors.New("Storage quota full")
+
+type FileInfo struct {
+	Name    string
+	Vpath   string
+	IsDir   bool
+	Size    int64
+	ModTime int64
+}
+
+//Serve the file operation opr as the given user
+func ServeFileAPI(w http.ResponseWriter, r *http.Request, userinfo *user.User, opr string) {
+	vpath := r.URL.Query().Get("path")
+	if vpath == "" || !strings.Contains(vpath, ":/") || inArray(strings.Split(filepath.ToSlash(vpath), "/"), "..") {
+		sendErrorStatus(w, http.StatusBadRequest, "Invalid path given")
+		return
+	}
+
+	writeOperation := opr == "write" || opr == "mkdir" || opr == "remove"
+	if writeOperation && r.Method != http.MethodPost {
+		sendErrorStatus(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if (writeOperation && !userinfo.CanWrite(vpath)) || !userinfo.CanRead(vpath) {
+		sendErrorStatus(w, http.StatusForbidden, "Permission denied")
+		return
+	}
+
+	realpath, err := userinfo.VirtualPathToRealPath(vpath)
+	if err != nil {
+		sendErrorStatus(w, http.StatusBadRequest, "Invalid path given")
+		return
+	}
+
+	switch opr {
+	case "list":
+		files, err := ListDir(vpath, realpath)
+		if err != nil {
+			sendErrorStatus(w, http.StatusNotFound, "Directory not exists")
+			return
+		}
+		js, _ := json.Marshal(files)
+		sendJSONResponse(w, string(js))
+	case "stat":
+		info, err := Stat(vpath, realpath)
+		if err != nil {
+			sendErrorStatus(w, http.StatusNotFound, "File not exists")
+			return
+		}
+		js, _ := json.Marshal(info)
+		sendJSONResponse(w, string(js))
+	case "read":
+		f, err := os.Open(realpath)
+		if err != nil {
+			sendErrorStatus(w, http.StatusNotFound, "File not exists")
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil || info.IsDir() {
+			sendErrorStatus(w, http.StatusBadRequest, "Target is not a file")
+			return
+		}
+		http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	case "write":
+		handleWrite(w, r, userinfo, realpath)
+	case "mkdir":
+		err := os.MkdirAll(realpath, 0755)
+		if err != nil {
+			sendErrorStatus(w, http.StatusInternalServerError, "Unable to create directory")
+			return
+		}
+		sendOK(w)
+	case "remove":
+		if strings.TrimRight(vpath[strings.Index(vpath, ":/")+2:], "/") == "" {
+			sendErrorStatus(w, http.StatusForbidden, "Virtual root cannot be removed")
+			return
+		}
+		if !fileExists(realpath) {
+			sendErrorStatus(w, http.StatusNotFound, "File not exists")
+			return
+		}
+		err := Remove(userinfo, realpath)
+		if err != nil {
+			sendErrorStatus(w, http.StatusInternalServerError, "Unable to remove file")
+			return
+		}
+		sendOK(w)
+	default:
+		sendErrorStatus(w, http.StatusNotFound, "Unknown operation")
+	}
+}
+
+//List the directory. Hidden files, metadata folders and the file system database are skipped
+func ListDir(vpath string, realpath string) ([]FileInfo, error) {
+	files, err := ioutil.ReadDir(realpath)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []FileInfo{}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), ".") || file.Name() == "aofs.db" || file.Name() == "aofs.db.lock" {
+			continue
+		}
+		results = append(results, newFileInfo(strings.TrimRight(vpath, "/")+"/"+file.Name(), file))
+	}
+	return results, nil
+}
+
+func Stat(vpath string, realpath string) (FileInfo, error) {
+	info, err := os.Stat(realpath)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return newFileInfo(vpath, info), nil
+}
+
+func handleWrite(w http.ResponseWriter, r *http.Request, userinfo *user.User, realpath string) {
+	if info, err := os.Stat(realpath); err == nil && info.IsDir() {
+		sendErrorStatus(w, http.StatusBadRequest, "Target is a directory")
+		return
+	}
+	if !fileExists(filepath.Dir(realpath)) {
+		sendErrorStatus(w, http.StatusNotFound, "Parent directory not exists")
+		return
+	}
+
+	err := WriteFile(userinfo, realpath, r.Body)
+	if err == ErrQuotaFull {
+		sendErrorStatus(w, http.StatusInsufficientStorage, "Storage quota full")
+		return
+	} else if err != nil {
+		sendErrorStatus(w, http.StatusInternalServerError, "Unable to write file")
+		return
+	}
+	sendOK(w)
+}
+
+/*
+	Write the content into the file as the user. The content is written to a temporary
+	file first so the original file is kept if the write failed, and the write stops as
+	soon as the content exceeds the remaining storage quota of the user.
+*/
+func WriteFile(userinfo *user.User, realpath string, content io.Reader) error {
+	//Only the user storage count towards the quota
+	quotaLimited := false
+	remainingQuota := int64(0)
+	fsh, err := userinfo.GetFileSystemHandlerFromRealPath(realpath)
+	if err == nil && fsh.Hierarchy == "user" && userinfo.StorageQuota.TotalStorageQuota != -1 {
+		quotaLimited = true
+		remainingQuota = userinfo.StorageQuota.TotalStorageQuota - userinfo.StorageQuota.UsedStorageQuota
+		if remainingQuota <= 0 {
+			return ErrQuotaFull
+		}
+		content = io.LimitReader(content, remainingQuota)
+	}
+
+	tmpFile := filepath.Join(filepath.Dir(realpath), "."+filepath.Base(realpath)+".upload")
+	f, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	size, err := io.Copy(f, content)
+	f.Close()
+	if err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+
+	//Reaching the limit means the content is larger than the remaining quota
+	if quotaLimited && !userinfo.StorageQuota.HaveSpace(size) {
+		os.Remove(tmpFile)
+		return ErrQuotaFull
+	}
+
+	if fileExists(realpath) {
+		userinfo.RemoveOwnershipFromFile(realpath)
+	}
+	err = os.Rename(tmpFile, realpath)
+	if err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	userinfo.SetOwnerOfFile(realpath)
+	return nil
+}
+
+//Remove the file or directory and reclaim the quota used by the files
+func Remove(userinfo *user.User, realpath string) error {
+	filepath.Walk(realpath, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			userinfo.RemoveOwnershipFromFile(path)
+		}
+		return nil
+	})
+	return os.RemoveAll(realpath)
+}
+
+func newFileInfo(vpath string, info os.FileInfo) FileInfo {
+	return FileInfo{
+		Name:    info.Name(),
+		Vpath:   vpath,
+		IsDir:   info.IsDir(),
+		Size:    info.Size(),
+		ModTime: info.ModTime().Unix(),
+	}
+}
+
+//Send error response with the given HTTP status code
+func sendErrorStatus(w http.ResponseWriter, statusCode int, errMsg string) {
+	js, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{errMsg})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(js)
+}
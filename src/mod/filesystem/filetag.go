@@ -0,0 +1,223 @@
+package filesystem
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	File Tags and Favourites
+	author: tobychui
+
+	This script store the per user file metadata (tags and favourites)
+	inside the fsdb of the file system handler, next to the ownership records.
+	Records are keyed by the relative path of the file so they can be carried
+	along when the file is renamed, moved or copied.
+*/
+
+//Tag record of a file for a single user
+type FileTagRecord struct {
+	Tags      []string
+	Favourite bool
+}
+
+//Check if this record contains any information worth storing
+func (r *FileTagRecord) IsEmpty() bool {
+	return len(r.Tags) == 0 && !r.Favourite
+}
+
+//Check if this record contains the given tag
+func (r *FileTagRecord) HasTag(tag string) bool {
+	for _, thisTag := range r.Tags {
+		if strings.EqualFold(thisTag, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+//Get the relative path of the given realpath from the root of this fsh
+func (fsh *FileSystemHandler) getRelativePath(realpath string) (string, error) {
+	rpabs, _ := filepath.Abs(realpath)
+	fsrabs, _ := filepath.Abs(fsh.Path)
+	reldir, err := filepath.Rel(fsrabs, rpabs)
+	if err != nil {
+		return "", err
+	}
+	reldir = filepath.ToSlash(reldir)
+	if reldir == ".." || strings.HasPrefix(reldir, "../") {
+		return "", errors.New("Path is not inside this file system handler")
+	}
+	return reldir, nil
+}
+
+//Read all user records of the given file, mapped by username
+func (fsh *FileSystemHandler) readFileTagEntry(reldir string) map[string]*FileTagRecord {
+	entry := map[string]*FileTagRecord{}
+	fsh.FilesystemDatabase.NewTable("tags")
+	if fsh.FilesystemDatabase.KeyExists("tags", "tags/"+reldir) {
+		fsh.FilesystemDatabase.Read("tags", "tags/"+reldir, &entry)
+	}
+	return entry
+}
+
+//Write all user records of the given file, remove the key if there is nothing to store
+func (fsh *FileSystemHandler) writeFileTagEntry(reldir string, entry map[string]*FileTagRecord) error {
+	fsh.FilesystemDatabase.NewTable("tags")
+	for username, record := range entry {
+		if record == nil || record.IsEmpty() {
+			delete(entry, username)
+		}
+	}
+
+	if len(entry) == 0 {
+		if fsh.FilesystemDatabase.KeyExists("tags", "tags/"+reldir) {
+			return fsh.FilesystemDatabase.Delete("tags", "tags/"+reldir)
+		}
+		return nil
+	}
+	return fsh.FilesystemDatabase.Write("tags", "tags/"+reldir, entry)
+}
+
+//Get the tag record of a file for the given user
+func (fsh *FileSystemHandler) GetFileTagRecord(realpath string, username string) (*FileTagRecord, error) {
+	reldir, err := fsh.getRelativePath(realpath)
+	if err != nil {
+		return &FileTagRecord{Tags: []string{}}, err
+	}
+
+	entry := fsh.readFileTagEntry(reldir)
+	if record, ok := entry[username]; ok && record != nil {
+		if record.Tags == nil {
+			record.Tags = []string{}
+		}
+		return record, nil
+	}
+	return &FileTagRecord{Tags: []string{}}, nil
+}
+
+//Set the tag record of a file for the given user. Empty record will be removed
+func (fsh *FileSystemHandler) SetFileTagRecord(realpath string, username string, record *FileTagRecord) error {
+	reldir, err := fsh.getRelativePath(realpath)
+	if err != nil {
+		return err
+	}
+
+	entry := fsh.readFileTagEntry(reldir)
+	entry[username] = record
+	return fsh.writeFileTagEntry(reldir, entry)
+}
+
+/*
+	Export all the tag records of the given file, including all files inside it if it is a folder.
+	The returned map use the relative path from the given realpath as key ("" for the file itself)
+*/
+func (fsh *FileSystemHandler) ExportFileTagRecords(realpath string) (map[string]map[string]*FileTagRecord, error) {
+	results := map[string]map[string]*FileTagRecord{}
+	reldir, err := fsh.getRelativePath(realpath)
+	if err != nil {
+		return results, err
+	}
+
+	fsh.FilesystemDatabase.NewTable("tags")
+	entries, err := fsh.FilesystemDatabase.ListTable("tags")
+	if err != nil {
+		return results, err
+	}
+
+	for _, keypairs := range entries {
+		thisRelpath := strings.TrimPrefix(string(keypairs[0]), "tags/")
+		subpath := ""
+		if thisRelpath == reldir {
+			subpath = ""
+		} else if reldir == "." || strings.HasPrefix(thisRelpath, reldir+"/") {
+			subpath = strings.TrimPrefix(thisRelpath, reldir+"/")
+		} else {
+			continue
+		}
+
+		entry := map[string]*FileTagRecord{}
+		if err := json.Unmarshal(keypairs[1], &entry); err != nil {
+			continue
+		}
+		results[subpath] = entry
+	}
+
+	return results, nil
+}
+
+//Import tag records exported by ExportFileTagRecords to the given realpath
+func (fsh *FileSystemHandler) ImportFileTagRecords(realpath string, records map[string]map[string]*FileTagRecord) error {
+	reldir, err := fsh.getRelativePath(realpath)
+	if err != nil {
+		return err
+	}
+
+	for subpath, entry := range records {
+		targetRelpath := reldir
+		if subpath != "" {
+			targetRelpath = reldir + "/" + subpath
+		}
+
+		//Merge with the records that already exists at the destination
+		existingEntry := fsh.readFileTagEntry(targetRelpath)
+		for username, record := range entry {
+			existingEntry[username] = record
+		}
+		fsh.writeFileTagEntry(targetRelpath, existingEntry)
+	}
+
+	return nil
+}
+
+//Remove all tag records of the given file, including all files inside it if it is a folder
+func (fsh *FileSystemHandler) DeleteFileTagRecords(realpath string) error {
+	reldir, err := fsh.getRelativePath(realpath)
+	if err != nil {
+		return err
+	}
+
+	records, err := fsh.ExportFileTagRecords(realpath)
+	if err != nil {
+		return err
+	}
+
+	for subpath := range records {
+		targetRelpath := reldir
+		if subpath != "" {
+			targetRelpath = reldir + "/" + subpath
+		}
+		fsh.FilesystemDatabase.Delete("tags", "tags/"+targetRelpath)
+	}
+
+	return nil
+}
+
+//List all the tagged files of the given user in this fsh, mapped by realpath
+func (fsh *FileSystemHandler) ListFileTagRecords(username string) (map[string]*FileTagRecord, error) {
+	results := map[string]*FileTagRecord{}
+	fsh.FilesystemDatabase.NewTable("tags")
+	entries, err := fsh.FilesystemDatabase.ListTable("tags")
+	if err != nil {
+		return results, err
+	}
+
+	for _, keypairs := range entries {
+		entry := map[string]*FileTagRecord{}
+		if err := json.Unmarshal(keypairs[1], &entry); err != nil {
+			continue
+		}
+
+		if record, ok := entry[username]; ok && record != nil {
+			if record.Tags == nil {
+				record.Tags = []string{}
+			}
+			thisRelpath := strings.TrimPrefix(string(keypairs[0]), "tags/")
+			results[filepath.ToSlash(filepath.Join(fsh.Path, thisRelpath))] = record
+		}
+	}
+
+	return results, nil
+}
@@ -0,0 +1,59 @@
+package metadata
+
+import (
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"imuslab.com/arozos/mod/filesystem"
+)
+
+/*
+	Archive Renderer
+
+	Render the file listing of zip, tar, rar and 7z archives into a thumbnail
+*/
+
+var archiveFormats = []string{".zip", ".tar", ".gz", ".tgz", ".bz2", ".tbz2", ".xz", ".txz", ".rar", ".7z"}
+
+func generateThumbnailForArchive(cacheFolder string, file string, generateOnly bool) (string, error) {
+	entries, err := filesystem.ViewZipFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	lines := []string{filepath.Base(file), strconv.Itoa(len(entries)) + " items", ""}
+	for _, entry := range entries {
+		lines = append(lines, formatArchiveEntry(entry))
+	}
+
+	outputFile := cacheFolder + filepath.Base(file) + ".jpg"
+	out, err := os.Create(outputFile)
+	if err != nil {
+		return "", err
+	}
+	jpeg.Encode(out, renderTextToImage(lines, 480, 480), &jpeg.Options{Quality: 90})
+	out.Close()
+
+	if !generateOnly {
+		//return the image as well
+		ctx, err := getImageAsBase64(outputFile)
+		return ctx, err
+	}
+	return "", nil
+}
+
+//Indent the archive entry according to its depth inside the archive
+func formatArchiveEntry(entry string) string {
+	entry = filepath.ToSlash(entry)
+	isFolder := strings.HasSuffix(entry, "/")
+	entry = strings.Trim(entry, "/")
+	depth := strings.Count(entry, "/")
+	name := entry[strings.LastIndex(entry, "/")+1:]
+	if isFolder {
+		name = name + "/"
+	}
+	return strings.Repeat("  ", depth) + name
+}
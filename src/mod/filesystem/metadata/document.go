@@ -0,0 +1,212 @@
+package metadata
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+/*
+	Document Renderer
+
+	Render the pages of PDF files into images using pdftoppm (poppler-utils)
+	or ghostscript. Office documents are converted into PDF with a headless
+	LibreOffice first if it is installed on the host
+*/
+
+var pdfFormats = []string{".pdf"}
+var officeFormats = []string{".doc", ".docx", ".odt", ".rtf", ".xls", ".xlsx", ".ods", ".ppt", ".pptx", ".odp"}
+
+func generateThumbnailForPDF(cacheFolder string, file string, generateOnly bool) (string, error) {
+	return generateThumbnailFromPdfPage(cacheFolder, file, file, generateOnly)
+}
+
+func generateThumbnailForOffice(cacheFolder string, file string, generateOnly bool) (string, error) {
+	if !fileExists(file) {
+		//The user removed this file before the thumbnail is finished
+		return "", errors.New("Source not exists")
+	}
+
+	pdfFile, tmpFolder, err := convertOfficeToPdf(file)
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpFolder)
+
+	return generateThumbnailFromPdfPage(cacheFolder, file, pdfFile, generateOnly)
+}
+
+//Render the first page of pdfFile as the thumbnail of file
+func generateThumbnailFromPdfPage(cacheFolder string, file string, pdfFile string, generateOnly bool) (string, error) {
+	pages, tmpFolder, err := renderPdfPages(pdfFile, 1, 480)
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpFolder)
+
+	if len(pages) == 0 {
+		return "", errors.New("Image generation failed")
+	}
+
+	page, err := loadImage(pages[0])
+	if err != nil {
+		return "", err
+	}
+
+	outputFile := cacheFolder + filepath.Base(file) + ".jpg"
+	out, err := os.Create(outputFile)
+	if err != nil {
+		return "", err
+	}
+	jpeg.Encode(out, fitDocumentPage(page, 480), &jpeg.Options{Quality: 90})
+	out.Close()
+
+	if !generateOnly {
+		//return the image as well
+		ctx, err := getImageAsBase64(outputFile)
+		return ctx, err
+	}
+	return "", nil
+}
+
+//Check if a PDF renderer is installed on this host
+func pdfRendererExists() bool {
+	return pkg_exists("pdftoppm") || pkg_exists("gs")
+}
+
+/*
+	Render the first maxPages pages of a PDF file into jpeg images with the given width.
+	The rendered pages are stored in a tmp folder which should be removed by the caller
+*/
+func renderPdfPages(file string, maxPages int, width int) ([]string, string, error) {
+	if !fileExists(file) {
+		return []string{}, "", errors.New("Source not exists")
+	}
+
+	tmpFolder, err := ioutil.TempDir("", "arozos-preview-")
+	if err != nil {
+		return []string{}, "", err
+	}
+
+	if pkg_exists("pdftoppm") {
+		//Output files are named as page-1.jpg, page-01.jpg etc depending on the page count
+		cmd := exec.Command("pdftoppm", "-jpeg", "-f", "1", "-l", strconv.Itoa(maxPages), "-scale-to-x", strconv.Itoa(width), "-scale-to-y", "-1", file, filepath.Join(tmpFolder, "page"))
+		_, err = cmd.CombinedOutput()
+	} else if pkg_exists("gs") {
+		cmd := exec.Command("gs", "-q", "-dNOPAUSE", "-dBATCH", "-dSAFER", "-sDEVICE=jpeg", "-r72", "-dFirstPage=1", "-dLastPage="+strconv.Itoa(maxPages), "-sOutputFile="+filepath.Join(tmpFolder, "page-%d.jpg"), file)
+		_, err = cmd.CombinedOutput()
+	} else {
+		err = errors.New("pdftoppm or ghostscript not installed. Skipping PDF rendering")
+	}
+
+	if err != nil {
+		os.RemoveAll(tmpFolder)
+		return []string{}, "", err
+	}
+
+	pages, _ := filepath.Glob(filepath.Join(tmpFolder, "page-*.jpg"))
+	sort.Slice(pages, func(i, j int) bool {
+		return pageNumber(pages[i]) < pageNumber(pages[j])
+	})
+
+	return pages, tmpFolder, nil
+}
+
+//Get the page number from the rendered page filename
+func pageNumber(file string) int {
+	name := strings.TrimSuffix(filepath.Base(file), ".jpg")
+	number, _ := strconv.Atoi(strings.TrimPrefix(name, "page-"))
+	return number
+}
+
+//Get the total number of pages of a PDF file, return 0 if unknown
+func getPdfPageCount(file string) int {
+	if !pkg_exists("pdfinfo") {
+		return 0
+	}
+
+	out, err := exec.Command("pdfinfo", file).Output()
+	if err != nil {
+		return 0
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "Pages:") {
+			count, _ := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "Pages:")))
+			return count
+		}
+	}
+	return 0
+}
+
+//Get the LibreOffice binary installed on this host
+func getOfficeConverter() string {
+	for _, name := range []string{"soffice", "libreoffice"} {
+		if pkg_exists(name) {
+			return name
+		}
+	}
+	return ""
+}
+
+/*
+	Convert an Office document into PDF using headless LibreOffice.
+	Return the converted PDF and the tmp folder that should be removed by the caller
+*/
+func convertOfficeToPdf(file string) (string, string, error) {
+	converter := getOfficeConverter()
+	if converter == "" {
+		return "", "", errors.New("LibreOffice not installed. Skipping document rendering")
+	}
+
+	tmpFolder, err := ioutil.TempDir("", "arozos-convert-")
+	if err != nil {
+		return "", "", err
+	}
+
+	//Use a dedicated profile folder so it will not conflict with other running instances
+	cmd := exec.Command(converter, "-env:UserInstallation=file://"+filepath.ToSlash(filepath.Join(tmpFolder, "profile")), "--headless", "--convert-to", "pdf", "--outdir", tmpFolder, file)
+	_, err = cmd.CombinedOutput()
+	if err != nil {
+		os.RemoveAll(tmpFolder)
+		return "", "", err
+	}
+
+	pdfFile := filepath.Join(tmpFolder, strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))+".pdf")
+	if !fileExists(pdfFile) {
+		os.RemoveAll(tmpFolder)
+		return "", "", errors.New("Document conversion failed")
+	}
+
+	return pdfFile, tmpFolder, nil
+}
+
+func loadImage(file string) (image.Image, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	return img, err
+}
+
+//Scale the page to the thumbnail width and keep the top part of it on a white square canvas
+func fitDocumentPage(page image.Image, size int) image.Image {
+	resized := resize.Resize(uint(size), 0, page, resize.Lanczos3)
+	canvas := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(canvas, canvas.Bounds(), &image.Uniform{color.White}, image.Point{}, draw.Src)
+	draw.Draw(canvas, canvas.Bounds(), resized, resized.Bounds().Min, draw.Over)
+	return canvas
+}
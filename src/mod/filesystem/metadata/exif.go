@@ -0,0 +1,486 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	EXIF Reader
+
+	This script extract the commonly used EXIF fields (capture time, camera,
+	orientation and GPS location) from JPEG, HEIC and TIFF based RAW files.
+	XMP sidecar files next to the image (e.g. IMG_0001.CR2.xmp or IMG_0001.xmp)
+	will be used to fill in or override the fields if exists
+*/
+
+type ImageExif struct {
+	CaptureTime int64  //Capture time in unix timestamp, 0 if unknown
+	CameraMake  string //Camera manufacturer
+	CameraModel string //Camera model
+	Orientation int    //EXIF orientation (1 - 8), 1 if unknown
+	HasGPS      bool   //If the GPS location is available
+	Latitude    float64
+	Longitude   float64
+	Width       int
+	Height      int
+}
+
+//TIFF tag IDs used by this reader
+const (
+	exifTagMake             = 0x010F
+	exifTagModel            = 0x0110
+	exifTagOrientation      = 0x0112
+	exifTagDateTime         = 0x0132
+	exifTagExifIFD          = 0x8769
+	exifTagGPSIFD           = 0x8825
+	exifTagDateTimeOriginal = 0x9003
+	exifTagPixelXDimension  = 0xA002
+	exifTagPixelYDimension  = 0xA003
+	exifTagGPSLatitudeRef   = 0x0001
+	exifTagGPSLatitude      = 0x0002
+	exifTagGPSLongitudeRef  = 0x0003
+	exifTagGPSLongitude     = 0x0004
+)
+
+//File extensions that contains a TIFF structure at the beginning of the file
+var tiffBasedRawFormats = []string{".tif", ".tiff", ".dng", ".cr2", ".nef", ".nrw", ".arw", ".srw", ".orf", ".pef", ".rw2"}
+
+//Image formats supported by the EXIF reader
+var ExifSupportedFormats = append([]string{".jpg", ".jpeg", ".heic", ".heif"}, tiffBasedRawFormats...)
+
+//Read the EXIF information of the given image file
+func ReadImageExif(file string) (*ImageExif, error) {
+	result := ImageExif{
+		Orientation: 1,
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return &result, err
+	}
+	defer f.Close()
+
+	ext := strings.ToLower(filepath.Ext(file))
+	if ext == ".jpg" || ext == ".jpeg" {
+		err = readJpegExif(f, &result)
+	} else if ext == ".heic" || ext == ".heif" {
+		err = readHeicExif(f, &result)
+	} else if inArray(tiffBasedRawFormats, ext) {
+		err = readTiffExif(f, 0, &result)
+	} else {
+		err = errors.New("Not supported image format")
+	}
+
+	//Load the sidecar file if exists
+	sidecarErr := readXmpSidecar(file, &result)
+	if err != nil && sidecarErr == nil {
+		//EXIF not found but sidecar exists
+		err = nil
+	}
+
+	return &result, err
+}
+
+//Read EXIF from the given bytes of a JPEG file
+func ReadJpegExifFromBytes(content []byte) (*ImageExif, error) {
+	result := ImageExif{
+		Orientation: 1,
+	}
+	err := readJpegExif(bytes.NewReader(content), &result)
+	return &result, err
+}
+
+//Scan the JPEG segments and parse the APP1 Exif segment
+func readJpegExif(r io.ReadSeeker, result *ImageExif) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if header[0] != 0xFF || header[1] != 0xD8 {
+		return errors.New("Not a valid JPEG file")
+	}
+
+	for {
+		marker := make([]byte, 4)
+		if _, err := io.ReadFull(r, marker); err != nil {
+			return err
+		}
+		if marker[0] != 0xFF {
+			return errors.New("Invalid JPEG segment")
+		}
+
+		//Start of scan or end of image. No more metadata after this point
+		if marker[1] == 0xDA || marker[1] == 0xD9 {
+			return errors.New("EXIF not found")
+		}
+
+		segmentLength := int64(binary.BigEndian.Uint16(marker[2:])) - 2
+		if segmentLength < 0 {
+			return errors.New("Invalid JPEG segment length")
+		}
+
+		if marker[1] == 0xE1 && segmentLength > 6 {
+			segment := make([]byte, segmentLength)
+			if _, err := io.ReadFull(r, segment); err != nil {
+				return err
+			}
+
+			if string(segment[:6]) == "Exif\x00\x00" {
+				return readTiffExif(bytes.NewReader(segment[6:]), 0, result)
+			}
+			continue
+		}
+
+		if _, err := r.Seek(segmentLength, io.SeekCurrent); err != nil {
+			return err
+		}
+	}
+}
+
+//HEIC store the EXIF block as an item inside the ISOBMFF container. Look for the Exif header directly
+func readHeicExif(f *os.File, result *ImageExif) error {
+	//The metadata is located near the beginning of the file in most cases
+	content, err := ioutil.ReadAll(io.LimitReader(f, 4<<20))
+	if err != nil {
+		return err
+	}
+
+	offset := bytes.Index(content, []byte("Exif\x00\x00"))
+	for offset >= 0 {
+		tiffStart := offset + 6
+		if tiffStart+8 <= len(content) {
+			byteOrder := string(content[tiffStart : tiffStart+2])
+			if byteOrder == "II" || byteOrder == "MM" {
+				return readTiffExif(bytes.NewReader(content[tiffStart:]), 0, result)
+			}
+		}
+
+		next := bytes.Index(content[offset+6:], []byte("Exif\x00\x00"))
+		if next < 0 {
+			break
+		}
+		offset = offset + 6 + next
+	}
+
+	return errors.New("EXIF not found")
+}
+
+type tiffReader struct {
+	r     io.ReaderAt
+	base  int64
+	order binary.ByteOrder
+}
+
+type tiffEntry struct {
+	tag      uint16
+	datatype uint16
+	count    uint32
+	value    []byte //Raw bytes of the value, 4 bytes or the content pointed by the offset
+}
+
+//Parse the TIFF structure starting at base offset of the given reader
+func readTiffExif(r io.ReaderAt, base int64, result *ImageExif) error {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, base); err != nil {
+		return err
+	}
+
+	tr := tiffReader{r: r, base: base}
+	if string(header[:2]) == "II" {
+		tr.order = binary.LittleEndian
+	} else if string(header[:2]) == "MM" {
+		tr.order = binary.BigEndian
+	} else {
+		return errors.New("Invalid TIFF header")
+	}
+
+	ifd0, err := tr.readIFD(int64(tr.order.Uint32(header[4:])))
+	if err != nil {
+		return err
+	}
+
+	if v, ok := ifd0[exifTagMake]; ok {
+		result.CameraMake = tr.asString(v)
+	}
+	if v, ok := ifd0[exifTagModel]; ok {
+		result.CameraModel = tr.asString(v)
+	}
+	if v, ok := ifd0[exifTagOrientation]; ok {
+		orientation := int(tr.asUint(v))
+		if orientation >= 1 && orientation <= 8 {
+			result.Orientation = orientation
+		}
+	}
+	if v, ok := ifd0[exifTagDateTime]; ok {
+		result.CaptureTime = parseExifTime(tr.asString(v))
+	}
+
+	//Exif Sub-IFD
+	if v, ok := ifd0[exifTagExifIFD]; ok {
+		exifIFD, err := tr.readIFD(int64(tr.asUint(v)))
+		if err == nil {
+			if v, ok := exifIFD[exifTagDateTimeOriginal]; ok {
+				captureTime := parseExifTime(tr.asString(v))
+				if captureTime > 0 {
+					result.CaptureTime = captureTime
+				}
+			}
+			if v, ok := exifIFD[exifTagPixelXDimension]; ok {
+				result.Width = int(tr.asUint(v))
+			}
+			if v, ok := exifIFD[exifTagPixelYDimension]; ok {
+				result.Height = int(tr.asUint(v))
+			}
+		}
+	}
+
+	//GPS Sub-IFD
+	if v, ok := ifd0[exifTagGPSIFD]; ok {
+		gpsIFD, err := tr.readIFD(int64(tr.asUint(v)))
+		if err == nil {
+			lat, latok := gpsIFD[exifTagGPSLatitude]
+			lng, lngok := gpsIFD[exifTagGPSLongitude]
+			if latok && lngok {
+				latitude := tr.asDegree(lat)
+				longitude := tr.asDegree(lng)
+				if ref, ok := gpsIFD[exifTagGPSLatitudeRef]; ok && strings.HasPrefix(tr.asString(ref), "S") {
+					latitude = -latitude
+				}
+				if ref, ok := gpsIFD[exifTagGPSLongitudeRef]; ok && strings.HasPrefix(tr.asString(ref), "W") {
+					longitude = -longitude
+				}
+
+				if !math.IsNaN(latitude) && !math.IsNaN(longitude) && !(latitude == 0 && longitude == 0) {
+					result.HasGPS = true
+					result.Latitude = latitude
+					result.Longitude = longitude
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+//Size in bytes of each TIFF data type
+var tiffTypeSize = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+//Read an IFD at the given offset (relative to the TIFF header)
+func (tr *tiffReader) readIFD(offset int64) (map[uint16]*tiffEntry, error) {
+	entries := map[uint16]*tiffEntry{}
+	countBytes := make([]byte, 2)
+	if _, err := tr.r.ReadAt(countBytes, tr.base+offset); err != nil {
+		return entries, err
+	}
+
+	entryCount := int(tr.order.Uint16(countBytes))
+	if entryCount > 1024 {
+		return entries, errors.New("Invalid IFD entry count")
+	}
+
+	raw := make([]byte, entryCount*12)
+	if _, err := tr.r.ReadAt(raw, tr.base+offset+2); err != nil {
+		return entries, err
+	}
+
+	for i := 0; i < entryCount; i++ {
+		thisEntry := raw[i*12 : i*12+12]
+		entry := tiffEntry{
+			tag:      tr.order.Uint16(thisEntry[0:2]),
+			datatype: tr.order.Uint16(thisEntry[2:4]),
+			count:    tr.order.Uint32(thisEntry[4:8]),
+		}
+
+		typeSize, ok := tiffTypeSize[entry.datatype]
+		if !ok {
+			continue
+		}
+
+		valueSize := typeSize * entry.count
+		if valueSize <= 4 {
+			entry.value = thisEntry[8 : 8+valueSize]
+		} else if valueSize < 64*1024 {
+			entry.value = make([]byte, valueSize)
+			valueOffset := int64(tr.order.Uint32(thisEntry[8:12]))
+			if _, err := tr.r.ReadAt(entry.value, tr.base+valueOffset); err != nil {
+				continue
+			}
+		} else {
+			//Value too large for the fields we are interested in
+			continue
+		}
+
+		entries[entry.tag] = &entry
+	}
+
+	return entries, nil
+}
+
+func (tr *tiffReader) asString(e *tiffEntry) string {
+	return strings.TrimSpace(strings.TrimRight(string(e.value), "\x00"))
+}
+
+func (tr *tiffReader) asUint(e *tiffEntry) uint32 {
+	switch e.datatype {
+	case 1, 7:
+		if len(e.value) >= 1 {
+			return uint32(e.value[0])
+		}
+	case 3:
+		if len(e.value) >= 2 {
+			return uint32(tr.order.Uint16(e.value))
+		}
+	case 4:
+		if len(e.value) >= 4 {
+			return tr.order.Uint32(e.value)
+		}
+	}
+	return 0
+}
+
+//Convert the 3 rationals of degree, minutes and seconds into decimal degree
+func (tr *tiffReader) asDegree(e *tiffEntry) float64 {
+	if e.datatype != 5 || len(e.value) < 24 {
+		return math.NaN()
+	}
+
+	values := []float64{}
+	for i := 0; i < 3; i++ {
+		numerator := float64(tr.order.Uint32(e.value[i*8 : i*8+4]))
+		denominator := float64(tr.order.Uint32(e.value[i*8+4 : i*8+8]))
+		if denominator == 0 {
+			values = append(values, 0)
+			continue
+		}
+		values = append(values, numerator/denominator)
+	}
+
+	return values[0] + values[1]/60 + values[2]/3600
+}
+
+//Parse EXIF date time format (2006:01:02 15:04:05) into unix timestamp
+func parseExifTime(datetime string) int64 {
+	t, err := time.ParseInLocation("2006:01:02 15:04:05", strings.TrimSpace(datetime), time.Local)
+	if err != nil {
+		return 0
+	}
+	return t.Unix()
+}
+
+/*
+	XMP Sidecar Reader
+
+	XMP sidecars are written by photo editing software next to RAW files.
+	Only the fields used by the photo index are extracted
+*/
+var (
+	xmpDateTimeOriginal = regexp.MustCompile(`exif:DateTimeOriginal(?:="|>)([^"<]+)`)
+	xmpMake             = regexp.MustCompile(`tiff:Make(?:="|>)([^"<]+)`)
+	xmpModel            = regexp.MustCompile(`tiff:Model(?:="|>)([^"<]+)`)
+	xmpOrientation      = regexp.MustCompile(`tiff:Orientation(?:="|>)([^"<]+)`)
+	xmpLatitude         = regexp.MustCompile(`exif:GPSLatitude(?:="|>)([^"<]+)`)
+	xmpLongitude        = regexp.MustCompile(`exif:GPSLongitude(?:="|>)([^"<]+)`)
+)
+
+//Get the sidecar path of the given image, return empty string if not exists
+func GetXmpSidecarPath(file string) string {
+	candidates := []string{
+		file + ".xmp",
+		file + ".XMP",
+		strings.TrimSuffix(file, filepath.Ext(file)) + ".xmp",
+		strings.TrimSuffix(file, filepath.Ext(file)) + ".XMP",
+	}
+
+	for _, candidate := range candidates {
+		if fileExists(candidate) {
+			return candidate
+		}
+	}
+
+	return ""
+}
+
+func readXmpSidecar(file string, result *ImageExif) error {
+	sidecar := GetXmpSidecarPath(file)
+	if sidecar == "" {
+		return errors.New("Sidecar not exists")
+	}
+
+	content, err := ioutil.ReadFile(sidecar)
+	if err != nil {
+		return err
+	}
+	xmp := string(content)
+
+	if m := xmpDateTimeOriginal.FindStringSubmatch(xmp); m != nil {
+		//XMP use ISO8601 date format
+		for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04:05.00", "2006-01-02T15:04"} {
+			t, err := time.ParseInLocation(layout, strings.TrimSpace(m[1]), time.Local)
+			if err == nil {
+				result.CaptureTime = t.Unix()
+				break
+			}
+		}
+	}
+	if m := xmpMake.FindStringSubmatch(xmp); m != nil {
+		result.CameraMake = strings.TrimSpace(m[1])
+	}
+	if m := xmpModel.FindStringSubmatch(xmp); m != nil {
+		result.CameraModel = strings.TrimSpace(m[1])
+	}
+	if m := xmpOrientation.FindStringSubmatch(xmp); m != nil {
+		orientation, err := strconv.Atoi(strings.TrimSpace(m[1]))
+		if err == nil && orientation >= 1 && orientation <= 8 {
+			result.Orientation = orientation
+		}
+	}
+
+	latMatch := xmpLatitude.FindStringSubmatch(xmp)
+	lngMatch := xmpLongitude.FindStringSubmatch(xmp)
+	if latMatch != nil && lngMatch != nil {
+		lat, laterr := parseXmpCoordinate(latMatch[1])
+		lng, lngerr := parseXmpCoordinate(lngMatch[1])
+		if laterr == nil && lngerr == nil {
+			result.HasGPS = true
+			result.Latitude = lat
+			result.Longitude = lng
+		}
+	}
+
+	return nil
+}
+
+//Parse XMP GPS coordinate in the format of "DDD,MM,SSk" or "DDD,MM.mmk"
+func parseXmpCoordinate(coordinate string) (float64, error) {
+	coordinate = strings.TrimSpace(coordinate)
+	if len(coordinate) < 2 {
+		return 0, errors.New("Invalid coordinate")
+	}
+
+	direction := strings.ToUpper(coordinate[len(coordinate)-1:])
+	parts := strings.Split(coordinate[:len(coordinate)-1], ",")
+	value := float64(0)
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return 0, err
+		}
+		value += v / math.Pow(60, float64(i))
+	}
+
+	if direction == "S" || direction == "W" {
+		value = -value
+	}
+	return value, nil
+}
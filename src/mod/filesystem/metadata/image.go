@@ -2,12 +2,15 @@ package metadata
 
 import (
 	"bytes"
+	"errors"
 	"image"
 	"image/jpeg"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
 
+	"github.com/disintegration/imaging"
 	"github.com/nfnt/resize"
 	"github.com/oliamb/cutter"
 )
@@ -23,6 +26,12 @@ func generateThumbnailForImage(cacheFolder string, file string, generateOnly boo
 		return "", err
 	}
 
+	//Rotate the image according to its EXIF orientation
+	exifInfo, err := ReadJpegExifFromBytes(imageBytes)
+	if err == nil {
+		img = applyExifOrientation(img, exifInfo.Orientation)
+	}
+
 	//Check boundary to decide resize mode
 	b := img.Bounds()
 	imgWidth := b.Max.X
@@ -60,3 +69,46 @@ func generateThumbnailForImage(cacheFolder string, file string, generateOnly boo
 		return "", nil
 	}
 }
+
+//Transform the image so it is displayed upright according to the EXIF orientation
+func applyExifOrientation(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	}
+	return img
+}
+
+//Render SVG into thumbnail using rsvg-convert if it is installed
+func generateThumbnailForSVG(cacheFolder string, file string, generateOnly bool) (string, error) {
+	if !pkg_exists("rsvg-convert") {
+		return "", errors.New("rsvg-convert not installed. Skipping SVG thumbnail")
+	}
+
+	outputFile := cacheFolder + filepath.Base(file) + ".png"
+	cmd := exec.Command("rsvg-convert", "-w", "480", "-h", "480", "--keep-aspect-ratio", "-o", outputFile, file)
+	_, err := cmd.CombinedOutput()
+	if err != nil {
+		os.Remove(outputFile)
+		return "", err
+	}
+
+	if !generateOnly {
+		//return the image as well
+		ctx, err := getImageAsBase64(outputFile)
+		return ctx, err
+	}
+	return "", nil
+}
@@ -154,6 +154,37 @@ func (rh *RenderHandler) LoadCache(file string, generateOnly bool) (string, erro
 		return img, err
 	}
 
+	if inArray([]string{".svg"}, strings.ToLower(filepath.Ext(file))) {
+		img, err := generateThumbnailForSVG(cacheFolder, file, generateOnly)
+		rh.renderingFiles.Delete(file)
+		return img, err
+	}
+
+	//Document renderers
+	if inArray(pdfFormats, strings.ToLower(filepath.Ext(file))) {
+		img, err := generateThumbnailForPDF(cacheFolder, file, generateOnly)
+		rh.renderingFiles.Delete(file)
+		return img, err
+	}
+
+	if inArray(officeFormats, strings.ToLower(filepath.Ext(file))) {
+		img, err := generateThumbnailForOffice(cacheFolder, file, generateOnly)
+		rh.renderingFiles.Delete(file)
+		return img, err
+	}
+
+	if inArray(textFormats, strings.ToLower(filepath.Ext(file))) {
+		img, err := generateThumbnailForText(cacheFolder, file, generateOnly)
+		rh.renderingFiles.Delete(file)
+		return img, err
+	}
+
+	if inArray(archiveFormats, strings.ToLower(filepath.Ext(file))) {
+		img, err := generateThumbnailForArchive(cacheFolder, file, generateOnly)
+		rh.renderingFiles.Delete(file)
+		return img, err
+	}
+
 	//Folder preview renderer
 	if isDir(file) && len(filepath.Base(file)) > 0 && filepath.Base(file)[:1] != "." {
 		img, err := generateThumbnailForFolder(cacheFolder, file, generateOnly)
@@ -0,0 +1,139 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nfnt/resize"
+	"imuslab.com/arozos/mod/filesystem"
+)
+
+/*
+	Rich Preview
+
+	Generate a multi-page preview of a file for the preview pane of
+	the file manager. Documents are rendered page by page while text
+	and archives return their content directly
+*/
+
+//Width of the rendered document pages in preview
+const previewPageWidth = 960
+
+type Preview struct {
+	Type       string   //pdf, document, text, archive or thumbnail
+	Pages      []string //Base64 encoded jpeg of each rendered page
+	TotalPages int      //Total number of pages in the document, 0 if unknown
+	Text       string   //Content snippet of text files
+	Entries    []string //File list of archives
+}
+
+//Generate the preview of the given file with at most maxPages pages rendered
+func (rh *RenderHandler) RenderPreview(file string, maxPages int) (*Preview, error) {
+	if !fileExists(file) {
+		return nil, errors.New("File not exists")
+	}
+
+	if maxPages <= 0 {
+		maxPages = 1
+	}
+
+	ext := strings.ToLower(filepath.Ext(file))
+	if inArray(pdfFormats, ext) {
+		return renderDocumentPreview("pdf", file, file, maxPages)
+	}
+
+	if inArray(officeFormats, ext) {
+		pdfFile, tmpFolder, err := convertOfficeToPdf(file)
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(tmpFolder)
+		return renderDocumentPreview("document", file, pdfFile, maxPages)
+	}
+
+	if inArray(textFormats, ext) {
+		content, err := readTextSnippet(file, textPreviewSize*4)
+		if err != nil {
+			return nil, err
+		}
+		return &Preview{
+			Type:    "text",
+			Pages:   []string{},
+			Text:    content,
+			Entries: []string{},
+		}, nil
+	}
+
+	if inArray(archiveFormats, ext) {
+		entries, err := filesystem.ViewZipFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return &Preview{
+			Type:    "archive",
+			Pages:   []string{},
+			Entries: entries,
+		}, nil
+	}
+
+	//Use the thumbnail for other file types
+	thumbnail, err := rh.LoadCache(file, false)
+	if err != nil {
+		return nil, err
+	}
+	return &Preview{
+		Type:       "thumbnail",
+		Pages:      []string{thumbnail},
+		TotalPages: 1,
+		Entries:    []string{},
+	}, nil
+}
+
+func renderDocumentPreview(previewType string, file string, pdfFile string, maxPages int) (*Preview, error) {
+	pages, tmpFolder, err := renderPdfPages(pdfFile, maxPages, previewPageWidth)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpFolder)
+
+	results := []string{}
+	for _, page := range pages {
+		img, err := loadImage(page)
+		if err != nil {
+			continue
+		}
+
+		//Ghostscript render by DPI instead of width. Scale it to the preview width
+		if img.Bounds().Dx() != previewPageWidth {
+			img = resize.Resize(previewPageWidth, 0, img, resize.Lanczos3)
+		}
+
+		buf := bytes.NewBuffer([]byte{})
+		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: 85})
+		if err != nil {
+			continue
+		}
+		results = append(results, base64.StdEncoding.EncodeToString(buf.Bytes()))
+	}
+
+	if len(results) == 0 {
+		return nil, errors.New("Unable to render " + filepath.Base(file))
+	}
+
+	totalPages := getPdfPageCount(pdfFile)
+	if totalPages == 0 {
+		totalPages = len(results)
+	}
+
+	return &Preview{
+		Type:       previewType,
+		Pages:      results,
+		TotalPages: totalPages,
+		Entries:    []string{},
+	}, nil
+}
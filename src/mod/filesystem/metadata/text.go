@@ -0,0 +1,121 @@
+package metadata
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/inconsolata"
+	"golang.org/x/image/math/fixed"
+)
+
+/*
+	Text Renderer
+
+	Render the first few lines of text and source code files into a
+	thumbnail using a built-in monospace font
+*/
+
+var textFormats = []string{".txt", ".md", ".log", ".csv", ".json", ".xml", ".yml", ".yaml", ".ini", ".conf", ".cfg",
+	".go", ".js", ".ts", ".agi", ".py", ".c", ".cpp", ".h", ".hpp", ".java", ".php", ".html", ".htm", ".css",
+	".sh", ".bat", ".ps1", ".sql", ".rs", ".rb", ".lua", ".kt", ".swift", ".vue"}
+
+//Maximum number of bytes to read from the text file for rendering
+const textPreviewSize = 16384
+
+func generateThumbnailForText(cacheFolder string, file string, generateOnly bool) (string, error) {
+	content, err := readTextSnippet(file, textPreviewSize)
+	if err != nil {
+		return "", err
+	}
+
+	outputFile := cacheFolder + filepath.Base(file) + ".jpg"
+	out, err := os.Create(outputFile)
+	if err != nil {
+		return "", err
+	}
+	jpeg.Encode(out, renderTextToImage(strings.Split(content, "\n"), 480, 480), &jpeg.Options{Quality: 90})
+	out.Close()
+
+	if !generateOnly {
+		//return the image as well
+		ctx, err := getImageAsBase64(outputFile)
+		return ctx, err
+	}
+	return "", nil
+}
+
+//Read the first maxBytes of a text file. Return error if the file looks like a binary file
+func readTextSnippet(file string, maxBytes int) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	buf := make([]byte, maxBytes)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	buf = buf[:n]
+
+	if bytes.IndexByte(buf, 0) >= 0 {
+		return "", errors.New("File is not a text file")
+	}
+
+	//Remove UTF-8 BOM and the incomplete rune at the end of the snippet
+	buf = bytes.TrimPrefix(buf, []byte("\ufeff"))
+	for i := 0; i < utf8.UTFMax-1 && len(buf) > 0 && !utf8.Valid(buf); i++ {
+		buf = buf[:len(buf)-1]
+	}
+
+	content := strings.ToValidUTF8(string(buf), "?")
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	return content, nil
+}
+
+//Draw the lines of text on a white canvas of the given size. Lines that do not fit are cropped
+func renderTextToImage(lines []string, width int, height int) image.Image {
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(canvas, canvas.Bounds(), &image.Uniform{color.White}, image.Point{}, draw.Src)
+
+	face := inconsolata.Regular8x16
+	margin := 12
+	lineHeight := face.Height
+	maxColumns := (width - margin*2) / face.Advance
+
+	drawer := font.Drawer{
+		Dst:  canvas,
+		Src:  &image.Uniform{color.RGBA{50, 50, 50, 255}},
+		Face: face,
+	}
+
+	y := margin + face.Ascent
+	for _, line := range lines {
+		if y > height-margin {
+			break
+		}
+
+		line = strings.ReplaceAll(line, "\t", "    ")
+		runes := []rune(line)
+		if len(runes) > maxColumns {
+			runes = runes[:maxColumns]
+		}
+
+		drawer.Dot = fixed.P(margin, y)
+		drawer.DrawString(string(runes))
+		y += lineHeight
+	}
+
+	return canvas
+}
@@ -29,6 +29,8 @@ type FileData struct {
 	ModTime     int64
 	IsShared    bool
 	Shortcut    *shortcut.ShortcutData //This will return nil or undefined if it is not a shortcut file
+	Tags        []string               //User defined tags of this file
+	IsFavourite bool                   //If this file is marked as favourite by the user
 }
 
 type TrashedFile struct {
@@ -4,8 +4,11 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"reflect"
+	"sync"
 
 	"imuslab.com/arozos/mod/database"
+	"imuslab.com/arozos/mod/event"
 )
 
 /*
@@ -19,7 +22,9 @@ import (
 
 type Manager struct {
 	RegisteredHandler []ProtocolHandler
+	EventBus          *event.EventBus //Event bus for publishing device status changes
 	cachedDeviceList  []*Device
+	lastStatus        sync.Map //Last known status of the devices, key is the device UUID
 	db                *database.Database
 }
 
@@ -152,7 +157,7 @@ func (m *Manager) HandleGetDeviceStatus(w http.ResponseWriter, r *http.Request)
 	for _, dev := range m.cachedDeviceList {
 		if dev.DeviceUUID == devid {
 			//Found. Get it status and return
-			status, err := dev.Handler.Status(dev)
+			status, err := m.GetDeviceStatus(dev)
 			if err != nil {
 				sendErrorResponse(w, err.Error())
 				return
@@ -189,6 +194,26 @@ func (m *Manager) HandleListing(w http.ResponseWriter, r *http.Request) {
 	sendJSONResponse(w, string(js))
 }
 
+//Get the status of the device and publish an event if it changed since the last check
+func (m *Manager) GetDeviceStatus(dev *Device) (map[string]interface{}, error) {
+	status, err := dev.Handler.Status(dev)
+	if err != nil {
+		return status, err
+	}
+
+	previousStatus, ok := m.lastStatus.Load(dev.DeviceUUID)
+	m.lastStatus.Store(dev.DeviceUUID, status)
+	if ok && !reflect.DeepEqual(previousStatus, status) {
+		m.EventBus.Publish(event.IoTStatusChanged, "", map[string]interface{}{
+			"device":         dev.DeviceUUID,
+			"name":           dev.Name,
+			"status":         status,
+			"previousStatus": previousStatus,
+		})
+	}
+	return status, nil
+}
+
 func (m *Manager) GetCachedDeviceList() []*Device {
 	if m.cachedDeviceList == nil {
 		m.ScanDevices()
@@ -0,0 +1,80 @@
+package modules
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	agi "imuslab.com/arozos/mod/agi"
+)
+
+/*
+	Module Capabilities
+
+	Allow admin to review and approve the capabilities declared
+	by the modules in their init.agi
+*/
+
+//Get the root folder of the module from its start dir, e.g. "Audio/index.html" => "Audio"
+func getModuleRoot(module ModuleInfo) string {
+	if module.StartDir == "" {
+		return ""
+	}
+	return strings.Split(filepath.ToSlash(module.StartDir), "/")[0]
+}
+
+/*
+	Handle the review and approval of module capabilities. Admin only
+	GET: module={name} => return the declared and approved capabilities of the module
+	GET: (no module) => return all the modules with capabilities pending for approval
+	POST: module={name}&opr={approve / revoke}
+*/
+func (m *ModuleHandler) HandleModuleCapabilities(w http.ResponseWriter, r *http.Request, gateway *agi.Gateway) {
+	moduleName, err := mv(r, "module", r.Method == http.MethodPost)
+	if err != nil {
+		if r.Method == http.MethodPost {
+			sendErrorResponse(w, "Invalid module name")
+			return
+		}
+
+		js, _ := json.Marshal(gateway.ListPendingModuleCapabilities())
+		sendJSONResponse(w, string(js))
+		return
+	}
+
+	//Resolve the module root folder from the module name
+	moduleRoot := ""
+	for _, mod := range m.LoadedModule {
+		if mod.Name == moduleName {
+			moduleRoot = getModuleRoot(mod)
+			break
+		}
+	}
+	if moduleRoot == "" {
+		//Maybe the module root folder is given directly
+		moduleRoot = filepath.Base(moduleName)
+	}
+
+	if r.Method != http.MethodPost {
+		js, _ := json.Marshal(gateway.GetModuleCapabilities(moduleRoot))
+		sendJSONResponse(w, string(js))
+		return
+	}
+
+	opr, _ := mv(r, "opr", true)
+	if opr == "approve" {
+		err = gateway.ApproveModuleCapabilities(moduleRoot)
+	} else if opr == "revoke" {
+		err = gateway.RevokeModuleCapabilities(moduleRoot)
+	} else {
+		sendErrorResponse(w, "Unknown operation")
+		return
+	}
+
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+	sendOK(w)
+}
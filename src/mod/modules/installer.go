@@ -3,7 +3,6 @@ package modules
 import (
 	"encoding/json"
 	"errors"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -33,14 +32,16 @@ func (m *ModuleHandler) InstallViaZip(realpath string, gateway *agi.Gateway) err
 		return errors.New("*Module Installer* Installer file not found. Given: " + realpath)
 	}
 
-	//Install it
-	unzipTmpFolder := "./tmp/installer/" + strconv.Itoa(int(time.Now().Unix()))
-	err := fs.Unzip(realpath, unzipTmpFolder)
+	//Extract it
+	unzipTmpFolder := filepath.Join(m.tmpDirectory, "installer", strconv.Itoa(int(time.Now().Unix())))
+	os.MkdirAll(unzipTmpFolder, 0755)
+	defer os.RemoveAll(unzipTmpFolder)
+	err := fs.ArozExtractArchiveWithProgress(realpath, unzipTmpFolder, func(filename string, current int, total int, progress float64) {})
 	if err != nil {
 		return err
 	}
 
-	//Move the module(s) to the web root
+	//Install the module(s) found in the package
 	files, _ := filepath.Glob(unzipTmpFolder + "/*")
 	folders := []string{}
 	for _, file := range files {
@@ -50,22 +51,19 @@ func (m *ModuleHandler) InstallViaZip(realpath string, gateway *agi.Gateway) err
 		}
 	}
 
+	if len(folders) == 0 {
+		return errors.New("No module found in the installer file")
+	}
+
 	for _, folder := range folders {
-		//Copy the module
-		err = fs.CopyDir(folder, "./web/"+filepath.Base(folder))
+		_, err = m.InstallPackage(folder, gateway, InstallOption{
+			Source: filepath.Base(realpath),
+		})
 		if err != nil {
-			log.Println(err)
-			continue
+			return err
 		}
-
-		//Activate the module
-		m.ActivateModuleByRoot("./web/"+filepath.Base(folder), gateway)
-		m.ModuleSortList()
 	}
 
-	//Remove the tmp folder
-	os.RemoveAll(unzipTmpFolder)
-
 	//OK
 	return nil
 }
@@ -101,26 +99,26 @@ func (m *ModuleHandler) InstallModuleViaGit(gitURL string, gateway *agi.Gateway)
 		}
 	}
 
-	//Do the copying
+	//Clean up the download folder
+	defer os.RemoveAll(downloadFolder)
+
+	//Install module folders as packages and copy the others to web root
 	for _, src := range copyPendingList {
-		log.Println(src)
+		if fileExists(filepath.Join(src, "init.agi")) {
+			_, err = m.InstallPackage(src, gateway, InstallOption{
+				Source: gitURL,
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
 		fs.FileCopy(src, "./web/", "skip", func(progress int, filename string) {
 			log.Println("Copying ", filename)
 		})
 	}
 
-	//Clean up the download folder
-	os.RemoveAll(downloadFolder)
-
-	//Add the newly installed module to module list
-	for _, moduleFolder := range copyPendingList {
-		//This module folder has been moved to web successfully.
-		m.ActivateModuleByRoot(moduleFolder, gateway)
-	}
-
-	//Sort the module lsit
-	m.ModuleSortList()
-
 	return nil
 }
 
@@ -129,16 +127,9 @@ func (m *ModuleHandler) ActivateModuleByRoot(moduleFolder string, gateway *agi.G
 	thisModuleEstimataedRoot := filepath.Join("./web/", filepath.Base(moduleFolder))
 	if fileExists(thisModuleEstimataedRoot) {
 		if fileExists(filepath.Join(thisModuleEstimataedRoot, "init.agi")) {
-			//Load this as an module
-			startDef, err := ioutil.ReadFile(filepath.Join(thisModuleEstimataedRoot, "init.agi"))
-			if err != nil {
-				log.Println("*Module Activator* Failed to read init.agi from " + filepath.Base(moduleFolder))
-				return errors.New("Failed to read init.agi from " + filepath.Base(moduleFolder))
-			}
-
 			//Execute the init script using AGI
 			log.Println("Starting module: ", filepath.Base(moduleFolder))
-			err = gateway.RunScript(string(startDef))
+			err := gateway.RunModuleInitScript(filepath.Join(thisModuleEstimataedRoot, "init.agi"))
 			if err != nil {
 				log.Println("*Module Activator* " + filepath.Base(moduleFolder) + " Starting failed" + err.Error())
 				return errors.New(filepath.Base(moduleFolder) + " Starting failed: " + err.Error())
@@ -152,7 +143,7 @@ func (m *ModuleHandler) ActivateModuleByRoot(moduleFolder string, gateway *agi.G
 }
 
 //Handle and return the information of the current installed modules
-func (m *ModuleHandler) HandleModuleInstallationListing(w http.ResponseWriter, r *http.Request) {
+func (m *ModuleHandler) HandleModuleInstallationListing(w http.ResponseWriter, r *http.Request, gateway *agi.Gateway) {
 	type ModuleInstallInfo struct {
 		Name          string //Name of the module
 		Desc          string //Description of module
@@ -162,6 +153,9 @@ func (m *ModuleHandler) HandleModuleInstallationListing(w http.ResponseWriter, r
 		InstallDate   string //The last editing date of the module file
 		DiskSpace     int64  //Disk space used
 		Uninstallable bool   //Indicate if this can be uninstall or disabled
+
+		CapabilitiesPending bool //Indicate if the module declared capabilities that are not yet approved
+		RollbackAvailable   bool //Indicate if a previous version of the module can be restored
 	}
 
 	results := []ModuleInstallInfo{}
@@ -197,6 +191,8 @@ func (m *ModuleHandler) HandleModuleInstallationListing(w http.ResponseWriter, r
 					t.Format("2006-01-02"),
 					totalsize,
 					canUninstall,
+					gateway.GetModuleCapabilities(getModuleRoot(mod)).Pending,
+					fileExists(filepath.Join(moduleRollbackFolder, getModuleRoot(mod), "init.agi")),
 				})
 			} else {
 				//Subservice
@@ -216,8 +212,32 @@ func (m *ModuleHandler) InstallModuleFromZip(vpath string, u *user.User) error {
 	return nil
 }
 
+//Export the data of the module into the module data backup folder, then remove it from the system
+func (m *ModuleHandler) removeModuleData(moduleRoot string, gateway *agi.Gateway) error {
+	if !gateway.ModuleHasData(moduleRoot) {
+		return nil
+	}
+
+	os.MkdirAll(moduleDataBackupFolder, 0755)
+	backupFile := filepath.Join(moduleDataBackupFolder, moduleRoot+"-"+strconv.FormatInt(time.Now().Unix(), 10)+".json")
+	f, err := os.Create(backupFile)
+	if err != nil {
+		return err
+	}
+
+	err = gateway.ExportModuleData(moduleRoot, f)
+	f.Close()
+	if err != nil {
+		os.Remove(backupFile)
+		return err
+	}
+
+	log.Println("*Module Installer* Data of " + moduleRoot + " exported to " + backupFile)
+	return gateway.RemoveModuleData(moduleRoot, "")
+}
+
 //Uninstall the given module
-func (m *ModuleHandler) UninstallModule(moduleName string) error {
+func (m *ModuleHandler) UninstallModule(moduleName string, gateway *agi.Gateway) error {
 	//Check if this module is allowed to be removed
 	var targetModuleInfo ModuleInfo
 	for _, mod := range m.LoadedModule {
@@ -248,6 +268,21 @@ func (m *ModuleHandler) UninstallModule(moduleName string) error {
 
 		m.LoadedModule = newLoadedModuleList
 
+		//Remove the capability records and event handlers of the module
+		if getModuleRoot(targetModuleInfo) != "" {
+			gateway.RemoveModuleCapabilities(getModuleRoot(targetModuleInfo))
+			gateway.RemoveModuleEventHandlers(getModuleRoot(targetModuleInfo))
+		}
+
+		//Export the stored data of the module for backup and remove it
+		err := m.removeModuleData(filepath.Base(moduleName), gateway)
+		if err != nil {
+			log.Println("*Module Installer* Unable to remove data of " + moduleName + ": " + err.Error())
+		}
+
+		//Remove the package record and the previous version kept for rollback
+		m.removePackage(moduleName)
+
 	} else {
 		return errors.New("Module not exists")
 	}
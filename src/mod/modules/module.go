@@ -6,6 +6,7 @@ import (
 	"sort"
 	"strings"
 
+	agi "imuslab.com/arozos/mod/agi"
 	user "imuslab.com/arozos/mod/user"
 )
 
@@ -23,24 +24,35 @@ type ModuleInfo struct {
 	InitFWSize   []int    //Floatwindow init size. [0] => Width, [1] => Height
 	InitEmbSize  []int    //Embedded mode init size. [0] => Width, [1] => Height
 	SupportedExt []string //Supported File Extensions. e.g. ".mp3", ".flac", ".wav"
+
+	Capabilities *agi.Capabilities //Capabilities required by this module, require admin approval before use
 }
 
 type ModuleHandler struct {
-	LoadedModule []ModuleInfo
-	userHandler  *user.UserHandler
-	tmpDirectory string
+	LoadedModule  []ModuleInfo
+	userHandler   *user.UserHandler
+	tmpDirectory  string
+	systemVersion string //ArozOS internal version for checking module compatibility
 }
 
-func NewModuleHandler(userHandler *user.UserHandler, tmpFolderPath string) *ModuleHandler {
+func NewModuleHandler(userHandler *user.UserHandler, tmpFolderPath string, systemVersion string) *ModuleHandler {
 	return &ModuleHandler{
-		LoadedModule: []ModuleInfo{},
-		userHandler:  userHandler,
-		tmpDirectory: tmpFolderPath,
+		LoadedModule:  []ModuleInfo{},
+		userHandler:   userHandler,
+		tmpDirectory:  tmpFolderPath,
+		systemVersion: systemVersion,
 	}
 }
 
 //Register endpoint. Provide moduleInfo datastructure or unparsed json
 func (m *ModuleHandler) RegisterModule(module ModuleInfo) {
+	//Replace the previous registration of the same module, e.g. after an upgrade
+	for i, thisModule := range m.LoadedModule {
+		if thisModule.Name == module.Name {
+			m.LoadedModule[i] = module
+			return
+		}
+	}
 	m.LoadedModule = append(m.LoadedModule, module)
 }
 
@@ -0,0 +1,636 @@
+package modules
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	agi "imuslab.com/arozos/mod/agi"
+	fs "imuslab.com/arozos/mod/filesystem"
+)
+
+/*
+	Module Package Manager
+
+	A module package is a module folder containing init.agi and an optional
+	module.json manifest, for example
+
+	{
+		"name": "MyModule",              //Must match the module folder name
+		"version": "1.2.0",              //Semantic version of the module
+		"arozos": ">=0.1.115",           //Required ArozOS internal version
+		"dependencies": {
+			"modules": {"Music": ">=0.1.0"},
+			"libs": ["filelib", "imagelib"]
+		}
+	}
+
+	A package can be signed by putting a base64 encoded ed25519 signature of the
+	package digest in module.sig. The package digest is the SHA256 of the lines
+	"{sha256 of file in hex} {path relative to module folder}\n" of all files
+	except module.sig, sorted by path. Signatures are verified against the
+	keys trusted by the admin.
+
+	Upgrades are atomic. The previous version is kept in the rollback folder
+	and restored automatically if the new version failed to start.
+*/
+
+const (
+	moduleStagingFolder    = "./system/modules/staging"
+	moduleRollbackFolder   = "./system/modules/rollback"
+	moduleDataBackupFolder = "./system/modules/data" //Data exported from uninstalled modules
+	manifestFilename       = "module.json"
+	signatureFilename      = "module.sig"
+)
+
+type ModuleDependencies struct {
+	Modules map[string]string `json:"modules"` //Required modules, module name => version constraint
+	Libs    []string          `json:"libs"`    //Required AGI libraries
+}
+
+type ModuleManifest struct {
+	Name         string              `json:"name"`
+	Version      string              `json:"version"`
+	Desc         string              `json:"desc,omitempty"`
+	Arozos       string              `json:"arozos,omitempty"` //Required ArozOS version constraint
+	Dependencies *ModuleDependencies `json:"dependencies,omitempty"`
+}
+
+type ModulePackage struct {
+	Manifest      ModuleManifest
+	Previous      *ModuleManifest //Manifest of the version that can be restored by rollback
+	Source        string          //Where this package is installed from, e.g. git URL, zip file or repository
+	Signer        string          //Name of the trusted key that signed this package, empty if unsigned
+	InstalledTime int64
+}
+
+type InstallOption struct {
+	Source string //Where the package come from
+	Force  bool   //Allow reinstalling the same version or downgrading
+}
+
+//Load the manifest of the module package. Modules without manifest use the folder name and no version
+func loadManifest(moduleFolder string) (*ModuleManifest, error) {
+	manifest := ModuleManifest{}
+	manifestFile := filepath.Join(moduleFolder, manifestFilename)
+	if fileExists(manifestFile) {
+		content, err := ioutil.ReadFile(manifestFile)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal(content, &manifest)
+		if err != nil {
+			return nil, errors.New("Invalid " + manifestFilename + ": " + err.Error())
+		}
+	}
+
+	folderName := filepath.Base(moduleFolder)
+	if manifest.Name == "" {
+		manifest.Name = folderName
+	} else if manifest.Name != folderName {
+		return nil, errors.New("Module name " + manifest.Name + " does not match its folder name " + folderName)
+	}
+
+	if manifest.Version != "" {
+		if _, err := parseVersion(manifest.Version); err != nil {
+			return nil, err
+		}
+	}
+
+	return &manifest, nil
+}
+
+//Calculate the digest of a module package for signing
+func GetPackageDigest(moduleFolder string) ([]byte, error) {
+	files := []string{}
+	err := filepath.Walk(moduleFolder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(moduleFolder, path)
+		if err != nil {
+			return err
+		}
+		relativePath = filepath.ToSlash(relativePath)
+		if relativePath != signatureFilename {
+			files = append(files, relativePath)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	digest := sha256.New()
+	for _, relativePath := range files {
+		f, err := os.Open(filepath.Join(moduleFolder, relativePath))
+		if err != nil {
+			return nil, err
+		}
+
+		fileHash := sha256.New()
+		_, err = io.Copy(fileHash, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		digest.Write([]byte(hex.EncodeToString(fileHash.Sum(nil)) + " " + relativePath + "\n"))
+	}
+
+	return digest.Sum(nil), nil
+}
+
+//Sign the module package with the given private key and write the signature to module.sig
+func SignPackage(moduleFolder string, privateKey ed25519.PrivateKey) error {
+	digest, err := GetPackageDigest(moduleFolder)
+	if err != nil {
+		return err
+	}
+
+	signature := ed25519.Sign(privateKey, digest)
+	return ioutil.WriteFile(filepath.Join(moduleFolder, signatureFilename), []byte(base64.StdEncoding.EncodeToString(signature)), 0755)
+}
+
+//Verify the signature of the package. Return the name of the trusted key that signed it, or empty string if not signed
+func (m *ModuleHandler) verifySignature(moduleFolder string) (string, error) {
+	signatureFile := filepath.Join(moduleFolder, signatureFilename)
+	if !fileExists(signatureFile) {
+		if m.IsSignatureRequired() {
+			return "", errors.New("Module package is not signed")
+		}
+		return "", nil
+	}
+
+	content, err := ioutil.ReadFile(signatureFile)
+	if err != nil {
+		return "", err
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return "", errors.New("Invalid module signature")
+	}
+
+	digest, err := GetPackageDigest(moduleFolder)
+	if err != nil {
+		return "", err
+	}
+
+	for name, publicKey := range m.ListTrustedKeys() {
+		key, err := base64.StdEncoding.DecodeString(publicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			continue
+		}
+
+		if ed25519.Verify(ed25519.PublicKey(key), digest, signature) {
+			return name, nil
+		}
+	}
+
+	return "", errors.New("Module signature is not signed by any trusted key")
+}
+
+//Get the installed version of the module, empty if the module has no version or not installed
+func (m *ModuleHandler) GetInstalledVersion(moduleRoot string) string {
+	if record, err := m.GetPackage(moduleRoot); err == nil && record.Manifest.Version != "" {
+		return record.Manifest.Version
+	}
+
+	for _, mod := range m.LoadedModule {
+		if getModuleRoot(mod) == moduleRoot || mod.Name == moduleRoot {
+			return mod.Version
+		}
+	}
+	return ""
+}
+
+//Check if the module is installed, either as a package or a loaded module
+func (m *ModuleHandler) isModuleInstalled(moduleRoot string) bool {
+	if fileExists(filepath.Join("./web", moduleRoot, "init.agi")) {
+		return true
+	}
+
+	for _, mod := range m.LoadedModule {
+		if getModuleRoot(mod) == moduleRoot || mod.Name == moduleRoot {
+			return true
+		}
+	}
+	return false
+}
+
+//Check if the system version and dependencies required by the manifest are satisfied
+func (m *ModuleHandler) checkRequirements(manifest *ModuleManifest, gateway *agi.Gateway) error {
+	if manifest.Arozos != "" && m.systemVersion != "" {
+		ok, err := VersionSatisfies(m.systemVersion, manifest.Arozos)
+		if err != nil {
+			return errors.New("Invalid ArozOS version requirement: " + err.Error())
+		}
+		if !ok {
+			return errors.New(manifest.Name + " requires ArozOS " + manifest.Arozos + " but this system is " + m.systemVersion)
+		}
+	}
+
+	if manifest.Dependencies == nil {
+		return nil
+	}
+
+	for moduleName, constraint := range manifest.Dependencies.Modules {
+		if !m.isModuleInstalled(moduleName) {
+			return errors.New(manifest.Name + " requires module " + moduleName + " which is not installed")
+		}
+
+		if constraint == "" || constraint == "*" {
+			continue
+		}
+
+		installedVersion := m.GetInstalledVersion(moduleName)
+		ok, err := VersionSatisfies(installedVersion, constraint)
+		if err != nil || !ok {
+			return errors.New(manifest.Name + " requires module " + moduleName + " " + constraint + " but installed version is " + installedVersion)
+		}
+	}
+
+	for _, libname := range manifest.Dependencies.Libs {
+		if _, ok := gateway.LoadedAGILibrary[libname]; !ok {
+			return errors.New(manifest.Name + " requires AGI library " + libname + " which is not available")
+		}
+	}
+
+	return nil
+}
+
+//Move a folder, fallback to copy if the folder cannot be renamed, e.g. across disks
+func moveFolder(src string, dest string) error {
+	os.MkdirAll(filepath.Dir(dest), 0755)
+	err := os.Rename(src, dest)
+	if err == nil {
+		return nil
+	}
+
+	os.MkdirAll(dest, 0755)
+	err = fs.CopyDir(src, dest)
+	if err != nil {
+		os.RemoveAll(dest)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+//Remove the module from the loaded module list and its event handlers before it is reloaded
+func (m *ModuleHandler) unloadModule(moduleRoot string, gateway *agi.Gateway) {
+	newLoadedModuleList := []ModuleInfo{}
+	for _, thisModule := range m.LoadedModule {
+		if getModuleRoot(thisModule) != moduleRoot {
+			newLoadedModuleList = append(newLoadedModuleList, thisModule)
+		}
+	}
+	m.LoadedModule = newLoadedModuleList
+	gateway.RemoveModuleEventHandlers(moduleRoot)
+}
+
+//Swap the module in web root with the given folder. The current version is moved to the rollback folder and restored if the new version failed to start
+func (m *ModuleHandler) swapModule(moduleRoot string, newFolder string, gateway *agi.Gateway) error {
+	target := filepath.Join("./web", moduleRoot)
+	backup := filepath.Join(moduleRollbackFolder, moduleRoot)
+	hasPrevious := fileExists(target)
+
+	//Keep the older backup until the new version started, so a failed install does not lose the rollback point
+	olderBackup := ""
+	if hasPrevious && fileExists(backup) {
+		olderBackup = filepath.Join(moduleStagingFolder, moduleRoot+"-backup-"+uuid.NewV4().String())
+		if err := moveFolder(backup, olderBackup); err != nil {
+			return errors.New("Unable to move the previous backup: " + err.Error())
+		}
+	}
+
+	if hasPrevious {
+		err := moveFolder(target, backup)
+		if err != nil {
+			if olderBackup != "" {
+				moveFolder(olderBackup, backup)
+			}
+			return errors.New("Unable to backup the current version: " + err.Error())
+		}
+	}
+
+	err := moveFolder(newFolder, target)
+	if err == nil {
+		m.unloadModule(moduleRoot, gateway)
+		err = m.ActivateModuleByRoot(target, gateway)
+		m.ModuleSortList()
+		if err == nil {
+			if olderBackup != "" {
+				os.RemoveAll(olderBackup)
+			}
+			return nil
+		}
+	}
+
+	//Failed to install the new version. Restore the previous version
+	log.Println("*Module Installer* " + moduleRoot + " failed to start. Rolling back")
+	os.RemoveAll(target)
+	m.unloadModule(moduleRoot, gateway)
+	if hasPrevious {
+		if restoreErr := moveFolder(backup, target); restoreErr != nil {
+			return errors.New("Install failed (" + err.Error() + ") and rollback failed: " + restoreErr.Error())
+		}
+		if olderBackup != "" {
+			moveFolder(olderBackup, backup)
+		}
+		m.ActivateModuleByRoot(target, gateway)
+		m.ModuleSortList()
+	}
+	return errors.New("Install failed and rolled back: " + err.Error())
+}
+
+//Verify and install the module package in the given folder
+func (m *ModuleHandler) InstallPackage(packageFolder string, gateway *agi.Gateway, option InstallOption) (*ModulePackage, error) {
+	if !fileExists(filepath.Join(packageFolder, "init.agi")) {
+		return nil, errors.New("init.agi not found in module package")
+	}
+
+	manifest, err := loadManifest(packageFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := m.verifySignature(packageFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.checkRequirements(manifest, gateway)
+	if err != nil {
+		return nil, err
+	}
+
+	//Check if this is an upgrade
+	installedVersion := m.GetInstalledVersion(manifest.Name)
+	if m.isModuleInstalled(manifest.Name) && installedVersion != "" && manifest.Version != "" && !option.Force {
+		result, err := CompareVersion(manifest.Version, installedVersion)
+		if err == nil && result <= 0 {
+			return nil, errors.New(manifest.Name + " " + installedVersion + " is already installed")
+		}
+	}
+
+	//Copy the package next to the web root so the swap is a rename
+	stagingFolder := filepath.Join(moduleStagingFolder, manifest.Name+"-"+uuid.NewV4().String())
+	os.MkdirAll(stagingFolder, 0755)
+	err = fs.CopyDir(packageFolder, stagingFolder)
+	if err != nil {
+		os.RemoveAll(stagingFolder)
+		return nil, err
+	}
+
+	var previous *ModuleManifest
+	if m.isModuleInstalled(manifest.Name) {
+		previous, _ = loadManifest(filepath.Join("./web", manifest.Name))
+		if previous != nil && previous.Version == "" {
+			previous.Version = installedVersion
+		}
+	}
+
+	err = m.swapModule(manifest.Name, stagingFolder, gateway)
+	os.RemoveAll(stagingFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	record := ModulePackage{
+		Manifest:      *manifest,
+		Previous:      previous,
+		Source:        option.Source,
+		Signer:        signer,
+		InstalledTime: time.Now().Unix(),
+	}
+	m.userHandler.GetDatabase().Write("module-packages", manifest.Name, record)
+	log.Println("*Module Installer* Installed " + manifest.Name + " " + manifest.Version)
+	return &record, nil
+}
+
+//Restore the previous version of the module
+func (m *ModuleHandler) RollbackModule(moduleRoot string, gateway *agi.Gateway) error {
+	moduleRoot = filepath.Base(moduleRoot)
+	backup := filepath.Join(moduleRollbackFolder, moduleRoot)
+	if !fileExists(filepath.Join(backup, "init.agi")) {
+		return errors.New("No previous version of " + moduleRoot + " to rollback to")
+	}
+
+	record, err := m.GetPackage(moduleRoot)
+	if err != nil {
+		return err
+	}
+
+	//Move the backup aside so the current version can take its place
+	restoreFolder := filepath.Join(moduleStagingFolder, moduleRoot+"-"+uuid.NewV4().String())
+	err = moveFolder(backup, restoreFolder)
+	if err != nil {
+		return err
+	}
+
+	err = m.swapModule(moduleRoot, restoreFolder, gateway)
+	os.RemoveAll(restoreFolder)
+	if err != nil {
+		return err
+	}
+
+	//The rolled back version can be restored again by another rollback
+	current := record.Manifest
+	if record.Previous != nil {
+		record.Manifest = *record.Previous
+	} else {
+		record.Manifest = ModuleManifest{Name: moduleRoot}
+	}
+	record.Previous = &current
+	record.InstalledTime = time.Now().Unix()
+	return m.userHandler.GetDatabase().Write("module-packages", moduleRoot, record)
+}
+
+//Get the package record of an installed module
+func (m *ModuleHandler) GetPackage(moduleRoot string) (*ModulePackage, error) {
+	sysdb := m.userHandler.GetDatabase()
+	if !sysdb.KeyExists("module-packages", moduleRoot) {
+		return nil, errors.New("Package record not found")
+	}
+
+	record := ModulePackage{}
+	err := sysdb.Read("module-packages", moduleRoot, &record)
+	return &record, err
+}
+
+//Remove the package record and rollback backup of an uninstalled module
+func (m *ModuleHandler) removePackage(moduleRoot string) {
+	m.userHandler.GetDatabase().Delete("module-packages", moduleRoot)
+	os.RemoveAll(filepath.Join(moduleRollbackFolder, filepath.Base(moduleRoot)))
+}
+
+//List the public keys trusted for module signatures, name => base64 ed25519 public key
+func (m *ModuleHandler) ListTrustedKeys() map[string]string {
+	results := map[string]string{}
+	entries, err := m.userHandler.GetDatabase().ListTable("module-trustedkeys")
+	if err != nil {
+		return results
+	}
+
+	for _, entry := range entries {
+		publicKey := ""
+		json.Unmarshal(entry[1], &publicKey)
+		results[string(entry[0])] = publicKey
+	}
+	return results
+}
+
+func (m *ModuleHandler) AddTrustedKey(name string, publicKey string) error {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(publicKey))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("Invalid ed25519 public key")
+	}
+	return m.userHandler.GetDatabase().Write("module-trustedkeys", name, base64.StdEncoding.EncodeToString(key))
+}
+
+func (m *ModuleHandler) RemoveTrustedKey(name string) error {
+	return m.userHandler.GetDatabase().Delete("module-trustedkeys", name)
+}
+
+//Check if only signed module packages can be installed
+func (m *ModuleHandler) IsSignatureRequired() bool {
+	required := false
+	m.userHandler.GetDatabase().Read("module", "settings/requireSignature", &required)
+	return required
+}
+
+func (m *ModuleHandler) SetSignatureRequired(required bool) error {
+	return m.userHandler.GetDatabase().Write("module", "settings/requireSignature", required)
+}
+
+//Resolve the module root folder from the module name
+func (m *ModuleHandler) resolveModuleRoot(moduleName string) string {
+	for _, mod := range m.LoadedModule {
+		if mod.Name == moduleName && getModuleRoot(mod) != "" {
+			return getModuleRoot(mod)
+		}
+	}
+	return filepath.Base(moduleName)
+}
+
+/*
+	Handle the package management of installed modules. Admin only
+	GET: (no module) => return the package records of all installed modules
+	GET: module={name} => return the package record of the module
+	POST: opr=rollback&module={name} => restore the previous version of the module
+*/
+func (m *ModuleHandler) HandleModulePackages(w http.ResponseWriter, r *http.Request, gateway *agi.Gateway) {
+	opr, _ := mv(r, "opr", true)
+	moduleName, _ := mv(r, "module", r.Method == http.MethodPost)
+
+	if r.Method != http.MethodPost {
+		if moduleName != "" {
+			record, err := m.GetPackage(m.resolveModuleRoot(moduleName))
+			if err != nil {
+				sendErrorResponse(w, err.Error())
+				return
+			}
+			js, _ := json.Marshal(record)
+			sendJSONResponse(w, string(js))
+			return
+		}
+
+		results := []ModulePackage{}
+		entries, _ := m.userHandler.GetDatabase().ListTable("module-packages")
+		for _, entry := range entries {
+			record := ModulePackage{}
+			if json.Unmarshal(entry[1], &record) == nil {
+				results = append(results, record)
+			}
+		}
+		js, _ := json.Marshal(results)
+		sendJSONResponse(w, string(js))
+		return
+	}
+
+	if moduleName == "" {
+		sendErrorResponse(w, "Invalid module name")
+		return
+	}
+
+	if opr == "rollback" {
+		err := m.RollbackModule(m.resolveModuleRoot(moduleName), gateway)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+		sendOK(w)
+	} else {
+		sendErrorResponse(w, "Unknown operation")
+	}
+}
+
+/*
+	Handle the trusted keys for module signature verification. Admin only
+	GET: return the trusted keys and if signature is required
+	POST: opr=add&name={name}&key={base64 ed25519 public key}
+	POST: opr=remove&name={name}
+	POST: opr=require&value={true / false}
+*/
+func (m *ModuleHandler) HandleTrustedKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		js, _ := json.Marshal(struct {
+			Keys             map[string]string
+			RequireSignature bool
+		}{
+			m.ListTrustedKeys(),
+			m.IsSignatureRequired(),
+		})
+		sendJSONResponse(w, string(js))
+		return
+	}
+
+	opr, _ := mv(r, "opr", true)
+	var err error
+	if opr == "add" || opr == "remove" {
+		name, _ := mv(r, "name", true)
+		if name == "" {
+			sendErrorResponse(w, "Invalid key name")
+			return
+		}
+
+		if opr == "add" {
+			key, _ := mv(r, "key", true)
+			err = m.AddTrustedKey(name, key)
+		} else {
+			err = m.RemoveTrustedKey(name)
+		}
+	} else if opr == "require" {
+		value, _ := mv(r, "value", true)
+		err = m.SetSignatureRequired(value == "true")
+	} else {
+		sendErrorResponse(w, "Unknown operation")
+		return
+	}
+
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+	sendOK(w)
+}
@@ -0,0 +1,440 @@
+package modules
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	agi "imuslab.com/arozos/mod/agi"
+	fs "imuslab.com/arozos/mod/filesystem"
+)
+
+/*
+	Module Repository
+
+	A repository is an index.json served over http(s) or stored in a local folder
+
+	{
+		"name": "My Repository",
+		"modules": [
+			{
+				"name": "MyModule",
+				"version": "1.2.0",
+				"desc": "An example module",
+				"arozos": ">=0.1.115",
+				"dependencies": {"libs": ["filelib"]},
+				"url": "packages/MyModule-1.2.0.zip",    //Relative to the index or absolute URL
+				"sha256": "..."                           //SHA256 of the package file
+			}
+		]
+	}
+*/
+
+type RepositoryModule struct {
+	Name         string              `json:"name"`
+	Version      string              `json:"version"`
+	Desc         string              `json:"desc"`
+	Arozos       string              `json:"arozos,omitempty"`
+	Dependencies *ModuleDependencies `json:"dependencies,omitempty"`
+	URL          string              `json:"url"`
+	Sha256       string              `json:"sha256"`
+}
+
+type RepositoryIndex struct {
+	Name    string             `json:"name"`
+	Modules []RepositoryModule `json:"modules"`
+}
+
+type CatalogueEntry struct {
+	RepositoryModule
+	Repository       string //Name of the repository providing this module
+	InstalledVersion string //Empty if not installed
+	Installed        bool
+	UpdateAvailable  bool
+}
+
+const repositoryTimeout = 30 * time.Second
+
+//List the module repositories, name => URL or local folder
+func (m *ModuleHandler) ListRepositories() map[string]string {
+	results := map[string]string{}
+	entries, err := m.userHandler.GetDatabase().ListTable("module-repos")
+	if err != nil {
+		return results
+	}
+
+	for _, entry := range entries {
+		location := ""
+		json.Unmarshal(entry[1], &location)
+		results[string(entry[0])] = location
+	}
+	return results
+}
+
+func (m *ModuleHandler) AddRepository(name string, location string) error {
+	if name == "" || location == "" {
+		return errors.New("Repository name and location cannot be empty")
+	}
+	return m.userHandler.GetDatabase().Write("module-repos", name, location)
+}
+
+func (m *ModuleHandler) RemoveRepository(name string) error {
+	return m.userHandler.GetDatabase().Delete("module-repos", name)
+}
+
+func isRemoteLocation(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+//Get the location of the index file of a repository
+func getIndexLocation(location string) string {
+	if isRemoteLocation(location) {
+		if strings.HasSuffix(location, ".json") {
+			return location
+		}
+		return strings.TrimSuffix(location, "/") + "/index.json"
+	}
+
+	if IsDir(location) {
+		return filepath.Join(location, "index.json")
+	}
+	return location
+}
+
+//Open a file from URL or local path
+func openLocation(location string) (io.ReadCloser, error) {
+	if !isRemoteLocation(location) {
+		return os.Open(location)
+	}
+
+	client := http.Client{Timeout: repositoryTimeout}
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.New("Unable to download " + location + ": " + resp.Status)
+	}
+	return resp.Body, nil
+}
+
+//Resolve the package URL relative to the index location
+func resolvePackageLocation(indexLocation string, packageURL string) (string, error) {
+	if isRemoteLocation(packageURL) {
+		return packageURL, nil
+	}
+
+	if isRemoteLocation(indexLocation) {
+		base, err := url.Parse(indexLocation)
+		if err != nil {
+			return "", err
+		}
+		ref, err := url.Parse(packageURL)
+		if err != nil {
+			return "", err
+		}
+		return base.ResolveReference(ref).String(), nil
+	}
+
+	if filepath.IsAbs(packageURL) {
+		return packageURL, nil
+	}
+	return filepath.Join(filepath.Dir(indexLocation), filepath.FromSlash(path.Clean("/"+packageURL))), nil
+}
+
+//Load the index of a repository
+func (m *ModuleHandler) GetRepositoryIndex(repoName string) (*RepositoryIndex, string, error) {
+	location, ok := m.ListRepositories()[repoName]
+	if !ok {
+		return nil, "", errors.New("Repository not found")
+	}
+
+	indexLocation := getIndexLocation(location)
+	f, err := openLocation(indexLocation)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, "", err
+	}
+
+	index := RepositoryIndex{}
+	err = json.Unmarshal(content, &index)
+	if err != nil {
+		return nil, "", errors.New("Invalid repository index: " + err.Error())
+	}
+
+	return &index, indexLocation, nil
+}
+
+//Get the list of modules available from all repositories. Only the latest version of each module is returned
+func (m *ModuleHandler) GetCatalogue() ([]CatalogueEntry, []error) {
+	latest := map[string]CatalogueEntry{}
+	errs := []error{}
+	for repoName := range m.ListRepositories() {
+		index, _, err := m.GetRepositoryIndex(repoName)
+		if err != nil {
+			errs = append(errs, errors.New(repoName+": "+err.Error()))
+			continue
+		}
+
+		for _, mod := range index.Modules {
+			if _, err := parseVersion(mod.Version); err != nil {
+				continue
+			}
+
+			if existing, ok := latest[mod.Name]; ok {
+				if result, _ := CompareVersion(mod.Version, existing.Version); result <= 0 {
+					continue
+				}
+			}
+
+			latest[mod.Name] = CatalogueEntry{
+				RepositoryModule: mod,
+				Repository:       repoName,
+			}
+		}
+	}
+
+	results := []CatalogueEntry{}
+	for _, entry := range latest {
+		entry.Installed = m.isModuleInstalled(entry.Name)
+		if entry.Installed {
+			entry.InstalledVersion = m.GetInstalledVersion(entry.Name)
+			if entry.InstalledVersion == "" {
+				entry.UpdateAvailable = true
+			} else if result, err := CompareVersion(entry.Version, entry.InstalledVersion); err == nil && result > 0 {
+				entry.UpdateAvailable = true
+			}
+		}
+		results = append(results, entry)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+	return results, errs
+}
+
+//Find the latest version of the module in the catalogue
+func (m *ModuleHandler) findInCatalogue(moduleName string) (*CatalogueEntry, error) {
+	catalogue, _ := m.GetCatalogue()
+	for _, entry := range catalogue {
+		if entry.Name == moduleName {
+			return &entry, nil
+		}
+	}
+	return nil, errors.New(moduleName + " not found in any repository")
+}
+
+//Download, verify and install a module from the repositories
+func (m *ModuleHandler) InstallFromRepository(moduleName string, gateway *agi.Gateway, force bool) (*ModulePackage, error) {
+	entry, err := m.findInCatalogue(moduleName)
+	if err != nil {
+		return nil, err
+	}
+
+	_, indexLocation, err := m.GetRepositoryIndex(entry.Repository)
+	if err != nil {
+		return nil, err
+	}
+
+	packageLocation, err := resolvePackageLocation(indexLocation, entry.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	//Download the package into tmp folder
+	workingFolder := filepath.Join(m.tmpDirectory, "download", uuid.NewV4().String())
+	os.MkdirAll(workingFolder, 0755)
+	defer os.RemoveAll(workingFolder)
+
+	packageFile := filepath.Join(workingFolder, path.Base(filepath.ToSlash(packageLocation)))
+	err = downloadPackage(packageLocation, packageFile, entry.Sha256)
+	if err != nil {
+		return nil, err
+	}
+
+	extractFolder := filepath.Join(workingFolder, "extract")
+	os.MkdirAll(extractFolder, 0755)
+	err = fs.ArozExtractArchiveWithProgress(packageFile, extractFolder, func(filename string, current int, total int, progress float64) {})
+	if err != nil {
+		return nil, err
+	}
+
+	moduleFolder, err := findModuleFolder(extractFolder, moduleName)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.InstallPackage(moduleFolder, gateway, InstallOption{
+		Source: entry.Repository + ":" + entry.Name + "@" + entry.Version,
+		Force:  force,
+	})
+}
+
+//Update the module to the latest version in the repositories
+func (m *ModuleHandler) UpdateModule(moduleName string, gateway *agi.Gateway) (*ModulePackage, error) {
+	if !m.isModuleInstalled(moduleName) {
+		return nil, errors.New(moduleName + " is not installed")
+	}
+
+	entry, err := m.findInCatalogue(moduleName)
+	if err != nil {
+		return nil, err
+	}
+
+	if !entry.UpdateAvailable {
+		return nil, errors.New(moduleName + " is already up to date")
+	}
+
+	return m.InstallFromRepository(moduleName, gateway, false)
+}
+
+//Download the package and verify its checksum
+func downloadPackage(location string, dest string, checksum string) error {
+	src, err := openLocation(location)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), src)
+	if err != nil {
+		return err
+	}
+
+	if checksum != "" && !strings.EqualFold(hex.EncodeToString(hash.Sum(nil)), checksum) {
+		return errors.New("Package checksum mismatch")
+	}
+	return nil
+}
+
+//Find the module folder containing init.agi in the extracted package
+func findModuleFolder(extractFolder string, moduleName string) (string, error) {
+	candidates := []string{
+		filepath.Join(extractFolder, moduleName),
+		extractFolder,
+	}
+
+	//Archives might wrap the module in a top level folder
+	subfolders, _ := filepath.Glob(filepath.Join(extractFolder, "*"))
+	for _, subfolder := range subfolders {
+		candidates = append(candidates, filepath.Join(subfolder, moduleName))
+	}
+
+	for _, candidate := range candidates {
+		if fileExists(filepath.Join(candidate, "init.agi")) {
+			if filepath.Base(candidate) != moduleName {
+				//Package contains the module files only. Rename the folder to match the module name
+				renamed := filepath.Join(filepath.Dir(extractFolder), moduleName)
+				err := os.Rename(candidate, renamed)
+				if err != nil {
+					return "", err
+				}
+				return renamed, nil
+			}
+			return candidate, nil
+		}
+	}
+
+	return "", errors.New("init.agi not found in module package")
+}
+
+/*
+	Handle the module repositories. Admin only
+	GET: (no opr) => return the list of repositories
+	GET: opr=catalogue => return the modules available from the repositories
+	POST: opr=add&name={name}&location={URL or local folder}
+	POST: opr=remove&name={name}
+	POST: opr=install&module={name} => install the latest version of the module
+	POST: opr=update&module={name} => update the module to the latest version
+*/
+func (m *ModuleHandler) HandleModuleRepositories(w http.ResponseWriter, r *http.Request, gateway *agi.Gateway) {
+	opr, _ := mv(r, "opr", r.Method == http.MethodPost)
+	if r.Method != http.MethodPost {
+		if opr == "catalogue" {
+			catalogue, errs := m.GetCatalogue()
+			errMessages := []string{}
+			for _, err := range errs {
+				errMessages = append(errMessages, err.Error())
+			}
+			js, _ := json.Marshal(struct {
+				Modules []CatalogueEntry
+				Errors  []string
+			}{
+				catalogue,
+				errMessages,
+			})
+			sendJSONResponse(w, string(js))
+			return
+		}
+
+		js, _ := json.Marshal(m.ListRepositories())
+		sendJSONResponse(w, string(js))
+		return
+	}
+
+	var err error
+	if opr == "add" {
+		name, _ := mv(r, "name", true)
+		location, _ := mv(r, "location", true)
+		err = m.AddRepository(name, location)
+	} else if opr == "remove" {
+		name, _ := mv(r, "name", true)
+		err = m.RemoveRepository(name)
+	} else if opr == "install" || opr == "update" {
+		moduleName, _ := mv(r, "module", true)
+		if moduleName == "" {
+			sendErrorResponse(w, "Invalid module name")
+			return
+		}
+
+		var record *ModulePackage
+		if opr == "install" {
+			force, _ := mv(r, "force", true)
+			record, err = m.InstallFromRepository(moduleName, gateway, force == "true")
+		} else {
+			record, err = m.UpdateModule(moduleName, gateway)
+		}
+
+		if err == nil {
+			js, _ := json.Marshal(record)
+			sendJSONResponse(w, string(js))
+			return
+		}
+	} else {
+		sendErrorResponse(w, "Unknown operation")
+		return
+	}
+
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+	sendOK(w)
+}
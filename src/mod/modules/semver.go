@@ -0,0 +1,163 @@
+package modules
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+/*
+	Semantic Version Utilities
+
+	Compare module versions and check them against version constraints.
+	Versions with missing parts are accepted, e.g. "1.2" equals "1.2.0"
+
+	Supported constraints, multiple constraints separated by space must all be satisfied
+	1.2.0 / =1.2.0   Exact version
+	>=1.2.0 / >1.2.0 / <=1.2.0 / <1.2.0
+	^1.2.0           Same major version, >= 1.2.0
+	~1.2.0           Same major and minor version, >= 1.2.0
+	*                Any version
+*/
+
+type semanticVersion struct {
+	Major      int
+	Minor      int
+	Patch      int
+	PreRelease string
+}
+
+func parseVersion(version string) (*semanticVersion, error) {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if version == "" {
+		return nil, errors.New("Empty version")
+	}
+
+	//Remove build metadata and split the pre-release tag
+	version = strings.SplitN(version, "+", 2)[0]
+	preRelease := ""
+	if strings.Contains(version, "-") {
+		parts := strings.SplitN(version, "-", 2)
+		version = parts[0]
+		preRelease = parts[1]
+	}
+
+	numbers := strings.Split(version, ".")
+	if len(numbers) > 3 {
+		return nil, errors.New("Invalid version: " + version)
+	}
+
+	results := []int{0, 0, 0}
+	for i, number := range numbers {
+		value, err := strconv.Atoi(number)
+		if err != nil || value < 0 {
+			return nil, errors.New("Invalid version: " + version)
+		}
+		results[i] = value
+	}
+
+	return &semanticVersion{
+		Major:      results[0],
+		Minor:      results[1],
+		Patch:      results[2],
+		PreRelease: preRelease,
+	}, nil
+}
+
+func (v *semanticVersion) compare(target *semanticVersion) int {
+	if v.Major != target.Major {
+		return compareInt(v.Major, target.Major)
+	}
+	if v.Minor != target.Minor {
+		return compareInt(v.Minor, target.Minor)
+	}
+	if v.Patch != target.Patch {
+		return compareInt(v.Patch, target.Patch)
+	}
+
+	//Pre-release versions have lower precedence than the normal version
+	if v.PreRelease == target.PreRelease {
+		return 0
+	} else if v.PreRelease == "" {
+		return 1
+	} else if target.PreRelease == "" {
+		return -1
+	}
+	return strings.Compare(v.PreRelease, target.PreRelease)
+}
+
+func compareInt(a int, b int) int {
+	if a > b {
+		return 1
+	} else if a < b {
+		return -1
+	}
+	return 0
+}
+
+//Compare two versions. Return 1 if a > b, -1 if a < b and 0 if they are equal
+func CompareVersion(a string, b string) (int, error) {
+	versionA, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+
+	versionB, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+
+	return versionA.compare(versionB), nil
+}
+
+//Check if the version satisfy all the constraints
+func VersionSatisfies(version string, constraints string) (bool, error) {
+	thisVersion, err := parseVersion(version)
+	if err != nil {
+		return false, err
+	}
+
+	for _, constraint := range strings.Fields(constraints) {
+		if constraint == "*" {
+			continue
+		}
+
+		operator := ""
+		for _, op := range []string{">=", "<=", ">", "<", "=", "^", "~"} {
+			if strings.HasPrefix(constraint, op) {
+				operator = op
+				break
+			}
+		}
+
+		target, err := parseVersion(strings.TrimPrefix(constraint, operator))
+		if err != nil {
+			return false, err
+		}
+
+		result := thisVersion.compare(target)
+		satisfied := false
+		switch operator {
+		case ">=":
+			satisfied = result >= 0
+		case "<=":
+			satisfied = result <= 0
+		case ">":
+			satisfied = result > 0
+		case "<":
+			satisfied = result < 0
+		case "^":
+			satisfied = result >= 0 && thisVersion.Major == target.Major
+		case "~":
+			satisfied = result >= 0 && thisVersion.Major == target.Major && thisVersion.Minor == target.Minor
+		default:
+			satisfied = result == 0
+		}
+
+		if !satisfied {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
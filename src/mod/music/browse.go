@@ -0,0 +1,206 @@
+package music
+
+import (
+	"sort"
+	"strings"
+)
+
+/*
+	Music Library Browsing
+
+	Group the indexed tracks into albums and artists and
+	provide keyword search on the library
+*/
+
+type Album struct {
+	Name     string
+	Artist   string
+	Year     int
+	Duration float64
+	Cover    string //Virtual path of the first track, for loading the album cover thumbnail
+	Tracks   []*Track
+}
+
+type Artist struct {
+	Name       string
+	AlbumCount int
+	TrackCount int
+	Albums     []string
+}
+
+const unknownAlbum = "Unknown Album"
+const unknownArtist = "Unknown Artist"
+
+//Get the artist of the album this track belongs to
+func (t *Track) albumArtist() string {
+	if t.AlbumArtist != "" {
+		return t.AlbumArtist
+	}
+	if t.Artist != "" {
+		return t.Artist
+	}
+	return unknownArtist
+}
+
+//Sort the tracks in album order (disc, track number, then title)
+func SortTracks(tracks []*Track) {
+	sort.SliceStable(tracks, func(i, j int) bool {
+		if tracks[i].DiscNumber != tracks[j].DiscNumber {
+			return tracks[i].DiscNumber < tracks[j].DiscNumber
+		}
+		if tracks[i].TrackNumber != tracks[j].TrackNumber {
+			return tracks[i].TrackNumber < tracks[j].TrackNumber
+		}
+		return strings.ToLower(tracks[i].Title) < strings.ToLower(tracks[j].Title)
+	})
+}
+
+//Group the tracks into albums, sorted by album name
+func GroupAlbums(tracks []*Track) []*Album {
+	albumMap := map[string]*Album{}
+	for _, thisTrack := range tracks {
+		albumName := thisTrack.Album
+		if albumName == "" {
+			albumName = unknownAlbum
+		}
+		artistName := thisTrack.albumArtist()
+
+		key := strings.ToLower(albumName) + "/" + strings.ToLower(artistName)
+		thisAlbum, ok := albumMap[key]
+		if !ok {
+			thisAlbum = &Album{
+				Name:   albumName,
+				Artist: artistName,
+				Cover:  thisTrack.Filepath,
+				Tracks: []*Track{},
+			}
+			albumMap[key] = thisAlbum
+		}
+
+		if thisTrack.Year > thisAlbum.Year {
+			thisAlbum.Year = thisTrack.Year
+		}
+		thisAlbum.Duration += thisTrack.Duration
+		thisAlbum.Tracks = append(thisAlbum.Tracks, thisTrack)
+	}
+
+	results := []*Album{}
+	for _, thisAlbum := range albumMap {
+		SortTracks(thisAlbum.Tracks)
+		thisAlbum.Cover = thisAlbum.Tracks[0].Filepath
+		results = append(results, thisAlbum)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return strings.ToLower(results[i].Name) < strings.ToLower(results[j].Name)
+	})
+	return results
+}
+
+//Group the tracks into artists, sorted by artist name
+func GroupArtists(tracks []*Track) []*Artist {
+	artistMap := map[string]*Artist{}
+	for _, thisTrack := range tracks {
+		artistName := thisTrack.Artist
+		if artistName == "" {
+			artistName = unknownArtist
+		}
+
+		key := strings.ToLower(artistName)
+		thisArtist, ok := artistMap[key]
+		if !ok {
+			thisArtist = &Artist{
+				Name:   artistName,
+				Albums: []string{},
+			}
+			artistMap[key] = thisArtist
+		}
+
+		thisArtist.TrackCount++
+		albumName := thisTrack.Album
+		if albumName == "" {
+			albumName = unknownAlbum
+		}
+		if !inArray(thisArtist.Albums, albumName) {
+			thisArtist.Albums = append(thisArtist.Albums, albumName)
+			thisArtist.AlbumCount++
+		}
+	}
+
+	results := []*Artist{}
+	for _, thisArtist := range artistMap {
+		results = append(results, thisArtist)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return strings.ToLower(results[i].Name) < strings.ToLower(results[j].Name)
+	})
+	return results
+}
+
+//Get the tracks of the given album (and optionally album artist)
+func FilterAlbum(tracks []*Track, album string, artist string) []*Track {
+	results := []*Track{}
+	for _, thisTrack := range tracks {
+		albumName := thisTrack.Album
+		if albumName == "" {
+			albumName = unknownAlbum
+		}
+		if !strings.EqualFold(albumName, album) {
+			continue
+		}
+		if artist != "" && !strings.EqualFold(thisTrack.albumArtist(), artist) {
+			continue
+		}
+		results = append(results, thisTrack)
+	}
+
+	SortTracks(results)
+	return results
+}
+
+//Get the tracks of the given artist
+func FilterArtist(tracks []*Track, artist string) []*Track {
+	results := []*Track{}
+	for _, thisTrack := range tracks {
+		artistName := thisTrack.Artist
+		if artistName == "" {
+			artistName = unknownArtist
+		}
+		if strings.EqualFold(artistName, artist) || strings.EqualFold(thisTrack.AlbumArtist, artist) {
+			results = append(results, thisTrack)
+		}
+	}
+
+	return results
+}
+
+//Search the tracks by title, artist, album, genre or filename. All keywords must match
+func Search(tracks []*Track, keyword string) []*Track {
+	keywords := strings.Fields(strings.ToLower(keyword))
+	results := []*Track{}
+	for _, thisTrack := range tracks {
+		searchable := strings.ToLower(strings.Join([]string{
+			thisTrack.Title,
+			thisTrack.Artist,
+			thisTrack.AlbumArtist,
+			thisTrack.Album,
+			thisTrack.Genre,
+			thisTrack.Filename,
+		}, " "))
+
+		matched := true
+		for _, thisKeyword := range keywords {
+			if !strings.Contains(searchable, thisKeyword) {
+				matched = false
+				break
+			}
+		}
+
+		if matched {
+			results = append(results, thisTrack)
+		}
+	}
+
+	return results
+}
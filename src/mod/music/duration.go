@@ -0,0 +1,335 @@
+package music
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	Audio Duration Reader
+
+	dhowden/tag only read the tags of the file, this script estimate
+	the playback length (in seconds) of the common audio formats by
+	reading their stream headers
+*/
+
+//Get the duration of the given audio file in seconds
+func GetAudioDuration(file string) (float64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".mp3":
+		return getMp3Duration(f, info.Size())
+	case ".flac":
+		return getFlacDuration(f)
+	case ".wav":
+		return getWavDuration(f)
+	case ".m4a", ".mp4", ".aac", ".alac":
+		return getMp4Duration(f, info.Size())
+	case ".ogg", ".opus":
+		return getOggDuration(f, info.Size())
+	}
+
+	return 0, errors.New("Unsupported audio format")
+}
+
+//Skip the ID3v2 header if exists and return the offset of the first audio frame
+func skipID3v2(f io.ReadSeeker) (int64, error) {
+	header := make([]byte, 10)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(f, header); err != nil {
+		return 0, err
+	}
+
+	if string(header[0:3]) != "ID3" {
+		return 0, nil
+	}
+
+	//Syncsafe integer
+	size := int64(header[6])<<21 | int64(header[7])<<14 | int64(header[8])<<7 | int64(header[9])
+	offset := size + 10
+	if header[5]&0x10 != 0 {
+		//Footer present
+		offset += 10
+	}
+	return offset, nil
+}
+
+var mp3Bitrates = map[int][]int{
+	//MPEG1 Layer III
+	1: {0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+	//MPEG2 / 2.5 Layer III
+	2: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+}
+
+var mp3SampleRates = map[int][]int{
+	1: {44100, 48000, 32000},
+	2: {22050, 24000, 16000},
+	3: {11025, 12000, 8000},
+}
+
+func getMp3Duration(f *os.File, filesize int64) (float64, error) {
+	offset, err := skipID3v2(f)
+	if err != nil {
+		return 0, err
+	}
+
+	//Search for the first frame sync within the first 64KB
+	buf := make([]byte, 65536)
+	f.Seek(offset, io.SeekStart)
+	n, _ := io.ReadFull(f, buf)
+	buf = buf[:n]
+
+	for i := 0; i+4 < len(buf); i++ {
+		if buf[i] != 0xFF || buf[i+1]&0xE0 != 0xE0 {
+			continue
+		}
+
+		versionBits := (buf[i+1] >> 3) & 0x03
+		layerBits := (buf[i+1] >> 1) & 0x03
+		bitrateIndex := int(buf[i+2] >> 4)
+		sampleRateIndex := int((buf[i+2] >> 2) & 0x03)
+		channelMode := buf[i+3] >> 6
+		if versionBits == 1 || layerBits != 1 || bitrateIndex == 0 || bitrateIndex == 15 || sampleRateIndex == 3 {
+			//Not a valid MPEG Layer III frame header
+			continue
+		}
+
+		//Version: 3 = MPEG1, 2 = MPEG2, 0 = MPEG2.5
+		mpegVersion := 1
+		if versionBits == 2 {
+			mpegVersion = 2
+		} else if versionBits == 0 {
+			mpegVersion = 3
+		}
+
+		bitrateTable := mp3Bitrates[1]
+		samplesPerFrame := 1152
+		if mpegVersion != 1 {
+			bitrateTable = mp3Bitrates[2]
+			samplesPerFrame = 576
+		}
+		bitrate := bitrateTable[bitrateIndex] * 1000
+		sampleRate := mp3SampleRates[mpegVersion][sampleRateIndex]
+
+		//Check for Xing / Info header (VBR) inside the first frame
+		sideInfoSize := 32
+		if mpegVersion == 1 && channelMode == 3 {
+			sideInfoSize = 17
+		} else if mpegVersion != 1 && channelMode != 3 {
+			sideInfoSize = 17
+		} else if mpegVersion != 1 {
+			sideInfoSize = 9
+		}
+		xingOffset := i + 4 + sideInfoSize
+		if xingOffset+12 <= len(buf) {
+			xingTag := string(buf[xingOffset : xingOffset+4])
+			if xingTag == "Xing" || xingTag == "Info" {
+				flags := binary.BigEndian.Uint32(buf[xingOffset+4 : xingOffset+8])
+				if flags&0x01 != 0 {
+					frames := binary.BigEndian.Uint32(buf[xingOffset+8 : xingOffset+12])
+					return float64(frames) * float64(samplesPerFrame) / float64(sampleRate), nil
+				}
+			}
+		}
+
+		//Check for VBRI header, always 32 bytes after the frame header
+		vbriOffset := i + 4 + 32
+		if vbriOffset+18 <= len(buf) && string(buf[vbriOffset:vbriOffset+4]) == "VBRI" {
+			frames := binary.BigEndian.Uint32(buf[vbriOffset+14 : vbriOffset+18])
+			return float64(frames) * float64(samplesPerFrame) / float64(sampleRate), nil
+		}
+
+		//Assume constant bitrate
+		audioSize := filesize - offset - int64(i)
+		return float64(audioSize) * 8 / float64(bitrate), nil
+	}
+
+	return 0, errors.New("No MPEG frame found")
+}
+
+func getFlacDuration(f *os.File) (float64, error) {
+	header := make([]byte, 4+4+34)
+	f.Seek(0, io.SeekStart)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return 0, err
+	}
+
+	if string(header[0:4]) != "fLaC" || header[4]&0x7F != 0 {
+		return 0, errors.New("Invalid FLAC stream")
+	}
+
+	//STREAMINFO block
+	streamInfo := header[8:]
+	sampleRate := uint64(streamInfo[10])<<12 | uint64(streamInfo[11])<<4 | uint64(streamInfo[12])>>4
+	totalSamples := uint64(streamInfo[13]&0x0F)<<32 | uint64(binary.BigEndian.Uint32(streamInfo[14:18]))
+	if sampleRate == 0 {
+		return 0, errors.New("Invalid FLAC sample rate")
+	}
+
+	return float64(totalSamples) / float64(sampleRate), nil
+}
+
+func getWavDuration(f *os.File) (float64, error) {
+	header := make([]byte, 12)
+	f.Seek(0, io.SeekStart)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return 0, err
+	}
+	if string(header[0:4]) != "RIFF" || string(header[8:12]) != "WAVE" {
+		return 0, errors.New("Invalid WAV file")
+	}
+
+	byteRate := uint32(0)
+	chunkHeader := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(f, chunkHeader); err != nil {
+			return 0, errors.New("Data chunk not found")
+		}
+		chunkSize := binary.LittleEndian.Uint32(chunkHeader[4:8])
+		chunkID := string(chunkHeader[0:4])
+		if chunkID == "fmt " {
+			fmtChunk := make([]byte, chunkSize)
+			if _, err := io.ReadFull(f, fmtChunk); err != nil || len(fmtChunk) < 12 {
+				return 0, errors.New("Invalid fmt chunk")
+			}
+			byteRate = binary.LittleEndian.Uint32(fmtChunk[8:12])
+			if chunkSize%2 == 1 {
+				f.Seek(1, io.SeekCurrent)
+			}
+		} else if chunkID == "data" {
+			if byteRate == 0 {
+				return 0, errors.New("Invalid byte rate")
+			}
+			return float64(chunkSize) / float64(byteRate), nil
+		} else {
+			f.Seek(int64(chunkSize+chunkSize%2), io.SeekCurrent)
+		}
+	}
+}
+
+//Find the mvhd atom inside the moov atom and read the duration
+func getMp4Duration(f *os.File, filesize int64) (float64, error) {
+	moovOffset, moovSize, err := findMp4Atom(f, 0, filesize, "moov")
+	if err != nil {
+		return 0, err
+	}
+
+	mvhdOffset, _, err := findMp4Atom(f, moovOffset+8, moovOffset+moovSize, "mvhd")
+	if err != nil {
+		return 0, err
+	}
+
+	mvhd := make([]byte, 32)
+	f.Seek(mvhdOffset+8, io.SeekStart)
+	if _, err := io.ReadFull(f, mvhd); err != nil {
+		return 0, err
+	}
+
+	var timescale uint32
+	var duration uint64
+	if mvhd[0] == 1 {
+		//Version 1, 64 bits time fields
+		timescale = binary.BigEndian.Uint32(mvhd[20:24])
+		duration = binary.BigEndian.Uint64(mvhd[24:32])
+	} else {
+		timescale = binary.BigEndian.Uint32(mvhd[12:16])
+		duration = uint64(binary.BigEndian.Uint32(mvhd[16:20]))
+	}
+
+	if timescale == 0 {
+		return 0, errors.New("Invalid timescale")
+	}
+	return float64(duration) / float64(timescale), nil
+}
+
+//Return the offset and size of the atom with given name in range [start, end)
+func findMp4Atom(f *os.File, start int64, end int64, name string) (int64, int64, error) {
+	header := make([]byte, 16)
+	offset := start
+	for offset+8 <= end {
+		f.Seek(offset, io.SeekStart)
+		if _, err := io.ReadFull(f, header[:8]); err != nil {
+			return 0, 0, err
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[0:4]))
+		if size == 1 {
+			//64 bits extended size
+			if _, err := io.ReadFull(f, header[8:16]); err != nil {
+				return 0, 0, err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+		} else if size == 0 {
+			size = end - offset
+		}
+
+		if size < 8 {
+			return 0, 0, errors.New("Invalid atom size")
+		}
+
+		if string(header[4:8]) == name {
+			return offset, size, nil
+		}
+		offset += size
+	}
+
+	return 0, 0, errors.New("Atom " + name + " not found")
+}
+
+//Read the sample rate from the identification header and the granule position of the last page
+func getOggDuration(f *os.File, filesize int64) (float64, error) {
+	head := make([]byte, 128)
+	f.Seek(0, io.SeekStart)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+	if len(head) < 28 || string(head[0:4]) != "OggS" {
+		return 0, errors.New("Invalid OGG stream")
+	}
+
+	sampleRate := uint32(0)
+	if idx := bytes.Index(head, []byte("\x01vorbis")); idx >= 0 && idx+16 <= len(head) {
+		sampleRate = binary.LittleEndian.Uint32(head[idx+12 : idx+16])
+	} else if idx := bytes.Index(head, []byte("OpusHead")); idx >= 0 {
+		//Opus granule position is always in 48kHz
+		sampleRate = 48000
+	}
+	if sampleRate == 0 {
+		return 0, errors.New("Unsupported OGG codec")
+	}
+
+	//Search for the last page header from the end of file
+	tailSize := int64(65536)
+	if tailSize > filesize {
+		tailSize = filesize
+	}
+	tail := make([]byte, tailSize)
+	f.Seek(filesize-tailSize, io.SeekStart)
+	if _, err := io.ReadFull(f, tail); err != nil {
+		return 0, err
+	}
+
+	idx := bytes.LastIndex(tail, []byte("OggS"))
+	if idx < 0 || idx+14 > len(tail) {
+		return 0, errors.New("Last OGG page not found")
+	}
+
+	granule := binary.LittleEndian.Uint64(tail[idx+6 : idx+14])
+	return float64(granule) / float64(sampleRate), nil
+}
@@ -0,0 +1,454 @@
+package music
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	fs "imuslab.com/arozos/mod/filesystem"
+)
+
+/*
+	Music Library HTTP Handlers
+
+	All handlers only return the tracks that is accessible by the current user
+*/
+
+/*
+	Handle library settings and scanning
+
+	opr=status	=> return the library folders and scanning state
+	opr=scan	=> start scanning the library in the background
+	opr=set		=> set the library folders (folders, JSON array of virtual paths)
+*/
+func (m *Manager) HandleLibrary(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := m.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	opr, _ := mv(r, "opr", true)
+	switch opr {
+	case "scan":
+		m.ScanInBackground(userinfo)
+		sendOK(w)
+	case "set":
+		foldersJSON, err := mv(r, "folders", true)
+		if err != nil {
+			sendErrorResponse(w, "Invalid folders given")
+			return
+		}
+
+		folders := []string{}
+		err = json.Unmarshal([]byte(foldersJSON), &folders)
+		if err != nil {
+			sendErrorResponse(w, "Invalid folders given")
+			return
+		}
+
+		err = m.SetLibraryFolders(userinfo, folders)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+
+		m.ScanInBackground(userinfo)
+		sendOK(w)
+	default:
+		js, _ := json.Marshal(struct {
+			Folders  []string
+			Scanning bool
+		}{
+			m.GetLibraryFolders(userinfo.Username),
+			m.IsScanning(userinfo.Username),
+		})
+		sendJSONResponse(w, string(js))
+	}
+}
+
+//List the tracks in the library, optionally filtered by album, artist or keyword
+func (m *Manager) HandleTracks(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := m.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	//Get a single track
+	file, err := mv(r, "file", true)
+	if err == nil {
+		thisTrack, err := m.GetTrack(userinfo, file)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+		js, _ := json.Marshal(thisTrack)
+		sendJSONResponse(w, string(js))
+		return
+	}
+
+	tracks := m.ListUserTracks(userinfo)
+	album, _ := mv(r, "album", true)
+	artist, _ := mv(r, "artist", true)
+	keyword, _ := mv(r, "keyword", true)
+	sortMode, _ := mv(r, "sort", true)
+	if album != "" {
+		tracks = FilterAlbum(tracks, album, artist)
+	} else if artist != "" {
+		tracks = FilterArtist(tracks, artist)
+	}
+
+	if keyword != "" {
+		tracks = Search(tracks, keyword)
+	}
+
+	if sortMode == "mostplayed" {
+		tracks = MostPlayed(tracks, 0)
+	}
+
+	js, _ := json.Marshal(tracks)
+	sendJSONResponse(w, string(js))
+}
+
+//List the albums in the library
+func (m *Manager) HandleAlbums(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := m.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	tracks := m.ListUserTracks(userinfo)
+	artist, _ := mv(r, "artist", true)
+	if artist != "" {
+		tracks = FilterArtist(tracks, artist)
+	}
+
+	js, _ := json.Marshal(GroupAlbums(tracks))
+	sendJSONResponse(w, string(js))
+}
+
+//List the artists in the library
+func (m *Manager) HandleArtists(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := m.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	js, _ := json.Marshal(GroupArtists(m.ListUserTracks(userinfo)))
+	sendJSONResponse(w, string(js))
+}
+
+//Record a play of the given track
+func (m *Manager) HandlePlayed(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := m.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	file, err := mv(r, "file", true)
+	if err != nil || !userinfo.CanRead(file) {
+		sendErrorResponse(w, "Invalid file given")
+		return
+	}
+
+	playRecord, err := m.RecordPlay(userinfo.Username, file)
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+
+	js, _ := json.Marshal(playRecord)
+	sendJSONResponse(w, string(js))
+}
+
+/*
+	Handle playlist operations
+
+	opr=list / create (name, tracks) / get (playlist) / delete (playlist) / rename (playlist, name)
+	opr=add (playlist, file) / remove (playlist, index) / set (playlist, tracks)
+	opr=import (file) / export (playlist, format, file)
+*/
+func (m *Manager) HandlePlaylists(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := m.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	opr, _ := mv(r, "opr", true)
+	if opr == "" || opr == "list" {
+		js, _ := json.Marshal(m.ListPlaylists(userinfo.Username))
+		sendJSONResponse(w, string(js))
+		return
+	}
+
+	if opr == "create" {
+		name, _ := mv(r, "name", true)
+		tracks := []string{}
+		tracksJSON, err := mv(r, "tracks", true)
+		if err == nil {
+			json.Unmarshal([]byte(tracksJSON), &tracks)
+		}
+
+		newPlaylist, err := m.CreatePlaylist(userinfo.Username, name, filterReadableTracks(userinfo.CanRead, tracks))
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+		js, _ := json.Marshal(newPlaylist)
+		sendJSONResponse(w, string(js))
+		return
+	}
+
+	if opr == "import" {
+		file, err := mv(r, "file", true)
+		if err != nil || !userinfo.CanRead(file) {
+			sendErrorResponse(w, "Invalid file given")
+			return
+		}
+
+		rpath, err := userinfo.VirtualPathToRealPath(file)
+		if err != nil {
+			sendErrorResponse(w, "Invalid file given")
+			return
+		}
+
+		content, err := ioutil.ReadFile(rpath)
+		if err != nil {
+			sendErrorResponse(w, "Unable to read playlist file")
+			return
+		}
+
+		newPlaylist, err := m.ImportPlaylist(userinfo, file, string(content))
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+		js, _ := json.Marshal(newPlaylist)
+		sendJSONResponse(w, string(js))
+		return
+	}
+
+	playlistID, err := mv(r, "playlist", true)
+	if err != nil {
+		sendErrorResponse(w, "Invalid playlist given")
+		return
+	}
+
+	if opr == "delete" {
+		err = m.DeletePlaylist(userinfo.Username, playlistID)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+		sendOK(w)
+		return
+	}
+
+	playlist, err := m.GetPlaylist(userinfo.Username, playlistID)
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+
+	switch opr {
+	case "get":
+		tracks := []*Track{}
+		for _, vpath := range playlist.Tracks {
+			thisTrack, err := m.GetTrack(userinfo, vpath)
+			if err != nil {
+				continue
+			}
+			tracks = append(tracks, thisTrack)
+		}
+
+		js, _ := json.Marshal(struct {
+			*Playlist
+			Tracks []*Track
+		}{playlist, tracks})
+		sendJSONResponse(w, string(js))
+		return
+	case "rename":
+		name, _ := mv(r, "name", true)
+		if strings.TrimSpace(name) == "" {
+			sendErrorResponse(w, "Playlist name cannot be empty")
+			return
+		}
+		playlist.Name = strings.TrimSpace(name)
+	case "add":
+		file, err := mv(r, "file", true)
+		if err != nil || !userinfo.CanRead(file) || !IsAudio(file) {
+			sendErrorResponse(w, "Invalid file given")
+			return
+		}
+		playlist.Tracks = append(playlist.Tracks, file)
+	case "remove":
+		index, err := mv(r, "index", true)
+		i, err2 := strconv.Atoi(index)
+		if err != nil || err2 != nil || i < 0 || i >= len(playlist.Tracks) {
+			sendErrorResponse(w, "Invalid index given")
+			return
+		}
+		playlist.Tracks = append(playlist.Tracks[:i], playlist.Tracks[i+1:]...)
+	case "set":
+		tracksJSON, err := mv(r, "tracks", true)
+		tracks := []string{}
+		if err != nil || json.Unmarshal([]byte(tracksJSON), &tracks) != nil {
+			sendErrorResponse(w, "Invalid tracks given")
+			return
+		}
+		playlist.Tracks = filterReadableTracks(userinfo.CanRead, tracks)
+	case "export":
+		format, _ := mv(r, "format", true)
+		if format == "" {
+			format = "m3u"
+		}
+
+		//Export to file if target is given, otherwise send it to the client as download
+		file, err := mv(r, "file", true)
+		baseDir := ""
+		if err == nil {
+			baseDir = path.Dir(file)
+		}
+
+		content, err := m.ExportPlaylist(userinfo, playlist, format, baseDir)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+
+		if file == "" {
+			w.Header().Set("Content-Disposition", "attachment; filename=\""+playlist.Name+"."+format+"\"")
+			w.Header().Set("Content-Type", "audio/x-mpegurl")
+			if format == "pls" {
+				w.Header().Set("Content-Type", "audio/x-scpls")
+			}
+			w.Write([]byte(content))
+			return
+		}
+
+		if !userinfo.CanWrite(file) {
+			sendErrorResponse(w, "Permission Denied")
+			return
+		}
+
+		rpath, err := userinfo.VirtualPathToRealPath(file)
+		if err != nil {
+			sendErrorResponse(w, "Invalid file given")
+			return
+		}
+
+		if !userinfo.StorageQuota.HaveSpace(int64(len(content))) {
+			sendErrorResponse(w, "Storage Quota Full")
+			return
+		}
+
+		if fs.FileExists(rpath) && userinfo.IsOwnerOfFile(rpath) {
+			userinfo.RemoveOwnershipFromFile(rpath)
+		}
+
+		err = ioutil.WriteFile(rpath, []byte(content), 0755)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+
+		//Add the filesize to user quota
+		userinfo.SetOwnerOfFile(rpath)
+		sendOK(w)
+		return
+	default:
+		sendErrorResponse(w, "Unknown operation")
+		return
+	}
+
+	err = m.SavePlaylist(playlist)
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+	sendOK(w)
+}
+
+/*
+	Handle play queue operations. All operations return the latest queue state
+
+	opr=get / set (tracks, position) / append (tracks) / remove (index) / move (from, to)
+	opr=next / prev / jump (index) / repeat (mode)
+*/
+func (m *Manager) HandleQueue(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := m.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	opr, _ := mv(r, "opr", true)
+	getIntParam := func(key string) int {
+		value, _ := mv(r, key, true)
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return -1
+		}
+		return i
+	}
+	getTracksParam := func() []string {
+		tracks := []string{}
+		tracksJSON, _ := mv(r, "tracks", true)
+		json.Unmarshal([]byte(tracksJSON), &tracks)
+		return filterReadableTracks(userinfo.CanRead, tracks)
+	}
+
+	queue, err := m.UpdateQueue(userinfo.Username, func(q *Queue) error {
+		switch opr {
+		case "set":
+			q.Tracks = getTracksParam()
+			q.Position = getIntParam("position")
+		case "append":
+			q.Tracks = append(q.Tracks, getTracksParam()...)
+		case "remove":
+			return q.Remove(getIntParam("index"))
+		case "move":
+			return q.Move(getIntParam("from"), getIntParam("to"))
+		case "next":
+			if nextIndex := q.NextIndex(); nextIndex >= 0 {
+				q.Position = nextIndex
+			}
+		case "prev":
+			if prevIndex := q.PrevIndex(); prevIndex >= 0 {
+				q.Position = prevIndex
+			}
+		case "jump":
+			q.Position = getIntParam("index")
+		case "repeat":
+			q.Repeat, _ = mv(r, "mode", true)
+		}
+		return nil
+	})
+
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+
+	js, _ := json.Marshal(m.GetQueueState(userinfo, queue))
+	sendJSONResponse(w, string(js))
+}
+
+//Remove the tracks that the user cannot access
+func filterReadableTracks(canRead func(string) bool, tracks []string) []string {
+	results := []string{}
+	for _, vpath := range tracks {
+		if canRead(vpath) && IsAudio(vpath) {
+			results = append(results, vpath)
+		}
+	}
+	return results
+}
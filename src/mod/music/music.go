@@ -0,0 +1,406 @@
+package music
+
+/*
+	ArozOS Music Library
+	author: tobychui
+
+	This module scan the music folders configured by each user and index the
+	tags (ID3 / Vorbis / MP4) of the audio files. Similar to the photo library,
+	the index is stored inside the fsdb (aofs.db) of the file system handler.
+	User specific data (library folders, playlists, play counts and play queue)
+	are stored in the system database.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dhowden/tag"
+	"imuslab.com/arozos/mod/database"
+	fs "imuslab.com/arozos/mod/filesystem"
+	user "imuslab.com/arozos/mod/user"
+)
+
+type Options struct {
+	UserHandler *user.UserHandler
+	Database    *database.Database //System database, for storing user playlists and settings
+}
+
+//Index record of an audio file, stored in the fsdb of the file system handler
+type TrackRecord struct {
+	Relpath     string
+	Title       string
+	Artist      string
+	AlbumArtist string
+	Album       string
+	Genre       string
+	Year        int
+	TrackNumber int
+	TrackTotal  int
+	DiscNumber  int
+	DiscTotal   int
+	Duration    float64 //In seconds, 0 if unknown
+	Format      string
+	Filesize    int64
+	ModTime     int64
+	IndexTime   int64
+}
+
+//Track information returned to the user
+type Track struct {
+	Filepath  string
+	Filename  string
+	PlayCount int
+	TrackRecord
+}
+
+type Manager struct {
+	options  Options
+	scanning sync.Map //Map of usernames that is scanning their library
+}
+
+//Audio extensions that will be included in the music library
+var SupportedFormats = []string{".mp3", ".flac", ".wav", ".ogg", ".opus", ".m4a", ".aac", ".alac"}
+
+//The default library folder if the user didn't set any
+var defaultLibraryFolders = []string{"user:/Music/"}
+
+//Create a new music library manager
+func NewMusicManager(options Options) *Manager {
+	options.Database.NewTable("music-library")
+	options.Database.NewTable("music-playlists")
+	options.Database.NewTable("music-playcount")
+	options.Database.NewTable("music-queue")
+	return &Manager{
+		options:  options,
+		scanning: sync.Map{},
+	}
+}
+
+//Check if the given file is a supported audio file
+func IsAudio(filename string) bool {
+	return inArray(SupportedFormats, strings.ToLower(filepath.Ext(filename)))
+}
+
+//Get the library folders (in virtual path) of the given user
+func (m *Manager) GetLibraryFolders(username string) []string {
+	folders := []string{}
+	if !m.options.Database.KeyExists("music-library", username) {
+		return defaultLibraryFolders
+	}
+	m.options.Database.Read("music-library", username, &folders)
+	return folders
+}
+
+//Set the library folders of the given user
+func (m *Manager) SetLibraryFolders(u *user.User, folders []string) error {
+	cleanedFolders := []string{}
+	for _, folder := range folders {
+		folder = strings.TrimSpace(folder)
+		if folder == "" || inArray(cleanedFolders, folder) {
+			continue
+		}
+
+		if !u.CanRead(folder) {
+			return errors.New("Permission denied: " + folder)
+		}
+
+		rpath, err := u.VirtualPathToRealPath(folder)
+		if err != nil {
+			return err
+		}
+
+		if info, err := os.Stat(rpath); err != nil || !info.IsDir() {
+			return errors.New("Folder not exists: " + folder)
+		}
+		cleanedFolders = append(cleanedFolders, folder)
+	}
+
+	return m.options.Database.Write("music-library", u.Username, cleanedFolders)
+}
+
+//Check if the library of the given user is being scanned
+func (m *Manager) IsScanning(username string) bool {
+	_, ok := m.scanning.Load(username)
+	return ok
+}
+
+//Scan all the library folders of the given user. Unchanged files will be skipped
+func (m *Manager) ScanUserLibrary(u *user.User) error {
+	if _, loaded := m.scanning.LoadOrStore(u.Username, true); loaded {
+		return errors.New("Library is already being scanned")
+	}
+	defer m.scanning.Delete(u.Username)
+
+	for _, folder := range m.GetLibraryFolders(u.Username) {
+		rpath, err := u.VirtualPathToRealPath(folder)
+		if err != nil || !u.CanRead(folder) {
+			continue
+		}
+
+		fsh, err := u.GetFileSystemHandlerFromRealPath(rpath)
+		if err != nil {
+			continue
+		}
+
+		if !fs.FileExists(rpath) && folder == defaultLibraryFolders[0] {
+			//Create the default music folder for the user
+			os.MkdirAll(rpath, 0755)
+		}
+
+		err = m.scanFolder(fsh, rpath)
+		if err != nil {
+			log.Println("[Music] Unable to scan "+folder+" ", err.Error())
+		}
+	}
+
+	return nil
+}
+
+//Scan the user library in the background
+func (m *Manager) ScanInBackground(u *user.User) {
+	if m.IsScanning(u.Username) {
+		return
+	}
+	go m.ScanUserLibrary(u)
+}
+
+//Scan the given folder and update its index in the fsh
+func (m *Manager) scanFolder(fsh *fs.FileSystemHandler, rpath string) error {
+	if fsh.Hierarchy == "backup" || fsh.Closed {
+		return errors.New("File system handler not indexable")
+	}
+
+	fsdb := fsh.FilesystemDatabase
+	err := fsdb.NewTable("music")
+	if err != nil {
+		return err
+	}
+
+	rootAbs, _ := filepath.Abs(fsh.Path)
+	folderAbs, _ := filepath.Abs(rpath)
+	folderRelpath, err := filepath.Rel(rootAbs, folderAbs)
+	if err != nil {
+		return err
+	}
+	folderRelpath = filepath.ToSlash(folderRelpath)
+
+	//Load the existing index of this folder
+	existingRecords := map[string]*TrackRecord{}
+	for _, thisRecord := range listTrackRecords(fsh, folderRelpath) {
+		existingRecords[thisRecord.Relpath] = thisRecord
+	}
+
+	seenFiles := map[string]bool{}
+	indexedCounter := 0
+	filepath.Walk(folderAbs, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		//Skip hidden folders like .cache and .trash
+		if info.IsDir() {
+			if path != folderAbs && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !IsAudio(path) {
+			return nil
+		}
+
+		relpath, err := filepath.Rel(rootAbs, path)
+		if err != nil {
+			return nil
+		}
+		relpath = filepath.ToSlash(relpath)
+		seenFiles[relpath] = true
+
+		//Skip the files that didn't change since the last scan
+		if oldRecord, ok := existingRecords[relpath]; ok {
+			if oldRecord.ModTime == info.ModTime().Unix() && oldRecord.Filesize == info.Size() {
+				return nil
+			}
+		}
+
+		fsdb.Write("music", relpath, buildTrackRecord(path, relpath, info))
+		indexedCounter++
+		return nil
+	})
+
+	//Remove the records of files that no longer exists
+	for relpath := range existingRecords {
+		if !seenFiles[relpath] {
+			fsdb.Delete("music", relpath)
+		}
+	}
+
+	if indexedCounter > 0 {
+		log.Println("[Music] Indexed " + IntToString(indexedCounter) + " tracks in " + fsh.UUID + ":/" + folderRelpath)
+	}
+	return nil
+}
+
+//Build the index record for the given audio file
+func buildTrackRecord(path string, relpath string, info os.FileInfo) *TrackRecord {
+	thisRecord := TrackRecord{
+		Relpath:   relpath,
+		Title:     strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)),
+		Format:    strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), "."),
+		Filesize:  info.Size(),
+		ModTime:   info.ModTime().Unix(),
+		IndexTime: time.Now().Unix(),
+	}
+
+	f, err := os.Open(path)
+	if err == nil {
+		m, err := tag.ReadFrom(f)
+		if err == nil {
+			if strings.TrimSpace(m.Title()) != "" {
+				thisRecord.Title = strings.TrimSpace(m.Title())
+			}
+			thisRecord.Artist = strings.TrimSpace(m.Artist())
+			thisRecord.AlbumArtist = strings.TrimSpace(m.AlbumArtist())
+			thisRecord.Album = strings.TrimSpace(m.Album())
+			thisRecord.Genre = strings.TrimSpace(m.Genre())
+			thisRecord.Year = m.Year()
+			thisRecord.TrackNumber, thisRecord.TrackTotal = m.Track()
+			thisRecord.DiscNumber, thisRecord.DiscTotal = m.Disc()
+		}
+		f.Close()
+	}
+
+	duration, err := GetAudioDuration(path)
+	if err == nil {
+		thisRecord.Duration = duration
+	}
+
+	return &thisRecord
+}
+
+//List all the track records in the fsh under the given relative folder path
+func listTrackRecords(fsh *fs.FileSystemHandler, folderRelpath string) []*TrackRecord {
+	results := []*TrackRecord{}
+	if !fsh.FilesystemDatabase.TableExists("music") {
+		return results
+	}
+
+	entries, err := fsh.FilesystemDatabase.ListTable("music")
+	if err != nil {
+		return results
+	}
+
+	for _, keypairs := range entries {
+		relpath := string(keypairs[0])
+		if folderRelpath != "." && !strings.HasPrefix(relpath, folderRelpath+"/") {
+			continue
+		}
+
+		thisRecord := new(TrackRecord)
+		if err := json.Unmarshal(keypairs[1], &thisRecord); err != nil {
+			continue
+		}
+		results = append(results, thisRecord)
+	}
+
+	return results
+}
+
+//List all the indexed tracks inside the library folders of the given user
+func (m *Manager) ListUserTracks(u *user.User) []*Track {
+	results := []*Track{}
+	playCounts := m.GetPlayCounts(u.Username)
+	addedFiles := map[string]bool{}
+	for _, folder := range m.GetLibraryFolders(u.Username) {
+		rpath, err := u.VirtualPathToRealPath(folder)
+		if err != nil || !u.CanRead(folder) {
+			continue
+		}
+
+		fsh, err := u.GetFileSystemHandlerFromRealPath(rpath)
+		if err != nil {
+			continue
+		}
+
+		rootAbs, _ := filepath.Abs(fsh.Path)
+		folderAbs, _ := filepath.Abs(rpath)
+		folderRelpath, err := filepath.Rel(rootAbs, folderAbs)
+		if err != nil {
+			continue
+		}
+
+		for _, thisRecord := range listTrackRecords(fsh, filepath.ToSlash(folderRelpath)) {
+			realpath := filepath.ToSlash(filepath.Join(fsh.Path, thisRecord.Relpath))
+			vpath, err := u.RealPathToVirtualPath(realpath)
+			if err != nil || addedFiles[vpath] || !u.CanRead(vpath) {
+				continue
+			}
+			addedFiles[vpath] = true
+
+			thisTrack := Track{
+				Filepath:    vpath,
+				Filename:    filepath.Base(thisRecord.Relpath),
+				TrackRecord: *thisRecord,
+			}
+			if playRecord, ok := playCounts[vpath]; ok {
+				thisTrack.PlayCount = playRecord.Count
+			}
+			results = append(results, &thisTrack)
+		}
+	}
+
+	return results
+}
+
+//Get the track information of the given file, read directly from the file if not indexed
+func (m *Manager) GetTrack(u *user.User, vpath string) (*Track, error) {
+	if !u.CanRead(vpath) {
+		return nil, errors.New("Permission denied")
+	}
+
+	rpath, err := u.VirtualPathToRealPath(vpath)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(rpath)
+	if err != nil || info.IsDir() || !IsAudio(rpath) {
+		return nil, errors.New("Invalid audio file")
+	}
+
+	fsh, err := u.GetFileSystemHandlerFromRealPath(rpath)
+	if err != nil {
+		return nil, err
+	}
+
+	rootAbs, _ := filepath.Abs(fsh.Path)
+	fileAbs, _ := filepath.Abs(rpath)
+	relpath, _ := filepath.Rel(rootAbs, fileAbs)
+	relpath = filepath.ToSlash(relpath)
+
+	thisRecord := new(TrackRecord)
+	if fsh.FilesystemDatabase.KeyExists("music", relpath) {
+		fsh.FilesystemDatabase.Read("music", relpath, &thisRecord)
+	}
+
+	if thisRecord.ModTime != info.ModTime().Unix() || thisRecord.Filesize != info.Size() {
+		thisRecord = buildTrackRecord(rpath, relpath, info)
+	}
+
+	thisTrack := Track{
+		Filepath:    vpath,
+		Filename:    filepath.Base(rpath),
+		TrackRecord: *thisRecord,
+	}
+	if playRecord, ok := m.GetPlayCounts(u.Username)[vpath]; ok {
+		thisTrack.PlayCount = playRecord.Count
+	}
+	return &thisTrack, nil
+}
@@ -0,0 +1,67 @@
+package music
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+	Play Counts
+
+	Play counts of each user are stored as a single map (keyed by virtual path)
+	in the system database
+*/
+
+type PlayRecord struct {
+	Count      int
+	LastPlayed int64
+}
+
+var playCountMutex sync.Mutex
+
+//Get the play records of the given user, mapped by virtual path
+func (m *Manager) GetPlayCounts(username string) map[string]*PlayRecord {
+	results := map[string]*PlayRecord{}
+	if m.options.Database.KeyExists("music-playcount", username) {
+		m.options.Database.Read("music-playcount", username, &results)
+	}
+	return results
+}
+
+//Increase the play count of the given track
+func (m *Manager) RecordPlay(username string, vpath string) (*PlayRecord, error) {
+	playCountMutex.Lock()
+	defer playCountMutex.Unlock()
+
+	playCounts := m.GetPlayCounts(username)
+	thisRecord, ok := playCounts[vpath]
+	if !ok {
+		thisRecord = &PlayRecord{}
+		playCounts[vpath] = thisRecord
+	}
+	thisRecord.Count++
+	thisRecord.LastPlayed = time.Now().Unix()
+
+	err := m.options.Database.Write("music-playcount", username, playCounts)
+	return thisRecord, err
+}
+
+//Get the most played tracks of the user, limited to the given number of tracks
+func MostPlayed(tracks []*Track, limit int) []*Track {
+	results := []*Track{}
+	for _, thisTrack := range tracks {
+		if thisTrack.PlayCount > 0 {
+			results = append(results, thisTrack)
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].PlayCount > results[j].PlayCount
+	})
+
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
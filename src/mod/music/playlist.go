@@ -0,0 +1,224 @@
+package music
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	user "imuslab.com/arozos/mod/user"
+)
+
+/*
+	User Playlists
+
+	Playlists are stored in the system database with key {username}/{playlistUUID}.
+	Tracks are referenced by their virtual path. Playlists can be imported from
+	and exported to M3U (.m3u / .m3u8) and PLS files
+*/
+
+type Playlist struct {
+	UUID       string
+	Name       string
+	Owner      string
+	Tracks     []string //Virtual paths of the tracks, in play order
+	CreateTime int64
+	UpdateTime int64
+}
+
+//List all the playlists of the given user
+func (m *Manager) ListPlaylists(username string) []*Playlist {
+	results := []*Playlist{}
+	entries, err := m.options.Database.ListTable("music-playlists")
+	if err != nil {
+		return results
+	}
+
+	for _, keypairs := range entries {
+		if !strings.HasPrefix(string(keypairs[0]), username+"/") {
+			continue
+		}
+
+		thisPlaylist := new(Playlist)
+		if err := json.Unmarshal(keypairs[1], &thisPlaylist); err != nil {
+			continue
+		}
+		results = append(results, thisPlaylist)
+	}
+
+	return results
+}
+
+//Get a playlist of the given user by its UUID
+func (m *Manager) GetPlaylist(username string, playlistID string) (*Playlist, error) {
+	if !m.options.Database.KeyExists("music-playlists", username+"/"+playlistID) {
+		return nil, errors.New("Playlist not exists")
+	}
+
+	thisPlaylist := new(Playlist)
+	err := m.options.Database.Read("music-playlists", username+"/"+playlistID, &thisPlaylist)
+	if err != nil {
+		return nil, err
+	}
+	return thisPlaylist, nil
+}
+
+//Create a new playlist with the given tracks
+func (m *Manager) CreatePlaylist(username string, name string, tracks []string) (*Playlist, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, errors.New("Playlist name cannot be empty")
+	}
+
+	if tracks == nil {
+		tracks = []string{}
+	}
+
+	newPlaylist := Playlist{
+		UUID:       uuid.NewV4().String(),
+		Name:       name,
+		Owner:      username,
+		Tracks:     tracks,
+		CreateTime: time.Now().Unix(),
+		UpdateTime: time.Now().Unix(),
+	}
+
+	err := m.SavePlaylist(&newPlaylist)
+	if err != nil {
+		return nil, err
+	}
+	return &newPlaylist, nil
+}
+
+//Save the modified playlist
+func (m *Manager) SavePlaylist(playlist *Playlist) error {
+	playlist.UpdateTime = time.Now().Unix()
+	return m.options.Database.Write("music-playlists", playlist.Owner+"/"+playlist.UUID, playlist)
+}
+
+//Remove a playlist. The tracks inside the playlist will not be removed
+func (m *Manager) DeletePlaylist(username string, playlistID string) error {
+	if !m.options.Database.KeyExists("music-playlists", username+"/"+playlistID) {
+		return errors.New("Playlist not exists")
+	}
+	return m.options.Database.Delete("music-playlists", username+"/"+playlistID)
+}
+
+/*
+	Parse the content of a M3U or PLS playlist file.
+	Relative paths are resolved from baseDir (virtual path of the folder containing the playlist).
+	Remote streams (e.g. http://) are not supported and will be skipped
+*/
+func ParsePlaylistFile(content string, format string, baseDir string) []string {
+	entries := []string{}
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		if line == "" {
+			continue
+		}
+
+		if format == "pls" {
+			//File1=path/to/file.mp3
+			if !strings.HasPrefix(strings.ToLower(line), "file") || !strings.Contains(line, "=") {
+				continue
+			}
+			line = strings.TrimSpace(line[strings.Index(line, "=")+1:])
+		} else if strings.HasPrefix(line, "#") {
+			//M3U comments and extended info
+			continue
+		}
+
+		line = strings.ReplaceAll(line, "\\", "/")
+		if strings.Contains(line, "://") {
+			continue
+		}
+
+		if !strings.Contains(line, ":/") {
+			//Relative path
+			line = path.Join(baseDir, line)
+		}
+
+		entries = append(entries, line)
+	}
+
+	return entries
+}
+
+//Import a M3U / PLS playlist file (virtual path) as a new playlist
+func (m *Manager) ImportPlaylist(u *user.User, vpath string, content string) (*Playlist, error) {
+	ext := strings.ToLower(path.Ext(vpath))
+	format := "m3u"
+	if ext == ".pls" {
+		format = "pls"
+	} else if ext != ".m3u" && ext != ".m3u8" {
+		return nil, errors.New("Unsupported playlist format")
+	}
+
+	tracks := []string{}
+	for _, entry := range ParsePlaylistFile(content, format, path.Dir(vpath)) {
+		if !u.CanRead(entry) || !IsAudio(entry) {
+			continue
+		}
+		tracks = append(tracks, entry)
+	}
+
+	name := strings.TrimSuffix(path.Base(vpath), path.Ext(vpath))
+	return m.CreatePlaylist(u.Username, name, tracks)
+}
+
+/*
+	Generate the content of a M3U or PLS playlist file for this playlist
+	Tracks inside baseDir are written as relative path so the file works in other players
+*/
+func (m *Manager) ExportPlaylist(u *user.User, playlist *Playlist, format string, baseDir string) (string, error) {
+	if format != "m3u" && format != "pls" {
+		return "", errors.New("Unsupported playlist format")
+	}
+
+	entries := []string{}
+	tracks := []*Track{}
+	for _, vpath := range playlist.Tracks {
+		thisTrack, err := m.GetTrack(u, vpath)
+		if err != nil {
+			//Track no longer accessible
+			continue
+		}
+
+		entry := vpath
+		if baseDir != "" && strings.HasPrefix(vpath, strings.TrimSuffix(baseDir, "/")+"/") {
+			entry = strings.TrimPrefix(vpath, strings.TrimSuffix(baseDir, "/")+"/")
+		}
+		entries = append(entries, entry)
+		tracks = append(tracks, thisTrack)
+	}
+
+	var sb strings.Builder
+	if format == "m3u" {
+		sb.WriteString("#EXTM3U\n")
+		for i, entry := range entries {
+			title := tracks[i].Title
+			if tracks[i].Artist != "" {
+				title = tracks[i].Artist + " - " + title
+			}
+			sb.WriteString("#EXTINF:" + strconv.Itoa(int(tracks[i].Duration)) + "," + title + "\n")
+			sb.WriteString(entry + "\n")
+		}
+	} else {
+		sb.WriteString("[playlist]\n")
+		for i, entry := range entries {
+			index := strconv.Itoa(i + 1)
+			sb.WriteString("File" + index + "=" + entry + "\n")
+			sb.WriteString("Title" + index + "=" + tracks[i].Title + "\n")
+			sb.WriteString("Length" + index + "=" + strconv.Itoa(int(tracks[i].Duration)) + "\n")
+		}
+		sb.WriteString("NumberOfEntries=" + strconv.Itoa(len(entries)) + "\n")
+		sb.WriteString("Version=2\n")
+	}
+
+	return sb.String(), nil
+}
@@ -0,0 +1,183 @@
+package music
+
+import (
+	"errors"
+	"net/url"
+	"sync"
+
+	user "imuslab.com/arozos/mod/user"
+)
+
+/*
+	Play Queue
+
+	Each user has one ordered play queue stored in the system database,
+	so the playback can be continued across devices. The queue state always
+	include the upcoming track so the client can preload it for gapless playback
+*/
+
+type Queue struct {
+	Tracks   []string //Virtual paths of the tracks in play order
+	Position int      //Index of the current track
+	Repeat   string   //none / all / one
+}
+
+//Queue state returned to the client
+type QueueState struct {
+	Queue
+	Current *QueueEntry
+	Next    *QueueEntry //The track to be preloaded, nil if it is the end of queue
+}
+
+type QueueEntry struct {
+	Index    int
+	MediaURL string
+	*Track
+}
+
+var queueMutex sync.Mutex
+
+//Get the play queue of the given user
+func (m *Manager) GetQueue(username string) *Queue {
+	thisQueue := Queue{
+		Tracks:   []string{},
+		Position: 0,
+		Repeat:   "none",
+	}
+	if m.options.Database.KeyExists("music-queue", username) {
+		m.options.Database.Read("music-queue", username, &thisQueue)
+	}
+	return &thisQueue
+}
+
+//Save the play queue of the given user
+func (m *Manager) SaveQueue(username string, queue *Queue) error {
+	if queue.Tracks == nil {
+		queue.Tracks = []string{}
+	}
+	if queue.Position < 0 || queue.Position >= len(queue.Tracks) {
+		queue.Position = 0
+	}
+	if queue.Repeat != "all" && queue.Repeat != "one" {
+		queue.Repeat = "none"
+	}
+	return m.options.Database.Write("music-queue", username, queue)
+}
+
+//Modify the queue of the given user with the given function and save it
+func (m *Manager) UpdateQueue(username string, updateFunc func(*Queue) error) (*Queue, error) {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+
+	thisQueue := m.GetQueue(username)
+	err := updateFunc(thisQueue)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.SaveQueue(username, thisQueue)
+	return thisQueue, err
+}
+
+//Get the index of the track after the current one, -1 if it is the end of queue
+func (q *Queue) NextIndex() int {
+	if len(q.Tracks) == 0 {
+		return -1
+	}
+	if q.Repeat == "one" {
+		return q.Position
+	}
+	if q.Position+1 < len(q.Tracks) {
+		return q.Position + 1
+	}
+	if q.Repeat == "all" {
+		return 0
+	}
+	return -1
+}
+
+//Get the index of the track before the current one, -1 if it is the start of queue
+func (q *Queue) PrevIndex() int {
+	if len(q.Tracks) == 0 {
+		return -1
+	}
+	if q.Position-1 >= 0 {
+		return q.Position - 1
+	}
+	if q.Repeat == "all" {
+		return len(q.Tracks) - 1
+	}
+	return -1
+}
+
+//Move the track at index "from" to index "to", keeping the current track playing
+func (q *Queue) Move(from int, to int) error {
+	if from < 0 || from >= len(q.Tracks) || to < 0 || to >= len(q.Tracks) {
+		return errors.New("Index out of range")
+	}
+
+	currentTrack := q.Position
+	moving := q.Tracks[from]
+	q.Tracks = append(q.Tracks[:from], q.Tracks[from+1:]...)
+	q.Tracks = append(q.Tracks[:to], append([]string{moving}, q.Tracks[to:]...)...)
+
+	//Update the current position
+	if currentTrack == from {
+		q.Position = to
+	} else if from < currentTrack && to >= currentTrack {
+		q.Position--
+	} else if from > currentTrack && to <= currentTrack {
+		q.Position++
+	}
+	return nil
+}
+
+//Remove the track at the given index
+func (q *Queue) Remove(index int) error {
+	if index < 0 || index >= len(q.Tracks) {
+		return errors.New("Index out of range")
+	}
+
+	q.Tracks = append(q.Tracks[:index], q.Tracks[index+1:]...)
+	if index < q.Position {
+		q.Position--
+	}
+	if q.Position >= len(q.Tracks) {
+		q.Position = 0
+	}
+	return nil
+}
+
+//Resolve the queue into the state returned to the client
+func (m *Manager) GetQueueState(u *user.User, queue *Queue) *QueueState {
+	state := QueueState{
+		Queue: *queue,
+	}
+
+	if len(queue.Tracks) == 0 {
+		return &state
+	}
+
+	state.Current = m.getQueueEntry(u, queue, queue.Position)
+	if nextIndex := queue.NextIndex(); nextIndex >= 0 {
+		state.Next = m.getQueueEntry(u, queue, nextIndex)
+	}
+	return &state
+}
+
+func (m *Manager) getQueueEntry(u *user.User, queue *Queue, index int) *QueueEntry {
+	if index < 0 || index >= len(queue.Tracks) {
+		return nil
+	}
+
+	thisTrack, err := m.GetTrack(u, queue.Tracks[index])
+	if err != nil {
+		return nil
+	}
+
+	return &QueueEntry{
+		Index:    index,
+		MediaURL: "/media/?file=" + url.QueryEscape(thisTrack.Filepath),
+		Track:    thisTrack,
+	}
+}
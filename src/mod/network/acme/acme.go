@@ -0,0 +1,433 @@
+package acme
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"imuslab.com/arozos/mod/database"
+)
+
+/*
+	ACME Certificate Manager
+
+	Obtain and renew TLS certificates automatically from an ACME server (e.g. Let's Encrypt)
+	The certificates are stored in the store folder and served through tls.Config.GetCertificate,
+	so renewed certificates take effect without restarting the HTTPS listener
+*/
+
+const (
+	LetsEncryptURL        = "https://acme-v02.api.letsencrypt.org/directory"
+	LetsEncryptStagingURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
+
+	ChallengeHTTP01 = "http-01"
+	ChallengeDNS01  = "dns-01"
+
+	defaultRenewBefore = 30 //Renew certificates 30 days before expire
+	renewCheckInterval = 12 * time.Hour
+	dnsConfigFilename  = "dns.json" //DNS provider credentials, kept in the store folder instead of the database
+)
+
+type Settings struct {
+	Enabled           bool
+	Email             string            //Contact email of the ACME account
+	DirectoryURL      string            //ACME directory URL, default Let's Encrypt
+	Domains           []string          //Hostnames to obtain certificates for
+	IncludeProxyHosts bool              //Also obtain certificates for the extra hostnames, e.g. reverse proxy subdomain rules
+	Challenge         string            //http-01 or dns-01
+	DNSProvider       string            //Name of the DNS provider plugin for dns-01
+	DNSConfig         map[string]string //Configuration of the DNS provider, stored in the store folder as it contains credentials
+	DNSPropagation    int               //Seconds to wait for the DNS record to propagate
+	RenewBefore       int               //Days before expire to renew the certificates
+}
+
+type Option struct {
+	Database       *database.Database
+	StoreFolder    string          //Folder for storing the account key and certificates, e.g. ./system/acme/
+	FallbackCert   string          //Certificate used when no ACME certificate matches, e.g. the -cert flag
+	FallbackKey    string          //Key of the fallback certificate
+	ExtraHostnames func() []string //Extra hostnames to cover when IncludeProxyHosts is set
+	HTTPClient     *http.Client    //HTTP client for the ACME server, nil for default
+}
+
+type CertificateInfo struct {
+	Domain    string
+	Issuer    string
+	NotBefore int64
+	NotAfter  int64
+	Error     string //Last error when obtaining or renewing this certificate
+}
+
+type managedCert struct {
+	Cert *tls.Certificate
+	Leaf *x509.Certificate
+}
+
+type CertManager struct {
+	option          *Option
+	settings        *Settings
+	settingsMutex   sync.RWMutex
+	certs           map[string]*managedCert //Certificates by hostname
+	certMutex       sync.RWMutex
+	fallback        *tls.Certificate
+	challengeTokens sync.Map //HTTP-01 token => key authorization
+	lastErrors      sync.Map //Hostname => last error
+	obtainMutex     sync.Mutex
+	renewTrigger    chan bool
+	stop            chan bool
+}
+
+func NewCertManager(option Option) (*CertManager, error) {
+	err := os.MkdirAll(filepath.Join(option.StoreFolder, "certs"), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	option.Database.NewTable("acme")
+	manager := CertManager{
+		option:       &option,
+		certs:        map[string]*managedCert{},
+		renewTrigger: make(chan bool, 1),
+	}
+	manager.settings = manager.loadSettings()
+
+	//Load the fallback certificate if exists
+	if option.FallbackCert != "" && fileExists(option.FallbackCert) && fileExists(option.FallbackKey) {
+		fallback, err := tls.LoadX509KeyPair(option.FallbackCert, option.FallbackKey)
+		if err != nil {
+			log.Println("[ACME] Unable to load certificate " + option.FallbackCert + ": " + err.Error())
+		} else {
+			manager.fallback = &fallback
+		}
+	}
+
+	//Load the previously obtained certificates
+	certFiles, _ := filepath.Glob(filepath.Join(option.StoreFolder, "certs", "*.crt"))
+	for _, certFile := range certFiles {
+		keyFile := strings.TrimSuffix(certFile, ".crt") + ".key"
+		cert, err := loadCertificate(certFile, keyFile)
+		if err != nil {
+			log.Println("[ACME] Unable to load certificate " + certFile + ": " + err.Error())
+			continue
+		}
+		manager.storeCertificate(cert)
+	}
+
+	return &manager, nil
+}
+
+func (m *CertManager) loadSettings() *Settings {
+	settings := Settings{
+		Enabled:           false,
+		DirectoryURL:      LetsEncryptURL,
+		Domains:           []string{},
+		IncludeProxyHosts: true,
+		Challenge:         ChallengeHTTP01,
+		DNSConfig:         map[string]string{},
+		DNSPropagation:    30,
+		RenewBefore:       defaultRenewBefore,
+	}
+	if m.option.Database.KeyExists("acme", "settings") {
+		m.option.Database.Read("acme", "settings", &settings)
+	}
+
+	if len(settings.DNSConfig) > 0 {
+		//Move the credentials stored in the database by older versions to the store folder
+		err := m.saveDNSConfig(settings.DNSConfig)
+		if err != nil {
+			log.Println("[ACME] Unable to move DNS provider config: " + err.Error())
+		} else {
+			m.option.Database.Write("acme", "settings", withoutDNSConfig(settings))
+		}
+	} else {
+		settings.DNSConfig = m.loadDNSConfig()
+	}
+	return &settings
+}
+
+func (m *CertManager) loadDNSConfig() map[string]string {
+	config := map[string]string{}
+	content, err := ioutil.ReadFile(filepath.Join(m.option.StoreFolder, dnsConfigFilename))
+	if err != nil {
+		return config
+	}
+	json.Unmarshal(content, &config)
+	return config
+}
+
+func (m *CertManager) saveDNSConfig(config map[string]string) error {
+	content, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	configFile := filepath.Join(m.option.StoreFolder, dnsConfigFilename)
+	err = ioutil.WriteFile(configFile, content, 0600)
+	if err != nil {
+		return err
+	}
+	//WriteFile does not change the permission of existing file
+	return os.Chmod(configFile, 0600)
+}
+
+//Get a copy of the settings that can be stored in the database
+func withoutDNSConfig(settings Settings) Settings {
+	settings.DNSConfig = map[string]string{}
+	return settings
+}
+
+//Get a copy of the current settings
+func (m *CertManager) GetSettings() Settings {
+	m.settingsMutex.RLock()
+	defer m.settingsMutex.RUnlock()
+	return *m.settings
+}
+
+//Update the settings and check the certificates again
+func (m *CertManager) SetSettings(settings Settings) error {
+	if settings.DirectoryURL == "" {
+		settings.DirectoryURL = LetsEncryptURL
+	}
+	if settings.RenewBefore <= 0 {
+		settings.RenewBefore = defaultRenewBefore
+	}
+	if settings.DNSConfig == nil {
+		settings.DNSConfig = map[string]string{}
+	}
+
+	if settings.Challenge != ChallengeHTTP01 && settings.Challenge != ChallengeDNS01 {
+		return errors.New("Unsupported challenge type")
+	}
+
+	if settings.Challenge == ChallengeDNS01 {
+		if _, err := newDNSProvider(settings.DNSProvider, settings.DNSConfig); err != nil {
+			return err
+		}
+	}
+
+	domains := []string{}
+	for _, domain := range settings.Domains {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain == "" {
+			continue
+		}
+		if strings.HasPrefix(domain, "*.") && settings.Challenge != ChallengeDNS01 {
+			return errors.New("Wildcard domain " + domain + " requires dns-01 challenge")
+		}
+		if !isValidHostname(domain) {
+			return errors.New("Invalid domain: " + domain)
+		}
+		domains = append(domains, domain)
+	}
+	settings.Domains = domains
+
+	m.settingsMutex.Lock()
+	m.settings = &settings
+	m.settingsMutex.Unlock()
+
+	err := m.saveDNSConfig(settings.DNSConfig)
+	if err != nil {
+		return err
+	}
+	err = m.option.Database.Write("acme", "settings", withoutDNSConfig(settings))
+	if err != nil {
+		return err
+	}
+
+	m.TriggerRenew()
+	return nil
+}
+
+/*
+	Certificate Store
+*/
+
+func (m *CertManager) storeCertificate(cert *tls.Certificate) {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return
+	}
+	cert.Leaf = leaf
+
+	m.certMutex.Lock()
+	defer m.certMutex.Unlock()
+	for _, name := range leaf.DNSNames {
+		m.certs[strings.ToLower(name)] = &managedCert{
+			Cert: cert,
+			Leaf: leaf,
+		}
+	}
+}
+
+//Get the certificate for the TLS handshake, for use as tls.Config.GetCertificate
+func (m *CertManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+	m.certMutex.RLock()
+	cert, ok := m.certs[name]
+	if !ok {
+		//Try wildcard certificate of the parent domain
+		if pos := strings.Index(name, "."); pos > 0 {
+			cert, ok = m.certs["*"+name[pos:]]
+		}
+	}
+	m.certMutex.RUnlock()
+
+	if ok {
+		return cert.Cert, nil
+	}
+
+	if m.fallback != nil {
+		return m.fallback, nil
+	}
+	return nil, errors.New("No certificate for " + name)
+}
+
+//Get the TLS config for serving with the managed certificates
+func (m *CertManager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: m.GetCertificate,
+	}
+}
+
+//List the managed certificates and the hostnames failed to obtain one
+func (m *CertManager) ListCertificates() []*CertificateInfo {
+	results := []*CertificateInfo{}
+	listed := map[string]bool{}
+
+	m.certMutex.RLock()
+	for domain, cert := range m.certs {
+		thisCert := &CertificateInfo{
+			Domain:    domain,
+			Issuer:    cert.Leaf.Issuer.CommonName,
+			NotBefore: cert.Leaf.NotBefore.Unix(),
+			NotAfter:  cert.Leaf.NotAfter.Unix(),
+		}
+		if lastError, ok := m.lastErrors.Load(domain); ok {
+			thisCert.Error = lastError.(string)
+		}
+		results = append(results, thisCert)
+		listed[domain] = true
+	}
+	m.certMutex.RUnlock()
+
+	m.lastErrors.Range(func(key, value interface{}) bool {
+		if !listed[key.(string)] {
+			results = append(results, &CertificateInfo{
+				Domain: key.(string),
+				Error:  value.(string),
+			})
+		}
+		return true
+	})
+	return results
+}
+
+//Remove the certificate of the hostname
+func (m *CertManager) RemoveCertificate(domain string) error {
+	domain = strings.ToLower(domain)
+	m.certMutex.Lock()
+	_, ok := m.certs[domain]
+	delete(m.certs, domain)
+	m.certMutex.Unlock()
+	m.lastErrors.Delete(domain)
+
+	if !ok {
+		return errors.New("Certificate not found")
+	}
+
+	certFile, keyFile := m.certificatePath(domain)
+	os.Remove(certFile)
+	os.Remove(keyFile)
+	return nil
+}
+
+func (m *CertManager) certificatePath(domain string) (string, string) {
+	filename := strings.Replace(domain, "*", "_wildcard", -1)
+	base := filepath.Join(m.option.StoreFolder, "certs", filename)
+	return base + ".crt", base + ".key"
+}
+
+func loadCertificate(certFile string, keyFile string) (*tls.Certificate, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+/*
+	HTTP-01 Challenge
+*/
+
+//Reply the HTTP-01 challenge if the request is for one. Return true if the request is handled
+func (m *CertManager) HandleHTTPChallenge(w http.ResponseWriter, r *http.Request) bool {
+	if !strings.HasPrefix(r.URL.Path, "/.well-known/acme-challenge/") {
+		return false
+	}
+
+	token := strings.TrimPrefix(r.URL.Path, "/.well-known/acme-challenge/")
+	keyAuth, ok := m.challengeTokens.Load(token)
+	if !ok {
+		return false
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(keyAuth.(string)))
+	return true
+}
+
+//Wrap the handler so HTTP-01 challenges are answered before reaching it
+func (m *CertManager) HTTPChallengeHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.HandleHTTPChallenge(w, r) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/*
+	Utilities
+*/
+
+func isValidHostname(hostname string) bool {
+	hostname = strings.TrimPrefix(hostname, "*.")
+	if hostname == "" || len(hostname) > 253 || net.ParseIP(hostname) != nil || !strings.Contains(hostname, ".") {
+		return false
+	}
+
+	for _, label := range strings.Split(hostname, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && c != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func encodePEM(blockType string, data []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data})
+}
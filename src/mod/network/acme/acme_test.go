@@ -0,0 +1,576 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	xacme "golang.org/x/crypto/acme"
+	"imuslab.com/arozos/mod/database"
+)
+
+/*
+	ACME Test Server
+
+	A minimal RFC 8555 server in the style of Pebble. Each order covers a single
+	identifier. Challenges are validated synchronously when accepted: http-01 by
+	fetching the key authorization from challengeURL, dns-01 by reading the TXT
+	records published through the "test" DNS provider.
+*/
+
+type testOrder struct {
+	ID          string
+	Domain      string
+	Token       string
+	Status      string
+	AuthzStatus string
+	CertPEM     []byte
+}
+
+type testCA struct {
+	server       *httptest.Server
+	key          *ecdsa.PrivateKey
+	cert         *x509.Certificate
+	certLifetime time.Duration
+	challengeURL string //Base URL answering the http-01 challenges
+
+	accountKey *ecdsa.PublicKey
+	orders     map[string]*testOrder
+	issued     int
+	dnsRecords map[string]string
+	mutex      sync.Mutex
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test ACME Root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	ca := &testCA{
+		key:          key,
+		cert:         cert,
+		certLifetime: 90 * 24 * time.Hour,
+		orders:       map[string]*testOrder{},
+		dnsRecords:   map[string]string{},
+	}
+	ca.server = httptest.NewServer(http.HandlerFunc(ca.serveHTTP))
+	return ca
+}
+
+func (ca *testCA) url(path string) string {
+	return ca.server.URL + path
+}
+
+func (ca *testCA) reply(w http.ResponseWriter, status int, location string, v interface{}) {
+	w.Header().Set("Replay-Nonce", strconv.FormatInt(time.Now().UnixNano(), 36))
+	if location != "" {
+		w.Header().Set("Location", location)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (ca *testCA) problem(w http.ResponseWriter, status int, detail string) {
+	ca.reply(w, status, "", map[string]string{"type": "urn:ietf:params:acme:error:malformed", "detail": detail})
+}
+
+//Decode the JWS request and verify the signature. Return the payload
+func (ca *testCA) readRequest(r *http.Request) ([]byte, error) {
+	body := struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	protectedJSON, err := base64.RawURLEncoding.DecodeString(body.Protected)
+	if err != nil {
+		return nil, err
+	}
+	protected := struct {
+		JWK *struct {
+			X string `json:"x"`
+			Y string `json:"y"`
+		} `json:"jwk"`
+	}{}
+	if err := json.Unmarshal(protectedJSON, &protected); err != nil {
+		return nil, err
+	}
+
+	ca.mutex.Lock()
+	if protected.JWK != nil {
+		x, _ := base64.RawURLEncoding.DecodeString(protected.JWK.X)
+		y, _ := base64.RawURLEncoding.DecodeString(protected.JWK.Y)
+		ca.accountKey = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	}
+	accountKey := ca.accountKey
+	ca.mutex.Unlock()
+	if accountKey == nil {
+		return nil, errors.New("account not registered")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(body.Signature)
+	if err != nil || len(signature) != 64 {
+		return nil, errors.New("invalid signature")
+	}
+	hash := sha256.Sum256([]byte(body.Protected + "." + body.Payload))
+	if !ecdsa.Verify(accountKey, hash[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		return nil, errors.New("signature verification failed")
+	}
+	return base64.RawURLEncoding.DecodeString(body.Payload)
+}
+
+func (ca *testCA) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/directory" {
+		ca.reply(w, http.StatusOK, "", map[string]string{
+			"newNonce":   ca.url("/nonce"),
+			"newAccount": ca.url("/account"),
+			"newOrder":   ca.url("/order"),
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		w.Header().Set("Replay-Nonce", strconv.FormatInt(time.Now().UnixNano(), 36))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	payload, err := ca.readRequest(r)
+	if err != nil {
+		ca.problem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] == "account" {
+		ca.reply(w, http.StatusCreated, ca.url("/account/1"), map[string]string{"status": "valid"})
+		return
+	}
+	if parts[0] == "order" && len(parts) == 1 {
+		ca.newOrder(w, payload)
+		return
+	}
+	if len(parts) != 2 {
+		ca.problem(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	ca.mutex.Lock()
+	order, ok := ca.orders[parts[1]]
+	ca.mutex.Unlock()
+	if !ok {
+		ca.problem(w, http.StatusNotFound, "order not found")
+		return
+	}
+
+	switch parts[0] {
+	case "order":
+		ca.replyOrder(w, http.StatusOK, order)
+	case "authz":
+		ca.replyAuthz(w, order)
+	case "challenge":
+		ca.validate(order, r.URL.Query().Get("type"))
+		ca.replyAuthz(w, order)
+	case "finalize":
+		ca.finalize(w, order, payload)
+	case "cert":
+		w.Header().Set("Replay-Nonce", strconv.FormatInt(time.Now().UnixNano(), 36))
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(order.CertPEM)
+	default:
+		ca.problem(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (ca *testCA) newOrder(w http.ResponseWriter, payload []byte) {
+	request := struct {
+		Identifiers []struct {
+			Value string `json:"value"`
+		} `json:"identifiers"`
+	}{}
+	if json.Unmarshal(payload, &request) != nil || len(request.Identifiers) != 1 {
+		ca.problem(w, http.StatusBadRequest, "exactly one identifier is supported")
+		return
+	}
+
+	ca.mutex.Lock()
+	order := &testOrder{
+		ID:          strconv.Itoa(len(ca.orders) + 1),
+		Domain:      request.Identifiers[0].Value,
+		Token:       base64.RawURLEncoding.EncodeToString([]byte("token-" + strconv.Itoa(len(ca.orders)+1))),
+		Status:      "pending",
+		AuthzStatus: "pending",
+	}
+	ca.orders[order.ID] = order
+	ca.mutex.Unlock()
+	ca.replyOrder(w, http.StatusCreated, order)
+}
+
+func (ca *testCA) replyOrder(w http.ResponseWriter, status int, order *testOrder) {
+	ca.mutex.Lock()
+	body := map[string]interface{}{
+		"status":         order.Status,
+		"identifiers":    []map[string]string{{"type": "dns", "value": order.Domain}},
+		"authorizations": []string{ca.url("/authz/" + order.ID)},
+		"finalize":       ca.url("/finalize/" + order.ID),
+	}
+	if order.CertPEM != nil {
+		body["certificate"] = ca.url("/cert/" + order.ID)
+	}
+	ca.mutex.Unlock()
+	ca.reply(w, status, ca.url("/order/"+order.ID), body)
+}
+
+func (ca *testCA) replyAuthz(w http.ResponseWriter, order *testOrder) {
+	challenges := []map[string]string{}
+	for _, challengeType := range []string{ChallengeHTTP01, ChallengeDNS01} {
+		if challengeType == ChallengeHTTP01 && strings.HasPrefix(order.Domain, "*.") {
+			continue
+		}
+		challenges = append(challenges, map[string]string{
+			"type":   challengeType,
+			"url":    ca.url("/challenge/" + order.ID + "?type=" + challengeType),
+			"token":  order.Token,
+			"status": order.AuthzStatus,
+		})
+	}
+
+	ca.mutex.Lock()
+	body := map[string]interface{}{
+		"status":     order.AuthzStatus,
+		"identifier": map[string]string{"type": "dns", "value": strings.TrimPrefix(order.Domain, "*.")},
+		"challenges": challenges,
+		"wildcard":   strings.HasPrefix(order.Domain, "*."),
+	}
+	ca.mutex.Unlock()
+	ca.reply(w, http.StatusOK, "", body)
+}
+
+//Check the key authorization of the challenge and update the order
+func (ca *testCA) validate(order *testOrder, challengeType string) {
+	thumbprint, _ := xacme.JWKThumbprint(ca.accountKey)
+	keyAuth := order.Token + "." + thumbprint
+
+	valid := false
+	if challengeType == ChallengeHTTP01 {
+		resp, err := http.Get(ca.challengeURL + "/.well-known/acme-challenge/" + order.Token)
+		if err == nil {
+			content, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			valid = resp.StatusCode == http.StatusOK && string(content) == keyAuth
+		}
+	} else if challengeType == ChallengeDNS01 {
+		hash := sha256.Sum256([]byte(keyAuth))
+		ca.mutex.Lock()
+		valid = ca.dnsRecords["_acme-challenge."+strings.TrimPrefix(order.Domain, "*.")] == base64.RawURLEncoding.EncodeToString(hash[:])
+		ca.mutex.Unlock()
+	}
+
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	if valid {
+		order.AuthzStatus = "valid"
+		order.Status = "ready"
+	} else {
+		order.AuthzStatus = "invalid"
+		order.Status = "invalid"
+	}
+}
+
+func (ca *testCA) finalize(w http.ResponseWriter, order *testOrder, payload []byte) {
+	ca.mutex.Lock()
+	ready := order.Status == "ready"
+	ca.mutex.Unlock()
+	if !ready {
+		ca.problem(w, http.StatusForbidden, "order is not ready")
+		return
+	}
+
+	request := struct {
+		CSR string `json:"csr"`
+	}{}
+	json.Unmarshal(payload, &request)
+	csrDER, _ := base64.RawURLEncoding.DecodeString(request.CSR)
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil || len(csr.DNSNames) != 1 || csr.DNSNames[0] != order.Domain {
+		ca.problem(w, http.StatusBadRequest, "invalid CSR")
+		return
+	}
+
+	ca.mutex.Lock()
+	ca.issued++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(ca.issued + 1)),
+		Subject:      pkix.Name{CommonName: order.Domain},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(ca.certLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, csr.PublicKey, ca.key)
+	if err == nil {
+		order.CertPEM = append(encodePEM("CERTIFICATE", der), encodePEM("CERTIFICATE", ca.cert.Raw)...)
+		order.Status = "valid"
+	}
+	ca.mutex.Unlock()
+	if err != nil {
+		ca.problem(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	ca.replyOrder(w, http.StatusOK, order)
+}
+
+func (ca *testCA) issuedCount() int {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	return ca.issued
+}
+
+/*
+	Test DNS provider, publishing the TXT records to the test server
+*/
+
+type testDNSProvider struct {
+	ca *testCA
+}
+
+func (p *testDNSProvider) Present(fqdn string, value string) error {
+	p.ca.mutex.Lock()
+	defer p.ca.mutex.Unlock()
+	p.ca.dnsRecords[fqdn] = value
+	return nil
+}
+
+func (p *testDNSProvider) CleanUp(fqdn string, value string) error {
+	p.ca.mutex.Lock()
+	defer p.ca.mutex.Unlock()
+	delete(p.ca.dnsRecords, fqdn)
+	return nil
+}
+
+/*
+	Tests
+*/
+
+type testEnv struct {
+	ca        *testCA
+	manager   *CertManager
+	db        *database.Database
+	store     string
+	challenge *httptest.Server
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	tmp, err := ioutil.TempDir("", "acmetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := database.NewDatabase(filepath.Join(tmp, "system.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := &testEnv{
+		ca:    newTestCA(t),
+		db:    db,
+		store: filepath.Join(tmp, "acme"),
+	}
+	env.manager = env.newManager(t)
+	env.challenge = httptest.NewServer(env.manager.HTTPChallengeHandler(http.NotFoundHandler()))
+	env.ca.challengeURL = env.challenge.URL
+
+	RegisterDNSProvider("test", func(config map[string]string) (DNSProvider, error) {
+		if config["token"] == "" {
+			return nil, errors.New("token is required")
+		}
+		return &testDNSProvider{ca: env.ca}, nil
+	})
+
+	t.Cleanup(func() {
+		env.challenge.Close()
+		env.ca.server.Close()
+		db.Close()
+		os.RemoveAll(tmp)
+	})
+	return env
+}
+
+func (env *testEnv) newManager(t *testing.T) *CertManager {
+	manager, err := NewCertManager(Option{
+		Database:    env.db,
+		StoreFolder: env.store,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manager
+}
+
+func (env *testEnv) setSettings(t *testing.T, settings Settings) {
+	settings.Enabled = true
+	settings.DirectoryURL = env.ca.url("/directory")
+	if err := env.manager.SetSettings(settings); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestObtainCertificateHTTP01(t *testing.T) {
+	env := newTestEnv(t)
+	env.setSettings(t, Settings{Domains: []string{"aroz.test"}, Challenge: ChallengeHTTP01})
+
+	if err := env.manager.ObtainCertificate("aroz.test"); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := env.manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "aroz.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf.Issuer.CommonName != "Test ACME Root" || cert.Leaf.DNSNames[0] != "aroz.test" {
+		t.Fatalf("unexpected certificate %v for %v", cert.Leaf.Issuer, cert.Leaf.DNSNames)
+	}
+	if _, err := env.manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.test"}); err == nil {
+		t.Error("certificate returned for a hostname without certificate")
+	}
+
+	//The certificate is loaded again after restart
+	restarted := env.newManager(t)
+	if _, err := restarted.GetCertificate(&tls.ClientHelloInfo{ServerName: "aroz.test"}); err != nil {
+		t.Error("certificate not loaded from store: " + err.Error())
+	}
+}
+
+func TestObtainCertificateDNS01Wildcard(t *testing.T) {
+	env := newTestEnv(t)
+	env.setSettings(t, Settings{
+		Domains:     []string{"*.aroz.test"},
+		Challenge:   ChallengeDNS01,
+		DNSProvider: "test",
+		DNSConfig:   map[string]string{"token": "secret-token"},
+	})
+
+	if err := env.manager.ObtainCertificate("*.aroz.test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "www.aroz.test"}); err != nil {
+		t.Error("wildcard certificate not served: " + err.Error())
+	}
+	if len(env.ca.dnsRecords) != 0 {
+		t.Error("TXT records not cleaned up")
+	}
+}
+
+func TestFailedChallenge(t *testing.T) {
+	env := newTestEnv(t)
+	env.setSettings(t, Settings{Domains: []string{"aroz.test"}, Challenge: ChallengeHTTP01})
+
+	//The challenge server is unreachable
+	env.challenge.Close()
+	if err := env.manager.ObtainCertificate("aroz.test"); err == nil {
+		t.Fatal("certificate obtained with failed challenge")
+	}
+
+	certs := env.manager.ListCertificates()
+	if len(certs) != 1 || certs[0].Domain != "aroz.test" || certs[0].Error == "" {
+		t.Errorf("error not listed: %+v", certs)
+	}
+}
+
+func TestRenewCertificates(t *testing.T) {
+	env := newTestEnv(t)
+	env.ca.certLifetime = 10 * 24 * time.Hour
+	env.setSettings(t, Settings{Domains: []string{"aroz.test"}, Challenge: ChallengeHTTP01, RenewBefore: 5})
+
+	env.manager.RenewCertificates()
+	if env.ca.issuedCount() != 1 {
+		t.Fatalf("expect 1 certificate issued, got %d", env.ca.issuedCount())
+	}
+
+	//Not expiring within 5 days
+	env.manager.RenewCertificates()
+	if env.ca.issuedCount() != 1 {
+		t.Fatalf("certificate renewed before the renew window")
+	}
+
+	//Expiring within 30 days
+	env.setSettings(t, Settings{Domains: []string{"aroz.test"}, Challenge: ChallengeHTTP01, RenewBefore: 30})
+	env.manager.RenewCertificates()
+	if env.ca.issuedCount() != 2 {
+		t.Fatalf("certificate not renewed within the renew window")
+	}
+}
+
+func TestDNSConfigNotInDatabase(t *testing.T) {
+	env := newTestEnv(t)
+	env.setSettings(t, Settings{
+		Domains:     []string{"*.aroz.test"},
+		Challenge:   ChallengeDNS01,
+		DNSProvider: "test",
+		DNSConfig:   map[string]string{"token": "secret-token"},
+	})
+
+	stored := Settings{}
+	env.db.Read("acme", "settings", &stored)
+	if len(stored.DNSConfig) != 0 {
+		t.Error("DNS credentials stored in the database")
+	}
+
+	info, err := os.Stat(filepath.Join(env.store, dnsConfigFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("DNS credentials file has permission %v", info.Mode().Perm())
+	}
+	if env.newManager(t).GetSettings().DNSConfig["token"] != "secret-token" {
+		t.Error("DNS credentials not loaded after restart")
+	}
+
+	//Credentials stored in the database by older versions are moved out
+	stored.DNSConfig = map[string]string{"token": "legacy-token"}
+	env.db.Write("acme", "settings", stored)
+	if env.newManager(t).GetSettings().DNSConfig["token"] != "legacy-token" {
+		t.Error("legacy DNS credentials not loaded")
+	}
+	stored = Settings{}
+	env.db.Read("acme", "settings", &stored)
+	if len(stored.DNSConfig) != 0 {
+		t.Error("legacy DNS credentials not removed from the database")
+	}
+}
@@ -0,0 +1,193 @@
+package acme
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	DNS-01 Provider Plugins
+
+	A DNS provider create and remove the TXT record for the dns-01 challenge.
+	Providers are registered by name with a factory that build the provider
+	from the key-value configuration set by admin.
+
+	Built-in providers:
+	exec        => Run a script, command=/path/to/script. Called with "present" or "cleanup", the record name and value
+	cloudflare  => Cloudflare API, token=API token with DNS edit permission, zone=Zone ID
+*/
+
+type DNSProvider interface {
+	Present(fqdn string, value string) error
+	CleanUp(fqdn string, value string) error
+}
+
+type DNSProviderFactory func(config map[string]string) (DNSProvider, error)
+
+var (
+	dnsProviders      = map[string]DNSProviderFactory{}
+	dnsProvidersMutex sync.RWMutex
+)
+
+func init() {
+	RegisterDNSProvider("exec", newExecProvider)
+	RegisterDNSProvider("cloudflare", newCloudflareProvider)
+}
+
+//Register a DNS provider plugin
+func RegisterDNSProvider(name string, factory DNSProviderFactory) {
+	dnsProvidersMutex.Lock()
+	defer dnsProvidersMutex.Unlock()
+	dnsProviders[name] = factory
+}
+
+//List the names of the registered DNS providers
+func ListDNSProviders() []string {
+	dnsProvidersMutex.RLock()
+	defer dnsProvidersMutex.RUnlock()
+	results := []string{}
+	for name := range dnsProviders {
+		results = append(results, name)
+	}
+	sort.Strings(results)
+	return results
+}
+
+func newDNSProvider(name string, config map[string]string) (DNSProvider, error) {
+	dnsProvidersMutex.RLock()
+	factory, ok := dnsProviders[name]
+	dnsProvidersMutex.RUnlock()
+	if !ok {
+		return nil, errors.New("DNS provider not found: " + name)
+	}
+	return factory(config)
+}
+
+/*
+	Exec Provider
+*/
+
+type execProvider struct {
+	command string
+}
+
+func newExecProvider(config map[string]string) (DNSProvider, error) {
+	command := strings.TrimSpace(config["command"])
+	if command == "" {
+		return nil, errors.New("exec provider require command")
+	}
+	return &execProvider{command: command}, nil
+}
+
+func (p *execProvider) run(action string, fqdn string, value string) error {
+	output, err := exec.Command(p.command, action, fqdn, value).CombinedOutput()
+	if err != nil {
+		return errors.New(action + " failed: " + strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (p *execProvider) Present(fqdn string, value string) error {
+	return p.run("present", fqdn, value)
+}
+
+func (p *execProvider) CleanUp(fqdn string, value string) error {
+	return p.run("cleanup", fqdn, value)
+}
+
+/*
+	Cloudflare Provider
+*/
+
+type cloudflareProvider struct {
+	token   string
+	zone    string
+	client  *http.Client
+	records sync.Map //fqdn + value => record ID
+}
+
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result struct {
+		ID string `json:"id"`
+	} `json:"result"`
+}
+
+func newCloudflareProvider(config map[string]string) (DNSProvider, error) {
+	if config["token"] == "" || config["zone"] == "" {
+		return nil, errors.New("cloudflare provider require token and zone")
+	}
+	return &cloudflareProvider{
+		token:  config["token"],
+		zone:   config["zone"],
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (p *cloudflareProvider) request(method string, path string, body interface{}) (*cloudflareResponse, error) {
+	payload := []byte{}
+	if body != nil {
+		payload, _ = json.Marshal(body)
+	}
+
+	req, err := http.NewRequest(method, "https://api.cloudflare.com/client/v4/zones/"+p.zone+"/dns_records"+path, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := cloudflareResponse{}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+	if !result.Success {
+		message := "Cloudflare request failed"
+		if len(result.Errors) > 0 {
+			message = result.Errors[0].Message
+		}
+		return nil, errors.New(message)
+	}
+	return &result, nil
+}
+
+func (p *cloudflareProvider) Present(fqdn string, value string) error {
+	result, err := p.request("POST", "", map[string]interface{}{
+		"type":    "TXT",
+		"name":    fqdn,
+		"content": value,
+		"ttl":     120,
+	})
+	if err != nil {
+		return err
+	}
+	p.records.Store(fqdn+" "+value, result.Result.ID)
+	return nil
+}
+
+func (p *cloudflareProvider) CleanUp(fqdn string, value string) error {
+	id, ok := p.records.Load(fqdn + " " + value)
+	if !ok {
+		return nil
+	}
+	p.records.Delete(fqdn + " " + value)
+	_, err := p.request("DELETE", "/"+id.(string), nil)
+	return err
+}
@@ -0,0 +1,99 @@
+package acme
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+/*
+	Handle the ACME settings
+
+	GET:
+	(Empty) => Get the settings and the list of DNS providers
+
+	POST:
+	settings={Settings JSON} => Update the settings
+*/
+func (m *CertManager) HandleSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		type reply struct {
+			Settings     Settings
+			DNSProviders []string
+		}
+		js, _ := json.Marshal(reply{
+			Settings:     m.GetSettings(),
+			DNSProviders: ListDNSProviders(),
+		})
+		sendJSONResponse(w, string(js))
+		return
+	}
+
+	settingsJSON, err := mv(r, "settings", true)
+	if err != nil {
+		sendErrorResponse(w, "Invalid settings given")
+		return
+	}
+
+	settings := Settings{}
+	err = json.Unmarshal([]byte(settingsJSON), &settings)
+	if err != nil {
+		sendErrorResponse(w, "Invalid settings given")
+		return
+	}
+
+	err = m.SetSettings(settings)
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+	sendOK(w)
+}
+
+/*
+	Handle the certificates
+
+	GET:
+	(Empty) => List the certificates
+
+	POST:
+	opr=renew&domain={hostname}  => Obtain a new certificate for the hostname now
+	opr=remove&domain={hostname} => Remove the certificate of the hostname
+*/
+func (m *CertManager) HandleCertificates(w http.ResponseWriter, r *http.Request) {
+	opr, _ := mv(r, "opr", true)
+	if opr == "" {
+		js, _ := json.Marshal(m.ListCertificates())
+		sendJSONResponse(w, string(js))
+		return
+	}
+
+	domain, err := mv(r, "domain", true)
+	if err != nil {
+		sendErrorResponse(w, "Invalid domain given")
+		return
+	}
+
+	if opr == "renew" {
+		if !isValidHostname(strings.ToLower(domain)) {
+			sendErrorResponse(w, "Invalid domain given")
+			return
+		}
+
+		err = m.ObtainCertificate(domain)
+		if err != nil {
+			sendErrorResponse(w, strings.Replace(err.Error(), "\"", "'", -1))
+			return
+		}
+		sendOK(w)
+	} else if opr == "remove" {
+		err = m.RemoveCertificate(domain)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+		sendOK(w)
+	} else {
+		sendErrorResponse(w, "Unknown operation")
+	}
+}
@@ -0,0 +1,338 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	xacme "golang.org/x/crypto/acme"
+)
+
+/*
+	Certificate Issuing
+
+	Each hostname get its own certificate, so adding or removing a hostname
+	never affect the certificates of the others
+*/
+
+const (
+	obtainTimeout = 5 * time.Minute
+)
+
+//Load the ACME account key, or create one if not exists
+func (m *CertManager) accountKey() (*ecdsa.PrivateKey, error) {
+	keyFile := filepath.Join(m.option.StoreFolder, "account.key")
+	if fileExists(keyFile) {
+		keyPEM, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(keyPEM)
+		if block == nil {
+			return nil, errors.New("Invalid account key")
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(keyFile, encodePEM("EC PRIVATE KEY", der), 0600)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+//Create an ACME client with registered account
+func (m *CertManager) newClient(ctx context.Context, settings Settings) (*xacme.Client, error) {
+	key, err := m.accountKey()
+	if err != nil {
+		return nil, err
+	}
+
+	client := &xacme.Client{
+		Key:          key,
+		DirectoryURL: settings.DirectoryURL,
+		HTTPClient:   m.option.HTTPClient,
+		UserAgent:    "arozos",
+	}
+
+	account := &xacme.Account{}
+	if settings.Email != "" {
+		account.Contact = []string{"mailto:" + settings.Email}
+	}
+	_, err = client.Register(ctx, account, xacme.AcceptTOS)
+	if err != nil && err != xacme.ErrAccountAlreadyExists {
+		return nil, err
+	}
+	return client, nil
+}
+
+//Obtain a new certificate for the hostname and start serving it
+func (m *CertManager) ObtainCertificate(domain string) error {
+	m.obtainMutex.Lock()
+	defer m.obtainMutex.Unlock()
+
+	domain = strings.ToLower(domain)
+	err := m.obtainCertificate(domain)
+	if err != nil {
+		m.lastErrors.Store(domain, err.Error())
+		return err
+	}
+	m.lastErrors.Delete(domain)
+	return nil
+}
+
+func (m *CertManager) obtainCertificate(domain string) error {
+	settings := m.GetSettings()
+	if strings.HasPrefix(domain, "*.") && settings.Challenge != ChallengeDNS01 {
+		return errors.New("Wildcard domain requires dns-01 challenge")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), obtainTimeout)
+	defer cancel()
+
+	client, err := m.newClient(ctx, settings)
+	if err != nil {
+		return err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, xacme.DomainIDs(domain))
+	if err != nil {
+		return err
+	}
+
+	//Complete the challenges of the pending authorizations
+	for _, authzURL := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, authzURL)
+		if err != nil {
+			return err
+		}
+		if authz.Status == xacme.StatusValid {
+			continue
+		}
+
+		err = m.completeChallenge(ctx, client, authz, settings)
+		if err != nil {
+			return err
+		}
+	}
+
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return err
+	}
+
+	//Create a new key and request the certificate with it
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domain},
+		DNSNames: []string{domain},
+	}, key)
+	if err != nil {
+		return err
+	}
+
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return err
+	}
+
+	certPEM := []byte{}
+	for _, der := range chain {
+		certPEM = append(certPEM, encodePEM("CERTIFICATE", der)...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	certFile, keyFile := m.certificatePath(domain)
+	err = ioutil.WriteFile(keyFile, encodePEM("EC PRIVATE KEY", keyDER), 0600)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(certFile, certPEM, 0600)
+	if err != nil {
+		return err
+	}
+
+	cert, err := loadCertificate(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	m.storeCertificate(cert)
+	log.Println("[ACME] Certificate obtained for " + domain)
+	return nil
+}
+
+func (m *CertManager) completeChallenge(ctx context.Context, client *xacme.Client, authz *xacme.Authorization, settings Settings) error {
+	var challenge *xacme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == settings.Challenge {
+			challenge = c
+		}
+	}
+	if challenge == nil {
+		return errors.New("ACME server does not offer " + settings.Challenge + " challenge for " + authz.Identifier.Value)
+	}
+
+	if settings.Challenge == ChallengeHTTP01 {
+		keyAuth, err := client.HTTP01ChallengeResponse(challenge.Token)
+		if err != nil {
+			return err
+		}
+		m.challengeTokens.Store(challenge.Token, keyAuth)
+		defer m.challengeTokens.Delete(challenge.Token)
+	} else {
+		provider, err := newDNSProvider(settings.DNSProvider, settings.DNSConfig)
+		if err != nil {
+			return err
+		}
+		value, err := client.DNS01ChallengeRecord(challenge.Token)
+		if err != nil {
+			return err
+		}
+
+		fqdn := "_acme-challenge." + strings.TrimPrefix(authz.Identifier.Value, "*.")
+		err = provider.Present(fqdn, value)
+		if err != nil {
+			return err
+		}
+		defer provider.CleanUp(fqdn, value)
+
+		//Wait for the record to propagate
+		select {
+		case <-time.After(time.Duration(settings.DNSPropagation) * time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	_, err := client.Accept(ctx, challenge)
+	if err != nil {
+		return err
+	}
+	_, err = client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+/*
+	Renewal
+*/
+
+//Get the hostnames that should have a certificate
+func (m *CertManager) desiredHostnames() []string {
+	settings := m.GetSettings()
+	hostnames := append([]string{}, settings.Domains...)
+	if settings.IncludeProxyHosts && m.option.ExtraHostnames != nil {
+		for _, hostname := range m.option.ExtraHostnames() {
+			hostname = strings.ToLower(hostname)
+			if isValidHostname(hostname) {
+				hostnames = append(hostnames, hostname)
+			}
+		}
+	}
+
+	results := []string{}
+	seen := map[string]bool{}
+	for _, hostname := range hostnames {
+		if !seen[hostname] {
+			results = append(results, hostname)
+			seen[hostname] = true
+		}
+	}
+	return results
+}
+
+//Check if the hostname need a new certificate
+func (m *CertManager) needRenew(domain string, renewBefore int) bool {
+	m.certMutex.RLock()
+	cert, ok := m.certs[domain]
+	m.certMutex.RUnlock()
+	if !ok {
+		return true
+	}
+	return time.Until(cert.Leaf.NotAfter) < time.Duration(renewBefore)*24*time.Hour
+}
+
+//Obtain or renew the certificates of all the hostnames that require one
+func (m *CertManager) RenewCertificates() {
+	settings := m.GetSettings()
+	if !settings.Enabled {
+		return
+	}
+
+	for _, domain := range m.desiredHostnames() {
+		if !m.needRenew(domain, settings.RenewBefore) {
+			continue
+		}
+
+		if strings.HasPrefix(domain, "*.") && settings.Challenge != ChallengeDNS01 {
+			continue
+		}
+
+		err := m.ObtainCertificate(domain)
+		if err != nil {
+			log.Println("[ACME] Unable to obtain certificate for " + domain + ": " + err.Error())
+		}
+	}
+}
+
+//Request a certificate check in the background, e.g. after hostnames changed
+func (m *CertManager) TriggerRenew() {
+	select {
+	case m.renewTrigger <- true:
+	default:
+		//Check already pending
+	}
+}
+
+//Start the renewal loop
+func (m *CertManager) Start() {
+	if m.stop != nil {
+		return
+	}
+	m.stop = make(chan bool)
+	go func(stop chan bool) {
+		ticker := time.NewTicker(renewCheckInterval)
+		defer ticker.Stop()
+		m.RenewCertificates()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				m.RenewCertificates()
+			case <-m.renewTrigger:
+				m.RenewCertificates()
+			}
+		}
+	}(m.stop)
+}
+
+func (m *CertManager) Stop() {
+	if m.stop != nil {
+		close(m.stop)
+		m.stop = nil
+	}
+}
@@ -0,0 +1,279 @@
+package bandwidth
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	db "imuslab.com/arozos/mod/database"
+	user "imuslab.com/arozos/mod/user"
+)
+
+/*
+	Bandwidth Limiter
+
+	Token bucket rate limits on upload and download, configured per
+	permission group and per protocol. Each user get their own buckets, so
+	one user cannot take the bandwidth of the others. Connections of users
+	in multiple groups use the most permissive limits of the groups.
+
+	Anonymous traffic (e.g. share links opened without login) share a
+	single set of buckets, and the connection cap is applied per IP address.
+*/
+
+const (
+	ProtocolWeb        = "web"        //File uploads, downloads and media streaming of the web desktop
+	ProtocolShare      = "share"      //Share links
+	ProtocolFTP        = "ftp"        //FTP and SFTP
+	ProtocolWebDAV     = "webdav"     //WebDAV
+	ProtocolSubservice = "subservice" //Subservice reverse proxy
+)
+
+//All protocols that can be limited
+var Protocols = []string{ProtocolWeb, ProtocolShare, ProtocolFTP, ProtocolWebDAV, ProtocolSubservice}
+
+var ErrTooManyConnections = errors.New("Too many concurrent connections")
+
+//Rate limits in bytes per second, 0 for unlimited
+type Limit struct {
+	Upload   int64
+	Download int64
+}
+
+type GroupLimit struct {
+	Limits         map[string]Limit //Limits by protocol
+	MaxConnections int              //Concurrent connections per user, 0 for unlimited
+}
+
+type Options struct {
+	UserHandler *user.UserHandler
+	Database    *db.Database
+}
+
+type Controller struct {
+	Options     Options
+	groups      map[string]*GroupLimit
+	anonymous   *GroupLimit
+	buckets     map[string]*bucket
+	connections map[int64]*Connection
+	nextID      int64
+	mutex       sync.Mutex
+}
+
+func NewController(option Options) (*Controller, error) {
+	err := option.Database.NewTable("bandwidth")
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Controller{
+		Options:     option,
+		groups:      map[string]*GroupLimit{},
+		anonymous:   newGroupLimit(),
+		buckets:     map[string]*bucket{},
+		connections: map[int64]*Connection{},
+	}
+
+	//Load the limits
+	entries, _ := option.Database.ListTable("bandwidth")
+	for _, keypairs := range entries {
+		key := string(keypairs[0])
+		limit := newGroupLimit()
+		option.Database.Read("bandwidth", key, limit)
+		if key == "anonymous" {
+			c.anonymous = limit
+		} else if strings.HasPrefix(key, "group/") {
+			c.groups[strings.TrimPrefix(key, "group/")] = limit
+		}
+	}
+
+	go c.sampleLoop()
+	return c, nil
+}
+
+func newGroupLimit() *GroupLimit {
+	return &GroupLimit{
+		Limits: map[string]Limit{},
+	}
+}
+
+func validateGroupLimit(limit *GroupLimit) error {
+	if limit.MaxConnections < 0 {
+		return errors.New("Invalid connection limit")
+	}
+	if limit.Limits == nil {
+		limit.Limits = map[string]Limit{}
+	}
+	for protocol, l := range limit.Limits {
+		if !inArray(Protocols, protocol) {
+			return errors.New("Unknown protocol " + protocol)
+		}
+		if l.Upload < 0 || l.Download < 0 {
+			return errors.New("Invalid rate limit for " + protocol)
+		}
+	}
+	return nil
+}
+
+//Get the limits of the permission group. Groups without limits return an empty GroupLimit
+func (c *Controller) GetGroupLimit(groupname string) GroupLimit {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if limit, ok := c.groups[groupname]; ok {
+		return copyGroupLimit(limit)
+	}
+	return *newGroupLimit()
+}
+
+//Set the limits of the permission group. Active connections follow the new limits immediately
+func (c *Controller) SetGroupLimit(groupname string, limit GroupLimit) error {
+	err := validateGroupLimit(&limit)
+	if err != nil {
+		return err
+	}
+	err = c.Options.Database.Write("bandwidth", "group/"+groupname, limit)
+	if err != nil {
+		return err
+	}
+
+	newLimit := copyGroupLimit(&limit)
+	c.mutex.Lock()
+	c.groups[groupname] = &newLimit
+	c.mutex.Unlock()
+	c.refreshLimits()
+	return nil
+}
+
+func (c *Controller) GetAnonymousLimit() GroupLimit {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return copyGroupLimit(c.anonymous)
+}
+
+//Set the limits of the anonymous traffic. The connection limit is applied per IP address
+func (c *Controller) SetAnonymousLimit(limit GroupLimit) error {
+	err := validateGroupLimit(&limit)
+	if err != nil {
+		return err
+	}
+	err = c.Options.Database.Write("bandwidth", "anonymous", limit)
+	if err != nil {
+		return err
+	}
+
+	newLimit := copyGroupLimit(&limit)
+	c.mutex.Lock()
+	c.anonymous = &newLimit
+	c.mutex.Unlock()
+	c.refreshLimits()
+	return nil
+}
+
+func copyGroupLimit(limit *GroupLimit) GroupLimit {
+	result := GroupLimit{
+		Limits:         map[string]Limit{},
+		MaxConnections: limit.MaxConnections,
+	}
+	for protocol, l := range limit.Limits {
+		result.Limits[protocol] = l
+	}
+	return result
+}
+
+//Get the effective limits of the user on the protocol, using the most permissive limits in the user's groups
+func (c *Controller) effectiveLimit(username string, protocol string) (Limit, int) {
+	if username == "" {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		return c.anonymous.Limits[protocol], c.anonymous.MaxConnections
+	}
+
+	groupnames := []string{}
+	userinfo, err := c.Options.UserHandler.GetUserInfoFromUsername(username)
+	if err == nil {
+		for _, group := range userinfo.PermissionGroup {
+			groupnames = append(groupnames, group.Name)
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(groupnames) == 0 {
+		return Limit{}, 0
+	}
+
+	result := Limit{Upload: -1, Download: -1}
+	maxConnections := -1
+	for _, groupname := range groupnames {
+		groupLimit, ok := c.groups[groupname]
+		if !ok {
+			//No limit on this group
+			return Limit{}, 0
+		}
+		limit := groupLimit.Limits[protocol]
+		result.Upload = mostPermissive(result.Upload, limit.Upload)
+		result.Download = mostPermissive(result.Download, limit.Download)
+		maxConnections = int(mostPermissive(int64(maxConnections), int64(groupLimit.MaxConnections)))
+	}
+	return result, maxConnections
+}
+
+//Return the larger limit, treating 0 as unlimited and -1 as not set
+func mostPermissive(current int64, value int64) int64 {
+	if current == 0 || value == 0 {
+		return 0
+	}
+	if value > current {
+		return value
+	}
+	return current
+}
+
+//Apply the current limits to the buckets of the active connections
+func (c *Controller) refreshLimits() {
+	c.mutex.Lock()
+	connections := []*Connection{}
+	for _, conn := range c.connections {
+		connections = append(connections, conn)
+	}
+	c.mutex.Unlock()
+
+	for _, conn := range connections {
+		limit, _ := c.effectiveLimit(conn.Username, conn.Protocol)
+		conn.upload.setRate(limit.Upload)
+		conn.download.setRate(limit.Download)
+	}
+}
+
+//Get the shared bucket of the user and protocol. Must be called with the mutex locked
+func (c *Controller) getBucket(key string, rate int64) *bucket {
+	b, ok := c.buckets[key]
+	if !ok {
+		b = newBucket(key)
+		c.buckets[key] = b
+	}
+	b.setRate(rate)
+	b.refs++
+	return b
+}
+
+//Must be called with the mutex locked
+func (c *Controller) releaseBucket(b *bucket) {
+	b.refs--
+	if b.refs <= 0 {
+		delete(c.buckets, b.key)
+	}
+}
+
+//Update the throughput of the connections every second
+func (c *Controller) sampleLoop() {
+	ticker := time.NewTicker(time.Second)
+	for range ticker.C {
+		c.mutex.Lock()
+		for _, conn := range c.connections {
+			conn.sample()
+		}
+		c.mutex.Unlock()
+	}
+}
@@ -0,0 +1,71 @@
+package bandwidth
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+	Token Bucket
+
+	The bucket refill at the rate limit and hold at most one second of tokens.
+	Transfers larger than the tokens available take the bucket into debt and
+	wait until it is paid back, so concurrent transfers share the rate fairly.
+*/
+
+type bucket struct {
+	key        string
+	rate       float64 //Bytes per second, 0 for unlimited
+	tokens     float64
+	lastUpdate time.Time
+	refs       int //Number of connections using this bucket
+	mutex      sync.Mutex
+}
+
+func newBucket(key string) *bucket {
+	return &bucket{
+		key:        key,
+		lastUpdate: time.Now(),
+	}
+}
+
+func (b *bucket) setRate(rate int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if float64(rate) != b.rate {
+		b.rate = float64(rate)
+		b.tokens = b.rate
+		b.lastUpdate = time.Now()
+	}
+}
+
+func (b *bucket) getRate() int64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return int64(b.rate)
+}
+
+//Take n tokens from the bucket and wait until the bucket is no longer in debt
+func (b *bucket) wait(n int) {
+	b.mutex.Lock()
+	if b.rate <= 0 {
+		b.mutex.Unlock()
+		return
+	}
+	now := time.Now()
+	b.tokens += now.Sub(b.lastUpdate).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.lastUpdate = now
+	b.tokens -= float64(n)
+	delay := time.Duration(0)
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mutex.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,193 @@
+package bandwidth
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	Connections
+
+	A connection is a HTTP request, a FTP session or a SFTP session. The data
+	passing through the connection is throttled with the buckets of the user
+	and counted for the live throughput view.
+*/
+
+const chunkSize = 16 << 10 //Maximum bytes sent or received between each throttling
+
+type Connection struct {
+	//Accessed atomically, keep at the top for 64-bit alignment on 32-bit platforms
+	bytesIn  int64
+	bytesOut int64
+
+	ID          int64
+	Username    string //Empty for anonymous
+	Protocol    string
+	RemoteAddr  string
+	Description string
+	StartTime   int64
+	RateIn      int64 //Upload throughput in bytes per second
+	RateOut     int64 //Download throughput in bytes per second
+
+	lastIn     int64
+	lastOut    int64
+	upload     *bucket
+	download   *bucket
+	controller *Controller
+	closed     int32
+}
+
+//Open a connection for the user. Empty username for anonymous. Return ErrTooManyConnections if the user reached the connection limit.
+//A nil Controller return a nil Connection, which transfer without limits
+func (c *Controller) Open(protocol string, username string, remoteAddr string, description string) (*Connection, error) {
+	if c == nil {
+		return nil, nil
+	}
+	limit, maxConnections := c.effectiveLimit(username, protocol)
+	clientIP := remoteIP(remoteAddr)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if maxConnections > 0 {
+		counter := 0
+		for _, conn := range c.connections {
+			if conn.Username == username && (username != "" || remoteIP(conn.RemoteAddr) == clientIP) {
+				counter++
+			}
+		}
+		if counter >= maxConnections {
+			return nil, ErrTooManyConnections
+		}
+	}
+
+	c.nextID++
+	conn := Connection{
+		ID:          c.nextID,
+		Username:    username,
+		Protocol:    protocol,
+		RemoteAddr:  remoteAddr,
+		Description: description,
+		StartTime:   time.Now().Unix(),
+		upload:      c.getBucket(username+"/"+protocol+"/up", limit.Upload),
+		download:    c.getBucket(username+"/"+protocol+"/down", limit.Download),
+		controller:  c,
+	}
+	c.connections[conn.ID] = &conn
+	return &conn, nil
+}
+
+//Close the connection and release the buckets. Safe to be called more than once
+func (conn *Connection) Close() {
+	if conn == nil || !atomic.CompareAndSwapInt32(&conn.closed, 0, 1) {
+		return
+	}
+	c := conn.controller
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.connections, conn.ID)
+	c.releaseBucket(conn.upload)
+	c.releaseBucket(conn.download)
+}
+
+//Set the description shown in the live view, e.g. the file being transferred
+func (conn *Connection) SetDescription(description string) {
+	if conn == nil {
+		return
+	}
+	conn.controller.mutex.Lock()
+	conn.Description = description
+	conn.controller.mutex.Unlock()
+}
+
+//Wrap the reader of the data uploaded by the client
+func (conn *Connection) UploadReader(r io.Reader) io.Reader {
+	if conn == nil {
+		return r
+	}
+	return &throttledReader{r: r, bucket: conn.upload, counter: &conn.bytesIn}
+}
+
+//Wrap the writer of the data uploaded by the client, e.g. the file being uploaded
+func (conn *Connection) UploadWriter(w io.Writer) io.Writer {
+	if conn == nil {
+		return w
+	}
+	return &throttledWriter{w: w, bucket: conn.upload, counter: &conn.bytesIn}
+}
+
+//Wrap the reader of the data downloaded by the client, e.g. the file being downloaded
+func (conn *Connection) DownloadReader(r io.Reader) io.Reader {
+	if conn == nil {
+		return r
+	}
+	return &throttledReader{r: r, bucket: conn.download, counter: &conn.bytesOut}
+}
+
+//Wrap the writer of the data downloaded by the client
+func (conn *Connection) DownloadWriter(w io.Writer) io.Writer {
+	if conn == nil {
+		return w
+	}
+	return &throttledWriter{w: w, bucket: conn.download, counter: &conn.bytesOut}
+}
+
+//Update the throughput. Must be called with the controller mutex locked
+func (conn *Connection) sample() {
+	bytesIn := atomic.LoadInt64(&conn.bytesIn)
+	bytesOut := atomic.LoadInt64(&conn.bytesOut)
+	conn.RateIn = bytesIn - conn.lastIn
+	conn.RateOut = bytesOut - conn.lastOut
+	conn.lastIn = bytesIn
+	conn.lastOut = bytesOut
+}
+
+func (conn *Connection) BytesIn() int64 {
+	return atomic.LoadInt64(&conn.bytesIn)
+}
+
+func (conn *Connection) BytesOut() int64 {
+	return atomic.LoadInt64(&conn.bytesOut)
+}
+
+type throttledReader struct {
+	r       io.Reader
+	bucket  *bucket
+	counter *int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > chunkSize {
+		p = p[:chunkSize]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		atomic.AddInt64(t.counter, int64(n))
+		t.bucket.wait(n)
+	}
+	return n, err
+}
+
+type throttledWriter struct {
+	w       io.Writer
+	bucket  *bucket
+	counter *int64
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		end := written + chunkSize
+		if end > len(p) {
+			end = len(p)
+		}
+		t.bucket.wait(end - written)
+		n, err := t.w.Write(p[written:end])
+		written += n
+		atomic.AddInt64(t.counter, int64(n))
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,131 @@
+package bandwidth
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+/*
+	Bandwidth Handlers
+
+	Admin endpoints for the limit settings and the live throughput view
+*/
+
+//Get or set the limits. Set with group (empty for anonymous) and limit (GroupLimit in JSON)
+func (c *Controller) HandleLimits(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		type groupEntry struct {
+			Name  string
+			Limit GroupLimit
+		}
+		groups := []groupEntry{}
+		for _, group := range c.Options.UserHandler.GetPermissionHandler().PermissionGroups {
+			groups = append(groups, groupEntry{group.Name, c.GetGroupLimit(group.Name)})
+		}
+		js, _ := json.Marshal(struct {
+			Protocols []string
+			Groups    []groupEntry
+			Anonymous GroupLimit
+		}{Protocols, groups, c.GetAnonymousLimit()})
+		sendJSONResponse(w, string(js))
+		return
+	}
+
+	group, _ := mv(r, "group", true)
+	limitJSON, err := mv(r, "limit", true)
+	if err != nil {
+		sendErrorResponse(w, "Invalid limit given")
+		return
+	}
+	limit := GroupLimit{}
+	err = json.Unmarshal([]byte(limitJSON), &limit)
+	if err != nil {
+		sendErrorResponse(w, "Invalid limit given")
+		return
+	}
+
+	if group == "" {
+		err = c.SetAnonymousLimit(limit)
+	} else {
+		if !c.Options.UserHandler.GetPermissionHandler().GroupExists(group) {
+			sendErrorResponse(w, "Group not exists")
+			return
+		}
+		err = c.SetGroupLimit(group, limit)
+	}
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+	sendOK(w)
+}
+
+type UserThroughput struct {
+	Username    string
+	Connections int
+	RateIn      int64
+	RateOut     int64
+}
+
+//List the active connections and the throughput of each user
+func (c *Controller) HandleLiveView(w http.ResponseWriter, r *http.Request) {
+	type connectionStatus struct {
+		ID          int64
+		Username    string
+		Protocol    string
+		RemoteAddr  string
+		Description string
+		StartTime   int64
+		BytesIn     int64
+		BytesOut    int64
+		RateIn      int64
+		RateOut     int64
+		LimitIn     int64
+		LimitOut    int64
+	}
+
+	c.mutex.Lock()
+	connections := []connectionStatus{}
+	users := map[string]*UserThroughput{}
+	for _, conn := range c.connections {
+		connections = append(connections, connectionStatus{
+			ID:          conn.ID,
+			Username:    conn.Username,
+			Protocol:    conn.Protocol,
+			RemoteAddr:  conn.RemoteAddr,
+			Description: conn.Description,
+			StartTime:   conn.StartTime,
+			BytesIn:     conn.BytesIn(),
+			BytesOut:    conn.BytesOut(),
+			RateIn:      conn.RateIn,
+			RateOut:     conn.RateOut,
+			LimitIn:     conn.upload.getRate(),
+			LimitOut:    conn.download.getRate(),
+		})
+		if _, ok := users[conn.Username]; !ok {
+			users[conn.Username] = &UserThroughput{Username: conn.Username}
+		}
+		users[conn.Username].Connections++
+		users[conn.Username].RateIn += conn.RateIn
+		users[conn.Username].RateOut += conn.RateOut
+	}
+	c.mutex.Unlock()
+
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].ID < connections[j].ID
+	})
+	userList := []*UserThroughput{}
+	for _, throughput := range users {
+		userList = append(userList, throughput)
+	}
+	sort.Slice(userList, func(i, j int) bool {
+		return userList[i].Username < userList[j].Username
+	})
+
+	js, _ := json.Marshal(struct {
+		Users       []*UserThroughput
+		Connections []connectionStatus
+	}{userList, connections})
+	sendJSONResponse(w, string(js))
+}
@@ -0,0 +1,120 @@
+package bandwidth
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+)
+
+/*
+	HTTP Middleware
+
+	Throttle the request body and the response of the HTTP handlers. Hijacked
+	connections (e.g. WebSocket) are throttled as well.
+*/
+
+//Wrap the handler with the limits of the logged in user. Requests without login are counted as anonymous
+func (c *Controller) HandlerFunc(protocol string, next http.HandlerFunc) http.HandlerFunc {
+	if c == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := ""
+		userinfo, err := c.Options.UserHandler.GetUserInfoFromRequest(w, r)
+		if err == nil {
+			username = userinfo.Username
+		}
+		c.Serve(w, r, protocol, username, next)
+	}
+}
+
+//Serve the request with the limits of the given user. Empty username for anonymous
+func (c *Controller) Serve(w http.ResponseWriter, r *http.Request, protocol string, username string, next http.HandlerFunc) {
+	if c == nil {
+		next(w, r)
+		return
+	}
+	conn, err := c.Open(protocol, username, r.RemoteAddr, r.Method+" "+r.URL.Path)
+	if err != nil {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "429 - "+err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	defer conn.Close()
+
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &throttledBody{Reader: conn.UploadReader(r.Body), body: r.Body}
+	}
+	next(&responseWriter{ResponseWriter: w, writer: conn.DownloadWriter(w), conn: conn}, r)
+}
+
+type throttledBody struct {
+	io.Reader
+	body io.ReadCloser
+}
+
+func (t *throttledBody) Close() error {
+	return t.body.Close()
+}
+
+type responseWriter struct {
+	http.ResponseWriter
+	writer io.Writer
+	conn   *Connection
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	return w.writer.Write(p)
+}
+
+func (w *responseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//Hijack the connection and throttle the data sent and received through it
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Hijack not supported")
+	}
+	netConn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn := &throttledConn{Conn: netConn, reader: w.conn.UploadReader(netConn), writer: w.conn.DownloadWriter(netConn)}
+	reader := io.Reader(conn)
+	if buffered := rw.Reader.Buffered(); buffered > 0 {
+		//Keep the data already read by the server
+		data, _ := rw.Reader.Peek(buffered)
+		reader = io.MultiReader(bytes.NewReader(append([]byte{}, data...)), conn)
+	}
+	return conn, bufio.NewReadWriter(bufio.NewReader(reader), bufio.NewWriter(conn)), nil
+}
+
+type throttledConn struct {
+	net.Conn
+	reader io.Reader
+	writer io.Writer
+}
+
+func (t *throttledConn) Read(p []byte) (int, error) {
+	return t.reader.Read(p)
+}
+
+func (t *throttledConn) Write(p []byte) (int, error) {
+	return t.writer.Write(p)
+}
+
+func remoteIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
@@ -0,0 +1,203 @@
+package dlna
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+	Device Access Control
+
+	Client devices are identified by their IP address. Every device that
+	contacted the media server is recorded so that the administrator can
+	allow or deny it and limit the libraries it can see.
+*/
+
+type Device struct {
+	Address   string   //IP address of the client device
+	Name      string   //Display name, set by the administrator or guessed from the user agent
+	UserAgent string   //Last seen user agent
+	Allowed   bool     //If the device can access the media server
+	Libraries []string //IDs of the libraries that is visible to this device. Empty means all libraries
+	FirstSeen int64
+	LastSeen  int64
+}
+
+//Interval for updating the last seen time of devices in the database
+const deviceSaveInterval = 60
+
+//Loopback is excluded as requests forwarded by a reverse proxy on the same host also come from loopback
+var lanNetworks = []string{
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+//Check if the request comes from the local area network. Proxy headers are ignored as DLNA clients always connect directly
+func isLANRequest(r *http.Request) bool {
+	return isLANAddress(clientAddress(r))
+}
+
+func isLANAddress(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range lanNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+//Guess a display name for the device from its user agent
+func guessDeviceName(userAgent string) string {
+	if userAgent == "" {
+		return "Unknown Device"
+	}
+	//Most renderers put their name as the first product token, e.g. "SEC_HHP_[TV] Samsung/1.0"
+	name := strings.Split(userAgent, " ")[0]
+	name = strings.TrimPrefix(name, "SEC_HHP_")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+//Record the device that sent the request and return its record
+func (s *Server) recordDevice(r *http.Request) *Device {
+	address := clientAddress(r)
+	now := time.Now().Unix()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	device, ok := s.devices[address]
+	if !ok {
+		device = &Device{
+			Address:   address,
+			Name:      guessDeviceName(r.UserAgent()),
+			UserAgent: r.UserAgent(),
+			Allowed:   s.defaultAllow,
+			Libraries: []string{},
+			FirstSeen: now,
+			LastSeen:  now,
+		}
+		s.devices[address] = device
+		s.saveDevices()
+		return device
+	}
+
+	if r.UserAgent() != "" {
+		device.UserAgent = r.UserAgent()
+	}
+	if now-device.LastSeen > deviceSaveInterval {
+		device.LastSeen = now
+		s.saveDevices()
+	}
+	return device
+}
+
+//Save the device list to database. Require the mutex to be locked by caller
+func (s *Server) saveDevices() {
+	s.options.Database.Write("dlna", "devices", s.devices)
+}
+
+func (s *Server) deviceAllowed(device *Device) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return device.Allowed
+}
+
+//Check if the library is visible to the device
+func (s *Server) libraryAllowed(device *Device, libraryID string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if !device.Allowed {
+		return false
+	}
+	if len(device.Libraries) == 0 {
+		return true
+	}
+	return inArray(device.Libraries, libraryID)
+}
+
+//List all the recorded devices
+func (s *Server) ListDevices() []*Device {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	results := []*Device{}
+	for _, device := range s.devices {
+		thisDevice := *device
+		results = append(results, &thisDevice)
+	}
+	return results
+}
+
+//Update the access rule of a device
+func (s *Server) SetDeviceRule(address string, name string, allowed bool, libraries []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	device, ok := s.devices[address]
+	if !ok {
+		if !isLANAddress(address) {
+			return errors.New("Invalid device address")
+		}
+		//Allow setting rules before the device connects
+		device = &Device{
+			Address:   address,
+			FirstSeen: time.Now().Unix(),
+		}
+		s.devices[address] = device
+	}
+
+	if strings.TrimSpace(name) != "" {
+		device.Name = strings.TrimSpace(name)
+	}
+	device.Allowed = allowed
+	device.Libraries = libraries
+	s.saveDevices()
+	return nil
+}
+
+//Remove a device record. It will be treated as new device on next connection
+func (s *Server) RemoveDevice(address string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.devices[address]; !ok {
+		return errors.New("Device not found")
+	}
+	delete(s.devices, address)
+	s.saveDevices()
+	return nil
+}
+
+//Set if new devices are allowed to access the media server by default
+func (s *Server) SetDefaultAllow(allow bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.defaultAllow = allow
+	s.options.Database.Write("dlna", "defaultAllow", allow)
+}
+
+func (s *Server) DefaultAllow() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.defaultAllow
+}
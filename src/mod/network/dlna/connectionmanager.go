@@ -0,0 +1,173 @@
+package dlna
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+/*
+	ConnectionManager Service and Event Subscription
+
+	The media server only acts as a source and does not manage connections,
+	so a single connection with ID 0 is always reported.
+*/
+
+//Subscription timeout in seconds
+const eventSubscriptionTimeout = 1800
+
+func (s *Server) handleConnectionManager(w http.ResponseWriter, r *http.Request) {
+	action, args, err := parseSOAPRequest(r)
+	if err != nil {
+		writeSOAPError(w, newUPnPError(upnpErrorInvalidAction, "Invalid Action"))
+		return
+	}
+
+	switch action {
+	case "GetProtocolInfo":
+		writeSOAPResponse(w, connectionManagerType, action, []soapArg{
+			{Name: "Source", Value: sourceProtocolInfo()},
+			{Name: "Sink", Value: ""},
+		})
+	case "GetCurrentConnectionIDs":
+		writeSOAPResponse(w, connectionManagerType, action, []soapArg{
+			{Name: "ConnectionIDs", Value: "0"},
+		})
+	case "GetCurrentConnectionInfo":
+		if strings.TrimSpace(args["ConnectionID"]) != "0" {
+			writeSOAPError(w, newUPnPError(706, "Invalid connection reference"))
+			return
+		}
+		writeSOAPResponse(w, connectionManagerType, action, []soapArg{
+			{Name: "RcsID", Value: "-1"},
+			{Name: "AVTransportID", Value: "-1"},
+			{Name: "ProtocolInfo", Value: ""},
+			{Name: "PeerConnectionManager", Value: ""},
+			{Name: "PeerConnectionID", Value: "-1"},
+			{Name: "Direction", Value: "Output"},
+			{Name: "Status", Value: "OK"},
+		})
+	default:
+		writeSOAPError(w, newUPnPError(upnpErrorInvalidAction, "Invalid Action"))
+	}
+}
+
+//List the protocol info of all the media types this server can provide
+func sourceProtocolInfo() string {
+	mimetypes := map[string]bool{}
+	for _, formats := range [][]string{videoFormats, photoFormats} {
+		for _, ext := range formats {
+			mimetypes[mimeType("file"+ext)] = true
+		}
+	}
+	for _, mimetype := range extraMimeTypes {
+		mimetypes[mimetype] = true
+	}
+
+	results := []string{}
+	for mimetype := range mimetypes {
+		if mimetype != "application/octet-stream" {
+			results = append(results, "http-get:*:"+mimetype+":*")
+		}
+	}
+	sort.Strings(results)
+	return strings.Join(results, ",")
+}
+
+/*
+	GENA Event Subscription
+
+	Some renderers refuse to use a media server if the subscription fails.
+	Subscriptions are accepted and the initial event with the current state
+	variables is sent to the callback, which must be on the subscriber itself.
+*/
+func (s *Server) handleEventSubscription(w http.ResponseWriter, r *http.Request, service string) {
+	if service != "ContentDirectory" && service != "ConnectionManager" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "SUBSCRIBE":
+		sid := r.Header.Get("SID")
+		callback := strings.Trim(r.Header.Get("CALLBACK"), "<> ")
+		if sid == "" {
+			//New subscription
+			if r.Header.Get("NT") != "upnp:event" || callback == "" {
+				http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+				return
+			}
+			callbackURL, err := url.Parse(strings.Split(callback, "><")[0])
+			if err != nil || callbackURL.Scheme != "http" || !sameHost(callbackURL.Hostname(), clientAddress(r)) {
+				http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+				return
+			}
+			sid = "uuid:" + uuid.NewV4().String()
+			go s.sendInitialEvent(callbackURL.String(), sid, service)
+		}
+
+		w.Header().Set("SID", sid)
+		w.Header().Set("TIMEOUT", "Second-"+strconv.Itoa(eventSubscriptionTimeout))
+		w.WriteHeader(http.StatusOK)
+	case "UNSUBSCRIBE":
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func sameHost(a string, b string) bool {
+	ipA := net.ParseIP(a)
+	ipB := net.ParseIP(b)
+	return ipA != nil && ipB != nil && ipA.Equal(ipB)
+}
+
+func (s *Server) sendInitialEvent(callback string, sid string, service string) {
+	variables := [][]string{}
+	if service == "ContentDirectory" {
+		variables = [][]string{
+			{"SystemUpdateID", strconv.FormatUint(uint64(s.systemUpdateID()), 10)},
+			{"ContainerUpdateIDs", ""},
+		}
+	} else {
+		variables = [][]string{
+			{"SourceProtocolInfo", sourceProtocolInfo()},
+			{"SinkProtocolInfo", ""},
+			{"CurrentConnectionIDs", "0"},
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="utf-8"?><e:propertyset xmlns:e="urn:schemas-upnp-org:event-1-0">`)
+	for _, variable := range variables {
+		buf.WriteString("<e:property>")
+		writeElement(&buf, variable[0], variable[1])
+		buf.WriteString("</e:property>")
+	}
+	buf.WriteString("</e:propertyset>")
+
+	//Wait for the subscriber to receive the SID first
+	time.Sleep(500 * time.Millisecond)
+	req, err := http.NewRequest("NOTIFY", callback, &buf)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("NT", "upnp:event")
+	req.Header.Set("NTS", "upnp:propchange")
+	req.Header.Set("SID", sid)
+	req.Header.Set("SEQ", "0")
+
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
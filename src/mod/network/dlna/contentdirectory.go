@@ -0,0 +1,398 @@
+package dlna
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	ContentDirectory Service
+
+	Supported actions
+	Browse, Search, GetSearchCapabilities, GetSortCapabilities,
+	GetSystemUpdateID and X_GetFeatureList (used by Samsung TVs)
+*/
+
+var sortCapabilities = []string{"dc:title", "dc:date", "upnp:originalTrackNumber", "upnp:album", "upnp:artist"}
+
+//DLNA flags for streaming (DLNA.ORG_FLAGS) of audio / video and images
+const (
+	dlnaFlagsAV    = "01700000000000000000000000000000"
+	dlnaFlagsImage = "00900000000000000000000000000000"
+)
+
+func (s *Server) handleContentDirectory(w http.ResponseWriter, r *http.Request, device *Device) {
+	action, args, err := parseSOAPRequest(r)
+	if err != nil {
+		writeSOAPError(w, newUPnPError(upnpErrorInvalidAction, "Invalid Action"))
+		return
+	}
+
+	switch action {
+	case "Browse":
+		result, uerr := s.browse(r, device, args)
+		if uerr != nil {
+			writeSOAPError(w, uerr)
+			return
+		}
+		writeSOAPResponse(w, contentDirectoryService, action, result)
+	case "Search":
+		result, uerr := s.search(r, device, args)
+		if uerr != nil {
+			writeSOAPError(w, uerr)
+			return
+		}
+		writeSOAPResponse(w, contentDirectoryService, action, result)
+	case "GetSearchCapabilities":
+		writeSOAPResponse(w, contentDirectoryService, action, []soapArg{
+			{Name: "SearchCaps", Value: strings.Join(searchableProperties, ",")},
+		})
+	case "GetSortCapabilities":
+		writeSOAPResponse(w, contentDirectoryService, action, []soapArg{
+			{Name: "SortCaps", Value: strings.Join(sortCapabilities, ",")},
+		})
+	case "GetSystemUpdateID":
+		writeSOAPResponse(w, contentDirectoryService, action, []soapArg{
+			{Name: "Id", Value: strconv.FormatUint(uint64(s.systemUpdateID()), 10)},
+		})
+	case "X_GetFeatureList":
+		writeSOAPResponse(w, contentDirectoryService, action, []soapArg{
+			{Name: "FeatureList", Value: `<?xml version="1.0" encoding="UTF-8"?><Features xmlns="urn:schemas-upnp-org:av:avs" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:schemaLocation="urn:schemas-upnp-org:av:avs http://www.upnp.org/schemas/av/avs.xsd"><Feature name="samsung.com_BASICVIEW" version="1"><container id="0" type="object.item.audioItem"/><container id="0" type="object.item.videoItem"/><container id="0" type="object.item.imageItem"/></Feature></Features>`},
+		})
+	default:
+		writeSOAPError(w, newUPnPError(upnpErrorInvalidAction, "Invalid Action"))
+	}
+}
+
+func (s *Server) browse(r *http.Request, device *Device, args map[string]string) ([]soapArg, *upnpError) {
+	objectID := args["ObjectID"]
+	startIndex, count, uerr := parsePaging(args)
+	if uerr != nil {
+		return nil, uerr
+	}
+
+	results := []*object{}
+	total := 0
+	switch args["BrowseFlag"] {
+	case "BrowseMetadata":
+		obj, err := s.getObject(device, objectID)
+		if err != nil {
+			return nil, newUPnPError(upnpErrorNoSuchObject, "No such object")
+		}
+		results = []*object{obj}
+		total = 1
+	case "BrowseDirectChildren":
+		children, err := s.getChildren(device, objectID)
+		if err != nil {
+			return nil, newUPnPError(upnpErrorNoSuchObject, "No such object")
+		}
+		if err := sortObjects(children, args["SortCriteria"]); err != nil {
+			return nil, newUPnPError(upnpErrorInvalidSort, "Unsupported or invalid sort criteria")
+		}
+		total = len(children)
+		results = pageObjects(children, startIndex, count)
+	default:
+		return nil, newUPnPError(upnpErrorInvalidArgs, "Invalid Args")
+	}
+
+	return s.resultArgs(r, results, total), nil
+}
+
+func (s *Server) search(r *http.Request, device *Device, args map[string]string) ([]soapArg, *upnpError) {
+	startIndex, count, uerr := parsePaging(args)
+	if uerr != nil {
+		return nil, uerr
+	}
+
+	exp, err := parseSearchCriteria(args["SearchCriteria"])
+	if err != nil {
+		return nil, newUPnPError(upnpErrorInvalidCriteria, "Unsupported or invalid search criteria")
+	}
+
+	items, err := s.collectItems(device, args["ContainerID"])
+	if err != nil {
+		return nil, newUPnPError(upnpErrorNoSuchContainer, "No such container")
+	}
+
+	matches := []*object{}
+	for _, item := range items {
+		if exp(item) {
+			matches = append(matches, item)
+		}
+	}
+	if err := sortObjects(matches, args["SortCriteria"]); err != nil {
+		return nil, newUPnPError(upnpErrorInvalidSort, "Unsupported or invalid sort criteria")
+	}
+
+	return s.resultArgs(r, pageObjects(matches, startIndex, count), len(matches)), nil
+}
+
+//Collect all items under the given container for searching
+func (s *Server) collectItems(device *Device, containerID string) ([]*object, error) {
+	results := []*object{}
+	itemsOfLibrary := func(library *Library, filter func(*mediaEntry) bool) {
+		index, err := s.getIndex(library)
+		if err != nil {
+			return
+		}
+		for _, entry := range index.entries {
+			if filter == nil || filter(entry) {
+				results = append(results, itemObject(library, entry, folderID(library, folderOf(entry.Relpath))))
+			}
+		}
+	}
+
+	if containerID == rootID {
+		for _, library := range s.visibleLibraries(device) {
+			itemsOfLibrary(library, nil)
+		}
+		return results, nil
+	}
+
+	library, _, kind, values, err := s.resolveID(device, containerID)
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case "":
+		itemsOfLibrary(library, nil)
+	case kindFolder:
+		itemsOfLibrary(library, func(entry *mediaEntry) bool {
+			return values[0] == "" || strings.HasPrefix(entry.Relpath, values[0]+"/")
+		})
+	case kindMetadata:
+		//Walk the metadata containers
+		seen := map[string]bool{}
+		pending := []string{containerID}
+		for len(pending) > 0 {
+			children, err := s.getChildren(device, pending[0])
+			pending = pending[1:]
+			if err != nil {
+				continue
+			}
+			for _, child := range children {
+				if seen[child.ID] {
+					continue
+				}
+				seen[child.ID] = true
+				if child.isContainer() {
+					pending = append(pending, child.ID)
+				} else {
+					results = append(results, child)
+				}
+			}
+		}
+	default:
+		return nil, errNoSuchObject
+	}
+	return results, nil
+}
+
+func parsePaging(args map[string]string) (int, int, *upnpError) {
+	startIndex := 0
+	count := 0
+	var err error
+	if args["StartingIndex"] != "" {
+		startIndex, err = strconv.Atoi(strings.TrimSpace(args["StartingIndex"]))
+		if err != nil || startIndex < 0 {
+			return 0, 0, newUPnPError(upnpErrorInvalidArgs, "Invalid Args")
+		}
+	}
+	if args["RequestedCount"] != "" {
+		count, err = strconv.Atoi(strings.TrimSpace(args["RequestedCount"]))
+		if err != nil || count < 0 {
+			return 0, 0, newUPnPError(upnpErrorInvalidArgs, "Invalid Args")
+		}
+	}
+	return startIndex, count, nil
+}
+
+//Get a page of objects. Count 0 means all objects after the start index
+func pageObjects(objects []*object, startIndex int, count int) []*object {
+	if startIndex >= len(objects) {
+		return []*object{}
+	}
+	objects = objects[startIndex:]
+	if count > 0 && count < len(objects) {
+		objects = objects[:count]
+	}
+	return objects
+}
+
+//Sort the objects with the sort criteria, e.g. "+upnp:album,-dc:date"
+func sortObjects(objects []*object, criteria string) error {
+	criteria = strings.TrimSpace(criteria)
+	if criteria == "" {
+		return nil
+	}
+
+	type sortKey struct {
+		property   string
+		descending bool
+	}
+	keys := []sortKey{}
+	for _, field := range strings.Split(criteria, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		key := sortKey{property: field}
+		if strings.HasPrefix(field, "+") || strings.HasPrefix(field, "-") {
+			key.property = field[1:]
+			key.descending = field[0] == '-'
+		}
+		if !inArray(sortCapabilities, key.property) {
+			//Ignore the properties that we cannot sort, as many clients send them anyway
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	sort.SliceStable(objects, func(i, j int) bool {
+		for _, key := range keys {
+			a, _ := objectProperty(objects[i], key.property)
+			b, _ := objectProperty(objects[j], key.property)
+			if key.property == "upnp:originalTrackNumber" {
+				//Compare as numbers
+				a = fmt.Sprintf("%08s", a)
+				b = fmt.Sprintf("%08s", b)
+			} else {
+				a = strings.ToLower(a)
+				b = strings.ToLower(b)
+			}
+			if a == b {
+				continue
+			}
+			if key.descending {
+				return a > b
+			}
+			return a < b
+		}
+		return false
+	})
+	return nil
+}
+
+//Build the Result, NumberReturned, TotalMatches and UpdateID arguments
+func (s *Server) resultArgs(r *http.Request, objects []*object, total int) []soapArg {
+	return []soapArg{
+		{Name: "Result", Value: s.renderDIDL(r, objects)},
+		{Name: "NumberReturned", Value: strconv.Itoa(len(objects))},
+		{Name: "TotalMatches", Value: strconv.Itoa(total)},
+		{Name: "UpdateID", Value: strconv.FormatUint(uint64(s.systemUpdateID()), 10)},
+	}
+}
+
+/*
+	DIDL-Lite
+*/
+
+//Get the URL of a media file with the given prefix ("media" or "art")
+func mediaURL(r *http.Request, prefix string, library *Library, entry *mediaEntry) string {
+	segments := []string{}
+	for _, segment := range strings.Split(entry.Relpath, "/") {
+		segments = append(segments, url.PathEscape(segment))
+	}
+	return "http://" + r.Host + "/dlna/" + prefix + "/" + library.ID + "/" + strings.Join(segments, "/")
+}
+
+func protocolInfo(mimetype string) string {
+	flags := dlnaFlagsAV
+	if strings.HasPrefix(mimetype, "image/") {
+		flags = dlnaFlagsImage
+	}
+	return "http-get:*:" + mimetype + ":DLNA.ORG_OP=01;DLNA.ORG_CI=0;DLNA.ORG_FLAGS=" + flags
+}
+
+//Format the duration as H:MM:SS.mmm
+func formatDuration(seconds float64) string {
+	d := time.Duration(seconds * float64(time.Second))
+	h := int(d.Hours())
+	m := int(d.Minutes()) % 60
+	sec := int(d.Seconds()) % 60
+	ms := int(d.Milliseconds()) % 1000
+	return fmt.Sprintf("%d:%02d:%02d.%03d", h, m, sec, ms)
+}
+
+func writeElement(buf *bytes.Buffer, name string, value string) {
+	buf.WriteString("<" + name + ">")
+	xml.EscapeText(buf, []byte(value))
+	buf.WriteString("</" + name + ">")
+}
+
+func writeAttr(buf *bytes.Buffer, name string, value string) {
+	buf.WriteString(" " + name + `="`)
+	xml.EscapeText(buf, []byte(value))
+	buf.WriteString(`"`)
+}
+
+func (s *Server) renderDIDL(r *http.Request, objects []*object) string {
+	var buf bytes.Buffer
+	buf.WriteString(`<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/" xmlns:dlna="urn:schemas-dlna-org:metadata-1-0/">`)
+	for _, o := range objects {
+		if o.isContainer() {
+			buf.WriteString("<container")
+			writeAttr(&buf, "id", o.ID)
+			writeAttr(&buf, "parentID", o.ParentID)
+			writeAttr(&buf, "restricted", "1")
+			writeAttr(&buf, "searchable", "1")
+			writeAttr(&buf, "childCount", strconv.Itoa(o.ChildCount))
+			buf.WriteString(">")
+			writeElement(&buf, "dc:title", o.Title)
+			writeElement(&buf, "upnp:class", o.Class)
+			buf.WriteString("</container>")
+			continue
+		}
+
+		entry := o.Entry
+		buf.WriteString("<item")
+		writeAttr(&buf, "id", o.ID)
+		writeAttr(&buf, "parentID", o.ParentID)
+		writeAttr(&buf, "restricted", "1")
+		buf.WriteString(">")
+		writeElement(&buf, "dc:title", o.Title)
+		writeElement(&buf, "upnp:class", o.Class)
+		writeElement(&buf, "dc:date", time.Unix(entry.CaptureTime, 0).Format("2006-01-02T15:04:05"))
+		if entry.Artist != "" {
+			writeElement(&buf, "dc:creator", entry.Artist)
+			writeElement(&buf, "upnp:artist", entry.Artist)
+		}
+		if entry.Album != "" {
+			writeElement(&buf, "upnp:album", entry.Album)
+		}
+		if entry.Genre != "" {
+			writeElement(&buf, "upnp:genre", entry.Genre)
+		}
+		if entry.TrackNumber > 0 {
+			writeElement(&buf, "upnp:originalTrackNumber", strconv.Itoa(entry.TrackNumber))
+		}
+
+		//Thumbnail rendered by the system thumbnail renderer
+		buf.WriteString(`<upnp:albumArtURI dlna:profileID="JPEG_TN">`)
+		xml.EscapeText(&buf, []byte(mediaURL(r, "art", o.Library, entry)))
+		buf.WriteString(`</upnp:albumArtURI>`)
+
+		buf.WriteString("<res")
+		writeAttr(&buf, "protocolInfo", protocolInfo(entry.Mime))
+		writeAttr(&buf, "size", strconv.FormatInt(entry.Size, 10))
+		if entry.Duration > 0 {
+			writeAttr(&buf, "duration", formatDuration(entry.Duration))
+		}
+		if entry.Width > 0 && entry.Height > 0 {
+			writeAttr(&buf, "resolution", strconv.Itoa(entry.Width)+"x"+strconv.Itoa(entry.Height))
+		}
+		buf.WriteString(">")
+		xml.EscapeText(&buf, []byte(mediaURL(r, "media", o.Library, entry)))
+		buf.WriteString("</res>")
+		buf.WriteString("</item>")
+	}
+	buf.WriteString("</DIDL-Lite>")
+	return buf.String()
+}
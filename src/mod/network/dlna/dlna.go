@@ -0,0 +1,204 @@
+package dlna
+
+/*
+	ArozOS DLNA Media Server
+	author: tobychui
+
+	This module implements a UPnP AV MediaServer (ContentDirectory and
+	ConnectionManager services) so that smart TVs, game consoles and other
+	DLNA renderers in the local area network can browse and stream the media
+	libraries selected by the administrator.
+
+	The media server is advertised with its own SSDP device description at
+	/dlna/device.xml. All /dlna/ endpoints are only accessible from the LAN
+	and every client device is checked against the per-device access rules.
+*/
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	uuid "github.com/satori/go.uuid"
+	"imuslab.com/arozos/mod/database"
+	"imuslab.com/arozos/mod/filesystem/metadata"
+	user "imuslab.com/arozos/mod/user"
+)
+
+type Options struct {
+	UserHandler   *user.UserHandler
+	Database      *database.Database      //System database, for storing libraries and device rules
+	RenderHandler *metadata.RenderHandler //Thumbnail renderer, for album art
+	Hostname      string                  //Hostname of the system, used in the friendly name
+	Vendor        string
+	VendorURL     string
+	ModelName     string
+	ModelDesc     string
+	Port          int //HTTP listening port of the system
+}
+
+type Server struct {
+	UUID    string //UUID of the media server device, different from the system UUID
+	Enabled bool
+
+	options           Options
+	libraries         []*Library
+	indexes           map[string]*libraryIndex //Library ID to scanned index
+	scanningLibraries []string                 //IDs of the libraries that is being scanned
+	devices           map[string]*Device       //Client address to device record
+	defaultAllow      bool                     //Allow new devices to access all libraries
+	updateID          uint32                   //SystemUpdateID of the ContentDirectory
+	advertiser        *advertiser
+	mutex             sync.RWMutex
+}
+
+//Create a new DLNA media server
+func NewMediaServer(options Options) *Server {
+	options.Database.NewTable("dlna")
+
+	//Load or generate the device UUID
+	deviceUUID := ""
+	if options.Database.KeyExists("dlna", "uuid") {
+		options.Database.Read("dlna", "uuid", &deviceUUID)
+	}
+	if deviceUUID == "" {
+		deviceUUID = uuid.NewV4().String()
+		options.Database.Write("dlna", "uuid", deviceUUID)
+	}
+
+	enabled := false
+	if options.Database.KeyExists("dlna", "enabled") {
+		options.Database.Read("dlna", "enabled", &enabled)
+	}
+
+	defaultAllow := true
+	if options.Database.KeyExists("dlna", "defaultAllow") {
+		options.Database.Read("dlna", "defaultAllow", &defaultAllow)
+	}
+
+	libraries := []*Library{}
+	if options.Database.KeyExists("dlna", "libraries") {
+		options.Database.Read("dlna", "libraries", &libraries)
+	}
+
+	devices := map[string]*Device{}
+	if options.Database.KeyExists("dlna", "devices") {
+		options.Database.Read("dlna", "devices", &devices)
+	}
+
+	return &Server{
+		UUID:              deviceUUID,
+		Enabled:           enabled,
+		options:           options,
+		libraries:         libraries,
+		indexes:           map[string]*libraryIndex{},
+		scanningLibraries: []string{},
+		devices:           devices,
+		defaultAllow:      defaultAllow,
+		updateID:          1,
+		mutex:             sync.RWMutex{},
+	}
+}
+
+//Get the friendly name shown on the client devices
+func (s *Server) FriendlyName() string {
+	return s.options.Hostname + " Media Server"
+}
+
+//Start advertising the media server in the LAN and scan the libraries
+func (s *Server) Start(outboundIP string) error {
+	if s.advertiser != nil {
+		return errors.New("Media server already started")
+	}
+
+	adv, err := newAdvertiser(s.UUID, outboundIP, s.options.Port)
+	if err != nil {
+		return err
+	}
+	s.advertiser = adv
+	s.Enabled = true
+	s.options.Database.Write("dlna", "enabled", true)
+
+	log.Println("[DLNA] Media server started as " + s.FriendlyName())
+	s.ScanInBackground()
+	return nil
+}
+
+//Stop advertising the media server. Endpoints will reject requests until it starts again
+func (s *Server) Stop() {
+	s.Close()
+	s.Enabled = false
+	s.options.Database.Write("dlna", "enabled", false)
+}
+
+//Send byebye to the LAN, use on system shutdown
+func (s *Server) Close() {
+	if s.advertiser != nil {
+		s.advertiser.Close()
+		s.advertiser = nil
+	}
+}
+
+//Increase the SystemUpdateID after the content is changed
+func (s *Server) bumpUpdateID() {
+	atomic.AddUint32(&s.updateID, 1)
+}
+
+func (s *Server) systemUpdateID() uint32 {
+	return atomic.LoadUint32(&s.updateID)
+}
+
+/*
+	Handle the requests under /dlna/
+
+	/dlna/device.xml				=> Device description
+	/dlna/ContentDirectory.xml		=> ContentDirectory service description
+	/dlna/ConnectionManager.xml		=> ConnectionManager service description
+	/dlna/control/{service}			=> SOAP control endpoint
+	/dlna/event/{service}			=> GENA event subscription
+	/dlna/media/{library}/{path}	=> Media file streaming
+	/dlna/art/{library}/{path}		=> Thumbnail of the media file
+*/
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.Enabled || !isLANRequest(r) {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Server", serverString)
+	device := s.recordDevice(r)
+	if !s.deviceAllowed(device) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	subpath := strings.TrimPrefix(r.URL.Path, "/dlna/")
+	switch {
+	case subpath == "device.xml":
+		s.handleDeviceDescription(w, r)
+	case subpath == "ContentDirectory.xml":
+		serveXML(w, contentDirectorySCPD)
+	case subpath == "ConnectionManager.xml":
+		serveXML(w, connectionManagerSCPD)
+	case subpath == "control/ContentDirectory":
+		s.handleContentDirectory(w, r, device)
+	case subpath == "control/ConnectionManager":
+		s.handleConnectionManager(w, r)
+	case strings.HasPrefix(subpath, "event/"):
+		s.handleEventSubscription(w, r, strings.TrimPrefix(subpath, "event/"))
+	case strings.HasPrefix(subpath, "media/"):
+		s.handleMedia(w, r, device, strings.TrimPrefix(subpath, "media/"))
+	case strings.HasPrefix(subpath, "art/"):
+		s.handleAlbumArt(w, r, device, strings.TrimPrefix(subpath, "art/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func serveXML(w http.ResponseWriter, content string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Write([]byte(content))
+}
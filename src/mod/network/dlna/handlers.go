@@ -0,0 +1,155 @@
+package dlna
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+/*
+	Media Server Admin HTTP Handlers
+*/
+
+/*
+	Handle library management
+
+	opr=list	=> list the libraries and their number of media files
+	opr=add		=> add a new library (name, type, mode, folder)
+	opr=remove	=> remove a library (id)
+	opr=scan	=> rescan all libraries in the background
+*/
+func (s *Server) HandleLibraries(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := s.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	opr, _ := mv(r, "opr", true)
+	switch opr {
+	case "add":
+		name, _ := mv(r, "name", true)
+		libraryType, _ := mv(r, "type", true)
+		mode, _ := mv(r, "mode", true)
+		folder, err := mv(r, "folder", true)
+		if err != nil {
+			sendErrorResponse(w, "Invalid folder given")
+			return
+		}
+		_, err = s.AddLibrary(userinfo, name, libraryType, mode, folder)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+		sendOK(w)
+	case "remove":
+		libraryID, err := mv(r, "id", true)
+		if err != nil {
+			sendErrorResponse(w, "Invalid library id given")
+			return
+		}
+		err = s.RemoveLibrary(libraryID)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+		sendOK(w)
+	case "scan":
+		s.ScanInBackground()
+		sendOK(w)
+	default:
+		type libraryInfo struct {
+			*Library
+			FileCount int
+			Scanned   bool
+		}
+		results := []libraryInfo{}
+		for _, library := range s.ListLibraries() {
+			thisInfo := libraryInfo{Library: library}
+			s.mutex.RLock()
+			if index, ok := s.indexes[library.ID]; ok {
+				thisInfo.FileCount = len(index.entries)
+				thisInfo.Scanned = true
+			}
+			s.mutex.RUnlock()
+			results = append(results, thisInfo)
+		}
+
+		js, _ := json.Marshal(struct {
+			Libraries []libraryInfo
+			Scanning  bool
+		}{
+			results,
+			s.IsScanning(),
+		})
+		sendJSONResponse(w, string(js))
+	}
+}
+
+/*
+	Handle device access rules
+
+	opr=list			=> list the devices that contacted the media server
+	opr=set				=> set the rule of a device (address, name, allowed, libraries as JSON array of library IDs)
+	opr=remove			=> remove a device record (address)
+	opr=defaultAllow	=> set if new devices are allowed by default (allow)
+*/
+func (s *Server) HandleDevices(w http.ResponseWriter, r *http.Request) {
+	opr, _ := mv(r, "opr", true)
+	switch opr {
+	case "set":
+		address, err := mv(r, "address", true)
+		if err != nil {
+			sendErrorResponse(w, "Invalid device address")
+			return
+		}
+		name, _ := mv(r, "name", true)
+		allowed, _ := mv(r, "allowed", true)
+
+		libraries := []string{}
+		librariesJSON, _ := mv(r, "libraries", true)
+		if librariesJSON != "" {
+			err = json.Unmarshal([]byte(librariesJSON), &libraries)
+			if err != nil {
+				sendErrorResponse(w, "Invalid libraries given")
+				return
+			}
+		}
+
+		err = s.SetDeviceRule(address, name, allowed == "true", libraries)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+		sendOK(w)
+	case "remove":
+		address, err := mv(r, "address", true)
+		if err != nil {
+			sendErrorResponse(w, "Invalid device address")
+			return
+		}
+		err = s.RemoveDevice(address)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+		sendOK(w)
+	case "defaultAllow":
+		allow, _ := mv(r, "allow", true)
+		s.SetDefaultAllow(allow == "true")
+		sendOK(w)
+	default:
+		devices := s.ListDevices()
+		sort.Slice(devices, func(i, j int) bool {
+			return devices[i].LastSeen > devices[j].LastSeen
+		})
+		js, _ := json.Marshal(struct {
+			Devices      []*Device
+			DefaultAllow bool
+		}{
+			devices,
+			s.DefaultAllow(),
+		})
+		sendJSONResponse(w, string(js))
+	}
+}
@@ -0,0 +1,456 @@
+package dlna
+
+import (
+	"errors"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dhowden/tag"
+	uuid "github.com/satori/go.uuid"
+	"imuslab.com/arozos/mod/filesystem/metadata"
+	"imuslab.com/arozos/mod/music"
+	user "imuslab.com/arozos/mod/user"
+)
+
+/*
+	Media Libraries
+
+	A library is a folder selected by the administrator that is exposed as
+	a video, music or photo library. The folder is resolved with the virtual
+	file system of the user who created the library. Libraries in folder mode
+	follow the folder structure, while libraries in metadata mode group the
+	media by artist, album, genre or date.
+*/
+
+const (
+	LibraryVideo = "video"
+	LibraryMusic = "music"
+	LibraryPhoto = "photo"
+
+	ModeFolder   = "folder"
+	ModeMetadata = "metadata"
+)
+
+//The index will be rescanned in the background if it is older than this (in seconds)
+const indexMaxAge = 600
+
+type Library struct {
+	ID     string
+	Name   string //Name of the library shown on the client devices
+	Type   string //Type of media, {video, music, photo}
+	Mode   string //How the library is organized, {folder, metadata}
+	Owner  string //Username of the creator, used to resolve the folder
+	Folder string //Virtual path of the library folder
+}
+
+//A media file found in the library
+type mediaEntry struct {
+	Relpath  string //Path relative to the library folder, in slash form
+	Realpath string
+	Title    string
+	Mime     string
+	Size     int64
+	ModTime  int64
+
+	//Music tags
+	Artist      string
+	Album       string
+	AlbumArtist string
+	Genre       string
+	Year        int
+	TrackNumber int
+	DiscNumber  int
+	Duration    float64
+
+	//Photo information
+	CaptureTime int64
+	Width       int
+	Height      int
+}
+
+type libraryIndex struct {
+	library  *Library
+	entries  []*mediaEntry            //All entries, sorted by relpath
+	byPath   map[string]*mediaEntry   //Relpath to entry
+	folders  map[string][]string      //Folder relpath to the relpaths of its sub-folders
+	files    map[string][]*mediaEntry //Folder relpath to the media files inside
+	scanTime int64
+}
+
+var videoFormats = []string{".mp4", ".m4v", ".mkv", ".avi", ".mov", ".wmv", ".webm", ".mpg", ".mpeg", ".ts", ".m2ts", ".flv", ".3gp"}
+var photoFormats = []string{".jpg", ".jpeg", ".png", ".gif", ".bmp", ".webp"}
+
+//Mime types that is not registered in most systems
+var extraMimeTypes = map[string]string{
+	".mkv":  "video/x-matroska",
+	".avi":  "video/x-msvideo",
+	".wmv":  "video/x-ms-wmv",
+	".m4v":  "video/mp4",
+	".ts":   "video/mp2t",
+	".m2ts": "video/mp2t",
+	".flv":  "video/x-flv",
+	".3gp":  "video/3gpp",
+	".mpg":  "video/mpeg",
+	".mpeg": "video/mpeg",
+	".mp3":  "audio/mpeg",
+	".flac": "audio/flac",
+	".ogg":  "audio/ogg",
+	".opus": "audio/ogg",
+	".m4a":  "audio/mp4",
+	".alac": "audio/mp4",
+	".aac":  "audio/aac",
+	".wav":  "audio/wav",
+	".webp": "image/webp",
+	".bmp":  "image/bmp",
+}
+
+//Check if the file belongs to the given type of library
+func isMediaFile(libraryType string, filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	switch libraryType {
+	case LibraryVideo:
+		return inArray(videoFormats, ext)
+	case LibraryMusic:
+		return music.IsAudio(filename)
+	case LibraryPhoto:
+		return inArray(photoFormats, ext)
+	}
+	return false
+}
+
+func mimeType(filename string) string {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if mimetype, ok := extraMimeTypes[ext]; ok {
+		return mimetype
+	}
+	mimetype := mime.TypeByExtension(ext)
+	if mimetype == "" {
+		return "application/octet-stream"
+	}
+	return strings.Split(mimetype, ";")[0]
+}
+
+/*
+	Library Management
+*/
+
+//Add a new library with the folder owned by the given user
+func (s *Server) AddLibrary(owner *user.User, name string, libraryType string, mode string, folder string) (*Library, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, errors.New("Library name cannot be empty")
+	}
+	if libraryType != LibraryVideo && libraryType != LibraryMusic && libraryType != LibraryPhoto {
+		return nil, errors.New("Invalid library type")
+	}
+	if mode != ModeFolder && mode != ModeMetadata {
+		return nil, errors.New("Invalid library mode")
+	}
+	if !owner.CanRead(folder) {
+		return nil, errors.New("Permission denied")
+	}
+	rpath, err := owner.VirtualPathToRealPath(folder)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(rpath); err != nil || !info.IsDir() {
+		return nil, errors.New("Library folder not exists")
+	}
+
+	newLibrary := Library{
+		ID:     uuid.NewV4().String(),
+		Name:   name,
+		Type:   libraryType,
+		Mode:   mode,
+		Owner:  owner.Username,
+		Folder: folder,
+	}
+
+	s.mutex.Lock()
+	s.libraries = append(s.libraries, &newLibrary)
+	s.saveLibraries()
+	s.mutex.Unlock()
+
+	s.bumpUpdateID()
+	go s.scanLibrary(&newLibrary)
+	return &newLibrary, nil
+}
+
+//Remove a library by its ID
+func (s *Server) RemoveLibrary(libraryID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, library := range s.libraries {
+		if library.ID == libraryID {
+			s.libraries = append(s.libraries[:i], s.libraries[i+1:]...)
+			delete(s.indexes, libraryID)
+			s.saveLibraries()
+			s.bumpUpdateID()
+			return nil
+		}
+	}
+	return errors.New("Library not found")
+}
+
+//List all libraries
+func (s *Server) ListLibraries() []*Library {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	results := []*Library{}
+	for _, library := range s.libraries {
+		thisLibrary := *library
+		results = append(results, &thisLibrary)
+	}
+	return results
+}
+
+//Get a library by its ID
+func (s *Server) GetLibrary(libraryID string) (*Library, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, library := range s.libraries {
+		if library.ID == libraryID {
+			return library, nil
+		}
+	}
+	return nil, errors.New("Library not found")
+}
+
+//Save the library list to database. Require the mutex to be locked by caller
+func (s *Server) saveLibraries() {
+	s.options.Database.Write("dlna", "libraries", s.libraries)
+}
+
+/*
+	Library Scanning
+*/
+
+//Check if any library is being scanned
+func (s *Server) IsScanning() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.scanningLibraries) > 0
+}
+
+//Rescan all libraries in the background
+func (s *Server) ScanInBackground() {
+	for _, library := range s.ListLibraries() {
+		go s.scanLibrary(library)
+	}
+}
+
+//Get the index of a library. Scan it now if it has never been scanned, or rescan in background if outdated
+func (s *Server) getIndex(library *Library) (*libraryIndex, error) {
+	s.mutex.RLock()
+	index, ok := s.indexes[library.ID]
+	s.mutex.RUnlock()
+	if !ok {
+		return s.scanLibrary(library)
+	}
+
+	if time.Now().Unix()-index.scanTime > indexMaxAge {
+		go s.scanLibrary(library)
+	}
+	return index, nil
+}
+
+//Scan the library folder and replace its index
+func (s *Server) scanLibrary(library *Library) (*libraryIndex, error) {
+	s.mutex.Lock()
+	if inArray(s.scanningLibraries, library.ID) {
+		//Already scanning. Return the current index if any
+		index, ok := s.indexes[library.ID]
+		s.mutex.Unlock()
+		if !ok {
+			return nil, errors.New("Library is being scanned")
+		}
+		return index, nil
+	}
+	s.scanningLibraries = append(s.scanningLibraries, library.ID)
+	previous := s.indexes[library.ID]
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		for i, id := range s.scanningLibraries {
+			if id == library.ID {
+				s.scanningLibraries = append(s.scanningLibraries[:i], s.scanningLibraries[i+1:]...)
+				break
+			}
+		}
+		s.mutex.Unlock()
+	}()
+
+	owner, err := s.options.UserHandler.GetUserInfoFromUsername(library.Owner)
+	if err != nil {
+		return nil, errors.New("Library owner not exists")
+	}
+	root, err := owner.VirtualPathToRealPath(library.Folder)
+	if err != nil {
+		return nil, err
+	}
+
+	index := libraryIndex{
+		library:  library,
+		entries:  []*mediaEntry{},
+		byPath:   map[string]*mediaEntry{},
+		folders:  map[string][]string{"": {}},
+		files:    map[string][]*mediaEntry{"": {}},
+		scanTime: time.Now().Unix(),
+	}
+
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if path != root && strings.HasPrefix(info.Name(), ".") {
+			//Hidden files and thumbnail cache folders
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		parent := folderOf(rel)
+
+		if info.IsDir() {
+			index.folders[parent] = append(index.folders[parent], rel)
+			index.folders[rel] = []string{}
+			index.files[rel] = []*mediaEntry{}
+			return nil
+		}
+
+		if !isMediaFile(library.Type, path) {
+			return nil
+		}
+
+		//Reuse the previous result if the file is not changed
+		var entry *mediaEntry
+		if previous != nil {
+			if oldEntry, ok := previous.byPath[rel]; ok && oldEntry.Size == info.Size() && oldEntry.ModTime == info.ModTime().Unix() {
+				entry = oldEntry
+			}
+		}
+		if entry == nil {
+			entry = buildMediaEntry(library.Type, path, rel, info)
+		}
+
+		index.entries = append(index.entries, entry)
+		index.byPath[rel] = entry
+		index.files[parent] = append(index.files[parent], entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	//Remove empty folders so that the TV will not show folders with nothing to play
+	pruneEmptyFolders(&index, "")
+
+	//Only update if the library is not removed during the scan
+	s.mutex.Lock()
+	if libraryExists(s.libraries, library.ID) {
+		s.indexes[library.ID] = &index
+	}
+	s.mutex.Unlock()
+
+	if previous == nil || len(previous.entries) != len(index.entries) {
+		log.Println("[DLNA] Indexed " + IntToString(len(index.entries)) + " files in library " + library.Name)
+	}
+	s.bumpUpdateID()
+	return &index, nil
+}
+
+func libraryExists(libraries []*Library, libraryID string) bool {
+	for _, library := range libraries {
+		if library.ID == libraryID {
+			return true
+		}
+	}
+	return false
+}
+
+//Remove folders without any media files inside. Return if the folder has media
+func pruneEmptyFolders(index *libraryIndex, folder string) bool {
+	hasMedia := len(index.files[folder]) > 0
+	keptFolders := []string{}
+	for _, subfolder := range index.folders[folder] {
+		if pruneEmptyFolders(index, subfolder) {
+			keptFolders = append(keptFolders, subfolder)
+		} else {
+			delete(index.folders, subfolder)
+			delete(index.files, subfolder)
+		}
+	}
+	sort.Strings(keptFolders)
+	index.folders[folder] = keptFolders
+	return hasMedia || len(keptFolders) > 0
+}
+
+//Get the parent folder of the relative path. The library root is an empty string
+func folderOf(rel string) string {
+	dir := filepath.ToSlash(filepath.Dir(rel))
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+//Read the information of a media file
+func buildMediaEntry(libraryType string, path string, rel string, info os.FileInfo) *mediaEntry {
+	entry := mediaEntry{
+		Relpath:     rel,
+		Realpath:    path,
+		Title:       strings.TrimSuffix(info.Name(), filepath.Ext(info.Name())),
+		Mime:        mimeType(path),
+		Size:        info.Size(),
+		ModTime:     info.ModTime().Unix(),
+		CaptureTime: info.ModTime().Unix(),
+	}
+
+	if libraryType == LibraryMusic {
+		f, err := os.Open(path)
+		if err == nil {
+			m, err := tag.ReadFrom(f)
+			if err == nil {
+				if strings.TrimSpace(m.Title()) != "" {
+					entry.Title = strings.TrimSpace(m.Title())
+				}
+				entry.Artist = strings.TrimSpace(m.Artist())
+				entry.AlbumArtist = strings.TrimSpace(m.AlbumArtist())
+				entry.Album = strings.TrimSpace(m.Album())
+				entry.Genre = strings.TrimSpace(m.Genre())
+				entry.Year = m.Year()
+				entry.TrackNumber, _ = m.Track()
+				entry.DiscNumber, _ = m.Disc()
+			}
+			f.Close()
+		}
+
+		duration, err := music.GetAudioDuration(path)
+		if err == nil {
+			entry.Duration = duration
+		}
+	} else if libraryType == LibraryPhoto {
+		exif, err := metadata.ReadImageExif(path)
+		if err == nil {
+			if exif.CaptureTime > 0 {
+				entry.CaptureTime = exif.CaptureTime
+			}
+			entry.Width = exif.Width
+			entry.Height = exif.Height
+		}
+	}
+
+	return &entry
+}
@@ -0,0 +1,97 @@
+package dlna
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+	Media Streaming
+
+	Only the files indexed in the libraries visible to the device can be
+	served. Range requests are handled by http.ServeContent so that the
+	renderers can seek inside the videos.
+*/
+
+//Find the indexed media entry from the request path {library}/{relpath}
+func (s *Server) resolveMediaPath(device *Device, subpath string) (*Library, *mediaEntry, bool) {
+	pos := strings.Index(subpath, "/")
+	if pos <= 0 {
+		return nil, nil, false
+	}
+	libraryID := subpath[:pos]
+	relpath := subpath[pos+1:]
+	if !s.libraryAllowed(device, libraryID) {
+		return nil, nil, false
+	}
+	library, err := s.GetLibrary(libraryID)
+	if err != nil {
+		return nil, nil, false
+	}
+	index, err := s.getIndex(library)
+	if err != nil {
+		return nil, nil, false
+	}
+	entry, ok := index.byPath[relpath]
+	if !ok {
+		return nil, nil, false
+	}
+	return library, entry, true
+}
+
+func (s *Server) handleMedia(w http.ResponseWriter, r *http.Request, device *Device, subpath string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, entry, ok := s.resolveMediaPath(device, subpath)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := os.Open(entry.Realpath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	transferMode := "Streaming"
+	if strings.HasPrefix(entry.Mime, "image/") {
+		transferMode = "Interactive"
+	}
+	w.Header().Set("Content-Type", entry.Mime)
+	w.Header().Set("transferMode.dlna.org", transferMode)
+	w.Header().Set("contentFeatures.dlna.org", strings.SplitN(protocolInfo(entry.Mime), ":", 4)[3])
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+//Serve the thumbnail of the media file as album art
+func (s *Server) handleAlbumArt(w http.ResponseWriter, r *http.Request, device *Device, subpath string) {
+	_, entry, ok := s.resolveMediaPath(device, subpath)
+	if !ok || s.options.RenderHandler == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	thumbnail, err := s.options.RenderHandler.LoadCacheAsBytes(entry.Realpath, false)
+	if err != nil || len(thumbnail) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", http.DetectContentType(thumbnail))
+	w.Header().Set("transferMode.dlna.org", "Interactive")
+	w.Header().Set("Cache-Control", "max-age=86400")
+	w.Header().Set("Last-Modified", time.Unix(entry.ModTime, 0).UTC().Format(http.TimeFormat))
+	w.Write(thumbnail)
+}
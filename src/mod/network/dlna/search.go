@@ -0,0 +1,254 @@
+package dlna
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Search Criteria
+
+	Parser of the search criteria defined in ContentDirectory:1 Section 2.5.5
+
+	searchCrit	::= searchExp | '*'
+	searchExp	::= relExp | searchExp logOp searchExp | '(' searchExp ')'
+	relExp		::= property binOp quotedVal | property existsOp boolVal
+
+	"and" has a higher precedence than "or"
+*/
+
+var errInvalidCriteria = errors.New("Invalid search criteria")
+
+//The properties that can be used in search criteria
+var searchableProperties = []string{"dc:title", "dc:creator", "dc:date", "upnp:class", "upnp:artist", "upnp:album", "upnp:genre", "@id", "@parentID"}
+
+//A compiled search criteria
+type searchExpression func(o *object) bool
+
+type criteriaParser struct {
+	tokens []string
+	pos    int
+}
+
+//Split the criteria into tokens. Quoted strings are returned with the quotes
+func tokenizeCriteria(criteria string) ([]string, error) {
+	tokens := []string{}
+	i := 0
+	for i < len(criteria) {
+		c := criteria[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			var sb strings.Builder
+			sb.WriteByte('"')
+			i++
+			closed := false
+			for i < len(criteria) {
+				if criteria[i] == '\\' && i+1 < len(criteria) {
+					sb.WriteByte(criteria[i+1])
+					i += 2
+					continue
+				}
+				if criteria[i] == '"' {
+					closed = true
+					i++
+					break
+				}
+				sb.WriteByte(criteria[i])
+				i++
+			}
+			if !closed {
+				return nil, errInvalidCriteria
+			}
+			tokens = append(tokens, sb.String())
+		default:
+			start := i
+			for i < len(criteria) && !strings.ContainsRune(" \t\r\n()\"", rune(criteria[i])) {
+				i++
+			}
+			tokens = append(tokens, criteria[start:i])
+		}
+	}
+	return tokens, nil
+}
+
+//Compile the search criteria into an expression
+func parseSearchCriteria(criteria string) (searchExpression, error) {
+	criteria = strings.TrimSpace(criteria)
+	if criteria == "" || criteria == "*" {
+		return func(o *object) bool { return true }, nil
+	}
+
+	tokens, err := tokenizeCriteria(criteria)
+	if err != nil {
+		return nil, err
+	}
+	p := criteriaParser{tokens: tokens}
+	exp, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, errInvalidCriteria
+	}
+	return exp, nil
+}
+
+func (p *criteriaParser) next() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+	return token
+}
+
+func (p *criteriaParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *criteriaParser) parseOr() (searchExpression, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(o *object) bool { return l(o) || right(o) }
+	}
+	return left, nil
+}
+
+func (p *criteriaParser) parseAnd() (searchExpression, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "and") {
+		p.next()
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(o *object) bool { return l(o) && right(o) }
+	}
+	return left, nil
+}
+
+func (p *criteriaParser) parsePrimary() (searchExpression, error) {
+	if p.peek() == "(" {
+		p.next()
+		exp, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, errInvalidCriteria
+		}
+		return exp, nil
+	}
+
+	property := p.next()
+	op := p.next()
+	value := p.next()
+	if property == "" || op == "" || value == "" {
+		return nil, errInvalidCriteria
+	}
+
+	if op == "exists" {
+		shouldExist := strings.EqualFold(value, "true")
+		if !shouldExist && !strings.EqualFold(value, "false") {
+			return nil, errInvalidCriteria
+		}
+		return func(o *object) bool {
+			_, ok := objectProperty(o, property)
+			return ok == shouldExist
+		}, nil
+	}
+
+	if !strings.HasPrefix(value, `"`) {
+		return nil, errInvalidCriteria
+	}
+	value = strings.ToLower(strings.TrimPrefix(value, `"`))
+
+	var compare func(actual string) bool
+	switch op {
+	case "=":
+		compare = func(actual string) bool { return actual == value }
+	case "!=":
+		compare = func(actual string) bool { return actual != value }
+	case "<":
+		compare = func(actual string) bool { return actual < value }
+	case "<=":
+		compare = func(actual string) bool { return actual <= value }
+	case ">":
+		compare = func(actual string) bool { return actual > value }
+	case ">=":
+		compare = func(actual string) bool { return actual >= value }
+	case "contains":
+		compare = func(actual string) bool { return strings.Contains(actual, value) }
+	case "doesNotContain":
+		compare = func(actual string) bool { return !strings.Contains(actual, value) }
+	case "derivedfrom":
+		compare = func(actual string) bool { return actual == value || strings.HasPrefix(actual, value+".") }
+	default:
+		return nil, errInvalidCriteria
+	}
+
+	return func(o *object) bool {
+		actual, ok := objectProperty(o, property)
+		if !ok {
+			return op == "!=" || op == "doesNotContain"
+		}
+		return compare(strings.ToLower(actual))
+	}, nil
+}
+
+//Get the value of a property of the object for search and sorting
+func objectProperty(o *object, property string) (string, bool) {
+	switch property {
+	case "@id":
+		return o.ID, true
+	case "@parentID":
+		return o.ParentID, true
+	case "dc:title":
+		return o.Title, true
+	case "upnp:class":
+		return o.Class, true
+	}
+
+	if o.Entry == nil {
+		return "", false
+	}
+	value := ""
+	switch property {
+	case "dc:creator", "upnp:artist":
+		value = o.Entry.Artist
+	case "upnp:album":
+		value = o.Entry.Album
+	case "upnp:genre":
+		value = o.Entry.Genre
+	case "dc:date":
+		value = time.Unix(o.Entry.CaptureTime, 0).Format("2006-01-02")
+	case "upnp:originalTrackNumber":
+		if o.Entry.TrackNumber > 0 {
+			value = strconv.Itoa(o.Entry.TrackNumber)
+		}
+	}
+	return value, value != ""
+}
@@ -0,0 +1,150 @@
+package dlna
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+/*
+	SOAP Control
+
+	Parse the UPnP action requests and write the action responses or
+	UPnP errors in SOAP envelope
+*/
+
+//Max size of the SOAP request body
+const maxSOAPRequestSize = 1 << 20
+
+//UPnP error codes
+const (
+	upnpErrorInvalidAction   = 401
+	upnpErrorInvalidArgs     = 402
+	upnpErrorActionFailed    = 501
+	upnpErrorNoSuchObject    = 701
+	upnpErrorInvalidCriteria = 708
+	upnpErrorInvalidSort     = 709
+	upnpErrorNoSuchContainer = 710
+	upnpErrorCannotProcess   = 720
+)
+
+type upnpError struct {
+	Code        int
+	Description string
+}
+
+func (e *upnpError) Error() string {
+	return e.Description
+}
+
+func newUPnPError(code int, description string) *upnpError {
+	return &upnpError{Code: code, Description: description}
+}
+
+//A key value pair of an action argument, in the order defined by the service description
+type soapArg struct {
+	Name  string
+	Value string
+}
+
+//Parse the SOAP request and return the action name and its arguments
+func parseSOAPRequest(r *http.Request) (string, map[string]string, error) {
+	if r.Method != http.MethodPost {
+		return "", nil, errors.New("Invalid method")
+	}
+
+	//Action name from SOAPACTION header, e.g. "urn:schemas-upnp-org:service:ContentDirectory:1#Browse"
+	soapAction := strings.Trim(r.Header.Get("SOAPACTION"), `"`)
+	action := ""
+	if pos := strings.LastIndex(soapAction, "#"); pos >= 0 {
+		action = soapAction[pos+1:]
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSOAPRequestSize))
+	if err != nil {
+		return "", nil, err
+	}
+
+	//Read the arguments, which are the children of the action element inside the body
+	args := map[string]string{}
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	depth := 0
+	inBody := false
+	bodyDepth := 0
+	currentArg := ""
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			if !inBody && t.Name.Local == "Body" {
+				inBody = true
+				bodyDepth = depth
+			} else if inBody && depth == bodyDepth+1 {
+				if action == "" {
+					action = t.Name.Local
+				}
+			} else if inBody && depth == bodyDepth+2 {
+				currentArg = t.Name.Local
+				args[currentArg] = ""
+			}
+		case xml.CharData:
+			if currentArg != "" {
+				args[currentArg] += string(t)
+			}
+		case xml.EndElement:
+			if depth == bodyDepth+2 {
+				currentArg = ""
+			}
+			depth--
+		}
+	}
+
+	if action == "" {
+		return "", nil, errors.New("Missing SOAP action")
+	}
+	return action, args, nil
+}
+
+//Write the action response
+func writeSOAPResponse(w http.ResponseWriter, serviceType string, action string, args []soapArg) {
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="utf-8"?>`)
+	buf.WriteString(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	buf.WriteString(`<u:` + action + `Response xmlns:u="` + serviceType + `">`)
+	for _, arg := range args {
+		buf.WriteString("<" + arg.Name + ">")
+		xml.EscapeText(&buf, []byte(arg.Value))
+		buf.WriteString("</" + arg.Name + ">")
+	}
+	buf.WriteString(`</u:` + action + `Response></s:Body></s:Envelope>`)
+
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Header().Set("EXT", "")
+	w.Write(buf.Bytes())
+}
+
+//Write the UPnP error as SOAP fault
+func writeSOAPError(w http.ResponseWriter, err *upnpError) {
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="utf-8"?>`)
+	buf.WriteString(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	buf.WriteString(`<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>`)
+	buf.WriteString(`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>` + IntToString(err.Code) + `</errorCode><errorDescription>`)
+	xml.EscapeText(&buf, []byte(err.Description))
+	buf.WriteString(`</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`)
+
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write(buf.Bytes())
+}
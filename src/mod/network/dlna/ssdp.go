@@ -0,0 +1,184 @@
+package dlna
+
+import (
+	"encoding/xml"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+
+	ssdp "github.com/koron/go-ssdp"
+)
+
+/*
+	SSDP Advertisement
+
+	A UPnP root device has to announce itself as the root device, its UUID,
+	its device type and all the services it provides. Each of them is sent
+	by its own advertiser so that M-SEARCH from any type of client get
+	a matching response.
+*/
+
+const (
+	mediaServerDeviceType   = "urn:schemas-upnp-org:device:MediaServer:1"
+	contentDirectoryService = "urn:schemas-upnp-org:service:ContentDirectory:1"
+	connectionManagerType   = "urn:schemas-upnp-org:service:ConnectionManager:1"
+	advertiseMaxAge         = 1800
+)
+
+var serverString = runtime.GOOS + "/1.0 UPnP/1.0 arozos-dlna/1.0"
+
+type advertiser struct {
+	ads  []*ssdp.Advertiser
+	quit chan bool
+}
+
+func newAdvertiser(deviceUUID string, outboundIP string, port int) (*advertiser, error) {
+	location := "http://" + outboundIP + ":" + strconv.Itoa(port) + "/dlna/device.xml"
+	udn := "uuid:" + deviceUUID
+	targets := [][]string{
+		{"upnp:rootdevice", udn + "::upnp:rootdevice"},
+		{udn, udn},
+		{mediaServerDeviceType, udn + "::" + mediaServerDeviceType},
+		{contentDirectoryService, udn + "::" + contentDirectoryService},
+		{connectionManagerType, udn + "::" + connectionManagerType},
+	}
+
+	a := advertiser{
+		ads:  []*ssdp.Advertiser{},
+		quit: make(chan bool),
+	}
+	for _, target := range targets {
+		ad, err := ssdp.Advertise(target[0], target[1], location, serverString, advertiseMaxAge)
+		if err != nil {
+			a.closeAdvertisers()
+			return nil, err
+		}
+		a.ads = append(a.ads, ad)
+	}
+
+	go func() {
+		a.alive()
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				a.alive()
+			case <-a.quit:
+				for _, ad := range a.ads {
+					ad.Bye()
+				}
+				a.closeAdvertisers()
+				return
+			}
+		}
+	}()
+
+	return &a, nil
+}
+
+func (a *advertiser) alive() {
+	for _, ad := range a.ads {
+		ad.Alive()
+	}
+}
+
+func (a *advertiser) closeAdvertisers() {
+	for _, ad := range a.ads {
+		ad.Close()
+	}
+}
+
+func (a *advertiser) Close() {
+	a.quit <- true
+}
+
+/*
+	Device Description
+*/
+
+type serviceDescription struct {
+	ServiceType string `xml:"serviceType"`
+	ServiceID   string `xml:"serviceId"`
+	SCPDURL     string `xml:"SCPDURL"`
+	ControlURL  string `xml:"controlURL"`
+	EventSubURL string `xml:"eventSubURL"`
+}
+
+type iconDescription struct {
+	Mimetype string `xml:"mimetype"`
+	Width    int    `xml:"width"`
+	Height   int    `xml:"height"`
+	Depth    int    `xml:"depth"`
+	URL      string `xml:"url"`
+}
+
+type deviceDescription struct {
+	XMLName      xml.Name             `xml:"urn:schemas-upnp-org:device-1-0 root"`
+	DLNANs       string               `xml:"xmlns:dlna,attr"`
+	SpecMajor    int                  `xml:"specVersion>major"`
+	SpecMinor    int                  `xml:"specVersion>minor"`
+	DeviceType   string               `xml:"device>deviceType"`
+	FriendlyName string               `xml:"device>friendlyName"`
+	Manufacturer string               `xml:"device>manufacturer"`
+	ManufactURL  string               `xml:"device>manufacturerURL"`
+	ModelDesc    string               `xml:"device>modelDescription"`
+	ModelName    string               `xml:"device>modelName"`
+	ModelNumber  string               `xml:"device>modelNumber"`
+	UDN          string               `xml:"device>UDN"`
+	DLNADoc      string               `xml:"device>dlna:X_DLNADOC"`
+	Icons        []iconDescription    `xml:"device>iconList>icon"`
+	Services     []serviceDescription `xml:"device>serviceList>service"`
+	Presentation string               `xml:"device>presentationURL"`
+}
+
+func (s *Server) handleDeviceDescription(w http.ResponseWriter, r *http.Request) {
+	desc := deviceDescription{
+		DLNANs:       "urn:schemas-dlna-org:device-1-0",
+		SpecMajor:    1,
+		SpecMinor:    0,
+		DeviceType:   mediaServerDeviceType,
+		FriendlyName: s.FriendlyName(),
+		Manufacturer: s.options.Vendor,
+		ManufactURL:  s.options.VendorURL,
+		ModelDesc:    s.options.ModelDesc,
+		ModelName:    s.options.ModelName,
+		ModelNumber:  s.options.ModelName,
+		UDN:          "uuid:" + s.UUID,
+		DLNADoc:      "DMS-1.50",
+		Icons: []iconDescription{
+			{
+				Mimetype: "image/png",
+				Width:    128,
+				Height:   128,
+				Depth:    24,
+				URL:      "/img/public/auth_icon.png",
+			},
+		},
+		Services: []serviceDescription{
+			{
+				ServiceType: contentDirectoryService,
+				ServiceID:   "urn:upnp-org:serviceId:ContentDirectory",
+				SCPDURL:     "/dlna/ContentDirectory.xml",
+				ControlURL:  "/dlna/control/ContentDirectory",
+				EventSubURL: "/dlna/event/ContentDirectory",
+			},
+			{
+				ServiceType: connectionManagerType,
+				ServiceID:   "urn:upnp-org:serviceId:ConnectionManager",
+				SCPDURL:     "/dlna/ConnectionManager.xml",
+				ControlURL:  "/dlna/control/ConnectionManager",
+				EventSubURL: "/dlna/event/ConnectionManager",
+			},
+		},
+		Presentation: "http://" + r.Host + "/",
+	}
+
+	content, err := xml.MarshalIndent(desc, "", "\t")
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	serveXML(w, xml.Header+string(content))
+}
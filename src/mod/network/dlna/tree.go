@@ -0,0 +1,554 @@
+package dlna
+
+import (
+	"errors"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Content Directory Tree
+
+	Object IDs are built from the library ID, the kind of object and
+	the path escaped values that locate the object, e.g.
+
+	0									=> Root container
+	{library}							=> Library root
+	{library}/d/{folder}				=> Folder container
+	{library}/i/{file}					=> Media item
+	{library}/m/{category}/{values}		=> Metadata container, e.g. {library}/m/album/{artist}/{album}
+*/
+
+const (
+	rootID = "0"
+
+	kindFolder   = "d"
+	kindItem     = "i"
+	kindMetadata = "m"
+
+	//Number of items in the recently added container
+	recentItemCount = 50
+)
+
+var errNoSuchObject = errors.New("No such object")
+
+//An object in the content directory, either a container or an item
+type object struct {
+	ID         string
+	ParentID   string
+	Title      string
+	Class      string
+	ChildCount int
+	Library    *Library
+	Entry      *mediaEntry //Nil for containers
+}
+
+func (o *object) isContainer() bool {
+	return o.Entry == nil
+}
+
+func makeID(libraryID string, kind string, values ...string) string {
+	id := libraryID + "/" + kind
+	for _, value := range values {
+		id += "/" + url.PathEscape(value)
+	}
+	return id
+}
+
+//Parse the object ID into library ID, kind and values
+func parseID(id string) (string, string, []string, error) {
+	segments := strings.Split(id, "/")
+	if len(segments) == 1 {
+		return segments[0], "", []string{}, nil
+	}
+	values := []string{}
+	for _, segment := range segments[2:] {
+		value, err := url.PathUnescape(segment)
+		if err != nil {
+			return "", "", nil, errNoSuchObject
+		}
+		values = append(values, value)
+	}
+	return segments[0], segments[1], values, nil
+}
+
+//Get the container ID of a folder in the library
+func folderID(library *Library, folder string) string {
+	if folder == "" && library.Mode == ModeFolder {
+		return library.ID
+	}
+	return makeID(library.ID, kindFolder, folder)
+}
+
+//Get the parent container ID of a folder in the library
+func folderParentID(library *Library, folder string) string {
+	if folder == "" {
+		if library.Mode == ModeFolder {
+			return rootID
+		}
+		return library.ID
+	}
+	return folderID(library, folderOf(folder))
+}
+
+func itemClass(libraryType string) string {
+	switch libraryType {
+	case LibraryMusic:
+		return "object.item.audioItem.musicTrack"
+	case LibraryPhoto:
+		return "object.item.imageItem.photo"
+	}
+	return "object.item.videoItem"
+}
+
+func itemObject(library *Library, entry *mediaEntry, parentID string) *object {
+	return &object{
+		ID:       makeID(library.ID, kindItem, entry.Relpath),
+		ParentID: parentID,
+		Title:    entry.Title,
+		Class:    itemClass(library.Type),
+		Library:  library,
+		Entry:    entry,
+	}
+}
+
+func containerObject(id string, parentID string, title string, class string, childCount int, library *Library) *object {
+	return &object{
+		ID:         id,
+		ParentID:   parentID,
+		Title:      title,
+		Class:      class,
+		ChildCount: childCount,
+		Library:    library,
+	}
+}
+
+//Get the libraries that is visible to the device
+func (s *Server) visibleLibraries(device *Device) []*Library {
+	results := []*Library{}
+	for _, library := range s.ListLibraries() {
+		if s.libraryAllowed(device, library.ID) {
+			results = append(results, library)
+		}
+	}
+	return results
+}
+
+//Get the object with the given ID
+func (s *Server) getObject(device *Device, id string) (*object, error) {
+	if id == rootID {
+		return containerObject(rootID, "-1", s.FriendlyName(), "object.container.storageFolder", len(s.visibleLibraries(device)), nil), nil
+	}
+
+	library, index, kind, values, err := s.resolveID(device, id)
+	if err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case "":
+		return libraryObject(library, index), nil
+	case kindItem:
+		entry, ok := index.byPath[values[0]]
+		if !ok {
+			return nil, errNoSuchObject
+		}
+		return itemObject(library, entry, folderID(library, folderOf(entry.Relpath))), nil
+	}
+
+	//Containers, find it from the children of its parent
+	parentID := containerParentID(library, kind, values)
+	siblings, err := s.getChildren(device, parentID)
+	if err != nil {
+		return nil, err
+	}
+	for _, sibling := range siblings {
+		if sibling.ID == id {
+			return sibling, nil
+		}
+	}
+	return nil, errNoSuchObject
+}
+
+//Get the children of the container with the given ID
+func (s *Server) getChildren(device *Device, id string) ([]*object, error) {
+	if id == rootID {
+		results := []*object{}
+		for _, library := range s.visibleLibraries(device) {
+			index, err := s.getIndex(library)
+			if err != nil {
+				//Library folder not accessible. Show it as an empty library
+				index = &libraryIndex{library: library, folders: map[string][]string{}, files: map[string][]*mediaEntry{}, byPath: map[string]*mediaEntry{}}
+			}
+			results = append(results, libraryObject(library, index))
+		}
+		return results, nil
+	}
+
+	library, index, kind, values, err := s.resolveID(device, id)
+	if err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case "":
+		if library.Mode == ModeFolder {
+			return folderChildren(library, index, ""), nil
+		}
+		return metadataRootChildren(library, index), nil
+	case kindFolder:
+		if _, ok := index.folders[values[0]]; !ok {
+			return nil, errNoSuchObject
+		}
+		return folderChildren(library, index, values[0]), nil
+	case kindMetadata:
+		return metadataChildren(library, index, id, values)
+	}
+	return nil, errNoSuchObject
+}
+
+//Resolve the object ID into the library and its index
+func (s *Server) resolveID(device *Device, id string) (*Library, *libraryIndex, string, []string, error) {
+	libraryID, kind, values, err := parseID(id)
+	if err != nil {
+		return nil, nil, "", nil, err
+	}
+	if (kind == kindItem || kind == kindFolder) && len(values) != 1 {
+		return nil, nil, "", nil, errNoSuchObject
+	}
+	if !s.libraryAllowed(device, libraryID) {
+		return nil, nil, "", nil, errNoSuchObject
+	}
+	library, err := s.GetLibrary(libraryID)
+	if err != nil {
+		return nil, nil, "", nil, errNoSuchObject
+	}
+	index, err := s.getIndex(library)
+	if err != nil {
+		return nil, nil, "", nil, errNoSuchObject
+	}
+	return library, index, kind, values, nil
+}
+
+func libraryObject(library *Library, index *libraryIndex) *object {
+	childCount := len(index.folders[""]) + len(index.files[""])
+	if library.Mode == ModeMetadata {
+		childCount = len(metadataRootChildren(library, index))
+	}
+	return containerObject(library.ID, rootID, library.Name, "object.container.storageFolder", childCount, library)
+}
+
+func folderChildren(library *Library, index *libraryIndex, folder string) []*object {
+	thisID := folderID(library, folder)
+	results := []*object{}
+	for _, subfolder := range index.folders[folder] {
+		childCount := len(index.folders[subfolder]) + len(index.files[subfolder])
+		results = append(results, containerObject(folderID(library, subfolder), thisID, path.Base(subfolder), "object.container.storageFolder", childCount, library))
+	}
+
+	files := append([]*mediaEntry{}, index.files[folder]...)
+	sortEntriesByName(files)
+	for _, entry := range files {
+		results = append(results, itemObject(library, entry, thisID))
+	}
+	return results
+}
+
+/*
+	Metadata containers
+*/
+
+//Get the parent ID of a metadata or folder container
+func containerParentID(library *Library, kind string, values []string) string {
+	if kind == kindFolder {
+		return folderParentID(library, values[0])
+	}
+	if len(values) <= 1 {
+		return library.ID
+	}
+	if values[0] == "album" && len(values) == 3 {
+		//Album is identified by artist and album name
+		return makeID(library.ID, kindMetadata, "album")
+	}
+	return makeID(library.ID, kindMetadata, values[:len(values)-1]...)
+}
+
+func metadataRootChildren(library *Library, index *libraryIndex) []*object {
+	categories := [][]string{}
+	switch library.Type {
+	case LibraryMusic:
+		categories = [][]string{
+			{"artist", "Artists"},
+			{"album", "Albums"},
+			{"genre", "Genres"},
+			{"all", "All Tracks"},
+		}
+	case LibraryPhoto:
+		categories = [][]string{
+			{"date", "By Date"},
+			{"all", "All Photos"},
+		}
+	case LibraryVideo:
+		categories = [][]string{
+			{"recent", "Recently Added"},
+			{"date", "By Year"},
+			{"all", "All Videos"},
+		}
+	}
+
+	results := []*object{}
+	for _, category := range categories {
+		children, _ := metadataChildren(library, index, makeID(library.ID, kindMetadata, category[0]), []string{category[0]})
+		results = append(results, containerObject(makeID(library.ID, kindMetadata, category[0]), library.ID, category[1], "object.container.storageFolder", len(children), library))
+	}
+	results = append(results, containerObject(folderID(library, ""), library.ID, "Folders", "object.container.storageFolder", len(index.folders[""])+len(index.files[""]), library))
+	return results
+}
+
+func metadataChildren(library *Library, index *libraryIndex, id string, values []string) ([]*object, error) {
+	if len(values) == 0 {
+		return nil, errNoSuchObject
+	}
+
+	switch values[0] {
+	case "all":
+		entries := append([]*mediaEntry{}, index.entries...)
+		if library.Type == LibraryPhoto {
+			sortEntriesByCaptureTime(entries)
+		} else {
+			sortEntriesByName(entries)
+		}
+		return itemObjects(library, entries, id), nil
+	case "recent":
+		entries := append([]*mediaEntry{}, index.entries...)
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].ModTime > entries[j].ModTime
+		})
+		if len(entries) > recentItemCount {
+			entries = entries[:recentItemCount]
+		}
+		return itemObjects(library, entries, id), nil
+	case "date":
+		return dateChildren(library, index, id, values[1:])
+	case "artist", "genre":
+		groupOf := func(entry *mediaEntry) string {
+			if values[0] == "genre" {
+				return valueOrUnknown(entry.Genre, "Unknown Genre")
+			}
+			return valueOrUnknown(entry.Artist, "Unknown Artist")
+		}
+		class := "object.container.person.musicArtist"
+		if values[0] == "genre" {
+			class = "object.container.genre.musicGenre"
+		}
+		return groupChildren(library, index, id, values, groupOf, class)
+	case "album":
+		return albumChildren(library, index, id, values[1:])
+	}
+	return nil, errNoSuchObject
+}
+
+func itemObjects(library *Library, entries []*mediaEntry, parentID string) []*object {
+	results := []*object{}
+	for _, entry := range entries {
+		results = append(results, itemObject(library, entry, parentID))
+	}
+	return results
+}
+
+//Group the entries with the given function. List the groups if no group is selected, or the tracks inside the selected group
+func groupChildren(library *Library, index *libraryIndex, id string, values []string, groupOf func(*mediaEntry) string, class string) ([]*object, error) {
+	groups := map[string][]*mediaEntry{}
+	for _, entry := range index.entries {
+		group := groupOf(entry)
+		groups[group] = append(groups[group], entry)
+	}
+
+	if len(values) == 1 {
+		names := []string{}
+		for name := range groups {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool {
+			return strings.ToLower(names[i]) < strings.ToLower(names[j])
+		})
+		results := []*object{}
+		for _, name := range names {
+			results = append(results, containerObject(makeID(library.ID, kindMetadata, values[0], name), id, name, class, len(groups[name]), library))
+		}
+		return results, nil
+	}
+
+	entries, ok := groups[values[1]]
+	if !ok || len(values) != 2 {
+		return nil, errNoSuchObject
+	}
+	entries = append([]*mediaEntry{}, entries...)
+	sortEntriesByAlbum(entries)
+	return itemObjects(library, entries, id), nil
+}
+
+func albumChildren(library *Library, index *libraryIndex, id string, values []string) ([]*object, error) {
+	type albumKey struct {
+		artist string
+		album  string
+	}
+	albums := map[albumKey][]*mediaEntry{}
+	for _, entry := range index.entries {
+		artist := entry.AlbumArtist
+		if artist == "" {
+			artist = valueOrUnknown(entry.Artist, "Unknown Artist")
+		}
+		key := albumKey{artist: artist, album: valueOrUnknown(entry.Album, "Unknown Album")}
+		albums[key] = append(albums[key], entry)
+	}
+
+	if len(values) == 0 {
+		keys := []albumKey{}
+		for key := range albums {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if strings.ToLower(keys[i].album) != strings.ToLower(keys[j].album) {
+				return strings.ToLower(keys[i].album) < strings.ToLower(keys[j].album)
+			}
+			return keys[i].artist < keys[j].artist
+		})
+		results := []*object{}
+		for _, key := range keys {
+			results = append(results, containerObject(makeID(library.ID, kindMetadata, "album", key.artist, key.album), id, key.album, "object.container.album.musicAlbum", len(albums[key]), library))
+		}
+		return results, nil
+	}
+
+	if len(values) != 2 {
+		return nil, errNoSuchObject
+	}
+	entries, ok := albums[albumKey{artist: values[0], album: values[1]}]
+	if !ok {
+		return nil, errNoSuchObject
+	}
+	entries = append([]*mediaEntry{}, entries...)
+	sortEntriesByAlbum(entries)
+	return itemObjects(library, entries, id), nil
+}
+
+//Group by year, then by month for photos
+func dateChildren(library *Library, index *libraryIndex, id string, values []string) ([]*object, error) {
+	timeOf := func(entry *mediaEntry) time.Time {
+		return time.Unix(entry.CaptureTime, 0)
+	}
+
+	if len(values) == 0 {
+		years := map[int]int{}
+		for _, entry := range index.entries {
+			years[timeOf(entry).Year()]++
+		}
+		yearList := []int{}
+		for year := range years {
+			yearList = append(yearList, year)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(yearList)))
+		results := []*object{}
+		for _, year := range yearList {
+			yearString := strconv.Itoa(year)
+			results = append(results, containerObject(makeID(library.ID, kindMetadata, "date", yearString), id, yearString, "object.container.storageFolder", years[year], library))
+		}
+		return results, nil
+	}
+
+	year, err := strconv.Atoi(values[0])
+	if err != nil {
+		return nil, errNoSuchObject
+	}
+	entries := []*mediaEntry{}
+	for _, entry := range index.entries {
+		if timeOf(entry).Year() == year {
+			entries = append(entries, entry)
+		}
+	}
+	sortEntriesByCaptureTime(entries)
+
+	if library.Type != LibraryPhoto {
+		if len(values) != 1 {
+			return nil, errNoSuchObject
+		}
+		return itemObjects(library, entries, id), nil
+	}
+
+	if len(values) == 1 {
+		//List the months of the year
+		months := map[int]int{}
+		for _, entry := range entries {
+			months[int(timeOf(entry).Month())]++
+		}
+		results := []*object{}
+		for month := 12; month >= 1; month-- {
+			if months[month] == 0 {
+				continue
+			}
+			monthString := strconv.Itoa(month)
+			title := time.Month(month).String() + " " + values[0]
+			results = append(results, containerObject(makeID(library.ID, kindMetadata, "date", values[0], monthString), id, title, "object.container.album.photoAlbum", months[month], library))
+		}
+		return results, nil
+	}
+
+	month, err := strconv.Atoi(values[1])
+	if err != nil || len(values) != 2 {
+		return nil, errNoSuchObject
+	}
+	monthEntries := []*mediaEntry{}
+	for _, entry := range entries {
+		if int(timeOf(entry).Month()) == month {
+			monthEntries = append(monthEntries, entry)
+		}
+	}
+	if len(monthEntries) == 0 {
+		return nil, errNoSuchObject
+	}
+	return itemObjects(library, monthEntries, id), nil
+}
+
+/*
+	Sorting
+*/
+
+func valueOrUnknown(value string, unknown string) string {
+	if value == "" {
+		return unknown
+	}
+	return value
+}
+
+func sortEntriesByName(entries []*mediaEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return strings.ToLower(entries[i].Title) < strings.ToLower(entries[j].Title)
+	})
+}
+
+func sortEntriesByCaptureTime(entries []*mediaEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].CaptureTime > entries[j].CaptureTime
+	})
+}
+
+//Sort the tracks in album order (album, disc, track number, then title)
+func sortEntriesByAlbum(entries []*mediaEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Album != entries[j].Album {
+			return strings.ToLower(entries[i].Album) < strings.ToLower(entries[j].Album)
+		}
+		if entries[i].DiscNumber != entries[j].DiscNumber {
+			return entries[i].DiscNumber < entries[j].DiscNumber
+		}
+		if entries[i].TrackNumber != entries[j].TrackNumber {
+			return entries[i].TrackNumber < entries[j].TrackNumber
+		}
+		return strings.ToLower(entries[i].Title) < strings.ToLower(entries[j].Title)
+	})
+}
@@ -2,6 +2,7 @@ package dynamicproxy
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"log"
 	"net/http"
@@ -9,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"imuslab.com/arozos/mod/network/dynamicproxy/dpcore"
@@ -28,10 +30,25 @@ type Router struct {
 	mux               http.Handler
 	useTLS            bool
 	server            *http.Server
+
+	rules         []*ProxyRule //Proxy rules managed by admin
+	routingTable  atomic.Value //Compiled routing table of the rules, *routingTable
+	ruleMutex     sync.Mutex
+	accessChecker AccessChecker
+	healthStop    chan bool
+	tlsConfig     *tls.Config
+	challenge     func(w http.ResponseWriter, r *http.Request) bool
+	stripCookies  []string
+	stripHeaders  []string
 }
 
 type RouterOption struct {
-	Port int
+	Port             int
+	AccessChecker    AccessChecker                                     //Check the login state of requests for rules that require login
+	TLSConfig        *tls.Config                                       //TLS config for serving with HTTPS, e.g. certificates from ACME
+	ChallengeHandler func(w http.ResponseWriter, r *http.Request) bool //Handle ACME HTTP challenges, return true if handled
+	StripCookies     []string                                          //Cookies never forwarded to the upstreams, e.g. the session cookie
+	StripHeaders     []string                                          //Request headers never forwarded to the upstreams, e.g. the auth token headers
 }
 
 type ProxyEndpoint struct {
@@ -52,18 +69,30 @@ type ProxyHandler struct {
 	Parent *Router
 }
 
-func NewDynamicProxy(port int) (*Router, error) {
+func NewDynamicProxy(option RouterOption) (*Router, error) {
 	proxyMap := sync.Map{}
 	domainMap := sync.Map{}
 	thisRouter := Router{
-		ListenPort:        port,
+		ListenPort:        option.Port,
 		ProxyEndpoints:    &proxyMap,
 		SubdomainEndpoint: &domainMap,
 		Running:           false,
 		useTLS:            false,
 		server:            nil,
+		rules:             []*ProxyRule{},
+		accessChecker:     option.AccessChecker,
+		tlsConfig:         option.TLSConfig,
+		challenge:         option.ChallengeHandler,
+		stripCookies:      option.StripCookies,
+		stripHeaders:      option.StripHeaders,
 	}
 
+	thisRouter.routingTable.Store(&routingTable{
+		pathRules:      []*compiledRule{},
+		subdomainRules: map[string]*compiledRule{},
+		allRules:       []*compiledRule{},
+	})
+
 	thisRouter.mux = &ProxyHandler{
 		Parent: &thisRouter,
 	}
@@ -78,16 +107,28 @@ func (router *Router) StartProxyService() error {
 		return errors.New("Reverse proxy server already running")
 	}
 
-	if router.Root == nil {
-		return errors.New("Reverse proxy router root not set")
+	if router.useTLS && router.tlsConfig == nil {
+		return errors.New("TLS config not set")
 	}
 
 	router.server = &http.Server{Addr: ":" + strconv.Itoa(router.ListenPort), Handler: router.mux}
 	router.Running = true
-	go func() {
-		err := router.server.ListenAndServe()
-		log.Println("[DynamicProxy] " + err.Error())
-	}()
+	if router.useTLS {
+		router.server.TLSConfig = router.tlsConfig
+		go func(server *http.Server) {
+			err := server.ListenAndServeTLS("", "")
+			log.Println("[DynamicProxy] " + err.Error())
+		}(router.server)
+	} else {
+		go func(server *http.Server) {
+			err := server.ListenAndServe()
+			log.Println("[DynamicProxy] " + err.Error())
+		}(router.server)
+	}
+
+	//Start checking the health of the upstreams
+	router.healthStop = make(chan bool)
+	go router.healthCheckLoop(router.healthStop)
 
 	return nil
 }
@@ -106,9 +147,19 @@ func (router *Router) StopProxyService() error {
 	//Discard the server object
 	router.server = nil
 	router.Running = false
+
+	if router.healthStop != nil {
+		close(router.healthStop)
+		router.healthStop = nil
+	}
 	return nil
 }
 
+//Serve with HTTPS using the TLS config given in router option. Take effect on next start
+func (router *Router) SetTLS(useTLS bool) {
+	router.useTLS = useTLS
+}
+
 /*
 	Add an URL into a custom proxy services
 */
@@ -177,6 +228,17 @@ func (router *Router) SetRootProxy(proxyLocation string, requireTLS bool) error
 
 //Do all the main routing in here
 func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	//Answer ACME challenges for the hostnames served by this proxy
+	if h.Parent.challenge != nil && h.Parent.challenge(w, r) {
+		return
+	}
+
+	//Rules managed by admin take priority
+	if rule := h.Parent.getRoutingTable().match(r); rule != nil {
+		h.ruleRequest(w, r, rule)
+		return
+	}
+
 	if strings.Contains(r.Host, ".") {
 		//This might be a subdomain. See if there are any subdomain proxy router for this
 		sep := h.Parent.getSubdomainProxyEndpointFromHostname(r.Host)
@@ -189,7 +251,9 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	targetProxyEndpoint := h.Parent.getTargetProxyEndpointFromRequestURI(r.RequestURI)
 	if targetProxyEndpoint != nil {
 		h.proxyRequest(w, r, targetProxyEndpoint)
-	} else {
+	} else if h.Parent.Root != nil {
 		h.proxyRequest(w, r, h.Parent.Root)
+	} else {
+		http.NotFound(w, r)
 	}
 }
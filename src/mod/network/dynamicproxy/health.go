@@ -0,0 +1,82 @@
+package dynamicproxy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+	Upstream Health Check
+
+	Upstreams of the rules with health check path set are probed periodically.
+	An upstream is considered healthy if it reply with a status code below 500
+*/
+
+const (
+	defaultHealthInterval = 30 //Default health check interval in seconds
+	healthCheckTimeout    = 5 * time.Second
+)
+
+func (router *Router) healthCheckLoop(stop chan bool) {
+	client := &http.Client{
+		Timeout: healthCheckTimeout,
+	}
+
+	lastChecked := map[*compiledRule]time.Time{}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			table := router.getRoutingTable()
+			checked := map[*compiledRule]time.Time{}
+			var wg sync.WaitGroup
+			for _, rule := range table.allRules {
+				if rule.Rule.HealthCheck == "" {
+					continue
+				}
+
+				interval := rule.Rule.HealthInterval
+				if interval <= 0 {
+					interval = defaultHealthInterval
+				}
+
+				last, ok := lastChecked[rule]
+				if ok && time.Since(last) < time.Duration(interval)*time.Second {
+					checked[rule] = last
+					continue
+				}
+
+				checked[rule] = time.Now()
+				for _, thisUpstream := range rule.upstreams {
+					wg.Add(1)
+					go func(rule *compiledRule, thisUpstream *upstream) {
+						defer wg.Done()
+						thisUpstream.setHealthy(checkUpstreamHealth(client, rule, thisUpstream))
+					}(rule, thisUpstream)
+				}
+			}
+			wg.Wait()
+
+			//Rules removed from the routing table are dropped here
+			lastChecked = checked
+		}
+	}
+}
+
+func checkUpstreamHealth(client *http.Client, rule *compiledRule, thisUpstream *upstream) bool {
+	scheme := "http://"
+	if rule.Rule.RequireTLS {
+		scheme = "https://"
+	}
+
+	resp, err := client.Get(scheme + thisUpstream.Host + rule.Rule.HealthCheck)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode < 500
+}
@@ -39,7 +39,31 @@ func (router *Router) rewriteURL(rooturl string, requestURL string) string {
 	return ""
 }
 
+//Remove the credentials of this host from the request so the upstreams cannot reuse them.
+//Cookies are scoped by hostname only, so the browser send the session cookie to the proxy port as well
+func (router *Router) stripCredentials(r *http.Request) {
+	for _, header := range router.stripHeaders {
+		r.Header.Del(header)
+	}
+	if len(router.stripCookies) == 0 || r.Header.Get("Cookie") == "" {
+		return
+	}
+
+	stripped := map[string]bool{}
+	for _, name := range router.stripCookies {
+		stripped[name] = true
+	}
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if !stripped[cookie.Name] {
+			r.AddCookie(cookie)
+		}
+	}
+}
+
 func (h *ProxyHandler) subdomainRequest(w http.ResponseWriter, r *http.Request, target *SubdomainEndpoint) {
+	h.Parent.stripCredentials(r)
 	r.Header.Set("X-Forwarded-Host", r.Host)
 	requestURL := r.URL.String()
 	if r.Header["Upgrade"] != nil && r.Header["Upgrade"][0] == "websocket" {
@@ -72,6 +96,7 @@ func (h *ProxyHandler) subdomainRequest(w http.ResponseWriter, r *http.Request,
 }
 
 func (h *ProxyHandler) proxyRequest(w http.ResponseWriter, r *http.Request, target *ProxyEndpoint) {
+	h.Parent.stripCredentials(r)
 	rewriteURL := h.Parent.rewriteURL(target.Root, r.RequestURI)
 	r.URL, _ = url.Parse(rewriteURL)
 	r.Header.Set("X-Forwarded-Host", r.Host)
@@ -0,0 +1,313 @@
+package dynamicproxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"imuslab.com/arozos/mod/network/dynamicproxy/dpcore"
+)
+
+/*
+	Proxy Rules
+
+	A proxy rule forward the requests matching a path prefix or a hostname to
+	one or more upstreams. Requests are distributed to the healthy upstreams
+	in round-robin order.
+
+	Rules are compiled into an immutable routing table. Updating the rules
+	swap the routing table atomically, so requests already being proxied
+	continue with the previous table and no connection is dropped.
+*/
+
+const (
+	RuleTypePath      = "path"      //Match requests by path prefix
+	RuleTypeSubdomain = "subdomain" //Match requests by hostname
+)
+
+type ProxyRule struct {
+	ID             string
+	Name           string
+	Type           string            //path or subdomain
+	Match          string            //Path prefix (e.g. /git) or hostname (e.g. git.example.com)
+	Upstreams      []string          //Upstream host with optional path, e.g. 192.168.0.10:3000
+	RequireTLS     bool              //Connect to the upstreams with https
+	RequireLogin   bool              //Require ArozOS login to access this rule
+	AllowGroups    []string          //Permission groups allowed to access this rule. Empty for all logged in users
+	AllowIPs       []string          //IP or CIDR allowed to access this rule. Empty for all
+	DenyIPs        []string          //IP or CIDR denied from accessing this rule. Take priority over AllowIPs
+	Headers        map[string]string //Headers injected into the upstream request. {username} is replaced by the login username
+	HealthCheck    string            //Path for health checking the upstreams, empty to disable
+	HealthInterval int               //Health check interval in seconds
+	Disabled       bool
+}
+
+//Function for checking the login state of the request. Return the username and permission groups, or error if not logged in
+type AccessChecker func(r *http.Request) (string, []string, error)
+
+type upstream struct {
+	Host    string
+	Proxy   *dpcore.ReverseProxy
+	healthy int32 //1 if healthy, accessed atomically
+}
+
+func (u *upstream) isHealthy() bool {
+	return atomic.LoadInt32(&u.healthy) == 1
+}
+
+func (u *upstream) setHealthy(healthy bool) {
+	value := int32(0)
+	if healthy {
+		value = 1
+	}
+	atomic.StoreInt32(&u.healthy, value)
+}
+
+//A proxy rule ready for serving requests
+type compiledRule struct {
+	Rule      *ProxyRule
+	upstreams []*upstream
+	allowNets []*net.IPNet
+	denyNets  []*net.IPNet
+	counter   uint32 //Round-robin counter, accessed atomically
+}
+
+type routingTable struct {
+	pathRules      []*compiledRule          //Sorted by match length, longest first
+	subdomainRules map[string]*compiledRule //Key is the lower case hostname
+	allRules       []*compiledRule
+}
+
+//Parse the IP or CIDR into network
+func parseIPNet(value string) (*net.IPNet, error) {
+	value = strings.TrimSpace(value)
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, errors.New("Invalid IP address: " + value)
+		}
+		if ip.To4() != nil {
+			value = value + "/32"
+		} else {
+			value = value + "/128"
+		}
+	}
+
+	_, ipnet, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, errors.New("Invalid IP range: " + value)
+	}
+	return ipnet, nil
+}
+
+//Check the rule is valid
+func (rule *ProxyRule) Validate() error {
+	if rule.Type != RuleTypePath && rule.Type != RuleTypeSubdomain {
+		return errors.New("Invalid rule type")
+	}
+
+	if rule.Match == "" {
+		return errors.New("Matching path or hostname cannot be empty")
+	}
+
+	if rule.Type == RuleTypePath && !strings.HasPrefix(rule.Match, "/") {
+		return errors.New("Matching path must start with /")
+	}
+
+	if len(rule.Upstreams) == 0 {
+		return errors.New("At least one upstream is required")
+	}
+
+	for _, host := range rule.Upstreams {
+		if _, err := url.Parse("http://" + strings.TrimSuffix(host, "/")); err != nil || strings.TrimSpace(host) == "" {
+			return errors.New("Invalid upstream: " + host)
+		}
+	}
+
+	for _, ip := range append(append([]string{}, rule.AllowIPs...), rule.DenyIPs...) {
+		if _, err := parseIPNet(ip); err != nil {
+			return err
+		}
+	}
+
+	if rule.HealthCheck != "" && !strings.HasPrefix(rule.HealthCheck, "/") {
+		return errors.New("Health check path must start with /")
+	}
+
+	return nil
+}
+
+func compileRule(rule *ProxyRule, previous *compiledRule) (*compiledRule, error) {
+	err := rule.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	compiled := &compiledRule{
+		Rule: rule,
+	}
+
+	for _, host := range rule.Upstreams {
+		host = strings.TrimSuffix(strings.TrimSpace(host), "/")
+		scheme := "http://"
+		if rule.RequireTLS {
+			scheme = "https://"
+		}
+		target, _ := url.Parse(scheme + host)
+
+		prepender := ""
+		if rule.Type == RuleTypePath {
+			prepender = rule.Match
+		}
+
+		thisUpstream := &upstream{
+			Host:    host,
+			Proxy:   dpcore.NewDynamicProxyCore(target, prepender),
+			healthy: 1,
+		}
+
+		//Keep the health state of the upstream from the previous table
+		if previous != nil {
+			for _, previousUpstream := range previous.upstreams {
+				if previousUpstream.Host == host {
+					thisUpstream.setHealthy(previousUpstream.isHealthy())
+				}
+			}
+		}
+		compiled.upstreams = append(compiled.upstreams, thisUpstream)
+	}
+
+	for _, ip := range rule.AllowIPs {
+		ipnet, _ := parseIPNet(ip)
+		compiled.allowNets = append(compiled.allowNets, ipnet)
+	}
+
+	for _, ip := range rule.DenyIPs {
+		ipnet, _ := parseIPNet(ip)
+		compiled.denyNets = append(compiled.denyNets, ipnet)
+	}
+
+	return compiled, nil
+}
+
+//Build a new routing table from the rules
+func buildRoutingTable(rules []*ProxyRule, previous *routingTable) (*routingTable, error) {
+	table := &routingTable{
+		pathRules:      []*compiledRule{},
+		subdomainRules: map[string]*compiledRule{},
+		allRules:       []*compiledRule{},
+	}
+
+	previousRules := map[string]*compiledRule{}
+	if previous != nil {
+		for _, rule := range previous.allRules {
+			previousRules[rule.Rule.ID] = rule
+		}
+	}
+
+	for _, rule := range rules {
+		if rule.Disabled {
+			continue
+		}
+
+		compiled, err := compileRule(rule, previousRules[rule.ID])
+		if err != nil {
+			return nil, errors.New(rule.Name + ": " + err.Error())
+		}
+
+		if rule.Type == RuleTypeSubdomain {
+			table.subdomainRules[strings.ToLower(rule.Match)] = compiled
+		} else {
+			table.pathRules = append(table.pathRules, compiled)
+		}
+		table.allRules = append(table.allRules, compiled)
+	}
+
+	sort.SliceStable(table.pathRules, func(i, j int) bool {
+		return len(table.pathRules[i].Rule.Match) > len(table.pathRules[j].Rule.Match)
+	})
+	return table, nil
+}
+
+//Find the rule matching the request, return nil if not found
+func (t *routingTable) match(r *http.Request) *compiledRule {
+	hostname := strings.ToLower(r.Host)
+	if host, _, err := net.SplitHostPort(hostname); err == nil {
+		hostname = host
+	}
+
+	if rule, ok := t.subdomainRules[hostname]; ok {
+		return rule
+	}
+
+	for _, rule := range t.pathRules {
+		match := rule.Rule.Match
+		if r.URL.Path == match || strings.HasPrefix(r.URL.Path, strings.TrimSuffix(match, "/")+"/") {
+			return rule
+		}
+	}
+	return nil
+}
+
+//Pick the next healthy upstream in round-robin order, return nil if all upstreams are down
+func (c *compiledRule) nextUpstream() *upstream {
+	total := len(c.upstreams)
+	start := atomic.AddUint32(&c.counter, 1)
+	for i := 0; i < total; i++ {
+		candidate := c.upstreams[(int(start)+i)%total]
+		if candidate.isHealthy() {
+			return candidate
+		}
+	}
+	return nil
+}
+
+//Check if the client IP can access this rule
+func (c *compiledRule) allowIP(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, ipnet := range c.denyNets {
+		if ipnet.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(c.allowNets) == 0 {
+		return true
+	}
+
+	for _, ipnet := range c.allowNets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//Check if the user in the given groups can access this rule
+func (c *compiledRule) allowGroups(groups []string) bool {
+	if len(c.Rule.AllowGroups) == 0 {
+		return true
+	}
+
+	for _, group := range groups {
+		for _, allowed := range c.Rule.AllowGroups {
+			if group == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
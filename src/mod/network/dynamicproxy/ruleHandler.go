@@ -0,0 +1,146 @@
+package dynamicproxy
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"imuslab.com/arozos/mod/network/websocketproxy"
+)
+
+/*
+	Rule Request Handler
+
+	Handle the requests matching the proxy rules managed by admin
+*/
+
+type UpstreamStatus struct {
+	RuleID  string
+	Host    string
+	Healthy bool
+}
+
+func (router *Router) getRoutingTable() *routingTable {
+	return router.routingTable.Load().(*routingTable)
+}
+
+//Replace all the proxy rules. The new rules take effect without dropping the ongoing connections
+func (router *Router) SetRules(rules []*ProxyRule) error {
+	router.ruleMutex.Lock()
+	defer router.ruleMutex.Unlock()
+
+	table, err := buildRoutingTable(rules, router.getRoutingTable())
+	if err != nil {
+		return err
+	}
+
+	router.rules = rules
+	router.routingTable.Store(table)
+	return nil
+}
+
+//Get a copy of the current proxy rules
+func (router *Router) GetRules() []*ProxyRule {
+	router.ruleMutex.Lock()
+	defer router.ruleMutex.Unlock()
+	results := make([]*ProxyRule, len(router.rules))
+	copy(results, router.rules)
+	return results
+}
+
+//Get the hostnames matched by the enabled subdomain rules
+func (router *Router) GetHostnames() []string {
+	results := []string{}
+	for hostname := range router.getRoutingTable().subdomainRules {
+		results = append(results, hostname)
+	}
+	return results
+}
+
+//Get the health state of all the upstreams of the enabled rules
+func (router *Router) GetUpstreamStatus() []*UpstreamStatus {
+	results := []*UpstreamStatus{}
+	for _, rule := range router.getRoutingTable().allRules {
+		for _, thisUpstream := range rule.upstreams {
+			results = append(results, &UpstreamStatus{
+				RuleID:  rule.Rule.ID,
+				Host:    thisUpstream.Host,
+				Healthy: thisUpstream.isHealthy(),
+			})
+		}
+	}
+	return results
+}
+
+func (h *ProxyHandler) ruleRequest(w http.ResponseWriter, r *http.Request, rule *compiledRule) {
+	//Check the client IP
+	if !rule.allowIP(r.RemoteAddr) {
+		http.Error(w, "403 - Forbidden", http.StatusForbidden)
+		return
+	}
+
+	//Check the login state and permission group of the user
+	username := ""
+	if rule.Rule.RequireLogin {
+		if h.Parent.accessChecker == nil {
+			http.Error(w, "403 - Forbidden", http.StatusForbidden)
+			return
+		}
+
+		thisUsername, groups, err := h.Parent.accessChecker(r)
+		if err != nil {
+			http.Error(w, "401 - Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if !rule.allowGroups(groups) {
+			http.Error(w, "403 - Forbidden", http.StatusForbidden)
+			return
+		}
+		username = thisUsername
+	}
+
+	//Pick an upstream for this request
+	target := rule.nextUpstream()
+	if target == nil {
+		http.Error(w, "502 - No healthy upstream", http.StatusBadGateway)
+		return
+	}
+
+	//Never forward the credentials of this host, then inject the custom headers
+	h.Parent.stripCredentials(r)
+	for key, value := range rule.Rule.Headers {
+		r.Header.Set(key, strings.Replace(value, "{username}", username, -1))
+	}
+
+	if rule.Rule.Type == RuleTypePath {
+		rewriteURL := h.Parent.rewriteURL(rule.Rule.Match, r.RequestURI)
+		r.URL, _ = url.Parse(rewriteURL)
+	}
+
+	r.Header.Set("X-Forwarded-Host", r.Host)
+	if r.Header["Upgrade"] != nil && r.Header["Upgrade"][0] == "websocket" {
+		//Handle WebSocket request. Forward the custom Upgrade header and rewrite origin
+		r.Header.Set("A-Upgrade", "websocket")
+		requestURL := strings.TrimPrefix(r.URL.String(), "/")
+		u, _ := url.Parse("ws://" + target.Host + "/" + requestURL)
+		if rule.Rule.RequireTLS {
+			u, _ = url.Parse("wss://" + target.Host + "/" + requestURL)
+		}
+		wspHandler := websocketproxy.NewProxy(u)
+		wspHandler.ServeHTTP(w, r)
+		return
+	}
+
+	r.Host = r.URL.Host
+	err := target.Proxy.ServeHTTP(w, r)
+	if err != nil {
+		log.Println("[DynamicProxy] " + rule.Rule.Name + ": " + err.Error())
+
+		//Take the upstream offline until the next health check pass
+		if rule.Rule.HealthCheck != "" {
+			target.setHealthy(false)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package nearby
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+	Rate Limiter
+
+	Token bucket limiter per IP address for the endpoints
+	that are accessible by other hosts in the LAN
+*/
+
+type bucket struct {
+	tokens     float64
+	lastUpdate time.Time
+}
+
+type rateLimiter struct {
+	rate    float64 //Tokens refilled per second
+	burst   float64
+	buckets map[string]*bucket
+	mutex   sync.Mutex
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: map[string]*bucket{},
+	}
+}
+
+//Take a token from the bucket of the given key. Return false if the bucket is empty
+func (l *rateLimiter) Allow(key string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, lastUpdate: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.lastUpdate).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.lastUpdate = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+//Remove the buckets that are already full
+func (l *rateLimiter) cleanup() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.lastUpdate).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package nearby
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	db "imuslab.com/arozos/mod/database"
+	"imuslab.com/arozos/mod/event"
+	"imuslab.com/arozos/mod/network/neighbour"
+	prout "imuslab.com/arozos/mod/prouter"
+	user "imuslab.com/arozos/mod/user"
+)
+
+/*
+	Nearby File Send
+
+	Send files to the users of other ArozOS hosts in the same LAN.
+
+	1. The sender pick a host found by the neighbour discoverer and one of the
+	   users on that host who allow receiving files from nearby devices
+	2. The sending host offer the files (name, size and SHA-256) to the receiving host
+	3. The recipient accept the offer and choose the destination folder, or decline it
+	4. The sending host stream the files directly to the receiving host. Interrupted
+	   transfers continue from the bytes already received. Each file is verified
+	   with the SHA-256 in the offer before it is moved to the destination folder
+
+	The endpoints between the hosts only accept requests from LAN addresses
+	and are rate limited per IP address.
+*/
+
+const (
+	StatePreparing = "preparing" //Calculating the checksums of the files (sender only)
+	StatePending   = "pending"   //Waiting for the recipient to respond
+	StateAccepted  = "accepted"
+	StateDeclined  = "declined"
+	StateExpired   = "expired"
+	StateCompleted = "completed"
+	StateFailed    = "failed"
+	StateCancelled = "cancelled"
+)
+
+const (
+	offerLifetime       = 300  //Time for the recipient to respond to the offer in seconds
+	transferIdleTimeout = 3600 //Accepted transfers without any progress are dropped after this time in seconds
+	recordRetention     = 86400
+	maxFilesPerOffer    = 100
+	maxPendingPerUser   = 5
+	maxPendingOffers    = 50
+)
+
+type FileEntry struct {
+	Name string
+	Size int64
+	Hash string //SHA-256 in hex
+}
+
+//Offer sent from the sending host
+type Offer struct {
+	SenderHost string //Host name of the sending host
+	SenderUUID string
+	SenderUser string
+	Recipient  string
+	Files      []FileEntry
+}
+
+//Response of the offer, required for checking the status and uploading the files
+type OfferTicket struct {
+	ID    string
+	Token string
+}
+
+//Transfer status reported to the sending host
+type TransferStatus struct {
+	State    string
+	Received []int64 //Bytes received for each file
+	Error    string
+}
+
+type Options struct {
+	HostName    string
+	HostUUID    string
+	Discoverer  *neighbour.Discoverer //Can be nil if MDNS is disabled
+	UserHandler *user.UserHandler
+	Database    *db.Database
+	EventBus    *event.EventBus
+}
+
+type Manager struct {
+	Options      Options
+	incoming     map[string]*incomingTransfer
+	outgoing     map[string]*outgoingTransfer
+	offerLimiter *rateLimiter //Limit for creating offers
+	apiLimiter   *rateLimiter //Limit for other requests between hosts
+	client       *http.Client
+	mutex        sync.Mutex
+}
+
+func NewManager(option Options) (*Manager, error) {
+	err := option.Database.NewTable("nearby")
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manager{
+		Options:      option,
+		incoming:     map[string]*incomingTransfer{},
+		outgoing:     map[string]*outgoingTransfer{},
+		offerLimiter: newRateLimiter(0.1, 5),
+		apiLimiter:   newRateLimiter(20, 40),
+		client: &http.Client{
+			Transport: &http.Transport{
+				//Hosts with HTTPS only mostly use self-signed certificates. The files are verified with the checksums instead
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		},
+	}
+
+	go m.cleanupLoop()
+	return m, nil
+}
+
+//Check if the user allow receiving files from nearby hosts
+func (m *Manager) CanReceive(username string) bool {
+	allow := false
+	if m.Options.Database.KeyExists("nearby", "receive/"+username) {
+		m.Options.Database.Read("nearby", "receive/"+username, &allow)
+	}
+	return allow
+}
+
+func (m *Manager) SetCanReceive(username string, allow bool) error {
+	return m.Options.Database.Write("nearby", "receive/"+username, allow)
+}
+
+//Remove the finished records and expire the pending offers
+func (m *Manager) cleanupLoop() {
+	for {
+		time.Sleep(30 * time.Second)
+		m.cleanup()
+	}
+}
+
+func (m *Manager) cleanup() {
+	now := time.Now().Unix()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for id, t := range m.incoming {
+		switch t.State {
+		case StatePending:
+			if now > t.CreatedTime+offerLifetime {
+				t.State = StateExpired
+				t.UpdateTime = now
+			}
+		case StateAccepted:
+			if now > t.UpdateTime+transferIdleTimeout {
+				t.State = StateFailed
+				t.Error = "Transfer timeout"
+				t.UpdateTime = now
+				t.removePartialFiles()
+			}
+		default:
+			if now > t.UpdateTime+recordRetention {
+				delete(m.incoming, id)
+			}
+		}
+	}
+	for id, t := range m.outgoing {
+		if t.isFinished() && now > t.UpdateTime+recordRetention {
+			delete(m.outgoing, id)
+		}
+	}
+	m.offerLimiter.cleanup()
+	m.apiLimiter.cleanup()
+}
+
+//Check if the request comes from the LAN and is within the rate limit
+func (m *Manager) checkRemoteRequest(w http.ResponseWriter, r *http.Request, limiter *rateLimiter) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || !prout.IsPrivateIP(net.ParseIP(host)) || !prout.CheckIfLAN(r) {
+		http.NotFound(w, r)
+		return false
+	}
+	if !limiter.Allow(host) {
+		w.Header().Set("Retry-After", "10")
+		sendErrorStatus(w, http.StatusTooManyRequests, "Too many requests")
+		return false
+	}
+	return true
+}
+
+//Check if the filename in the offer is safe to use
+func validFilename(name string) bool {
+	if name == "" || name == "." || name == ".." || len(name) > 255 {
+		return false
+	}
+	if strings.ContainsAny(name, "/\\\x00") || filepath.Base(name) != name {
+		return false
+	}
+	return !strings.HasPrefix(name, ".")
+}
+
+func newRandomID(length int) (string, error) {
+	buf := make([]byte, length)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", errors.New("Unable to generate random ID")
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+//Send the error with the status code to the other hosts
+func sendErrorStatus(w http.ResponseWriter, statusCode int, errMsg string) {
+	js, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{errMsg})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(js)
+}
@@ -0,0 +1,550 @@
+package nearby
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"imuslab.com/arozos/mod/event"
+)
+
+/*
+	Receiving Host
+
+	Endpoints for the sending hosts and the recipients on this host
+*/
+
+type incomingTransfer struct {
+	ID          string
+	Token       string `json:"-"`
+	SenderHost  string
+	SenderUUID  string
+	SenderUser  string
+	SenderIP    string
+	Recipient   string
+	Files       []FileEntry
+	Received    []int64
+	Saved       []string //Virtual paths of the received files
+	State       string
+	Error       string
+	DestDir     string
+	CreatedTime int64
+	UpdateTime  int64
+	destRealDir string
+	uploading   map[int]bool
+}
+
+func (t *incomingTransfer) status() *TransferStatus {
+	received := make([]int64, len(t.Received))
+	copy(received, t.Received)
+	return &TransferStatus{
+		State:    t.State,
+		Received: received,
+		Error:    t.Error,
+	}
+}
+
+func (t *incomingTransfer) partFilePath(index int) string {
+	return filepath.Join(t.destRealDir, "."+t.Files[index].Name+"."+t.ID[:8]+".part")
+}
+
+func (t *incomingTransfer) removePartialFiles() {
+	if t.destRealDir == "" {
+		return
+	}
+	for i := range t.Files {
+		os.Remove(t.partFilePath(i))
+	}
+}
+
+/*
+	Endpoints for the sending hosts
+*/
+
+//List the users on this host that accept files from nearby hosts
+func (m *Manager) HandleRecipients(w http.ResponseWriter, r *http.Request) {
+	if !m.checkRemoteRequest(w, r, m.apiLimiter) {
+		return
+	}
+	recipients := []string{}
+	for _, username := range m.Options.UserHandler.GetAuthAgent().ListUsers() {
+		if m.CanReceive(username) {
+			recipients = append(recipients, username)
+		}
+	}
+	sort.Strings(recipients)
+	js, _ := json.Marshal(struct {
+		HostName   string
+		HostUUID   string
+		Recipients []string
+	}{m.Options.HostName, m.Options.HostUUID, recipients})
+	sendJSONResponse(w, string(js))
+}
+
+//Offer files to a user on this host. The offer is shown to the recipient to accept or decline
+func (m *Manager) HandleOffer(w http.ResponseWriter, r *http.Request) {
+	if !m.checkRemoteRequest(w, r, m.offerLimiter) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		sendErrorStatus(w, http.StatusMethodNotAllowed, "POST only")
+		return
+	}
+
+	offer := Offer{}
+	err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&offer)
+	if err != nil {
+		sendErrorStatus(w, http.StatusBadRequest, "Invalid offer")
+		return
+	}
+	err = validateOffer(&offer)
+	if err != nil {
+		sendErrorStatus(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !m.Options.UserHandler.GetAuthAgent().UserExists(offer.Recipient) || !m.CanReceive(offer.Recipient) {
+		sendErrorStatus(w, http.StatusNotFound, "Recipient not found")
+		return
+	}
+
+	id, err := newRandomID(16)
+	if err != nil {
+		sendErrorStatus(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	token, err := newRandomID(32)
+	if err != nil {
+		sendErrorStatus(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	senderIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+	now := time.Now().Unix()
+	transfer := incomingTransfer{
+		ID:          id,
+		Token:       token,
+		SenderHost:  offer.SenderHost,
+		SenderUUID:  offer.SenderUUID,
+		SenderUser:  offer.SenderUser,
+		SenderIP:    senderIP,
+		Recipient:   offer.Recipient,
+		Files:       offer.Files,
+		Received:    make([]int64, len(offer.Files)),
+		Saved:       make([]string, len(offer.Files)),
+		State:       StatePending,
+		CreatedTime: now,
+		UpdateTime:  now,
+		uploading:   map[int]bool{},
+	}
+
+	m.mutex.Lock()
+	pendingTotal := 0
+	pendingForUser := 0
+	for _, t := range m.incoming {
+		if t.State == StatePending {
+			pendingTotal++
+			if t.Recipient == offer.Recipient {
+				pendingForUser++
+			}
+		}
+	}
+	if pendingTotal >= maxPendingOffers || pendingForUser >= maxPendingPerUser {
+		m.mutex.Unlock()
+		sendErrorStatus(w, http.StatusTooManyRequests, "Too many pending offers")
+		return
+	}
+	m.incoming[id] = &transfer
+	m.mutex.Unlock()
+
+	if m.Options.EventBus != nil {
+		m.Options.EventBus.Publish(event.NearbyOffer, offer.Recipient, map[string]interface{}{
+			"id":         id,
+			"senderHost": offer.SenderHost,
+			"senderUser": offer.SenderUser,
+			"files":      len(offer.Files),
+		})
+	}
+
+	js, _ := json.Marshal(OfferTicket{ID: id, Token: token})
+	sendJSONResponse(w, string(js))
+}
+
+func validateOffer(offer *Offer) error {
+	if len(offer.Files) == 0 || len(offer.Files) > maxFilesPerOffer {
+		return errors.New("Invalid number of files")
+	}
+	if len(offer.SenderHost) > 128 || len(offer.SenderUser) > 128 || len(offer.SenderUUID) > 128 {
+		return errors.New("Invalid sender")
+	}
+	names := []string{}
+	for i, file := range offer.Files {
+		if !validFilename(file.Name) || inArray(names, file.Name) {
+			return errors.New("Invalid filename: " + file.Name)
+		}
+		names = append(names, file.Name)
+		if file.Size < 0 {
+			return errors.New("Invalid file size")
+		}
+		hash, err := hex.DecodeString(file.Hash)
+		if err != nil || len(hash) != sha256.Size {
+			return errors.New("Invalid checksum")
+		}
+		offer.Files[i].Hash = strings.ToLower(file.Hash)
+	}
+	return nil
+}
+
+//Find the transfer with the id and token in the request, which must come from the sending host
+func (m *Manager) getIncomingFromRequest(w http.ResponseWriter, r *http.Request) (*incomingTransfer, bool) {
+	if !m.checkRemoteRequest(w, r, m.apiLimiter) {
+		return nil, false
+	}
+	id, _ := mv(r, "id", false)
+	token, _ := mv(r, "token", false)
+	senderIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	m.mutex.Lock()
+	transfer, ok := m.incoming[id]
+	m.mutex.Unlock()
+	if !ok || token == "" || transfer.Token != token || transfer.SenderIP != senderIP {
+		sendErrorStatus(w, http.StatusNotFound, "Transfer not found")
+		return nil, false
+	}
+	return transfer, true
+}
+
+//Get the status of the offer and the number of bytes received for each file
+func (m *Manager) HandleTransferStatus(w http.ResponseWriter, r *http.Request) {
+	transfer, ok := m.getIncomingFromRequest(w, r)
+	if !ok {
+		return
+	}
+	m.mutex.Lock()
+	js, _ := json.Marshal(transfer.status())
+	m.mutex.Unlock()
+	sendJSONResponse(w, string(js))
+}
+
+//Upload the content of a file starting from the given offset. Require id, token, index and offset
+func (m *Manager) HandleUpload(w http.ResponseWriter, r *http.Request) {
+	transfer, ok := m.getIncomingFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodPost {
+		sendErrorStatus(w, http.StatusMethodNotAllowed, "POST only")
+		return
+	}
+	index, err := strconv.Atoi(r.URL.Query().Get("index"))
+	if err != nil || index < 0 || index >= len(transfer.Files) {
+		sendErrorStatus(w, http.StatusBadRequest, "Invalid file index")
+		return
+	}
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil {
+		sendErrorStatus(w, http.StatusBadRequest, "Invalid offset")
+		return
+	}
+
+	m.mutex.Lock()
+	if transfer.State != StateAccepted || transfer.Saved[index] != "" {
+		m.mutex.Unlock()
+		sendErrorStatus(w, http.StatusConflict, "Transfer not accepting this file")
+		return
+	}
+	if transfer.uploading[index] || transfer.Received[index] != offset {
+		//Sender should continue from the number of bytes received in the transfer status
+		m.mutex.Unlock()
+		sendErrorStatus(w, http.StatusConflict, "Offset mismatch")
+		return
+	}
+	transfer.uploading[index] = true
+	m.mutex.Unlock()
+
+	file := transfer.Files[index]
+	partFile := transfer.partFilePath(index)
+	f, err := os.OpenFile(partFile, os.O_CREATE|os.O_WRONLY, 0755)
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+		if err == nil {
+			_, err = io.Copy(&progressWriter{w: f, m: m, t: transfer, index: index}, io.LimitReader(r.Body, file.Size-offset))
+		}
+		f.Close()
+	}
+
+	//Sync the received bytes with the part file so the sender can continue from there
+	received := int64(0)
+	if info, statErr := os.Stat(partFile); statErr == nil {
+		received = info.Size()
+	}
+	m.mutex.Lock()
+	transfer.Received[index] = received
+	transfer.UpdateTime = time.Now().Unix()
+	delete(transfer.uploading, index)
+	cancelled := transfer.State != StateAccepted
+	m.mutex.Unlock()
+
+	if cancelled {
+		os.Remove(partFile)
+		sendErrorStatus(w, http.StatusConflict, "Transfer cancelled")
+		return
+	}
+	if err != nil {
+		sendErrorStatus(w, http.StatusInternalServerError, "Transfer interrupted")
+		return
+	}
+	if received < file.Size {
+		sendErrorStatus(w, http.StatusBadRequest, "Incomplete upload")
+		return
+	}
+
+	//Verify the file with the checksum in the offer
+	hash, err := fileHash(partFile)
+	if err != nil || hash != file.Hash {
+		os.Remove(partFile)
+		m.mutex.Lock()
+		transfer.Received[index] = 0
+		m.mutex.Unlock()
+		sendErrorStatus(w, http.StatusUnprocessableEntity, "Checksum mismatch")
+		return
+	}
+
+	vpath, err := m.saveReceivedFile(transfer, index)
+	if err != nil {
+		os.Remove(partFile)
+		m.mutex.Lock()
+		transfer.Received[index] = 0
+		transfer.State = StateFailed
+		transfer.Error = err.Error()
+		m.mutex.Unlock()
+		transfer.removePartialFiles()
+		sendErrorStatus(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	m.mutex.Lock()
+	transfer.Saved[index] = vpath
+	completed := !inArray(transfer.Saved, "")
+	if completed {
+		transfer.State = StateCompleted
+	}
+	m.mutex.Unlock()
+
+	if completed && m.Options.EventBus != nil {
+		m.Options.EventBus.Publish(event.NearbyReceived, transfer.Recipient, map[string]interface{}{
+			"id":         transfer.ID,
+			"senderHost": transfer.SenderHost,
+			"senderUser": transfer.SenderUser,
+			"files":      transfer.Saved,
+		})
+	}
+	sendOK(w)
+}
+
+//Move the verified part file to the destination folder, renaming it if the filename is taken
+func (m *Manager) saveReceivedFile(transfer *incomingTransfer, index int) (string, error) {
+	userinfo, err := m.Options.UserHandler.GetUserInfoFromUsername(transfer.Recipient)
+	if err != nil {
+		return "", err
+	}
+
+	name := transfer.Files[index].Name
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	target := filepath.Join(transfer.destRealDir, name)
+	for i := 1; fileExists(target); i++ {
+		target = filepath.Join(transfer.destRealDir, base+" ("+strconv.Itoa(i)+")"+ext)
+	}
+
+	fsh, err := userinfo.GetFileSystemHandlerFromRealPath(target)
+	if err == nil && fsh.Hierarchy == "user" && !userinfo.StorageQuota.HaveSpace(transfer.Files[index].Size) {
+		return "", errors.New("Storage quota full")
+	}
+	err = os.Rename(transfer.partFilePath(index), target)
+	if err != nil {
+		return "", err
+	}
+	userinfo.SetOwnerOfFile(target)
+	return strings.TrimRight(transfer.DestDir, "/") + "/" + filepath.Base(target), nil
+}
+
+//Cancel the transfer from the sending host
+func (m *Manager) HandleRemoteCancel(w http.ResponseWriter, r *http.Request) {
+	transfer, ok := m.getIncomingFromRequest(w, r)
+	if !ok {
+		return
+	}
+	m.cancelIncoming(transfer)
+	sendOK(w)
+}
+
+func (m *Manager) cancelIncoming(transfer *incomingTransfer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if transfer.State == StatePending || transfer.State == StateAccepted {
+		transfer.State = StateCancelled
+		transfer.UpdateTime = time.Now().Unix()
+		transfer.removePartialFiles()
+	}
+}
+
+/*
+	Endpoints for the recipients
+*/
+
+//Get or set if the current user accept files from nearby hosts. Set with receive=true or false
+func (m *Manager) HandleSettings(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := m.Options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		receive, _ := mv(r, "receive", true)
+		err = m.SetCanReceive(userinfo.Username, receive == "true")
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+		sendOK(w)
+		return
+	}
+
+	js, _ := json.Marshal(struct {
+		HostName string
+		Receive  bool
+	}{m.Options.HostName, m.CanReceive(userinfo.Username)})
+	sendJSONResponse(w, string(js))
+}
+
+//List the offers and transfers to the current user
+func (m *Manager) HandleIncoming(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := m.Options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	m.mutex.Lock()
+	results := []incomingTransfer{}
+	for _, t := range m.incoming {
+		if t.Recipient == userinfo.Username {
+			results = append(results, *t)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].CreatedTime > results[j].CreatedTime
+	})
+	js, _ := json.Marshal(results)
+	m.mutex.Unlock()
+	sendJSONResponse(w, string(js))
+}
+
+//Accept or decline the offer. Require id, accept (true or false) and dest folder if accepted
+func (m *Manager) HandleRespond(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := m.Options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+	id, _ := mv(r, "id", true)
+	accept, _ := mv(r, "accept", true)
+
+	m.mutex.Lock()
+	transfer, ok := m.incoming[id]
+	m.mutex.Unlock()
+	if !ok || transfer.Recipient != userinfo.Username {
+		sendErrorResponse(w, "Offer not found")
+		return
+	}
+
+	destRealDir := ""
+	dest, _ := mv(r, "dest", true)
+	if accept == "true" {
+		dest = strings.TrimSpace(dest)
+		if !strings.Contains(dest, ":/") || inArray(strings.Split(filepath.ToSlash(dest), "/"), "..") {
+			sendErrorResponse(w, "Invalid destination given")
+			return
+		}
+		if !userinfo.CanWrite(dest) {
+			sendErrorResponse(w, "Permission denied")
+			return
+		}
+		destRealDir, err = userinfo.VirtualPathToRealPath(dest)
+		if err != nil || !IsDir(destRealDir) {
+			sendErrorResponse(w, "Destination folder not exists")
+			return
+		}
+
+		totalSize := int64(0)
+		for _, file := range transfer.Files {
+			totalSize += file.Size
+		}
+		fsh, err := userinfo.GetFileSystemHandlerFromVirtualPath(dest)
+		if err == nil && fsh.Hierarchy == "user" && !userinfo.StorageQuota.HaveSpace(totalSize) {
+			sendErrorResponse(w, "Storage quota full")
+			return
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if transfer.State != StatePending {
+		sendErrorResponse(w, "Offer is already "+transfer.State)
+		return
+	}
+	if accept == "true" {
+		transfer.State = StateAccepted
+		transfer.DestDir = dest
+		transfer.destRealDir = destRealDir
+	} else {
+		transfer.State = StateDeclined
+	}
+	transfer.UpdateTime = time.Now().Unix()
+	sendOK(w)
+}
+
+//Record the number of bytes written while receiving the file
+type progressWriter struct {
+	w     io.Writer
+	m     *Manager
+	t     *incomingTransfer
+	index int
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.m.mutex.Lock()
+	p.t.Received[p.index] += int64(n)
+	p.t.UpdateTime = time.Now().Unix()
+	cancelled := p.t.State != StateAccepted
+	p.m.mutex.Unlock()
+	if err == nil && cancelled {
+		err = errors.New("Transfer cancelled")
+	}
+	return n, err
+}
+
+func fileHash(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,648 @@
+package nearby
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"imuslab.com/arozos/mod/network/mdns"
+	prout "imuslab.com/arozos/mod/prouter"
+)
+
+/*
+	Sending Host
+
+	Offer the files to the receiving host and upload them once the
+	recipient accepted. Interrupted uploads continue from the number
+	of bytes the receiving host reported.
+*/
+
+const (
+	requestTimeout = 10 * time.Second
+	pollInterval   = 2 * time.Second
+	maxRetries     = 5
+)
+
+type outgoingFile struct {
+	Name     string
+	Vpath    string
+	Size     int64
+	Hash     string
+	Sent     int64
+	realpath string
+}
+
+type outgoingTransfer struct {
+	ID          string
+	Owner       string
+	HostUUID    string
+	HostName    string
+	Recipient   string
+	Files       []*outgoingFile
+	State       string
+	Error       string
+	CreatedTime int64
+	UpdateTime  int64
+	baseURL     string
+	ticket      *OfferTicket
+	cancel      context.CancelFunc
+}
+
+func (t *outgoingTransfer) isFinished() bool {
+	return t.State != StatePreparing && t.State != StatePending && t.State != StateAccepted
+}
+
+//Nearby host that can receive files
+type NearbyHost struct {
+	UUID     string
+	HostName string
+	Address  string
+	Port     int
+}
+
+//List the hosts found by the neighbour discoverer that are in the LAN, excluding this host
+func (m *Manager) GetNearbyHosts() []*NearbyHost {
+	results := []*NearbyHost{}
+	if m.Options.Discoverer == nil {
+		return results
+	}
+	for _, host := range m.Options.Discoverer.GetNearbyHosts() {
+		if host.UUID == "" || host.UUID == m.Options.HostUUID {
+			continue
+		}
+		address := lanAddress(host)
+		if address == "" {
+			continue
+		}
+		results = append(results, &NearbyHost{
+			UUID:     host.UUID,
+			HostName: host.HostName,
+			Address:  address,
+			Port:     host.Port,
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].HostName < results[j].HostName
+	})
+	return results
+}
+
+func (m *Manager) getNearbyHost(hostUUID string) (*NearbyHost, error) {
+	for _, host := range m.GetNearbyHosts() {
+		if host.UUID == hostUUID {
+			return host, nil
+		}
+	}
+	return nil, errors.New("Host not found in the local network")
+}
+
+//Return the first private IPv4 address of the host
+func lanAddress(host *mdns.NetworkHost) string {
+	for _, ip := range host.IPv4 {
+		if prout.IsPrivateIP(ip) {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+type recipientList struct {
+	HostName   string
+	HostUUID   string
+	Recipients []string
+}
+
+//Find the base URL of the host and get the recipients on it. HTTP is tried before HTTPS
+func (m *Manager) getRecipients(ctx context.Context, host *NearbyHost) (string, *recipientList, error) {
+	address := net.JoinHostPort(host.Address, strconv.Itoa(host.Port))
+	var lastErr error
+	for _, scheme := range []string{"http", "https"} {
+		baseURL := scheme + "://" + address
+		result := recipientList{}
+		err := m.callRemote(ctx, http.MethodGet, baseURL+"/system/nearby/recipients", nil, &result)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if result.HostUUID != host.UUID {
+			lastErr = errors.New("Host identity mismatch")
+			continue
+		}
+		return baseURL, &result, nil
+	}
+	return "", nil, lastErr
+}
+
+//Send a JSON request to the receiving host and decode the JSON response into result
+func (m *Manager) callRemote(ctx context.Context, method string, url string, payload interface{}, result interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	var body io.Reader
+	if payload != nil {
+		js, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(js)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return readError(resp)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(result)
+}
+
+type remoteError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *remoteError) Error() string {
+	return e.Message
+}
+
+func readError(resp *http.Response) error {
+	result := struct {
+		Error string `json:"error"`
+	}{}
+	json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&result)
+	if result.Error == "" {
+		result.Error = "Host responded with status " + strconv.Itoa(resp.StatusCode)
+	}
+	return &remoteError{StatusCode: resp.StatusCode, Message: result.Error}
+}
+
+/*
+	Endpoints for the senders
+*/
+
+//List the nearby hosts
+func (m *Manager) HandleHosts(w http.ResponseWriter, r *http.Request) {
+	js, _ := json.Marshal(m.GetNearbyHosts())
+	sendJSONResponse(w, string(js))
+}
+
+//List the users that accept files on the nearby host. Require host (uuid)
+func (m *Manager) HandleHostRecipients(w http.ResponseWriter, r *http.Request) {
+	hostUUID, _ := mv(r, "host", false)
+	host, err := m.getNearbyHost(hostUUID)
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+	_, result, err := m.getRecipients(r.Context(), host)
+	if err != nil {
+		sendErrorResponse(w, "Unable to connect to "+host.HostName+": "+err.Error())
+		return
+	}
+	js, _ := json.Marshal(result.Recipients)
+	sendJSONResponse(w, string(js))
+}
+
+//Send files to a user on the nearby host. Require host (uuid), recipient and files (JSON array of vpaths)
+func (m *Manager) HandleSend(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := m.Options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	hostUUID, _ := mv(r, "host", true)
+	host, err := m.getNearbyHost(hostUUID)
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+	recipient, err := mv(r, "recipient", true)
+	if err != nil || strings.TrimSpace(recipient) == "" {
+		sendErrorResponse(w, "Invalid recipient given")
+		return
+	}
+	filelist, _ := mv(r, "files", true)
+	vpaths := []string{}
+	err = json.Unmarshal([]byte(filelist), &vpaths)
+	if err != nil || len(vpaths) == 0 {
+		sendErrorResponse(w, "Invalid files given")
+		return
+	}
+	if len(vpaths) > maxFilesPerOffer {
+		sendErrorResponse(w, "Too many files")
+		return
+	}
+
+	files := []*outgoingFile{}
+	names := []string{}
+	for _, vpath := range vpaths {
+		if !strings.Contains(vpath, ":/") || inArray(strings.Split(filepath.ToSlash(vpath), "/"), "..") {
+			sendErrorResponse(w, "Invalid path given")
+			return
+		}
+		if !userinfo.CanRead(vpath) {
+			sendErrorResponse(w, "Permission denied")
+			return
+		}
+		realpath, err := userinfo.VirtualPathToRealPath(vpath)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+		info, err := os.Stat(realpath)
+		if err != nil || info.IsDir() {
+			sendErrorResponse(w, "File not exists or is a folder: "+vpath)
+			return
+		}
+		if !validFilename(info.Name()) || inArray(names, info.Name()) {
+			sendErrorResponse(w, "Filename not allowed or duplicated: "+info.Name())
+			return
+		}
+		names = append(names, info.Name())
+		files = append(files, &outgoingFile{
+			Name:     info.Name(),
+			Vpath:    vpath,
+			Size:     info.Size(),
+			realpath: realpath,
+		})
+	}
+
+	id, err := newRandomID(8)
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	now := time.Now().Unix()
+	transfer := outgoingTransfer{
+		ID:          id,
+		Owner:       userinfo.Username,
+		HostUUID:    host.UUID,
+		HostName:    host.HostName,
+		Recipient:   recipient,
+		Files:       files,
+		State:       StatePreparing,
+		CreatedTime: now,
+		UpdateTime:  now,
+		cancel:      cancel,
+	}
+	m.mutex.Lock()
+	m.outgoing[id] = &transfer
+	m.mutex.Unlock()
+
+	go m.runTransfer(ctx, &transfer, host)
+
+	js, _ := json.Marshal(id)
+	sendJSONResponse(w, string(js))
+}
+
+//List the transfers sent by the current user
+func (m *Manager) HandleOutgoing(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := m.Options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	type fileProgress struct {
+		Name string
+		Size int64
+		Sent int64
+	}
+	type transferProgress struct {
+		ID          string
+		HostName    string
+		Recipient   string
+		Files       []fileProgress
+		State       string
+		Error       string
+		CreatedTime int64
+	}
+
+	m.mutex.Lock()
+	results := []transferProgress{}
+	for _, t := range m.outgoing {
+		if t.Owner != userinfo.Username {
+			continue
+		}
+		files := []fileProgress{}
+		for _, file := range t.Files {
+			files = append(files, fileProgress{file.Name, file.Size, file.Sent})
+		}
+		results = append(results, transferProgress{t.ID, t.HostName, t.Recipient, files, t.State, t.Error, t.CreatedTime})
+	}
+	m.mutex.Unlock()
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].CreatedTime > results[j].CreatedTime
+	})
+	js, _ := json.Marshal(results)
+	sendJSONResponse(w, string(js))
+}
+
+//Cancel a transfer sent by or to the current user. Require id
+func (m *Manager) HandleCancel(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := m.Options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+	id, _ := mv(r, "id", true)
+
+	m.mutex.Lock()
+	outgoing, isOutgoing := m.outgoing[id]
+	incoming, isIncoming := m.incoming[id]
+	m.mutex.Unlock()
+
+	if isOutgoing && outgoing.Owner == userinfo.Username {
+		//The worker notify the receiving host when it stops
+		outgoing.cancel()
+		sendOK(w)
+		return
+	}
+	if isIncoming && incoming.Recipient == userinfo.Username {
+		m.cancelIncoming(incoming)
+		sendOK(w)
+		return
+	}
+	sendErrorResponse(w, "Transfer not found")
+}
+
+/*
+	Transfer worker
+*/
+
+func (m *Manager) setOutgoingState(t *outgoingTransfer, state string, errMsg string) {
+	m.mutex.Lock()
+	t.State = state
+	t.Error = errMsg
+	t.UpdateTime = time.Now().Unix()
+	m.mutex.Unlock()
+}
+
+func (m *Manager) runTransfer(ctx context.Context, t *outgoingTransfer, host *NearbyHost) {
+	defer t.cancel()
+	err := m.transfer(ctx, t, host)
+	if ctx.Err() != nil {
+		//Cancelled by the sender. Let the receiving host remove the partial files
+		if t.ticket != nil {
+			m.remoteCancel(t)
+		}
+		m.setOutgoingState(t, StateCancelled, "")
+		return
+	}
+	if err != nil {
+		m.mutex.Lock()
+		finished := t.isFinished()
+		m.mutex.Unlock()
+		if !finished {
+			if t.ticket != nil {
+				m.remoteCancel(t)
+			}
+			m.setOutgoingState(t, StateFailed, err.Error())
+		}
+	}
+}
+
+func (m *Manager) transfer(ctx context.Context, t *outgoingTransfer, host *NearbyHost) error {
+	//Calculate the checksums for the integrity check on the receiving host
+	for _, file := range t.Files {
+		hash, err := fileHash(file.realpath)
+		if err != nil {
+			return errors.New("Unable to read " + file.Name)
+		}
+		file.Hash = hash
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+
+	baseURL, recipients, err := m.getRecipients(ctx, host)
+	if err != nil {
+		return errors.New("Unable to connect to " + host.HostName + ": " + err.Error())
+	}
+	if !inArray(recipients.Recipients, t.Recipient) {
+		return errors.New("Recipient not accepting files")
+	}
+
+	offer := Offer{
+		SenderHost: m.Options.HostName,
+		SenderUUID: m.Options.HostUUID,
+		SenderUser: t.Owner,
+		Recipient:  t.Recipient,
+	}
+	for _, file := range t.Files {
+		offer.Files = append(offer.Files, FileEntry{Name: file.Name, Size: file.Size, Hash: file.Hash})
+	}
+	ticket := OfferTicket{}
+	err = m.callRemote(ctx, http.MethodPost, baseURL+"/system/nearby/offer", offer, &ticket)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	t.baseURL = baseURL
+	t.ticket = &ticket
+	m.mutex.Unlock()
+	m.setOutgoingState(t, StatePending, "")
+
+	//Wait for the recipient to respond
+	status, err := m.waitForResponse(ctx, t, baseURL)
+	if err != nil {
+		return err
+	}
+	if status.State != StateAccepted {
+		m.setOutgoingState(t, status.State, status.Error)
+		return nil
+	}
+	m.setOutgoingState(t, StateAccepted, "")
+
+	for i := range t.Files {
+		err = m.uploadFile(ctx, t, baseURL, i)
+		if err != nil {
+			return err
+		}
+	}
+
+	status, err = m.getRemoteStatus(ctx, t, baseURL)
+	if err != nil {
+		return err
+	}
+	if status.State != StateCompleted {
+		m.setOutgoingState(t, status.State, status.Error)
+		return nil
+	}
+	m.setOutgoingState(t, StateCompleted, "")
+	return nil
+}
+
+func (m *Manager) getRemoteStatus(ctx context.Context, t *outgoingTransfer, baseURL string) (*TransferStatus, error) {
+	status := TransferStatus{}
+	err := m.callRemote(ctx, http.MethodGet, baseURL+"/system/nearby/transfer?"+ticketQuery(t.ticket).Encode(), nil, &status)
+	if err != nil {
+		return nil, err
+	}
+	if len(status.Received) != len(t.Files) {
+		return nil, errors.New("Invalid transfer status")
+	}
+	return &status, nil
+}
+
+func (m *Manager) waitForResponse(ctx context.Context, t *outgoingTransfer, baseURL string) (*TransferStatus, error) {
+	deadline := time.Now().Add(offerLifetime*time.Second + time.Minute)
+	failures := 0
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(pollInterval):
+		}
+
+		status, err := m.getRemoteStatus(ctx, t, baseURL)
+		if err != nil {
+			failures++
+			if failures > maxRetries {
+				return nil, err
+			}
+			continue
+		}
+		failures = 0
+		if status.State != StatePending {
+			return status, nil
+		}
+	}
+	return &TransferStatus{State: StateExpired}, nil
+}
+
+//Upload the file from the offset reported by the receiving host, retrying with backoff
+func (m *Manager) uploadFile(ctx context.Context, t *outgoingTransfer, baseURL string, index int) error {
+	file := t.Files[index]
+	var lastErr error
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(1<<uint(attempt-1)) * time.Second):
+			}
+		}
+
+		status, err := m.getRemoteStatus(ctx, t, baseURL)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if status.State != StateAccepted {
+			return errors.New("Transfer " + status.State + " by the receiving host")
+		}
+		offset := status.Received[index]
+		if offset >= file.Size && file.Size > 0 {
+			//Already received and verified
+			m.mutex.Lock()
+			file.Sent = file.Size
+			m.mutex.Unlock()
+			return nil
+		}
+
+		err = m.uploadFrom(ctx, t, baseURL, index, offset)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		lastErr = err
+		if rerr, ok := err.(*remoteError); ok && rerr.StatusCode == http.StatusNotFound {
+			return err
+		}
+	}
+	return errors.New("Unable to send " + file.Name + ": " + lastErr.Error())
+}
+
+func (m *Manager) uploadFrom(ctx context.Context, t *outgoingTransfer, baseURL string, index int, offset int64) error {
+	file := t.Files[index]
+	f, err := os.Open(file.realpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	file.Sent = offset
+	m.mutex.Unlock()
+
+	query := ticketQuery(t.ticket)
+	query.Set("index", strconv.Itoa(index))
+	query.Set("offset", strconv.FormatInt(offset, 10))
+	body := &progressReader{r: io.LimitReader(f, file.Size-offset), m: m, file: file}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL+"/system/nearby/upload?"+query.Encode(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = file.Size - offset
+	if req.ContentLength == 0 {
+		req.Body = http.NoBody
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return readError(resp)
+	}
+	return nil
+}
+
+func (m *Manager) remoteCancel(t *outgoingTransfer) {
+	m.callRemote(context.Background(), http.MethodPost, t.baseURL+"/system/nearby/cancel?"+ticketQuery(t.ticket).Encode(), nil, nil)
+}
+
+func ticketQuery(ticket *OfferTicket) url.Values {
+	query := url.Values{}
+	query.Set("id", ticket.ID)
+	query.Set("token", ticket.Token)
+	return query
+}
+
+//Record the number of bytes sent for the progress view
+type progressReader struct {
+	r    io.Reader
+	m    *Manager
+	file *outgoingFile
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.m.mutex.Lock()
+	p.file.Sent += int64(n)
+	p.m.mutex.Unlock()
+	return n, err
+}
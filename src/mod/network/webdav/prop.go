@@ -236,6 +236,10 @@ func propnames(ctx context.Context, fs FileSystem, ls LockSystem, name string) (
 
 	pnames := make([]xml.Name, 0, len(liveProps)+len(deadProps))
 	for pn, prop := range liveProps {
+		if _, ok := deadProps[pn]; ok {
+			// Overridden by the dead property of the same name.
+			continue
+		}
 		if prop.findFn != nil && (prop.dir || !isDir) {
 			pnames = append(pnames, pn)
 		}
@@ -0,0 +1,115 @@
+package photo
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+/*
+	Photo Albums
+
+	User created albums are stored in the system database with key
+	{username}/{albumUUID}. Photos are referenced by their virtual path
+*/
+
+type Album struct {
+	UUID       string
+	Name       string
+	Owner      string
+	Photos     []string //Virtual paths of the photos in this album
+	CreateTime int64
+}
+
+//List all the albums of the given user
+func (m *Manager) ListAlbums(username string) []*Album {
+	results := []*Album{}
+	entries, err := m.options.Database.ListTable("photo-albums")
+	if err != nil {
+		return results
+	}
+
+	for _, keypairs := range entries {
+		if !strings.HasPrefix(string(keypairs[0]), username+"/") {
+			continue
+		}
+
+		thisAlbum := new(Album)
+		if err := json.Unmarshal(keypairs[1], &thisAlbum); err != nil {
+			continue
+		}
+		results = append(results, thisAlbum)
+	}
+
+	return results
+}
+
+//Get an album of the given user by its UUID
+func (m *Manager) GetAlbum(username string, albumID string) (*Album, error) {
+	if !m.options.Database.KeyExists("photo-albums", username+"/"+albumID) {
+		return nil, errors.New("Album not exists")
+	}
+
+	thisAlbum := new(Album)
+	err := m.options.Database.Read("photo-albums", username+"/"+albumID, &thisAlbum)
+	if err != nil {
+		return nil, err
+	}
+	return thisAlbum, nil
+}
+
+//Create a new empty album for the given user
+func (m *Manager) CreateAlbum(username string, name string) (*Album, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, errors.New("Album name cannot be empty")
+	}
+
+	newAlbum := Album{
+		UUID:       uuid.NewV4().String(),
+		Name:       name,
+		Owner:      username,
+		Photos:     []string{},
+		CreateTime: time.Now().Unix(),
+	}
+
+	err := m.options.Database.Write("photo-albums", username+"/"+newAlbum.UUID, newAlbum)
+	if err != nil {
+		return nil, err
+	}
+	return &newAlbum, nil
+}
+
+//Save the modified album
+func (m *Manager) SaveAlbum(album *Album) error {
+	return m.options.Database.Write("photo-albums", album.Owner+"/"+album.UUID, album)
+}
+
+//Remove an album. The photos inside the album will not be removed
+func (m *Manager) DeleteAlbum(username string, albumID string) error {
+	if !m.options.Database.KeyExists("photo-albums", username+"/"+albumID) {
+		return errors.New("Album not exists")
+	}
+	return m.options.Database.Delete("photo-albums", username+"/"+albumID)
+}
+
+//Add a photo to the album if it is not already inside
+func (a *Album) AddPhoto(vpath string) {
+	if !inArray(a.Photos, vpath) {
+		a.Photos = append(a.Photos, vpath)
+	}
+}
+
+//Remove a photo from the album
+func (a *Album) RemovePhoto(vpath string) {
+	newPhotoList := []string{}
+	for _, thisPhoto := range a.Photos {
+		if thisPhoto != vpath {
+			newPhotoList = append(newPhotoList, thisPhoto)
+		}
+	}
+	a.Photos = newPhotoList
+}
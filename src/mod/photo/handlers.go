@@ -0,0 +1,280 @@
+package photo
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strconv"
+
+	fs "imuslab.com/arozos/mod/filesystem"
+	"imuslab.com/arozos/mod/filesystem/metadata"
+)
+
+/*
+	Photo Library HTTP Handlers
+
+	All handlers only return the photos that is accessible by the current user
+*/
+
+//Start indexing the user accessible storages in the background
+func (m *Manager) HandleIndex(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := m.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	m.IndexInBackground(userinfo.GetAllAccessibleFileSystemHandler())
+	sendOK(w)
+}
+
+//List the photos in timeline, group by day, month or year
+func (m *Manager) HandleTimeline(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := m.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	groupBy, _ := mv(r, "group", false)
+	if groupBy != "" && groupBy != "day" && groupBy != "month" && groupBy != "year" {
+		sendErrorResponse(w, "Invalid group mode given")
+		return
+	}
+
+	timeline := BuildTimeline(m.ListUserPhotos(userinfo), groupBy)
+	js, _ := json.Marshal(timeline)
+	sendJSONResponse(w, string(js))
+}
+
+//List the photos with GPS location for the map view. Accept optional bounding box
+func (m *Manager) HandleMap(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := m.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	var bbox *BoundingBox
+	minlat, err := mv(r, "minlat", false)
+	if err == nil {
+		maxlat, _ := mv(r, "maxlat", false)
+		minlng, _ := mv(r, "minlng", false)
+		maxlng, _ := mv(r, "maxlng", false)
+		bbox = &BoundingBox{}
+		bbox.MinLatitude, err = strconv.ParseFloat(minlat, 64)
+		if err == nil {
+			bbox.MaxLatitude, err = strconv.ParseFloat(maxlat, 64)
+		}
+		if err == nil {
+			bbox.MinLongitude, err = strconv.ParseFloat(minlng, 64)
+		}
+		if err == nil {
+			bbox.MaxLongitude, err = strconv.ParseFloat(maxlng, 64)
+		}
+		if err != nil {
+			sendErrorResponse(w, "Invalid bounding box given")
+			return
+		}
+	}
+
+	photos := FilterGeotagged(m.ListUserPhotos(userinfo), bbox)
+	SortByCaptureTime(photos)
+	js, _ := json.Marshal(photos)
+	sendJSONResponse(w, string(js))
+}
+
+//List the groups of photos that have identical content
+func (m *Manager) HandleDuplicates(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := m.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	js, _ := json.Marshal(FindDuplicates(m.ListUserPhotos(userinfo)))
+	sendJSONResponse(w, string(js))
+}
+
+//List the burst shot groups
+func (m *Manager) HandleBursts(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := m.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	js, _ := json.Marshal(FindBursts(m.ListUserPhotos(userinfo)))
+	sendJSONResponse(w, string(js))
+}
+
+//Get the EXIF information of a single photo
+func (m *Manager) HandleInfo(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := m.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	vpath, err := mv(r, "file", false)
+	if err != nil {
+		sendErrorResponse(w, "Invalid file given")
+		return
+	}
+
+	if !userinfo.CanRead(vpath) {
+		sendErrorResponse(w, "Permission Denied")
+		return
+	}
+
+	rpath, err := userinfo.VirtualPathToRealPath(vpath)
+	if err != nil || !fs.FileExists(rpath) {
+		sendErrorResponse(w, "File not exists")
+		return
+	}
+
+	exifInfo, err := metadata.ReadImageExif(rpath)
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+
+	js, _ := json.Marshal(Photo{
+		Filepath:  vpath,
+		Filename:  filepath.Base(rpath),
+		ImageExif: *exifInfo,
+	})
+	sendJSONResponse(w, string(js))
+}
+
+//Get the orientation corrected thumbnail of a photo
+func (m *Manager) HandleThumbnail(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := m.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		http.Error(w, "401 - Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vpath, err := mv(r, "file", false)
+	if err != nil {
+		http.Error(w, "400 - Invalid file given", http.StatusBadRequest)
+		return
+	}
+
+	if !userinfo.CanRead(vpath) {
+		http.Error(w, "403 - Permission Denied", http.StatusForbidden)
+		return
+	}
+
+	rpath, err := userinfo.VirtualPathToRealPath(vpath)
+	if err != nil || !fs.FileExists(rpath) {
+		http.Error(w, "404 - File not exists", http.StatusNotFound)
+		return
+	}
+
+	thumbnail, err := m.options.RenderHandler.LoadCacheAsBytes(rpath, false)
+	if err != nil {
+		http.Error(w, "500 - "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Write(thumbnail)
+}
+
+/*
+	Handle album operations
+
+	opr=list / create (name) / delete (album) / get (album) / add (album, file) / remove (album, file)
+*/
+func (m *Manager) HandleAlbums(w http.ResponseWriter, r *http.Request) {
+	userinfo, err := m.options.UserHandler.GetUserInfoFromRequest(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	opr, _ := mv(r, "opr", true)
+	if opr == "" || opr == "list" {
+		js, _ := json.Marshal(m.ListAlbums(userinfo.Username))
+		sendJSONResponse(w, string(js))
+		return
+	}
+
+	if opr == "create" {
+		name, _ := mv(r, "name", true)
+		newAlbum, err := m.CreateAlbum(userinfo.Username, name)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+		js, _ := json.Marshal(newAlbum)
+		sendJSONResponse(w, string(js))
+		return
+	}
+
+	albumID, err := mv(r, "album", true)
+	if err != nil {
+		sendErrorResponse(w, "Invalid album given")
+		return
+	}
+
+	if opr == "delete" {
+		err = m.DeleteAlbum(userinfo.Username, albumID)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+		sendOK(w)
+		return
+	}
+
+	album, err := m.GetAlbum(userinfo.Username, albumID)
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+
+	switch opr {
+	case "get":
+		//Resolve the photos in the album, skipping those that no longer accessible
+		photos := []*Photo{}
+		for _, vpath := range album.Photos {
+			rpath, err := userinfo.VirtualPathToRealPath(vpath)
+			if err != nil || !userinfo.CanRead(vpath) || !fs.FileExists(rpath) {
+				continue
+			}
+			thisPhoto := Photo{
+				Filepath: vpath,
+				Filename: filepath.Base(rpath),
+			}
+			exifInfo, err := metadata.ReadImageExif(rpath)
+			if err == nil {
+				thisPhoto.ImageExif = *exifInfo
+			}
+			photos = append(photos, &thisPhoto)
+		}
+
+		js, _ := json.Marshal(struct {
+			*Album
+			Photos []*Photo
+		}{album, photos})
+		sendJSONResponse(w, string(js))
+	case "add":
+		vpath, err := mv(r, "file", true)
+		if err != nil || !userinfo.CanRead(vpath) {
+			sendErrorResponse(w, "Invalid file given")
+			return
+		}
+		album.AddPhoto(vpath)
+		m.SaveAlbum(album)
+		sendOK(w)
+	case "remove":
+		vpath, _ := mv(r, "file", true)
+		album.RemovePhoto(vpath)
+		m.SaveAlbum(album)
+		sendOK(w)
+	default:
+		sendErrorResponse(w, "Unknown operation")
+	}
+}
@@ -0,0 +1,279 @@
+package photo
+
+/*
+	ArozOS Photo Library Indexer
+	author: tobychui
+
+	This module index the EXIF information of the images stored in each
+	file system handler. The index live inside the fsdb (aofs.db) of the handler
+	so it moves together with the storage device.
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"imuslab.com/arozos/mod/database"
+	fs "imuslab.com/arozos/mod/filesystem"
+	"imuslab.com/arozos/mod/filesystem/metadata"
+	user "imuslab.com/arozos/mod/user"
+)
+
+type Options struct {
+	UserHandler   *user.UserHandler
+	Database      *database.Database      //System database, for storing user albums
+	RenderHandler *metadata.RenderHandler //Thumbnail renderer
+}
+
+//Index record of an image, stored in the fsdb of the file system handler
+type PhotoRecord struct {
+	Relpath   string
+	Filesize  int64
+	ModTime   int64
+	Hash      string
+	IndexTime int64
+	metadata.ImageExif
+}
+
+//Photo information returned to the user
+type Photo struct {
+	Filepath string
+	Filename string
+	Filesize int64
+	ModTime  int64
+	Hash     string
+	metadata.ImageExif
+}
+
+type Manager struct {
+	options  Options
+	indexing sync.Map //Map of fsh UUIDs that is being indexed
+}
+
+//Image extensions that will be included in the photo library
+var photoFormats = append([]string{".png", ".gif", ".webp", ".bmp"}, metadata.ExifSupportedFormats...)
+
+//Create a new photo library manager
+func NewPhotoManager(options Options) *Manager {
+	options.Database.NewTable("photo-albums")
+	return &Manager{
+		options:  options,
+		indexing: sync.Map{},
+	}
+}
+
+//Check if the given file is a supported photo
+func IsPhoto(filename string) bool {
+	return inArray(photoFormats, strings.ToLower(filepath.Ext(filename)))
+}
+
+//Check if the given file system handler is being indexed
+func (m *Manager) IsIndexing(fsh *fs.FileSystemHandler) bool {
+	_, ok := m.indexing.Load(fsh.UUID)
+	return ok
+}
+
+//Index all the photos inside the given file system handler. Unchanged files will be skipped
+func (m *Manager) IndexFileSystemHandler(fsh *fs.FileSystemHandler) error {
+	if fsh.Hierarchy == "backup" || fsh.Closed {
+		return errors.New("File system handler not indexable")
+	}
+
+	if _, loaded := m.indexing.LoadOrStore(fsh.UUID, true); loaded {
+		return errors.New("File system handler is already being indexed")
+	}
+	defer m.indexing.Delete(fsh.UUID)
+
+	fsdb := fsh.FilesystemDatabase
+	err := fsdb.NewTable("photo")
+	if err != nil {
+		return err
+	}
+
+	//Load the existing index
+	existingRecords := map[string]*PhotoRecord{}
+	entries, _ := fsdb.ListTable("photo")
+	for _, keypairs := range entries {
+		thisRecord := new(PhotoRecord)
+		if err := json.Unmarshal(keypairs[1], &thisRecord); err == nil {
+			existingRecords[string(keypairs[0])] = thisRecord
+		}
+	}
+
+	rootAbs, _ := filepath.Abs(fsh.Path)
+	seenFiles := map[string]bool{}
+	indexedCounter := 0
+	filepath.Walk(rootAbs, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		//Skip hidden folders like .cache and .trash
+		if info.IsDir() {
+			if path != rootAbs && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !IsPhoto(path) {
+			return nil
+		}
+
+		relpath, err := filepath.Rel(rootAbs, path)
+		if err != nil {
+			return nil
+		}
+		relpath = filepath.ToSlash(relpath)
+		seenFiles[relpath] = true
+
+		//Skip the files that didn't change since the last index
+		if oldRecord, ok := existingRecords[relpath]; ok {
+			if oldRecord.ModTime == info.ModTime().Unix() && oldRecord.Filesize == info.Size() {
+				return nil
+			}
+		}
+
+		thisRecord, err := buildPhotoRecord(path, relpath, info)
+		if err != nil {
+			return nil
+		}
+
+		fsdb.Write("photo", relpath, thisRecord)
+		indexedCounter++
+		return nil
+	})
+
+	//Remove the records of files that no longer exists
+	for relpath := range existingRecords {
+		if !seenFiles[relpath] {
+			fsdb.Delete("photo", relpath)
+		}
+	}
+
+	if indexedCounter > 0 {
+		log.Println("[Photo] Indexed " + IntToString(indexedCounter) + " photos in " + fsh.UUID + ":/")
+	}
+	return nil
+}
+
+//Index all the given file system handlers in the background
+func (m *Manager) IndexInBackground(fshs []*fs.FileSystemHandler) {
+	go func() {
+		for _, fsh := range fshs {
+			if fsh.Hierarchy == "backup" || fsh.Closed || m.IsIndexing(fsh) {
+				continue
+			}
+			err := m.IndexFileSystemHandler(fsh)
+			if err != nil {
+				log.Println("[Photo] Unable to index "+fsh.UUID+":/ ", err.Error())
+			}
+		}
+	}()
+}
+
+//Build the index record for the given image
+func buildPhotoRecord(path string, relpath string, info os.FileInfo) (*PhotoRecord, error) {
+	hash, err := getFileHash(path)
+	if err != nil {
+		return nil, err
+	}
+
+	exifInfo, err := metadata.ReadImageExif(path)
+	if err != nil {
+		//No EXIF. Use the modification time as capture time
+		exifInfo.CaptureTime = info.ModTime().Unix()
+	} else if exifInfo.CaptureTime == 0 {
+		exifInfo.CaptureTime = info.ModTime().Unix()
+	}
+
+	return &PhotoRecord{
+		Relpath:   relpath,
+		Filesize:  info.Size(),
+		ModTime:   info.ModTime().Unix(),
+		Hash:      hash,
+		IndexTime: time.Now().Unix(),
+		ImageExif: *exifInfo,
+	}, nil
+}
+
+//Get the sha256 hash of the file content for duplicate detection
+func getFileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+/*
+	List all indexed photos that the user can access
+
+	Only the file system handlers that is accessible by the user will be scanned
+	and files under other user's home directory are excluded
+*/
+func (m *Manager) ListUserPhotos(u *user.User) []*Photo {
+	results := []*Photo{}
+	for _, fsh := range u.GetAllAccessibleFileSystemHandler() {
+		if !fsh.FilesystemDatabase.TableExists("photo") {
+			//Not indexed yet. Start indexing it in the background
+			m.IndexInBackground([]*fs.FileSystemHandler{fsh})
+			continue
+		}
+
+		userPrefix := ""
+		if fsh.Hierarchy == "user" {
+			userPrefix = "users/" + u.Username + "/"
+		}
+
+		entries, err := fsh.FilesystemDatabase.ListTable("photo")
+		if err != nil {
+			continue
+		}
+
+		for _, keypairs := range entries {
+			relpath := string(keypairs[0])
+			if userPrefix != "" && !strings.HasPrefix(relpath, userPrefix) {
+				continue
+			}
+
+			thisRecord := new(PhotoRecord)
+			if err := json.Unmarshal(keypairs[1], &thisRecord); err != nil {
+				continue
+			}
+
+			realpath := filepath.ToSlash(filepath.Join(fsh.Path, relpath))
+			vpath, err := u.RealPathToVirtualPath(realpath)
+			if err != nil || !u.CanRead(vpath) {
+				continue
+			}
+
+			results = append(results, &Photo{
+				Filepath:  vpath,
+				Filename:  filepath.Base(relpath),
+				Filesize:  thisRecord.Filesize,
+				ModTime:   thisRecord.ModTime,
+				Hash:      thisRecord.Hash,
+				ImageExif: thisRecord.ImageExif,
+			})
+		}
+	}
+
+	return results
+}
@@ -0,0 +1,150 @@
+package photo
+
+import (
+	"sort"
+	"time"
+)
+
+/*
+	Photo Library Queries
+
+	This script group the indexed photos into timeline, map markers,
+	duplicate sets and burst shots
+*/
+
+//Photos taken within this amount of seconds with the same camera are considered as a burst
+const burstMaxInterval = 2
+
+//A group of photos in the timeline
+type TimelineGroup struct {
+	Label  string //e.g. 2021-06-01, 2021-06 or 2021
+	Photos []*Photo
+}
+
+//Bounding box for filtering photos on the map view
+type BoundingBox struct {
+	MinLatitude  float64
+	MaxLatitude  float64
+	MinLongitude float64
+	MaxLongitude float64
+}
+
+//Sort the photos by capture time, latest first
+func SortByCaptureTime(photos []*Photo) {
+	sort.SliceStable(photos, func(i, j int) bool {
+		return photos[i].CaptureTime > photos[j].CaptureTime
+	})
+}
+
+//Group the photos into timeline by day, month or year
+func BuildTimeline(photos []*Photo, groupBy string) []*TimelineGroup {
+	dateFormat := "2006-01-02"
+	if groupBy == "month" {
+		dateFormat = "2006-01"
+	} else if groupBy == "year" {
+		dateFormat = "2006"
+	}
+
+	SortByCaptureTime(photos)
+	results := []*TimelineGroup{}
+	var currentGroup *TimelineGroup
+	for _, thisPhoto := range photos {
+		label := time.Unix(thisPhoto.CaptureTime, 0).Format(dateFormat)
+		if currentGroup == nil || currentGroup.Label != label {
+			currentGroup = &TimelineGroup{
+				Label:  label,
+				Photos: []*Photo{},
+			}
+			results = append(results, currentGroup)
+		}
+		currentGroup.Photos = append(currentGroup.Photos, thisPhoto)
+	}
+
+	return results
+}
+
+//Get the photos with GPS location, optionally inside the given bounding box
+func FilterGeotagged(photos []*Photo, bbox *BoundingBox) []*Photo {
+	results := []*Photo{}
+	for _, thisPhoto := range photos {
+		if !thisPhoto.HasGPS {
+			continue
+		}
+
+		if bbox != nil {
+			if thisPhoto.Latitude < bbox.MinLatitude || thisPhoto.Latitude > bbox.MaxLatitude {
+				continue
+			}
+			if thisPhoto.Longitude < bbox.MinLongitude || thisPhoto.Longitude > bbox.MaxLongitude {
+				continue
+			}
+		}
+
+		results = append(results, thisPhoto)
+	}
+
+	return results
+}
+
+//Find photos with identical content. Each returned group contains at least 2 photos
+func FindDuplicates(photos []*Photo) [][]*Photo {
+	hashGroups := map[string][]*Photo{}
+	hashOrder := []string{}
+	for _, thisPhoto := range photos {
+		if thisPhoto.Hash == "" {
+			continue
+		}
+		if _, ok := hashGroups[thisPhoto.Hash]; !ok {
+			hashOrder = append(hashOrder, thisPhoto.Hash)
+		}
+		hashGroups[thisPhoto.Hash] = append(hashGroups[thisPhoto.Hash], thisPhoto)
+	}
+
+	results := [][]*Photo{}
+	for _, hash := range hashOrder {
+		if len(hashGroups[hash]) > 1 {
+			results = append(results, hashGroups[hash])
+		}
+	}
+
+	return results
+}
+
+//Find burst shots, aka photos taken continuously by the same camera. Each returned group contains at least 2 photos
+func FindBursts(photos []*Photo) [][]*Photo {
+	//Sort the photos by capture time, oldest first
+	sortedPhotos := make([]*Photo, len(photos))
+	copy(sortedPhotos, photos)
+	sort.SliceStable(sortedPhotos, func(i, j int) bool {
+		return sortedPhotos[i].CaptureTime < sortedPhotos[j].CaptureTime
+	})
+
+	results := [][]*Photo{}
+	currentBurst := []*Photo{}
+	for _, thisPhoto := range sortedPhotos {
+		if thisPhoto.CameraModel == "" {
+			//Photos without camera information are not taken by a camera
+			continue
+		}
+
+		if len(currentBurst) > 0 {
+			lastPhoto := currentBurst[len(currentBurst)-1]
+			if lastPhoto.CameraModel == thisPhoto.CameraModel && thisPhoto.CaptureTime-lastPhoto.CaptureTime <= burstMaxInterval {
+				currentBurst = append(currentBurst, thisPhoto)
+				continue
+			}
+
+			if len(currentBurst) > 1 {
+				results = append(results, currentBurst)
+			}
+		}
+
+		currentBurst = []*Photo{thisPhoto}
+	}
+
+	if len(currentBurst) > 1 {
+		results = append(results, currentBurst)
+	}
+
+	return results
+}
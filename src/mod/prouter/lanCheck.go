@@ -108,3 +108,16 @@ func inRange(r ipRange, ipAddress net.IP) bool {
 	}
 	return false
 }
+
+//Check if the request is coming from the local area network. Used by handlers that are not wrapped by the router
+func CheckIfLAN(r *http.Request) bool {
+	return checkIfLAN(r)
+}
+
+//Check if the IP address is a loopback or private network address
+func IsPrivateIP(ipAddress net.IP) bool {
+	if ipAddress == nil {
+		return false
+	}
+	return ipAddress.IsLoopback() || isPrivateSubnet(ipAddress)
+}
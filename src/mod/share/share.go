@@ -27,6 +27,7 @@ import (
 	"imuslab.com/arozos/mod/auth"
 	"imuslab.com/arozos/mod/common"
 	"imuslab.com/arozos/mod/database"
+	"imuslab.com/arozos/mod/event"
 	filesystem "imuslab.com/arozos/mod/filesystem"
 	"imuslab.com/arozos/mod/user"
 )
@@ -37,6 +38,7 @@ type Options struct {
 	UserHandler *user.UserHandler
 	HostName    string
 	TmpFolder   string
+	EventBus    *event.EventBus
 }
 
 type ShareOption struct {
@@ -236,6 +238,17 @@ func (s *Manager) HandleShareAccess(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		//Notify the share owner
+		accessor, _ := s.options.AuthAgent.GetUserName(w, r)
+		s.options.EventBus.Publish(event.ShareAccessed, shareOption.Owner, map[string]interface{}{
+			"uuid":     shareOption.UUID,
+			"path":     s.getOwnerVirtualPath(shareOption),
+			"rel":      relpath,
+			"download": directDownload,
+			"accessor": accessor,
+			"ip":       r.RemoteAddr,
+		})
+
 		//Serve the download page
 		if isDir(shareOption.FileRealPath) {
 			type File struct {
@@ -707,10 +720,29 @@ func (s *Manager) CreateNewShare(userinfo *user.User, vpath string) (*ShareOptio
 		//Write object to database
 		s.options.Database.Write("share", shareUUID, shareOption)
 
+		s.options.EventBus.Publish(event.ShareCreated, userinfo.Username, map[string]interface{}{
+			"uuid":       shareUUID,
+			"path":       vpath,
+			"permission": shareOption.Permission,
+		})
+
 		return &shareOption, nil
 	}
 }
 
+//Get the virtual path of the shared file from the view of the share owner
+func (s *Manager) getOwnerVirtualPath(shareOption *ShareOption) string {
+	owner, err := s.options.UserHandler.GetUserInfoFromUsername(shareOption.Owner)
+	if err != nil {
+		return ""
+	}
+	vpath, err := owner.RealPathToVirtualPath(shareOption.FileRealPath)
+	if err != nil {
+		return ""
+	}
+	return vpath
+}
+
 //Delete the share on this vpath
 func (s *Manager) DeleteShare(userinfo *user.User, vpath string) error {
 	//Translate the vpath to realpath
@@ -0,0 +1,274 @@
+package dav
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+	Collections
+
+	Each calendar or address book is a folder inside the user's storage.
+	The collection properties and the change log used for sync-collection
+	are stored in a hidden metadata file inside the folder. Changes are
+	detected by comparing the ETag of every resource, so files modified
+	through other file services are also picked up by the sync clients.
+*/
+
+const (
+	collectionCalendar    = "calendar"
+	collectionAddressBook = "addressbook"
+
+	metaFilename    = ".collection.json"
+	syncTokenPrefix = "http://arozos.com/ns/sync/"
+)
+
+type resourceState struct {
+	ETag  string //ETag of the resource when last scanned
+	UID   string //UID of the calendar object or vCard
+	Token int64  //Sync token when this resource last changed
+}
+
+type collectionMeta struct {
+	Type        string            //Type of collection, {calendar, addressbook}
+	DisplayName string            //Display name of the collection
+	Description string            //Calendar or address book description
+	Color       string            //Calendar color, e.g. #FF0000FF
+	Components  []string          //Supported calendar components, calendar only
+	Props       map[string]string //Other dead properties set by clients, keyed by {namespace}name
+
+	SyncToken int64                     //Current sync token of the collection
+	Resources map[string]*resourceState //Resources in this collection
+	Removed   map[string]int64          //Removed resources and the sync token of removal
+}
+
+func newCollectionMeta(collectionType string) *collectionMeta {
+	meta := collectionMeta{
+		Type:       collectionType,
+		Components: []string{},
+		Props:      map[string]string{},
+		SyncToken:  1,
+		Resources:  map[string]*resourceState{},
+		Removed:    map[string]int64{},
+	}
+	if collectionType == collectionCalendar {
+		meta.Components = []string{"VEVENT", "VTODO"}
+	}
+	return &meta
+}
+
+//Load the collection metadata from the collection folder
+func loadCollection(dir string) (*collectionMeta, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, metaFilename))
+	if err != nil {
+		return nil, errors.New("Not a collection")
+	}
+	meta := collectionMeta{}
+	err = json.Unmarshal(content, &meta)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Props == nil {
+		meta.Props = map[string]string{}
+	}
+	if meta.Resources == nil {
+		meta.Resources = map[string]*resourceState{}
+	}
+	if meta.Removed == nil {
+		meta.Removed = map[string]int64{}
+	}
+	return &meta, nil
+}
+
+func (m *collectionMeta) save(dir string) error {
+	js, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, metaFilename), js, 0644)
+}
+
+//Create a new collection folder with the given metadata
+func createCollection(dir string, meta *collectionMeta) error {
+	if fileExists(dir) {
+		return errors.New("Collection already exists")
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	return meta.save(dir)
+}
+
+//Get the ETag of a resource, which is the same as the one generated by the WebDAV handler
+func fileETag(fi os.FileInfo) string {
+	return fmt.Sprintf(`"%x%x"`, fi.ModTime().UnixNano(), fi.Size())
+}
+
+//Read the UID of a resource
+func resourceUID(collectionType string, filename string) string {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return ""
+	}
+	root, err := parseComponent(content)
+	if err != nil {
+		return ""
+	}
+	if collectionType == collectionAddressBook {
+		if uid := root.prop("UID"); uid != nil {
+			return uid.Value
+		}
+		return ""
+	}
+	for _, child := range root.Children {
+		if child.Name == "VTIMEZONE" {
+			continue
+		}
+		if uid := child.prop("UID"); uid != nil {
+			return uid.Value
+		}
+	}
+	return ""
+}
+
+//List the resource files inside a collection folder
+func listResources(dir string) (map[string]os.FileInfo, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	results := map[string]os.FileInfo{}
+	for _, fi := range files {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		results[fi.Name()] = fi
+	}
+	return results, nil
+}
+
+//Load the collection and update its change log with the current content of the folder
+func refreshCollection(dir string) (*collectionMeta, error) {
+	meta, err := loadCollection(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := listResources(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	newToken := meta.SyncToken + 1
+	changed := false
+	for name, fi := range files {
+		etag := fileETag(fi)
+		state, ok := meta.Resources[name]
+		if ok && state.ETag == etag {
+			continue
+		}
+
+		meta.Resources[name] = &resourceState{
+			ETag:  etag,
+			UID:   resourceUID(meta.Type, filepath.Join(dir, name)),
+			Token: newToken,
+		}
+		delete(meta.Removed, name)
+		changed = true
+	}
+
+	for name := range meta.Resources {
+		if _, ok := files[name]; !ok {
+			delete(meta.Resources, name)
+			meta.Removed[name] = newToken
+			changed = true
+		}
+	}
+
+	if changed {
+		meta.SyncToken = newToken
+		err = meta.save(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return meta, nil
+}
+
+//Find the resource using the given UID. Return empty string if not found
+func (m *collectionMeta) resourceWithUID(uid string) string {
+	for name, state := range m.Resources {
+		if state.UID == uid {
+			return name
+		}
+	}
+	return ""
+}
+
+//Get the sync token in URI form
+func (m *collectionMeta) syncTokenURI() string {
+	return syncTokenPrefix + strconv.FormatInt(m.SyncToken, 10)
+}
+
+//Parse the sync token sent by client. Empty token means initial sync
+func (m *collectionMeta) parseSyncToken(token string) (int64, error) {
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return 0, nil
+	}
+	if !strings.HasPrefix(token, syncTokenPrefix) {
+		return 0, errors.New("Invalid sync token")
+	}
+	value, err := strconv.ParseInt(strings.TrimPrefix(token, syncTokenPrefix), 10, 64)
+	if err != nil || value < 0 || value > m.SyncToken {
+		return 0, errors.New("Invalid sync token")
+	}
+	return value, nil
+}
+
+//Get the resources changed and removed after the given sync token
+func (m *collectionMeta) changesSince(token int64) ([]string, []string) {
+	changed := []string{}
+	removed := []string{}
+	for name, state := range m.Resources {
+		if state.Token > token {
+			changed = append(changed, name)
+		}
+	}
+	if token > 0 {
+		for name, removedToken := range m.Removed {
+			if removedToken > token {
+				removed = append(removed, name)
+			}
+		}
+	}
+	return changed, removed
+}
+
+//Create the home folder with a default collection if it does not exists
+func ensureHome(homeDir string, collectionType string) error {
+	if fileExists(homeDir) {
+		return nil
+	}
+
+	err := os.MkdirAll(homeDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	meta := newCollectionMeta(collectionType)
+	if collectionType == collectionCalendar {
+		meta.DisplayName = "Personal"
+	} else {
+		meta.DisplayName = "Contacts"
+	}
+	return createCollection(filepath.Join(homeDir, "default"), meta)
+}
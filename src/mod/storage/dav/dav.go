@@ -0,0 +1,408 @@
+package dav
+
+/*
+	CalDAV and CardDAV Server
+
+	This module serves calendars (RFC 4791) and address books (RFC 6352)
+	on top of the internal WebDAV handler. Collections are stored under the
+	hidden .dav folder of the user's storage, i.e.
+
+	user:/.dav/calendars/{collection}/{event}.ics
+	user:/.dav/contacts/{collection}/{contact}.vcf
+
+	Endpoints
+	/caldav/{username}/		Calendar home and principal of the user
+	/carddav/{username}/	Address book home and principal of the user
+	/.well-known/caldav		Service discovery, see RFC 6764
+	/.well-known/carddav
+*/
+
+import (
+	"encoding/xml"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"imuslab.com/arozos/mod/network/webdav"
+	"imuslab.com/arozos/mod/user"
+)
+
+const (
+	serviceCalDAV  = "caldav"
+	serviceCardDAV = "carddav"
+)
+
+type Server struct {
+	hostname       string            //The hostname of this devices
+	userHandler    *user.UserHandler //The central userHandler
+	lockSystems    sync.Map          //The lock system of each user
+	collectionLock sync.Mutex        //Lock for updating collection metadata
+	Enabled        bool              //If the server is enabled. Set this to false for disable this service
+}
+
+//requestContext contains the user and service information of the current request
+type requestContext struct {
+	server         *Server
+	service        string     //Service of this request, {caldav, carddav}
+	collectionType string     //Type of collections under this service
+	userinfo       *user.User //The authenticated user
+	homeDir        string     //Real path of the home folder of this service
+	prefix         string     //URL prefix of the home folder, e.g. /caldav/alice
+}
+
+//NewServer create a new CalDAV and CardDAV server
+func NewServer(hostname string, userHandler *user.UserHandler) *Server {
+	return &Server{
+		hostname:    hostname,
+		userHandler: userHandler,
+		lockSystems: sync.Map{},
+		Enabled:     true,
+	}
+}
+
+//Get the WebDAV lock system of the user
+func (s *Server) getLockSystem(username string) webdav.LockSystem {
+	ls, _ := s.lockSystems.LoadOrStore(username, webdav.NewMemLS())
+	return ls.(webdav.LockSystem)
+}
+
+//Authenticate the request with HTTP basic auth or the current login session
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request, service string) (*user.User, bool) {
+	authAgent := s.userHandler.GetAuthAgent()
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		if authAgent.CheckAuth(r) {
+			userinfo, err := s.userHandler.GetUserInfoFromRequest(w, r)
+			if err == nil {
+				return userinfo, true
+			}
+		}
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="Login with your `+s.hostname+` account"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, false
+	}
+
+	if !authAgent.ValidateUsernameAndPassword(username, password) {
+		authAgent.Logger.LogAuthByRequestInfo(username, r.RemoteAddr, time.Now().Unix(), false, service)
+		log.Println("Someone from " + r.RemoteAddr + " try to log into " + username + " " + service + " endpoint with incorrect password")
+		w.Header().Set("WWW-Authenticate", `Basic realm="Login with your `+s.hostname+` account"`)
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	userinfo, err := s.userHandler.GetUserInfoFromUsername(username)
+	if err != nil {
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	return userinfo, true
+}
+
+//Handle all requests to /caldav, /carddav and the well-known discovery URLs
+func (s *Server) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	if !s.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+
+	//Service discovery
+	if r.URL.Path == "/.well-known/caldav" || r.URL.Path == "/.well-known/carddav" {
+		http.Redirect(w, r, "/"+strings.TrimPrefix(r.URL.Path, "/.well-known/")+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	service := segments[0]
+	if service != serviceCalDAV && service != serviceCardDAV {
+		http.NotFound(w, r)
+		return
+	}
+
+	userinfo, ok := s.authenticate(w, r, service)
+	if !ok {
+		return
+	}
+
+	if len(segments) < 2 {
+		//Service root, point the client to the user principal
+		s.handleServiceRoot(w, r, service, userinfo)
+		return
+	}
+
+	if segments[1] != userinfo.Username {
+		http.Error(w, "Permission Denied", http.StatusForbidden)
+		return
+	}
+
+	ctx, err := s.newRequestContext(service, userinfo)
+	if err != nil {
+		log.Println("Unable to open "+service+" home for "+userinfo.Username+": ", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	ctx.serveHTTP(w, r)
+}
+
+func (s *Server) newRequestContext(service string, userinfo *user.User) (*requestContext, error) {
+	collectionType := collectionCalendar
+	folder := "calendars"
+	if service == serviceCardDAV {
+		collectionType = collectionAddressBook
+		folder = "contacts"
+	}
+
+	homeDir, err := userinfo.VirtualPathToRealPath("user:/.dav/" + folder)
+	if err != nil {
+		return nil, err
+	}
+
+	s.collectionLock.Lock()
+	err = ensureHome(homeDir, collectionType)
+	s.collectionLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return &requestContext{
+		server:         s,
+		service:        service,
+		collectionType: collectionType,
+		userinfo:       userinfo,
+		homeDir:        filepath.ToSlash(filepath.Clean(homeDir)),
+		prefix:         "/" + service + "/" + userinfo.Username,
+	}, nil
+}
+
+//Serve the request inside the home folder of the user
+func (c *requestContext) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "OPTIONS":
+		c.handleOptions(w, r)
+	case "PUT":
+		c.handlePut(w, r)
+	case "MKCOL", "MKCALENDAR":
+		c.handleMkcol(w, r)
+	case "PROPPATCH":
+		c.handleProppatch(w, r)
+	case "REPORT":
+		c.handleReport(w, r)
+	default:
+		//Other requests are served by the WebDAV handler
+		if isHiddenPath(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
+		handler := &webdav.Handler{
+			Prefix:     c.prefix,
+			FileSystem: &davFileSystem{Dir: webdav.Dir(c.homeDir), ctx: c},
+			LockSystem: c.server.getLockSystem(c.userinfo.Username),
+		}
+		handler.ServeHTTP(w, r)
+	}
+}
+
+//Handle request to the service root, which only tells the client who the current user is
+func (s *Server) handleServiceRoot(w http.ResponseWriter, r *http.Request, service string, userinfo *user.User) {
+	if r.Method == "OPTIONS" {
+		setOptionHeaders(w)
+		return
+	}
+	if r.Method != "PROPFIND" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := parseXMLBody(r.Body)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	principal := hrefElement("/" + service + "/" + userinfo.Username + "/")
+	available := []davProp{
+		{Name: xml.Name{Space: nsDAV, Local: "resourcetype"}, InnerXML: emptyElement(xml.Name{Space: nsDAV, Local: "collection"})},
+		{Name: xml.Name{Space: nsDAV, Local: "current-user-principal"}, InnerXML: principal},
+		{Name: xml.Name{Space: nsDAV, Local: "principal-URL"}, InnerXML: principal},
+	}
+
+	found, notFound := selectProps(available, body)
+	ms := newMultistatus()
+	ms.addPropResponse("/"+service+"/", found, notFound)
+	ms.write(w)
+}
+
+//Pick the requested properties from the available properties. Return all if no prop is specified
+func selectProps(available []davProp, propfind *xmlNode) ([]davProp, []xml.Name) {
+	propNode := propfind.child(nsDAV, "prop")
+	if propNode == nil {
+		return available, []xml.Name{}
+	}
+
+	found := []davProp{}
+	notFound := []xml.Name{}
+	for _, name := range propNode.propNames() {
+		matched := false
+		for _, p := range available {
+			if p.Name == name {
+				found = append(found, p)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			notFound = append(notFound, name)
+		}
+	}
+	return found, notFound
+}
+
+func setOptionHeaders(w http.ResponseWriter) {
+	w.Header().Set("Allow", "OPTIONS, GET, HEAD, DELETE, PUT, PROPFIND, PROPPATCH, COPY, MOVE, LOCK, UNLOCK, MKCOL, MKCALENDAR, REPORT")
+	w.Header().Set("DAV", "1, 2, 3, calendar-access, addressbook, extended-mkcol")
+}
+
+/*
+	Hrefs and properties
+*/
+
+//Get the href of a path relative to the home folder
+func (c *requestContext) href(rel string) string {
+	u := url.URL{Path: c.prefix + "/" + strings.TrimPrefix(rel, "/")}
+	return u.EscapedPath()
+}
+
+//Get the path relative to the home folder from an href. Return false if it is outside of the home folder
+func (c *requestContext) relativePath(href string) (string, bool) {
+	u, err := url.Parse(href)
+	if err != nil {
+		return "", false
+	}
+	p := path.Clean(u.Path)
+	if p != c.prefix && !strings.HasPrefix(p, c.prefix+"/") {
+		return "", false
+	}
+	return strings.TrimPrefix(p, c.prefix), true
+}
+
+//Get the path relative to the home folder of the request URI
+func (c *requestContext) requestPath(r *http.Request) string {
+	return strings.TrimPrefix(path.Clean(r.URL.Path), c.prefix)
+}
+
+//Split the relative path into collection and resource name
+func splitRelativePath(rel string) (string, string, int) {
+	segments := strings.Split(strings.Trim(path.Clean("/"+rel), "/"), "/")
+	if segments[0] == "" {
+		return "", "", 0
+	}
+	if len(segments) == 1 {
+		return segments[0], "", 1
+	}
+	return segments[0], strings.Join(segments[1:], "/"), len(segments)
+}
+
+func (c *requestContext) contentType() string {
+	if c.collectionType == collectionCalendar {
+		return "text/calendar; charset=utf-8"
+	}
+	return "text/vcard; charset=utf-8"
+}
+
+func (c *requestContext) principalHref() string {
+	return "/" + c.service + "/" + c.userinfo.Username + "/"
+}
+
+//Properties available on every resource
+func (c *requestContext) commonProps() []davProp {
+	privileges := ""
+	for _, p := range []string{"read", "write", "write-properties", "write-content", "bind", "unbind", "read-current-user-privilege-set"} {
+		privileges += element(xml.Name{Space: nsDAV, Local: "privilege"}, emptyElement(xml.Name{Space: nsDAV, Local: p}))
+	}
+	return []davProp{
+		{Name: xml.Name{Space: nsDAV, Local: "current-user-principal"}, InnerXML: hrefElement(c.principalHref())},
+		{Name: xml.Name{Space: nsDAV, Local: "owner"}, InnerXML: hrefElement(c.principalHref())},
+		{Name: xml.Name{Space: nsDAV, Local: "current-user-privilege-set"}, InnerXML: privileges},
+	}
+}
+
+//Properties of the user principal, which is also the home collection
+func (c *requestContext) principalProps() []davProp {
+	resourceType := emptyElement(xml.Name{Space: nsDAV, Local: "collection"}) + emptyElement(xml.Name{Space: nsDAV, Local: "principal"})
+	return []davProp{
+		{Name: xml.Name{Space: nsDAV, Local: "resourcetype"}, InnerXML: resourceType},
+		{Name: xml.Name{Space: nsDAV, Local: "displayname"}, InnerXML: escapeXML(c.userinfo.Username)},
+		{Name: xml.Name{Space: nsDAV, Local: "principal-URL"}, InnerXML: hrefElement(c.principalHref())},
+		{Name: xml.Name{Space: nsDAV, Local: "principal-collection-set"}, InnerXML: hrefElement("/" + c.service + "/")},
+		{Name: xml.Name{Space: nsCalDAV, Local: "calendar-home-set"}, InnerXML: hrefElement("/" + serviceCalDAV + "/" + c.userinfo.Username + "/")},
+		{Name: xml.Name{Space: nsCardDAV, Local: "addressbook-home-set"}, InnerXML: hrefElement("/" + serviceCardDAV + "/" + c.userinfo.Username + "/")},
+	}
+}
+
+//Properties of a calendar or address book collection
+func (c *requestContext) collectionProps(meta *collectionMeta) []davProp {
+	reports := []xml.Name{{Space: nsDAV, Local: "sync-collection"}}
+	resourceType := emptyElement(xml.Name{Space: nsDAV, Local: "collection"})
+	props := []davProp{}
+	if meta.Type == collectionCalendar {
+		resourceType += emptyElement(xml.Name{Space: nsCalDAV, Local: "calendar"})
+		reports = append(reports, xml.Name{Space: nsCalDAV, Local: "calendar-query"}, xml.Name{Space: nsCalDAV, Local: "calendar-multiget"})
+		components := ""
+		for _, comp := range meta.Components {
+			components += `<comp xmlns="` + nsCalDAV + `" name="` + escapeXML(comp) + `"/>`
+		}
+		props = append(props,
+			davProp{Name: xml.Name{Space: nsCalDAV, Local: "supported-calendar-component-set"}, InnerXML: components},
+			davProp{Name: xml.Name{Space: nsCalDAV, Local: "supported-calendar-data"}, InnerXML: `<calendar-data xmlns="` + nsCalDAV + `" content-type="text/calendar" version="2.0"/>`},
+			davProp{Name: xml.Name{Space: nsCalDAV, Local: "calendar-description"}, InnerXML: escapeXML(meta.Description)},
+			davProp{Name: xml.Name{Space: nsAppleCal, Local: "calendar-color"}, InnerXML: escapeXML(meta.Color)},
+		)
+	} else {
+		resourceType += emptyElement(xml.Name{Space: nsCardDAV, Local: "addressbook"})
+		reports = append(reports, xml.Name{Space: nsCardDAV, Local: "addressbook-query"}, xml.Name{Space: nsCardDAV, Local: "addressbook-multiget"})
+		props = append(props,
+			davProp{Name: xml.Name{Space: nsCardDAV, Local: "supported-address-data"}, InnerXML: `<address-data-type xmlns="` + nsCardDAV + `" content-type="text/vcard" version="3.0"/><address-data-type xmlns="` + nsCardDAV + `" content-type="text/vcard" version="4.0"/>`},
+			davProp{Name: xml.Name{Space: nsCardDAV, Local: "addressbook-description"}, InnerXML: escapeXML(meta.Description)},
+		)
+	}
+
+	supportedReports := ""
+	for _, report := range reports {
+		supportedReports += element(xml.Name{Space: nsDAV, Local: "supported-report"}, element(xml.Name{Space: nsDAV, Local: "report"}, emptyElement(report)))
+	}
+
+	props = append(props,
+		davProp{Name: xml.Name{Space: nsDAV, Local: "resourcetype"}, InnerXML: resourceType},
+		davProp{Name: xml.Name{Space: nsDAV, Local: "displayname"}, InnerXML: escapeXML(meta.DisplayName)},
+		davProp{Name: xml.Name{Space: nsDAV, Local: "sync-token"}, InnerXML: escapeXML(meta.syncTokenURI())},
+		davProp{Name: xml.Name{Space: nsCalSrv, Local: "getctag"}, InnerXML: escapeXML(meta.syncTokenURI())},
+		davProp{Name: xml.Name{Space: nsDAV, Local: "supported-report-set"}, InnerXML: supportedReports},
+	)
+
+	//Dead properties set by the clients
+	for key, value := range meta.Props {
+		props = append(props, davProp{Name: decodePropKey(key), InnerXML: value})
+	}
+	return props
+}
+
+//Encode a property name as {namespace}name for storing in the collection metadata
+func encodePropKey(name xml.Name) string {
+	return "{" + name.Space + "}" + name.Local
+}
+
+func decodePropKey(key string) xml.Name {
+	if strings.HasPrefix(key, "{") {
+		if pos := strings.Index(key, "}"); pos > 0 {
+			return xml.Name{Space: key[1:pos], Local: key[pos+1:]}
+		}
+	}
+	return xml.Name{Local: key}
+}
@@ -0,0 +1,135 @@
+package dav
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"imuslab.com/arozos/mod/network/webdav"
+)
+
+/*
+	DAV File System
+
+	Wrap the WebDAV directory file system of the user home so that the
+	CalDAV / CardDAV properties are served as dead properties by the
+	internal WebDAV handler. Hidden files (e.g. collection metadata)
+	are not accessible by clients.
+*/
+
+type davFileSystem struct {
+	webdav.Dir
+	ctx *requestContext
+}
+
+type davFile struct {
+	webdav.File
+	fs   *davFileSystem
+	name string
+}
+
+//Check if the given path contains hidden segments
+func isHiddenPath(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs *davFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if isHiddenPath(name) {
+		return nil, os.ErrNotExist
+	}
+	f, err := fs.Dir.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &davFile{File: f, fs: fs, name: name}, nil
+}
+
+func (fs *davFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if isHiddenPath(name) {
+		return os.ErrPermission
+	}
+	return fs.Dir.Mkdir(ctx, name, perm)
+}
+
+func (fs *davFileSystem) RemoveAll(ctx context.Context, name string) error {
+	if isHiddenPath(name) || path.Clean("/"+name) == "/" {
+		return os.ErrPermission
+	}
+	return fs.Dir.RemoveAll(ctx, name)
+}
+
+func (fs *davFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	if isHiddenPath(oldName) || isHiddenPath(newName) {
+		return os.ErrPermission
+	}
+	return fs.Dir.Rename(ctx, oldName, newName)
+}
+
+func (fs *davFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if isHiddenPath(name) {
+		return nil, os.ErrNotExist
+	}
+	return fs.Dir.Stat(ctx, name)
+}
+
+//Hide the hidden files from directory listing
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	files, err := f.File.Readdir(count)
+	results := []os.FileInfo{}
+	for _, fi := range files {
+		if !strings.HasPrefix(fi.Name(), ".") {
+			results = append(results, fi)
+		}
+	}
+	return results, err
+}
+
+func (f *davFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	props := f.fs.ctx.commonProps()
+
+	segments := strings.Split(strings.Trim(path.Clean("/"+f.name), "/"), "/")
+	if segments[0] == "" {
+		//Home collection, which is also the principal of the user
+		props = append(props, f.fs.ctx.principalProps()...)
+	} else if len(segments) == 1 {
+		//Calendar or address book collection
+		meta, err := f.fs.ctx.collection(segments[0])
+		if err == nil {
+			props = append(props, f.fs.ctx.collectionProps(meta)...)
+		}
+	} else {
+		//Calendar object or address object resources
+		props = append(props, davProp{
+			Name:     xml.Name{Space: nsDAV, Local: "getcontenttype"},
+			InnerXML: f.fs.ctx.contentType(),
+		})
+	}
+
+	results := map[xml.Name]webdav.Property{}
+	for _, p := range props {
+		results[p.Name] = webdav.Property{
+			XMLName:  p.Name,
+			InnerXML: []byte(p.InnerXML),
+		}
+	}
+	return results, nil
+}
+
+//Properties are updated with PROPPATCH handled by the DAV server, not the WebDAV handler
+func (f *davFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	pstat := webdav.Propstat{Status: http.StatusForbidden}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			pstat.Props = append(pstat.Props, webdav.Property{XMLName: p.XMLName})
+		}
+	}
+	return []webdav.Propstat{pstat}, nil
+}
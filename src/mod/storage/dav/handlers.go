@@ -0,0 +1,409 @@
+package dav
+
+import (
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//Maximum size of a calendar object or address object resource
+const maxResourceSize = 10 << 20
+
+//Get the collection metadata with the change log updated
+func (c *requestContext) collection(name string) (*collectionMeta, error) {
+	c.server.collectionLock.Lock()
+	defer c.server.collectionLock.Unlock()
+	return refreshCollection(filepath.Join(c.homeDir, name))
+}
+
+func (c *requestContext) handleOptions(w http.ResponseWriter, r *http.Request) {
+	setOptionHeaders(w)
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+	PUT
+
+	Create or update a calendar object or address object resource.
+	The content is validated and UID must be unique inside the collection.
+	If-Match and If-None-Match are supported for safe updates.
+*/
+func (c *requestContext) handlePut(w http.ResponseWriter, r *http.Request) {
+	rel := c.requestPath(r)
+	collectionName, name, depth := splitRelativePath(rel)
+	if depth != 2 || strings.Contains(name, "/") || isHiddenPath(rel) {
+		http.Error(w, "Resources can only be created inside a collection", http.StatusForbidden)
+		return
+	}
+
+	collectionDir := filepath.Join(c.homeDir, collectionName)
+	meta, err := loadCollection(collectionDir)
+	if err != nil {
+		http.Error(w, "Collection not exists", http.StatusConflict)
+		return
+	}
+
+	//Check content type
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if meta.Type == collectionCalendar && mediaType != "" && mediaType != "text/calendar" {
+		newPreconditionError(nsCalDAV, "supported-calendar-data", "Content type must be text/calendar").write(w)
+		return
+	}
+	if meta.Type == collectionAddressBook && mediaType != "" && mediaType != "text/vcard" && mediaType != "text/x-vcard" {
+		newPreconditionError(nsCardDAV, "supported-address-data", "Content type must be text/vcard").write(w)
+		return
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(r.Body, maxResourceSize+1))
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if len(content) > maxResourceSize {
+		if meta.Type == collectionCalendar {
+			newPreconditionError(nsCalDAV, "max-resource-size", "Resource too large").write(w)
+		} else {
+			newPreconditionError(nsCardDAV, "max-resource-size", "Resource too large").write(w)
+		}
+		return
+	}
+
+	//Validate the content
+	var uid string
+	var davErr *davError
+	if meta.Type == collectionCalendar {
+		uid, _, davErr = validateCalendarData(content, meta.Components)
+	} else {
+		uid, davErr = validateAddressData(content)
+	}
+	if davErr != nil {
+		davErr.write(w)
+		return
+	}
+
+	c.server.collectionLock.Lock()
+	defer c.server.collectionLock.Unlock()
+	meta, err = refreshCollection(collectionDir)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	//Check preconditions of the request
+	target := filepath.Join(collectionDir, name)
+	var oldSize int64 = 0
+	currentETag := ""
+	if fi, err := os.Stat(target); err == nil {
+		if fi.IsDir() {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		oldSize = fi.Size()
+		currentETag = fileETag(fi)
+	}
+
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && currentETag != "" {
+		if ifNoneMatch == "*" || etagListContains(ifNoneMatch, currentETag) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+	}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if currentETag == "" || (ifMatch != "*" && !etagListContains(ifMatch, currentETag)) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+	}
+
+	if existing := meta.resourceWithUID(uid); existing != "" && existing != name {
+		if meta.Type == collectionCalendar {
+			newPreconditionError(nsCalDAV, "no-uid-conflict", "UID already used by "+existing).write(w)
+		} else {
+			newPreconditionError(nsCardDAV, "no-uid-conflict", "UID already used by "+existing).write(w)
+		}
+		return
+	}
+
+	//Check user storage quota
+	sizeChange := int64(len(content)) - oldSize
+	if sizeChange > 0 && !c.userinfo.StorageQuota.HaveSpace(sizeChange) {
+		http.Error(w, "Storage Quota Full", http.StatusInsufficientStorage)
+		return
+	}
+
+	//Write to a temporary file and replace the original one
+	tmpFile := filepath.Join(collectionDir, ".upload-"+strconv.FormatInt(int64(os.Getpid()), 10))
+	err = ioutil.WriteFile(tmpFile, content, 0644)
+	if err == nil {
+		err = os.Rename(tmpFile, target)
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		log.Println("Unable to write DAV resource: ", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if sizeChange > 0 {
+		c.userinfo.StorageQuota.AllocateSpace(sizeChange)
+	} else if sizeChange < 0 {
+		c.userinfo.StorageQuota.ReclaimSpace(-sizeChange)
+	}
+
+	//Record the change
+	refreshCollection(collectionDir)
+
+	if fi, err := os.Stat(target); err == nil {
+		w.Header().Set("ETag", fileETag(fi))
+	}
+	if currentETag == "" {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+//Check if the If-Match / If-None-Match header value contains the etag
+func etagListContains(header string, etag string) bool {
+	for _, value := range strings.Split(header, ",") {
+		value = strings.TrimPrefix(strings.TrimSpace(value), "W/")
+		if value == etag {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	MKCALENDAR and extended MKCOL
+
+	Create a new calendar (RFC 4791 Section 5.3.1) or address book (RFC 5689).
+	Only calendar or address book collections can be created in the home folder.
+*/
+func (c *requestContext) handleMkcol(w http.ResponseWriter, r *http.Request) {
+	rel := c.requestPath(r)
+	collectionName, _, depth := splitRelativePath(rel)
+	if depth != 1 || isHiddenPath(rel) {
+		http.Error(w, "Collections can only be created in the home folder", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == "MKCALENDAR" && c.collectionType != collectionCalendar {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := parseXMLBody(r.Body)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	meta := newCollectionMeta(c.collectionType)
+	meta.DisplayName = collectionName
+	props := body.child(nsDAV, "set").child(nsDAV, "prop")
+	if r.Method == "MKCOL" {
+		//Extended MKCOL must specify the resource type of the collection
+		resourceType := props.child(nsDAV, "resourcetype")
+		if c.collectionType == collectionCalendar && resourceType.child(nsCalDAV, "calendar") == nil ||
+			c.collectionType == collectionAddressBook && resourceType.child(nsCardDAV, "addressbook") == nil {
+			newPreconditionError(nsDAV, "valid-resourcetype", "Only "+c.collectionType+" collection can be created").write(w)
+			return
+		}
+	}
+
+	if props != nil {
+		for i := range props.Children {
+			if davErr := meta.applyProp(&props.Children[i], false, true); davErr != nil {
+				davErr.write(w)
+				return
+			}
+		}
+	}
+
+	c.server.collectionLock.Lock()
+	defer c.server.collectionLock.Unlock()
+	collectionDir := filepath.Join(c.homeDir, collectionName)
+	if fileExists(collectionDir) {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	err = createCollection(collectionDir, meta)
+	if err != nil {
+		log.Println("Unable to create DAV collection: ", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+//Properties that are computed by the server and cannot be changed by clients
+var protectedProps = []xml.Name{
+	{Space: nsDAV, Local: "resourcetype"},
+	{Space: nsDAV, Local: "getetag"},
+	{Space: nsDAV, Local: "getcontenttype"},
+	{Space: nsDAV, Local: "getcontentlength"},
+	{Space: nsDAV, Local: "getlastmodified"},
+	{Space: nsDAV, Local: "creationdate"},
+	{Space: nsDAV, Local: "lockdiscovery"},
+	{Space: nsDAV, Local: "supportedlock"},
+	{Space: nsDAV, Local: "sync-token"},
+	{Space: nsDAV, Local: "owner"},
+	{Space: nsDAV, Local: "current-user-principal"},
+	{Space: nsDAV, Local: "current-user-privilege-set"},
+	{Space: nsDAV, Local: "supported-report-set"},
+	{Space: nsCalSrv, Local: "getctag"},
+	{Space: nsCalDAV, Local: "supported-calendar-component-set"},
+	{Space: nsCalDAV, Local: "supported-calendar-data"},
+	{Space: nsCardDAV, Local: "supported-address-data"},
+}
+
+//Set or remove a property of the collection. Protected properties can only be set on creation
+func (m *collectionMeta) applyProp(prop *xmlNode, remove bool, creation bool) *davError {
+	name := prop.XMLName
+	switch {
+	case name == xml.Name{Space: nsDAV, Local: "displayname"}:
+		m.DisplayName = prop.text()
+	case name == xml.Name{Space: nsCalDAV, Local: "calendar-description"}, name == xml.Name{Space: nsCardDAV, Local: "addressbook-description"}:
+		m.Description = prop.text()
+	case name == xml.Name{Space: nsAppleCal, Local: "calendar-color"}:
+		m.Color = prop.text()
+	case creation && name == xml.Name{Space: nsDAV, Local: "resourcetype"}:
+		//Validated by the MKCOL handler
+	case creation && name == xml.Name{Space: nsCalDAV, Local: "supported-calendar-component-set"}:
+		components := []string{}
+		for _, comp := range prop.childrenNamed(nsCalDAV, "comp") {
+			compName := strings.ToUpper(comp.attr("name"))
+			if !inArray(calendarObjectComponents, compName) {
+				return newPreconditionError(nsCalDAV, "supported-calendar-component", compName+" is not supported")
+			}
+			components = append(components, compName)
+		}
+		if len(components) > 0 {
+			m.Components = components
+		}
+	default:
+		for _, protected := range protectedProps {
+			if name == protected {
+				return newPreconditionError(nsDAV, "cannot-modify-protected-property", name.Local+" is protected")
+			}
+		}
+		if remove {
+			delete(m.Props, encodePropKey(name))
+		} else {
+			m.Props[encodePropKey(name)] = prop.Inner
+		}
+		return nil
+	}
+
+	if remove {
+		switch name.Local {
+		case "displayname":
+			m.DisplayName = ""
+		case "calendar-description", "addressbook-description":
+			m.Description = ""
+		case "calendar-color":
+			m.Color = ""
+		}
+	}
+	return nil
+}
+
+/*
+	PROPPATCH
+
+	Update the properties of calendar and address book collections.
+	The update is atomic, all changes are discarded if any of them fails.
+*/
+func (c *requestContext) handleProppatch(w http.ResponseWriter, r *http.Request) {
+	body, err := parseXMLBody(r.Body)
+	if err != nil || body == nil || !body.is(nsDAV, "propertyupdate") {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	type propUpdate struct {
+		prop   *xmlNode
+		remove bool
+	}
+	updates := []propUpdate{}
+	for i := range body.Children {
+		instruction := &body.Children[i]
+		remove := instruction.is(nsDAV, "remove")
+		if !remove && !instruction.is(nsDAV, "set") {
+			continue
+		}
+		props := instruction.child(nsDAV, "prop")
+		if props == nil {
+			continue
+		}
+		for j := range props.Children {
+			updates = append(updates, propUpdate{prop: &props.Children[j], remove: remove})
+		}
+	}
+
+	names := []xml.Name{}
+	for _, update := range updates {
+		names = append(names, update.prop.XMLName)
+	}
+
+	rel := c.requestPath(r)
+	collectionName, _, depth := splitRelativePath(rel)
+	ms := newMultistatus()
+	if depth != 1 || isHiddenPath(rel) {
+		//Only collection properties can be updated
+		if depth == 0 || fileExists(filepath.Join(c.homeDir, filepath.FromSlash(rel))) {
+			ms.addPropStatusResponse(r.URL.EscapedPath(), propStatus{names: names, status: http.StatusForbidden})
+			ms.write(w)
+		} else {
+			http.NotFound(w, r)
+		}
+		return
+	}
+
+	c.server.collectionLock.Lock()
+	defer c.server.collectionLock.Unlock()
+	collectionDir := filepath.Join(c.homeDir, collectionName)
+	meta, err := loadCollection(collectionDir)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	failed := []xml.Name{}
+	succeeded := []xml.Name{}
+	for _, update := range updates {
+		if davErr := meta.applyProp(update.prop, update.remove, false); davErr != nil {
+			failed = append(failed, update.prop.XMLName)
+		} else {
+			succeeded = append(succeeded, update.prop.XMLName)
+		}
+	}
+
+	if len(failed) > 0 {
+		stats := []propStatus{{names: failed, status: http.StatusForbidden}}
+		if len(succeeded) > 0 {
+			stats = append(stats, propStatus{names: succeeded, status: http.StatusFailedDependency})
+		}
+		ms.addPropStatusResponse(r.URL.EscapedPath(), stats...)
+		ms.write(w)
+		return
+	}
+
+	err = meta.save(collectionDir)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	ms.addPropStatusResponse(r.URL.EscapedPath(), propStatus{names: names, status: http.StatusOK})
+	ms.write(w)
+}
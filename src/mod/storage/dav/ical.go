@@ -0,0 +1,395 @@
+package dav
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	iCalendar and vCard Parser
+
+	Both iCalendar (RFC 5545) and vCard (RFC 6350) share the same
+	content line format, so a single parser is used for both of them.
+	Only the structure required for validation and query filtering is parsed,
+	the original content is always stored and served as it is.
+*/
+
+type contentProp struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+type component struct {
+	Name     string
+	Props    []*contentProp
+	Children []*component
+}
+
+//Get the first property with the given name
+func (c *component) prop(name string) *contentProp {
+	for _, p := range c.Props {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+//Get all properties with the given name
+func (c *component) propsNamed(name string) []*contentProp {
+	results := []*contentProp{}
+	for _, p := range c.Props {
+		if p.Name == name {
+			results = append(results, p)
+		}
+	}
+	return results
+}
+
+//Get all child components with the given name
+func (c *component) childrenNamed(name string) []*component {
+	results := []*component{}
+	for _, child := range c.Children {
+		if child.Name == name {
+			results = append(results, child)
+		}
+	}
+	return results
+}
+
+//Unfold the content lines, see RFC 5545 Section 3.1
+func unfoldLines(data string) []string {
+	data = strings.Replace(data, "\r\n", "\n", -1)
+	lines := []string{}
+	for _, line := range strings.Split(data, "\n") {
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		lines = append(lines, strings.TrimRight(line, "\r"))
+	}
+	return lines
+}
+
+//Parse a single content line into name, parameters and value
+func parseContentLine(line string) (*contentProp, error) {
+	inQuote := false
+	segments := []string{}
+	last := 0
+	valueStart := -1
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if c == '"' {
+			inQuote = !inQuote
+		} else if !inQuote && c == ';' {
+			segments = append(segments, line[last:i])
+			last = i + 1
+		} else if !inQuote && c == ':' {
+			segments = append(segments, line[last:i])
+			valueStart = i + 1
+			break
+		}
+	}
+	if valueStart < 0 || len(segments) == 0 || segments[0] == "" {
+		return nil, errors.New("Invalid content line: " + line)
+	}
+
+	name := strings.ToUpper(segments[0])
+	//Strip the group prefix of vCard properties (e.g. item1.EMAIL)
+	if pos := strings.LastIndex(name, "."); pos >= 0 {
+		name = name[pos+1:]
+	}
+
+	params := map[string]string{}
+	for _, param := range segments[1:] {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			//vCard 2.1 style parameter without value (e.g. TEL;CELL)
+			params["TYPE"] = kv[0]
+			continue
+		}
+		params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], "\"")
+	}
+
+	return &contentProp{
+		Name:   name,
+		Params: params,
+		Value:  line[valueStart:],
+	}, nil
+}
+
+//Parse iCalendar or vCard data into a tree of components
+func parseComponent(data []byte) (*component, error) {
+	lines := unfoldLines(string(data))
+	if len(lines) == 0 {
+		return nil, errors.New("Empty content")
+	}
+
+	var root *component
+	stack := []*component{}
+	for _, line := range lines {
+		prop, err := parseContentLine(line)
+		if err != nil {
+			return nil, err
+		}
+
+		if prop.Name == "BEGIN" {
+			if root != nil && len(stack) == 0 {
+				return nil, errors.New("Only one root component is allowed")
+			}
+			comp := &component{Name: strings.ToUpper(prop.Value)}
+			if len(stack) == 0 {
+				root = comp
+			} else {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, comp)
+			}
+			stack = append(stack, comp)
+		} else if prop.Name == "END" {
+			if len(stack) == 0 || stack[len(stack)-1].Name != strings.ToUpper(prop.Value) {
+				return nil, errors.New("Unexpected END:" + prop.Value)
+			}
+			stack = stack[:len(stack)-1]
+		} else {
+			if len(stack) == 0 {
+				return nil, errors.New("Property " + prop.Name + " outside of component")
+			}
+			current := stack[len(stack)-1]
+			current.Props = append(current.Props, prop)
+		}
+	}
+
+	if len(stack) != 0 {
+		return nil, errors.New("Component " + stack[len(stack)-1].Name + " is not closed")
+	}
+
+	return root, nil
+}
+
+/*
+	Validation
+*/
+
+var calendarObjectComponents = []string{"VEVENT", "VTODO", "VJOURNAL", "VFREEBUSY"}
+
+//Validate a calendar object resource. Return the UID and the component type of the object
+func validateCalendarData(data []byte, allowedComponents []string) (string, string, *davError) {
+	root, err := parseComponent(data)
+	if err != nil {
+		return "", "", newPreconditionError(nsCalDAV, "valid-calendar-data", err.Error())
+	}
+
+	if root.Name != "VCALENDAR" {
+		return "", "", newPreconditionError(nsCalDAV, "valid-calendar-data", "Root component must be VCALENDAR")
+	}
+
+	if root.prop("VERSION") == nil || root.prop("PRODID") == nil {
+		return "", "", newPreconditionError(nsCalDAV, "valid-calendar-data", "VERSION and PRODID are required")
+	}
+
+	if root.prop("METHOD") != nil {
+		return "", "", newPreconditionError(nsCalDAV, "valid-calendar-object-resource", "METHOD is not allowed in calendar object resource")
+	}
+
+	uid := ""
+	compType := ""
+	for _, child := range root.Children {
+		if child.Name == "VTIMEZONE" {
+			continue
+		}
+
+		if !inArray(calendarObjectComponents, child.Name) {
+			if strings.HasPrefix(child.Name, "X-") {
+				continue
+			}
+			return "", "", newPreconditionError(nsCalDAV, "valid-calendar-data", "Unknown component "+child.Name)
+		}
+
+		if !inArray(allowedComponents, child.Name) {
+			return "", "", newPreconditionError(nsCalDAV, "supported-calendar-component", child.Name+" is not supported by this calendar")
+		}
+
+		//All components must be the same type and share the same UID
+		thisUID := child.prop("UID")
+		if thisUID == nil || thisUID.Value == "" {
+			return "", "", newPreconditionError(nsCalDAV, "valid-calendar-object-resource", "UID is required")
+		}
+
+		if compType == "" {
+			compType = child.Name
+			uid = thisUID.Value
+		} else if compType != child.Name || uid != thisUID.Value {
+			return "", "", newPreconditionError(nsCalDAV, "valid-calendar-object-resource", "All components must have the same type and UID")
+		}
+	}
+
+	if compType == "" {
+		return "", "", newPreconditionError(nsCalDAV, "valid-calendar-object-resource", "No calendar component found")
+	}
+
+	return uid, compType, nil
+}
+
+//Validate an address object resource. Return the UID of the vCard
+func validateAddressData(data []byte) (string, *davError) {
+	root, err := parseComponent(data)
+	if err != nil {
+		return "", newPreconditionError(nsCardDAV, "valid-address-data", err.Error())
+	}
+
+	if root.Name != "VCARD" {
+		return "", newPreconditionError(nsCardDAV, "valid-address-data", "Root component must be VCARD")
+	}
+
+	version := root.prop("VERSION")
+	if version == nil || !(version.Value == "3.0" || version.Value == "4.0") {
+		return "", newPreconditionError(nsCardDAV, "supported-address-data", "Only vCard 3.0 and 4.0 are supported")
+	}
+
+	if root.prop("FN") == nil {
+		return "", newPreconditionError(nsCardDAV, "valid-address-data", "FN is required")
+	}
+
+	uid := root.prop("UID")
+	if uid == nil || uid.Value == "" {
+		return "", newPreconditionError(nsCardDAV, "valid-address-data", "UID is required")
+	}
+
+	return uid.Value, nil
+}
+
+/*
+	Date and Time
+
+	Floating time and time with TZID are treated as UTC. This is good enough
+	for selecting the events to be synced, the client handles the exact timezone.
+*/
+
+//Parse DATE or DATE-TIME value. Return the time and if it is a DATE only value
+func parseDateTime(prop *contentProp) (time.Time, bool, error) {
+	value := prop.Value
+	if prop.Params["VALUE"] == "DATE" || len(value) == 8 {
+		t, err := time.Parse("20060102", value)
+		return t, true, err
+	}
+
+	t, err := time.Parse("20060102T150405Z", value)
+	if err != nil {
+		t, err = time.Parse("20060102T150405", value)
+	}
+	return t, false, err
+}
+
+//Parse iCalendar DURATION value, e.g. P1W, PT1H30M, -P1D
+func parseDuration(value string) (time.Duration, error) {
+	negative := false
+	if strings.HasPrefix(value, "-") {
+		negative = true
+		value = value[1:]
+	}
+	value = strings.TrimPrefix(value, "+")
+	if !strings.HasPrefix(value, "P") {
+		return 0, errors.New("Invalid duration")
+	}
+	value = value[1:]
+
+	var d time.Duration
+	inTime := false
+	number := ""
+	for _, c := range value {
+		if c >= '0' && c <= '9' {
+			number += string(c)
+			continue
+		}
+		if c == 'T' {
+			inTime = true
+			continue
+		}
+
+		n, err := strconv.Atoi(number)
+		if err != nil {
+			return 0, errors.New("Invalid duration")
+		}
+		number = ""
+		switch {
+		case c == 'W':
+			d += time.Duration(n) * 7 * 24 * time.Hour
+		case c == 'D':
+			d += time.Duration(n) * 24 * time.Hour
+		case c == 'H' && inTime:
+			d += time.Duration(n) * time.Hour
+		case c == 'M' && inTime:
+			d += time.Duration(n) * time.Minute
+		case c == 'S' && inTime:
+			d += time.Duration(n) * time.Second
+		default:
+			return 0, errors.New("Invalid duration")
+		}
+	}
+
+	if negative {
+		d = -d
+	}
+	return d, nil
+}
+
+//Get the time span of a calendar component. Return false if the component has no start time
+func componentTimeSpan(comp *component) (time.Time, time.Time, bool) {
+	startProp := comp.prop("DTSTART")
+	if startProp == nil && comp.Name == "VTODO" {
+		startProp = comp.prop("DUE")
+	}
+	if startProp == nil {
+		return time.Time{}, time.Time{}, false
+	}
+
+	start, isDate, err := parseDateTime(startProp)
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+
+	end := start
+	if endProp := comp.prop("DTEND"); endProp != nil {
+		if t, _, err := parseDateTime(endProp); err == nil {
+			end = t
+		}
+	} else if dueProp := comp.prop("DUE"); dueProp != nil && dueProp != startProp {
+		if t, _, err := parseDateTime(dueProp); err == nil {
+			end = t
+		}
+	} else if durationProp := comp.prop("DURATION"); durationProp != nil {
+		if d, err := parseDuration(durationProp.Value); err == nil {
+			end = start.Add(d)
+		}
+	} else if isDate {
+		//All day event
+		end = start.Add(24 * time.Hour)
+	}
+
+	//Recurring component might occur at any time after the first instance
+	if comp.prop("RRULE") != nil || comp.prop("RDATE") != nil {
+		end = time.Unix(1<<40, 0)
+	}
+
+	return start, end, true
+}
+
+//Check if the component overlaps with the given time range, see RFC 4791 Section 9.9
+func componentInTimeRange(comp *component, rangeStart time.Time, rangeEnd time.Time) bool {
+	start, end, ok := componentTimeSpan(comp)
+	if !ok {
+		//Component without time information always match
+		return true
+	}
+
+	if end.Equal(start) {
+		return !start.Before(rangeStart) && start.Before(rangeEnd)
+	}
+	return start.Before(rangeEnd) && end.After(rangeStart)
+}
@@ -0,0 +1,412 @@
+package dav
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	REPORT
+
+	Supported reports
+	calendar-query, calendar-multiget (RFC 4791 Section 7)
+	addressbook-query, addressbook-multiget (RFC 6352 Section 8)
+	sync-collection (RFC 6578)
+*/
+
+//A calendar object or address object resource loaded for a report
+type davResource struct {
+	collection string
+	name       string
+	info       os.FileInfo
+	content    []byte
+}
+
+func (c *requestContext) handleReport(w http.ResponseWriter, r *http.Request) {
+	body, err := parseXMLBody(r.Body)
+	if err != nil || body == nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	rel := c.requestPath(r)
+	if isHiddenPath(rel) {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case c.collectionType == collectionCalendar && body.is(nsCalDAV, "calendar-query"):
+		c.handleQuery(w, r, rel, body, c.matchCalendarFilter)
+	case c.collectionType == collectionAddressBook && body.is(nsCardDAV, "addressbook-query"):
+		c.handleQuery(w, r, rel, body, c.matchAddressBookFilter)
+	case c.collectionType == collectionCalendar && body.is(nsCalDAV, "calendar-multiget"),
+		c.collectionType == collectionAddressBook && body.is(nsCardDAV, "addressbook-multiget"):
+		c.handleMultiget(w, body)
+	case body.is(nsDAV, "sync-collection"):
+		c.handleSyncCollection(w, r, rel, body)
+	default:
+		newPreconditionError(nsDAV, "supported-report", "Unsupported report").write(w)
+	}
+}
+
+//Load a resource with the given relative path
+func (c *requestContext) loadResource(collection string, name string) (*davResource, error) {
+	filename := filepath.Join(c.homeDir, collection, name)
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, os.ErrNotExist
+	}
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &davResource{
+		collection: collection,
+		name:       name,
+		info:       fi,
+		content:    content,
+	}, nil
+}
+
+//Load the resources targeted by the request URI, which can be a collection or a single resource
+func (c *requestContext) targetResources(rel string) ([]*davResource, bool) {
+	collection, name, depth := splitRelativePath(rel)
+	if depth == 2 {
+		res, err := c.loadResource(collection, name)
+		if err != nil {
+			return nil, false
+		}
+		return []*davResource{res}, true
+	} else if depth != 1 {
+		return nil, false
+	}
+
+	files, err := listResources(filepath.Join(c.homeDir, collection))
+	if err != nil {
+		return nil, false
+	}
+	names := []string{}
+	for filename := range files {
+		names = append(names, filename)
+	}
+	sort.Strings(names)
+
+	results := []*davResource{}
+	for _, filename := range names {
+		res, err := c.loadResource(collection, filename)
+		if err == nil {
+			results = append(results, res)
+		}
+	}
+	return results, true
+}
+
+//Get the requested properties of a resource
+func (c *requestContext) resourceProps(res *davResource, propNode *xmlNode) ([]davProp, []xml.Name) {
+	names := []xml.Name{
+		{Space: nsDAV, Local: "getetag"},
+		{Space: nsDAV, Local: "getcontenttype"},
+		{Space: nsDAV, Local: "getcontentlength"},
+		{Space: nsDAV, Local: "getlastmodified"},
+	}
+	if propNode != nil {
+		names = propNode.propNames()
+	}
+
+	found := []davProp{}
+	notFound := []xml.Name{}
+	for _, name := range names {
+		value := ""
+		switch {
+		case name == xml.Name{Space: nsDAV, Local: "getetag"}:
+			value = escapeXML(fileETag(res.info))
+		case name == xml.Name{Space: nsDAV, Local: "getcontenttype"}:
+			value = escapeXML(c.contentType())
+		case name == xml.Name{Space: nsDAV, Local: "getcontentlength"}:
+			value = strconv.FormatInt(res.info.Size(), 10)
+		case name == xml.Name{Space: nsDAV, Local: "getlastmodified"}:
+			value = res.info.ModTime().UTC().Format(http.TimeFormat)
+		case name == xml.Name{Space: nsDAV, Local: "resourcetype"}:
+			value = ""
+		case name == xml.Name{Space: nsDAV, Local: "current-user-principal"}:
+			value = hrefElement(c.principalHref())
+		case c.collectionType == collectionCalendar && name == xml.Name{Space: nsCalDAV, Local: "calendar-data"},
+			c.collectionType == collectionAddressBook && name == xml.Name{Space: nsCardDAV, Local: "address-data"}:
+			value = escapeXML(string(res.content))
+		default:
+			notFound = append(notFound, name)
+			continue
+		}
+		found = append(found, davProp{Name: name, InnerXML: value})
+	}
+	return found, notFound
+}
+
+func (c *requestContext) handleQuery(w http.ResponseWriter, r *http.Request, rel string, body *xmlNode, matcher func(*xmlNode, *davResource) bool) {
+	resources, ok := c.targetResources(rel)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	//Limit on number of results, addressbook-query only
+	limit := -1
+	if nresults := body.child(nsCardDAV, "limit").child(nsCardDAV, "nresults"); nresults != nil {
+		if value, err := strconv.Atoi(nresults.text()); err == nil && value >= 0 {
+			limit = value
+		}
+	}
+
+	ms := newMultistatus()
+	propNode := body.child(nsDAV, "prop")
+	count := 0
+	for _, res := range resources {
+		if !matcher(body, res) {
+			continue
+		}
+		if limit >= 0 && count >= limit {
+			//Truncated results, see RFC 6352 Section 8.6.1
+			ms.addStatusResponse(r.URL.EscapedPath(), http.StatusInsufficientStorage)
+			break
+		}
+		found, notFound := c.resourceProps(res, propNode)
+		ms.addPropResponse(c.href(res.collection+"/"+res.name), found, notFound)
+		count++
+	}
+	ms.write(w)
+}
+
+func (c *requestContext) handleMultiget(w http.ResponseWriter, body *xmlNode) {
+	ms := newMultistatus()
+	propNode := body.child(nsDAV, "prop")
+	for _, hrefNode := range body.childrenNamed(nsDAV, "href") {
+		href := hrefNode.text()
+		rel, ok := c.relativePath(href)
+		collection, name, depth := splitRelativePath(rel)
+		if !ok || depth != 2 || isHiddenPath(rel) {
+			ms.addStatusResponse(href, http.StatusNotFound)
+			continue
+		}
+
+		res, err := c.loadResource(collection, name)
+		if err != nil {
+			ms.addStatusResponse(href, http.StatusNotFound)
+			continue
+		}
+		found, notFound := c.resourceProps(res, propNode)
+		ms.addPropResponse(href, found, notFound)
+	}
+	ms.write(w)
+}
+
+func (c *requestContext) handleSyncCollection(w http.ResponseWriter, r *http.Request, rel string, body *xmlNode) {
+	collection, _, depth := splitRelativePath(rel)
+	if depth != 1 {
+		newPreconditionError(nsDAV, "supported-report", "sync-collection is only supported on collections").write(w)
+		return
+	}
+
+	meta, err := c.collection(collection)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	token, err := meta.parseSyncToken(body.child(nsDAV, "sync-token").text())
+	if err != nil {
+		newPreconditionError(nsDAV, "valid-sync-token", err.Error()).write(w)
+		return
+	}
+
+	changed, removed := meta.changesSince(token)
+	sort.Strings(changed)
+	sort.Strings(removed)
+
+	ms := newMultistatus()
+	propNode := body.child(nsDAV, "prop")
+	for _, name := range changed {
+		res, err := c.loadResource(collection, name)
+		if err != nil {
+			//Removed after the refresh
+			continue
+		}
+		found, notFound := c.resourceProps(res, propNode)
+		ms.addPropResponse(c.href(collection+"/"+name), found, notFound)
+	}
+	for _, name := range removed {
+		ms.addStatusResponse(c.href(collection+"/"+name), http.StatusNotFound)
+	}
+	ms.addElement(xml.Name{Space: nsDAV, Local: "sync-token"}, escapeXML(meta.syncTokenURI()))
+	ms.write(w)
+}
+
+/*
+	Filters
+*/
+
+//Check if the calendar object matches the calendar-query filter
+func (c *requestContext) matchCalendarFilter(body *xmlNode, res *davResource) bool {
+	filter := body.child(nsCalDAV, "filter")
+	if filter == nil {
+		return true
+	}
+	root, err := parseComponent(res.content)
+	if err != nil {
+		return false
+	}
+	for _, compFilter := range filter.childrenNamed(nsCalDAV, "comp-filter") {
+		if !matchCompFilter([]*component{root}, compFilter) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchCompFilter(comps []*component, filter *xmlNode) bool {
+	name := strings.ToUpper(filter.attr("name"))
+	candidates := []*component{}
+	for _, comp := range comps {
+		if comp.Name == name {
+			candidates = append(candidates, comp)
+		}
+	}
+
+	if filter.child(nsCalDAV, "is-not-defined") != nil {
+		return len(candidates) == 0
+	}
+
+	for _, comp := range candidates {
+		if matchComponent(comp, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchComponent(comp *component, filter *xmlNode) bool {
+	if timeRange := filter.child(nsCalDAV, "time-range"); timeRange != nil {
+		start, end := parseTimeRange(timeRange)
+		if !componentInTimeRange(comp, start, end) {
+			return false
+		}
+	}
+
+	for _, propFilter := range filter.childrenNamed(nsCalDAV, "prop-filter") {
+		if !matchPropFilter(comp.propsNamed(strings.ToUpper(propFilter.attr("name"))), propFilter, nsCalDAV) {
+			return false
+		}
+	}
+
+	for _, compFilter := range filter.childrenNamed(nsCalDAV, "comp-filter") {
+		if !matchCompFilter(comp.Children, compFilter) {
+			return false
+		}
+	}
+	return true
+}
+
+//Parse the start and end of time-range element. Missing values are unbounded
+func parseTimeRange(timeRange *xmlNode) (time.Time, time.Time) {
+	start := time.Unix(0, 0)
+	end := time.Unix(1<<40, 0)
+	if t, err := time.Parse("20060102T150405Z", timeRange.attr("start")); err == nil {
+		start = t
+	}
+	if t, err := time.Parse("20060102T150405Z", timeRange.attr("end")); err == nil {
+		end = t
+	}
+	return start, end
+}
+
+//Check if the vCard matches the addressbook-query filter
+func (c *requestContext) matchAddressBookFilter(body *xmlNode, res *davResource) bool {
+	filter := body.child(nsCardDAV, "filter")
+	propFilters := filter.childrenNamed(nsCardDAV, "prop-filter")
+	if len(propFilters) == 0 {
+		return true
+	}
+	root, err := parseComponent(res.content)
+	if err != nil {
+		return false
+	}
+
+	allOf := filter.attr("test") == "allof"
+	for _, propFilter := range propFilters {
+		matched := matchPropFilter(root.propsNamed(strings.ToUpper(propFilter.attr("name"))), propFilter, nsCardDAV)
+		if allOf && !matched {
+			return false
+		}
+		if !allOf && matched {
+			return true
+		}
+	}
+	return allOf
+}
+
+func matchPropFilter(props []*contentProp, filter *xmlNode, ns string) bool {
+	if filter.child(ns, "is-not-defined") != nil {
+		return len(props) == 0
+	}
+	if len(props) == 0 {
+		return false
+	}
+
+	textMatches := filter.childrenNamed(ns, "text-match")
+	if len(textMatches) == 0 {
+		return true
+	}
+
+	allOf := filter.attr("test") == "allof"
+	for _, textMatch := range textMatches {
+		matched := false
+		for _, p := range props {
+			if matchText(p.Value, textMatch) {
+				matched = true
+				break
+			}
+		}
+		if allOf && !matched {
+			return false
+		}
+		if !allOf && matched {
+			return true
+		}
+	}
+	return allOf
+}
+
+func matchText(value string, textMatch *xmlNode) bool {
+	needle := textMatch.Text
+	if textMatch.attr("collation") != "i;octet" {
+		value = strings.ToLower(value)
+		needle = strings.ToLower(needle)
+	}
+
+	matched := false
+	switch textMatch.attr("match-type") {
+	case "equals":
+		matched = value == needle
+	case "starts-with":
+		matched = strings.HasPrefix(value, needle)
+	case "ends-with":
+		matched = strings.HasSuffix(value, needle)
+	default:
+		matched = strings.Contains(value, needle)
+	}
+
+	if textMatch.attr("negate-condition") == "yes" {
+		return !matched
+	}
+	return matched
+}
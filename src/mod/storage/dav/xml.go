@@ -0,0 +1,252 @@
+package dav
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+	XML Helpers
+
+	Request bodies are decoded into a generic node tree as the CalDAV and
+	CardDAV reports have deep and loosely defined structures. Responses are
+	written with each element declaring its own default namespace, so no
+	prefix bookkeeping is required.
+*/
+
+const (
+	nsDAV      = "DAV:"
+	nsCalDAV   = "urn:ietf:params:xml:ns:caldav"
+	nsCardDAV  = "urn:ietf:params:xml:ns:carddav"
+	nsCalSrv   = "http://calendarserver.org/ns/"
+	nsAppleCal = "http://apple.com/ns/ical/"
+)
+
+//davError is a WebDAV error with an optional precondition element, see RFC 4918 Section 16
+type davError struct {
+	status    int
+	condition xml.Name
+	message   string
+}
+
+func newPreconditionError(space string, local string, message string) *davError {
+	return &davError{
+		status:    http.StatusForbidden,
+		condition: xml.Name{Space: space, Local: local},
+		message:   message,
+	}
+}
+
+func (e *davError) Error() string {
+	return e.message
+}
+
+//Write the error to the client
+func (e *davError) write(w http.ResponseWriter) {
+	if e.condition.Local == "" {
+		http.Error(w, e.message, e.status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(e.status)
+	io.WriteString(w, xml.Header+`<error xmlns="DAV:">`+emptyElement(e.condition)+`</error>`)
+}
+
+/*
+	Request parsing
+*/
+
+type xmlNode struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr `xml:",any,attr"`
+	Children []xmlNode  `xml:",any"`
+	Text     string     `xml:",chardata"`
+	Inner    string     `xml:",innerxml"`
+}
+
+//Decode the request body into a node tree. Return nil if the body is empty
+func parseXMLBody(r io.Reader) (*xmlNode, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r, 10<<20))
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, nil
+	}
+	node := xmlNode{}
+	err = xml.Unmarshal(body, &node)
+	if err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+func (n *xmlNode) is(space string, local string) bool {
+	return n.XMLName.Space == space && n.XMLName.Local == local
+}
+
+//Get the first child with the given name
+func (n *xmlNode) child(space string, local string) *xmlNode {
+	if n == nil {
+		return nil
+	}
+	for i := range n.Children {
+		if n.Children[i].is(space, local) {
+			return &n.Children[i]
+		}
+	}
+	return nil
+}
+
+//Get all children with the given name
+func (n *xmlNode) childrenNamed(space string, local string) []*xmlNode {
+	results := []*xmlNode{}
+	if n == nil {
+		return results
+	}
+	for i := range n.Children {
+		if n.Children[i].is(space, local) {
+			results = append(results, &n.Children[i])
+		}
+	}
+	return results
+}
+
+//Get the value of an attribute without namespace
+func (n *xmlNode) attr(name string) string {
+	if n == nil {
+		return ""
+	}
+	for _, a := range n.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+//Get the text content of the node, empty if the node is nil
+func (n *xmlNode) text() string {
+	if n == nil {
+		return ""
+	}
+	return strings.TrimSpace(n.Text)
+}
+
+//Get the property names listed in a DAV:prop element
+func (n *xmlNode) propNames() []xml.Name {
+	names := []xml.Name{}
+	if n == nil {
+		return names
+	}
+	for _, c := range n.Children {
+		names = append(names, c.XMLName)
+	}
+	return names
+}
+
+/*
+	Response writing
+*/
+
+func escapeXML(value string) string {
+	buf := bytes.Buffer{}
+	xml.EscapeText(&buf, []byte(value))
+	return buf.String()
+}
+
+func emptyElement(name xml.Name) string {
+	return `<` + name.Local + ` xmlns="` + escapeXML(name.Space) + `"/>`
+}
+
+func element(name xml.Name, innerXML string) string {
+	if innerXML == "" {
+		return emptyElement(name)
+	}
+	return `<` + name.Local + ` xmlns="` + escapeXML(name.Space) + `">` + innerXML + `</` + name.Local + `>`
+}
+
+func hrefElement(href string) string {
+	return element(xml.Name{Space: nsDAV, Local: "href"}, escapeXML(href))
+}
+
+//davProp is a property value in a response. An empty value is written as an empty element
+type davProp struct {
+	Name     xml.Name
+	InnerXML string
+}
+
+type multistatus struct {
+	buf bytes.Buffer
+}
+
+func newMultistatus() *multistatus {
+	m := multistatus{}
+	m.buf.WriteString(xml.Header + `<multistatus xmlns="DAV:">`)
+	return &m
+}
+
+func statusLine(code int) string {
+	return "HTTP/1.1 " + strconv.Itoa(code) + " " + http.StatusText(code)
+}
+
+//Add a response with the found properties and the names of missing properties
+func (m *multistatus) addPropResponse(href string, found []davProp, notFound []xml.Name) {
+	m.buf.WriteString(`<response>` + hrefElement(href))
+	if len(found) > 0 || len(notFound) == 0 {
+		m.buf.WriteString(`<propstat><prop>`)
+		for _, p := range found {
+			m.buf.WriteString(element(p.Name, p.InnerXML))
+		}
+		m.buf.WriteString(`</prop><status>` + statusLine(http.StatusOK) + `</status></propstat>`)
+	}
+	if len(notFound) > 0 {
+		m.buf.WriteString(`<propstat><prop>`)
+		for _, name := range notFound {
+			m.buf.WriteString(emptyElement(name))
+		}
+		m.buf.WriteString(`</prop><status>` + statusLine(http.StatusNotFound) + `</status></propstat>`)
+	}
+	m.buf.WriteString(`</response>`)
+}
+
+//propStatus is the status of a group of properties, used by PROPPATCH
+type propStatus struct {
+	names  []xml.Name
+	status int
+}
+
+//Add a response with the status of each group of properties
+func (m *multistatus) addPropStatusResponse(href string, stats ...propStatus) {
+	m.buf.WriteString(`<response>` + hrefElement(href))
+	for _, stat := range stats {
+		m.buf.WriteString(`<propstat><prop>`)
+		for _, name := range stat.names {
+			m.buf.WriteString(emptyElement(name))
+		}
+		m.buf.WriteString(`</prop><status>` + statusLine(stat.status) + `</status></propstat>`)
+	}
+	m.buf.WriteString(`</response>`)
+}
+
+//Add a response with only a status, used for removed resources in sync-collection
+func (m *multistatus) addStatusResponse(href string, status int) {
+	m.buf.WriteString(`<response>` + hrefElement(href) + `<status>` + statusLine(status) + `</status></response>`)
+}
+
+//Add a raw element directly under the multistatus
+func (m *multistatus) addElement(name xml.Name, innerXML string) {
+	m.buf.WriteString(element(name, innerXML))
+}
+
+func (m *multistatus) write(w http.ResponseWriter) {
+	m.buf.WriteString(`</multistatus>`)
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(207)
+	w.Write(m.buf.Bytes())
+}
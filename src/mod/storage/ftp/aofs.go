@@ -5,6 +5,7 @@ package ftp
 
 import (
 	"errors"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -15,12 +16,54 @@ import (
 
 	"github.com/spf13/afero"
 	fs "imuslab.com/arozos/mod/filesystem"
+	"imuslab.com/arozos/mod/network/bandwidth"
 	"imuslab.com/arozos/mod/user"
 )
 
 type aofs struct {
 	userinfo  *user.User
 	tmpFolder string
+	conn      *bandwidth.Connection //Bandwidth limited connection of the session, can be nil
+}
+
+//File with the reads and writes throttled by the bandwidth limits of the session
+type limitedFile struct {
+	*os.File
+	reader io.Reader
+	writer io.Writer
+}
+
+func (f *limitedFile) Read(p []byte) (int, error) {
+	return f.reader.Read(p)
+}
+
+func (f *limitedFile) Write(p []byte) (int, error) {
+	return f.writer.Write(p)
+}
+
+//Hide the ReadFrom and WriteTo of os.File so io.Copy cannot bypass the limits
+func (f *limitedFile) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(f.writer, r)
+}
+
+func (f *limitedFile) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, f.reader)
+}
+
+//Wrap the opened file so the transfer is limited. Folders are returned as is
+func (a aofs) limitFile(fd *os.File) afero.File {
+	if a.conn == nil {
+		return fd
+	}
+	if info, err := fd.Stat(); err != nil || info.IsDir() {
+		return fd
+	}
+	a.conn.SetDescription(filepath.Base(fd.Name()))
+	return &limitedFile{
+		File:   fd,
+		reader: a.conn.DownloadReader(fd),
+		writer: a.conn.UploadWriter(fd),
+	}
 }
 
 func (a aofs) Create(name string) (afero.File, error) {
@@ -36,7 +79,7 @@ func (a aofs) Create(name string) (afero.File, error) {
 	if err != nil {
 		return nil, err
 	}
-	return fd, nil
+	return a.limitFile(fd), nil
 }
 
 func (a aofs) Chown(name string, uid, gid int) error {
@@ -93,7 +136,7 @@ func (a aofs) Open(name string) (afero.File, error) {
 	if err != nil {
 		return nil, err
 	}
-	return fd, nil
+	return a.limitFile(fd), nil
 
 }
 
@@ -131,7 +174,7 @@ func (a aofs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, err
 		if err != nil {
 			return nil, err
 		}
-		return fd, nil
+		return a.limitFile(fd), nil
 	} else {
 		if !a.checkAllowAccess(rewritePath, "read") {
 			return nil, errors.New("Permission Denied")
@@ -140,7 +183,7 @@ func (a aofs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, err
 		if err != nil {
 			return nil, err
 		}
-		return fd, nil
+		return a.limitFile(fd), nil
 	}
 }
 
@@ -327,7 +370,7 @@ func insideHiddenFolder(path string) bool {
 	thisPathInfo := filepath.ToSlash(filepath.Clean(path))
 	pathData := strings.Split(thisPathInfo, "/")
 	for _, thispd := range pathData {
-		if thispd[:1] == "." {
+		if len(thispd) > 0 && thispd[:1] == "." {
 			//This path contain one of the folder is hidden
 			return true
 		}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	ftp "github.com/fclairamb/ftpserverlib"
+	"imuslab.com/arozos/mod/network/bandwidth"
 )
 
 func (m mainDriver) GetSettings() (*ftp.Settings, error) {
@@ -42,6 +43,12 @@ func (m mainDriver) ClientDisconnected(cc ftp.ClientContext) {
 		m.connectedUserList.Delete(cc.ID())
 	}
 
+	//Release the bandwidth limited connection
+	if conn, ok := m.connections.Load(cc.ID()); ok {
+		conn.(*bandwidth.Connection).Close()
+		m.connections.Delete(cc.ID())
+	}
+
 }
 
 //Authenicate user using arozos authAgent
@@ -68,6 +75,15 @@ func (m mainDriver) AuthUser(cc ftp.ClientContext, user string, pass string) (ft
 			return nil, errors.New("User " + userinfo.Username + " has no permission to access FTP endpoint")
 		}
 
+		//Check the concurrent connection limit of this user
+		conn, err := m.bandwidth.Open(bandwidth.ProtocolFTP, userinfo.Username, cc.RemoteAddr().String(), "FTP session")
+		if err != nil {
+			return nil, err
+		}
+		if conn != nil {
+			m.connections.Store(cc.ID(), conn)
+		}
+
 		//Create tmp buffer for this user
 		tmpFolder := m.tmpFolder + "users/" + userinfo.Username + "/ftpbuf/"
 		os.MkdirAll(tmpFolder, 0755)
@@ -80,6 +96,7 @@ func (m mainDriver) AuthUser(cc ftp.ClientContext, user string, pass string) (ft
 		return aofs{
 			userinfo:  userinfo,
 			tmpFolder: tmpFolder,
+			conn:      conn,
 		}, nil
 	} else {
 		//log the signin request
@@ -89,5 +106,8 @@ func (m mainDriver) AuthUser(cc ftp.ClientContext, user string, pass string) (ft
 }
 
 func (m mainDriver) GetTLSConfig() (*tls.Config, error) {
-	return nil, errors.New("Not Supported")
+	if m.tlsConfig == nil {
+		return nil, errors.New("Not Supported")
+	}
+	return m.tlsConfig, nil
 }
@@ -1,6 +1,7 @@
 package ftp
 
 import (
+	"crypto/tls"
 	"errors"
 	"log"
 	"strconv"
@@ -9,6 +10,7 @@ import (
 
 	ftp "github.com/fclairamb/ftpserverlib"
 	"imuslab.com/arozos/mod/database"
+	"imuslab.com/arozos/mod/network/bandwidth"
 	"imuslab.com/arozos/mod/user"
 )
 
@@ -27,10 +29,14 @@ type mainDriver struct {
 	userHandler       *user.UserHandler
 	tmpFolder         string
 	connectedUserList *sync.Map
+	connections       *sync.Map //Bandwidth limited connections of the logged in clients
+	tlsConfig         *tls.Config
+	bandwidth         *bandwidth.Controller
 }
 
 //NewFTPHandler creates a new handler for FTP Server as a wrapper to the ftpserverlib
-func NewFTPHandler(userHandler *user.UserHandler, ServerName string, Port int, tmpFolder string, PassiveModeIP string) (*Handler, error) {
+//Explicit TLS (FTPS) is enabled if tlsConfig is not nil. Transfers are not limited if bandwidthController is nil
+func NewFTPHandler(userHandler *user.UserHandler, ServerName string, Port int, tmpFolder string, PassiveModeIP string, tlsConfig *tls.Config, bandwidthController *bandwidth.Controller) (*Handler, error) {
 	//Create table for ftp if it doesn't exists
 	db := userHandler.GetDatabase()
 	db.NewTable("ftp")
@@ -48,6 +54,9 @@ func NewFTPHandler(userHandler *user.UserHandler, ServerName string, Port int, t
 		userHandler:       userHandler,
 		tmpFolder:         tmpFolder,
 		connectedUserList: &sync.Map{},
+		connections:       &sync.Map{},
+		tlsConfig:         tlsConfig,
+		bandwidth:         bandwidthController,
 	})
 	return &Handler{
 		ServerName:    ServerName,
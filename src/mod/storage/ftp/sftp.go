@@ -0,0 +1,329 @@
+package ftp
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"imuslab.com/arozos/mod/database"
+	"imuslab.com/arozos/mod/network/bandwidth"
+	"imuslab.com/arozos/mod/user"
+)
+
+/*
+	SFTP Server
+
+	SSH File Transfer Protocol server that expose the same virtual roots as
+	the FTP server. Users login with their ArozOS password or the SSH public
+	keys they registered. Only the sftp subsystem is served, shell and exec
+	requests are rejected.
+*/
+
+//SFTPHandler is the handler for the SFTP server defined in arozos
+type SFTPHandler struct {
+	Port          int
+	ServerRunning bool
+	UPNPEnabled   bool
+	userHandler   *user.UserHandler
+	tmpFolder     string
+	config        *ssh.ServerConfig
+	listener      net.Listener
+	connections   *sync.Map
+	bandwidth     *bandwidth.Controller
+}
+
+//NewSFTPHandler creates a new handler for SFTP Server. The host key is created if not exists.
+//Transfers are not limited if bandwidthController is nil
+func NewSFTPHandler(userHandler *user.UserHandler, Port int, tmpFolder string, hostKeyPath string, bandwidthController *bandwidth.Controller) (*SFTPHandler, error) {
+	//Create table for sftp if it doesn't exists
+	db := userHandler.GetDatabase()
+	db.NewTable("sftp")
+
+	hostKey, err := loadOrCreateHostKey(hostKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	handler := SFTPHandler{
+		Port:          Port,
+		ServerRunning: false,
+		UPNPEnabled:   false,
+		userHandler:   userHandler,
+		tmpFolder:     tmpFolder,
+		connections:   &sync.Map{},
+		bandwidth:     bandwidthController,
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback:  handler.authPassword,
+		PublicKeyCallback: handler.authPublicKey,
+		ServerVersion:     "SSH-2.0-arozos",
+	}
+	config.AddHostKey(hostKey)
+	handler.config = config
+
+	return &handler, nil
+}
+
+//Update which usergroups can access the file system via sftp server
+func UpdateSFTPAccessableGroups(database *database.Database, groups []string) {
+	database.Write("sftp", "groups", groups)
+	if len(groups) == 0 {
+		log.Println("Setting no group access to sftp server!")
+	}
+}
+
+//Get the SSH public keys registered by the user, in authorized_keys format
+func GetUserSSHKeys(database *database.Database, username string) []string {
+	keys := []string{}
+	if database.KeyExists("sftp", "keys/"+username) {
+		database.Read("sftp", "keys/"+username, &keys)
+	}
+	return keys
+}
+
+//Set the SSH public keys of the user. All keys must be valid authorized_keys entries
+func SetUserSSHKeys(database *database.Database, username string, keys []string) error {
+	validKeys := []string{}
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		_, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+		if err != nil {
+			return errors.New("Invalid public key: " + err.Error())
+		}
+		validKeys = append(validKeys, key)
+	}
+	return database.Write("sftp", "keys/"+username, validKeys)
+}
+
+//Load the host key of the server, or generate one if not exists
+func loadOrCreateHostKey(keyPath string) (ssh.Signer, error) {
+	if fileExists(keyPath) {
+		keyPEM, err := ioutil.ReadFile(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		return ssh.ParsePrivateKey(keyPEM)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	os.MkdirAll(filepath.Dir(keyPath), 0700)
+	err = ioutil.WriteFile(keyPath, keyPEM, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(keyPEM)
+}
+
+/*
+	Authentication
+*/
+
+//Check if the user is in the groups allowed to access sftp server
+func (s *SFTPHandler) checkGroupAccess(userinfo *user.User) bool {
+	allowedPgs := []string{}
+	err := s.userHandler.GetDatabase().Read("sftp", "groups", &allowedPgs)
+	if err != nil {
+		allowedPgs = []string{}
+	}
+	return userinfo.UserIsInOneOfTheGroupOf(allowedPgs)
+}
+
+func (s *SFTPHandler) authorize(conn ssh.ConnMetadata, keyAuth bool, validated bool) (*ssh.Permissions, error) {
+	authAgent := s.userHandler.GetAuthAgent()
+	username := conn.User()
+	if !validated {
+		authAgent.Logger.LogAuthByRequestInfo(username, conn.RemoteAddr().String(), time.Now().Unix(), false, "sftp")
+		if keyAuth {
+			return nil, errors.New("Public key not accepted")
+		}
+		return nil, errors.New("Invalid username or password")
+	}
+
+	userinfo, err := s.userHandler.GetUserInfoFromUsername(username)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.checkGroupAccess(userinfo) {
+		authAgent.Logger.LogAuthByRequestInfo(username, conn.RemoteAddr().String(), time.Now().Unix(), false, "sftp")
+		log.Println(userinfo.Username + " tries to access SFTP endpoint with invalid permission settings.")
+		return nil, errors.New("User " + userinfo.Username + " has no permission to access SFTP endpoint")
+	}
+
+	authAgent.Logger.LogAuthByRequestInfo(username, conn.RemoteAddr().String(), time.Now().Unix(), true, "sftp")
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			"username": userinfo.Username,
+		},
+	}, nil
+}
+
+//Authenicate user using arozos authAgent
+func (s *SFTPHandler) authPassword(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	validated := s.userHandler.GetAuthAgent().ValidateUsernameAndPassword(conn.User(), string(password))
+	return s.authorize(conn, false, validated)
+}
+
+//Authenicate user using the public keys registered by the user
+func (s *SFTPHandler) authPublicKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	validated := false
+	if s.userHandler.GetAuthAgent().UserExists(conn.User()) {
+		for _, authorizedKey := range GetUserSSHKeys(s.userHandler.GetDatabase(), conn.User()) {
+			thisKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+			if err != nil {
+				continue
+			}
+			if bytes.Equal(thisKey.Marshal(), key.Marshal()) {
+				validated = true
+				break
+			}
+		}
+	}
+	return s.authorize(conn, true, validated)
+}
+
+/*
+	Server
+*/
+
+//Start listening for SFTP connections
+func (s *SFTPHandler) Start() error {
+	if s.listener != nil {
+		return errors.New("SFTP server already running")
+	}
+
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(s.Port))
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	s.ServerRunning = true
+	log.Println("SFTP Server Started, listening at: " + strconv.Itoa(s.Port))
+
+	go func(listener net.Listener) {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				//Listener closed
+				return
+			}
+			go s.serveConn(conn)
+		}
+	}(listener)
+	return nil
+}
+
+//Close the SFTP Server and all the connections
+func (s *SFTPHandler) Close() {
+	if s.listener != nil {
+		s.listener.Close()
+		s.listener = nil
+	}
+
+	s.connections.Range(func(key, value interface{}) bool {
+		value.(*ssh.ServerConn).Close()
+		return true
+	})
+	s.ServerRunning = false
+}
+
+func (s *SFTPHandler) serveConn(conn net.Conn) {
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	s.connections.Store(serverConn.RemoteAddr().String(), serverConn)
+	defer s.connections.Delete(serverConn.RemoteAddr().String())
+	go ssh.DiscardRequests(requests)
+
+	username := serverConn.Permissions.Extensions["username"]
+	userinfo, err := s.userHandler.GetUserInfoFromUsername(username)
+	if err != nil {
+		serverConn.Close()
+		return
+	}
+
+	//Check the concurrent connection limit of this user
+	limitedConn, err := s.bandwidth.Open(bandwidth.ProtocolFTP, userinfo.Username, serverConn.RemoteAddr().String(), "SFTP session")
+	if err != nil {
+		log.Println("[SFTP] " + userinfo.Username + " rejected: " + err.Error())
+		serverConn.Close()
+		return
+	}
+	defer limitedConn.Close()
+
+	//Create tmp buffer for this user
+	tmpFolder := s.tmpFolder + "users/" + userinfo.Username + "/sftpbuf/"
+	os.MkdirAll(tmpFolder, 0755)
+
+	var wg sync.WaitGroup
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "Only session channel is supported")
+			continue
+		}
+
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer channel.Close()
+			for req := range channelRequests {
+				//Only the sftp subsystem is allowed
+				if req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp" {
+					req.Reply(true, nil)
+					go ssh.DiscardRequests(channelRequests)
+					//Throttle the whole channel, the file handles of the sftp server are not limited
+					rw := struct {
+						io.Reader
+						io.Writer
+					}{limitedConn.UploadReader(channel), limitedConn.DownloadWriter(channel)}
+					server := newSFTPServer(rw, aofs{
+						userinfo:  userinfo,
+						tmpFolder: tmpFolder,
+						conn:      limitedConn,
+					})
+					server.Serve()
+					return
+				}
+				req.Reply(false, nil)
+			}
+		}()
+	}
+	wg.Wait()
+
+	//Recalculate user storage quota after the transfers
+	userinfo.StorageQuota.CalculateQuotaUsage()
+}
@@ -0,0 +1,734 @@
+package ftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	SFTP Protocol Handler
+
+	Implementation of the SFTP version 3 protocol (draft-ietf-secsh-filexfer-02)
+	All paths from the client are virtual paths translated by aofs, so the
+	access rules are the same as the FTP server.
+*/
+
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpLstat    = 7
+	sftpFstat    = 8
+	sftpSetstat  = 9
+	sftpFsetstat = 10
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpRmdir    = 15
+	sftpRealpath = 16
+	sftpStat     = 17
+	sftpRename   = 18
+	sftpReadlink = 19
+	sftpSymlink  = 20
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+
+	sftpStatusOK               = 0
+	sftpStatusEOF              = 1
+	sftpStatusNoSuchFile       = 2
+	sftpStatusPermissionDenied = 3
+	sftpStatusFailure          = 4
+	sftpStatusBadMessage       = 5
+	sftpStatusOpUnsupported    = 8
+
+	sftpFlagRead   = 0x01
+	sftpFlagWrite  = 0x02
+	sftpFlagAppend = 0x04
+	sftpFlagCreate = 0x08
+	sftpFlagTrunc  = 0x10
+	sftpFlagExcl   = 0x20
+
+	sftpAttrSize        = 0x01
+	sftpAttrUIDGID      = 0x02
+	sftpAttrPermissions = 0x04
+	sftpAttrACModTime   = 0x08
+	sftpAttrExtended    = 0x80000000
+
+	sftpMaxPacket     = 256 * 1024
+	sftpMaxRead       = 64 * 1024
+	sftpReaddirBatch  = 100
+	sftpMaxOpenHandle = 256
+)
+
+var errSFTPPermissionDenied = errors.New("Permission Denied")
+
+type sftpFileHandle struct {
+	file     *os.File
+	realPath string
+	entries  []os.FileInfo //Directory entries not yet sent, nil for files
+	isDir    bool
+	writable bool
+}
+
+type sftpServer struct {
+	rw          io.ReadWriter
+	fs          aofs
+	handles     map[string]*sftpFileHandle
+	nextHandle  int
+	outgoingBuf []byte
+}
+
+func newSFTPServer(rw io.ReadWriter, fs aofs) *sftpServer {
+	return &sftpServer{
+		rw:      rw,
+		fs:      fs,
+		handles: map[string]*sftpFileHandle{},
+	}
+}
+
+//Serve the client until the channel is closed
+func (s *sftpServer) Serve() error {
+	defer s.closeAllHandles()
+	header := make([]byte, 4)
+	for {
+		_, err := io.ReadFull(s.rw, header)
+		if err != nil {
+			return err
+		}
+		length := binary.BigEndian.Uint32(header)
+		if length < 1 || length > sftpMaxPacket {
+			return errors.New("Invalid packet length")
+		}
+
+		packet := make([]byte, length)
+		_, err = io.ReadFull(s.rw, packet)
+		if err != nil {
+			return err
+		}
+
+		err = s.handlePacket(packet)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *sftpServer) closeAllHandles() {
+	for id, handle := range s.handles {
+		if handle.file != nil {
+			handle.file.Close()
+		}
+		delete(s.handles, id)
+	}
+}
+
+/*
+	Packet encoding
+*/
+
+type sftpReader struct {
+	data []byte
+	err  error
+}
+
+func (r *sftpReader) uint32() uint32 {
+	if len(r.data) < 4 {
+		r.err = errors.New("Packet too short")
+		return 0
+	}
+	value := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return value
+}
+
+func (r *sftpReader) uint64() uint64 {
+	if len(r.data) < 8 {
+		r.err = errors.New("Packet too short")
+		return 0
+	}
+	value := binary.BigEndian.Uint64(r.data)
+	r.data = r.data[8:]
+	return value
+}
+
+func (r *sftpReader) bytes() []byte {
+	length := r.uint32()
+	if r.err != nil || uint32(len(r.data)) < length {
+		r.err = errors.New("Packet too short")
+		return []byte{}
+	}
+	value := r.data[:length]
+	r.data = r.data[length:]
+	return value
+}
+
+func (r *sftpReader) string() string {
+	return string(r.bytes())
+}
+
+type sftpAttributes struct {
+	flags uint32
+	size  uint64
+	perm  uint32
+	atime uint32
+	mtime uint32
+}
+
+func (r *sftpReader) attrs() *sftpAttributes {
+	attrs := &sftpAttributes{}
+	attrs.flags = r.uint32()
+	if attrs.flags&sftpAttrSize != 0 {
+		attrs.size = r.uint64()
+	}
+	if attrs.flags&sftpAttrUIDGID != 0 {
+		r.uint32()
+		r.uint32()
+	}
+	if attrs.flags&sftpAttrPermissions != 0 {
+		attrs.perm = r.uint32()
+	}
+	if attrs.flags&sftpAttrACModTime != 0 {
+		attrs.atime = r.uint32()
+		attrs.mtime = r.uint32()
+	}
+	if attrs.flags&sftpAttrExtended != 0 {
+		count := r.uint32()
+		for i := uint32(0); i < count && r.err == nil; i++ {
+			r.string()
+			r.string()
+		}
+	}
+	return attrs
+}
+
+func appendUint32(buf []byte, value uint32) []byte {
+	return append(buf, byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+}
+
+func appendUint64(buf []byte, value uint64) []byte {
+	return appendUint32(appendUint32(buf, uint32(value>>32)), uint32(value))
+}
+
+func appendString(buf []byte, value string) []byte {
+	return append(appendUint32(buf, uint32(len(value))), value...)
+}
+
+func appendFileInfo(buf []byte, info os.FileInfo) []byte {
+	mode := uint32(info.Mode().Perm())
+	if info.IsDir() {
+		mode |= 0040000
+	} else if info.Mode()&os.ModeSymlink != 0 {
+		mode |= 0120000
+	} else {
+		mode |= 0100000
+	}
+
+	buf = appendUint32(buf, sftpAttrSize|sftpAttrPermissions|sftpAttrACModTime)
+	buf = appendUint64(buf, uint64(info.Size()))
+	buf = appendUint32(buf, mode)
+	buf = appendUint32(buf, uint32(info.ModTime().Unix()))
+	buf = appendUint32(buf, uint32(info.ModTime().Unix()))
+	return buf
+}
+
+//Long name in ls -l format for clients that display it directly
+func (s *sftpServer) longName(info os.FileInfo) string {
+	owner := s.fs.userinfo.Username
+	return fmt.Sprintf("%s 1 %s %s %d %s %s", info.Mode().String(), owner, owner, info.Size(), info.ModTime().Format("Jan _2 15:04"), info.Name())
+}
+
+func (s *sftpServer) send(packetType byte, id uint32, payload []byte) error {
+	buf := appendUint32(s.outgoingBuf[:0], uint32(len(payload)+5))
+	buf = append(buf, packetType)
+	buf = appendUint32(buf, id)
+	buf = append(buf, payload...)
+	s.outgoingBuf = buf
+	_, err := s.rw.Write(buf)
+	return err
+}
+
+func (s *sftpServer) sendStatus(id uint32, code uint32, message string) error {
+	payload := appendUint32(nil, code)
+	payload = appendString(payload, message)
+	payload = appendString(payload, "en")
+	return s.send(sftpStatus, id, payload)
+}
+
+func (s *sftpServer) sendError(id uint32, err error) error {
+	if err == nil {
+		return s.sendStatus(id, sftpStatusOK, "OK")
+	}
+
+	if os.IsNotExist(err) {
+		return s.sendStatus(id, sftpStatusNoSuchFile, "No such file")
+	} else if os.IsPermission(err) || err == errSFTPPermissionDenied {
+		return s.sendStatus(id, sftpStatusPermissionDenied, "Permission denied")
+	} else if err == io.EOF {
+		return s.sendStatus(id, sftpStatusEOF, "EOF")
+	}
+	return s.sendStatus(id, sftpStatusFailure, err.Error())
+}
+
+func (s *sftpServer) sendHandle(id uint32, handle *sftpFileHandle) error {
+	if len(s.handles) >= sftpMaxOpenHandle {
+		if handle.file != nil {
+			handle.file.Close()
+		}
+		return s.sendStatus(id, sftpStatusFailure, "Too many open files")
+	}
+
+	s.nextHandle++
+	handleID := strconv.Itoa(s.nextHandle)
+	s.handles[handleID] = handle
+	return s.send(sftpHandle, id, appendString(nil, handleID))
+}
+
+func (s *sftpServer) sendName(id uint32, names []string, infos []os.FileInfo) error {
+	payload := appendUint32(nil, uint32(len(names)))
+	for i, name := range names {
+		payload = appendString(payload, name)
+		if infos[i] != nil {
+			payload = appendString(payload, s.longName(infos[i]))
+			payload = appendFileInfo(payload, infos[i])
+		} else {
+			payload = appendString(payload, name)
+			payload = appendUint32(payload, 0)
+		}
+	}
+	return s.send(sftpName, id, payload)
+}
+
+/*
+	Path translation
+*/
+
+//Convert the client path into an absolute virtual path
+func cleanVirtualPath(p string) string {
+	return path.Clean("/" + strings.Replace(p, "\\", "/", -1))
+}
+
+//Translate the virtual path into real path, checking the permission of the given mode
+func (s *sftpServer) resolve(virtualPath string, mode string) (string, error) {
+	realPath, _, err := s.fs.pathRewrite(cleanVirtualPath(virtualPath))
+	if err != nil {
+		return "", errSFTPPermissionDenied
+	}
+	if !s.fs.checkAllowAccess(realPath, mode) {
+		return "", errSFTPPermissionDenied
+	}
+	return realPath, nil
+}
+
+/*
+	Request handling
+*/
+
+func (s *sftpServer) handlePacket(packet []byte) error {
+	packetType := packet[0]
+	r := &sftpReader{data: packet[1:]}
+	if packetType == sftpInit {
+		//Reply with protocol version 3 without extensions
+		buf := appendUint32(nil, 5)
+		buf = append(buf, sftpVersion)
+		buf = appendUint32(buf, 3)
+		_, err := s.rw.Write(buf)
+		return err
+	}
+
+	id := r.uint32()
+	if r.err != nil {
+		return r.err
+	}
+
+	var err error
+	switch packetType {
+	case sftpOpen:
+		err = s.handleOpen(id, r)
+	case sftpClose:
+		err = s.handleClose(id, r)
+	case sftpRead:
+		err = s.handleRead(id, r)
+	case sftpWrite:
+		err = s.handleWrite(id, r)
+	case sftpLstat, sftpStat:
+		err = s.handleStat(id, r)
+	case sftpFstat:
+		err = s.handleFstat(id, r)
+	case sftpSetstat:
+		err = s.handleSetstat(id, r)
+	case sftpFsetstat:
+		err = s.handleFsetstat(id, r)
+	case sftpOpendir:
+		err = s.handleOpendir(id, r)
+	case sftpReaddir:
+		err = s.handleReaddir(id, r)
+	case sftpRemove, sftpRmdir:
+		err = s.handleRemove(id, r)
+	case sftpMkdir:
+		err = s.handleMkdir(id, r)
+	case sftpRealpath:
+		err = s.handleRealpath(id, r)
+	case sftpRename:
+		err = s.handleRename(id, r)
+	case sftpReadlink, sftpSymlink:
+		err = s.sendStatus(id, sftpStatusOpUnsupported, "Symbolic links are not supported")
+	default:
+		err = s.sendStatus(id, sftpStatusOpUnsupported, "Unsupported operation")
+	}
+	return err
+}
+
+func (s *sftpServer) getHandle(r *sftpReader) *sftpFileHandle {
+	handle, ok := s.handles[r.string()]
+	if !ok {
+		return nil
+	}
+	return handle
+}
+
+func (s *sftpServer) handleOpen(id uint32, r *sftpReader) error {
+	filename := r.string()
+	pflags := r.uint32()
+	r.attrs()
+	if r.err != nil {
+		return s.sendStatus(id, sftpStatusBadMessage, r.err.Error())
+	}
+
+	write := pflags&(sftpFlagWrite|sftpFlagAppend|sftpFlagCreate|sftpFlagTrunc) != 0
+	mode := "read"
+	if write {
+		mode = "write"
+	}
+	realPath, err := s.resolve(filename, mode)
+	if err != nil {
+		return s.sendError(id, err)
+	}
+
+	if insideHiddenFolder(realPath) {
+		return s.sendError(id, errSFTPPermissionDenied)
+	}
+
+	flags := os.O_RDONLY
+	if pflags&sftpFlagRead != 0 && write {
+		flags = os.O_RDWR
+	} else if write {
+		flags = os.O_WRONLY
+	}
+	if pflags&sftpFlagAppend != 0 {
+		flags |= os.O_APPEND
+	}
+	if pflags&sftpFlagCreate != 0 {
+		flags |= os.O_CREATE
+	}
+	if pflags&sftpFlagTrunc != 0 {
+		flags |= os.O_TRUNC
+	}
+	if pflags&sftpFlagExcl != 0 {
+		flags |= os.O_EXCL
+	}
+
+	newFile := !fileExists(realPath)
+	if newFile && pflags&sftpFlagCreate != 0 {
+		//Set ownership of this file to user
+		fsh, err := s.fs.userinfo.GetFileSystemHandlerFromRealPath(realPath)
+		if err == nil {
+			fsh.CreateFileRecord(realPath, s.fs.userinfo.Username)
+		}
+	}
+
+	file, err := os.OpenFile(realPath, flags, 0755)
+	if err != nil {
+		return s.sendError(id, err)
+	}
+
+	//Release the space used by the truncated content
+	if !newFile && pflags&sftpFlagTrunc != 0 {
+		s.fs.userinfo.StorageQuota.CalculateQuotaUsage()
+	}
+
+	s.fs.conn.SetDescription(filepath.Base(realPath))
+	return s.sendHandle(id, &sftpFileHandle{
+		file:     file,
+		realPath: realPath,
+		writable: write,
+	})
+}
+
+func (s *sftpServer) handleClose(id uint32, r *sftpReader) error {
+	handleID := r.string()
+	handle, ok := s.handles[handleID]
+	if !ok {
+		return s.sendStatus(id, sftpStatusFailure, "Invalid handle")
+	}
+	delete(s.handles, handleID)
+
+	var err error
+	if handle.file != nil {
+		err = handle.file.Close()
+	}
+	return s.sendError(id, err)
+}
+
+func (s *sftpServer) handleRead(id uint32, r *sftpReader) error {
+	handle := s.getHandle(r)
+	offset := r.uint64()
+	length := r.uint32()
+	if handle == nil || handle.isDir {
+		return s.sendStatus(id, sftpStatusFailure, "Invalid handle")
+	}
+
+	if length > sftpMaxRead {
+		length = sftpMaxRead
+	}
+
+	buf := make([]byte, length)
+	n, err := handle.file.ReadAt(buf, int64(offset))
+	if n == 0 && err != nil {
+		return s.sendError(id, err)
+	}
+
+	payload := appendUint32(make([]byte, 0, n+4), uint32(n))
+	payload = append(payload, buf[:n]...)
+	return s.send(sftpData, id, payload)
+}
+
+func (s *sftpServer) handleWrite(id uint32, r *sftpReader) error {
+	handle := s.getHandle(r)
+	offset := r.uint64()
+	data := r.bytes()
+	if r.err != nil {
+		return s.sendStatus(id, sftpStatusBadMessage, r.err.Error())
+	}
+	if handle == nil || handle.isDir || !handle.writable {
+		return s.sendStatus(id, sftpStatusFailure, "Invalid handle")
+	}
+
+	//Check the storage quota for the size growth of the file
+	info, err := handle.file.Stat()
+	if err != nil {
+		return s.sendError(id, err)
+	}
+	growth := int64(offset) + int64(len(data)) - info.Size()
+	if growth > 0 {
+		if !s.fs.userinfo.StorageQuota.HaveSpace(growth) {
+			return s.sendStatus(id, sftpStatusFailure, "Storage Quota Fulled")
+		}
+		s.fs.userinfo.StorageQuota.AllocateSpace(growth)
+	}
+
+	_, err = handle.file.WriteAt(data, int64(offset))
+	return s.sendError(id, err)
+}
+
+func (s *sftpServer) handleStat(id uint32, r *sftpReader) error {
+	filename := r.string()
+	realPath, err := s.resolve(filename, "read")
+	if err != nil {
+		return s.sendError(id, err)
+	}
+
+	info, err := os.Stat(realPath)
+	if err != nil {
+		return s.sendError(id, err)
+	}
+	return s.send(sftpAttrs, id, appendFileInfo(nil, info))
+}
+
+func (s *sftpServer) handleFstat(id uint32, r *sftpReader) error {
+	handle := s.getHandle(r)
+	if handle == nil {
+		return s.sendStatus(id, sftpStatusFailure, "Invalid handle")
+	}
+
+	info, err := os.Stat(handle.realPath)
+	if err != nil {
+		return s.sendError(id, err)
+	}
+	return s.send(sftpAttrs, id, appendFileInfo(nil, info))
+}
+
+//Apply the attributes. Only size and modification time are supported, permissions are ignored like FTP
+func (s *sftpServer) applyAttrs(realPath string, attrs *sftpAttributes) error {
+	if attrs.flags&sftpAttrSize != 0 {
+		info, err := os.Stat(realPath)
+		if err != nil {
+			return err
+		}
+		growth := int64(attrs.size) - info.Size()
+		if growth > 0 && !s.fs.userinfo.StorageQuota.HaveSpace(growth) {
+			return errors.New("Storage Quota Fulled")
+		}
+		err = os.Truncate(realPath, int64(attrs.size))
+		if err != nil {
+			return err
+		}
+	}
+
+	if attrs.flags&sftpAttrACModTime != 0 {
+		err := os.Chtimes(realPath, time.Unix(int64(attrs.atime), 0), time.Unix(int64(attrs.mtime), 0))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sftpServer) handleSetstat(id uint32, r *sftpReader) error {
+	filename := r.string()
+	attrs := r.attrs()
+	if r.err != nil {
+		return s.sendStatus(id, sftpStatusBadMessage, r.err.Error())
+	}
+
+	realPath, err := s.resolve(filename, "write")
+	if err != nil {
+		return s.sendError(id, err)
+	}
+	return s.sendError(id, s.applyAttrs(realPath, attrs))
+}
+
+func (s *sftpServer) handleFsetstat(id uint32, r *sftpReader) error {
+	handle := s.getHandle(r)
+	attrs := r.attrs()
+	if r.err != nil {
+		return s.sendStatus(id, sftpStatusBadMessage, r.err.Error())
+	}
+	if handle == nil {
+		return s.sendStatus(id, sftpStatusFailure, "Invalid handle")
+	}
+	if !handle.writable {
+		return s.sendError(id, errSFTPPermissionDenied)
+	}
+	return s.sendError(id, s.applyAttrs(handle.realPath, attrs))
+}
+
+func (s *sftpServer) handleOpendir(id uint32, r *sftpReader) error {
+	dirname := r.string()
+	realPath, err := s.resolve(dirname, "read")
+	if err != nil {
+		return s.sendError(id, err)
+	}
+
+	dir, err := os.Open(realPath)
+	if err != nil {
+		return s.sendError(id, err)
+	}
+	entries, err := dir.Readdir(-1)
+	dir.Close()
+	if err != nil {
+		return s.sendError(id, err)
+	}
+
+	//Hide the hidden folders, e.g. .trash and .cache
+	visibleEntries := []os.FileInfo{}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), ".") {
+			visibleEntries = append(visibleEntries, entry)
+		}
+	}
+	sort.Slice(visibleEntries, func(i, j int) bool {
+		return visibleEntries[i].Name() < visibleEntries[j].Name()
+	})
+
+	return s.sendHandle(id, &sftpFileHandle{
+		realPath: realPath,
+		entries:  visibleEntries,
+		isDir:    true,
+	})
+}
+
+func (s *sftpServer) handleReaddir(id uint32, r *sftpReader) error {
+	handle := s.getHandle(r)
+	if handle == nil || !handle.isDir {
+		return s.sendStatus(id, sftpStatusFailure, "Invalid handle")
+	}
+
+	if len(handle.entries) == 0 {
+		return s.sendStatus(id, sftpStatusEOF, "EOF")
+	}
+
+	batch := handle.entries
+	if len(batch) > sftpReaddirBatch {
+		batch = batch[:sftpReaddirBatch]
+	}
+	handle.entries = handle.entries[len(batch):]
+
+	names := []string{}
+	for _, entry := range batch {
+		names = append(names, entry.Name())
+	}
+	return s.sendName(id, names, batch)
+}
+
+func (s *sftpServer) handleRemove(id uint32, r *sftpReader) error {
+	filename := r.string()
+	virtualPath := cleanVirtualPath(filename)
+	if _, err := s.resolve(virtualPath, "write"); err != nil {
+		return s.sendError(id, err)
+	}
+
+	//Removed files are moved to trash like the FTP server
+	err := s.fs.Remove(virtualPath)
+	return s.sendError(id, err)
+}
+
+func (s *sftpServer) handleMkdir(id uint32, r *sftpReader) error {
+	dirname := r.string()
+	r.attrs()
+	realPath, err := s.resolve(dirname, "write")
+	if err != nil {
+		return s.sendError(id, err)
+	}
+	return s.sendError(id, os.Mkdir(realPath, 0755))
+}
+
+func (s *sftpServer) handleRealpath(id uint32, r *sftpReader) error {
+	filename := r.string()
+	virtualPath := cleanVirtualPath(filename)
+
+	var info os.FileInfo
+	if realPath, err := s.resolve(virtualPath, "read"); err == nil {
+		info, _ = os.Stat(realPath)
+	}
+	return s.sendName(id, []string{virtualPath}, []os.FileInfo{info})
+}
+
+func (s *sftpServer) handleRename(id uint32, r *sftpReader) error {
+	oldname := r.string()
+	newname := r.string()
+	if r.err != nil {
+		return s.sendStatus(id, sftpStatusBadMessage, r.err.Error())
+	}
+
+	oldpath, err := s.resolve(oldname, "write")
+	if err != nil {
+		return s.sendError(id, err)
+	}
+	newpath, err := s.resolve(newname, "write")
+	if err != nil {
+		return s.sendError(id, err)
+	}
+	if !fileExists(oldpath) {
+		return s.sendStatus(id, sftpStatusNoSuchFile, "No such file")
+	}
+	if fileExists(newpath) {
+		return s.sendStatus(id, sftpStatusFailure, "File already exists")
+	}
+	return s.sendError(id, os.Rename(oldpath, newpath))
+}
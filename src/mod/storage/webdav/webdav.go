@@ -19,17 +19,19 @@ import (
 	"sync"
 	"time"
 
+	"imuslab.com/arozos/mod/network/bandwidth"
 	"imuslab.com/arozos/mod/network/webdav"
 	"imuslab.com/arozos/mod/user"
 )
 
 type Server struct {
-	hostname    string            //The hostname of this devices
-	userHandler *user.UserHandler //The central userHandler
-	filesystems sync.Map          //The syncmap for storing opened file server
-	prefix      string            //The prefix to strip away from filepath
-	tlsMode     bool              //Bypass tls windows mode if enabled
-	Enabled     bool              //If the server is enabled. Set this to false for disable this service
+	hostname    string                //The hostname of this devices
+	userHandler *user.UserHandler     //The central userHandler
+	bandwidth   *bandwidth.Controller //The bandwidth limiter, transfers are not limited if nil
+	filesystems sync.Map              //The syncmap for storing opened file server
+	prefix      string                //The prefix to strip away from filepath
+	tlsMode     bool                  //Bypass tls windows mode if enabled
+	Enabled     bool                  //If the server is enabled. Set this to false for disable this service
 
 	//Windows related authentication using Web interface
 	readOnlyFileSystemHandler *webdav.Handler
@@ -46,7 +48,7 @@ type WindowClientInfo struct {
 }
 
 //NewServer create a new WebDAV server object required by arozos
-func NewServer(hostname string, prefix string, tmpdir string, tlsMode bool, userHandler *user.UserHandler) *Server {
+func NewServer(hostname string, prefix string, tmpdir string, tlsMode bool, userHandler *user.UserHandler, bandwidthController *bandwidth.Controller) *Server {
 	//Generate a default handler
 	os.MkdirAll(filepath.Join(tmpdir, "webdav"), 0777)
 
@@ -59,6 +61,7 @@ func NewServer(hostname string, prefix string, tmpdir string, tlsMode bool, user
 	return &Server{
 		hostname:                  hostname,
 		userHandler:               userHandler,
+		bandwidth:                 bandwidthController,
 		filesystems:               sync.Map{},
 		prefix:                    prefix,
 		tlsMode:                   tlsMode,
@@ -257,7 +260,7 @@ func (s *Server) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	fs := s.getFsFromRealRoot(realRoot, filepath.ToSlash(filepath.Join(s.prefix, reqRoot)))
 
 	//Serve the content
-	fs.ServeHTTP(w, r)
+	s.bandwidth.Serve(w, r, bandwidth.ProtocolWebDAV, userinfo.Username, fs.ServeHTTP)
 
 }
 
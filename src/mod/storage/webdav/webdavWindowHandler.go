@@ -17,6 +17,7 @@ import (
 	"time"
 
 	uuid "github.com/satori/go.uuid"
+	"imuslab.com/arozos/mod/network/bandwidth"
 )
 
 //Handle request from Windows File Explorer
@@ -130,7 +131,7 @@ func (s *Server) HandleWindowClientAccess(w http.ResponseWriter, r *http.Request
 
 			//Get and serve the file content
 			fs := s.getFsFromRealRoot(realRoot, filepath.ToSlash(filepath.Join(s.prefix, vroot)))
-			fs.ServeHTTP(w, r)
+			s.bandwidth.Serve(w, r, bandwidth.ProtocolWebDAV, userinfo.Username, fs.ServeHTTP)
 		}
 	}
 
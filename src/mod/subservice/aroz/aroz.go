@@ -0,0 +1,359 @@
+package aroz
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	ArozOS Subservice Client
+
+	This package is designed to be imported by subservices written in Go.
+	It only depends on the standard library.
+
+	When ArozOS proxy a request to the subservice, it attach a short-lived
+	identity assertion (JWT signed with ES256) in the aoidentity header. Use
+	VerifyRequest to check the signature and get the user information, and
+	the file functions to access the user's files on behalf of the user.
+
+	Example:
+		client, _ := aroz.NewClient(*rpt)
+		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			identity, err := client.VerifyRequest(r)
+			if err != nil {
+				http.Error(w, "401 - Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			files, _ := client.ListDir(identity, "user:/Desktop")
+		})
+*/
+
+const (
+	IdentityHeader = "aoidentity"             //Header that contains the signed identity assertion
+	JWKSPath       = "/.well-known/jwks.json" //Path of the public keys on the ArozOS host
+	Issuer         = "arozos"
+	clockSkew      = 30               //Allowed clock skew in seconds
+	keyRefreshWait = 30 * time.Second //Minimum interval between key refresh
+)
+
+//Virtual root accessible by the user
+type Vroot struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Permission string `json:"permission"` //readonly or readwrite
+}
+
+//Identity asserted by ArozOS
+type Identity struct {
+	Issuer    string   `json:"iss"`
+	Username  string   `json:"sub"`
+	Audience  string   `json:"aud"` //Module name of the subservice this assertion is issued for
+	IssuedAt  int64    `json:"iat"`
+	ExpiresAt int64    `json:"exp"`
+	TokenID   string   `json:"jti"`
+	Groups    []string `json:"groups"`
+	IsAdmin   bool     `json:"admin"`
+	Vroots    []Vroot  `json:"vroots"`
+
+	Token string `json:"-"` //The raw token, used for calling back into ArozOS
+}
+
+type Client struct {
+	BaseURL    string //ArozOS base URL, e.g. http://localhost:8080
+	Audience   string //If set, only assertions issued for this module name are accepted
+	HTTPClient *http.Client
+
+	keys        map[string]*ecdsa.PublicKey
+	lastRefresh time.Time
+	mutex       sync.Mutex
+}
+
+//Create a new client. The given URL can be the -rpt flag passed to the subservice or the ArozOS base URL
+func NewClient(arozURL string) (*Client, error) {
+	u, err := url.Parse(arozURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, errors.New("Invalid ArozOS URL")
+	}
+	return &Client{
+		BaseURL: u.Scheme + "://" + u.Host,
+		HTTPClient: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+		keys: map[string]*ecdsa.PublicKey{},
+	}, nil
+}
+
+//Verify the identity assertion attached to the proxied request
+func (c *Client) VerifyRequest(r *http.Request) (*Identity, error) {
+	token := r.Header.Get(IdentityHeader)
+	if token == "" {
+		return nil, errors.New("Identity assertion not found")
+	}
+	return c.VerifyToken(token)
+}
+
+//Verify the identity assertion, fetching the public keys from ArozOS if needed
+func (c *Client) VerifyToken(token string) (*Identity, error) {
+	keyID, err := tokenKeyID(token)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := c.getKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	identity, err := VerifyToken(token, key)
+	if err != nil {
+		return nil, err
+	}
+	if c.Audience != "" && identity.Audience != c.Audience {
+		return nil, errors.New("Identity assertion is not issued for this service")
+	}
+	return identity, nil
+}
+
+//Get the public key with the given ID. Keys are refetched if the ID is unknown (e.g. key rotated)
+func (c *Client) getKey(keyID string) (*ecdsa.PublicKey, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if key, ok := c.keys[keyID]; ok {
+		return key, nil
+	}
+	if time.Since(c.lastRefresh) < keyRefreshWait {
+		return nil, errors.New("Unknown signing key")
+	}
+
+	c.lastRefresh = time.Now()
+	keys, err := c.fetchKeys()
+	if err != nil {
+		return nil, err
+	}
+	c.keys = keys
+	if key, ok := c.keys[keyID]; ok {
+		return key, nil
+	}
+	return nil, errors.New("Unknown signing key")
+}
+
+func (c *Client) fetchKeys() (map[string]*ecdsa.PublicKey, error) {
+	resp, err := c.HTTPClient.Get(c.BaseURL + JWKSPath)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Unable to fetch signing keys: " + resp.Status)
+	}
+
+	keySet := JWKSet{}
+	err = json.NewDecoder(resp.Body).Decode(&keySet)
+	if err != nil {
+		return nil, err
+	}
+
+	results := map[string]*ecdsa.PublicKey{}
+	for _, jwk := range keySet.Keys {
+		key, err := jwk.PublicKey()
+		if err != nil {
+			continue
+		}
+		results[jwk.KeyID] = key
+	}
+	return results, nil
+}
+
+//Check if the user can read the given virtual path according to the assertion
+func (id *Identity) CanRead(vpath string) bool {
+	return id.vrootPermission(vpath) != ""
+}
+
+//Check if the user can write to the given virtual path according to the assertion
+func (id *Identity) CanWrite(vpath string) bool {
+	return id.vrootPermission(vpath) == "readwrite"
+}
+
+func (id *Identity) vrootPermission(vpath string) string {
+	pos := strings.Index(vpath, ":/")
+	if pos <= 0 {
+		return ""
+	}
+	for _, vroot := range id.Vroots {
+		if vroot.ID == vpath[:pos] {
+			return vroot.Permission
+		}
+	}
+	return ""
+}
+
+/*
+	JSON Web Token and Key Set
+*/
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	Y         string `json:"y"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+}
+
+type tokenHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+//Create the JWK of the given public key
+func NewJWK(key *ecdsa.PublicKey) JWK {
+	return JWK{
+		KeyType:   "EC",
+		Curve:     "P-256",
+		X:         base64.RawURLEncoding.EncodeToString(padBytes(key.X.Bytes(), 32)),
+		Y:         base64.RawURLEncoding.EncodeToString(padBytes(key.Y.Bytes(), 32)),
+		KeyID:     KeyID(key),
+		Algorithm: "ES256",
+		Use:       "sig",
+	}
+}
+
+func (k JWK) PublicKey() (*ecdsa.PublicKey, error) {
+	if k.KeyType != "EC" || k.Curve != "P-256" {
+		return nil, errors.New("Unsupported key type")
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	key := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}
+	if !key.Curve.IsOnCurve(key.X, key.Y) {
+		return nil, errors.New("Invalid public key")
+	}
+	return key, nil
+}
+
+//Key ID derived from the public key
+func KeyID(key *ecdsa.PublicKey) string {
+	hash := sha256.Sum256(elliptic.Marshal(key.Curve, key.X, key.Y))
+	return base64.RawURLEncoding.EncodeToString(hash[:12])
+}
+
+//Sign the identity with the given private key and return the token
+func SignToken(identity *Identity, key *ecdsa.PrivateKey) (string, error) {
+	header, _ := json.Marshal(tokenHeader{
+		Algorithm: "ES256",
+		Type:      "JWT",
+		KeyID:     KeyID(&key.PublicKey),
+	})
+	payload, err := json.Marshal(identity)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		return "", err
+	}
+	signature := append(padBytes(r.Bytes(), 32), padBytes(s.Bytes(), 32)...)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+//Verify the token with the given public key and return the identity
+func VerifyToken(token string, key *ecdsa.PublicKey) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Malformed identity assertion")
+	}
+
+	header := tokenHeader{}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerJSON, &header) != nil {
+		return nil, errors.New("Malformed identity assertion")
+	}
+	if header.Algorithm != "ES256" {
+		return nil, errors.New("Unsupported signing algorithm")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(signature) != 64 {
+		return nil, errors.New("Invalid signature")
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(key, hash[:], r, s) {
+		return nil, errors.New("Invalid signature")
+	}
+
+	identity := Identity{}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &identity) != nil {
+		return nil, errors.New("Malformed identity assertion")
+	}
+
+	now := time.Now().Unix()
+	if identity.Issuer != Issuer {
+		return nil, errors.New("Invalid issuer")
+	}
+	if identity.ExpiresAt+clockSkew < now {
+		return nil, errors.New("Identity assertion expired")
+	}
+	if identity.IssuedAt-clockSkew > now {
+		return nil, errors.New("Identity assertion not yet valid")
+	}
+	if identity.Username == "" {
+		return nil, errors.New("Invalid subject")
+	}
+
+	identity.Token = token
+	return &identity, nil
+}
+
+//Get the key ID from the token header without verifying it
+func tokenKeyID(token string) (string, error) {
+	pos := strings.Index(token, ".")
+	if pos <= 0 {
+		return "", errors.New("Malformed identity assertion")
+	}
+	header := tokenHeader{}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(token[:pos])
+	if err != nil || json.Unmarshal(headerJSON, &header) != nil {
+		return "", errors.New("Malformed identity assertion")
+	}
+	return header.KeyID, nil
+}
+
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
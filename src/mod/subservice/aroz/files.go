@@ -0,0 +1,115 @@
+package aroz
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+/*
+	File Access on behalf of the user
+
+	These functions call the file API of ArozOS with the identity assertion
+	of the user. The same permission of the user apply, so the subservice
+	can only access the virtual roots listed in the assertion.
+*/
+
+const FileAPIPath = "/api/subservice/fs/"
+
+type FileInfo struct {
+	Name    string
+	Vpath   string
+	IsDir   bool
+	Size    int64
+	ModTime int64
+}
+
+//List the files in the given directory, e.g. user:/Desktop
+func (c *Client) ListDir(identity *Identity, vpath string) ([]FileInfo, error) {
+	results := []FileInfo{}
+	err := c.callFileAPI(identity, http.MethodGet, "list", vpath, nil, &results)
+	return results, err
+}
+
+//Get the information of the given file or directory
+func (c *Client) Stat(identity *Identity, vpath string) (*FileInfo, error) {
+	result := FileInfo{}
+	err := c.callFileAPI(identity, http.MethodGet, "stat", vpath, nil, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+//Open the given file for reading. Caller must close the returned reader
+func (c *Client) ReadFile(identity *Identity, vpath string) (io.ReadCloser, error) {
+	resp, err := c.doFileRequest(identity, http.MethodGet, "read", vpath, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+//Write the content to the given file. Existing file will be overwritten
+func (c *Client) WriteFile(identity *Identity, vpath string, content io.Reader) error {
+	return c.callFileAPI(identity, http.MethodPost, "write", vpath, content, nil)
+}
+
+//Create the given directory and its parents
+func (c *Client) Mkdir(identity *Identity, vpath string) error {
+	return c.callFileAPI(identity, http.MethodPost, "mkdir", vpath, nil, nil)
+}
+
+//Remove the given file or directory
+func (c *Client) Remove(identity *Identity, vpath string) error {
+	return c.callFileAPI(identity, http.MethodPost, "remove", vpath, nil, nil)
+}
+
+func (c *Client) callFileAPI(identity *Identity, method string, opr string, vpath string, body io.Reader, result interface{}) error {
+	resp, err := c.doFileRequest(identity, method, opr, vpath, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if result == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (c *Client) doFileRequest(identity *Identity, method string, opr string, vpath string, body io.Reader) (*http.Response, error) {
+	if identity == nil || identity.Token == "" {
+		return nil, errors.New("Invalid identity")
+	}
+
+	req, err := http.NewRequest(method, c.BaseURL+FileAPIPath+opr+"?path="+url.QueryEscape(vpath), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+identity.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		errResp := struct {
+			Error string `json:"error"`
+		}{}
+		content, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(content, &errResp) == nil && errResp.Error != "" {
+			return nil, errors.New(errResp.Error)
+		}
+		return nil, errors.New("ArozOS returned " + resp.Status)
+	}
+	return resp, nil
+}
@@ -0,0 +1,16 @@
+// +build !linux
+
+package subservice
+
+import "errors"
+
+func applyResourceLimits(serviceDir string, pid int, cpuLimit int, memoryLimit int) error {
+	if cpuLimit <= 0 && memoryLimit <= 0 {
+		return nil
+	}
+	return errors.New("Resource limits are only supported on Linux")
+}
+
+func removeResourceLimits(serviceDir string) {
+
+}
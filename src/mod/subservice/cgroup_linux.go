@@ -0,0 +1,113 @@
+// +build linux
+
+package subservice
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+/*
+	Resource limits with Linux control groups
+
+	cgroup v2 (unified hierarchy) is used if available, otherwise it fall back
+	to the cpu and memory controllers of cgroup v1. Each subservice get its own
+	group under arozos/. Root permission is required to create the groups.
+*/
+
+const (
+	cgroupRoot      = "/sys/fs/cgroup"
+	cgroupParent    = "arozos"
+	cgroupCPUPeriod = 100000
+)
+
+func applyResourceLimits(serviceDir string, pid int, cpuLimit int, memoryLimit int) error {
+	if cpuLimit <= 0 && memoryLimit <= 0 {
+		return nil
+	}
+
+	if fileExists(filepath.Join(cgroupRoot, "cgroup.controllers")) {
+		return applyCgroupV2Limits(serviceDir, pid, cpuLimit, memoryLimit)
+	}
+	return applyCgroupV1Limits(serviceDir, pid, cpuLimit, memoryLimit)
+}
+
+func applyCgroupV2Limits(serviceDir string, pid int, cpuLimit int, memoryLimit int) error {
+	parent := filepath.Join(cgroupRoot, cgroupParent)
+	group := filepath.Join(parent, serviceDir)
+	err := os.MkdirAll(group, 0755)
+	if err != nil {
+		return errors.New("Unable to create cgroup: " + err.Error())
+	}
+
+	//Enable the cpu and memory controllers for the child groups
+	ioutil.WriteFile(filepath.Join(cgroupRoot, "cgroup.subtree_control"), []byte("+cpu +memory"), 0644)
+	ioutil.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte("+cpu +memory"), 0644)
+
+	cpuMax := "max " + strconv.Itoa(cgroupCPUPeriod)
+	if cpuLimit > 0 {
+		cpuMax = strconv.Itoa(cpuLimit*cgroupCPUPeriod/100) + " " + strconv.Itoa(cgroupCPUPeriod)
+	}
+	err = ioutil.WriteFile(filepath.Join(group, "cpu.max"), []byte(cpuMax), 0644)
+	if err != nil {
+		return errors.New("Unable to set CPU limit: " + err.Error())
+	}
+
+	memoryMax := "max"
+	if memoryLimit > 0 {
+		memoryMax = strconv.FormatInt(int64(memoryLimit)*1024*1024, 10)
+	}
+	err = ioutil.WriteFile(filepath.Join(group, "memory.max"), []byte(memoryMax), 0644)
+	if err != nil {
+		return errors.New("Unable to set memory limit: " + err.Error())
+	}
+
+	return ioutil.WriteFile(filepath.Join(group, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+}
+
+func applyCgroupV1Limits(serviceDir string, pid int, cpuLimit int, memoryLimit int) error {
+	if cpuLimit > 0 {
+		group := filepath.Join(cgroupRoot, "cpu", cgroupParent, serviceDir)
+		err := os.MkdirAll(group, 0755)
+		if err != nil {
+			return errors.New("Unable to create cpu cgroup: " + err.Error())
+		}
+		ioutil.WriteFile(filepath.Join(group, "cpu.cfs_period_us"), []byte(strconv.Itoa(cgroupCPUPeriod)), 0644)
+		err = ioutil.WriteFile(filepath.Join(group, "cpu.cfs_quota_us"), []byte(strconv.Itoa(cpuLimit*cgroupCPUPeriod/100)), 0644)
+		if err != nil {
+			return errors.New("Unable to set CPU limit: " + err.Error())
+		}
+		err = ioutil.WriteFile(filepath.Join(group, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	if memoryLimit > 0 {
+		group := filepath.Join(cgroupRoot, "memory", cgroupParent, serviceDir)
+		err := os.MkdirAll(group, 0755)
+		if err != nil {
+			return errors.New("Unable to create memory cgroup: " + err.Error())
+		}
+		err = ioutil.WriteFile(filepath.Join(group, "memory.limit_in_bytes"), []byte(strconv.FormatInt(int64(memoryLimit)*1024*1024, 10)), 0644)
+		if err != nil {
+			return errors.New("Unable to set memory limit: " + err.Error())
+		}
+		err = ioutil.WriteFile(filepath.Join(group, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Remove the cgroups of the subservice. Only empty groups can be removed
+func removeResourceLimits(serviceDir string) {
+	os.Remove(filepath.Join(cgroupRoot, cgroupParent, serviceDir))
+	os.Remove(filepath.Join(cgroupRoot, "cpu", cgroupParent, serviceDir))
+	os.Remove(filepath.Join(cgroupRoot, "memory", cgroupParent, serviceDir))
+}
@@ -0,0 +1,168 @@
+package subservice
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	Subservice Runtime Config
+
+	A subservice can declare its health check and default runtime settings
+	in supervisor.json inside its service directory. Admin can override them
+	from the settings interface, which will be stored in the system folder so
+	that it will not be overwritten when the subservice is upgraded.
+*/
+
+const (
+	serviceConfigFilename = "supervisor.json"
+	adminConfigFolder     = "./system/subservice/config/"
+)
+
+type HealthCheck struct {
+	Path      string //Path under the subservice port (e.g. /health) or full URL to probe
+	Interval  int    //Interval between checks in seconds
+	Timeout   int    //Timeout of each check in seconds
+	Threshold int    //Number of consecutive failures before the service is restarted
+	Grace     int    //Seconds to wait after startup before the first check
+}
+
+type ServiceConfig struct {
+	HealthCheck   HealthCheck
+	Env           map[string]string //Extra environment variables
+	WorkingDir    string            //Working directory, relative to the service directory if not absolute
+	CPULimit      int               //CPU limit in percentage of a single core, 0 for unlimited
+	MemoryLimit   int               //Memory limit in MB, 0 for unlimited
+	MaxRestarts   int               //Number of crashes allowed within RestartWindow before the service is marked as failed
+	RestartWindow int               //Crash loop detection window in seconds
+}
+
+func defaultServiceConfig() *ServiceConfig {
+	return &ServiceConfig{
+		HealthCheck: HealthCheck{
+			Interval:  30,
+			Timeout:   5,
+			Threshold: 3,
+			Grace:     10,
+		},
+		Env:           map[string]string{},
+		MaxRestarts:   5,
+		RestartWindow: 300,
+	}
+}
+
+//Load the config of the subservice. Admin config take priority over the one shipped with the service
+func loadServiceConfig(servicePath string) (*ServiceConfig, bool) {
+	config := defaultServiceConfig()
+	if fileExists(filepath.Join(servicePath, serviceConfigFilename)) {
+		content, err := ioutil.ReadFile(filepath.Join(servicePath, serviceConfigFilename))
+		if err == nil {
+			json.Unmarshal(content, config)
+		}
+	}
+
+	overridden := false
+	adminConfigPath := adminConfigFolder + filepath.Base(servicePath) + ".json"
+	if fileExists(adminConfigPath) {
+		content, err := ioutil.ReadFile(adminConfigPath)
+		if err == nil {
+			adminConfig := defaultServiceConfig()
+			if json.Unmarshal(content, adminConfig) == nil {
+				config = adminConfig
+				overridden = true
+			}
+		}
+	}
+
+	config.fillDefaults()
+	return config, overridden
+}
+
+//Save the admin config of the given subservice
+func saveServiceConfig(serviceDir string, config *ServiceConfig) error {
+	err := config.validate()
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(adminConfigFolder, 0755)
+	js, err := json.MarshalIndent(config, "", " ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(adminConfigFolder+serviceDir+".json", js, 0755)
+}
+
+//Remove the admin config and fall back to the one shipped with the service
+func resetServiceConfig(serviceDir string) error {
+	if !fileExists(adminConfigFolder + serviceDir + ".json") {
+		return nil
+	}
+	return os.Remove(adminConfigFolder + serviceDir + ".json")
+}
+
+func (c *ServiceConfig) fillDefaults() {
+	defaults := defaultServiceConfig()
+	if c.HealthCheck.Interval <= 0 {
+		c.HealthCheck.Interval = defaults.HealthCheck.Interval
+	}
+	if c.HealthCheck.Timeout <= 0 {
+		c.HealthCheck.Timeout = defaults.HealthCheck.Timeout
+	}
+	if c.HealthCheck.Threshold <= 0 {
+		c.HealthCheck.Threshold = defaults.HealthCheck.Threshold
+	}
+	if c.HealthCheck.Grace < 0 {
+		c.HealthCheck.Grace = 0
+	}
+	if c.Env == nil {
+		c.Env = map[string]string{}
+	}
+	if c.MaxRestarts <= 0 {
+		c.MaxRestarts = defaults.MaxRestarts
+	}
+	if c.RestartWindow <= 0 {
+		c.RestartWindow = defaults.RestartWindow
+	}
+}
+
+func (c *ServiceConfig) validate() error {
+	for key := range c.Env {
+		if key == "" || strings.ContainsAny(key, "= \t\r\n") {
+			return errors.New("Invalid environment variable name: " + key)
+		}
+	}
+	if c.CPULimit < 0 || c.MemoryLimit < 0 {
+		return errors.New("Resource limits cannot be negative")
+	}
+	if c.MemoryLimit > 0 && c.MemoryLimit < 8 {
+		return errors.New("Memory limit must be at least 8MB")
+	}
+	if c.HealthCheck.Path != "" && !strings.HasPrefix(c.HealthCheck.Path, "/") && !strings.HasPrefix(c.HealthCheck.Path, "http://") && !strings.HasPrefix(c.HealthCheck.Path, "https://") {
+		return errors.New("Health check must be a path starting with / or a full URL")
+	}
+	return nil
+}
+
+//Get the working directory of the subservice process
+func (c *ServiceConfig) workingDir(servicePath string) string {
+	if c.WorkingDir == "" {
+		return filepath.ToSlash(servicePath + "/")
+	}
+	if filepath.IsAbs(c.WorkingDir) {
+		return c.WorkingDir
+	}
+	return filepath.ToSlash(filepath.Join(servicePath, c.WorkingDir))
+}
+
+//Get the environment variables of the subservice process
+func (c *ServiceConfig) environ() []string {
+	env := os.Environ()
+	for key, value := range c.Env {
+		env = append(env, key+"="+value)
+	}
+	return env
+}
@@ -0,0 +1,62 @@
+package subservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"imuslab.com/arozos/mod/filesystem/fileapi"
+	"imuslab.com/arozos/mod/subservice/aroz"
+)
+
+/*
+	Subservice File API
+
+	Allow subservices to access the files on behalf of the user with the
+	identity assertion passed in the Authorization header as bearer token.
+	Only local processes can use this API. The file operations are served by
+	the shared virtual path file API.
+
+	/api/subservice/fs/list?path={vpath}	=> list the directory
+	/api/subservice/fs/stat?path={vpath}	=> get the file info
+	/api/subservice/fs/read?path={vpath}	=> read the file, support range request
+	/api/subservice/fs/write?path={vpath}	=> write the request body into the file (POST)
+	/api/subservice/fs/mkdir?path={vpath}	=> create the directory (POST)
+	/api/subservice/fs/remove?path={vpath}	=> remove the file or directory (POST)
+*/
+
+func (sr *SubServiceRouter) HandleFileAPI(w http.ResponseWriter, r *http.Request) {
+	if !isLoopbackRequest(r) {
+		http.NotFound(w, r)
+		return
+	}
+
+	//Authenticate the request with the identity assertion
+	if sr.identity == nil {
+		sendErrorStatus(w, http.StatusServiceUnavailable, "Identity assertion not available")
+		return
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer"))
+	identity, err := sr.identity.Verify(token)
+	if err != nil {
+		sendErrorStatus(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userinfo, err := sr.userHandler.GetUserInfoFromUsername(identity.Username)
+	if err != nil {
+		sendErrorStatus(w, http.StatusUnauthorized, "User not exists")
+		return
+	}
+
+	fileapi.ServeFileAPI(w, r, userinfo, strings.TrimPrefix(r.URL.Path, aroz.FileAPIPath))
+}
+
+//Send error response with the given HTTP status code
+func sendErrorStatus(w http.ResponseWriter, statusCode int, errMsg string) {
+	js, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{errMsg})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(js)
+}
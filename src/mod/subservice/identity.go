@@ -0,0 +1,139 @@
+package subservice
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"imuslab.com/arozos/mod/subservice/aroz"
+	user "imuslab.com/arozos/mod/user"
+)
+
+/*
+	Subservice Identity Assertion
+
+	Requests proxied to the subservices carry a short-lived JWT (ES256) in the
+	aoidentity header. It contains the username, permission groups, admin flag
+	and the virtual roots accessible by the user. The public key is exposed at
+	/.well-known/jwks.json for local processes so that the subservice can verify
+	the assertion without calling back into the auth agent.
+
+	See the aroz package for the client side implementation.
+*/
+
+const (
+	identityKeyPath  = "./system/subservice/identity.pem"
+	identityLifetime = 300 //Lifetime of the identity assertion in seconds
+)
+
+type IdentitySigner struct {
+	key *ecdsa.PrivateKey
+}
+
+//Load the signing key from the given path, or generate a new one if it does not exists
+func NewIdentitySigner(keyPath string) (*IdentitySigner, error) {
+	if fileExists(keyPath) {
+		content, err := ioutil.ReadFile(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(content)
+		if block == nil {
+			return nil, errors.New("Invalid identity signing key")
+		}
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return &IdentitySigner{key: key}, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	os.MkdirAll(filepath.Dir(keyPath), 0755)
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &IdentitySigner{key: key}, nil
+}
+
+//Create a signed identity assertion of the user for the given subservice module
+func (s *IdentitySigner) NewIdentityToken(u *user.User, audience string) (string, error) {
+	groups := []string{}
+	for _, pg := range u.PermissionGroup {
+		groups = append(groups, pg.Name)
+	}
+
+	vroots := []aroz.Vroot{}
+	for _, fsh := range u.GetAllAccessibleFileSystemHandler() {
+		permission := u.GetPathAccessPermission(fsh.UUID + ":/")
+		if permission != "readonly" && permission != "readwrite" {
+			continue
+		}
+		vroots = append(vroots, aroz.Vroot{
+			ID:         fsh.UUID,
+			Name:       fsh.Name,
+			Permission: permission,
+		})
+	}
+
+	now := time.Now().Unix()
+	return aroz.SignToken(&aroz.Identity{
+		Issuer:    aroz.Issuer,
+		Username:  u.Username,
+		Audience:  audience,
+		IssuedAt:  now,
+		ExpiresAt: now + identityLifetime,
+		TokenID:   uuid.NewV4().String(),
+		Groups:    groups,
+		IsAdmin:   u.IsAdmin(),
+		Vroots:    vroots,
+	}, s.key)
+}
+
+//Verify the identity assertion signed by this signer
+func (s *IdentitySigner) Verify(token string) (*aroz.Identity, error) {
+	return aroz.VerifyToken(token, &s.key.PublicKey)
+}
+
+//Serve the public key as JSON Web Key Set. Only local processes can access it
+func (s *IdentitySigner) HandleJWKS(w http.ResponseWriter, r *http.Request) {
+	if !isLoopbackRequest(r) {
+		http.NotFound(w, r)
+		return
+	}
+
+	js, _ := json.Marshal(aroz.JWKSet{
+		Keys: []aroz.JWK{aroz.NewJWK(&s.key.PublicKey)},
+	})
+	w.Header().Set("Cache-Control", "max-age=3600")
+	sendJSONResponse(w, string(js))
+}
+
+//Check if the request is coming from the same host
+func isLoopbackRequest(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,184 @@
+package subservice
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Subservice Log Capture
+
+	The stdout and stderr of the subservice are written into a log file under
+	the system folder. When the log file grows over the size limit, it is
+	rotated to {service}.log.1, {service}.log.2 ... up to logMaxBackups files.
+*/
+
+const (
+	logFolder     = "./system/subservice/logs/"
+	logMaxSize    = 1024 * 1024 //1MB per log file
+	logMaxBackups = 5
+	logMaxTail    = 256 * 1024 //Maximum number of bytes returned to the log viewer
+)
+
+type serviceLogger struct {
+	path  string
+	file  *os.File
+	size  int64
+	mutex sync.Mutex
+}
+
+func newServiceLogger(serviceDir string) (*serviceLogger, error) {
+	os.MkdirAll(logFolder, 0755)
+	logger := &serviceLogger{
+		path: filepath.ToSlash(filepath.Join(logFolder, serviceDir+".log")),
+	}
+	err := logger.open()
+	if err != nil {
+		return nil, err
+	}
+	return logger, nil
+}
+
+func (l *serviceLogger) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+func (l *serviceLogger) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		//Logger closed. Discard the output
+		return len(p), nil
+	}
+
+	if l.size+int64(len(p)) > logMaxSize && l.size > 0 {
+		l.rotate()
+	}
+
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+//Write a supervisor event into the log
+func (l *serviceLogger) Event(msg string) {
+	l.Write([]byte("[Supervisor] " + time.Now().Format("2006-01-02 15:04:05") + " " + msg + "\n"))
+}
+
+//Shift the log files by one. The oldest one will be removed
+func (l *serviceLogger) rotate() {
+	l.file.Close()
+	os.Remove(l.path + "." + strconv.Itoa(logMaxBackups))
+	for i := logMaxBackups - 1; i > 0; i-- {
+		os.Rename(l.path+"."+strconv.Itoa(i), l.path+"."+strconv.Itoa(i+1))
+	}
+	os.Rename(l.path, l.path+"."+strconv.Itoa(1))
+
+	l.file = nil
+	l.size = 0
+	l.open()
+}
+
+func (l *serviceLogger) Close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+type logFileInfo struct {
+	Index   int
+	Name    string
+	Size    int64
+	ModTime int64
+}
+
+//List the current and rotated log files of the subservice
+func listLogFiles(serviceDir string) []logFileInfo {
+	results := []logFileInfo{}
+	basePath := filepath.ToSlash(filepath.Join(logFolder, serviceDir+".log"))
+	for i := 0; i <= logMaxBackups; i++ {
+		thisPath := basePath
+		if i > 0 {
+			thisPath = basePath + "." + strconv.Itoa(i)
+		}
+		info, err := os.Stat(thisPath)
+		if err != nil {
+			continue
+		}
+		results = append(results, logFileInfo{
+			Index:   i,
+			Name:    filepath.Base(thisPath),
+			Size:    info.Size(),
+			ModTime: info.ModTime().Unix(),
+		})
+	}
+	return results
+}
+
+//Read the last n lines of the log file with the given rotation index
+func readLogTail(serviceDir string, index int, lines int) (string, error) {
+	if index < 0 || index > logMaxBackups {
+		return "", errors.New("Invalid log file index")
+	}
+	logPath := filepath.ToSlash(filepath.Join(logFolder, serviceDir+".log"))
+	if index > 0 {
+		logPath = logPath + "." + strconv.Itoa(index)
+	}
+	if !fileExists(logPath) {
+		return "", nil
+	}
+
+	f, err := os.Open(logPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	offset := info.Size() - logMaxTail
+	if offset < 0 {
+		offset = 0
+	}
+	f.Seek(offset, io.SeekStart)
+	buf := make([]byte, info.Size()-offset)
+	n, _ := io.ReadFull(f, buf)
+	content := string(buf[:n])
+	if offset > 0 {
+		//Drop the partial first line
+		if pos := strings.Index(content, "\n"); pos >= 0 {
+			content = content[pos+1:]
+		}
+	}
+
+	if lines > 0 {
+		allLines := strings.Split(strings.TrimRight(content, "\n"), "\n")
+		if len(allLines) > lines {
+			allLines = allLines[len(allLines)-lines:]
+		}
+		content = strings.Join(allLines, "\n")
+	}
+	return content, nil
+}
@@ -14,11 +14,12 @@ import (
 	"sort"
 	"strconv"
 	"strings"
-	"time"
+	"sync"
 
 	modules "imuslab.com/arozos/mod/modules"
 	"imuslab.com/arozos/mod/network/reverseproxy"
 	"imuslab.com/arozos/mod/network/websocketproxy"
+	"imuslab.com/arozos/mod/subservice/aroz"
 	user "imuslab.com/arozos/mod/user"
 )
 
@@ -37,7 +38,9 @@ type SubService struct {
 	RpEndpoint   string                     //Reverse Proxy Endpoint
 	ProxyHandler *reverseproxy.ReverseProxy //Reverse Proxy Object
 	Info         modules.ModuleInfo         //Module information for this subservice
-	Process      *exec.Cmd                  //The CMD runtime object of the process
+	Process      *exec.Cmd                  //The CMD runtime object of the first started process, restarted processes are tracked by the supervisor
+
+	supervisor *supervisor //Supervisor that restart the process when it crash
 }
 
 type SubServiceRouter struct {
@@ -48,9 +51,17 @@ type SubServiceRouter struct {
 	listenPort    int
 	userHandler   *user.UserHandler
 	moduleHandler *modules.ModuleHandler
+	identity      *IdentitySigner
+	mutex         sync.RWMutex //Guard RunningSubService against concurrent load, kill and listing
 }
 
 func NewSubServiceRouter(ReservePaths []string, basePort int, userHandler *user.UserHandler, moduleHandler *modules.ModuleHandler, parentPort int) *SubServiceRouter {
+	//Load the key for signing the identity assertions passed to subservices
+	identitySigner, err := NewIdentitySigner(identityKeyPath)
+	if err != nil {
+		log.Println("[Subservice] Unable to load identity signing key: " + err.Error())
+	}
+
 	return &SubServiceRouter{
 		ReservePaths:      ReservePaths,
 		RunningSubService: []SubService{},
@@ -59,6 +70,7 @@ func NewSubServiceRouter(ReservePaths []string, basePort int, userHandler *user.
 		listenPort:    parentPort,
 		userHandler:   userHandler,
 		moduleHandler: moduleHandler,
+		identity:      identitySigner,
 	}
 }
 
@@ -207,24 +219,20 @@ func (sr *SubServiceRouter) Launch(servicePath string, startupMode bool) error {
 			absolutePath, _ = filepath.Abs(initPath)
 		}
 
-		cmd := exec.Command(absolutePath)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Dir = filepath.ToSlash(servicePath + "/")
-
-		//Spawn a new go routine to run this subservice
-		go func(cmdObject *exec.Cmd) {
-			if err := cmd.Start(); err != nil {
-				panic(err)
-			}
-		}(cmd)
+		//Start the subservice under supervisor
+		serviceSupervisor, err := sr.startSupervisor(serviceRoot, servicePath, absolutePath, []string{}, 0)
+		if err != nil {
+			log.Println("[Subservice] Unable to start service " + serviceRoot + ": " + err.Error())
+			return errors.New("Unable to start service " + serviceRoot + ": " + err.Error())
+		}
 
 		//Create the servie object
 		thisSubService = SubService{
 			Path:       binaryExecPath,
 			Info:       thisModuleInfo,
 			ServiceDir: serviceRoot,
-			Process:    cmd,
+			Process:    serviceSupervisor.cmd,
+			supervisor: serviceSupervisor,
 		}
 		log.Println("[Subservice] Starting service " + serviceRoot + " in compatibility mode.")
 	} else {
@@ -268,18 +276,12 @@ func (sr *SubServiceRouter) Launch(servicePath string, startupMode bool) error {
 			servicePort = intToString(thisServicePort)
 		}
 
-		cmd := exec.Command(absolutePath, "-port", servicePort, "-rpt", "http://localhost:"+intToString(sr.listenPort)+"/api/ajgi/interface")
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Dir = filepath.ToSlash(servicePath + "/")
-		//log.Println(cmd.Dir,binaryExecPath)
-
-		//Spawn a new go routine to run this subservice
-		go func(cmdObject *exec.Cmd) {
-			if err := cmd.Start(); err != nil {
-				panic(err)
-			}
-		}(cmd)
+		//Start the subservice under supervisor
+		serviceSupervisor, err := sr.startSupervisor(serviceRoot, servicePath, absolutePath, []string{"-port", servicePort, "-rpt", "http://localhost:" + intToString(sr.listenPort) + "/api/ajgi/interface"}, thisServicePort)
+		if err != nil {
+			log.Println("[Subservice] Unable to start service " + serviceRoot + ": " + err.Error())
+			return errors.New("Unable to start service " + serviceRoot + ": " + err.Error())
+		}
 
 		//Create a subservice object for this subservice
 		thisSubService = SubService{
@@ -288,7 +290,8 @@ func (sr *SubServiceRouter) Launch(servicePath string, startupMode bool) error {
 			ServiceDir: serviceRoot,
 			RpEndpoint: rProxyEndpoint,
 			Info:       thisModuleInfo,
-			Process:    cmd,
+			Process:    serviceSupervisor.cmd,
+			supervisor: serviceSupervisor,
 		}
 
 		//Create a new proxy object
@@ -298,7 +301,9 @@ func (sr *SubServiceRouter) Launch(servicePath string, startupMode bool) error {
 	}
 
 	//Append this subservice into the list
+	sr.mutex.Lock()
 	sr.RunningSubService = append(sr.RunningSubService, thisSubService)
+	sr.mutex.Unlock()
 
 	//Append this module into the loaded module list
 	sr.moduleHandler.LoadedModule = append(sr.moduleHandler.LoadedModule, thisModuleInfo)
@@ -315,6 +320,7 @@ func (sr *SubServiceRouter) HandleListing(w http.ResponseWriter, r *http.Request
 		RpEndpoint string
 		ProcessID  int
 		Info       modules.ModuleInfo
+		Supervisor SupervisorStatus
 	}
 
 	type disabledServiceInfo struct {
@@ -324,14 +330,16 @@ func (sr *SubServiceRouter) HandleListing(w http.ResponseWriter, r *http.Request
 
 	enabled := []visableInfo{}
 	disabled := []disabledServiceInfo{}
-	for _, thisSubservice := range sr.RunningSubService {
+	for _, thisSubservice := range sr.listSubServices() {
+		thisStatus := thisSubservice.supervisor.Status()
 		enabled = append(enabled, visableInfo{
 			Port:       thisSubservice.Port,
 			Path:       thisSubservice.Path,
 			ServiceDir: thisSubservice.ServiceDir,
 			RpEndpoint: thisSubservice.RpEndpoint,
-			ProcessID:  thisSubservice.Process.Process.Pid,
+			ProcessID:  thisStatus.ProcessID,
 			Info:       thisSubservice.Info,
+			Supervisor: thisStatus,
 		})
 	}
 
@@ -402,6 +410,143 @@ func (sr *SubServiceRouter) HandleStartSubService(w http.ResponseWriter, r *http
 
 }
 
+//Restart a running subservice. Failed subservices will be started again
+func (sr *SubServiceRouter) HandleRestartSubService(w http.ResponseWriter, r *http.Request) {
+	userinfo, _ := sr.userHandler.GetUserInfoFromRequest(w, r)
+
+	//Require admin permission
+	if !userinfo.IsAdmin() {
+		sendErrorResponse(w, "Permission denied")
+		return
+	}
+
+	serviceDir, _ := mv(r, "serviceDir", true)
+	ss, err := sr.GetSubService(serviceDir)
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+
+	err = ss.supervisor.Restart()
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+	} else {
+		sendOK(w)
+	}
+}
+
+/*
+	Handle subservice log viewing
+
+	serviceDir	=> the subservice directory name
+	file		=> index of the log file, 0 for current and 1 to 5 for rotated logs
+	lines		=> number of lines from the end of the log file, default 200
+*/
+func (sr *SubServiceRouter) HandleServiceLogs(w http.ResponseWriter, r *http.Request) {
+	userinfo, _ := sr.userHandler.GetUserInfoFromRequest(w, r)
+
+	//Require admin permission
+	if !userinfo.IsAdmin() {
+		sendErrorResponse(w, "Permission denied")
+		return
+	}
+
+	serviceDir, _ := mv(r, "serviceDir", false)
+	if serviceDir == "" || serviceDir != filepath.Base(serviceDir) || !fileExists("subservice/"+serviceDir) {
+		sendErrorResponse(w, "Invalid subservice given")
+		return
+	}
+
+	fileIndex := 0
+	file, _ := mv(r, "file", false)
+	if file != "" {
+		fileIndex, _ = strconv.Atoi(file)
+	}
+	lineCount := 200
+	lines, _ := mv(r, "lines", false)
+	if lines != "" {
+		lineCount, _ = strconv.Atoi(lines)
+	}
+
+	content, err := readLogTail(serviceDir, fileIndex, lineCount)
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+
+	js, _ := json.Marshal(struct {
+		Files   []logFileInfo
+		Content string
+	}{
+		Files:   listLogFiles(serviceDir),
+		Content: content,
+	})
+	sendJSONResponse(w, string(js))
+}
+
+/*
+	Handle subservice runtime config
+
+	opr=get		=> get the current config of the subservice
+	opr=set		=> save the config as JSON (config), applied on next restart
+	opr=reset	=> remove the admin config and use the one shipped with the subservice
+*/
+func (sr *SubServiceRouter) HandleServiceConfig(w http.ResponseWriter, r *http.Request) {
+	userinfo, _ := sr.userHandler.GetUserInfoFromRequest(w, r)
+
+	//Require admin permission
+	if !userinfo.IsAdmin() {
+		sendErrorResponse(w, "Permission denied")
+		return
+	}
+
+	serviceDir, _ := mv(r, "serviceDir", true)
+	if serviceDir == "" || serviceDir != filepath.Base(serviceDir) || !fileExists("subservice/"+serviceDir) {
+		sendErrorResponse(w, "Invalid subservice given")
+		return
+	}
+
+	opr, _ := mv(r, "opr", true)
+	switch opr {
+	case "set":
+		configJSON, err := mv(r, "config", true)
+		if err != nil {
+			sendErrorResponse(w, "Invalid config given")
+			return
+		}
+		config := defaultServiceConfig()
+		err = json.Unmarshal([]byte(configJSON), config)
+		if err != nil {
+			sendErrorResponse(w, "Invalid config given")
+			return
+		}
+		config.fillDefaults()
+		err = saveServiceConfig(serviceDir, config)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+		sendOK(w)
+	case "reset":
+		err := resetServiceConfig(serviceDir)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+		sendOK(w)
+	default:
+		config, overridden := loadServiceConfig("subservice/" + serviceDir)
+		js, _ := json.Marshal(struct {
+			Config     *ServiceConfig
+			Overridden bool
+		}{
+			Config:     config,
+			Overridden: overridden,
+		})
+		sendJSONResponse(w, string(js))
+	}
+}
+
 //Check if the user has permission to access such proxy module
 func (sr *SubServiceRouter) CheckUserPermissionOnSubservice(ss *SubService, u *user.User) bool {
 	moduleName := ss.Info.Name
@@ -412,7 +557,7 @@ func (sr *SubServiceRouter) CheckUserPermissionOnSubservice(ss *SubService, u *u
 func (sr *SubServiceRouter) CheckIfReverseProxyPath(r *http.Request) (bool, *reverseproxy.ReverseProxy, string, *SubService) {
 	requestURL := r.URL.Path
 
-	for _, subservice := range sr.RunningSubService {
+	for _, subservice := range sr.listSubServices() {
 		thisServiceProxyEP := subservice.RpEndpoint
 		if thisServiceProxyEP != "" {
 			if len(requestURL) > len(thisServiceProxyEP)+1 && requestURL[1:len(thisServiceProxyEP)+1] == thisServiceProxyEP {
@@ -438,45 +583,22 @@ func (sr *SubServiceRouter) CheckIfReverseProxyPath(r *http.Request) (bool, *rev
 }
 
 func (sr *SubServiceRouter) Close() {
-	//Handle shutdown of subprocesses. Kill all of them
-	for _, subservice := range sr.RunningSubService {
-		cmd := subservice.Process
-		if cmd != nil {
-			if runtime.GOOS == "windows" {
-				//Force kill with the power of CMD
-				kill := exec.Command("TASKKILL", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid))
-				//kill.Stderr = os.Stderr
-				//kill.Stdout = os.Stdout
-				kill.Run()
-			} else {
-				//Send sigkill to process
-				cmd.Process.Kill()
-			}
-		}
+	//Handle shutdown of subprocesses. Stop the supervisors and kill all of them
+	for _, subservice := range sr.listSubServices() {
+		subservice.supervisor.Stop()
 	}
 }
 
 func (sr *SubServiceRouter) KillSubService(serviceDir string) error {
 	//Remove them from the system
-	ssi := -1
 	moduleName := ""
-	for i, ss := range sr.RunningSubService {
+	for _, ss := range sr.listSubServices() {
 		if ss.ServiceDir == serviceDir {
-			ssi = i
 			moduleName = ss.Info.Name
-			//Kill the module cmd
-			cmd := ss.Process
-			if cmd != nil {
-				if runtime.GOOS == "windows" {
-					//Force kill with the power of CMD
-					kill := exec.Command("TASKKILL", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid))
-					kill.Run()
-				} else {
-					err := cmd.Process.Kill()
-					if err != nil {
-						return err
-					}
-				}
+			//Stop the supervisor and kill the module cmd
+			err := ss.supervisor.Stop()
+			if err != nil {
+				return err
 			}
 
 			//Write a suspended file into the module
@@ -485,11 +607,15 @@ func (sr *SubServiceRouter) KillSubService(serviceDir string) error {
 	}
 
 	//Pop this service from running Subservice
-	if ssi != -1 {
-		i := ssi
-		copy(sr.RunningSubService[i:], sr.RunningSubService[i+1:])
-		sr.RunningSubService = sr.RunningSubService[:len(sr.RunningSubService)-1]
+	sr.mutex.Lock()
+	for i, ss := range sr.RunningSubService {
+		if ss.ServiceDir == serviceDir {
+			copy(sr.RunningSubService[i:], sr.RunningSubService[i+1:])
+			sr.RunningSubService = sr.RunningSubService[:len(sr.RunningSubService)-1]
+			break
+		}
 	}
+	sr.mutex.Unlock()
 
 	//Pop the related module from the loadedModule list
 	mi := -1
@@ -521,9 +647,11 @@ func (sr *SubServiceRouter) StartSubService(serviceDir string) error {
 		return sr.moduleHandler.LoadedModule[i].Name < sr.moduleHandler.LoadedModule[j].Name
 	})
 
+	sr.mutex.Lock()
 	sort.Slice(sr.RunningSubService, func(i, j int) bool {
 		return sr.RunningSubService[i].Info.Name < sr.RunningSubService[j].Info.Name
 	})
+	sr.mutex.Unlock()
 
 	return nil
 }
@@ -531,7 +659,7 @@ func (sr *SubServiceRouter) StartSubService(serviceDir string) error {
 //Get a list of subservice roots in realpath
 func (sr *SubServiceRouter) GetSubserviceRoot() []string {
 	subserviceRoots := []string{}
-	for _, subService := range sr.RunningSubService {
+	for _, subService := range sr.listSubServices() {
 		subserviceRoots = append(subserviceRoots, subService.Path)
 	}
 
@@ -548,7 +676,7 @@ func (sr *SubServiceRouter) GetNextUsablePort() int {
 }
 
 func (sr *SubServiceRouter) CheckIfPortInUse(port int) bool {
-	for _, service := range sr.RunningSubService {
+	for _, service := range sr.listSubServices() {
 		if service.Port == port {
 			return true
 		}
@@ -568,6 +696,13 @@ func (sr *SubServiceRouter) HandleRoutingRequest(w http.ResponseWriter, r *http.
 	token, _ := sr.userHandler.GetAuthAgent().NewTokenFromRequest(w, r)
 	r.Header.Set("aouser", u.Username)
 	r.Header.Set("aotoken", token)
+	r.Header.Del(aroz.IdentityHeader)
+	if sr.identity != nil {
+		identity, err := sr.identity.NewIdentityToken(u, subserviceObject.Info.Name)
+		if err == nil {
+			r.Header.Set(aroz.IdentityHeader, identity)
+		}
+	}
 	r.Header.Set("X-Forwarded-Host", r.Host)
 	if r.Header["Upgrade"] != nil && r.Header["Upgrade"][0] == "websocket" {
 		//Handle WebSocket request. Forward the custom Upgrade header and rewrite origin
@@ -592,12 +727,49 @@ func (sr *SubServiceRouter) HandleRoutingRequest(w http.ResponseWriter, r *http.
 
 //Handle fail start over when the remote target is not responding
 func (sr *SubServiceRouter) RestartSubService(ss *SubService) {
-	go func(ss *SubService) {
-		//Kill the original subservice
-		sr.KillSubService(ss.ServiceDir)
-		log.Println("RESTARTING SUBSERVICE " + ss.Info.Name + " IN 10 SECOUNDS")
-		time.Sleep(10000 * time.Millisecond)
-		sr.StartSubService(ss.ServiceDir)
-		log.Println("SUBSERVICE " + ss.Info.Name + " RESTARTED")
-	}(ss)
+	if ss.supervisor != nil {
+		//Health check the subservice or restart it with backoff
+		ss.supervisor.ProxyError()
+	}
+}
+
+//Start the subservice process under a new supervisor
+func (sr *SubServiceRouter) startSupervisor(serviceDir string, servicePath string, execPath string, args []string, port int) (*supervisor, error) {
+	serviceSupervisor, err := newSupervisor(serviceDir, servicePath, execPath, args, port)
+	if err != nil {
+		return nil, err
+	}
+	err = serviceSupervisor.Start()
+	if err != nil {
+		return nil, err
+	}
+	return serviceSupervisor, nil
+}
+
+//Serve the public key for verifying the identity assertions
+func (sr *SubServiceRouter) HandleJWKS(w http.ResponseWriter, r *http.Request) {
+	if sr.identity == nil {
+		http.NotFound(w, r)
+		return
+	}
+	sr.identity.HandleJWKS(w, r)
+}
+
+//Get the running subservice by its service directory
+func (sr *SubServiceRouter) GetSubService(serviceDir string) (*SubService, error) {
+	for _, ss := range sr.listSubServices() {
+		if ss.ServiceDir == serviceDir {
+			return &ss, nil
+		}
+	}
+	return nil, errors.New("Subservice not running")
+}
+
+//Get a snapshot of the running subservices. Supervisor methods must not be called while holding the mutex
+func (sr *SubServiceRouter) listSubServices() []SubService {
+	sr.mutex.RLock()
+	defer sr.mutex.RUnlock()
+	results := make([]SubService, len(sr.RunningSubService))
+	copy(results, sr.RunningSubService)
+	return results
 }
@@ -0,0 +1,451 @@
+package subservice
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Subservice Supervisor
+
+	Each subservice process is watched by a supervisor. If the process exit
+	without being stopped by the system, it is restarted with exponential backoff.
+	If it crashed more than MaxRestarts times within RestartWindow, the
+	service is marked as failed and will not be restarted until admin restart
+	it manually.
+
+	If the service declared a health check, it is probed periodically and the
+	process is restarted after Threshold consecutive failures.
+*/
+
+const (
+	StatusRunning    = "running"
+	StatusRestarting = "restarting"
+	StatusFailed     = "failed"
+	StatusStopped    = "stopped"
+
+	HealthUnknown   = "unknown"
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+
+	backoffBase        = 1 * time.Second
+	backoffMax         = 60 * time.Second
+	proxyErrorCooldown = 10 * time.Second //Proxy errors shortly after startup are ignored
+)
+
+type supervisor struct {
+	serviceDir  string
+	servicePath string
+	execPath    string
+	args        []string
+	port        int
+	config      *ServiceConfig
+	overridden  bool
+	logger      *serviceLogger
+
+	cmd            *exec.Cmd
+	status         string
+	health         string
+	healthFailures int
+	crashes        []time.Time
+	restartCount   int
+	lastExit       string
+	startTime      time.Time
+	stopped        bool
+	restartNow     bool //The process is killed for an immediate restart
+	checkNow       chan bool
+	stop           chan bool
+	mutex          sync.Mutex
+}
+
+type SupervisorStatus struct {
+	Status           string
+	Health           string
+	ProcessID        int
+	StartTime        int64
+	Restarts         int
+	RecentCrashes    int
+	LastExit         string
+	HealthCheck      bool
+	ConfigOverridden bool
+}
+
+func newSupervisor(serviceDir string, servicePath string, execPath string, args []string, port int) (*supervisor, error) {
+	logger, err := newServiceLogger(serviceDir)
+	if err != nil {
+		return nil, err
+	}
+	config, overridden := loadServiceConfig(servicePath)
+	return &supervisor{
+		serviceDir:  serviceDir,
+		servicePath: servicePath,
+		execPath:    execPath,
+		args:        args,
+		port:        port,
+		config:      config,
+		overridden:  overridden,
+		logger:      logger,
+		status:      StatusStopped,
+		health:      HealthUnknown,
+		crashes:     []time.Time{},
+		checkNow:    make(chan bool, 1),
+		stop:        make(chan bool),
+	}, nil
+}
+
+//Start the subservice process and begin supervising it
+func (sv *supervisor) Start() error {
+	sv.mutex.Lock()
+	err := sv.spawn()
+	sv.mutex.Unlock()
+	if err != nil {
+		sv.logger.Close()
+		return err
+	}
+
+	go sv.healthCheckLoop()
+	return nil
+}
+
+//Spawn a new process. Caller must hold the mutex
+func (sv *supervisor) spawn() error {
+	workingDir := sv.config.workingDir(sv.servicePath)
+	if !fileExists(workingDir) {
+		sv.logger.Event("Working directory " + workingDir + " not exists")
+		return errors.New("Working directory not exists: " + workingDir)
+	}
+
+	cmd := exec.Command(sv.execPath, sv.args...)
+	cmd.Dir = workingDir
+	cmd.Env = sv.config.environ()
+	cmd.Stdout = io.MultiWriter(os.Stdout, sv.logger)
+	cmd.Stderr = io.MultiWriter(os.Stderr, sv.logger)
+	err := cmd.Start()
+	if err != nil {
+		sv.logger.Event("Failed to start process: " + err.Error())
+		return err
+	}
+
+	//Child processes forked before this point will not be limited
+	err = applyResourceLimits(sv.serviceDir, cmd.Process.Pid, sv.config.CPULimit, sv.config.MemoryLimit)
+	if err != nil {
+		sv.logger.Event("Resource limits not applied: " + err.Error())
+		log.Println("[Subservice] Resource limits not applied to " + sv.serviceDir + ": " + err.Error())
+	}
+
+	sv.cmd = cmd
+	sv.status = StatusRunning
+	sv.health = HealthUnknown
+	sv.healthFailures = 0
+	sv.startTime = time.Now()
+	sv.logger.Event("Process started with PID " + strconv.Itoa(cmd.Process.Pid))
+
+	go sv.watch(cmd)
+	return nil
+}
+
+//Wait for the process to exit and decide if it should be restarted
+func (sv *supervisor) watch(cmd *exec.Cmd) {
+	err := cmd.Wait()
+	exitMessage := "exit status 0"
+	if err != nil {
+		exitMessage = err.Error()
+	}
+
+	sv.mutex.Lock()
+	if sv.cmd != cmd {
+		sv.mutex.Unlock()
+		return
+	}
+	sv.lastExit = exitMessage
+	removeResourceLimits(sv.serviceDir)
+
+	if sv.stopped {
+		sv.status = StatusStopped
+		sv.health = HealthUnknown
+		sv.logger.Event("Process stopped (" + exitMessage + ")")
+		sv.mutex.Unlock()
+		sv.logger.Close()
+		return
+	}
+
+	if sv.restartNow {
+		sv.restartNow = false
+		sv.restartCount++
+		sv.logger.Event("Process restarted by admin (" + exitMessage + ")")
+		if sv.spawn() != nil {
+			sv.status = StatusFailed
+		}
+		sv.mutex.Unlock()
+		return
+	}
+
+	//The process crashed
+	now := time.Now()
+	sv.crashes = append(sv.recentCrashes(now), now)
+	if len(sv.crashes) > sv.config.MaxRestarts {
+		sv.status = StatusFailed
+		sv.logger.Event("Process exited unexpectedly (" + exitMessage + "). Crashed " + strconv.Itoa(len(sv.crashes)) + " times within " + strconv.Itoa(sv.config.RestartWindow) + " seconds, marked as failed")
+		log.Println("[Subservice] " + sv.serviceDir + " is crash looping and marked as failed")
+		sv.mutex.Unlock()
+		return
+	}
+
+	delay := restartBackoff(len(sv.crashes))
+	sv.status = StatusRestarting
+	sv.logger.Event("Process exited unexpectedly (" + exitMessage + "). Restarting in " + delay.String())
+	log.Println("[Subservice] " + sv.serviceDir + " exited unexpectedly (" + exitMessage + "). Restarting in " + delay.String())
+	sv.mutex.Unlock()
+
+	select {
+	case <-time.After(delay):
+	case <-sv.stop:
+		return
+	}
+
+	sv.mutex.Lock()
+	defer sv.mutex.Unlock()
+	if sv.stopped || sv.status != StatusRestarting || sv.cmd != cmd {
+		//Stopped or restarted manually during the backoff
+		return
+	}
+	sv.restartCount++
+	if sv.spawn() != nil {
+		sv.status = StatusFailed
+	}
+}
+
+//Get the crashes within the restart window. Caller must hold the mutex
+func (sv *supervisor) recentCrashes(now time.Time) []time.Time {
+	results := []time.Time{}
+	window := time.Duration(sv.config.RestartWindow) * time.Second
+	for _, crashTime := range sv.crashes {
+		if now.Sub(crashTime) < window {
+			results = append(results, crashTime)
+		}
+	}
+	return results
+}
+
+//Delay before the n-th restart, doubled on each consecutive crash
+func restartBackoff(n int) time.Duration {
+	delay := backoffBase
+	for i := 1; i < n && delay < backoffMax; i++ {
+		delay = delay * 2
+	}
+	if delay > backoffMax {
+		delay = backoffMax
+	}
+	return delay
+}
+
+//Restart the subservice manually. This also reload the config and clear the failed state
+func (sv *supervisor) Restart() error {
+	sv.mutex.Lock()
+	defer sv.mutex.Unlock()
+	if sv.stopped {
+		return errors.New("Subservice already stopped")
+	}
+
+	sv.config, sv.overridden = loadServiceConfig(sv.servicePath)
+	sv.crashes = []time.Time{}
+	if sv.status == StatusRunning {
+		//Kill the process and let the watcher start it again
+		sv.restartNow = true
+		return killProcess(sv.cmd)
+	}
+
+	sv.restartCount++
+	sv.logger.Event("Process restarted by admin")
+	err := sv.spawn()
+	if err != nil {
+		sv.status = StatusFailed
+		return err
+	}
+	return nil
+}
+
+//Stop supervising and kill the subservice process
+func (sv *supervisor) Stop() error {
+	sv.mutex.Lock()
+	if sv.stopped {
+		sv.mutex.Unlock()
+		return nil
+	}
+	sv.stopped = true
+	close(sv.stop)
+	running := sv.status == StatusRunning
+	cmd := sv.cmd
+	if !running {
+		sv.status = StatusStopped
+	}
+	sv.mutex.Unlock()
+
+	if !running {
+		sv.logger.Close()
+		return nil
+	}
+
+	//The watcher will close the logger after the process exit
+	return killProcess(cmd)
+}
+
+//Called when the reverse proxy failed to reach the subservice
+func (sv *supervisor) ProxyError() {
+	sv.mutex.Lock()
+	defer sv.mutex.Unlock()
+	if sv.status != StatusRunning || time.Since(sv.startTime) < proxyErrorCooldown {
+		return
+	}
+
+	if sv.healthCheckURL() != "" {
+		//Let the health check decide if the service should be restarted
+		select {
+		case sv.checkNow <- true:
+		default:
+		}
+		return
+	}
+
+	sv.logger.Event("Subservice is not responding to proxy requests. Restarting")
+	sv.startTime = time.Now()
+	killProcess(sv.cmd)
+}
+
+func (sv *supervisor) Status() SupervisorStatus {
+	sv.mutex.Lock()
+	defer sv.mutex.Unlock()
+	pid := 0
+	if sv.cmd != nil && sv.cmd.Process != nil && sv.status == StatusRunning {
+		pid = sv.cmd.Process.Pid
+	}
+	return SupervisorStatus{
+		Status:           sv.status,
+		Health:           sv.health,
+		ProcessID:        pid,
+		StartTime:        sv.startTime.Unix(),
+		Restarts:         sv.restartCount,
+		RecentCrashes:    len(sv.recentCrashes(time.Now())),
+		LastExit:         sv.lastExit,
+		HealthCheck:      sv.healthCheckURL() != "",
+		ConfigOverridden: sv.overridden,
+	}
+}
+
+/*
+	Health Check
+*/
+
+//Get the URL to probe. Caller must hold the mutex
+func (sv *supervisor) healthCheckURL() string {
+	path := sv.config.HealthCheck.Path
+	if path == "" {
+		return ""
+	}
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		return path
+	}
+	if sv.port == 0 {
+		//No proxy services do not have an assigned port
+		return ""
+	}
+	return "http://localhost:" + strconv.Itoa(sv.port) + path
+}
+
+func (sv *supervisor) healthCheckLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastCheck := time.Now()
+	for {
+		select {
+		case <-sv.stop:
+			return
+		case <-sv.checkNow:
+			sv.runHealthCheck()
+			lastCheck = time.Now()
+		case <-ticker.C:
+			sv.mutex.Lock()
+			interval := time.Duration(sv.config.HealthCheck.Interval) * time.Second
+			sv.mutex.Unlock()
+			if time.Since(lastCheck) < interval {
+				continue
+			}
+			sv.runHealthCheck()
+			lastCheck = time.Now()
+		}
+	}
+}
+
+func (sv *supervisor) runHealthCheck() {
+	sv.mutex.Lock()
+	checkURL := sv.healthCheckURL()
+	grace := time.Duration(sv.config.HealthCheck.Grace) * time.Second
+	if checkURL == "" || sv.status != StatusRunning || time.Since(sv.startTime) < grace {
+		sv.mutex.Unlock()
+		return
+	}
+	cmd := sv.cmd
+	client := http.Client{
+		Timeout: time.Duration(sv.config.HealthCheck.Timeout) * time.Second,
+	}
+	sv.mutex.Unlock()
+
+	failReason := ""
+	resp, err := client.Get(checkURL)
+	if err != nil {
+		failReason = err.Error()
+	} else {
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			failReason = "status code " + strconv.Itoa(resp.StatusCode)
+		}
+	}
+
+	sv.mutex.Lock()
+	defer sv.mutex.Unlock()
+	if sv.cmd != cmd || sv.status != StatusRunning {
+		//Process restarted during the check
+		return
+	}
+
+	if failReason == "" {
+		if sv.health == HealthUnhealthy {
+			sv.logger.Event("Health check recovered")
+		}
+		sv.health = HealthHealthy
+		sv.healthFailures = 0
+		return
+	}
+
+	sv.health = HealthUnhealthy
+	sv.healthFailures++
+	sv.logger.Event("Health check failed (" + strconv.Itoa(sv.healthFailures) + "/" + strconv.Itoa(sv.config.HealthCheck.Threshold) + "): " + failReason)
+	if sv.healthFailures >= sv.config.HealthCheck.Threshold {
+		sv.logger.Event("Health check failure threshold reached. Restarting")
+		log.Println("[Subservice] " + sv.serviceDir + " failed its health check. Restarting")
+		sv.healthFailures = 0
+		killProcess(cmd)
+	}
+}
+
+//Kill the process of the subservice
+func killProcess(cmd *exec.Cmd) error {
+	if cmd == nil || cmd.Process == nil {
+		return nil
+	}
+	if runtime.GOOS == "windows" {
+		//Force kill with the power of CMD
+		kill := exec.Command("TASKKILL", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid))
+		return kill.Run()
+	}
+	return cmd.Process.Kill()
+}
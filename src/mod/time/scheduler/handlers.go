@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/tidwall/pretty"
+	"imuslab.com/arozos/mod/agi"
 )
 
 //List all the jobs related to the given user
@@ -137,6 +138,24 @@ func (a *Scheduler) HandleAddJob(w http.ResponseWriter, r *http.Request) {
 		baseUnixTime = int64(baseTimeInt)
 	}
 
+	//Optional execution limit of this job. Fields not given use the system default.
+	//Only admin can raise the limit above the system default
+	var executionLimit *agi.ExecutionLimit
+	_, timeoutErr := mv(r, "timeout", true)
+	_, maxhttpErr := mv(r, "maxhttp", true)
+	_, maxwriteErr := mv(r, "maxwrite", true)
+	if timeoutErr == nil || maxhttpErr == nil || maxwriteErr == nil {
+		limit, err := agi.ParseExecutionLimit(r, a.gateway.Option.DefaultLimit)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+		if !userinfo.IsAdmin() {
+			limit = limit.Within(a.gateway.Option.DefaultLimit)
+		}
+		executionLimit = &limit
+	}
+
 	//Create a new job
 	newJob := Job{
 		Name:              taskName,
@@ -146,6 +165,7 @@ func (a *Scheduler) HandleAddJob(w http.ResponseWriter, r *http.Request) {
 		ExecutionInterval: int64(interval),
 		BaseTime:          baseUnixTime,
 		ScriptFile:        realScriptPath,
+		ExecutionLimit:    executionLimit,
 	}
 
 	//Write current job lists to file
@@ -34,6 +34,7 @@ type Job struct {
 	JobType           string                 //Job type, accept {file/function}. If not set default to file
 	ScriptFile        string                 //The script file being called. Can be an agi script (.agi / .js) or shell script (.bat or .sh)
 	ScriptFunc        func() (string, error) `json:"-"` //The target function to execute
+	ExecutionLimit    *agi.ExecutionLimit    //Execution limit of the AGI script, nil to use the system default
 }
 
 type Scheduler struct {
@@ -165,7 +166,7 @@ func (a *Scheduler) createTicker(duration time.Duration) chan bool {
 									}
 
 									//Run the script with this user scope
-									resp, err := a.gateway.ExecuteAGIScriptAsUser(thisJob.ScriptFile, userinfo)
+									resp, err := a.gateway.ExecuteAGIScriptAsUser(thisJob.ScriptFile, userinfo, thisJob.ExecutionLimit)
 									if err != nil {
 										cronlog("[ERROR] " + thisJob.Name + " " + err.Error())
 									} else {
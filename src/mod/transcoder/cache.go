@@ -0,0 +1,137 @@
+package transcoder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+	Transcode Cache
+
+	Each transcoded video is stored in its own folder (named by the cache key)
+	inside the cache folder. When the total size exceed the limit, the least
+	recently accessed videos are removed first
+*/
+
+type lruCache struct {
+	folder     string
+	maxSize    int64
+	lastAccess map[string]int64
+	mutex      sync.Mutex
+}
+
+func newLRUCache(folder string, maxSize int64) *lruCache {
+	return &lruCache{
+		folder:     folder,
+		maxSize:    maxSize,
+		lastAccess: map[string]int64{},
+	}
+}
+
+//Update the last access time of the given key
+func (c *lruCache) Touch(key string) {
+	c.mutex.Lock()
+	c.lastAccess[key] = time.Now().UnixNano()
+	c.mutex.Unlock()
+}
+
+//Get the total size of the given folder
+func getFolderSize(folder string) int64 {
+	var size int64
+	filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+//Get the total size of the cache folder in bytes
+func (c *lruCache) Size() int64 {
+	return getFolderSize(c.folder)
+}
+
+//Remove the least recently used items until the cache is smaller than the limit. Return the evicted keys
+func (c *lruCache) Evict(excludeKeys []string) []string {
+	evicted := []string{}
+	if c.maxSize <= 0 {
+		return evicted
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	type cacheItem struct {
+		key        string
+		size       int64
+		lastAccess int64
+	}
+
+	items := []*cacheItem{}
+	var totalSize int64
+	folders, _ := ioutil.ReadDir(c.folder)
+	for _, folder := range folders {
+		if !folder.IsDir() {
+			continue
+		}
+
+		thisItem := cacheItem{
+			key:  folder.Name(),
+			size: getFolderSize(filepath.Join(c.folder, folder.Name())),
+		}
+
+		if lastAccess, ok := c.lastAccess[thisItem.key]; ok {
+			thisItem.lastAccess = lastAccess
+		} else {
+			//Not accessed since startup, use the modification time of the folder
+			thisItem.lastAccess = folder.ModTime().UnixNano()
+		}
+
+		totalSize += thisItem.size
+		items = append(items, &thisItem)
+	}
+
+	if totalSize <= c.maxSize {
+		return evicted
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].lastAccess < items[j].lastAccess
+	})
+
+	for _, thisItem := range items {
+		if totalSize <= c.maxSize {
+			break
+		}
+
+		if inArray(excludeKeys, thisItem.key) {
+			//Still transcoding
+			continue
+		}
+
+		err := os.RemoveAll(filepath.Join(c.folder, thisItem.key))
+		if err != nil {
+			continue
+		}
+
+		totalSize -= thisItem.size
+		delete(c.lastAccess, thisItem.key)
+		evicted = append(evicted, thisItem.key)
+	}
+
+	return evicted
+}
+
+func inArray(arr []string, str string) bool {
+	for _, a := range arr {
+		if a == str {
+			return true
+		}
+	}
+	return false
+}
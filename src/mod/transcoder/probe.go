@@ -0,0 +1,93 @@
+package transcoder
+
+import (
+	"encoding/json"
+	"errors"
+	"os/exec"
+	"strconv"
+)
+
+/*
+	Media Probe
+
+	Read the stream information of a video using ffprobe
+*/
+
+type SubtitleStream struct {
+	Index    int    //Index among the subtitle streams, used for extraction
+	Codec    string //e.g. subrip, ass, mov_text
+	Language string
+	Title    string
+}
+
+type MediaInfo struct {
+	Duration   float64
+	Width      int
+	Height     int
+	VideoCodec string
+	AudioCodec string
+	Subtitles  []*SubtitleStream
+}
+
+type ffprobeOutput struct {
+	Streams []struct {
+		CodecType string `json:"codec_type"`
+		CodecName string `json:"codec_name"`
+		Width     int    `json:"width"`
+		Height    int    `json:"height"`
+		Tags      struct {
+			Language string `json:"language"`
+			Title    string `json:"title"`
+		} `json:"tags"`
+	} `json:"streams"`
+	Format struct {
+		Duration string `json:"duration"`
+	} `json:"format"`
+}
+
+//Get the stream information of the given media file
+func (t *Transcoder) Probe(file string) (*MediaInfo, error) {
+	if _, err := exec.LookPath(t.options.FfprobePath); err != nil {
+		return nil, errors.New("ffprobe not found")
+	}
+
+	cmd := exec.Command(t.options.FfprobePath, "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams", file)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	probeResult := ffprobeOutput{}
+	err = json.Unmarshal(out, &probeResult)
+	if err != nil {
+		return nil, err
+	}
+
+	info := MediaInfo{
+		Subtitles: []*SubtitleStream{},
+	}
+	info.Duration, _ = strconv.ParseFloat(probeResult.Format.Duration, 64)
+	for _, stream := range probeResult.Streams {
+		switch stream.CodecType {
+		case "video":
+			if info.VideoCodec == "" {
+				info.VideoCodec = stream.CodecName
+				info.Width = stream.Width
+				info.Height = stream.Height
+			}
+		case "audio":
+			if info.AudioCodec == "" {
+				info.AudioCodec = stream.CodecName
+			}
+		case "subtitle":
+			info.Subtitles = append(info.Subtitles, &SubtitleStream{
+				Index:    len(info.Subtitles),
+				Codec:    stream.CodecName,
+				Language: stream.Tags.Language,
+				Title:    stream.Tags.Title,
+			})
+		}
+	}
+
+	return &info, nil
+}
@@ -0,0 +1,225 @@
+package transcoder
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+	Subtitle Converter
+
+	Browsers only support WebVTT in the <track> element. This script convert
+	the sidecar SRT / ASS subtitle files to WebVTT and extract the embedded
+	text subtitle tracks in video containers using ffmpeg
+*/
+
+var SubtitleFormats = []string{".srt", ".ass", ".ssa", ".vtt"}
+
+//Bitmap based subtitle codecs that cannot be converted to WebVTT
+var bitmapSubtitleCodecs = []string{"hdmv_pgs_subtitle", "dvd_subtitle", "dvb_subtitle", "xsub"}
+
+var srtTimestampRegex = regexp.MustCompile(`(\d{2}:\d{2}:\d{2}),(\d{3})`)
+var assOverrideTagRegex = regexp.MustCompile(`\{[^}]*\}`)
+
+//Find the subtitle files next to the video, e.g. movie.srt or movie.en.ass for movie.mkv
+func FindSidecarSubtitles(videoFile string) []string {
+	results := []string{}
+	basename := strings.TrimSuffix(filepath.Base(videoFile), filepath.Ext(videoFile))
+	files, err := ioutil.ReadDir(filepath.Dir(videoFile))
+	if err != nil {
+		return results
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !inArray(SubtitleFormats, strings.ToLower(filepath.Ext(file.Name()))) {
+			continue
+		}
+
+		if strings.HasPrefix(file.Name(), basename+".") {
+			results = append(results, filepath.Join(filepath.Dir(videoFile), file.Name()))
+		}
+	}
+
+	return results
+}
+
+//Load a subtitle file and convert it into WebVTT
+func LoadSubtitleAsWebVTT(subtitleFile string) (string, error) {
+	content, err := ioutil.ReadFile(subtitleFile)
+	if err != nil {
+		return "", err
+	}
+
+	//Remove UTF-8 BOM
+	text := strings.TrimPrefix(string(content), "\ufeff")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+
+	switch strings.ToLower(filepath.Ext(subtitleFile)) {
+	case ".vtt":
+		return text, nil
+	case ".srt":
+		return ConvertSrtToWebVTT(text), nil
+	case ".ass", ".ssa":
+		return ConvertAssToWebVTT(text), nil
+	}
+
+	return "", errors.New("Unsupported subtitle format")
+}
+
+//Convert SRT subtitle content to WebVTT
+func ConvertSrtToWebVTT(content string) string {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	return "WEBVTT\n\n" + srtTimestampRegex.ReplaceAllString(content, "$1.$2")
+}
+
+//Convert ASS / SSA subtitle content to WebVTT. Styling is discarded
+func ConvertAssToWebVTT(content string) string {
+	var sb strings.Builder
+	sb.WriteString("WEBVTT\n\n")
+
+	//Find the column order from the Format line of the Events section
+	inEvents := false
+	startCol, endCol, textCol := 1, 2, 9
+	for _, line := range strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			inEvents = strings.EqualFold(line, "[Events]")
+			continue
+		}
+
+		if !inEvents {
+			continue
+		}
+
+		if strings.HasPrefix(line, "Format:") {
+			columns := strings.Split(strings.TrimPrefix(line, "Format:"), ",")
+			for i, column := range columns {
+				switch strings.TrimSpace(strings.ToLower(column)) {
+				case "start":
+					startCol = i
+				case "end":
+					endCol = i
+				case "text":
+					textCol = i
+				}
+			}
+			continue
+		}
+
+		if !strings.HasPrefix(line, "Dialogue:") {
+			continue
+		}
+
+		//The text column is always the last one and might contains comma
+		fields := strings.SplitN(strings.TrimPrefix(line, "Dialogue:"), ",", textCol+1)
+		if len(fields) <= textCol {
+			continue
+		}
+
+		start, err := assTimeToVTT(strings.TrimSpace(fields[startCol]))
+		if err != nil {
+			continue
+		}
+		end, err := assTimeToVTT(strings.TrimSpace(fields[endCol]))
+		if err != nil {
+			continue
+		}
+
+		text := assOverrideTagRegex.ReplaceAllString(fields[textCol], "")
+		text = strings.ReplaceAll(text, "\\N", "\n")
+		text = strings.ReplaceAll(text, "\\n", "\n")
+		text = strings.ReplaceAll(text, "\\h", " ")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		sb.WriteString(start + " --> " + end + "\n" + text + "\n\n")
+	}
+
+	return sb.String()
+}
+
+//Convert ASS time (H:MM:SS.cc) to WebVTT time (HH:MM:SS.mmm)
+func assTimeToVTT(assTime string) (string, error) {
+	parts := strings.Split(assTime, ":")
+	if len(parts) != 3 {
+		return "", errors.New("Invalid time")
+	}
+
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return "", err
+	}
+
+	secondParts := strings.Split(parts[2], ".")
+	centiseconds := "00"
+	if len(secondParts) == 2 {
+		centiseconds = secondParts[1]
+	}
+	for len(centiseconds) < 3 {
+		centiseconds += "0"
+	}
+
+	return leftPad(strconv.Itoa(hours)) + ":" + parts[1] + ":" + secondParts[0] + "." + centiseconds[:3], nil
+}
+
+func leftPad(value string) string {
+	if len(value) < 2 {
+		return "0" + value
+	}
+	return value
+}
+
+//Extract the embedded subtitle track with the given index and convert it into WebVTT
+func (t *Transcoder) ExtractSubtitle(file string, index int, codec string) (string, error) {
+	if inArray(bitmapSubtitleCodecs, codec) {
+		return "", errors.New("Bitmap subtitle cannot be converted")
+	}
+
+	key, err := GetCacheKey(file)
+	if err != nil {
+		return "", err
+	}
+
+	//Check if it is already extracted
+	outputFolder := filepath.Join(t.options.CacheFolder, key, "subtitles")
+	outputFile := filepath.Join(outputFolder, strconv.Itoa(index)+".vtt")
+	if content, err := ioutil.ReadFile(outputFile); err == nil {
+		t.cache.Touch(key)
+		return string(content), nil
+	}
+
+	os.MkdirAll(outputFolder, 0755)
+	select {
+	case t.slots <- true:
+	default:
+		return "", errors.New("Too many concurrent transcodes")
+	}
+	defer func() { <-t.slots }()
+
+	cmd := exec.Command(t.options.FfmpegPath, "-hide_banner", "-loglevel", "error", "-y",
+		"-i", file,
+		"-map", "0:s:"+strconv.Itoa(index),
+		"-f", "webvtt",
+		outputFile,
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		os.Remove(outputFile)
+		return "", errors.New("Subtitle extraction failed: " + strings.TrimSpace(string(out)))
+	}
+
+	content, err := ioutil.ReadFile(outputFile)
+	if err != nil {
+		return "", err
+	}
+
+	t.cache.Touch(key)
+	return string(content), nil
+}
@@ -0,0 +1,369 @@
+package transcoder
+
+/*
+	ArozOS Video Transcoder
+	author: tobychui
+
+	This module convert videos that cannot be played in browsers (e.g. MKV / HEVC / AVI)
+	or are too large for mobile networks into HLS streams with multiple bitrate renditions
+	using ffmpeg. Renditions are transcoded on demand when the client first request it
+	and the segments are cached in the tmp folder with LRU eviction.
+*/
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Options struct {
+	FfmpegPath    string //Path of the ffmpeg binary, default "ffmpeg"
+	FfprobePath   string //Path of the ffprobe binary, default "ffprobe"
+	CacheFolder   string //Folder for storing the transcoded segments
+	MaxCacheSize  int64  //Maximum size of the cache folder in bytes
+	MaxConcurrent int    //Maximum number of ffmpeg process running at the same time
+}
+
+//A bitrate rendition of the HLS stream
+type Rendition struct {
+	Name         string //e.g. 720p
+	Height       int
+	VideoBitrate int //In kbps
+	AudioBitrate int //In kbps
+}
+
+//Renditions provided by the transcoder, from high to low quality
+var Renditions = []*Rendition{
+	{Name: "1080p", Height: 1080, VideoBitrate: 5000, AudioBitrate: 192},
+	{Name: "720p", Height: 720, VideoBitrate: 2800, AudioBitrate: 128},
+	{Name: "480p", Height: 480, VideoBitrate: 1400, AudioBitrate: 128},
+	{Name: "360p", Height: 360, VideoBitrate: 800, AudioBitrate: 96},
+}
+
+//A running transcode process
+type job struct {
+	cmd      *exec.Cmd
+	err      error
+	finished bool
+}
+
+type Transcoder struct {
+	options   Options
+	jobs      map[string]*job
+	jobsMutex sync.Mutex
+	slots     chan bool //Semaphore for limiting concurrent transcodes
+	cache     *lruCache
+}
+
+//Create a new transcoder
+func NewTranscoder(options Options) (*Transcoder, error) {
+	if options.FfmpegPath == "" {
+		options.FfmpegPath = "ffmpeg"
+	}
+	if options.FfprobePath == "" {
+		options.FfprobePath = "ffprobe"
+	}
+	if options.MaxConcurrent <= 0 {
+		options.MaxConcurrent = 1
+	}
+
+	err := os.MkdirAll(options.CacheFolder, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Transcoder{
+		options: options,
+		jobs:    map[string]*job{},
+		slots:   make(chan bool, options.MaxConcurrent),
+		cache:   newLRUCache(options.CacheFolder, options.MaxCacheSize),
+	}, nil
+}
+
+//Check if ffmpeg is available on this host
+func (t *Transcoder) IsAvailable() bool {
+	_, err := exec.LookPath(t.options.FfmpegPath)
+	return err == nil
+}
+
+//Get the cache key of the given file. The key changes when the file is modified
+func GetCacheKey(file string) (string, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+
+	abspath, _ := filepath.Abs(file)
+	h := sha1.New()
+	h.Write([]byte(abspath + "/" + strconv.FormatInt(info.Size(), 10) + "/" + strconv.FormatInt(info.ModTime().Unix(), 10)))
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+//Get the rendition with the given name
+func GetRendition(name string) (*Rendition, error) {
+	for _, thisRendition := range Renditions {
+		if thisRendition.Name == name {
+			return thisRendition, nil
+		}
+	}
+	return nil, errors.New("Rendition not found")
+}
+
+//Get the renditions suitable for the given file, renditions larger than the source are skipped
+func (t *Transcoder) GetRenditions(file string) []*Rendition {
+	results := []*Rendition{}
+	sourceHeight := 0
+	info, err := t.Probe(file)
+	if err == nil {
+		sourceHeight = info.Height
+	}
+
+	for _, thisRendition := range Renditions {
+		if sourceHeight > 0 && thisRendition.Height > sourceHeight {
+			continue
+		}
+		results = append(results, thisRendition)
+	}
+
+	if len(results) == 0 {
+		//Source smaller than the lowest rendition
+		results = append(results, Renditions[len(Renditions)-1])
+	}
+	return results
+}
+
+/*
+	Generate the HLS master playlist of the given file.
+	urlGenerator is used to generate the URL of each rendition playlist
+*/
+func (t *Transcoder) GetMasterPlaylist(file string, urlGenerator func(rendition string) string) string {
+	var sb strings.Builder
+	sb.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for _, thisRendition := range t.GetRenditions(file) {
+		bandwidth := (thisRendition.VideoBitrate + thisRendition.AudioBitrate) * 1000
+		width := thisRendition.Height * 16 / 9
+		width = width - width%2
+		sb.WriteString("#EXT-X-STREAM-INF:BANDWIDTH=" + strconv.Itoa(bandwidth) + ",RESOLUTION=" + strconv.Itoa(width) + "x" + strconv.Itoa(thisRendition.Height) + ",NAME=\"" + thisRendition.Name + "\"\n")
+		sb.WriteString(urlGenerator(thisRendition.Name) + "\n")
+	}
+	return sb.String()
+}
+
+/*
+	Get the playlist of the given rendition. The transcode process will be started if
+	it is not transcoded yet. segmentURLGenerator is used to rewrite the segment URLs
+*/
+func (t *Transcoder) GetRenditionPlaylist(file string, renditionName string, segmentURLGenerator func(segment string) string) (string, error) {
+	rendition, err := GetRendition(renditionName)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := GetCacheKey(file)
+	if err != nil {
+		return "", err
+	}
+
+	outputFolder := filepath.Join(t.options.CacheFolder, key, rendition.Name)
+	playlistFile := filepath.Join(outputFolder, "index.m3u8")
+	err = t.startTranscode(file, key, rendition, outputFolder)
+	if err != nil {
+		return "", err
+	}
+
+	//Wait for the first segment to be ready
+	timeout := time.Now().Add(30 * time.Second)
+	for {
+		content, err := ioutil.ReadFile(playlistFile)
+		if err == nil && strings.Contains(string(content), ".ts") {
+			t.cache.Touch(key)
+			return rewritePlaylist(string(content), segmentURLGenerator), nil
+		}
+
+		running, jobErr := t.getJobState(key + "/" + rendition.Name)
+		if jobErr != nil {
+			return "", jobErr
+		} else if !running && err == nil {
+			//Finished but no segment produced
+			return "", errors.New("Transcode failed")
+		}
+
+		if time.Now().After(timeout) {
+			return "", errors.New("Transcode timeout")
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+//Get the filepath of a segment in the cache
+func (t *Transcoder) GetSegment(file string, renditionName string, segment string) (string, error) {
+	if _, err := GetRendition(renditionName); err != nil {
+		return "", err
+	}
+
+	if segment != filepath.Base(segment) || filepath.Ext(segment) != ".ts" {
+		return "", errors.New("Invalid segment name")
+	}
+
+	key, err := GetCacheKey(file)
+	if err != nil {
+		return "", err
+	}
+
+	segmentFile := filepath.Join(t.options.CacheFolder, key, renditionName, segment)
+	if _, err := os.Stat(segmentFile); err != nil {
+		return "", errors.New("Segment not found")
+	}
+
+	t.cache.Touch(key)
+	return segmentFile, nil
+}
+
+//Replace the relative segment paths in the ffmpeg generated playlist
+func rewritePlaylist(content string, segmentURLGenerator func(segment string) string) string {
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines[i] = segmentURLGenerator(filepath.Base(line))
+	}
+	return strings.Join(lines, "\n")
+}
+
+//Get if the given job is running and the error it returned
+func (t *Transcoder) getJobState(jobID string) (bool, error) {
+	t.jobsMutex.Lock()
+	defer t.jobsMutex.Unlock()
+	thisJob, ok := t.jobs[jobID]
+	if !ok {
+		return false, nil
+	}
+	return !thisJob.finished, thisJob.err
+}
+
+//Start the ffmpeg process for the given rendition if it is not running or transcoded
+func (t *Transcoder) startTranscode(file string, key string, rendition *Rendition, outputFolder string) error {
+	jobID := key + "/" + rendition.Name
+	t.jobsMutex.Lock()
+	defer t.jobsMutex.Unlock()
+
+	if thisJob, ok := t.jobs[jobID]; ok && !thisJob.finished {
+		//Transcoding
+		return nil
+	}
+
+	//Check if this rendition is already transcoded
+	if content, err := ioutil.ReadFile(filepath.Join(outputFolder, "index.m3u8")); err == nil && strings.Contains(string(content), "#EXT-X-ENDLIST") {
+		return nil
+	}
+
+	//Acquire a transcode slot
+	select {
+	case t.slots <- true:
+	default:
+		return errors.New("Too many concurrent transcodes")
+	}
+
+	os.RemoveAll(outputFolder)
+	err := os.MkdirAll(outputFolder, 0755)
+	if err != nil {
+		<-t.slots
+		return err
+	}
+
+	cmd := exec.Command(t.options.FfmpegPath,
+		"-hide_banner", "-loglevel", "error",
+		"-i", file,
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-vf", "scale=-2:"+strconv.Itoa(rendition.Height),
+		"-c:v", "libx264", "-preset", "veryfast", "-profile:v", "main",
+		"-b:v", strconv.Itoa(rendition.VideoBitrate)+"k",
+		"-maxrate", strconv.Itoa(rendition.VideoBitrate*107/100)+"k",
+		"-bufsize", strconv.Itoa(rendition.VideoBitrate*3/2)+"k",
+		"-g", "48", "-keyint_min", "48", "-sc_threshold", "0",
+		"-c:a", "aac", "-ac", "2", "-b:a", strconv.Itoa(rendition.AudioBitrate)+"k",
+		"-f", "hls",
+		"-hls_time", "6",
+		"-hls_playlist_type", "event",
+		"-hls_segment_filename", filepath.Join(outputFolder, "seg_%05d.ts"),
+		filepath.Join(outputFolder, "index.m3u8"),
+	)
+
+	thisJob := &job{
+		cmd: cmd,
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		<-t.slots
+		return err
+	}
+
+	t.jobs[jobID] = thisJob
+	t.cache.Touch(key)
+	log.Println("[Transcoder] Transcoding " + filepath.Base(file) + " to " + rendition.Name)
+
+	go func() {
+		err := cmd.Wait()
+		<-t.slots
+
+		t.jobsMutex.Lock()
+		thisJob.err = err
+		thisJob.finished = true
+		t.jobsMutex.Unlock()
+
+		if err != nil {
+			log.Println("[Transcoder] Transcode failed for "+filepath.Base(file)+": ", err.Error())
+		}
+
+		//Evict old cache if the cache folder is too large
+		evictedKeys := t.cache.Evict(t.activeKeys())
+		t.jobsMutex.Lock()
+		for _, evictedKey := range evictedKeys {
+			for jobID := range t.jobs {
+				if strings.HasPrefix(jobID, evictedKey+"/") {
+					delete(t.jobs, jobID)
+				}
+			}
+		}
+		t.jobsMutex.Unlock()
+	}()
+
+	return nil
+}
+
+//Get the cache keys that have running transcode jobs
+func (t *Transcoder) activeKeys() []string {
+	t.jobsMutex.Lock()
+	defer t.jobsMutex.Unlock()
+
+	keys := []string{}
+	for jobID, thisJob := range t.jobs {
+		if !thisJob.finished {
+			keys = append(keys, strings.Split(jobID, "/")[0])
+		}
+	}
+	return keys
+}
+
+//Kill all the running transcode processes
+func (t *Transcoder) Close() {
+	t.jobsMutex.Lock()
+	defer t.jobsMutex.Unlock()
+	for _, thisJob := range t.jobs {
+		if !thisJob.finished && thisJob.cmd.Process != nil {
+			thisJob.cmd.Process.Kill()
+		}
+	}
+}
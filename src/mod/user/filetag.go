@@ -0,0 +1,218 @@
+package user
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	fs "imuslab.com/arozos/mod/filesystem"
+)
+
+/*
+	File Tag Handler
+	author: tobychui
+
+	This module handle the user file tags, favourites and the
+	tag based file query (aka smart collections)
+*/
+
+//Query for searching tagged files. Empty fields are ignored
+type FileTagQuery struct {
+	Tags           []string //All given tags must exists on the file
+	Type           string   //File extension (e.g. pdf) or mime type prefix (e.g. image)
+	ModifiedWithin int      //Only return files modified within the given amount of days
+	FavouriteOnly  bool     //Only return files marked as favourite
+}
+
+//Result of a tag query
+type TaggedFile struct {
+	Filepath  string
+	Filename  string
+	IsDir     bool
+	Tags      []string
+	Favourite bool
+	ModTime   int64
+}
+
+//Get the tag record of the given file for this user
+func (u *User) GetFileTags(realpath string) (*fs.FileTagRecord, error) {
+	fsHandler, err := u.GetFileSystemHandlerFromRealPath(realpath)
+	if err != nil {
+		return &fs.FileTagRecord{Tags: []string{}}, err
+	}
+
+	return fsHandler.GetFileTagRecord(realpath, u.Username)
+}
+
+//Overwrite the tags of the given file for this user
+func (u *User) SetFileTags(realpath string, tags []string) error {
+	fsHandler, err := u.GetFileSystemHandlerFromRealPath(realpath)
+	if err != nil {
+		return err
+	}
+
+	record, _ := fsHandler.GetFileTagRecord(realpath, u.Username)
+	record.Tags = cleanFileTags(tags)
+	return fsHandler.SetFileTagRecord(realpath, u.Username, record)
+}
+
+//Mark or unmark the given file as favourite for this user
+func (u *User) SetFileFavourite(realpath string, favourite bool) error {
+	fsHandler, err := u.GetFileSystemHandlerFromRealPath(realpath)
+	if err != nil {
+		return err
+	}
+
+	record, _ := fsHandler.GetFileTagRecord(realpath, u.Username)
+	record.Favourite = favourite
+	return fsHandler.SetFileTagRecord(realpath, u.Username, record)
+}
+
+/*
+	Move the tag records of a file (or folder) to its new location.
+	destRealpath should be the new full path of the file, not its parent folder
+*/
+func (u *User) MoveFileTags(srcRealpath string, destRealpath string) error {
+	err := u.CopyFileTags(srcRealpath, destRealpath)
+	if err != nil {
+		return err
+	}
+
+	return u.RemoveFileTags(srcRealpath)
+}
+
+//Copy the tag records of a file (or folder) to the given new full path
+func (u *User) CopyFileTags(srcRealpath string, destRealpath string) error {
+	srcHandler, err := u.GetFileSystemHandlerFromRealPath(srcRealpath)
+	if err != nil {
+		return err
+	}
+
+	destHandler, err := u.GetFileSystemHandlerFromRealPath(destRealpath)
+	if err != nil {
+		return err
+	}
+
+	records, err := srcHandler.ExportFileTagRecords(srcRealpath)
+	if err != nil || len(records) == 0 {
+		return err
+	}
+
+	return destHandler.ImportFileTagRecords(destRealpath, records)
+}
+
+//Remove the tag records of a file (or folder)
+func (u *User) RemoveFileTags(realpath string) error {
+	fsHandler, err := u.GetFileSystemHandlerFromRealPath(realpath)
+	if err != nil {
+		return err
+	}
+
+	return fsHandler.DeleteFileTagRecords(realpath)
+}
+
+//List all tags used by this user, mapped to the number of files using it
+func (u *User) ListAllFileTags() map[string]int {
+	results := map[string]int{}
+	for _, fsh := range u.GetAllAccessibleFileSystemHandler() {
+		records, err := fsh.ListFileTagRecords(u.Username)
+		if err != nil {
+			continue
+		}
+
+		for _, record := range records {
+			for _, tag := range record.Tags {
+				results[tag]++
+			}
+		}
+	}
+
+	return results
+}
+
+//Search the user tagged files with the given query
+func (u *User) QueryTaggedFiles(query *FileTagQuery) []*TaggedFile {
+	results := []*TaggedFile{}
+	for _, fsh := range u.GetAllAccessibleFileSystemHandler() {
+		records, err := fsh.ListFileTagRecords(u.Username)
+		if err != nil {
+			continue
+		}
+
+		for realpath, record := range records {
+			fileInfo, err := os.Stat(realpath)
+			if err != nil {
+				//File no longer exists
+				continue
+			}
+
+			if !query.Match(realpath, fileInfo, record) {
+				continue
+			}
+
+			vpath, err := u.RealPathToVirtualPath(realpath)
+			if err != nil {
+				continue
+			}
+
+			results = append(results, &TaggedFile{
+				Filepath:  vpath,
+				Filename:  filepath.Base(realpath),
+				IsDir:     fileInfo.IsDir(),
+				Tags:      record.Tags,
+				Favourite: record.Favourite,
+				ModTime:   fileInfo.ModTime().Unix(),
+			})
+		}
+	}
+
+	return results
+}
+
+//Check if the given file matches this query
+func (q *FileTagQuery) Match(realpath string, fileInfo os.FileInfo, record *fs.FileTagRecord) bool {
+	if q.FavouriteOnly && !record.Favourite {
+		return false
+	}
+
+	for _, tag := range q.Tags {
+		if !record.HasTag(tag) {
+			return false
+		}
+	}
+
+	if q.ModifiedWithin > 0 && fileInfo.ModTime().Before(time.Now().AddDate(0, 0, -q.ModifiedWithin)) {
+		return false
+	}
+
+	if q.Type != "" {
+		filetype := strings.ToLower(strings.TrimPrefix(q.Type, "."))
+		if fileInfo.IsDir() {
+			return filetype == "folder"
+		}
+
+		if strings.ToLower(strings.TrimPrefix(filepath.Ext(realpath), ".")) != filetype {
+			//Check if the mime type matches instead
+			mime, _, err := fs.GetMime(realpath)
+			if err != nil || !strings.HasPrefix(mime, filetype) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+//Trim, deduplicate and remove empty tags
+func cleanFileTags(tags []string) []string {
+	results := []string{}
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || inSliceIgnoreCase(results, tag) {
+			continue
+		}
+		results = append(results, tag)
+	}
+	return results
+}
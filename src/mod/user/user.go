@@ -139,6 +139,11 @@ func (u *UserHandler) GetUserInfoFromUsername(username string) (*User, error) {
 	return &thisUser, nil
 }
 
+//Remove the buffered quota manager of the user, e.g. when the database of this user handler is closed
+func (u *UserHandler) ClearQuotaCache(username string) {
+	quotaManagerBuffer.Delete(username)
+}
+
 //Get user obejct from session
 func (u *UserHandler) GetUserInfoFromRequest(w http.ResponseWriter, r *http.Request) (*User, error) {
 	username, err := u.authAgent.GetUserName(w, r)
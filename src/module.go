@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"log"
 	"net/http"
 	"os"
@@ -15,7 +16,7 @@ var (
 
 func ModuleServiceInit() {
 	//Create a new module handler
-	moduleHandler = module.NewModuleHandler(userHandler, *tmp_directory)
+	moduleHandler = module.NewModuleHandler(userHandler, *tmp_directory, internal_version)
 
 	//Pass through the endpoint to authAgent
 	http.HandleFunc("/system/modules/list", func(w http.ResponseWriter, r *http.Request) {
@@ -55,7 +56,13 @@ func ModuleServiceInit() {
 			}
 
 			//Install it
-			moduleHandler.InstallViaZip(rpath, AGIGateway)
+			err = moduleHandler.InstallViaZip(rpath, AGIGateway)
+			if err != nil {
+				log.Println("*Module Installer* Failed to install module: ", err.Error())
+				sendErrorResponse(w, err.Error())
+				return
+			}
+			sendOK(w)
 		} else {
 			//Permission denied
 			sendErrorResponse(w, "Permission Denied")
@@ -91,10 +98,13 @@ func ModuleServiceInit() {
 		})
 	}
 
-	err := sysdb.NewTable("module")
-	if err != nil {
-		log.Fatal(err)
-		os.Exit(0)
+	//Create the tables for module settings, package records, repositories and trusted signing keys
+	for _, tableName := range []string{"module", "module-packages", "module-repos", "module-trustedkeys"} {
+		err := sysdb.NewTable(tableName)
+		if err != nil {
+			log.Fatal(err)
+			os.Exit(0)
+		}
 	}
 
 }
@@ -125,6 +135,16 @@ func ModuleInstallerInit() {
 	})
 
 	router.HandleFunc("/system/module/install", HandleModuleInstall)
+	router.HandleFunc("/system/module/capabilities", func(w http.ResponseWriter, r *http.Request) {
+		moduleHandler.HandleModuleCapabilities(w, r, AGIGateway)
+	})
+	router.HandleFunc("/system/module/package", func(w http.ResponseWriter, r *http.Request) {
+		moduleHandler.HandleModulePackages(w, r, AGIGateway)
+	})
+	router.HandleFunc("/system/module/repos", func(w http.ResponseWriter, r *http.Request) {
+		moduleHandler.HandleModuleRepositories(w, r, AGIGateway)
+	})
+	router.HandleFunc("/system/module/keys", moduleHandler.HandleTrustedKeys)
 
 }
 
@@ -147,10 +167,51 @@ func HandleModuleInstall(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		//Return the capabilities that require admin approval if any
+		pendingCapabilities := AGIGateway.ListPendingModuleCapabilities()
+		if len(pendingCapabilities) > 0 {
+			js, _ := json.Marshal(pendingCapabilities)
+			sendJSONResponse(w, string(js))
+			return
+		}
+
 		//Reply ok
 		sendOK(w)
 	} else if opr == "zipinstall" {
+		//Get the installer file path from request
+		installerPath, _ := mv(r, "path", true)
+		if installerPath == "" {
+			sendErrorResponse(w, "Invalid installer path")
+			return
+		}
 
+		userinfo, err := userHandler.GetUserInfoFromRequest(w, r)
+		if err != nil {
+			sendErrorResponse(w, "User not logged in")
+			return
+		}
+
+		rpath, err := userinfo.VirtualPathToRealPath(installerPath)
+		if err != nil {
+			sendErrorResponse(w, "Invalid installer path")
+			return
+		}
+
+		err = moduleHandler.InstallViaZip(rpath, AGIGateway)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+
+		//Return the capabilities that require admin approval if any
+		pendingCapabilities := AGIGateway.ListPendingModuleCapabilities()
+		if len(pendingCapabilities) > 0 {
+			js, _ := json.Marshal(pendingCapabilities)
+			sendJSONResponse(w, string(js))
+			return
+		}
+
+		sendOK(w)
 	} else if opr == "remove" {
 		//Get the module name from list
 		module, _ := mv(r, "module", true)
@@ -160,7 +221,7 @@ func HandleModuleInstall(w http.ResponseWriter, r *http.Request) {
 		}
 
 		//Remove the module
-		err := moduleHandler.UninstallModule(module)
+		err := moduleHandler.UninstallModule(module, AGIGateway)
 		if err != nil {
 			sendErrorResponse(w, err.Error())
 			return
@@ -171,6 +232,6 @@ func HandleModuleInstall(w http.ResponseWriter, r *http.Request) {
 
 	} else {
 		//List all the modules
-		moduleHandler.HandleModuleInstallationListing(w, r)
+		moduleHandler.HandleModuleInstallationListing(w, r, AGIGateway)
 	}
 }
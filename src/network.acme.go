@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net/http"
+
+	"imuslab.com/arozos/mod/network/acme"
+	prout "imuslab.com/arozos/mod/prouter"
+)
+
+/*
+	Network ACME Certificate Interface
+
+	This is an interface for managing the certificates obtained from ACME servers
+	(e.g. Let's Encrypt) for the HTTPS listener and the reverse proxy. Certificates
+	are renewed automatically and swapped without restarting the listeners.
+*/
+
+var (
+	certManager *acme.CertManager
+)
+
+func certManagerInit() {
+	manager, err := acme.NewCertManager(acme.Option{
+		Database:     sysdb,
+		StoreFolder:  "./system/acme/",
+		FallbackCert: *tls_cert,
+		FallbackKey:  *tls_key,
+		ExtraHostnames: func() []string {
+			if dynamicProxyRouter == nil {
+				return []string{}
+			}
+			return dynamicProxyRouter.GetHostnames()
+		},
+	})
+	if err != nil {
+		log.Println("ACME Certificate Manager Initialization Failed: ", err.Error())
+		return
+	}
+	certManager = manager
+
+	//Create a setting interface for certificates
+	router := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "System Setting",
+		AdminOnly:   true,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			sendErrorResponse(w, "Permission Denied")
+		},
+	})
+
+	registerSetting(settingModule{
+		Name:         "Certificates",
+		Desc:         "Automatic HTTPS certificates",
+		IconPath:     "SystemAO/network/img/ethernet.png",
+		Group:        "Network",
+		StartDir:     "SystemAO/network/acme.html",
+		RequireAdmin: true,
+	})
+
+	router.HandleFunc("/system/network/acme/settings", certManager.HandleSettings)
+	router.HandleFunc("/system/network/acme/certs", certManager.HandleCertificates)
+
+	certManager.Start()
+}
+
+//Get the TLS config for the HTTPS listeners
+func certManagerTLSConfig() *tls.Config {
+	if certManager == nil {
+		//Certificate manager not started. Serve with the certificate given in the startup flags
+		cert, err := tls.LoadX509KeyPair(*tls_cert, *tls_key)
+		if err != nil {
+			log.Println("Unable to load TLS certificate: ", err.Error())
+		}
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}
+	}
+	return certManager.TLSConfig()
+}
+
+//Wrap the HTTP handler so ACME HTTP-01 challenges are answered on the HTTP listener
+func certManagerHTTPHandler(next http.Handler) http.Handler {
+	if certManager == nil {
+		return next
+	}
+	return certManager.HTTPChallengeHandler(next)
+}
+
+//Answer ACME HTTP-01 challenges on other listeners, return true if handled
+func certManagerHandleChallenge(w http.ResponseWriter, r *http.Request) bool {
+	if certManager == nil {
+		return false
+	}
+	return certManager.HandleHTTPChallenge(w, r)
+}
@@ -0,0 +1,54 @@
+package main
+
+/*
+	Bandwidth Limits Entry point
+
+	Rate limits and connection caps per permission group and protocol,
+	with the live throughput view for admins
+*/
+
+import (
+	"log"
+	"net/http"
+
+	"imuslab.com/arozos/mod/network/bandwidth"
+	prout "imuslab.com/arozos/mod/prouter"
+)
+
+var (
+	BandwidthController *bandwidth.Controller
+)
+
+func BandwidthInit() {
+	controller, err := bandwidth.NewController(bandwidth.Options{
+		UserHandler: userHandler,
+		Database:    sysdb,
+	})
+	if err != nil {
+		//Transfers are not limited if the controller is nil
+		log.Println("[Bandwidth] Unable to start bandwidth limiter: " + err.Error())
+		return
+	}
+	BandwidthController = controller
+
+	registerSetting(settingModule{
+		Name:         "Bandwidth",
+		Desc:         "Bandwidth Limits and Live Throughput",
+		IconPath:     "SystemAO/network/img/ethernet.png",
+		Group:        "Network",
+		StartDir:     "SystemAO/network/bandwidth.html",
+		RequireAdmin: true,
+	})
+
+	router := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "System Setting",
+		AdminOnly:   true,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			sendErrorResponse(w, "Permission Denied")
+		},
+	})
+
+	router.HandleFunc("/system/bandwidth/limits", BandwidthController.HandleLimits)
+	router.HandleFunc("/system/bandwidth/live", BandwidthController.HandleLiveView)
+}
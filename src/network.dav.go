@@ -0,0 +1,89 @@
+package main
+
+/*
+	CalDAV and CardDAV Entry point
+
+	Sync calendars and contacts with the collections stored in the user's storage
+*/
+
+import (
+	"encoding/json"
+	"net/http"
+
+	prout "imuslab.com/arozos/mod/prouter"
+	dav "imuslab.com/arozos/mod/storage/dav"
+)
+
+var (
+	DAVHandler *dav.Server
+)
+
+func DAVServerInit() {
+	//Create a database table for the calendar and contacts service
+	sysdb.NewTable("dav")
+
+	//Create a new CalDAV and CardDAV server
+	DAVHandler = dav.NewServer(*host_name, userHandler)
+
+	//Check the default state
+	enabled := true
+	if sysdb.KeyExists("dav", "enabled") {
+		sysdb.Read("dav", "enabled", &enabled)
+	}
+	DAVHandler.Enabled = enabled
+
+	//Handle setting related functions
+	router := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "System Setting",
+		AdminOnly:   false,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			sendErrorResponse(w, "Permission Denied")
+		},
+	})
+
+	router.HandleFunc("/system/network/dav/status", func(w http.ResponseWriter, r *http.Request) {
+		//Show status for every user, only allow change if admin
+		userinfo, err := userHandler.GetUserInfoFromRequest(w, r)
+		if err != nil {
+			sendErrorResponse(w, "User not logged in")
+			return
+		}
+		isAdmin := userinfo.IsAdmin()
+
+		set, _ := mv(r, "set", false)
+		if set == "" {
+			//Return the current status
+			type ServerStatus struct {
+				Enabled  bool
+				IsAdmin  bool
+				Username string
+			}
+			js, _ := json.Marshal(ServerStatus{
+				Enabled:  DAVHandler.Enabled,
+				IsAdmin:  isAdmin,
+				Username: userinfo.Username,
+			})
+			sendJSONResponse(w, string(js))
+		} else if isAdmin && set == "disable" {
+			DAVHandler.Enabled = false
+			sysdb.Write("dav", "enabled", false)
+			sendOK(w)
+		} else if isAdmin && set == "enable" {
+			DAVHandler.Enabled = true
+			sysdb.Write("dav", "enabled", true)
+			sendOK(w)
+		} else {
+			sendErrorResponse(w, "Permission Denied")
+		}
+	})
+
+	//Register settings
+	registerSetting(settingModule{
+		Name:     "Calendar & Contacts",
+		Desc:     "CalDAV and CardDAV Server",
+		IconPath: "SystemAO/info/img/small_icon.png",
+		Group:    "Network",
+		StartDir: "SystemAO/disk/dav.html",
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+/*
+	DLNA Media Server Entry point
+
+	Stream the admin selected media libraries to TVs and consoles in the LAN
+*/
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	network "imuslab.com/arozos/mod/network"
+	dlna "imuslab.com/arozos/mod/network/dlna"
+	prout "imuslab.com/arozos/mod/prouter"
+)
+
+var (
+	DLNAServer *dlna.Server
+)
+
+func DLNAServerInit() {
+	if !*allow_ssdp {
+		//DLNA requires SSDP for device discovery
+		log.Println("[DLNA] SSDP disabled. Media server will not be started")
+		return
+	}
+
+	DLNAServer = dlna.NewMediaServer(dlna.Options{
+		UserHandler:   userHandler,
+		Database:      sysdb,
+		RenderHandler: thumbRenderHandler,
+		Hostname:      *host_name,
+		Vendor:        deviceVendor,
+		VendorURL:     deviceVendorURL,
+		ModelName:     deviceModel,
+		ModelDesc:     deviceModelDesc,
+		Port:          *listen_port,
+	})
+
+	//Public endpoints for the DLNA clients, only accessible within LAN
+	http.Handle("/dlna/", DLNAServer)
+
+	if DLNAServer.Enabled {
+		err := startDLNAServer()
+		if err != nil {
+			log.Println("[DLNA] Media server startup failed: " + err.Error())
+		}
+	}
+
+	//Handle setting related functions
+	router := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "System Setting",
+		AdminOnly:   true,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			sendErrorResponse(w, "Permission Denied")
+		},
+	})
+
+	router.HandleFunc("/system/network/dlna/status", func(w http.ResponseWriter, r *http.Request) {
+		set, _ := mv(r, "set", true)
+		if set == "" {
+			//Return the current status
+			type ServerStatus struct {
+				Enabled      bool
+				FriendlyName string
+				UUID         string
+			}
+			js, _ := json.Marshal(ServerStatus{
+				Enabled:      DLNAServer.Enabled,
+				FriendlyName: DLNAServer.FriendlyName(),
+				UUID:         DLNAServer.UUID,
+			})
+			sendJSONResponse(w, string(js))
+		} else if set == "enable" {
+			err := startDLNAServer()
+			if err != nil {
+				sendErrorResponse(w, err.Error())
+				return
+			}
+			sendOK(w)
+		} else if set == "disable" {
+			DLNAServer.Stop()
+			sendOK(w)
+		} else {
+			sendErrorResponse(w, "Invalid operation")
+		}
+	})
+	router.HandleFunc("/system/network/dlna/libraries", DLNAServer.HandleLibraries)
+	router.HandleFunc("/system/network/dlna/devices", DLNAServer.HandleDevices)
+
+	//Register settings
+	registerSetting(settingModule{
+		Name:         "Media Server",
+		Desc:         "DLNA / UPnP Media Server",
+		IconPath:     "SystemAO/network/img/ethernet.png",
+		Group:        "Network",
+		StartDir:     "SystemAO/network/dlna.html",
+		RequireAdmin: true,
+	})
+}
+
+//Start advertising the media server on the outbound network interface
+func startDLNAServer() error {
+	obip, err := network.GetOutboundIP()
+	if err != nil {
+		return err
+	}
+	return DLNAServer.Start(obip.String())
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"log"
@@ -58,6 +59,7 @@ func FTPServerInit() {
 	adminRouter.HandleFunc("/system/storage/ftp/start", storageHandleFTPServerStart)
 	adminRouter.HandleFunc("/system/storage/ftp/stop", storageHandleFTPServerStop)
 	adminRouter.HandleFunc("/system/storage/ftp/upnp", storageHandleFTPuPnP)
+	adminRouter.HandleFunc("/system/storage/ftp/tls", storageHandleFTPTLS)
 	adminRouter.HandleFunc("/system/storage/ftp/status", storageHandleFTPServerStatus)
 	adminRouter.HandleFunc("/system/storage/ftp/updateGroups", storageHandleFTPAccessUpdate)
 	adminRouter.HandleFunc("/system/storage/ftp/setPort", storageHandleFTPSetPort)
@@ -155,6 +157,29 @@ func storageHandleFTPuPnP(w http.ResponseWriter, r *http.Request) {
 	sendOK(w)
 }
 
+//Update explicit TLS (FTPS) setting on FTP server
+func storageHandleFTPTLS(w http.ResponseWriter, r *http.Request) {
+	enable, _ := mv(r, "enable", false)
+	if enable == "true" {
+		log.Println("Enabling TLS on FTP Server")
+		sysdb.Write("ftp", "tls", true)
+	} else {
+		log.Println("Disabling TLS on FTP Server")
+		sysdb.Write("ftp", "tls", false)
+	}
+
+	//Restart FTP Server if server is running
+	if ftpServer != nil && ftpServer.ServerRunning {
+		err := storageFTPServerStart()
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+	}
+
+	sendOK(w)
+}
+
 //Update access permission on FTP server
 func storageHandleFTPAccessUpdate(w http.ResponseWriter, r *http.Request) {
 	//Get groups paramter from post req
@@ -211,6 +236,7 @@ func storageHandleFTPServerStatus(w http.ResponseWriter, r *http.Request) {
 		FTPUpnpEnabled bool
 		PublicAddr     string
 		PassiveMode    bool
+		TLSEnabled     bool
 		UserGroups     []string
 	}
 
@@ -234,6 +260,11 @@ func storageHandleFTPServerStatus(w http.ResponseWriter, r *http.Request) {
 		sysdb.Read("ftp", "groups", &userGroups)
 	}
 
+	enableTLS := false
+	if sysdb.KeyExists("ftp", "tls") {
+		sysdb.Read("ftp", "tls", &enableTLS)
+	}
+
 	ftpUpnp := false
 	if ftpServer != nil && ftpServer.UPNPEnabled {
 		ftpUpnp = true
@@ -279,6 +310,7 @@ func storageHandleFTPServerStatus(w http.ResponseWriter, r *http.Request) {
 		PublicAddr:     publicAddr,
 		UserGroups:     userGroups,
 		PassiveMode:    forcePassiveMode,
+		TLSEnabled:     enableTLS,
 	})
 	sendJSONResponse(w, string(jsonString))
 }
@@ -306,6 +338,16 @@ func storageFTPServerStart() error {
 	forcePassiveMode := false
 	sysdb.Read("ftp", "passive", &forcePassiveMode)
 
+	//Use the certificates of the HTTPS listener for explicit TLS
+	var tlsConfig *tls.Config
+	enableTLS := false
+	if sysdb.KeyExists("ftp", "tls") {
+		sysdb.Read("ftp", "tls", &enableTLS)
+	}
+	if enableTLS {
+		tlsConfig = certManagerTLSConfig()
+	}
+
 	//Create a new FTP Handler
 	passiveModeIP := ""
 	if *allow_upnp && enableUPnP {
@@ -323,7 +365,7 @@ func storageFTPServerStart() error {
 		passiveModeIP = externalIP
 	}
 
-	h, err := ftp.NewFTPHandler(userHandler, *host_name, serverPort, *tmp_directory, passiveModeIP)
+	h, err := ftp.NewFTPHandler(userHandler, *host_name, serverPort, *tmp_directory, passiveModeIP, tlsConfig, BandwidthController)
 	if err != nil {
 		return err
 	}
@@ -57,6 +57,10 @@ func NetworkServiceInit() {
 	//Start the port forward configuration interface
 	portForwardInit()
 
+	//Start the certificate manager and the reverse proxy gateway
+	certManagerInit()
+	reverseProxyInit()
+
 	//Start userhomepage if enabled
 	//Handle user webroot routings if homepage is enabled
 	if *allow_homepage {
@@ -193,6 +197,12 @@ func StopNetworkServices() {
 		SSDP.Close()
 	}
 
+	//Shutdown DLNA media server if started
+	if DLNAServer != nil {
+		log.Println("\r- Shutting down DLNA media server")
+		DLNAServer.Close()
+	}
+
 	//Shutdown MDNS if enabled
 	if *allow_mdns {
 		log.Println("\r- Shutting down MDNS service")
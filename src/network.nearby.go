@@ -0,0 +1,68 @@
+package main
+
+/*
+	Nearby File Send Entry point
+
+	Send files to the users of other ArozOS hosts in the same LAN
+*/
+
+import (
+	"log"
+	"net/http"
+
+	"imuslab.com/arozos/mod/network/nearby"
+	prout "imuslab.com/arozos/mod/prouter"
+)
+
+var (
+	NearbyShare *nearby.Manager
+)
+
+func NearbyShareInit() {
+	manager, err := nearby.NewManager(nearby.Options{
+		HostName:    *host_name,
+		HostUUID:    deviceUUID,
+		Discoverer:  NeighbourDiscoverer,
+		UserHandler: userHandler,
+		Database:    sysdb,
+		EventBus:    eventBus,
+	})
+	if err != nil {
+		log.Println("[Nearby] Unable to start nearby file send: " + err.Error())
+		return
+	}
+	NearbyShare = manager
+
+	//Public endpoints for the other hosts, only accessible within LAN and rate limited
+	http.HandleFunc("/system/nearby/recipients", NearbyShare.HandleRecipients)
+	http.HandleFunc("/system/nearby/offer", NearbyShare.HandleOffer)
+	http.HandleFunc("/system/nearby/transfer", NearbyShare.HandleTransferStatus)
+	http.HandleFunc("/system/nearby/upload", NearbyShare.HandleUpload)
+	http.HandleFunc("/system/nearby/cancel", NearbyShare.HandleRemoteCancel)
+
+	registerSetting(settingModule{
+		Name:         "Nearby Share",
+		Desc:         "Send files to nearby ArOZ Hosts",
+		IconPath:     "SystemAO/cluster/img/small_icon.png",
+		Group:        "Cluster",
+		StartDir:     "SystemAO/cluster/nearby.html",
+		RequireAdmin: false,
+	})
+
+	router := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "System Setting",
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			sendErrorResponse(w, "Permission Denied")
+		},
+	})
+
+	router.HandleFunc("/system/nearby/settings", NearbyShare.HandleSettings)
+	router.HandleFunc("/system/nearby/incoming", NearbyShare.HandleIncoming)
+	router.HandleFunc("/system/nearby/respond", NearbyShare.HandleRespond)
+	router.HandleFunc("/system/nearby/hosts", NearbyShare.HandleHosts)
+	router.HandleFunc("/system/nearby/hostRecipients", NearbyShare.HandleHostRecipients)
+	router.HandleFunc("/system/nearby/send", NearbyShare.HandleSend)
+	router.HandleFunc("/system/nearby/outgoing", NearbyShare.HandleOutgoing)
+	router.HandleFunc("/system/nearby/userCancel", NearbyShare.HandleCancel)
+}
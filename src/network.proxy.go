@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	uuid "github.com/satori/go.uuid"
+	"imuslab.com/arozos/mod/network/dynamicproxy"
+	prout "imuslab.com/arozos/mod/prouter"
+	"imuslab.com/arozos/mod/subservice/aroz"
+)
+
+/*
+	Network Reverse Proxy Interface
+
+	This is an interface for managing the reverse proxy gateway. The proxy rules
+	are stored in the system database and forward requests by path prefix or
+	hostname to services in the local network. Rules can be restricted to
+	logged in ArozOS users, permission groups or IP ranges.
+*/
+
+var (
+	dynamicProxyRouter *dynamicproxy.Router
+)
+
+const (
+	defaultReverseProxyPort = 8081
+)
+
+type reverseProxySettings struct {
+	Port    int
+	Enabled bool
+	UseTLS  bool
+	Running bool
+}
+
+func reverseProxyInit() {
+	//Create database table if not exists
+	sysdb.NewTable("dynamicproxy")
+
+	settings := reverseProxyLoadSettings()
+	proxyRouter, err := dynamicproxy.NewDynamicProxy(dynamicproxy.RouterOption{
+		Port:             settings.Port,
+		AccessChecker:    reverseProxyCheckAccess,
+		TLSConfig:        certManagerTLSConfig(),
+		ChallengeHandler: certManagerHandleChallenge,
+		StripCookies:     []string{authAgent.SessionName},
+		StripHeaders:     []string{"aouser", "aotoken", aroz.IdentityHeader},
+	})
+	if err != nil {
+		log.Println("Reverse Proxy Initialization Failed: ", err.Error())
+		return
+	}
+	dynamicProxyRouter = proxyRouter
+	dynamicProxyRouter.SetTLS(settings.UseTLS)
+
+	//Load the proxy rules from database
+	err = dynamicProxyRouter.SetRules(reverseProxyLoadRules())
+	if err != nil {
+		log.Println("Unable to load reverse proxy rules: ", err.Error())
+	}
+
+	if settings.Enabled {
+		err = dynamicProxyRouter.StartProxyService()
+		if err != nil {
+			log.Println("Unable to start reverse proxy: ", err.Error())
+		}
+	}
+
+	//Create a setting interface for reverse proxy
+	router := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "System Setting",
+		AdminOnly:   true,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			sendErrorResponse(w, "Permission Denied")
+		},
+	})
+
+	registerSetting(settingModule{
+		Name:         "Reverse Proxy",
+		Desc:         "Reverse proxy gateway to local services",
+		IconPath:     "SystemAO/network/img/ethernet.png",
+		Group:        "Network",
+		StartDir:     "SystemAO/network/proxy.html",
+		RequireAdmin: true,
+	})
+
+	router.HandleFunc("/system/network/proxy/rules", reverseProxy_handleRules)
+	router.HandleFunc("/system/network/proxy/settings", reverseProxy_handleSettings)
+	router.HandleFunc("/system/network/proxy/status", reverseProxy_handleStatus)
+}
+
+//Check the login state of requests that pass through the proxy
+func reverseProxyCheckAccess(r *http.Request) (string, []string, error) {
+	username, err := authAgent.GetUserName(nil, r)
+	if err != nil {
+		return "", []string{}, err
+	}
+
+	userinfo, err := userHandler.GetUserInfoFromUsername(username)
+	if err != nil {
+		return "", []string{}, err
+	}
+
+	groups := []string{}
+	for _, pg := range userinfo.GetUserPermissionGroup() {
+		groups = append(groups, pg.Name)
+	}
+	return username, groups, nil
+}
+
+func reverseProxyLoadSettings() *reverseProxySettings {
+	settings := reverseProxySettings{
+		Port:    defaultReverseProxyPort,
+		Enabled: false,
+	}
+	if sysdb.KeyExists("dynamicproxy", "settings/port") {
+		sysdb.Read("dynamicproxy", "settings/port", &settings.Port)
+	}
+	if sysdb.KeyExists("dynamicproxy", "settings/enabled") {
+		sysdb.Read("dynamicproxy", "settings/enabled", &settings.Enabled)
+	}
+	if sysdb.KeyExists("dynamicproxy", "settings/tls") {
+		sysdb.Read("dynamicproxy", "settings/tls", &settings.UseTLS)
+	}
+	return &settings
+}
+
+func reverseProxyLoadRules() []*dynamicproxy.ProxyRule {
+	rules := []*dynamicproxy.ProxyRule{}
+	entries, _ := sysdb.ListTable("dynamicproxy")
+	for _, keypairs := range entries {
+		if !strings.HasPrefix(string(keypairs[0]), "rule/") {
+			continue
+		}
+
+		thisRule := dynamicproxy.ProxyRule{}
+		err := json.Unmarshal(keypairs[1], &thisRule)
+		if err != nil {
+			log.Println("Unable to load reverse proxy rule " + string(keypairs[0]) + ": " + err.Error())
+			continue
+		}
+		rules = append(rules, &thisRule)
+	}
+	return rules
+}
+
+//Apply the new rule set to the proxy. Rules are only written to database if they are valid
+func reverseProxyApplyRules(rules []*dynamicproxy.ProxyRule) error {
+	if dynamicProxyRouter == nil {
+		return errors.New("Reverse proxy is not initialized")
+	}
+	err := dynamicProxyRouter.SetRules(rules)
+	if err != nil {
+		return err
+	}
+
+	//Obtain certificates for the new hostnames
+	if certManager != nil {
+		certManager.TriggerRenew()
+	}
+	return nil
+}
+
+/*
+	Handle the proxy rules
+
+	GET:
+	(Empty) => List all the rules
+
+	POST:
+	opr=add&rule={ProxyRule JSON}    => Add a new rule
+	opr=edit&rule={ProxyRule JSON}   => Replace the rule with the same ID
+	opr=remove&id={rule ID}          => Remove a rule
+	opr=toggle&id={rule ID}          => Enable or disable a rule
+*/
+func reverseProxy_handleRules(w http.ResponseWriter, r *http.Request) {
+	opr, _ := mv(r, "opr", true)
+	if opr == "" {
+		js, _ := json.Marshal(dynamicProxyRouter.GetRules())
+		sendJSONResponse(w, string(js))
+		return
+	}
+
+	rules := dynamicProxyRouter.GetRules()
+	if opr == "add" || opr == "edit" {
+		ruleJSON, err := mv(r, "rule", true)
+		if err != nil {
+			sendErrorResponse(w, "Invalid rule given")
+			return
+		}
+
+		newRule := dynamicproxy.ProxyRule{}
+		err = json.Unmarshal([]byte(ruleJSON), &newRule)
+		if err != nil {
+			sendErrorResponse(w, "Invalid rule given")
+			return
+		}
+
+		if strings.TrimSpace(newRule.Name) == "" {
+			newRule.Name = newRule.Match
+		}
+
+		if opr == "add" {
+			newRule.ID = uuid.NewV4().String()
+			rules = append(rules, &newRule)
+		} else {
+			replaced := false
+			for i, rule := range rules {
+				if rule.ID == newRule.ID {
+					rules[i] = &newRule
+					replaced = true
+				}
+			}
+
+			if !replaced {
+				sendErrorResponse(w, "Rule not found")
+				return
+			}
+		}
+
+		err = newRule.Validate()
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+
+		err = reverseProxyApplyRules(rules)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+
+		sysdb.Write("dynamicproxy", "rule/"+newRule.ID, newRule)
+		sendOK(w)
+	} else if opr == "remove" || opr == "toggle" {
+		id, err := mv(r, "id", true)
+		if err != nil {
+			sendErrorResponse(w, "Invalid rule id given")
+			return
+		}
+
+		newRules := []*dynamicproxy.ProxyRule{}
+		var targetRule *dynamicproxy.ProxyRule
+		for _, rule := range rules {
+			if rule.ID == id {
+				targetRule = rule
+				if opr == "remove" {
+					continue
+				}
+
+				//Copy the rule so the running routing table is not modified
+				toggledRule := *rule
+				toggledRule.Disabled = !rule.Disabled
+				targetRule = &toggledRule
+				rule = &toggledRule
+			}
+			newRules = append(newRules, rule)
+		}
+
+		if targetRule == nil {
+			sendErrorResponse(w, "Rule not found")
+			return
+		}
+
+		err = reverseProxyApplyRules(newRules)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+
+		if opr == "remove" {
+			sysdb.Delete("dynamicproxy", "rule/"+id)
+		} else {
+			sysdb.Write("dynamicproxy", "rule/"+id, targetRule)
+		}
+		sendOK(w)
+	} else {
+		sendErrorResponse(w, "Unknown operation")
+	}
+}
+
+/*
+	Handle the proxy server settings
+
+	GET:
+	(Empty) => Get the listening port and state of the proxy server
+
+	POST:
+	port={port}&enabled={true/false}&tls={true/false} => Update the settings and restart the proxy server
+*/
+func reverseProxy_handleSettings(w http.ResponseWriter, r *http.Request) {
+	settings := reverseProxyLoadSettings()
+	if r.Method != http.MethodPost {
+		settings.Running = dynamicProxyRouter.Running
+		js, _ := json.Marshal(settings)
+		sendJSONResponse(w, string(js))
+		return
+	}
+
+	port, err := mv(r, "port", true)
+	if err == nil {
+		portNumber, err := strconv.Atoi(port)
+		if err != nil || portNumber < 1 || portNumber > 65535 {
+			sendErrorResponse(w, "Invalid port number")
+			return
+		}
+
+		if portNumber == *listen_port || (*use_tls && portNumber == *tls_listen_port) {
+			sendErrorResponse(w, "Port already in use by ArozOS")
+			return
+		}
+		settings.Port = portNumber
+	}
+
+	enabled, err := mv(r, "enabled", true)
+	if err == nil {
+		settings.Enabled = (enabled == "true")
+	}
+
+	useTLS, err := mv(r, "tls", true)
+	if err == nil {
+		settings.UseTLS = (useTLS == "true")
+	}
+
+	//Restart the proxy server with the new settings
+	if dynamicProxyRouter.Running {
+		err = dynamicProxyRouter.StopProxyService()
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+	}
+
+	dynamicProxyRouter.ListenPort = settings.Port
+	dynamicProxyRouter.SetTLS(settings.UseTLS)
+	if settings.Enabled {
+		err = dynamicProxyRouter.StartProxyService()
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+	}
+
+	sysdb.Write("dynamicproxy", "settings/port", settings.Port)
+	sysdb.Write("dynamicproxy", "settings/enabled", settings.Enabled)
+	sysdb.Write("dynamicproxy", "settings/tls", settings.UseTLS)
+	sendOK(w)
+}
+
+//Get the health state of the upstreams
+func reverseProxy_handleStatus(w http.ResponseWriter, r *http.Request) {
+	js, _ := json.Marshal(dynamicProxyRouter.GetUpstreamStatus())
+	sendJSONResponse(w, string(js))
+}
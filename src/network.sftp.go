@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	prout "imuslab.com/arozos/mod/prouter"
+	ftp "imuslab.com/arozos/mod/storage/ftp"
+)
+
+/*
+	SFTP Server related handlers
+*/
+
+var (
+	sftpServer *ftp.SFTPHandler
+)
+
+//Handle init of the SFTP server endpoints
+func SFTPServerInit() {
+	//Register SFTP Server Setting page
+	registerSetting(settingModule{
+		Name:         "SFTP Server",
+		Desc:         "SSH File Transfer Protocol Server",
+		IconPath:     "SystemAO/disk/smart/img/small_icon.png",
+		Group:        "Network",
+		StartDir:     "SystemAO/disk/sftp.html",
+		RequireAdmin: true,
+	})
+
+	//Register the SSH key setting page for all users
+	registerSetting(settingModule{
+		Name:         "SSH Keys",
+		Desc:         "Manage the SSH public keys for SFTP login",
+		IconPath:     "SystemAO/users/img/small_icon.png",
+		Group:        "Users",
+		StartDir:     "SystemAO/users/sshkeys.html",
+		RequireAdmin: false,
+	})
+
+	//Register SFTP Endpoints
+	adminRouter := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "System Setting",
+		AdminOnly:   true,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			errorHandlePermissionDenied(w, r)
+		},
+	})
+
+	router := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "System Setting",
+		AdminOnly:   false,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			sendErrorResponse(w, "Permission Denied")
+		},
+	})
+
+	//Create database related tables
+	sysdb.NewTable("sftp")
+	defaultEnable := false
+	if sysdb.KeyExists("sftp", "default") {
+		sysdb.Read("sftp", "default", &defaultEnable)
+	} else {
+		sysdb.Write("sftp", "default", false)
+	}
+
+	//Enable this service
+	if defaultEnable {
+		err := storageSFTPServerStart()
+		if err != nil {
+			log.Println("Failed to start SFTP Server: ", err)
+		}
+	}
+
+	adminRouter.HandleFunc("/system/storage/sftp/start", storageHandleSFTPServerStart)
+	adminRouter.HandleFunc("/system/storage/sftp/stop", storageHandleSFTPServerStop)
+	adminRouter.HandleFunc("/system/storage/sftp/upnp", storageHandleSFTPuPnP)
+	adminRouter.HandleFunc("/system/storage/sftp/status", storageHandleSFTPServerStatus)
+	adminRouter.HandleFunc("/system/storage/sftp/updateGroups", storageHandleSFTPAccessUpdate)
+	adminRouter.HandleFunc("/system/storage/sftp/setPort", storageHandleSFTPSetPort)
+	router.HandleFunc("/system/storage/sftp/keys", storageHandleSFTPUserKeys)
+}
+
+//Start the SFTP Server by request
+func storageHandleSFTPServerStart(w http.ResponseWriter, r *http.Request) {
+	err := storageSFTPServerStart()
+	if err != nil {
+		sendErrorResponse(w, err.Error())
+		return
+	}
+
+	//Remember the SFTP server status
+	sysdb.Write("sftp", "default", true)
+	sendOK(w)
+}
+
+//Stop the SFTP server by request
+func storageHandleSFTPServerStop(w http.ResponseWriter, r *http.Request) {
+	if sftpServer != nil {
+		if sftpServer.UPNPEnabled && UPNP != nil {
+			UPNP.ClosePort(sftpServer.Port)
+			sftpServer.UPNPEnabled = false
+		}
+		sftpServer.Close()
+	}
+	sysdb.Write("sftp", "default", false)
+	log.Println("SFTP Server Stopped")
+	sendOK(w)
+}
+
+//Update UPnP setting on SFTP server
+func storageHandleSFTPuPnP(w http.ResponseWriter, r *http.Request) {
+	enable, _ := mv(r, "enable", false)
+	if enable == "true" {
+		log.Println("Enabling UPnP on SFTP Server Port")
+		sysdb.Write("sftp", "upnp", true)
+	} else {
+		log.Println("Disabling UPnP on SFTP Server Port")
+		sysdb.Write("sftp", "upnp", false)
+	}
+
+	//Restart SFTP Server if server is running
+	if sftpServer != nil && sftpServer.ServerRunning {
+		storageSFTPServerStart()
+	}
+
+	sendOK(w)
+}
+
+//Update access permission on SFTP server
+func storageHandleSFTPAccessUpdate(w http.ResponseWriter, r *http.Request) {
+	//Get groups paramter from post req
+	groupString, err := mv(r, "groups", true)
+	if err != nil {
+		sendErrorResponse(w, "groups not defined")
+		return
+	}
+
+	//Prase it
+	groups := []string{}
+	err = json.Unmarshal([]byte(groupString), &groups)
+	if err != nil {
+		sendErrorResponse(w, "Unable to parse groups")
+		return
+	}
+
+	log.Println("Updating SFTP Access group to: ", groups)
+	//Set the accessable group
+	ftp.UpdateSFTPAccessableGroups(sysdb, groups)
+
+	sendOK(w)
+}
+
+func storageHandleSFTPSetPort(w http.ResponseWriter, r *http.Request) {
+	port, err := mv(r, "port", true)
+	if err != nil {
+		sendErrorResponse(w, "Port not defined")
+		return
+	}
+
+	//Try parse the port into int
+	portInt, err := strconv.Atoi(port)
+	if err != nil || portInt <= 0 || portInt > 65535 {
+		sendErrorResponse(w, "Invalid port number")
+		return
+	}
+
+	//Update the database port configuration
+	sysdb.Write("sftp", "port", portInt)
+
+	//Restart the SFTP server if it is running now
+	if sftpServer != nil && sftpServer.ServerRunning {
+		err = storageSFTPServerStart()
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+	}
+
+	sendOK(w)
+}
+
+func storageHandleSFTPServerStatus(w http.ResponseWriter, r *http.Request) {
+	type ServerStatus struct {
+		Enabled         bool
+		Port            int
+		AllowUPNP       bool
+		UPNPEnabled     bool
+		SFTPUpnpEnabled bool
+		PublicAddr      string
+		UserGroups      []string
+	}
+
+	enabled := false
+	if sftpServer != nil && sftpServer.ServerRunning {
+		enabled = true
+	}
+
+	serverPort := 2022
+	if sysdb.KeyExists("sftp", "port") {
+		sysdb.Read("sftp", "port", &serverPort)
+	}
+
+	enableUPnP := false
+	if sysdb.KeyExists("sftp", "upnp") {
+		sysdb.Read("sftp", "upnp", &enableUPnP)
+	}
+
+	userGroups := []string{}
+	if sysdb.KeyExists("sftp", "groups") {
+		sysdb.Read("sftp", "groups", &userGroups)
+	}
+
+	sftpUpnp := false
+	if sftpServer != nil && sftpServer.UPNPEnabled {
+		sftpUpnp = true
+	}
+
+	publicAddr := ""
+	if UPNP != nil && UPNP.ExternalIP != "" && sftpUpnp {
+		publicAddr = UPNP.ExternalIP
+	}
+
+	jsonString, _ := json.Marshal(ServerStatus{
+		Enabled:         enabled,
+		Port:            serverPort,
+		AllowUPNP:       *allow_upnp,
+		UPNPEnabled:     enableUPnP,
+		SFTPUpnpEnabled: sftpUpnp,
+		PublicAddr:      publicAddr,
+		UserGroups:      userGroups,
+	})
+	sendJSONResponse(w, string(jsonString))
+}
+
+/*
+	Handle the SSH public keys of the current user
+
+	GET: List the registered keys
+	POST keys=["ssh-ed25519 AAAA... comment"]: Replace the registered keys
+*/
+func storageHandleSFTPUserKeys(w http.ResponseWriter, r *http.Request) {
+	username, err := authAgent.GetUserName(w, r)
+	if err != nil {
+		sendErrorResponse(w, "User not logged in")
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		keyString, err := mv(r, "keys", true)
+		if err != nil {
+			sendErrorResponse(w, "keys not defined")
+			return
+		}
+
+		keys := []string{}
+		err = json.Unmarshal([]byte(keyString), &keys)
+		if err != nil {
+			sendErrorResponse(w, "Unable to parse keys")
+			return
+		}
+
+		err = ftp.SetUserSSHKeys(sysdb, username, keys)
+		if err != nil {
+			sendErrorResponse(w, err.Error())
+			return
+		}
+
+		sendOK(w)
+		return
+	}
+
+	js, _ := json.Marshal(ftp.GetUserSSHKeys(sysdb, username))
+	sendJSONResponse(w, string(js))
+}
+
+func storageSFTPServerStart() error {
+	if sftpServer != nil {
+		//If the previous sftp server is not closed, close it and open a new one
+		if sftpServer.UPNPEnabled && UPNP != nil {
+			UPNP.ClosePort(sftpServer.Port)
+		}
+		sftpServer.Close()
+	}
+
+	//Load new server config from database
+	serverPort := int(2022)
+	if sysdb.KeyExists("sftp", "port") {
+		sysdb.Read("sftp", "port", &serverPort)
+	}
+
+	enableUPnP := false
+	if sysdb.KeyExists("sftp", "upnp") {
+		sysdb.Read("sftp", "upnp", &enableUPnP)
+	}
+
+	//Create a new SFTP Handler
+	h, err := ftp.NewSFTPHandler(userHandler, serverPort, *tmp_directory, "./system/sftp/host.key", BandwidthController)
+	if err != nil {
+		return err
+	}
+	err = h.Start()
+	if err != nil {
+		return err
+	}
+	sftpServer = h
+
+	if *allow_upnp && enableUPnP {
+		if UPNP == nil {
+			return errors.New("UPnP did not started correctly on this host. Ignore this option")
+		}
+
+		//Forward the port
+		err := UPNP.ForwardPort(sftpServer.Port, *host_name+" SFTP Server")
+		if err != nil {
+			log.Println("Failed to start SFTP Server UPnP: ", err)
+			sftpServer.UPNPEnabled = false
+			return err
+		}
+		sftpServer.UPNPEnabled = true
+	}
+
+	return nil
+}
@@ -23,7 +23,7 @@ func WebDAVInit() {
 	sysdb.NewTable("webdav")
 
 	//Create a new webdav server
-	newserver := awebdav.NewServer(*host_name, "/webdav", *tmp_directory, *use_tls, userHandler)
+	newserver := awebdav.NewServer(*host_name, "/webdav", *tmp_directory, *use_tls, userHandler, BandwidthController)
 	WebDavHandler = newserver
 
 	//Check the webdav default state
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+
+	fs "imuslab.com/arozos/mod/filesystem"
+	"imuslab.com/arozos/mod/photo"
+	prout "imuslab.com/arozos/mod/prouter"
+)
+
+/*
+	Photo Library
+
+	This script register the photo library APIs used by the Photo module.
+	Image EXIF information are indexed into the fsdb of each storage
+	(see mod/photo/photo.go) and refreshed nightly
+*/
+
+var (
+	photoManager *photo.Manager
+)
+
+func PhotoIndexInit() {
+	photoManager = photo.NewPhotoManager(photo.Options{
+		UserHandler:   userHandler,
+		Database:      sysdb,
+		RenderHandler: thumbRenderHandler,
+	})
+
+	router := prout.NewModuleRouter(prout.RouterOption{
+		ModuleName:  "Photo",
+		AdminOnly:   false,
+		UserHandler: userHandler,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			sendErrorResponse(w, "Permission Denied")
+		},
+	})
+
+	router.HandleFunc("/system/photo/index", photoManager.HandleIndex)
+	router.HandleFunc("/system/photo/timeline", photoManager.HandleTimeline)
+	router.HandleFunc("/system/photo/map", photoManager.HandleMap)
+	router.HandleFunc("/system/photo/albums", photoManager.HandleAlbums)
+	router.HandleFunc("/system/photo/duplicates", photoManager.HandleDuplicates)
+	router.HandleFunc("/system/photo/bursts", photoManager.HandleBursts)
+	router.HandleFunc("/system/photo/thumbnail", photoManager.HandleThumbnail)
+	router.HandleFunc("/system/photo/info", photoManager.HandleInfo)
+
+	//Refresh the photo index of all storages every night
+	nightlyManager.RegisterNightlyTask(photo_indexAllStorages)
+}
+
+//Index the photos in all storage pools
+func photo_indexAllStorages() {
+	fshs := []*fs.FileSystemHandler{}
+	for _, pool := range GetAllStoragePools() {
+		fshs = append(fshs, pool.Storages...)
+	}
+	photoManager.IndexInBackground(fshs)
+}
@@ -29,6 +29,9 @@ func RunStartup() {
 	}
 	sysdb = dbconn
 
+	//Start the system event bus
+	EventBusInit() //See event.go
+
 	//2. Initiate the auth Agent
 	AuthInit() //See auth.go
 
@@ -45,6 +48,7 @@ func RunStartup() {
 	OAuthInit()             //Oauth system init
 	GroupStoragePoolInit()  //Register permission groups's storage pool, require permissionInit()
 	BridgeStoragePoolInit() //Register the bridged storage pool based on mounted storage pools
+	BandwidthInit()         //Bandwidth limits, must start before the file serving services
 
 	//6. Start Modules and Package Manager
 	ModuleServiceInit() //Module Handler
@@ -53,6 +57,8 @@ func RunStartup() {
 	//7. Kickstart the File System and Desktop
 	SchedulerInit()  //Start System Scheudler
 	FileSystemInit() //Start FileSystem
+	FileTagsInit()   //Start File Tags and Smart Collections, require FileSystemInit()
+	PhotoIndexInit() //Start Photo Library Indexer, require FileSystemInit()
 	DesktopInit()    //Start Desktop
 
 	//StorageDaemonInit() //Start File System handler daemon (for backup and other sync process)
@@ -89,10 +95,14 @@ func RunStartup() {
 	backup_init()
 
 	//Start High Level Services that requires full arozos architectures
-	FTPServerInit() //Start FTP Server Endpoints
-	WebDAVInit()    //Start WebDAV Endpoint
-	ClusterInit()   //Start Cluster Services
-	IoTHubInit()    //Inialize ArozOS IoT Hub module
+	FTPServerInit()   //Start FTP Server Endpoints
+	SFTPServerInit()  //Start SFTP Server Endpoints
+	WebDAVInit()      //Start WebDAV Endpoint
+	DAVServerInit()   //Start CalDAV and CardDAV Endpoints
+	DLNAServerInit()  //Start DLNA Media Server
+	ClusterInit()     //Start Cluster Services
+	NearbyShareInit() //Start Nearby File Send
+	IoTHubInit()      //Inialize ArozOS IoT Hub module
 
 	ModuleInstallerInit() //Start Module Installer
 
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"imuslab.com/arozos/mod/database"
+	"imuslab.com/arozos/mod/event"
 	"imuslab.com/arozos/mod/permission"
 	"imuslab.com/arozos/mod/storage/bridge"
 
@@ -256,10 +257,20 @@ func HandleFSHToggle(w http.ResponseWriter, r *http.Request) {
 
 		targetFSH.FilesystemDatabase = conn
 		targetFSH.Closed = false
+		eventBus.Publish(event.StorageAttached, "", map[string]interface{}{
+			"uuid":  targetFSH.UUID,
+			"name":  targetFSH.Name,
+			"group": group,
+		})
 	} else {
 		//Close the fsh database and set this to true
 		targetFSH.FilesystemDatabase.Close()
 		targetFSH.Closed = true
+		eventBus.Publish(event.StorageDetached, "", map[string]interface{}{
+			"uuid":  targetFSH.UUID,
+			"name":  targetFSH.Name,
+			"group": group,
+		})
 	}
 
 	//Give it some time to finish unloading
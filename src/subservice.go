@@ -7,6 +7,7 @@ import (
 
 	prout "imuslab.com/arozos/mod/prouter"
 	subservice "imuslab.com/arozos/mod/subservice"
+	aroz "imuslab.com/arozos/mod/subservice/aroz"
 )
 
 /*
@@ -58,6 +59,13 @@ func SubserviceInit() {
 	adminRouter.HandleFunc("/system/subservice/list", ssRouter.HandleListing)
 	adminRouter.HandleFunc("/system/subservice/kill", ssRouter.HandleKillSubService)
 	adminRouter.HandleFunc("/system/subservice/start", ssRouter.HandleStartSubService)
+	adminRouter.HandleFunc("/system/subservice/restart", ssRouter.HandleRestartSubService)
+	adminRouter.HandleFunc("/system/subservice/logs", ssRouter.HandleServiceLogs)
+	adminRouter.HandleFunc("/system/subservice/config", ssRouter.HandleServiceConfig)
+
+	//Register the local endpoints for subservices to verify identity assertions and access files
+	http.HandleFunc(aroz.JWKSPath, ssRouter.HandleJWKS)
+	http.HandleFunc(aroz.FileAPIPath, ssRouter.HandleFileAPI)
 
 	//Make subservice dir
 	os.MkdirAll("./subservice", 0644)
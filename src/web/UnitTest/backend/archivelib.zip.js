@@ -0,0 +1,13 @@
+/*
+    archivelib.zip Zip a file and list the content of the created archive
+*/
+
+requirelib("archivelib");
+var succ = archivelib.zip(["user:/Desktop/test.jpeg"], "user:/Desktop/test.zip", function(filename, current, total, progress){
+    console.log("Zipping " + filename + " (" + current + "/" + total + ") " + progress + "%");
+});
+if (!succ){
+    sendJSONResp(JSON.stringify({error: "Zip failed"}));
+}else{
+    sendJSONResp(JSON.stringify(archivelib.list("user:/Desktop/test.zip")));
+}
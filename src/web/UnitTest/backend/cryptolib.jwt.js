@@ -0,0 +1,14 @@
+/*
+    cryptolib.jwt Sign and verify a JSON Web Token
+*/
+
+requirelib("cryptolib");
+var secret = cryptolib.randomBytes(32);
+var token = cryptolib.jwtSign({username: "test"}, secret, 60);
+var encrypted = cryptolib.encrypt("Hello World", secret);
+sendJSONResp(JSON.stringify({
+    "token": token,
+    "payload": cryptolib.jwtVerify(token, secret),
+    "invalid": cryptolib.jwtVerify(token, "wrong secret"),
+    "decrypted": cryptolib.decrypt(encrypted, secret)
+}));
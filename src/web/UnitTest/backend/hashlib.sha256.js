@@ -0,0 +1,6 @@
+requirelib("hashlib");
+sendJSONResp(JSON.stringify({
+    "string": hashlib.sha256("Hello World"),
+    "file": hashlib.hashFile("crc32", "user:/Desktop/test.jpeg")
+}));
+//will return hash in hex or false
@@ -0,0 +1,18 @@
+requirelib("kvlib");
+kvlib.set("unittest:a", {value: 1});
+kvlib.set("unittest:b", "Hello World");
+var swapped = kvlib.cas("unittest:counter", null, 1);
+var rejected = kvlib.cas("unittest:counter", null, 2);
+kvlib.user.set("unittest:theme", "dark");
+sendJSONResp(JSON.stringify({
+    "get": kvlib.get("unittest:a"),
+    "list": kvlib.list("unittest:"),
+    "cas": [swapped, rejected],
+    "user": kvlib.user.get("unittest:theme"),
+    "usage": kvlib.usage()
+}));
+kvlib.delete("unittest:a");
+kvlib.delete("unittest:b");
+kvlib.delete("unittest:counter");
+kvlib.user.delete("unittest:theme");
+//kvlib is only available to scripts inside module folders
@@ -0,0 +1,22 @@
+//This script will list the albums in your music library and queue the first album
+console.log("Music Library Test");
+var loaded = requirelib("musiclib");
+if (loaded) {
+    var albums = musiclib.getAlbums();
+    var queue = false;
+    if (albums.length > 0){
+        var tracks = [];
+        for (var i = 0; i < albums[0].Tracks.length; i++){
+            tracks.push(albums[0].Tracks[i].Filepath);
+        }
+        queue = musiclib.setQueue(tracks, 0);
+    }
+
+    sendJSONResp(JSON.stringify({
+        folders: musiclib.getFolders(),
+        albums: albums,
+        queue: queue
+    }));
+} else {
+    console.log("Failed to load lib: musiclib");
+}
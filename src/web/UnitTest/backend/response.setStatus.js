@@ -0,0 +1,12 @@
+/*
+    response.setStatus Set the HTTP status code, headers and cookies of the response
+*/
+
+console.log("Request method: " + request.method);
+response.setStatus(201);
+response.setHeader("X-Unit-Test", "arozos");
+response.setCookie("unittest", "hello", {maxAge: 60, httpOnly: true});
+sendJSONResp(JSON.stringify({
+    "query": request.query,
+    "form": request.form
+}));
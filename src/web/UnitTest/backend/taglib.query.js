@@ -0,0 +1,19 @@
+//This script will tag a file on your desktop and search it with taglib.query
+console.log("File Tag Test");
+requirelib("filelib");
+var loaded = requirelib("taglib");
+if (loaded) {
+    filelib.writeFile("user:/Desktop/invoice.txt", "Hello World! This is a tagged file");
+    taglib.setTags("user:/Desktop/invoice.txt", ["invoice", "2021"]);
+    taglib.setFavourite("user:/Desktop/invoice.txt", true);
+
+    //Search for the file using tag, type and modification time
+    var results = taglib.query({tags: ["invoice"], type: "txt", days: 30});
+    sendJSONResp(JSON.stringify({
+        tags: taglib.getTags("user:/Desktop/invoice.txt"),
+        favourite: taglib.isFavourite("user:/Desktop/invoice.txt"),
+        results: results
+    }));
+} else {
+    console.log("Failed to load lib: taglib");
+}